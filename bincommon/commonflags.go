@@ -66,7 +66,7 @@ var (
 	http10Flag          = flag.Bool("http1.0", false, "Use http1.0 (instead of http 1.1)")
 	httpsInsecureFlag   = flag.Bool("k", false, "Do not verify certs in https connections")
 	httpsInsecureFlagL  = flag.Bool("https-insecure", false, "Long form of the -k flag")
-	resolve             = flag.String("resolve", "", "Resolve CN of cert to this IP, so that we can call https://cn directly")
+	resolve             = flag.String("resolve", "", "Connect to this IP instead of the url's host, or curl style `host:port:addr`")
 	headersFlags        headersFlagList
 	httpOpts            fhttp.HTTPOptions
 	followRedirectsFlag = flag.Bool("L", false, "Follow redirects (implies -std-client) - do not use for load test")
@@ -97,7 +97,73 @@ var (
 		"`Path` to a custom CA certificate file to be used for the TLS client connections, "+
 			"if empty, use https:// prefix for standard internet/system CAs")
 	// LogErrorsFlag determines if the non ok http error codes get logged as they occur or not.
-	LogErrorsFlag = flag.Bool("log-errors", true, "Log http non 2xx/418 error codes as they occur")
+	LogErrorsFlag    = flag.Bool("log-errors", true, "Log http non 2xx/418 error codes as they occur")
+	traceHeadersFlag = flag.String("trace-headers", "",
+		"Generate trace context headers on each request: \""+fhttp.TraceW3C+"\" (traceparent) or \""+fhttp.TraceB3+
+			"\" (x-b3-*), empty for none")
+	tracePerConnectionFlag = flag.Bool("trace-per-connection", false,
+		"With -trace-headers, keep the same trace id (new span id per request) for all the requests on a connection")
+	discardBodyFlag = flag.Bool("discard-body", false,
+		"Read and count the response bodies without keeping them (less memory and cpu for large responses)")
+	readLimitFlag = flag.Int("read-limit", 0,
+		"Keep at most this many bytes of each response body, the rest is read and counted but discarded (0 for no limit)")
+	affinityHeaderFlag = flag.String("affinity-header", "",
+		"Header `name` to send an affinity key (\"user\" id) in, each key always going on the same connection")
+	affinityKeysFlag = flag.Int("affinity-keys", 1000,
+		"Number of distinct affinity keys, from 0 to n-1, with -affinity-header (at least as many as connections)")
+	sniFlag = flag.String("sni", "",
+		"TLS server `name` to present instead of the url's host (std client), e.g. when connecting through -resolve")
+	userAgentFileFlag = flag.String("user-agent-file", "",
+		"File `path` with one User-Agent per line to rotate through, one per request (instead of fortio's)")
+	captureHeaderFlag = flag.String("capture-header", "",
+		"Response header `name` (e.g. X-Served-By, X-Cache) whose values distribution is reported, "+
+			"for the first 100 distinct values (the others are counted as \"(other)\")")
+	headerSetsFileFlag = flag.String("header-sets-file", "",
+		"File `path` with header sets (\"Key: Value\" lines, sets separated by empty lines) to rotate through, one per request")
+	replayFileFlag = flag.String("replay-file", "",
+		"File `path` of requests recorded by fortio server -record-file to replay in turn, one per call, on the target url")
+	sendDeadlineFlag = flag.Bool("send-deadline", false,
+		"Send each request's deadline (its start plus -timeout) in the "+fhttp.DeadlineHeader+" header, honored by the echo server")
+	serverTimingFlag = flag.Bool("server-timing", false,
+		"Ask the echo server for its received and first write timestamps and report the server vs network time split of the calls")
+	acceptEncodingFlag = flag.String("accept-encoding", "",
+		"Accept-Encoding `header` to send, e.g. \"gzip, deflate\", the responses being kept compressed unless -decompress")
+	decompressFlag = flag.Bool("decompress", false,
+		"Decode the gzip and deflate responses, reporting their wire and decoded bytes (asks for \""+
+			fhttp.DecodableEncodings+"\" unless -accept-encoding is set, which then can't list other encodings like br)")
+	methodMixFlag = flag.String("method-mix", "",
+		"Comma separated METHOD:weight[:payload] `mix` of the requests' methods, payload being @file, a size or the payload "+
+			"itself, e.g. \"GET:90,POST:10:@order.json\" (std client), reporting each method's codes and latency")
+	longPollFlag = flag.Duration("long-poll", 0,
+		"Long poll (hanging GET) mode: the target holds the requests open up to this `duration`, the requests' "+
+			"deadline instead of -timeout; the ones still held then are counted as held, not as timeouts, "+
+			"and the hold and reconnect durations are reported (default 0: off)")
+	latencyBreakdownFlag = flag.Bool("latency-breakdown", false,
+		"Time the DNS, connect, TLS, time to first byte and body phases of each request and report their histograms")
+	h2cFlag = flag.Bool("h2c", false,
+		"Use HTTP/2 cleartext with prior knowledge (no upgrade) in the fast client, to load test h2c backends")
+	connMaxLifetimeFlag = flag.Duration("conn-max-lifetime", 0,
+		"Close each keep-alive connection, for a new one to be made, once it's that old (default 0: no limit)")
+	connMaxRequestsFlag = flag.Int("conn-max-requests", 0,
+		"Close each keep-alive connection, for a new one to be made, after that many requests (default 0: no limit)")
+	connectRateFlag = flag.String("connect-rate", "",
+		"Limit how fast new connections are opened, across all the -c connections, to that `rate` (N/s or N/m), "+
+			"independently of the request -qps, e.g. to ramp up gently on SYN rate sensitive devices or TLS terminators")
+	connReuseRangeFlag = flag.String("connection-reuse-range", "",
+		"Close each keep-alive connection after a random number of requests in `min:max` (instead of -conn-max-requests), "+
+			"to measure the impact of connection churn, e.g. on sidecars")
+	slowWriteIntervalFlag = flag.Duration("slow-write-interval", 0,
+		"Slow client simulation: write each request -slow-write-bytes at a time with this interval in between (fast client), "+
+			"to check in a controlled test how the target handles slow clients (default 0: normal writes)")
+	slowWriteBytesFlag = flag.Int("slow-write-bytes", 1, "Number of request bytes written every -slow-write-interval")
+	proxyFlag          = flag.String("proxy", "",
+		"Forward proxy to send the http requests through, `socks5://host:port` or http://host:port (CONNECT tunnel), "+
+			"with optional user:password@ credentials")
+	tlsResumptionFlag = flag.Bool("tls-resumption", false,
+		"Resume the TLS sessions on new connections (https), instead of a full handshake for each")
+	tlsSessionTicketsFlag = flag.Bool("tls-session-tickets", true,
+		"Use TLS session tickets to resume sessions on new connections (https, with -tls-resumption), false for "+
+			"no tickets asked from the server")
 	// RunIDFlag is optional RunID to be present in json results (and default json result filename if not 0).
 	RunIDFlag = flag.Int64("runid", 0, "Optional RunID to add to json result and auto save filename, to match server mode")
 )
@@ -171,6 +237,7 @@ func SharedHTTPOptions() *fhttp.HTTPOptions {
 	httpOpts.HTTPReqTimeOut = *httpReqTimeoutFlag
 	httpOpts.Insecure = TLSInsecure()
 	httpOpts.Resolve = *resolve
+	httpOpts.SNI = *sniFlag
 	httpOpts.UserCredentials = *userCredentialsFlag
 	httpOpts.ContentType = *contentTypeFlag
 	httpOpts.Payload = fnet.GeneratePayload(*PayloadFileFlag, *PayloadSizeFlag, *PayloadFlag)
@@ -183,5 +250,67 @@ func SharedHTTPOptions() *fhttp.HTTPOptions {
 	httpOpts.Cert = *CertFlag
 	httpOpts.Key = *KeyFlag
 	httpOpts.LogErrors = *LogErrorsFlag
+	httpOpts.TraceHeaders = strings.TrimSpace(*traceHeadersFlag)
+	httpOpts.TracePerConnection = *tracePerConnectionFlag
+	httpOpts.DiscardBody = *discardBodyFlag
+	httpOpts.ReadLimit = *readLimitFlag
+	httpOpts.AffinityHeader = *affinityHeaderFlag
+	httpOpts.AffinityKeys = *affinityKeysFlag
+	httpOpts.CaptureHeader = *captureHeaderFlag
+	httpOpts.SendDeadline = *sendDeadlineFlag
+	httpOpts.ServerTiming = *serverTimingFlag
+	httpOpts.LatencyBreakdown = *latencyBreakdownFlag
+	httpOpts.LongPoll = *longPollFlag
+	httpOpts.AcceptEncoding = *acceptEncodingFlag
+	httpOpts.Decompress = *decompressFlag
+	httpOpts.H2C = *h2cFlag
+	httpOpts.ConnMaxLifetime = *connMaxLifetimeFlag
+	httpOpts.ConnMaxRequests = *connMaxRequestsFlag
+	httpOpts.SlowWriteInterval = *slowWriteIntervalFlag
+	httpOpts.SlowWriteBytes = *slowWriteBytesFlag
+	httpOpts.TLSResumption = *tlsResumptionFlag
+	httpOpts.DisableTLSSessionTickets = !*tlsSessionTicketsFlag
+	httpOpts.Proxy = *proxyFlag
+	if httpOpts.Proxy != "" {
+		if _, err := fhttp.ParseProxy(httpOpts.Proxy); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	if *connectRateFlag != "" {
+		r, err := fhttp.ParseConnectRate(*connectRateFlag)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		httpOpts.ConnectRate = r
+	}
+	if *connReuseRangeFlag != "" {
+		r, err := fhttp.ParseConnReuseRange(*connReuseRangeFlag)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		httpOpts.ConnReuseRange = r
+	}
+	if *headerSetsFileFlag != "" && *userAgentFileFlag != "" {
+		log.Fatalf("Only one of -header-sets-file and -user-agent-file can be set")
+	}
+	var err error
+	if *headerSetsFileFlag != "" {
+		httpOpts.HeaderSets, err = fhttp.ReadHeaderSets(*headerSetsFileFlag, false)
+	} else if *userAgentFileFlag != "" {
+		httpOpts.HeaderSets, err = fhttp.ReadHeaderSets(*userAgentFileFlag, true)
+	}
+	if err != nil {
+		log.Fatalf("Unable to read header sets: %v", err)
+	}
+	if *methodMixFlag != "" {
+		if httpOpts.MethodMix, err = fhttp.ParseMethodMix(*methodMixFlag, true); err != nil {
+			log.Fatalf("Invalid -method-mix: %v", err)
+		}
+	}
+	if *replayFileFlag != "" {
+		if httpOpts.Replay, err = fhttp.ReadRecordedRequests(*replayFileFlag); err != nil {
+			log.Fatalf("Unable to read recorded requests: %v", err)
+		}
+	}
 	return &httpOpts
 }
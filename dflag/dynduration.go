@@ -74,3 +74,13 @@ func (d *DynDurationValue) WithNotifier(notifier func(oldValue time.Duration, ne
 func (d *DynDurationValue) String() string {
 	return fmt.Sprintf("%v", d.Get())
 }
+
+// ValidateDynDurationRange returns a validator that checks if the duration value is in range.
+func ValidateDynDurationRange(fromInclusive time.Duration, toInclusive time.Duration) func(time.Duration) error {
+	return func(value time.Duration) error {
+		if value > toInclusive || value < fromInclusive {
+			return fmt.Errorf("value %v not in [%v, %v] range", value, fromInclusive, toInclusive)
+		}
+		return nil
+	}
+}
@@ -43,6 +43,17 @@ func TestDynDuration_FiresValidators(t *testing.T) {
 	assert.Error(t, set.Set("some_duration_1", "2h"), "error from validator when value out of range")
 }
 
+func TestDynDuration_RangeValidator(t *testing.T) {
+	set := flag.NewFlagSet("foobar", flag.ContinueOnError)
+	dynFlag := DynDuration(set, "some_duration_1", 5*time.Second, "Use it or lose it").
+		WithValidator(ValidateDynDurationRange(0, 1*time.Hour))
+
+	assert.NoError(t, set.Set("some_duration_1", "1h"), "no error from validator when in range")
+	assert.Error(t, set.Set("some_duration_1", "-1s"), "error from validator when value below range")
+	assert.Error(t, set.Set("some_duration_1", "61m"), "error from validator when value above range")
+	assert.Equal(t, 1*time.Hour, dynFlag.Get(), "rejected values must not change the value")
+}
+
 func TestDynDuration_FiresNotifier(t *testing.T) {
 	waitCh := make(chan bool, 1)
 	notifier := func(oldVal time.Duration, newVal time.Duration) {
@@ -21,9 +21,10 @@ func DynInt64(flagSet *flag.FlagSet, name string, value int64, usage string) *Dy
 // DynInt64Value is a flag-related `int64` value wrapper.
 type DynInt64Value struct {
 	DynamicFlagValueTag
-	ptr       *int64
-	validator func(int64) error
-	notifier  func(oldValue int64, newValue int64)
+	ptr          *int64
+	validator    func(int64) error
+	notifier     func(oldValue int64, newValue int64)
+	syncNotifier bool
 }
 
 // Get retrieves the value in a thread-safe manner.
@@ -50,7 +51,11 @@ func (d *DynInt64Value) Set(input string) error {
 	}
 	oldVal := atomic.SwapInt64(d.ptr, val)
 	if d.notifier != nil {
-		go d.notifier(oldVal, val)
+		if d.syncNotifier {
+			d.notifier(oldVal, val)
+		} else {
+			go d.notifier(oldVal, val)
+		}
 	}
 	return nil
 }
@@ -70,6 +75,13 @@ func (d *DynInt64Value) WithNotifier(notifier func(oldValue int64, newValue int6
 	return d
 }
 
+// WithSyncNotifier adds a function is called synchronously every time a new value is successfully set.
+func (d *DynInt64Value) WithSyncNotifier(notifier func(oldValue int64, newValue int64)) *DynInt64Value {
+	d.notifier = notifier
+	d.syncNotifier = true
+	return d
+}
+
 // String returns the canonical string representation of the type.
 func (d *DynInt64Value) String() string {
 	return fmt.Sprintf("%v", d.Get())
@@ -52,6 +52,18 @@ func TestDynInt64_FiresNotifier(t *testing.T) {
 	}
 }
 
+func TestDynInt64_FiresSyncNotifier(t *testing.T) {
+	var got int64
+	set := flag.NewFlagSet("foobar", flag.ContinueOnError)
+	DynInt64(set, "some_int_1", 13371337, "Use it or lose it").
+		WithValidator(ValidateDynInt64Range(0, 2000)).
+		WithSyncNotifier(func(oldVal int64, newVal int64) { got = newVal })
+	assert.NoError(t, set.Set("some_int_1", "42"))
+	assert.EqualValues(t, 42, got, "sync notifier must have been called before Set returns")
+	assert.Error(t, set.Set("some_int_1", "-1"), "error from validator when value out of range")
+	assert.EqualValues(t, 42, got, "notifier must not be called for rejected values")
+}
+
 func Benchmark_Int64_Dyn_Get(b *testing.B) {
 	set := flag.NewFlagSet("foobar", flag.ContinueOnError)
 	value := DynInt64(set, "some_int_1", 13371337, "Use it or lose it")
@@ -18,6 +18,7 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"runtime"
@@ -27,10 +28,13 @@ import (
 
 	"fortio.org/fortio/fnet"
 	"fortio.org/fortio/log"
+	"fortio.org/fortio/otlp"
 	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/stats"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 // Dial dials grpc using insecure or tls transport security when serverAddr
@@ -82,20 +86,75 @@ type GRPCRunnerResults struct {
 	Destination string
 	Streams     int
 	Ping        bool
+	// Messages sent and received on a ping stream for each call (0 when not streaming).
+	StreamMessages int
+	// Round trip latency of each message of the ping streams, nil when none.
+	MessageLatency *stats.HistogramData
+	msgLatency     *stats.Histogram
+	// Unary method called instead of health check or ping, empty if none.
+	Method string
+	method *methodCaller
+	// Health watch mode: number of watch streams opened (one per call, kept open until the thread's
+	// next call or the end of the run) and count of the status updates received on them after the
+	// first status.
+	HealthWatch  bool
+	WatchStreams int64
+	WatchUpdates HealthResultMap
+	watch        *watchState
+	// Spans of the sampled calls, when exporting to an OTLP endpoint.
+	exporter *otlp.Exporter
+	rpcName  string
+	// Result code of the last call, for the timeseries.
+	lastCode string
+}
+
+// ErrorRate returns the fraction of the calls which failed, i.e. not SERVING (health) nor OK (see periodic.HasErrorRate).
+func (grpcstate *GRPCRunnerResults) ErrorRate() float64 {
+	return periodic.ErrorRate(grpcstate.RetCodes, "SERVING", "OK")
+}
+
+// LastCallFailed returns true when the last call wasn't SERVING nor OK (see periodic.CallErrorer).
+func (grpcstate *GRPCRunnerResults) LastCallFailed() bool {
+	return grpcstate.lastCode != "SERVING" && grpcstate.lastCode != "OK"
 }
 
 // Run exercises GRPC health check or ping at the target QPS.
 // To be set as the Function in RunnerOptions.
 func (grpcstate *GRPCRunnerResults) Run(t int) {
 	log.Debugf("Calling in %d", t)
+	ctx := context.Background()
+	if grpcstate.watch != nil {
+		ctx = grpcstate.watch.ctx
+	}
+	ctx, span := grpcstate.newCallSpan(ctx, t)
+	if grpcstate.method != nil {
+		code, err := grpcstate.method.call(ctx)
+		if err != nil {
+			log.Warnf("Error making grpc %s call: %v", grpcstate.Method, err)
+		}
+		grpcstate.RetCodes[code]++
+		grpcstate.lastCode = code
+		grpcstate.endCallSpan(span, err, "")
+		return
+	}
 	var err error
 	var res interface{}
 	status := grpc_health_v1.HealthCheckResponse_SERVING
-	if grpcstate.Ping {
-		res, err = grpcstate.clientP.Ping(context.Background(), &grpcstate.reqP)
-	} else {
+	switch {
+	case grpcstate.StreamMessages > 0:
+		err = grpcstate.pingStream(ctx)
+	case grpcstate.Ping:
+		res, err = grpcstate.clientP.Ping(ctx, &grpcstate.reqP)
+	case grpcstate.watch != nil:
+		var r *grpc_health_v1.HealthCheckResponse
+		r, err = grpcstate.watch.open(ctx, grpcstate.clientH, &grpcstate.reqH)
+		if r != nil {
+			status = r.Status
+			res = r
+		}
+	default:
 		var r *grpc_health_v1.HealthCheckResponse
-		r, err = grpcstate.clientH.Check(context.Background(), &grpcstate.reqH)
+		r, err = grpcstate.clientH.Check(ctx, &grpcstate.reqH)
 		if r != nil {
 			status = r.Status
 			res = r
@@ -105,9 +164,64 @@ func (grpcstate *GRPCRunnerResults) Run(t int) {
 	if err != nil {
 		log.Warnf("Error making grpc call: %v", err)
 		grpcstate.RetCodes[Error]++
+		grpcstate.lastCode = Error
+		grpcstate.endCallSpan(span, err, Error)
 	} else {
 		grpcstate.RetCodes[status.String()]++
+		grpcstate.lastCode = status.String()
+		grpcstate.endCallSpan(span, nil, status.String())
+	}
+}
+
+// Warmup makes a warmup call, not counted in the results (see periodic.Warmer).
+// In watch mode it's a unary health Check, so no stream is opened or replaced.
+func (grpcstate *GRPCRunnerResults) Warmup(t int) {
+	ctx := context.Background()
+	var err error
+	switch {
+	case grpcstate.method != nil:
+		_, err = grpcstate.method.call(ctx)
+	case grpcstate.StreamMessages > 0:
+		msgLatency := grpcstate.msgLatency
+		grpcstate.msgLatency = nil
+		err = grpcstate.pingStream(ctx)
+		grpcstate.msgLatency = msgLatency
+	case grpcstate.Ping:
+		_, err = grpcstate.clientP.Ping(ctx, &grpcstate.reqP)
+	default:
+		_, err = grpcstate.clientH.Check(ctx, &grpcstate.reqH)
+	}
+	log.Debugf("Warmup call in %d: %v", t, err)
+}
+
+// pingStream sends and receives StreamMessages ping messages, one at a time,
+// on a new stream and records the round trip latency of each.
+func (grpcstate *GRPCRunnerResults) pingStream(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // also releases the stream on errors
+	stream, err := grpcstate.clientP.PingStream(ctx)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < grpcstate.StreamMessages; i++ {
+		start := time.Now()
+		if err = stream.Send(&grpcstate.reqP); err != nil {
+			return err
+		}
+		if _, err = stream.Recv(); err != nil {
+			return err
+		}
+		if grpcstate.msgLatency != nil {
+			grpcstate.msgLatency.Record(time.Since(start).Seconds())
+		}
+	}
+	if err = stream.CloseSend(); err != nil {
+		return err
+	}
+	if _, err = stream.Recv(); err != io.EOF {
+		return fmt.Errorf("expected end of ping stream, got %v", err)
 	}
+	return nil
 }
 
 // GRPCRunnerOptions includes the base RunnerOptions plus grpc specific
@@ -117,7 +231,7 @@ type GRPCRunnerOptions struct {
 	Destination        string
 	Service            string        // Service to be checked when using grpc health check
 	Profiler           string        // file to save profiles to. defaults to no profiling
-	Payload            string        // Payload to be sent for grpc ping service
+	Payload            string        // Payload to be sent for grpc ping service, or json request for Method
 	Streams            int           // number of streams. total go routines and data streams will be streams*numthreads.
 	Delay              time.Duration // Delay to be sent when using grpc ping service
 	CACert             string        // Path to CA certificate for grpc TLS
@@ -126,6 +240,23 @@ type GRPCRunnerOptions struct {
 	AllowInitialErrors bool          // whether initial errors don't cause an abort
 	UsePing            bool          // use our own Ping proto for grpc load instead of standard health check one.
 	UnixDomainSocket   string        // unix domain socket path to use for physical connection instead of Destination
+	StreamMessages     int           // > 0 for ping streams of that many messages per call instead of unary pings (implies UsePing)
+	// Any unary method to call, "package.Service/Method", instead of health check or ping. With its
+	// json request in Payload, in which {uuid} is replaced by a new uuid for each call.
+	Method string
+	// FileDescriptorSet file (protoc --include_imports -o) describing Method, the server reflection is
+	// used when empty.
+	Protoset string
+	// HealthWatch uses the health Watch streaming rpc instead of Check: the latency is the time to the
+	// first status and each call's stream is kept open until the thread's next call (so at most one
+	// stream per thread is open) or the end of the run, counting the status updates, e.g. to measure
+	// the health propagation of a service mesh.
+	HealthWatch bool
+	// OTLP/HTTP endpoint to send spans of sampled calls to (empty for no export), the calls
+	// then carry the W3C traceparent metadata of their span.
+	OTLPEndpoint string
+	// Fraction of the calls to export as spans when OTLPEndpoint is set. (0 is the same as 1: all)
+	OTLPSampleRate float64
 }
 
 // RunGRPCTest runs an http test and returns the aggregated stats.
@@ -138,12 +269,23 @@ func RunGRPCTest(o *GRPCRunnerOptions) (*GRPCRunnerResults, error) {
 		// sort of todo, this redoing some of periodic normalize (but we can't use normalize which does too much)
 		o.NumThreads = periodic.DefaultRunnerOptions.NumThreads
 	}
-	if o.UsePing {
+	if o.StreamMessages > 0 && o.Method == "" {
+		o.UsePing = true
+	}
+	switch {
+	case o.Method != "":
+		o.RunType = "GRPC Method " + o.Method
+	case o.UsePing:
 		o.RunType = "GRPC Ping"
+		if o.StreamMessages > 0 {
+			o.RunType += fmt.Sprintf(" Stream Messages=%d", o.StreamMessages)
+		}
 		if o.Delay > 0 {
 			o.RunType += fmt.Sprintf(" Delay=%v", o.Delay)
 		}
-	} else {
+	case o.HealthWatch:
+		o.RunType = "GRPC Health Watch"
+	default:
 		o.RunType = "GRPC Health"
 	}
 	pll := len(o.Payload)
@@ -160,11 +302,29 @@ func RunGRPCTest(o *GRPCRunnerOptions) (*GRPCRunnerResults, error) {
 		Destination: o.Destination,
 		Streams:     o.Streams,
 		Ping:        o.UsePing,
+		Method:      o.Method,
+	}
+	total.StreamMessages = o.StreamMessages
+	var watchCtx context.Context
+	var watchCancel context.CancelFunc
+	if o.HealthWatch && !o.UsePing && o.Method == "" {
+		total.HealthWatch = true
+		total.WatchUpdates = make(HealthResultMap)
+		watchCtx, watchCancel = context.WithCancel(context.Background())
+		defer watchCancel()
+	}
+	if o.StreamMessages > 0 {
+		total.msgLatency = r.Options().NewLatencyHistogram()
+	}
+	if o.OTLPEndpoint != "" {
+		total.exporter = otlp.NewExporter(o.OTLPEndpoint, "fortio", o.OTLPSampleRate)
+		total.rpcName = rpcName(o)
 	}
 	grpcstate := make([]GRPCRunnerResults, numThreads)
 	out := r.Options().Out // Important as the default value is set from nil to stdout inside NewPeriodicRunner
 	var conn *grpc.ClientConn
 	var err error
+	var md protoreflect.MethodDescriptor
 	ts := time.Now().UnixNano()
 	for i := 0; i < numThreads; i++ {
 		r.Options().Runners[i] = &grpcstate[i]
@@ -178,23 +338,43 @@ func RunGRPCTest(o *GRPCRunnerOptions) (*GRPCRunnerResults, error) {
 			log.Debugf("Reusing previous client connection for %d", i)
 		}
 		grpcstate[i].Ping = o.UsePing
+		grpcstate[i].StreamMessages = o.StreamMessages
+		grpcstate[i].Method = o.Method
 		var err error
-		if o.UsePing { // nolint: nestif
+		switch {
+		case o.Method != "":
+			if md == nil {
+				if md, err = findMethod(conn, o.Method, o.Protoset); err != nil {
+					log.Errf("Unable to find grpc method %s: %v", o.Method, err)
+					return nil, err
+				}
+			}
+			if grpcstate[i].method, err = newMethodCaller(conn, md, o.Payload); err != nil {
+				return nil, err
+			}
+			if o.Exactly <= 0 && !o.HasWarmup() {
+				_, err = grpcstate[i].method.call(context.Background())
+			}
+		case o.UsePing:
 			grpcstate[i].clientP = NewPingServerClient(conn)
 			if grpcstate[i].clientP == nil {
 				return nil, fmt.Errorf("unable to create ping client %d for %s", i, o.Destination)
 			}
 			grpcstate[i].reqP = PingMessage{Payload: o.Payload, DelayNanos: o.Delay.Nanoseconds(), Seq: int64(i), Ts: ts}
-			if o.Exactly <= 0 {
-				_, err = grpcstate[i].clientP.Ping(context.Background(), &grpcstate[i].reqP)
+			if o.Exactly <= 0 && !o.HasWarmup() {
+				if o.StreamMessages > 0 {
+					err = grpcstate[i].pingStream(context.Background()) // before the latency histogram is set: not recorded
+				} else {
+					_, err = grpcstate[i].clientP.Ping(context.Background(), &grpcstate[i].reqP)
+				}
 			}
-		} else {
+		default:
 			grpcstate[i].clientH = grpc_health_v1.NewHealthClient(conn)
 			if grpcstate[i].clientH == nil {
 				return nil, fmt.Errorf("unable to create health client %d for %s", i, o.Destination)
 			}
 			grpcstate[i].reqH = grpc_health_v1.HealthCheckRequest{Service: o.Service}
-			if o.Exactly <= 0 {
+			if o.Exactly <= 0 && !o.HasWarmup() {
 				_, err = grpcstate[i].clientH.Check(context.Background(), &grpcstate[i].reqH)
 			}
 		}
@@ -204,6 +384,16 @@ func RunGRPCTest(o *GRPCRunnerOptions) (*GRPCRunnerResults, error) {
 		}
 		// Setup the stats for each 'thread'
 		grpcstate[i].RetCodes = make(HealthResultMap)
+		if total.msgLatency != nil {
+			grpcstate[i].msgLatency = total.msgLatency.Clone()
+		}
+		if total.HealthWatch {
+			grpcstate[i].HealthWatch = true
+			grpcstate[i].watch = newWatchState(watchCtx)
+		}
+		grpcstate[i].Destination = o.Destination
+		grpcstate[i].exporter = total.exporter
+		grpcstate[i].rpcName = total.rpcName
 	}
 
 	if o.Profiler != "" {
@@ -217,6 +407,9 @@ func RunGRPCTest(o *GRPCRunnerOptions) (*GRPCRunnerResults, error) {
 		}
 	}
 	total.RunnerResults = r.Run()
+	if watchCancel != nil {
+		watchCancel() // closes the watch streams
+	}
 	if o.Profiler != "" {
 		pprof.StopCPUProfile()
 		fm, err := os.Create(o.Profiler + ".mem")
@@ -242,6 +435,12 @@ func RunGRPCTest(o *GRPCRunnerOptions) (*GRPCRunnerResults, error) {
 			}
 			total.RetCodes[k] += grpcstate[i].RetCodes[k]
 		}
+		if total.msgLatency != nil {
+			total.msgLatency.Transfer(grpcstate[i].msgLatency)
+		}
+		if grpcstate[i].watch != nil {
+			grpcstate[i].watch.close(&total)
+		}
 		// TODO: if grpc client needs 'cleanup'/Close like http one, do it on original NumThreads
 	}
 	// Cleanup state:
@@ -250,10 +449,24 @@ func RunGRPCTest(o *GRPCRunnerOptions) (*GRPCRunnerResults, error) {
 	if o.UsePing {
 		which = "Ping"
 	}
+	if o.Method != "" {
+		which = o.Method
+	}
 	_, _ = fmt.Fprintf(out, "Jitter: %t\n", total.Jitter)
 	for _, k := range keys {
 		_, _ = fmt.Fprintf(out, "%s %s : %d\n", which, k, total.RetCodes[k])
 	}
+	if total.msgLatency != nil && total.msgLatency.Count > 0 {
+		total.msgLatency.Print(out, "Stream message latency", o.Percentiles)
+		total.MessageLatency = total.msgLatency.Export().CalcPercentiles(o.Percentiles)
+	}
+	if total.HealthWatch {
+		printWatch(out, total.WatchStreams, total.WatchUpdates)
+	}
+	if total.exporter != nil {
+		exported, dropped := total.exporter.Close()
+		_, _ = fmt.Fprintf(out, "Spans exported: %d (dropped %d)\n", exported, dropped)
+	}
 	return &total, nil
 }
 
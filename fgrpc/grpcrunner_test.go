@@ -16,14 +16,24 @@
 package fgrpc
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
 	"fortio.org/fortio/fnet"
 	"fortio.org/fortio/log"
 	"fortio.org/fortio/periodic"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 )
 
 var (
@@ -214,6 +224,143 @@ func TestGRPCRunnerMaxStreams(t *testing.T) {
 	}
 }
 
+func TestGRPCRunnerStream(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port := PingServerTCP("0", "", "", "stream", 0)
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:         50,
+			Exactly:     20,
+			NumThreads:  2,
+			WarmupCalls: 4, // not counted in the results nor messages latency
+		},
+		Destination:    fmt.Sprintf("localhost:%d", port),
+		Payload:        "test",
+		Delay:          2 * time.Millisecond,
+		StreamMessages: 5,
+	}
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING.String()]
+	if ok != 20 || !res.Ping || res.WarmupHistogram == nil || res.WarmupHistogram.Count != 4 {
+		t.Errorf("Unexpected stream results %v (ping %v)", res.RetCodes, res.Ping)
+	}
+	if res.MessageLatency == nil || res.MessageLatency.Count != 100 {
+		t.Fatalf("Expected 100 stream messages latency, got %+v", res.MessageLatency)
+	}
+	if res.MessageLatency.Avg < opts.Delay.Seconds() || res.DurationHistogram.Avg < 5*opts.Delay.Seconds() {
+		t.Errorf("Ping delay not applied to each message: %v %v", res.MessageLatency.Avg, res.DurationHistogram.Avg)
+	}
+}
+
+func TestGRPCRunnerHealthWatch(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	socket, addr := fnet.Listen("grpc health watch test", "0")
+	grpcServer := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("watch", grpc_health_v1.HealthCheckResponse_SERVING)
+	grpc_health_v1.RegisterHealthServer(grpcServer, healthServer)
+	go func() { _ = grpcServer.Serve(socket) }()
+	defer grpcServer.Stop()
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:        4,
+			Exactly:    4,
+			NumThreads: 2,
+		},
+		Destination: fmt.Sprintf("localhost:%d", addr.(*net.TCPAddr).Port),
+		Service:     "watch",
+		HealthWatch: true,
+	}
+	// Between the 2 calls of each thread, their already open streams get the new status:
+	go func() {
+		time.Sleep(250 * time.Millisecond)
+		healthServer.SetServingStatus("watch", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	}()
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serving := res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING.String()]
+	notServing := res.RetCodes[grpc_health_v1.HealthCheckResponse_NOT_SERVING.String()]
+	if !res.HealthWatch || res.WatchStreams != 4 || serving != 2 || notServing != 2 {
+		t.Errorf("Unexpected watch results %v, %d streams", res.RetCodes, res.WatchStreams)
+	}
+	// Only the (one per thread) streams open at the time get the update:
+	if updates := res.WatchUpdates[grpc_health_v1.HealthCheckResponse_NOT_SERVING.String()]; updates != 2 {
+		t.Errorf("Expected 2 NOT_SERVING updates, got %v", res.WatchUpdates)
+	}
+}
+
+func TestGRPCRunnerSpans(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	var mu sync.Mutex
+	var spans []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []struct {
+						TraceID string `json:"traceId"`
+						SpanID  string `json:"spanId"`
+						Name    string `json:"name"`
+					} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		_ = json.Unmarshal(data, &req)
+		mu.Lock()
+		for _, s := range req.ResourceSpans[0].ScopeSpans[0].Spans {
+			spans = append(spans, s.Name+" 00-"+s.TraceID+"-"+s.SpanID+"-01")
+		}
+		mu.Unlock()
+	}))
+	defer collector.Close()
+	socket, addr := fnet.Listen("grpc spans test", "0")
+	var traceParents []string
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{},
+		info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		mu.Lock()
+		traceParents = append(traceParents, md.Get("traceparent")...)
+		mu.Unlock()
+		return handler(ctx, req)
+	}))
+	grpc_health_v1.RegisterHealthServer(grpcServer, health.NewServer())
+	go func() { _ = grpcServer.Serve(socket) }()
+	defer grpcServer.Stop()
+	opts := GRPCRunnerOptions{
+		RunnerOptions: periodic.RunnerOptions{
+			QPS:        100,
+			Exactly:    5,
+			NumThreads: 1,
+		},
+		Destination:    fmt.Sprintf("localhost:%d", addr.(*net.TCPAddr).Port),
+		OTLPEndpoint:   collector.URL,
+		OTLPSampleRate: 1,
+	}
+	res, err := RunGRPCTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[grpc_health_v1.HealthCheckResponse_SERVING.String()] != 5 {
+		t.Errorf("unexpected results %v", res.RetCodes)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(spans) != 5 || len(traceParents) != 5 {
+		t.Fatalf("expected 5 spans and traceparents, got %v and %v", spans, traceParents)
+	}
+	for i, s := range spans {
+		if s != "grpc.health.v1.Health/Check "+traceParents[i] {
+			t.Errorf("span %q doesn't match the call's traceparent %q", s, traceParents[i])
+		}
+	}
+}
+
 func TestGRPCRunnerWithError(t *testing.T) {
 	log.SetLogLevel(log.Info)
 	iPort := PingServerTCP("0", "", "", "bar", 0)
@@ -0,0 +1,228 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fgrpc // import "fortio.org/fortio/fgrpc"
+
+// Calls of any unary method, described by a protoset file or the server
+// reflection, with a json request.
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"fortio.org/fortio/log"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	// Replaced by a new uuid for each call in the json request.
+	uuidToken = "{uuid}"
+	// Timeout of the server reflection requests.
+	reflectionTimeout = 10 * time.Second
+)
+
+// methodCaller calls a unary method. Not thread safe, each thread has its own.
+type methodCaller struct {
+	conn     *grpc.ClientConn
+	path     string // "/package.Service/Method"
+	req      *dynamicpb.Message
+	resp     *dynamicpb.Message
+	template string // json request to set again for each call when it has uuidToken(s), empty otherwise
+}
+
+// splitMethod returns the service and method names of "package.Service/Method"
+// (or "package.Service.Method").
+func splitMethod(method string) (protoreflect.FullName, protoreflect.Name, error) {
+	method = strings.TrimPrefix(method, "/")
+	i := strings.LastIndexAny(method, "/.")
+	if i <= 0 || i == len(method)-1 {
+		return "", "", fmt.Errorf("invalid grpc method %q, expecting package.Service/Method", method)
+	}
+	service, name := protoreflect.FullName(method[:i]), protoreflect.Name(method[i+1:])
+	if !service.IsValid() || !name.IsValid() {
+		return "", "", fmt.Errorf("invalid grpc method %q, expecting package.Service/Method", method)
+	}
+	return service, name, nil
+}
+
+// findMethod returns the descriptor of the unary method, from the protoset
+// file (FileDescriptorSet, as generated by protoc --include_imports -o) or,
+// when empty, from the server reflection on conn.
+func findMethod(conn *grpc.ClientConn, method, protoset string) (protoreflect.MethodDescriptor, error) {
+	service, name, err := splitMethod(method)
+	if err != nil {
+		return nil, err
+	}
+	var set *descriptorpb.FileDescriptorSet
+	if protoset != "" {
+		set, err = readProtoset(protoset)
+	} else {
+		set, err = reflectFiles(conn, service)
+	}
+	if err != nil {
+		return nil, err
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, err
+	}
+	d, err := files.FindDescriptorByName(service)
+	if err != nil {
+		return nil, fmt.Errorf("service %s not found: %w", service, err)
+	}
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a service", service)
+	}
+	md := sd.Methods().ByName(name)
+	if md == nil {
+		return nil, fmt.Errorf("method %s not found in service %s", name, service)
+	}
+	if md.IsStreamingClient() || md.IsStreamingServer() {
+		return nil, fmt.Errorf("method %s is a streaming one, only unary methods can be called", md.FullName())
+	}
+	return md, nil
+}
+
+func readProtoset(protoset string) (*descriptorpb.FileDescriptorSet, error) {
+	data, err := ioutil.ReadFile(protoset)
+	if err != nil {
+		return nil, err
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	if err = proto.Unmarshal(data, set); err != nil {
+		return nil, fmt.Errorf("invalid protoset %s: %w", protoset, err)
+	}
+	return set, nil
+}
+
+// reflectFiles returns the file defining service, and all its dependencies,
+// from the server reflection. Dependencies the server doesn't provide are
+// looked up in the ones linked in fortio (e.g. the well known types).
+func reflectFiles(conn *grpc.ClientConn, service protoreflect.FullName) (*descriptorpb.FileDescriptorSet, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), reflectionTimeout)
+	defer cancel()
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.CloseSend() // nolint: errcheck
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := make(map[string]bool)
+	fetch := func(req *rpb.ServerReflectionRequest) error {
+		if err := stream.Send(req); err != nil {
+			return err
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if e := resp.GetErrorResponse(); e != nil {
+			return fmt.Errorf("server reflection error %d: %s", e.ErrorCode, e.ErrorMessage)
+		}
+		for _, b := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			fd := &descriptorpb.FileDescriptorProto{}
+			if err := proto.Unmarshal(b, fd); err != nil {
+				return err
+			}
+			if !seen[fd.GetName()] {
+				seen[fd.GetName()] = true
+				set.File = append(set.File, fd)
+			}
+		}
+		return nil
+	}
+	err = fetch(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: string(service)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get %s from the server reflection: %w", service, err)
+	}
+	for i := 0; i < len(set.File); i++ { // set.File grows with the dependencies
+		for _, dep := range set.File[i].Dependency {
+			if seen[dep] {
+				continue
+			}
+			err = fetch(&rpb.ServerReflectionRequest{
+				MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: dep},
+			})
+			if seen[dep] {
+				continue
+			}
+			fd, lerr := protoregistry.GlobalFiles.FindFileByPath(dep)
+			if lerr != nil {
+				return nil, fmt.Errorf("unable to get dependency %s from the server reflection: %v", dep, err)
+			}
+			log.LogVf("Using the built in %s for the server reflection's missing dependency (%v)", dep, err)
+			seen[dep] = true
+			set.File = append(set.File, protodesc.ToFileDescriptorProto(fd))
+		}
+	}
+	return set, nil
+}
+
+// newMethodCaller returns a caller of md on conn with the json request, in
+// which {uuid} is replaced by a new uuid for each call.
+func newMethodCaller(conn *grpc.ClientConn, md protoreflect.MethodDescriptor, request string) (*methodCaller, error) {
+	c := methodCaller{
+		conn: conn,
+		path: fmt.Sprintf("/%s/%s", md.Parent().FullName(), md.Name()),
+		req:  dynamicpb.NewMessage(md.Input()),
+		resp: dynamicpb.NewMessage(md.Output()),
+	}
+	if strings.TrimSpace(request) == "" {
+		request = "{}"
+	}
+	if strings.Contains(request, uuidToken) {
+		c.template = request
+	}
+	if err := c.setRequest(request); err != nil {
+		return nil, fmt.Errorf("invalid json request for %s: %w", md.FullName(), err)
+	}
+	return &c, nil
+}
+
+func (c *methodCaller) setRequest(request string) error {
+	if c.template != "" {
+		request = strings.ReplaceAll(c.template, uuidToken, uuid.New().String())
+	}
+	return protojson.Unmarshal([]byte(request), c.req)
+}
+
+// call makes the call and returns the status code string (e.g. "OK").
+func (c *methodCaller) call(ctx context.Context) (string, error) {
+	if c.template != "" {
+		if err := c.setRequest(""); err != nil {
+			return "InvalidRequest", err
+		}
+	}
+	err := c.conn.Invoke(ctx, c.path, c.req, c.resp)
+	if log.LogDebug() && err == nil {
+		log.Debugf("%s response: %v", c.path, c.resp)
+	}
+	return status.Code(err).String(), err
+}
@@ -0,0 +1,110 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fgrpc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/periodic"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestSplitMethod(t *testing.T) {
+	tests := []struct {
+		method, service, name string
+	}{
+		{"fgrpc.PingServer/Ping", "fgrpc.PingServer", "Ping"},
+		{"/fgrpc.PingServer/Ping", "fgrpc.PingServer", "Ping"},
+		{"grpc.health.v1.Health.Check", "grpc.health.v1.Health", "Check"},
+		{"Ping", "", ""},
+		{"fgrpc.PingServer/", "", ""},
+		{"fgrpc.Ping-Server/Ping", "", ""},
+	}
+	for _, tst := range tests {
+		service, name, err := splitMethod(tst.method)
+		if string(service) != tst.service || string(name) != tst.name || (err == nil) != (tst.service != "") {
+			t.Errorf("splitMethod(%q) = %q %q %v, expected %q %q", tst.method, service, name, err, tst.service, tst.name)
+		}
+	}
+}
+
+func TestGRPCRunnerMethod(t *testing.T) {
+	log.SetLogLevel(log.Info)
+	port := PingServerTCP("0", "", "", "method", 0)
+	dest := fmt.Sprintf("localhost:%d", port)
+	// Protoset of the health service, for the method calls without reflection:
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{
+		protodesc.ToFileDescriptorProto(grpc_health_v1.File_grpc_health_v1_health_proto),
+	}}
+	data, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	protoset := filepath.Join(t.TempDir(), "health.protoset")
+	if err = ioutil.WriteFile(protoset, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method   string
+		protoset string
+		request  string
+		err      string // expected error substring, empty for success
+	}{
+		{"fgrpc.PingServer/Ping", "", `{"payload": "{uuid}", "delayNanos": "1000"}`, ""},
+		{"grpc.health.v1.Health/Check", "", "", ""},
+		{"grpc.health.v1.Health/Check", protoset, `{"service": "method"}`, ""},
+		{"fgrpc.PingServer/PingStream", "", "", "only unary methods"},
+		{"fgrpc.PingServer/Nope", "", "", "method Nope not found"},
+		{"fgrpc.NoSuchService/Ping", "", "", "server reflection"},
+		{"fgrpc.PingServer/Ping", protoset, "", "service fgrpc.PingServer not found"},
+		{"fgrpc.PingServer/Ping", "", `{"nope": 1}`, "invalid json request"},
+		{"fgrpc.PingServer/Ping", "/no/such/file", "", "no such file"},
+	}
+	for _, tst := range tests {
+		opts := GRPCRunnerOptions{
+			RunnerOptions: periodic.RunnerOptions{
+				QPS:        50,
+				Exactly:    10,
+				NumThreads: 2,
+			},
+			Destination: dest,
+			Method:      tst.method,
+			Protoset:    tst.protoset,
+			Payload:     tst.request,
+		}
+		res, err := RunGRPCTest(&opts)
+		if tst.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tst.err) {
+				t.Errorf("%s %q: expected error %q, got %v", tst.method, tst.protoset, tst.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %q: unexpected error %v", tst.method, tst.protoset, err)
+			continue
+		}
+		if res.RetCodes["OK"] != 10 || res.Method != tst.method || !strings.HasPrefix(res.RunType, "GRPC Method "+tst.method) {
+			t.Errorf("%s %q: unexpected results %v %q", tst.method, tst.protoset, res.RetCodes, res.RunType)
+		}
+	}
+}
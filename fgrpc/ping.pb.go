@@ -95,6 +95,7 @@ const _ = grpc.SupportPackageIsVersion4
 
 type PingServerClient interface {
 	Ping(ctx context.Context, in *PingMessage, opts ...grpc.CallOption) (*PingMessage, error)
+	PingStream(ctx context.Context, opts ...grpc.CallOption) (PingServer_PingStreamClient, error)
 }
 
 type pingServerClient struct {
@@ -114,10 +115,42 @@ func (c *pingServerClient) Ping(ctx context.Context, in *PingMessage, opts ...gr
 	return out, nil
 }
 
+func (c *pingServerClient) PingStream(ctx context.Context, opts ...grpc.CallOption) (PingServer_PingStreamClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_PingServer_serviceDesc.Streams[0], c.cc, "/fgrpc.PingServer/PingStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &pingServerPingStreamClient{stream}
+	return x, nil
+}
+
+type PingServer_PingStreamClient interface {
+	Send(*PingMessage) error
+	Recv() (*PingMessage, error)
+	grpc.ClientStream
+}
+
+type pingServerPingStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *pingServerPingStreamClient) Send(m *PingMessage) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *pingServerPingStreamClient) Recv() (*PingMessage, error) {
+	m := new(PingMessage)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // Server API for PingServer service
 
 type PingServerServer interface {
 	Ping(context.Context, *PingMessage) (*PingMessage, error)
+	PingStream(PingServer_PingStreamServer) error
 }
 
 func RegisterPingServerServer(s *grpc.Server, srv PingServerServer) {
@@ -142,6 +175,32 @@ func _PingServer_Ping_Handler(srv interface{}, ctx context.Context, dec func(int
 	return interceptor(ctx, in, info, handler)
 }
 
+func _PingServer_PingStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(PingServerServer).PingStream(&pingServerPingStreamServer{stream})
+}
+
+type PingServer_PingStreamServer interface {
+	Send(*PingMessage) error
+	Recv() (*PingMessage, error)
+	grpc.ServerStream
+}
+
+type pingServerPingStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *pingServerPingStreamServer) Send(m *PingMessage) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *pingServerPingStreamServer) Recv() (*PingMessage, error) {
+	m := new(PingMessage)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 var _PingServer_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "fgrpc.PingServer",
 	HandlerType: (*PingServerServer)(nil),
@@ -151,14 +210,21 @@ var _PingServer_serviceDesc = grpc.ServiceDesc{
 			Handler:    _PingServer_Ping_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "PingStream",
+			Handler:       _PingServer_PingStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
 	Metadata: "ping.proto",
 }
 
 func init() { proto.RegisterFile("ping.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 163 bytes of a gzipped FileDescriptorProto
+	// 176 bytes of a gzipped FileDescriptorProto
 	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x2a, 0xc8, 0xcc, 0x4b,
 	0xd7, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x4d, 0x4b, 0x2f, 0x2a, 0x48, 0x56, 0xca, 0xe4,
 	0xe2, 0x0e, 0xc8, 0xcc, 0x4b, 0xf7, 0x4d, 0x2d, 0x2e, 0x4e, 0x4c, 0x4f, 0x15, 0x12, 0xe0, 0x62,
@@ -166,8 +232,8 @@ var fileDescriptor0 = []byte{
 	0x4a, 0x8a, 0x25, 0x98, 0xc0, 0x02, 0x4c, 0x25, 0xc5, 0x42, 0x12, 0x5c, 0xec, 0x05, 0x89, 0x95,
 	0x39, 0xf9, 0x89, 0x29, 0x12, 0xcc, 0x0a, 0x8c, 0x1a, 0x9c, 0x41, 0x30, 0xae, 0x90, 0x1c, 0x17,
 	0x57, 0x4a, 0x6a, 0x4e, 0x62, 0xa5, 0x5f, 0x62, 0x5e, 0x7e, 0xb1, 0x04, 0x0b, 0x58, 0x07, 0x92,
-	0x88, 0x91, 0x1d, 0x17, 0x17, 0xc8, 0xaa, 0xe0, 0xd4, 0xa2, 0xb2, 0xd4, 0x22, 0x21, 0x03, 0x2e,
+	0x88, 0x51, 0x15, 0x17, 0x17, 0xc8, 0xaa, 0xe0, 0xd4, 0xa2, 0xb2, 0xd4, 0x22, 0x21, 0x03, 0x2e,
 	0x16, 0x10, 0x4f, 0x48, 0x48, 0x0f, 0xec, 0x10, 0x3d, 0x24, 0x57, 0x48, 0x61, 0x11, 0x53, 0x62,
-	0x48, 0x62, 0x03, 0x3b, 0xdc, 0x18, 0x10, 0x00, 0x00, 0xff, 0xff, 0x54, 0x22, 0xa0, 0xfe, 0xc6,
-	0x00, 0x00, 0x00,
+	0x10, 0xb2, 0x82, 0xea, 0x2f, 0x29, 0x4a, 0x4d, 0xcc, 0x25, 0x5e, 0x9f, 0x06, 0xa3, 0x01, 0x63,
+	0x12, 0x1b, 0xd8, 0xd3, 0xc6, 0x80, 0x01, 0x00, 0xd9, 0xc9, 0x0f, 0x4d, 0x02, 0x01, 0x00, 0x00,
 }
@@ -17,6 +17,7 @@ package fgrpc
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"time"
@@ -53,6 +54,24 @@ func (s *pingSrv) Ping(c context.Context, in *PingMessage) (*PingMessage, error)
 	return &out, nil
 }
 
+// PingStream echoes each message of the stream, like Ping, until the client
+// closes its side of it.
+func (s *pingSrv) PingStream(stream PingServer_PingStreamServer) error {
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		out, _ := s.Ping(stream.Context(), in)
+		if err = stream.Send(out); err != nil {
+			return err
+		}
+	}
+}
+
 // PingServer starts a grpc ping (and health) echo server.
 // returns the port being bound (useful when passing "0" as the port to
 // get a dynamic server). Pass the healthServiceName to use for the
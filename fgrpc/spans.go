@@ -0,0 +1,70 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fgrpc // import "fortio.org/fortio/fgrpc"
+
+import (
+	"context"
+	"strings"
+
+	"fortio.org/fortio/otlp"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// rpcName returns the "package.Service/Method" of the run's calls.
+func rpcName(o *GRPCRunnerOptions) string {
+	switch {
+	case o.Method != "":
+		return strings.TrimPrefix(o.Method, "/")
+	case o.StreamMessages > 0:
+		return "fgrpc.PingServer/PingStream"
+	case o.UsePing:
+		return "fgrpc.PingServer/Ping"
+	case o.HealthWatch:
+		return "grpc.health.v1.Health/Watch"
+	}
+	return "grpc.health.v1.Health/Check"
+}
+
+// newCallSpan starts the span of the call when sampled, and returns ctx with
+// its traceparent metadata so the server side spans are part of the same trace.
+// The span is nil when not sampled.
+func (grpcstate *GRPCRunnerResults) newCallSpan(ctx context.Context, t int) (context.Context, *otlp.Span) {
+	if grpcstate.exporter == nil || !grpcstate.exporter.Sample() {
+		return ctx, nil
+	}
+	s := grpcstate.exporter.NewSpan(grpcstate.rpcName)
+	s.Attributes["rpc.system"] = "grpc"
+	if i := strings.LastIndex(grpcstate.rpcName, "/"); i > 0 {
+		s.Attributes["rpc.service"] = grpcstate.rpcName[:i]
+		s.Attributes["rpc.method"] = grpcstate.rpcName[i+1:]
+	}
+	s.Attributes["net.peer.name"] = grpcstate.Destination
+	s.Attributes["fortio.thread"] = t
+	return metadata.AppendToOutgoingContext(ctx, "traceparent", s.TraceParent()), s
+}
+
+// endCallSpan completes and exports the span, if any, with the call's result.
+func (grpcstate *GRPCRunnerResults) endCallSpan(s *otlp.Span, err error, result string) {
+	if s == nil {
+		return
+	}
+	s.Attributes["rpc.grpc.status_code"] = int(status.Code(err))
+	if result != "" {
+		s.Attributes["fortio.result"] = result
+	}
+	s.Error = err != nil
+	grpcstate.exporter.Export(s)
+}
@@ -0,0 +1,105 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fgrpc // import "fortio.org/fortio/fgrpc"
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"fortio.org/fortio/log"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// watchState is the per thread state of the health watch mode: each call
+// opens a Watch stream, its latency being the time to the first status, and
+// the stream is kept open, counting the status updates, until the thread's next
+// call replaces it or the end of the run. So at most one stream per thread (-c)
+// is open at a time.
+type watchState struct {
+	ctx     context.Context    // canceled at the end of the run, closing the streams
+	cancel  context.CancelFunc // of the thread's current stream, nil when none
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	streams int64
+	updates HealthResultMap // statuses received after the first one
+}
+
+func newWatchState(ctx context.Context) *watchState {
+	return &watchState{ctx: ctx, updates: make(HealthResultMap)}
+}
+
+// open closes the thread's previous watch stream, if any, opens a new one, with
+// ctx derived from the state's one, and returns its first status.
+func (w *watchState) open(ctx context.Context, client grpc_health_v1.HealthClient,
+	req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	if w.cancel != nil {
+		w.cancel()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	w.cancel = cancel
+	stream, err := client.Watch(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	res, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	w.streams++
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		for {
+			r, err := stream.Recv()
+			if err != nil {
+				if err != io.EOF && ctx.Err() == nil {
+					log.Warnf("Error on grpc health watch stream: %v", err)
+				}
+				return
+			}
+			log.Debugf("Health watch update %v", r.Status)
+			w.mu.Lock()
+			w.updates[r.Status.String()]++
+			w.mu.Unlock()
+		}
+	}()
+	return res, nil
+}
+
+// close waits for the streams, which must have been canceled, to be done and
+// adds the stream count and updates to total's.
+func (w *watchState) close(total *GRPCRunnerResults) {
+	w.wg.Wait()
+	total.WatchStreams += w.streams
+	for k, v := range w.updates {
+		total.WatchUpdates[k] += v
+	}
+}
+
+// printWatch prints the number of watch streams and the status updates they got.
+func printWatch(out io.Writer, streams int64, updates HealthResultMap) {
+	_, _ = fmt.Fprintf(out, "Health watch streams: %d\n", streams)
+	keys := make([]string, 0, len(updates))
+	for k := range updates {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(out, "Health watch update %s : %d\n", k, updates[k])
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"bytes"
+	"fmt"
+	"net/textproto"
+	"strconv"
+)
+
+// affinityKeys are the affinity keys ("users") pinned to a client: key k, of
+// HTTPOptions.AffinityKeys, is always sent on connection k % connections so
+// sticky routing backends see consistent keys. Not thread safe, each client
+// has its own.
+type affinityKeys struct {
+	header string
+	keys   []string // all the same width so they can be updated in place in a raw request
+	next   int
+}
+
+// ValidateAffinity returns an error if there are fewer affinity keys than
+// connections (some connections would have no key).
+func ValidateAffinity(o *HTTPOptions, numConnections int) error {
+	if o.AffinityHeader != "" && o.AffinityKeys < numConnections {
+		return fmt.Errorf("need at least as many affinity keys as connections: %d < %d", o.AffinityKeys, numConnections)
+	}
+	return nil
+}
+
+func newAffinityKeys(o *HTTPOptions) *affinityKeys {
+	if o.AffinityHeader == "" || o.AffinityKeys <= 0 {
+		return nil
+	}
+	numConns := o.numConnections
+	if numConns <= 0 {
+		numConns = 1
+	}
+	width := len(strconv.Itoa(o.AffinityKeys - 1))
+	a := &affinityKeys{header: textproto.CanonicalMIMEHeaderKey(o.AffinityHeader)}
+	for k := o.ID % numConns; k < o.AffinityKeys; k += numConns {
+		a.keys = append(a.keys, fmt.Sprintf("%0*d", width, k))
+	}
+	return a
+}
+
+// nextKey returns the next key pinned to this client, round robin.
+func (a *affinityKeys) nextKey() string {
+	k := a.keys[a.next]
+	a.next = (a.next + 1) % len(a.keys)
+	return k
+}
+
+// writeRaw appends the header, with the first key, to a raw request being built
+// and returns where the key is so it can be updated in place.
+func (a *affinityKeys) writeRaw(buf *bytes.Buffer) int {
+	buf.WriteString(a.header + ": ")
+	off := buf.Len()
+	buf.WriteString(a.keys[0])
+	buf.WriteString("\r\n")
+	return off
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/stats"
+)
+
+// Cache classes of the responses (see HTTPRunnerOptions.CacheStats).
+const (
+	CacheHit     = "HIT"
+	CacheMiss    = "MISS"
+	CacheBypass  = "BYPASS"
+	CacheUnknown = "UNKNOWN" // none of the cache headers in the response
+)
+
+// CacheClasses are all the cache classes, in reporting order.
+var CacheClasses = []string{CacheHit, CacheMiss, CacheBypass, CacheUnknown}
+
+// ResponseHeaderer is implemented by the clients which can return a header of
+// the last response: its (first) value, empty if absent or if the request failed.
+type ResponseHeaderer interface {
+	ResponseHeader(name string) string
+}
+
+// ResponseHeader returns the value of the name header in the last response.
+func (c *Client) ResponseHeader(name string) string {
+	return c.respHeader.Get(name)
+}
+
+// ResponseHeader returns the value of the name header in the last response.
+func (c *FastClient) ResponseHeader(name string) string {
+	return c.headerValue([]byte("\r\n" + name + ":"))
+}
+
+// ClassifyCache returns the cache class of a response from its headers, in
+// order of precedence: Cache-Status (RFC 9211, the cache closest to the
+// client, i.e. the last one, is used), X-Cache (also last one when multiple
+// values like "MISS, HIT") and Age (> 0 is a hit).
+func ClassifyCache(header func(name string) string) string {
+	if v := header("Cache-Status"); v != "" {
+		return classifyCacheStatus(v)
+	}
+	if v := header("X-Cache"); v != "" {
+		return classifyXCache(v)
+	}
+	if v := header("Age"); v != "" {
+		if age, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && age > 0 {
+			return CacheHit
+		}
+		return CacheMiss
+	}
+	return CacheUnknown
+}
+
+// classifyCacheStatus classifies a Cache-Status header value, e.g.
+// "Origin; fwd=miss, CDN; hit" (hit) or "CDN; fwd=bypass".
+func classifyCacheStatus(v string) string {
+	members := strings.Split(v, ",")
+	params := strings.Split(members[len(members)-1], ";")
+	for _, p := range params[1:] {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		switch strings.ToLower(kv[0]) {
+		case "hit":
+			return CacheHit
+		case "fwd":
+			if len(kv) == 2 && strings.EqualFold(strings.Trim(kv[1], "\""), "bypass") {
+				return CacheBypass
+			}
+			return CacheMiss
+		}
+	}
+	return CacheUnknown
+}
+
+// classifyXCache classifies an X-Cache header value, e.g. "HIT from edge-1",
+// "TCP_MISS" or "MISS, HIT".
+func classifyXCache(v string) string {
+	values := strings.Split(v, ",")
+	last := strings.ToUpper(values[len(values)-1])
+	switch {
+	case strings.Contains(last, "PASS"): // also BYPASS
+		return CacheBypass
+	case strings.Contains(last, "HIT"):
+		return CacheHit
+	case strings.Contains(last, "MISS"):
+		return CacheMiss
+	}
+	return CacheUnknown
+}
+
+// newCacheLatency returns the latency histograms of each cache class.
+func newCacheLatency(ro *periodic.RunnerOptions) map[string]*stats.Histogram {
+	h := make(map[string]*stats.Histogram, len(CacheClasses))
+	for _, class := range CacheClasses {
+		h[class] = ro.NewLatencyHistogram()
+	}
+	return h
+}
+
+// printCacheStats prints the hit ratio and each class' count and latency.
+func printCacheStats(out io.Writer, counts map[string]int64, latency map[string]*stats.HistogramData, ratio float64) {
+	_, _ = fmt.Fprintf(out, "Cache hit ratio: %.1f %%\n", 100.*ratio)
+	for _, class := range CacheClasses {
+		h := latency[class]
+		if h == nil || h.Count == 0 {
+			continue
+		}
+		_, _ = fmt.Fprintf(out, "Cache %s : %d, latency avg %.3f ms", class, counts[class], 1000.*h.Avg)
+		for _, p := range h.Percentiles {
+			_, _ = fmt.Fprintf(out, " p%g %.3f ms", p.Percentile, 1000.*p.Value)
+		}
+		_, _ = fmt.Fprintln(out)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestClassifyCache(t *testing.T) {
+	tests := []struct {
+		headers http.Header
+		class   string
+	}{
+		{http.Header{}, CacheUnknown},
+		{http.Header{"Cache-Status": {"ExampleCDN; hit"}}, CacheHit},
+		{http.Header{"Cache-Status": {"Origin; fwd=uri-miss, ExampleCDN; hit; ttl=30"}}, CacheHit},
+		{http.Header{"Cache-Status": {"ExampleCDN; hit, Edge; fwd=stale"}}, CacheMiss},
+		{http.Header{"Cache-Status": {"ExampleCDN; fwd=bypass"}}, CacheBypass},
+		{http.Header{"Cache-Status": {"ExampleCDN"}, "X-Cache": {"HIT"}}, CacheUnknown},
+		{http.Header{"X-Cache": {"Hit from cloudfront"}}, CacheHit},
+		{http.Header{"X-Cache": {"TCP_MISS"}}, CacheMiss},
+		{http.Header{"X-Cache": {"HIT, MISS"}}, CacheMiss},
+		{http.Header{"X-Cache": {"MISS, HIT"}, "Age": {"0"}}, CacheHit},
+		{http.Header{"X-Cache": {"PASS"}}, CacheBypass},
+		{http.Header{"X-Cache": {"BYPASS"}}, CacheBypass},
+		{http.Header{"X-Cache": {"foo"}}, CacheUnknown},
+		{http.Header{"Age": {"120"}}, CacheHit},
+		{http.Header{"Age": {"0"}}, CacheMiss},
+	}
+	for _, tst := range tests {
+		if class := ClassifyCache(tst.headers.Get); class != tst.class {
+			t.Errorf("for %v got %s, expected %s", tst.headers, class, tst.class)
+		}
+	}
+}
+
+func TestHTTPRunnerCacheStats(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	var count int64
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt64(&count, 1) % 4 {
+		case 0:
+			w.Header().Set("X-Cache", "MISS")
+		case 1, 2:
+			w.Header().Set("Age", "42")
+		case 3:
+			w.Header().Set("Cache-Status", "TestCache; fwd=bypass")
+		}
+	})
+	for _, std := range []bool{false, true} {
+		atomic.StoreInt64(&count, 0)
+		opts := HTTPRunnerOptions{}
+		opts.QPS = 100
+		opts.Exactly = 40
+		opts.NumThreads = 2
+		opts.URL = fmt.Sprintf("http://localhost:%d/", addr.Port)
+		opts.DisableFastClient = std
+		opts.CacheStats = true
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.CacheCounts[CacheHit] != 20 || res.CacheCounts[CacheMiss] != 10 || res.CacheCounts[CacheBypass] != 10 ||
+			res.CacheCounts[CacheUnknown] != 0 {
+			t.Errorf("std %v: unexpected cache counts %v", std, res.CacheCounts)
+		}
+		if res.CacheHitRatio != 0.5 {
+			t.Errorf("std %v: unexpected hit ratio %g", std, res.CacheHitRatio)
+		}
+		if res.CacheLatency[CacheHit].Count != 20 || res.CacheLatency[CacheHit].Avg <= 0 {
+			t.Errorf("std %v: unexpected hit latency %+v", std, res.CacheLatency[CacheHit])
+		}
+		if res.CacheLatency[CacheUnknown] != nil {
+			t.Errorf("std %v: unexpected unknown latency %+v", std, res.CacheLatency[CacheUnknown])
+		}
+		if _, err = json.Marshal(res); err != nil {
+			t.Errorf("std %v: unable to json serialize the results: %v", std, err)
+		}
+	}
+}
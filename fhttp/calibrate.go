@@ -0,0 +1,169 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"runtime"
+	"time"
+
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/periodic"
+)
+
+// CalibrationConnections are the standard numbers of connections of the
+// calibration steps.
+var CalibrationConnections = []int{1, 4, 16, 64}
+
+// calibrationPercentile is the latency percentile reported for each step.
+const calibrationPercentile = 99
+
+// CalibrationOptions are the options of a calibration (fortio calibrate): max
+// qps http runs of Duration against fortio's own in-process echo server, one
+// for each of the Connections, measuring how much load this machine can
+// generate. The URL is set to the echo server's.
+type CalibrationOptions struct {
+	HTTPRunnerOptions
+	// Numbers of connections (threads) of the steps, CalibrationConnections when empty.
+	Connections []int
+}
+
+// CalibrationStep is the result of one step of a calibration.
+type CalibrationStep struct {
+	NumThreads int
+	ActualQPS  float64
+	ErrorRate  float64
+	Latency    float64 // in seconds, at the 99th percentile
+	Result     *HTTPRunnerResults
+}
+
+// CalibrationResults is the generator capacity baseline: the max qps achieved
+// (and with how many connections) when the target adds no latency of its own,
+// and the result of each step.
+type CalibrationResults struct {
+	RunType       string
+	Labels        string
+	StartTime     time.Time
+	RunID         int64
+	SchemaVersion int
+	NumCPU        int
+	GoMaxProcs    int
+	StepDuration  time.Duration
+	// Highest actual qps of the steps and its number of connections.
+	MaxQPS            float64
+	MaxQPSConnections int
+	// Actual qps of a single connection, i.e. the client's own per call overhead.
+	SingleConnectionQPS float64
+	Interrupted         bool
+	Steps               []CalibrationStep
+}
+
+// ID returns an id for the report, in the same format as the other runs'.
+func (c *CalibrationResults) ID() string {
+	r := periodic.RunnerResults{StartTime: c.StartTime, Labels: c.Labels, RunID: c.RunID}
+	return r.ID()
+}
+
+// RunCalibration starts an echo server on an available loopback port and runs
+// the calibration steps against it, in order, until done or interrupted.
+func RunCalibration(o *CalibrationOptions) (*CalibrationResults, error) {
+	if o.Duration <= 0 {
+		return nil, fmt.Errorf("calibration needs a duration for each step, not %v", o.Duration)
+	}
+	connections := o.Connections
+	if len(connections) == 0 {
+		connections = CalibrationConnections
+	}
+	out := o.Out
+	if out == nil {
+		out = os.Stdout
+	}
+	mux, addr := HTTPServer("calibrate", "localhost:0")
+	if addr == nil {
+		return nil, fmt.Errorf("unable to start the calibration echo server")
+	}
+	mux.HandleFunc("/", EchoHandler)
+	res := &CalibrationResults{
+		RunType:       "HTTP calibration",
+		Labels:        o.Labels,
+		StartTime:     time.Now(),
+		RunID:         o.RunID,
+		SchemaVersion: periodic.SchemaVersion,
+		NumCPU:        runtime.NumCPU(),
+		GoMaxProcs:    runtime.GOMAXPROCS(0),
+		StepDuration:  o.Duration,
+	}
+	// Same as for the capacity steps, ^C stops the whole calibration.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+	for i, n := range connections {
+		_, _ = fmt.Fprintf(out, "Calibration step %d/%d with %d connections\n", i+1, len(connections), n)
+		so := CapacityOptions{HTTPRunnerOptions: o.HTTPRunnerOptions, LatencyPercentile: calibrationPercentile}
+		so.URL = fmt.Sprintf("http://%s/", addr.String())
+		so.NumThreads = n
+		so.Schedule = nil
+		so.Runners = nil
+		step, interrupted, err := so.runStep(-1, sig)
+		if interrupted {
+			log.Warnf("Calibration interrupted during the %d connections step", n)
+			res.Interrupted = true
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		res.Steps = append(res.Steps, CalibrationStep{
+			NumThreads: n,
+			ActualQPS:  step.ActualQPS,
+			ErrorRate:  step.ErrorRate,
+			Latency:    step.Latency,
+			Result:     step.Result,
+		})
+		if n == 1 {
+			res.SingleConnectionQPS = step.ActualQPS
+		}
+		if step.ActualQPS > res.MaxQPS {
+			res.MaxQPS = step.ActualQPS
+			res.MaxQPSConnections = n
+		}
+	}
+	res.print(out)
+	return res, nil
+}
+
+// print prints the summary of each step and the baseline found.
+func (c *CalibrationResults) print(out io.Writer) {
+	_, _ = fmt.Fprintf(out, "Calibration steps of %v at max qps against the in-process echo server (%d cpus, %d procs):\n",
+		c.StepDuration, c.NumCPU, c.GoMaxProcs)
+	for _, s := range c.Steps {
+		_, _ = fmt.Fprintf(out, "  %d connections : %.1f qps, p%d %.3f ms, %.2f %% errors\n",
+			s.NumThreads, s.ActualQPS, calibrationPercentile, 1000.*s.Latency, 100.*s.ErrorRate)
+	}
+	if len(c.Steps) == 0 {
+		_, _ = fmt.Fprintf(out, "No calibration step completed\n")
+		return
+	}
+	_, _ = fmt.Fprintf(out, "Generator capacity baseline: %.1f qps (with %d connections)\n", c.MaxQPS, c.MaxQPSConnections)
+	if c.SingleConnectionQPS > 0 {
+		_, _ = fmt.Fprintf(out, "A single connection can't exceed %.1f qps even against a zero latency target\n",
+			c.SingleConnectionQPS)
+	}
+	_, _ = fmt.Fprintf(out, "Results of runs above about %.0f qps (half the baseline) may be limited by this machine\n",
+		c.MaxQPS/2)
+}
@@ -0,0 +1,52 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunCalibration(t *testing.T) {
+	var out bytes.Buffer
+	o := CalibrationOptions{Connections: []int{1, 2}}
+	o.Duration = 200 * time.Millisecond
+	o.Out = &out
+	res, err := RunCalibration(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Steps) != 2 || res.Steps[0].NumThreads != 1 || res.Steps[1].NumThreads != 2 {
+		t.Fatalf("unexpected steps %+v", res.Steps)
+	}
+	for _, s := range res.Steps {
+		if s.ActualQPS <= 0 || s.ErrorRate != 0 || s.Latency <= 0 || s.Result == nil {
+			t.Errorf("unexpected step %+v", s)
+		}
+	}
+	if res.SingleConnectionQPS != res.Steps[0].ActualQPS || res.MaxQPS < res.SingleConnectionQPS ||
+		res.Steps[res.MaxQPSConnections-1].ActualQPS != res.MaxQPS {
+		t.Errorf("unexpected baseline %g with %d connections, single %g", res.MaxQPS, res.MaxQPSConnections,
+			res.SingleConnectionQPS)
+	}
+	if !strings.Contains(out.String(), "Generator capacity baseline: ") {
+		t.Errorf("missing baseline in output %q", out.String())
+	}
+	if _, err = RunCalibration(&CalibrationOptions{}); err == nil {
+		t.Errorf("expected an error without a step duration")
+	}
+}
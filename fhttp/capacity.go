@@ -0,0 +1,312 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/periodic"
+)
+
+// saturationRatio is the fraction of its target QPS a capacity step must
+// achieve, below it the target (or fortio) can't keep up.
+const saturationRatio = 0.9
+
+// searchResolution is the default precision, relative to the max sustainable
+// QPS found, at which a capacity Search stops.
+const searchResolution = 0.05
+
+// CapacityOptions are the options of a capacity (ramp to failure) test: http
+// runs of Duration at increasing QPS, starting at QPS, until a step fails one
+// of the thresholds.
+type CapacityOptions struct {
+	HTTPRunnerOptions
+	// QPS increase for each step (0 for the starting QPS, i.e. QPS, 2*QPS, 3*QPS,...).
+	StepQPS float64
+	// Last step's target QPS, 0 for no limit (until failure).
+	MaxQPS float64
+	// Fraction of non ok responses above which a step fails (0: any error fails it).
+	MaxErrorRate float64
+	// Latency at LatencyPercentile above which a step fails (0 for no limit).
+	LatencyPercentile float64
+	MaxLatency        time.Duration
+	// A step also fails when its latency (at LatencyPercentile) exceeds KneeFactor
+	// times the first step's (0 to disable).
+	KneeFactor float64
+	// Search for the max sustainable QPS instead of the linear steps: double
+	// the QPS, from QPS, until a step fails (or MaxQPS) and then binary search
+	// between the highest passing and lowest failing steps until they are
+	// within StepQPS (0 for 5% of the passing one).
+	Search bool
+}
+
+// CapacityStep is the result of one step of a capacity test.
+type CapacityStep struct {
+	TargetQPS float64
+	ActualQPS float64
+	ErrorRate float64
+	Latency   float64 // in seconds, at the LatencyPercentile
+	Passed    bool
+	Reason    string // why the step failed (empty when passed)
+	Result    *HTTPRunnerResults
+}
+
+// CapacityResults is the capacity report: the max sustainable QPS (achieved
+// by the last passing step, the knee) and the result of each step.
+type CapacityResults struct {
+	RunType           string
+	Labels            string
+	StartTime         time.Time
+	RunID             int64
+	SchemaVersion     int
+	URL               string
+	StepDuration      time.Duration
+	LatencyPercentile float64
+	MaxErrorRate      float64
+	MaxLatency        time.Duration
+	KneeFactor        float64
+	// Zero when even the first step failed.
+	MaxSustainableQPS float64
+	KneeTargetQPS     float64
+	Search            bool
+	Interrupted       bool
+	Steps             []CapacityStep
+}
+
+// ID returns an id for the report, in the same format as the other runs'.
+func (c *CapacityResults) ID() string {
+	r := periodic.RunnerResults{StartTime: c.StartTime, Labels: c.Labels, RunID: c.RunID}
+	return r.ID()
+}
+
+// ErrorRate returns the fraction of non ok responses of the run (see periodic.HasErrorRate),
+// the long polls still held at their deadline (LongPollHeld) being ok.
+func (httpstate *HTTPRunnerResults) ErrorRate() float64 {
+	var total, errors int64
+	for code, n := range httpstate.RetCodes {
+		total += n
+		if !codeIsOK(code) && code != LongPollHeld {
+			errors += n
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(errors) / float64(total)
+}
+
+// checkStep sets the step's Passed and Reason against the thresholds, baseline
+// being the first step's latency (0 for the first step itself).
+func (o *CapacityOptions) checkStep(step *CapacityStep, baseline float64) {
+	switch {
+	case step.ErrorRate > o.MaxErrorRate:
+		step.Reason = fmt.Sprintf("error rate %.2f %% above %.2f %%", 100.*step.ErrorRate, 100.*o.MaxErrorRate)
+	case o.MaxLatency > 0 && step.Latency > o.MaxLatency.Seconds():
+		step.Reason = fmt.Sprintf("p%g latency %.3f ms above %v", o.LatencyPercentile, 1000.*step.Latency, o.MaxLatency)
+	case o.KneeFactor > 0 && baseline > 0 && step.Latency > o.KneeFactor*baseline:
+		step.Reason = fmt.Sprintf("p%g latency %.3f ms above %g times the first step's %.3f ms", o.LatencyPercentile,
+			1000.*step.Latency, o.KneeFactor, 1000.*baseline)
+	case step.ActualQPS < saturationRatio*step.TargetQPS:
+		step.Reason = fmt.Sprintf("actual qps %.1f below %g %% of the target", step.ActualQPS, 100.*saturationRatio)
+	default:
+		step.Passed = true
+	}
+}
+
+// RunCapacityTest runs the capacity test steps until one fails (or MaxQPS is
+// reached, the Search is over or the run is interrupted) and returns the report.
+func RunCapacityTest(o *CapacityOptions) (*CapacityResults, error) {
+	if o.QPS <= 0 {
+		return nil, fmt.Errorf("capacity test needs a starting qps, not %g", o.QPS)
+	}
+	if o.Duration < 0 {
+		return nil, fmt.Errorf("capacity test needs a duration for each step, not %v", o.Duration)
+	}
+	if o.Duration == 0 {
+		o.Duration = periodic.DefaultRunnerOptions.Duration
+	}
+	if o.LatencyPercentile <= 0 {
+		o.LatencyPercentile = 99
+	}
+	stepQPS := o.StepQPS
+	if stepQPS <= 0 {
+		stepQPS = o.QPS
+	}
+	out := o.Out
+	if out == nil {
+		out = os.Stdout
+	}
+	res := &CapacityResults{
+		RunType:           "HTTP capacity",
+		Labels:            o.Labels,
+		StartTime:         time.Now(),
+		RunID:             o.RunID,
+		SchemaVersion:     periodic.SchemaVersion,
+		URL:               o.URL,
+		StepDuration:      o.Duration,
+		LatencyPercentile: o.LatencyPercentile,
+		MaxErrorRate:      o.MaxErrorRate,
+		MaxLatency:        o.MaxLatency,
+		KneeFactor:        o.KneeFactor,
+		Search:            o.Search,
+	}
+	// We handle ^C ourselves to stop the ramp, not just the current step.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+	var lo, hi float64 // search: highest passing and lowest failing targets so far (0 for none)
+	target := o.QPS
+	for i := 0; ; i++ {
+		if !o.Search {
+			target = o.QPS + float64(i)*stepQPS
+			if o.MaxQPS > 0 && target > o.MaxQPS {
+				break
+			}
+		}
+		_, _ = fmt.Fprintf(out, "Capacity step %d at %g qps\n", len(res.Steps)+1, target)
+		step, interrupted, err := o.runStep(target, sig)
+		if interrupted {
+			log.Warnf("Capacity test interrupted during the %g qps step", target)
+			res.Interrupted = true
+			break
+		}
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			res.Steps = append(res.Steps, CapacityStep{TargetQPS: target, Reason: err.Error()})
+			break
+		}
+		baseline := 0.
+		if i > 0 {
+			baseline = res.Steps[0].Latency
+		}
+		o.checkStep(&step, baseline)
+		res.Steps = append(res.Steps, step)
+		if step.Passed && target > res.KneeTargetQPS {
+			res.MaxSustainableQPS = step.ActualQPS
+			res.KneeTargetQPS = target
+		}
+		if !o.Search {
+			if !step.Passed {
+				break
+			}
+			continue
+		}
+		if step.Passed {
+			lo = target
+		} else {
+			hi = target
+		}
+		var more bool
+		if target, more = o.nextSearchTarget(lo, hi); !more {
+			break
+		}
+	}
+	if o.Search {
+		// Report (and chart) the latency as a function of the load, not in the search order.
+		sort.SliceStable(res.Steps, func(i, j int) bool { return res.Steps[i].TargetQPS < res.Steps[j].TargetQPS })
+	}
+	res.print(out)
+	return res, nil
+}
+
+// runStep runs the http test of a step at the target qps. Returns true
+// instead of the step if interrupted (by sig).
+func (o *CapacityOptions) runStep(target float64, sig chan os.Signal) (CapacityStep, bool, error) {
+	so := o.HTTPRunnerOptions
+	so.QPS = target
+	so.Exactly = 0
+	so.BurstSize = 0
+	so.ConcurrencyOnly = false
+	stop := periodic.NewAborter()
+	so.Stop = stop
+	var interrupted int32
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-sig:
+			atomic.StoreInt32(&interrupted, 1)
+			stop.Abort()
+		case <-done:
+		}
+	}()
+	r, err := RunHTTPTest(&so)
+	close(done)
+	if atomic.LoadInt32(&interrupted) != 0 {
+		return CapacityStep{}, true, nil
+	}
+	if err != nil {
+		return CapacityStep{}, false, err
+	}
+	return CapacityStep{
+		TargetQPS: target,
+		ActualQPS: r.ActualQPS,
+		ErrorRate: r.ErrorRate(),
+		Latency:   r.DurationHistogram.CalcPercentile(o.LatencyPercentile),
+		Result:    r,
+	}, false, nil
+}
+
+// nextSearchTarget returns the next step's target qps of the Search given
+// the highest passing (lo) and lowest failing (hi) targets so far (0 for
+// none), or false when the search is over.
+func (o *CapacityOptions) nextSearchTarget(lo, hi float64) (float64, bool) {
+	switch {
+	case lo == 0:
+		return 0, false // even the first step failed
+	case hi == 0 && o.MaxQPS > 0 && lo >= o.MaxQPS:
+		return 0, false // passing at MaxQPS
+	case hi == 0:
+		next := 2 * lo
+		if o.MaxQPS > 0 && next > o.MaxQPS {
+			next = o.MaxQPS
+		}
+		return next, true
+	}
+	resolution := o.StepQPS
+	if resolution <= 0 {
+		resolution = searchResolution * lo
+	}
+	if hi-lo <= resolution {
+		return 0, false
+	}
+	return (lo + hi) / 2, true
+}
+
+// print prints the summary of each step and the capacity found.
+func (c *CapacityResults) print(out io.Writer) {
+	_, _ = fmt.Fprintf(out, "Capacity steps of %v (p%g latency):\n", c.StepDuration, c.LatencyPercentile)
+	for _, s := range c.Steps {
+		status := "ok"
+		if !s.Passed {
+			status = "FAILED: " + s.Reason
+		}
+		_, _ = fmt.Fprintf(out, "  %g qps : actual %.1f qps, errors %.2f %%, latency %.3f ms - %s\n",
+			s.TargetQPS, s.ActualQPS, 100.*s.ErrorRate, 1000.*s.Latency, status)
+	}
+	if c.MaxSustainableQPS == 0 {
+		_, _ = fmt.Fprintf(out, "No sustainable qps found\n")
+		return
+	}
+	_, _ = fmt.Fprintf(out, "Max sustainable qps: %.1f (knee at the %g qps step)\n", c.MaxSustainableQPS, c.KneeTargetQPS)
+}
@@ -0,0 +1,151 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCapacityCheckStep(t *testing.T) {
+	o := CapacityOptions{MaxErrorRate: 0.01, LatencyPercentile: 99, MaxLatency: 100 * time.Millisecond, KneeFactor: 3}
+	tests := []struct {
+		step     CapacityStep
+		baseline float64
+		reason   string // expected start of the reason, empty when passing
+	}{
+		{CapacityStep{TargetQPS: 100, ActualQPS: 99.5, Latency: 0.010}, 0, ""},
+		{CapacityStep{TargetQPS: 100, ActualQPS: 99.5, Latency: 0.010, ErrorRate: 0.05}, 0, "error rate"},
+		{CapacityStep{TargetQPS: 100, ActualQPS: 99.5, Latency: 0.150}, 0, "p99 latency 150.000 ms above 100ms"},
+		{CapacityStep{TargetQPS: 100, ActualQPS: 99.5, Latency: 0.040}, 0.010, "p99 latency 40.000 ms above 3 times"},
+		{CapacityStep{TargetQPS: 100, ActualQPS: 99.5, Latency: 0.020}, 0.010, ""},
+		{CapacityStep{TargetQPS: 100, ActualQPS: 80, Latency: 0.010}, 0.010, "actual qps"},
+	}
+	for _, tst := range tests {
+		step := tst.step
+		o.checkStep(&step, tst.baseline)
+		if step.Passed != (tst.reason == "") || !strings.HasPrefix(step.Reason, tst.reason) {
+			t.Errorf("for %+v (baseline %g) got %v %q, expected %q", tst.step, tst.baseline, step.Passed, step.Reason, tst.reason)
+		}
+	}
+}
+
+func TestRunCapacityTest(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	var count int64
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// Overloaded after the first step (2 warmup calls + 20 calls).
+		if atomic.AddInt64(&count, 1) > 30 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	opts := CapacityOptions{MaxErrorRate: 0.01}
+	opts.QPS = 40
+	opts.Duration = 500 * time.Millisecond
+	opts.NumThreads = 2
+	opts.AllowInitialErrors = true
+	opts.URL = fmt.Sprintf("http://localhost:%d/", addr.Port)
+	res, err := RunCapacityTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Steps) != 2 || !res.Steps[0].Passed || res.Steps[1].Passed || res.Steps[1].TargetQPS != 80 {
+		t.Fatalf("unexpected steps %+v", res.Steps)
+	}
+	if res.KneeTargetQPS != 40 || res.MaxSustainableQPS != res.Steps[0].ActualQPS || res.Steps[1].ErrorRate < 0.5 {
+		t.Errorf("unexpected capacity %+v", res)
+	}
+	if _, err = json.Marshal(res); err != nil {
+		t.Errorf("unable to json serialize the report: %v", err)
+	}
+	// All passing up to MaxQPS.
+	atomic.StoreInt64(&count, -1000)
+	opts.StepQPS = 20
+	opts.MaxQPS = 80
+	res, err = RunCapacityTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Steps) != 3 || !res.Steps[2].Passed || res.KneeTargetQPS != 80 {
+		t.Errorf("unexpected steps up to max qps %+v", res.Steps)
+	}
+	opts.QPS = -1
+	if _, err = RunCapacityTest(&opts); err == nil {
+		t.Errorf("expected error for max qps capacity test")
+	}
+}
+
+func TestCapacityNextSearchTarget(t *testing.T) {
+	tests := []struct {
+		maxQPS, step, lo, hi float64
+		next                 float64 // 0 when the search is over
+	}{
+		{0, 0, 0, 100, 0},        // first step failed
+		{0, 0, 100, 0, 200},      // doubling
+		{150, 0, 100, 0, 150},    // up to the max
+		{150, 0, 150, 0, 0},      // passing at the max
+		{0, 0, 100, 200, 150},    // bisecting
+		{0, 0, 100, 104, 0},      // within 5%
+		{0, 10, 100, 115, 107.5}, // not yet within the step
+		{0, 10, 100, 110, 0},     // within the step
+	}
+	for _, tst := range tests {
+		o := CapacityOptions{MaxQPS: tst.maxQPS, StepQPS: tst.step, Search: true}
+		next, more := o.nextSearchTarget(tst.lo, tst.hi)
+		if next != tst.next || more != (tst.next != 0) {
+			t.Errorf("for %+v got %g %v", tst, next, more)
+		}
+	}
+}
+
+func TestCapacitySearch(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	var fail int32
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&fail) != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	opts := CapacityOptions{MaxErrorRate: 0.01, MaxQPS: 50, Search: true}
+	opts.QPS = 20
+	opts.Duration = 300 * time.Millisecond
+	opts.NumThreads = 1
+	opts.AllowInitialErrors = true
+	opts.URL = fmt.Sprintf("http://localhost:%d/", addr.Port)
+	res, err := RunCapacityTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Doubling, capped at the max:
+	if len(res.Steps) != 3 || res.Steps[1].TargetQPS != 40 || res.Steps[2].TargetQPS != 50 || !res.Steps[2].Passed {
+		t.Fatalf("unexpected steps %+v", res.Steps)
+	}
+	if !res.Search || res.KneeTargetQPS != 50 || res.MaxSustainableQPS != res.Steps[2].ActualQPS {
+		t.Errorf("unexpected capacity %+v", res)
+	}
+	atomic.StoreInt32(&fail, 1)
+	res, err = RunCapacityTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Steps) != 1 || res.Steps[0].Passed || res.MaxSustainableQPS != 0 {
+		t.Errorf("unexpected steps when failing from the start %+v", res.Steps)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	// MaxHeaderValues is the number of distinct captured header values counted
+	// separately, per thread and in the run's total, so capturing a high
+	// cardinality header (request ids, dates...) doesn't grow the memory with the
+	// length of the run.
+	MaxHeaderValues = 100
+	// OtherHeaderValues is the HeaderValues key of the values beyond MaxHeaderValues.
+	OtherHeaderValues = "(other)"
+)
+
+// addHeaderValue adds n to the count of the captured header value v, or to
+// the OtherHeaderValues one when MaxHeaderValues are already counted.
+func addHeaderValue(values map[string]int64, v string, n int64) {
+	if _, found := values[v]; !found {
+		counted := len(values)
+		if _, others := values[OtherHeaderValues]; others {
+			counted--
+		}
+		if counted >= MaxHeaderValues {
+			v = OtherHeaderValues
+		}
+	}
+	values[v] += n
+}
+
+// HeaderCapturer is implemented by the clients which can capture a response
+// header (see HTTPOptions.CaptureHeader): CapturedHeader returns its value in
+// the last response, empty if absent (or if the request failed).
+type HeaderCapturer interface {
+	CapturedHeader() string
+}
+
+// CapturedHeader returns the value of the HTTPOptions.CaptureHeader in the last response.
+func (c *Client) CapturedHeader() string {
+	return c.captured
+}
+
+// CapturedHeader returns the value of the HTTPOptions.CaptureHeader in the last response.
+func (c *FastClient) CapturedHeader() string {
+	if c.captureKey == nil {
+		return ""
+	}
+	return c.headerValue(c.captureKey)
+}
+
+// headerValue returns the value of the header, key being "\r\n<name>:", in
+// the last response.
+func (c *FastClient) headerValue(key []byte) string {
+	if c.headerLen == 0 {
+		return ""
+	}
+	headers := c.buffer[:c.headerLen]
+	found, offset := FoldFind(headers, key)
+	if !found {
+		return ""
+	}
+	value := headers[offset+len(key):]
+	if end := bytes.Index(value, []byte("\r\n")); end >= 0 {
+		value = value[:end]
+	}
+	return string(bytes.TrimSpace(value))
+}
+
+// printHeaderValues prints the distribution of the captured header values,
+// most frequent first.
+func printHeaderValues(out io.Writer, header string, values map[string]int64, total float64) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if values[keys[i]] != values[keys[j]] {
+			return values[keys[i]] > values[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	_, _ = fmt.Fprintf(out, "Response header %s values:\n", header)
+	for _, k := range keys {
+		v := k
+		if v == "" {
+			v = "(none)"
+		}
+		_, _ = fmt.Fprintf(out, "  %s : %d (%.1f %%)\n", v, values[k], 100.*float64(values[k])/total)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"crypto/tls"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"fortio.org/fortio/log"
+)
+
+// certReloader holds the client certificate, shared by all the clients of a
+// run, and reloads it from disk on demand. Only new connections (TLS
+// handshakes) use the reloaded certificate, established ones and their in
+// flight requests are unaffected.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	reloads  int
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	r.reloads = 0
+	return r, nil
+}
+
+// reload loads the certificate and key from disk again. On error the previous
+// certificate is kept.
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		log.Errf("LoadX509KeyPair error for cert %v / key %v: %v", r.certFile, r.keyFile, err)
+		return err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.reloads++
+	r.mu.Unlock()
+	log.LogVf("Loaded client cert %v / key %v", r.certFile, r.keyFile)
+	return nil
+}
+
+// clientCertificate is the tls.Config GetClientCertificate callback.
+func (r *certReloader) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// reloadCount returns how many times the certificate was reloaded successfully.
+func (r *certReloader) reloadCount() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.reloads
+}
+
+// watch reloads the certificate every interval (if > 0) and/or on SIGHUP
+// until the returned stop function is called.
+func (r *certReloader) watch(interval time.Duration, onSignal bool) (stop func()) {
+	done := make(chan struct{})
+	var tick <-chan time.Time
+	var ticker *time.Ticker
+	if interval > 0 {
+		ticker = time.NewTicker(interval)
+		tick = ticker.C
+	}
+	var sig chan os.Signal
+	if onSignal {
+		sig = make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGHUP)
+	}
+	go func() {
+		for {
+			select {
+			case <-done:
+				if ticker != nil {
+					ticker.Stop()
+				}
+				if sig != nil {
+					signal.Stop(sig)
+				}
+				return
+			case <-tick:
+				_ = r.reload()
+			case <-sig:
+				log.Infof("Got SIGHUP, reloading client cert %v / key %v", r.certFile, r.keyFile)
+				_ = r.reload()
+			}
+		}
+	}()
+	return func() { close(done) }
+}
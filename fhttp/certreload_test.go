@@ -0,0 +1,135 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self signed cert/key pair with the given common name.
+func writeTestCert(t *testing.T, certFile, keyFile, cn string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func certCN(c *tls.Certificate) string {
+	x, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		return err.Error()
+	}
+	return x.Subject.CommonName
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	writeTestCert(t, certFile, keyFile, "client-a")
+	var mu sync.Mutex
+	var peer string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		peer = r.TLS.PeerCertificates[0].Subject.CommonName
+		mu.Unlock()
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := HTTPOptions{URL: srv.URL, Insecure: true, DisableFastClient: true, DisableKeepAlive: true, certs: certs}
+	client, err := NewStdClient(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for _, cn := range []string{"client-a", "client-b"} {
+		if cn != "client-a" {
+			writeTestCert(t, certFile, keyFile, cn)
+			if err = certs.reload(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if code, _, _ := client.Fetch(); code != http.StatusOK {
+			t.Errorf("Got %d with cert %s", code, cn)
+		}
+		mu.Lock()
+		if peer != cn {
+			t.Errorf("Server got cert %q expected %q", peer, cn)
+		}
+		mu.Unlock()
+	}
+	// Bad files keep the previous cert.
+	if err = ioutil.WriteFile(keyFile, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = certs.reload(); err == nil {
+		t.Errorf("Expected reload error for invalid key")
+	}
+	c, _ := certs.clientCertificate(nil)
+	if certCN(c) != "client-b" || certs.reloadCount() != 1 {
+		t.Errorf("Unexpected cert %q after failed reload (%d reloads)", certCN(c), certs.reloadCount())
+	}
+	// Periodic reload.
+	writeTestCert(t, certFile, keyFile, "client-c")
+	stop := certs.watch(10*time.Millisecond, false)
+	defer stop()
+	for i := 0; i < 100 && certs.reloadCount() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c, _ = certs.clientCertificate(nil)
+	if certCN(c) != "client-c" {
+		t.Errorf("Periodic reload didn't happen, cert is %q", certCN(c))
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ParseConnectRate parses a rate of new connections, "N/s", "N/m" or just N
+// (per second), e.g. "10/s", and returns it per second.
+func ParseConnectRate(s string) (float64, error) {
+	num, per := s, 1.
+	switch {
+	case strings.HasSuffix(s, "/s"):
+		num = strings.TrimSuffix(s, "/s")
+	case strings.HasSuffix(s, "/m"):
+		num, per = strings.TrimSuffix(s, "/m"), 60
+	}
+	rate, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || rate <= 0 {
+		return 0, fmt.Errorf("invalid connect rate %q, expecting a positive N/s or N/m", s)
+	}
+	return rate / per, nil
+}
+
+// connectLimiter spaces the opening of new connections, shared by all the
+// clients of a run (see HTTPOptions.ConnectRate): each waits for its turn, at
+// most one connection every 1/rate, independently of the requests' qps.
+type connectLimiter struct {
+	interval time.Duration
+	abort    <-chan struct{} // the run's stop channel, nil for a client's own limiter
+	mu       sync.Mutex
+	next     time.Time // earliest time for the next connection
+	waits    int64
+	waited   time.Duration
+}
+
+// errConnectAborted is returned by the waits interrupted by the end of the run.
+var errConnectAborted = errors.New("run aborted while waiting to connect")
+
+// connectWaiter is implemented by the clients which can wait for the connect
+// rate limiter, so that wait is excluded from the calls' latency.
+type connectWaiter interface {
+	// takeConnectWait returns the time waited to connect since the last call of it.
+	takeConnectWait() time.Duration
+}
+
+func newConnectLimiter(rate float64) *connectLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &connectLimiter{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+// wait blocks until a new connection can be opened, or ctx is done or the run
+// aborted, and returns how long it waited.
+func (l *connectLimiter) wait(ctx context.Context) (time.Duration, error) {
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	d := at.Sub(now)
+	if d > 0 {
+		l.waits++
+		l.waited += d
+	}
+	l.mu.Unlock()
+	if d <= 0 {
+		return 0, nil
+	}
+	start := time.Now()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return d, nil
+	case <-ctx.Done():
+		return time.Since(start), ctx.Err()
+	case <-l.abort:
+		return time.Since(start), errConnectAborted
+	}
+}
+
+// stats returns how many connections had to wait and for how long in total.
+func (l *connectLimiter) stats() (int64, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.waits, l.waited
+}
+
+// connectLimit returns the run's shared limiter, or else a new one for the
+// client, nil when the connect rate isn't limited.
+func (h *HTTPOptions) connectLimit() *connectLimiter {
+	if h.connectLimiter != nil {
+		return h.connectLimiter
+	}
+	return newConnectLimiter(h.ConnectRate)
+}
@@ -0,0 +1,110 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseConnectRate(t *testing.T) {
+	for _, tst := range []struct {
+		in       string
+		expected float64
+		err      bool
+	}{
+		{"10/s", 10, false},
+		{"10", 10, false},
+		{"0.5/s", .5, false},
+		{"120/m", 2, false},
+		{"0/s", 0, true},
+		{"-1", 0, true},
+		{"10/h", 0, true},
+		{"", 0, true},
+	} {
+		r, err := ParseConnectRate(tst.in)
+		if (err != nil) != tst.err || r != tst.expected {
+			t.Errorf("ParseConnectRate(%q) = %g, %v, expected %g (error %v)", tst.in, r, err, tst.expected, tst.err)
+		}
+	}
+}
+
+func TestConnectLimiter(t *testing.T) {
+	if l := newConnectLimiter(0); l != nil {
+		t.Errorf("unexpected limiter without a rate %+v", l)
+	}
+	l := newConnectLimiter(50) // one every 20ms
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, err := l.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first one doesn't wait:
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("unexpected %v for 5 connections at 50/s", elapsed)
+	}
+	if waits, waited := l.stats(); waits != 4 || waited < 70*time.Millisecond {
+		t.Errorf("unexpected %d waits for %v", waits, waited)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l = newConnectLimiter(1)
+	_, _ = l.wait(ctx)
+	if _, err := l.wait(ctx); err != context.Canceled {
+		t.Errorf("expected the wait to be canceled, got %v", err)
+	}
+	// Or interrupted by the end of the run:
+	abort := make(chan struct{})
+	l = newConnectLimiter(1)
+	l.abort = abort
+	_, _ = l.wait(context.Background())
+	time.AfterFunc(50*time.Millisecond, func() { close(abort) })
+	if waited, err := l.wait(context.Background()); err != errConnectAborted || waited > 500*time.Millisecond {
+		t.Errorf("expected the wait to be aborted, got %v after %v", err, waited)
+	}
+}
+
+func TestHTTPRunnerConnectRate(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/", EchoHandler)
+	for _, std := range []bool{false, true} {
+		opts := HTTPRunnerOptions{}
+		opts.QPS = -1
+		opts.Exactly = 20
+		opts.NumThreads = 4
+		opts.URL = fmt.Sprintf("http://localhost:%d/?close=1", addr.Port)
+		opts.DisableFastClient = std
+		opts.ConnectRate = 100
+		start := time.Now()
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A new connection for each call (plus the initial ones), at most one every 10ms:
+		if elapsed := time.Since(start); elapsed < 150*time.Millisecond || res.ConnectRate != 100 || res.ConnectWaits < 15 {
+			t.Errorf("std %v: unexpected %d waits (%v) in %v", std, res.ConnectWaits, res.ConnectWaited, elapsed)
+		}
+		// The waits aren't part of the calls' latency:
+		if avg := res.DurationHistogram.Avg; avg >= 0.01 {
+			t.Errorf("std %v: connect waits counted in the %gs average latency", std, avg)
+		}
+		if opts.HTTPOptions.connectLimiter != nil {
+			t.Errorf("std %v: the limiter should be cleared after the run", std)
+		}
+	}
+}
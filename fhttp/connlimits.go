@@ -0,0 +1,93 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseConnReuseRange parses a "min:max" (or just "n") number of requests
+// per connection, for HTTPOptions.ConnReuseRange.
+func ParseConnReuseRange(s string) ([2]int, error) {
+	var r [2]int
+	parts := strings.SplitN(s, ":", 2)
+	for i, p := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || n <= 0 {
+			return r, fmt.Errorf("invalid connection reuse range %q, expecting min:max positive numbers of requests", s)
+		}
+		r[i] = n
+	}
+	if len(parts) == 1 {
+		r[1] = r[0]
+	}
+	if r[0] > r[1] {
+		return r, fmt.Errorf("invalid connection reuse range %q, min is above max", s)
+	}
+	return r, nil
+}
+
+// connLimits tracks the age and number of requests of a client's current
+// keep-alive connection, to recycle it per HTTPOptions.ConnMaxLifetime and
+// ConnMaxRequests (or ConnReuseRange). The age counts from the connection's
+// first request. Not thread safe, each client has its own.
+type connLimits struct {
+	maxLifetime time.Duration
+	reuseRange  [2]int
+	rnd         *rand.Rand // nil for a fixed number of requests
+	maxRequests int        // of the current connection, 0 for no limit
+	start       time.Time
+	requests    int
+}
+
+func newConnLimits(o *HTTPOptions) *connLimits {
+	if o.DisableKeepAlive || (o.ConnMaxLifetime <= 0 && o.ConnMaxRequests <= 0 && o.ConnReuseRange[1] <= 0) {
+		return nil
+	}
+	l := &connLimits{maxLifetime: o.ConnMaxLifetime, maxRequests: o.ConnMaxRequests}
+	if o.ConnReuseRange[1] > 0 {
+		l.reuseRange = o.ConnReuseRange
+		l.rnd = rand.New(rand.NewSource(time.Now().UnixNano() + int64(o.ID))) // nolint: gosec // not for crypto
+		l.reset()
+	}
+	return l
+}
+
+// next counts a request on the current connection and returns true when the
+// connection must be closed after it.
+func (l *connLimits) next() bool {
+	if l.requests == 0 {
+		l.start = time.Now()
+	}
+	l.requests++
+	if (l.maxRequests > 0 && l.requests >= l.maxRequests) ||
+		(l.maxLifetime > 0 && time.Since(l.start) >= l.maxLifetime) {
+		l.reset()
+		return true
+	}
+	return false
+}
+
+// reset starts the tracking over, for a new connection.
+func (l *connLimits) reset() {
+	l.requests = 0
+	if l.rnd != nil {
+		l.maxRequests = l.reuseRange[0] + l.rnd.Intn(l.reuseRange[1]-l.reuseRange[0]+1)
+	}
+}
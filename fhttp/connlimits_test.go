@@ -0,0 +1,123 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnLimits(t *testing.T) {
+	if l := newConnLimits(&HTTPOptions{ConnMaxRequests: 3, DisableKeepAlive: true}); l != nil {
+		t.Errorf("unexpected limits without keep alive %+v", l)
+	}
+	l := newConnLimits(&HTTPOptions{ConnMaxRequests: 3})
+	var closes []bool
+	for i := 0; i < 7; i++ {
+		closes = append(closes, l.next())
+	}
+	if fmt.Sprint(closes) != "[false false true false false true false]" {
+		t.Errorf("unexpected closes %v", closes)
+	}
+	l = newConnLimits(&HTTPOptions{ConnMaxLifetime: 50 * time.Millisecond})
+	if l.next() || l.next() {
+		t.Errorf("unexpected close of a new connection")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !l.next() || l.next() {
+		t.Errorf("expected the old connection only to be closed")
+	}
+}
+
+func TestParseConnReuseRange(t *testing.T) {
+	for _, tst := range []struct {
+		in       string
+		expected [2]int
+		err      bool
+	}{
+		{"10:20", [2]int{10, 20}, false},
+		{"5", [2]int{5, 5}, false},
+		{" 1 : 2 ", [2]int{1, 2}, false},
+		{"20:10", [2]int{}, true},
+		{"0:10", [2]int{}, true},
+		{"a:b", [2]int{}, true},
+		{"", [2]int{}, true},
+	} {
+		r, err := ParseConnReuseRange(tst.in)
+		if tst.err != (err != nil) || (!tst.err && r != tst.expected) {
+			t.Errorf("%q: unexpected %v %v", tst.in, r, err)
+		}
+	}
+}
+
+func TestConnReuseRange(t *testing.T) {
+	l := newConnLimits(&HTTPOptions{ConnReuseRange: [2]int{2, 4}})
+	seen := make(map[int]bool)
+	requests := 0
+	for i := 0; i < 1000; i++ {
+		requests++
+		if l.next() {
+			if requests < 2 || requests > 4 {
+				t.Fatalf("unexpected close after %d requests", requests)
+			}
+			seen[requests] = true
+			requests = 0
+		}
+	}
+	if len(seen) != 3 {
+		t.Errorf("expected all of 2, 3 and 4 requests per connection, got %v", seen)
+	}
+}
+
+func TestConnMaxRequests(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	var mu sync.Mutex
+	conns := make(map[string]int)
+	mux.HandleFunc("/conns/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		conns[r.RemoteAddr]++
+		mu.Unlock()
+		EchoHandler(w, r)
+	})
+	url := fmt.Sprintf("http://localhost:%d/conns/", addr.Port)
+	for _, tst := range []HTTPOptions{{}, {DisableFastClient: true}, {H2C: true}} {
+		mu.Lock()
+		conns = make(map[string]int)
+		mu.Unlock()
+		o := tst
+		o.Init(url)
+		o.ConnMaxRequests = 3
+		client, _ := NewClient(&o)
+		for i := 0; i < 10; i++ {
+			if code, _, _ := client.Fetch(); code != http.StatusOK {
+				t.Errorf("%+v: unexpected code %d", tst, code)
+			}
+		}
+		client.Close()
+		mu.Lock()
+		counts := []int{}
+		for _, n := range conns {
+			counts = append(counts, n)
+		}
+		mu.Unlock()
+		// 3+3+3+1 requests
+		if len(counts) != 4 {
+			t.Errorf("std %v h2c %v: unexpected connections %v", tst.DisableFastClient, tst.H2C, conns)
+		}
+	}
+}
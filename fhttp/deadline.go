@@ -0,0 +1,71 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"bytes"
+	"net/http"
+	"time"
+
+	"fortio.org/fortio/log"
+)
+
+const (
+	// DeadlineHeader is the request header carrying the client's deadline for
+	// the request (see HTTPOptions.SendDeadline), honored by the echo server.
+	DeadlineHeader = "X-Fortio-Deadline"
+	// DeadlineRemainingHeader is the echo server response header with the
+	// time that remained until the request's deadline when it was received.
+	DeadlineRemainingHeader = "X-Fortio-Deadline-Remaining"
+	// Always in UTC and with milliseconds, so all the deadlines have the same
+	// width and can be updated in place in the fast client's raw request.
+	deadlineFormat = "2006-01-02T15:04:05.000Z07:00"
+)
+
+// FormatDeadline returns the DeadlineHeader value for the deadline t.
+func FormatDeadline(t time.Time) string {
+	return t.UTC().Format(deadlineFormat)
+}
+
+// ParseDeadline parses a DeadlineHeader value (any RFC 3339 time).
+func ParseDeadline(s string) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// writeDeadlineRaw appends the header, with the deadline of a request starting
+// now, to a raw request being built and returns where the deadline is so it
+// can be updated in place.
+func writeDeadlineRaw(buf *bytes.Buffer, timeout time.Duration) int {
+	buf.WriteString(DeadlineHeader + ": ")
+	off := buf.Len()
+	buf.WriteString(FormatDeadline(time.Now().Add(timeout)))
+	buf.WriteString("\r\n")
+	return off
+}
+
+// requestDeadline returns the time remaining, at received, until the deadline
+// of r, false if it has none (or an invalid one).
+func requestDeadline(r *http.Request, received time.Time) (time.Duration, bool) {
+	v := r.Header.Get(DeadlineHeader)
+	if v == "" {
+		return 0, false
+	}
+	deadline, err := ParseDeadline(v)
+	if err != nil {
+		log.Warnf("Ignoring invalid %s %q: %v", DeadlineHeader, v, err)
+		return 0, false
+	}
+	return deadline.Sub(received), true
+}
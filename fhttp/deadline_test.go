@@ -0,0 +1,111 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFormatDeadline(t *testing.T) {
+	d1 := time.Date(2021, 10, 17, 1, 2, 3, 0, time.UTC)
+	d2 := time.Date(2021, 10, 17, 11, 22, 33, 456789000, time.FixedZone("PDT", -7*3600))
+	s1, s2 := FormatDeadline(d1), FormatDeadline(d2)
+	if s1 != "2021-10-17T01:02:03.000Z" || s2 != "2021-10-17T18:22:33.456Z" {
+		t.Errorf("unexpected deadlines %q %q", s1, s2)
+	}
+	if p, err := ParseDeadline(s2); err != nil || !p.Equal(d2.Truncate(time.Millisecond)) {
+		t.Errorf("unexpected parsed deadline %v: %v", p, err)
+	}
+}
+
+func TestSendDeadline(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	deadlines := make(chan string, 10)
+	mux.HandleFunc("/deadline", func(w http.ResponseWriter, r *http.Request) {
+		deadlines <- r.Header.Get(DeadlineHeader)
+	})
+	for _, stdClient := range []bool{false, true} {
+		o := NewHTTPOptions(fmt.Sprintf("http://localhost:%d/deadline", addr.Port))
+		o.DisableFastClient = stdClient
+		o.SendDeadline = true
+		o.HTTPReqTimeOut = 5 * time.Second
+		client, _ := NewClient(o)
+		for i := 0; i < 2; i++ {
+			start := time.Now()
+			if code, _, _ := client.Fetch(); code != http.StatusOK {
+				t.Errorf("std %v: unexpected code %d", stdClient, code)
+			}
+			deadline, err := ParseDeadline(<-deadlines)
+			expected := start.Add(o.HTTPReqTimeOut)
+			if err != nil || deadline.Before(expected.Add(-time.Millisecond)) || deadline.After(expected.Add(time.Second)) {
+				t.Errorf("std %v: unexpected deadline %v (expected about %v): %v", stdClient, deadline, expected, err)
+			}
+			time.Sleep(5 * time.Millisecond) // next deadline is different
+		}
+		client.Close()
+	}
+}
+
+func TestEchoDeadline(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/", EchoHandler)
+	base := fmt.Sprintf("http://localhost:%d/", addr.Port)
+	tests := []struct {
+		query    string
+		budget   time.Duration
+		status   int
+		maxDelay time.Duration
+	}{
+		{"", time.Second, http.StatusOK, 500 * time.Millisecond},
+		{"?delay=20ms", time.Second, http.StatusOK, 500 * time.Millisecond},
+		{"?delay=5s", 50 * time.Millisecond, http.StatusGatewayTimeout, time.Second},
+		{"?busy=5s", 50 * time.Millisecond, http.StatusGatewayTimeout, time.Second},
+		{"?busy=30ms&delay=5s", 100 * time.Millisecond, http.StatusGatewayTimeout, time.Second},
+		{"", -time.Second, http.StatusGatewayTimeout, 500 * time.Millisecond},
+	}
+	for _, tst := range tests {
+		o := NewHTTPOptions(base + tst.query)
+		o.DisableFastClient = true
+		o.AddAndValidateExtraHeader(DeadlineHeader + ": " + FormatDeadline(time.Now().Add(tst.budget)))
+		client, _ := NewClient(o)
+		start := time.Now()
+		code, _, _ := client.Fetch()
+		elapsed := time.Since(start)
+		remaining := client.(ResponseHeaderer).ResponseHeader(DeadlineRemainingHeader)
+		client.Close()
+		if code != tst.status || elapsed > tst.maxDelay {
+			t.Errorf("%q %v: unexpected status %d after %v", tst.query, tst.budget, code, elapsed)
+		}
+		d, err := time.ParseDuration(remaining)
+		if err != nil || d > tst.budget || d < tst.budget-100*time.Millisecond {
+			t.Errorf("%q %v: unexpected remaining %q: %v", tst.query, tst.budget, remaining, err)
+		}
+	}
+	// Busy is spent on the cpu (at least for the busy duration), unlike a delay:
+	o := NewHTTPOptions(base + "?busy=50ms")
+	start := time.Now()
+	if code, _ := Fetch(o); code != http.StatusOK || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("unexpected code %d after %v for busy=50ms", code, time.Since(start))
+	}
+	// Invalid deadlines are ignored:
+	o = NewHTTPOptions(base + "?delay=10ms")
+	o.AddAndValidateExtraHeader(DeadlineHeader + ": tomorrow")
+	if code, _ := Fetch(o); code != http.StatusOK {
+		t.Errorf("unexpected code %d with invalid deadline", code)
+	}
+}
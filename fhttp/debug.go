@@ -0,0 +1,129 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/version"
+)
+
+// DebugReply is the ?format=json reply of the DebugHandler: the same request
+// dump as the text one, structured so automated tests (e.g. asserting what a
+// proxy forwards) don't have to parse it.
+type DebugReply struct {
+	Version    string
+	Hostname   string
+	Uptime     string
+	RemoteAddr string
+	LocalAddr  string
+	Method     string
+	URL        string
+	Proto      string
+	Host       string // removed from the Header by go
+	Header     http.Header
+	Body       DebugBody
+	TLS        *DebugTLS // nil for non TLS requests
+	Env        []string  // only with ?env=dump
+}
+
+// DebugBody describes the request body.
+type DebugBody struct {
+	Length  int
+	Summary string // see DebugSummary
+}
+
+// DebugTLS is the TLS state of the request's connection.
+type DebugTLS struct {
+	Version            string
+	CipherSuite        string
+	ServerName         string // SNI
+	NegotiatedProtocol string // ALPN
+	DidResume          bool
+	PeerCertificates   []string // subjects of the client certificates, if any
+}
+
+func newDebugTLS(s *tls.ConnectionState) *DebugTLS {
+	if s == nil {
+		return nil
+	}
+	res := DebugTLS{
+		Version:            periodic.TLSVersionName(s.Version),
+		CipherSuite:        tls.CipherSuiteName(s.CipherSuite),
+		ServerName:         s.ServerName,
+		NegotiatedProtocol: s.NegotiatedProtocol,
+		DidResume:          s.DidResume,
+	}
+	for _, c := range s.PeerCertificates {
+		res.PeerCertificates = append(res.PeerCertificates, c.Subject.String())
+	}
+	return &res
+}
+
+// write appends the text (DebugHandler) version of the TLS state to buf.
+func (d *DebugTLS) write(buf *bytes.Buffer) {
+	buf.WriteString("\n\ntls:\n\n")
+	_, _ = fmt.Fprintf(buf, "Version: %s\nCipher: %s\nALPN: %s\nSNI: %s\nResumed: %v",
+		d.Version, d.CipherSuite, d.NegotiatedProtocol, d.ServerName, d.DidResume)
+	for _, c := range d.PeerCertificates {
+		buf.WriteString("\nClient certificate: ")
+		buf.WriteString(c)
+	}
+}
+
+// debugJSONHandler is the json output mode of the DebugHandler.
+func debugJSONHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errf("Error reading %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hostname, _ := os.Hostname()
+	res := DebugReply{
+		Version:    version.Long(),
+		Hostname:   hostname,
+		Uptime:     fmt.Sprint(RoundDuration(time.Since(startTime))),
+		RemoteAddr: r.RemoteAddr,
+		Method:     r.Method,
+		URL:        r.URL.String(),
+		Proto:      r.Proto,
+		Host:       r.Host,
+		Header:     r.Header,
+		Body:       DebugBody{len(data), DebugSummary(data, 512)},
+		TLS:        newDebugTLS(r.TLS),
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		res.LocalAddr = addr.String()
+	}
+	if r.FormValue("env") == "dump" {
+		res.Env = os.Environ()
+	}
+	b, _ := json.MarshalIndent(res, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(b); err != nil {
+		log.Errf("Error writing response %v to %v", err, r.RemoteAddr)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestDebugHandlerJSON(t *testing.T) {
+	m, a := DynamicHTTPServer(false)
+	m.HandleFunc("/debug", DebugHandler)
+	url := fmt.Sprintf("http://localhost:%d/debug?format=json", a.Port)
+	o := HTTPOptions{URL: url, Payload: []byte("abc=def")}
+	o.AddAndValidateExtraHeader("X-Foo: bar")
+	o.AddAndValidateExtraHeader("Content-Type: application/x-www-form-urlencoded")
+	client, _ := NewClient(&o)
+	code, data, header := client.Fetch()
+	if code != http.StatusOK {
+		t.Errorf("Got %d instead of 200", code)
+	}
+	if ct := client.(ResponseHeaderer).ResponseHeader("Content-Type"); ct != "application/json" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	var res DebugReply
+	if err := json.Unmarshal(data[header:], &res); err != nil {
+		t.Fatalf("unable to parse %q: %v", data[header:], err)
+	}
+	if res.Method != "POST" || res.URL != "/debug?format=json" || res.Proto != "HTTP/1.1" ||
+		res.Host != fmt.Sprintf("localhost:%d", a.Port) || res.Header.Get("X-Foo") != "bar" ||
+		res.Header.Get("User-Agent") != userAgent || !strings.HasSuffix(res.LocalAddr, fmt.Sprintf(":%d", a.Port)) {
+		t.Errorf("unexpected request dump %+v", res)
+	}
+	// The form body wasn't consumed by the format parameter parsing:
+	if res.Body.Length != 7 || !strings.Contains(res.Body.Summary, "abc=def") {
+		t.Errorf("unexpected body %+v", res.Body)
+	}
+	if res.TLS != nil || res.Env != nil || res.Version == "" || res.RemoteAddr == "" {
+		t.Errorf("unexpected %+v", res)
+	}
+	client.Close()
+}
+
+func TestDebugHandlerTLS(t *testing.T) {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(DebugHandler))
+	s.EnableHTTP2 = true
+	s.TLS = &tls.Config{ClientAuth: tls.RequestClientCert} // nolint: gosec // test server
+	s.StartTLS()
+	defer s.Close()
+	dir, err := ioutil.TempDir("", "fortio-debug-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := path.Join(dir, "client.crt"), path.Join(dir, "client.key")
+	writeTestCert(t, certFile, keyFile, "fortio test client")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := s.Client()
+	tr := client.Transport.(*http.Transport)
+	tr.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	tr.TLSClientConfig.ServerName = "example.com" // in the httptest cert
+	get := func(query string) string {
+		resp, err := client.Get(s.URL + "/foo" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return string(data)
+	}
+	var res DebugReply
+	data := get("?format=json&env=dump")
+	if err := json.Unmarshal([]byte(data), &res); err != nil {
+		t.Fatalf("unable to parse %q: %v", data, err)
+	}
+	if res.TLS == nil {
+		t.Fatalf("no tls state in %+v", res)
+	}
+	expected := DebugTLS{
+		Version:            "TLS 1.3",
+		CipherSuite:        res.TLS.CipherSuite,
+		ServerName:         "example.com",
+		NegotiatedProtocol: "h2",
+		PeerCertificates:   []string{"CN=fortio test client"},
+	}
+	if res.TLS.CipherSuite == "" || fmt.Sprint(*res.TLS) != fmt.Sprint(expected) {
+		t.Errorf("unexpected tls state %+v", res.TLS)
+	}
+	if len(res.Env) == 0 || res.Method != "GET" || res.Proto != "HTTP/2.0" || res.Body.Length != 0 {
+		t.Errorf("unexpected %+v", res)
+	}
+	text := get("")
+	expectedText := fmt.Sprintf("\n\ntls:\n\nVersion: TLS 1.3\nCipher: %s\nALPN: h2\nSNI: example.com\n"+
+		"Resumed: false\nClient certificate: CN=fortio test client\n\nbody:", res.TLS.CipherSuite)
+	if !strings.Contains(text, expectedText) {
+		t.Errorf("tls state not found in %q", text)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// maxStatusCounted is the upper bound (excluded) of the status codes counted
+// individually, others are counted as 0.
+const maxStatusCounted = 1000
+
+// counterShard is one set of counters, updated by the handlers running on
+// (mostly) the same P.
+type counterShard struct {
+	requests int64
+	status   [maxStatusCounted]int64
+	_        [64]byte // padding so shards don't share a cache line
+}
+
+// echoCounters are the echo server request counters. They are sharded to
+// avoid all the handlers contending on the same cache line at high request
+// rates and aggregated on read. The sync.Pool of shards gives P affinity
+// without locking nor allocating.
+type echoCounters struct {
+	shards []counterShard
+	next   uint32
+	pool   sync.Pool
+}
+
+func newEchoCounters(numShards int) *echoCounters {
+	c := &echoCounters{shards: make([]counterShard, numShards)}
+	c.pool.New = func() interface{} {
+		i := int(atomic.AddUint32(&c.next, 1)) % len(c.shards)
+		return &c.shards[i]
+	}
+	return c
+}
+
+// record counts one request with the given response status.
+func (c *echoCounters) record(status int) {
+	s := c.pool.Get().(*counterShard)
+	atomic.AddInt64(&s.requests, 1)
+	if status < 0 || status >= maxStatusCounted {
+		status = 0
+	}
+	atomic.AddInt64(&s.status[status], 1)
+	c.pool.Put(s)
+}
+
+// requests returns the total number of requests recorded.
+func (c *echoCounters) requests() int64 {
+	var total int64
+	for i := range c.shards {
+		total += atomic.LoadInt64(&c.shards[i].requests)
+	}
+	return total
+}
+
+// statusCounts returns the number of requests recorded for each status.
+func (c *echoCounters) statusCounts() map[int]int64 {
+	res := make(map[int]int64)
+	for i := range c.shards {
+		for code := range c.shards[i].status {
+			if n := atomic.LoadInt64(&c.shards[i].status[code]); n > 0 {
+				res[code] += n
+			}
+		}
+	}
+	return res
+}
+
+var echoCounts = newEchoCounters(runtime.NumCPU())
+
+// EchoRequestCount returns the number of requests received by the echo
+// handler, like EchoRequests but counted without contention. Only updated in
+// Debug mode.
+func EchoRequestCount() int64 {
+	return echoCounts.requests()
+}
+
+// EchoStatusCounts returns the number of requests received by the echo
+// handler for each response status (statuses >= 1000 are counted as 0).
+// Only updated in Debug mode.
+func EchoStatusCounts() map[int]int64 {
+	return echoCounts.statusCounts()
+}
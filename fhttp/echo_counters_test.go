@@ -0,0 +1,84 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"fortio.org/fortio/log"
+)
+
+func TestEchoCountersConcurrent(t *testing.T) {
+	c := newEchoCounters(4)
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				if g%2 == 0 {
+					c.record(200)
+				} else {
+					c.record(1234) // out of range, counted as 0
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if n := c.requests(); n != 16000 {
+		t.Errorf("Got %d requests, expected 16000", n)
+	}
+	counts := c.statusCounts()
+	if len(counts) != 2 || counts[200] != 8000 || counts[0] != 8000 {
+		t.Errorf("Unexpected status counts %v", counts)
+	}
+}
+
+func TestEchoCountersHandler(t *testing.T) {
+	prev := log.SetLogLevel(log.Debug) // only counted in debug mode
+	defer log.SetLogLevel(prev)
+	m, a := DynamicHTTPServer(false)
+	m.HandleFunc("/echo", EchoHandler)
+	before := EchoRequestCount()
+	beforeVar := atomic.LoadInt64(&EchoRequests)
+	before503 := EchoStatusCounts()[503]
+	for _, status := range []int{200, 503, 503} {
+		o := NewHTTPOptions(fmt.Sprintf("http://localhost:%d/echo?status=%d", a.Port, status))
+		if code, _ := Fetch(o); code != status {
+			t.Errorf("Got %d, expected %d", code, status)
+		}
+	}
+	if n := EchoRequestCount() - before; n != 3 {
+		t.Errorf("Got %d more requests, expected 3", n)
+	}
+	if n := atomic.LoadInt64(&EchoRequests) - beforeVar; n != 3 {
+		t.Errorf("Got %d more requests in EchoRequests, expected 3", n)
+	}
+	if n := EchoStatusCounts()[503] - before503; n != 2 {
+		t.Errorf("Got %d more 503s, expected 2", n)
+	}
+}
+
+func BenchmarkEchoCounters(b *testing.B) {
+	c := newEchoCounters(8)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.record(200)
+		}
+	})
+}
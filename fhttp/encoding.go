@@ -0,0 +1,184 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"fortio.org/fortio/log"
+)
+
+const (
+	// DecodableEncodings is the Accept-Encoding sent when decompressing (see
+	// HTTPOptions.Decompress) without an explicit AcceptEncoding.
+	DecodableEncodings = "gzip, deflate"
+	// IdentityEncoding is the ContentEncodings key of the uncompressed responses.
+	IdentityEncoding = "identity"
+)
+
+// acceptEncoding returns the Accept-Encoding header to send, if any.
+func (h *HTTPOptions) acceptEncoding() string {
+	if h.AcceptEncoding == "" && h.Decompress {
+		return DecodableEncodings
+	}
+	return h.AcceptEncoding
+}
+
+// undecodableEncodings returns the encodings listed in the Accept-Encoding
+// header which can't be decoded (e.g. br or *), the refused ones (q=0) aside.
+func undecodableEncodings(accept string) []string {
+	var res []string
+	for _, e := range strings.Split(accept, ",") {
+		params := strings.Split(e, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		switch name {
+		case "", IdentityEncoding, "gzip", "x-gzip", "deflate":
+			continue
+		}
+		refused := false
+		for _, p := range params[1:] {
+			if q := strings.Split(strings.TrimSpace(p), "="); len(q) == 2 && strings.TrimSpace(q[0]) == "q" {
+				if v, err := strconv.ParseFloat(strings.TrimSpace(q[1]), 64); err == nil && v == 0 {
+					refused = true
+				}
+			}
+		}
+		if !refused {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// contentDecoder decodes the compressed response bodies of a thread, reusing
+// its readers and buffer.
+type contentDecoder struct {
+	gz      *gzip.Reader
+	fl      io.ReadCloser
+	reader  bytes.Reader
+	chunked []byte // de-chunked body of the fast client's chunked responses
+}
+
+// decodedSize returns the size of the body once decoded, false when the
+// encoding isn't supported (e.g. br sent without being asked for), in which
+// case the body is counted as is.
+func (d *contentDecoder) decodedSize(encoding string, body []byte) (int64, bool, error) {
+	d.reader.Reset(body)
+	var r io.Reader
+	switch encoding {
+	case IdentityEncoding:
+		return int64(len(body)), true, nil
+	case "gzip", "x-gzip":
+		if d.gz == nil {
+			gz, err := gzip.NewReader(&d.reader)
+			if err != nil {
+				return 0, true, err
+			}
+			d.gz = gz
+		} else if err := d.gz.Reset(&d.reader); err != nil {
+			return 0, true, err
+		}
+		r = d.gz
+	case "deflate":
+		if d.fl == nil {
+			d.fl = flate.NewReader(&d.reader)
+		} else if err := d.fl.(flate.Resetter).Reset(&d.reader, nil); err != nil {
+			return 0, true, err
+		}
+		r = d.fl
+	default:
+		return int64(len(body)), false, nil
+	}
+	n, err := io.Copy(ioutil.Discard, r)
+	return n, true, err
+}
+
+// dechunk returns the data of a raw chunked body (as read by the fast client).
+func (d *contentDecoder) dechunk(body []byte) ([]byte, error) {
+	d.chunked = d.chunked[:0]
+	for {
+		off, size := ParseChunkSize(body)
+		if size < 0 || off+size > len(body) {
+			return d.chunked, fmt.Errorf("truncated chunked body")
+		}
+		if size == 0 {
+			return d.chunked, nil
+		}
+		d.chunked = append(d.chunked, body[off:off+size]...)
+		body = body[off+size:]
+		if len(body) >= 2 { // CRLF after the data
+			body = body[2:]
+		}
+	}
+}
+
+// recordEncoding counts the Content-Encoding of the last response and its body
+// bytes, decoded too when decompressing.
+func (httpstate *HTTPRunnerResults) recordEncoding(body []byte, headerSize int) {
+	header := httpstate.encodingHeaders.ResponseHeader
+	encoding := strings.ToLower(header("Content-Encoding"))
+	if encoding == "" {
+		encoding = IdentityEncoding
+	}
+	httpstate.ContentEncodings[encoding]++
+	wire := body[headerSize:]
+	if headerSize > 0 && strings.EqualFold(header("Transfer-Encoding"), "chunked") {
+		var err error
+		if wire, err = httpstate.decoder.dechunk(wire); err != nil {
+			log.LogVf("Unable to de-chunk response: %v", err)
+		}
+	}
+	httpstate.WireBytes += int64(len(wire))
+	if !httpstate.Decompress {
+		return
+	}
+	n, decoded, err := httpstate.decoder.decodedSize(encoding, wire)
+	if err != nil {
+		log.LogVf("Unable to decode %s response: %v", encoding, err)
+		httpstate.DecodeErrors++
+		return
+	}
+	if !decoded {
+		httpstate.UndecodedResponses++
+	}
+	httpstate.DecodedBytes += n
+}
+
+// printEncodings prints the responses per Content-Encoding and the wire vs
+// decoded bytes.
+func printEncodings(out io.Writer, total *HTTPRunnerResults) {
+	keys := make([]string, 0, len(total.ContentEncodings))
+	for k := range total.ContentEncodings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(out, "Content-Encoding %s : %d\n", k, total.ContentEncodings[k])
+	}
+	if !total.Decompress {
+		_, _ = fmt.Fprintf(out, "Body bytes received: %d (kept compressed)\n", total.WireBytes)
+		return
+	}
+	_, _ = fmt.Fprintf(out, "Body bytes received: %d, decoded: %d (%.2fx), decode errors: %d, not decoded: %d\n",
+		total.WireBytes, total.DecodedBytes, total.CompressionRatio, total.DecodeErrors, total.UndecodedResponses)
+}
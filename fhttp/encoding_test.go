@@ -0,0 +1,166 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDecodedSize(t *testing.T) {
+	plain := []byte(strings.Repeat("fortio compresses well ", 100))
+	var gz, fl bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	_, _ = w.Write(plain)
+	w.Close()
+	f, _ := flate.NewWriter(&fl, flate.DefaultCompression)
+	_, _ = f.Write(plain)
+	f.Close()
+	d := contentDecoder{}
+	for i := 0; i < 2; i++ { // the 2nd time reusing the readers
+		for _, tst := range []struct {
+			encoding string
+			body     []byte
+			expected int64
+			decoded  bool
+		}{
+			{IdentityEncoding, plain, int64(len(plain)), true},
+			{"gzip", gz.Bytes(), int64(len(plain)), true},
+			{"deflate", fl.Bytes(), int64(len(plain)), true},
+			{"br", gz.Bytes(), int64(gz.Len()), false},
+		} {
+			n, decoded, err := d.decodedSize(tst.encoding, tst.body)
+			if err != nil || n != tst.expected || decoded != tst.decoded {
+				t.Errorf("%s: got %d %v %v instead of %d %v", tst.encoding, n, decoded, err, tst.expected, tst.decoded)
+			}
+		}
+	}
+	if _, _, err := d.decodedSize("gzip", plain); err == nil {
+		t.Errorf("expected an error decoding a non gzip body")
+	}
+	data, err := d.dechunk([]byte("5\r\nhello\r\n7\r\n world!\r\n0\r\n\r\n"))
+	if err != nil || string(data) != "hello world!" {
+		t.Errorf("unexpected de-chunked %q %v", data, err)
+	}
+	if _, err = d.dechunk([]byte("5\r\nhel")); err == nil {
+		t.Errorf("expected an error for a truncated chunked body")
+	}
+}
+
+func TestUndecodableEncodings(t *testing.T) {
+	for _, tst := range []struct {
+		accept   string
+		expected string
+	}{
+		{"", ""},
+		{"gzip, deflate", ""},
+		{"GZIP;q=0.8, x-gzip, identity", ""},
+		{"br", "br"},
+		{"gzip, deflate, br", "br"},
+		{"br;q=0, gzip", ""},
+		{"br; q=0.5, zstd, *", "br,zstd,*"},
+		{"*;q=0, gzip", ""},
+	} {
+		if u := strings.Join(undecodableEncodings(tst.accept), ","); u != tst.expected {
+			t.Errorf("undecodableEncodings(%q) = %q, expected %q", tst.accept, u, tst.expected)
+		}
+	}
+}
+
+// compressedHandler replies with a gzip compressed body when accepted, chunked
+// unless asked for a length, or with a fake br one.
+func compressedHandler(plain []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accept := r.Header.Get("Accept-Encoding")
+		switch {
+		case strings.Contains(accept, "gzip"):
+			var gz bytes.Buffer
+			zw := gzip.NewWriter(&gz)
+			_, _ = zw.Write(plain)
+			zw.Close()
+			w.Header().Set("Content-Encoding", "gzip")
+			if r.FormValue("length") != "" {
+				w.Header().Set("Content-Length", strconv.Itoa(gz.Len()))
+			}
+			_, _ = w.Write(gz.Bytes()[:10])
+			w.(http.Flusher).Flush() // chunked without a length
+			_, _ = w.Write(gz.Bytes()[10:])
+		case strings.Contains(accept, "br"):
+			w.Header().Set("Content-Encoding", "br")
+			_, _ = w.Write([]byte("not really br"))
+		default:
+			_, _ = w.Write(plain)
+		}
+	}
+}
+
+func TestHTTPRunnerDecompress(t *testing.T) {
+	plain := []byte(strings.Repeat("fortio compresses well ", 100))
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/", compressedHandler(plain))
+	for _, std := range []bool{false, true} {
+		for _, query := range []string{"", "?length=1"} {
+			opts := HTTPRunnerOptions{}
+			opts.QPS = -1
+			opts.Exactly = 10
+			opts.NumThreads = 2
+			opts.URL = fmt.Sprintf("http://localhost:%d/%s", addr.Port, query)
+			opts.DisableFastClient = std
+			opts.Decompress = true
+			res, err := RunHTTPTest(&opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.ContentEncodings["gzip"] != 10 || res.DecodedBytes != int64(10*len(plain)) || res.DecodeErrors != 0 ||
+				res.WireBytes <= 0 || res.WireBytes >= res.DecodedBytes || res.CompressionRatio <= 1 ||
+				res.AcceptEncoding != DecodableEncodings {
+				t.Errorf("std %v %q: unexpected encodings %v wire %d decoded %d (%d errors) ratio %g accept %q", std, query,
+					res.ContentEncodings, res.WireBytes, res.DecodedBytes, res.DecodeErrors, res.CompressionRatio,
+					res.AcceptEncoding)
+			}
+		}
+		// Kept compressed, and br isn't decoded:
+		opts := HTTPRunnerOptions{}
+		opts.QPS = -1
+		opts.Exactly = 4
+		opts.NumThreads = 1
+		opts.URL = fmt.Sprintf("http://localhost:%d/", addr.Port)
+		opts.DisableFastClient = std
+		opts.AcceptEncoding = "br"
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.ContentEncodings["br"] != 4 || res.WireBytes != 4*13 || res.DecodedBytes != 0 {
+			t.Errorf("std %v: unexpected kept compressed %v wire %d decoded %d", std, res.ContentEncodings,
+				res.WireBytes, res.DecodedBytes)
+		}
+		opts.Decompress = true
+		if _, err = RunHTTPTest(&opts); err == nil || !strings.Contains(err.Error(), "can't decompress br encoded") {
+			t.Errorf("std %v: expected an error decompressing br, got %v", std, err)
+		}
+		opts.AcceptEncoding = "gzip;q=1, br;q=0"
+		opts.DiscardBody = true
+		if _, err = RunHTTPTest(&opts); err == nil {
+			t.Errorf("std %v: expected an error decompressing discarded bodies", std)
+		}
+	}
+}
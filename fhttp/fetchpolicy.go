@@ -0,0 +1,226 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"fortio.org/fortio/dflag"
+)
+
+var (
+	fetchAllow = dflag.DynStringSlice(flag.CommandLine, "fetch-allow", []string{},
+		"Comma separated list of [scheme://]host[:port] rules (host being a name, *.domain, * or a CIDR) of the "+
+			"targets the fetch and fetch2 proxy endpoints may fetch, see -fetch-default-deny. dynamic flag.").
+		WithValidator(validateFetchRules)
+	fetchDeny = dflag.DynStringSlice(flag.CommandLine, "fetch-deny", []string{},
+		"Comma separated list of [scheme://]host[:port] rules (host being a name, *.domain, * or a CIDR) of the "+
+			"targets the fetch and fetch2 proxy endpoints refuse, checked before -fetch-allow. dynamic flag.").
+		WithValidator(validateFetchRules)
+	fetchDefaultDeny = dflag.DynBool(flag.CommandLine, "fetch-default-deny", false,
+		"Refuse the fetch and fetch2 proxy targets not matching a -fetch-allow rule (instead of allowing the ones "+
+			"not matching a -fetch-deny rule). dynamic flag.")
+)
+
+// FetchRule matches fetch proxy targets: an optional scheme and port, and a
+// host which is either a name (case insensitive), "*.domain" for the domain's
+// sub domains, "*" for any host or a CIDR matching the ips the host resolves to.
+type FetchRule struct {
+	Scheme string // empty for any
+	Host   string
+	Port   string // empty for any
+	cidr   *net.IPNet
+}
+
+// ParseFetchRule parses a "[scheme://]host[:port]" FetchRule.
+func ParseFetchRule(s string) (FetchRule, error) {
+	var r FetchRule
+	s = strings.TrimSpace(s)
+	if i := strings.Index(s, "://"); i >= 0 {
+		r.Scheme = strings.ToLower(s[:i])
+		s = s[i+3:]
+	}
+	r.Host = s
+	// CIDRs (including ipv6 ones) can't have a port:
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		r.cidr = n
+		return r, nil
+	}
+	if host, port, err := net.SplitHostPort(s); err == nil {
+		r.Host, r.Port = host, port
+		if _, n, err := net.ParseCIDR(host); err == nil {
+			r.cidr = n
+		}
+	}
+	// "name." is the same fully qualified name as "name":
+	r.Host = strings.TrimSuffix(strings.ToLower(strings.Trim(r.Host, "[]")), ".")
+	if r.Host == "" || (r.cidr == nil && strings.ContainsAny(r.Host, "/ ")) {
+		return r, fmt.Errorf("invalid fetch rule %q, expecting [scheme://]host[:port] with host a name, *.domain, * or a cidr", s)
+	}
+	return r, nil
+}
+
+// ParseFetchRules parses a list of FetchRule, ignoring empty entries.
+func ParseFetchRules(rules []string) ([]FetchRule, error) {
+	var res []FetchRule
+	for _, s := range rules {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		r, err := ParseFetchRule(s)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+func validateFetchRules(rules []string) error {
+	_, err := ParseFetchRules(rules)
+	return err
+}
+
+// Matches returns true when the rule matches the target of scheme, host and
+// port, with ips being the ones the host resolves to (looked up by the caller
+// only when a rule needs them).
+func (r *FetchRule) Matches(scheme, host, port string, ips []net.IP) bool {
+	if r.Scheme != "" && r.Scheme != scheme {
+		return false
+	}
+	if r.Port != "" && r.Port != port {
+		return false
+	}
+	switch {
+	case r.cidr != nil:
+		for _, ip := range ips {
+			if r.cidr.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	case r.Host == "*":
+		return true
+	case strings.HasPrefix(r.Host, "*."):
+		return strings.HasSuffix(host, r.Host[1:])
+	}
+	return r.Host == host
+}
+
+// FetchPolicy decides which targets the fetch proxy may fetch: the ones not
+// matching a Deny rule which either match an Allow rule or, unless DefaultDeny,
+// don't match any rule.
+type FetchPolicy struct {
+	Allow       []FetchRule
+	Deny        []FetchRule
+	DefaultDeny bool
+}
+
+// CurrentFetchPolicy returns the fetch policy of the -fetch-allow, -fetch-deny
+// and -fetch-default-deny dynamic flags.
+func CurrentFetchPolicy() *FetchPolicy {
+	// Validated when set:
+	allow, _ := ParseFetchRules(fetchAllow.Get())
+	deny, _ := ParseFetchRules(fetchDeny.Get())
+	return &FetchPolicy{Allow: allow, Deny: deny, DefaultDeny: fetchDefaultDeny.Get()}
+}
+
+// Check returns an error when the target url isn't allowed by the policy.
+func (p *FetchPolicy) Check(u *url.URL) error {
+	if len(p.Allow) == 0 && len(p.Deny) == 0 && !p.DefaultDeny {
+		return nil
+	}
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".") // so "name." can't bypass the name rules
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if scheme == "https" {
+			port = "443"
+		}
+	}
+	var ips []net.IP
+	if p.needIPs() {
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		} else if resolved, err := net.LookupIP(host); err == nil {
+			ips = resolved
+		} else if p.denyIPs() {
+			// Can't tell if it's within a denied network, to be safe.
+			return fmt.Errorf("unable to resolve %q to check the fetch policy: %w", host, err)
+		}
+		// else it can only be allowed by a name rule (and will fail to fetch anyway).
+	}
+	for i := range p.Deny {
+		if p.Deny[i].Matches(scheme, host, port, ips) {
+			return fmt.Errorf("%s is denied by the fetch policy (%s)", u.Redacted(), p.Deny[i].String())
+		}
+	}
+	for i := range p.Allow {
+		if p.Allow[i].Matches(scheme, host, port, ips) {
+			return nil
+		}
+	}
+	if p.DefaultDeny {
+		return fmt.Errorf("%s isn't allowed by the fetch policy", u.Redacted())
+	}
+	return nil
+}
+
+// CheckFetchURL returns an error when the url doesn't parse or isn't allowed
+// by the CurrentFetchPolicy.
+func CheckFetchURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	return CurrentFetchPolicy().Check(u)
+}
+
+func (p *FetchPolicy) needIPs() bool {
+	return hasCIDR(p.Allow) || hasCIDR(p.Deny)
+}
+
+func (p *FetchPolicy) denyIPs() bool {
+	return hasCIDR(p.Deny)
+}
+
+func hasCIDR(rules []FetchRule) bool {
+	for i := range rules {
+		if rules[i].cidr != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the rule in its parsed form.
+func (r *FetchRule) String() string {
+	s := r.Host
+	if r.cidr != nil {
+		s = r.cidr.String()
+	}
+	if r.Port != "" {
+		s = net.JoinHostPort(s, r.Port)
+	}
+	if r.Scheme != "" {
+		s = r.Scheme + "://" + s
+	}
+	return s
+}
@@ -0,0 +1,141 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestParseFetchRule(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"example.com", "example.com"},
+		{"HTTPS://*.Example.com:8443", "https://*.example.com:8443"},
+		{"10.0.0.0/8", "10.0.0.0/8"},
+		{"10.1.2.3/8:80", "10.0.0.0/8:80"},
+		{"fd00::/8", "fd00::/8"},
+		{"[::1]:8080", "[::1]:8080"},
+		{"*:22", "*:22"},
+		{"Metadata.Internal.", "metadata.internal"},
+		{"*.corp.example.:443", "*.corp.example:443"},
+	}
+	for _, tst := range tests {
+		r, err := ParseFetchRule(tst.in)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", tst.in, err)
+			continue
+		}
+		if r.String() != tst.expected {
+			t.Errorf("got %q for %q, expected %q", r.String(), tst.in, tst.expected)
+		}
+	}
+	for _, bad := range []string{"http://", "a/b", "foo bar"} {
+		if _, err := ParseFetchRule(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+	if err := validateFetchRules([]string{"ok.com", " ", "a/b"}); err == nil {
+		t.Errorf("expected an error for the invalid rule")
+	}
+}
+
+func TestFetchPolicy(t *testing.T) {
+	rules := func(s ...string) []FetchRule {
+		r, err := ParseFetchRules(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	labs := FetchPolicy{
+		Allow:       rules("*.lab.example.com", "https://api.example.com", "192.168.0.0/16:8080"),
+		Deny:        rules("*:22", "secret.lab.example.com"),
+		DefaultDeny: true,
+	}
+	denyOnly := FetchPolicy{Deny: rules("169.254.0.0/16", "http://*.internal")}
+	denyNames := FetchPolicy{Deny: rules("metadata.internal", "*.corp.example.")}
+	tests := []struct {
+		policy  *FetchPolicy
+		url     string
+		allowed bool
+	}{
+		{&FetchPolicy{}, "http://anything:1234/", true},
+		{&labs, "http://a.lab.example.com/x", true},
+		{&labs, "http://A.LAB.example.com:8080/x", true},
+		{&labs, "http://lab.example.com/", false},
+		{&labs, "http://a.lab.example.com:22/", false},
+		{&labs, "https://secret.lab.example.com/", false},
+		{&labs, "https://api.example.com/v1", true},
+		{&labs, "http://api.example.com/v1", false},
+		{&labs, "http://192.168.1.2:8080/", true},
+		{&labs, "http://192.168.1.2/", false},
+		{&labs, "http://10.0.0.1:8080/", false},
+		{&denyOnly, "http://169.254.169.254/latest/meta-data/", false},
+		{&denyOnly, "http://db.internal/", false},
+		{&denyOnly, "https://localhost.internal/", false}, // unresolvable with a denied cidr
+		{&denyOnly, "https://localhost/", true},
+		{&denyOnly, "http://127.0.0.1:8080/", true},
+		{&denyOnly, "http://db.internal./", false},
+		{&denyNames, "http://metadata.internal/x", false},
+		{&denyNames, "http://metadata.internal./x", false},
+		{&denyNames, "http://a.corp.example/x", false},
+		{&denyNames, "http://a.corp.example./x", false},
+		{&denyNames, "http://corp.example./x", true},
+	}
+	for _, tst := range tests {
+		u, _ := url.Parse(tst.url)
+		err := tst.policy.Check(u)
+		if (err == nil) != tst.allowed {
+			t.Errorf("%s: expected allowed %t, got %v", tst.url, tst.allowed, err)
+		}
+	}
+}
+
+func TestFetchPolicyHandlers(t *testing.T) {
+	mux, addr := ServeTCP("0", "/debug")
+	mux.HandleFunc("/fetch2/", FetcherHandler2)
+	mux.Handle("/fetch/", http.StripPrefix("/fetch/", http.HandlerFunc(FetcherHandler)))
+	if err := fetchDeny.Set(fmt.Sprintf("localhost:%d", addr.Port)); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = fetchDeny.Set(" ") }()
+	for _, u := range []string{
+		fmt.Sprintf("localhost:%d/fetch2/?url=localhost:%d/debug", addr.Port, addr.Port),
+		fmt.Sprintf("localhost:%d/fetch/localhost:%d/debug", addr.Port, addr.Port),
+	} {
+		code, data := Fetch(&HTTPOptions{URL: u})
+		if code != http.StatusForbidden {
+			t.Errorf("Got %d %s instead of forbidden for %s", code, DebugSummary(data, 256), u)
+		}
+	}
+	// Redirects are checked too:
+	u := fmt.Sprintf("localhost:%d/fetch2/?url=127.0.0.1:%d/echo%%3fstatus%%3d302%%26header%%3dLocation:http://localhost:%d/debug",
+		addr.Port, addr.Port, addr.Port)
+	code, data := Fetch(&HTTPOptions{URL: u})
+	if code != http.StatusBadRequest {
+		t.Errorf("Got %d %s instead of bad request for a denied redirect %s", code, DebugSummary(data, 256), u)
+	}
+	if err := fetchDeny.Set(" "); err != nil {
+		t.Fatal(err)
+	}
+	if code, data = Fetch(&HTTPOptions{URL: u}); code != http.StatusOK {
+		t.Errorf("Got %d %s instead of ok once allowed for %s", code, DebugSummary(data, 256), u)
+	}
+}
@@ -0,0 +1,453 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+// HTTP/2 cleartext with prior knowledge (h2c) for the fast client: the raw
+// http/1.1 request, still built and updated in place like for http/1.1, is
+// sent as HEADERS and DATA frames (one stream at a time per connection) and
+// the response is written in the buffer as http/1.1 like headers followed by
+// the body, so the rest of fortio (header capture, sizes,...) is unchanged.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"fortio.org/fortio/log"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	// Our receive window, per stream and for the connection, large enough to
+	// never have to send stream window updates.
+	h2cWindow = 1 << 30
+	// Streams ids are 31 bits, we reconnect well before running out.
+	h2cMaxStreamID = 1 << 30
+	// Status line prefix of the responses written in the buffer, same length
+	// as the http/1.x one (retcodeOffset).
+	h2cStatusPrefix = "HTTP/2.0 "
+)
+
+// h2cConn is an http/2 connection and its state.
+type h2cConn struct {
+	conn       net.Conn
+	w          *bufio.Writer
+	framer     *http2.Framer
+	henc       *hpack.Encoder
+	hbuf       bytes.Buffer
+	streamID   uint32 // of the current (last) request
+	maxFrame   int    // peer's max frame size
+	sendWindow int    // connection send window
+	initWindow int    // peer's initial stream window
+	streamSend int    // current stream send window
+	received   int    // data received since our last connection window update
+	goAway     bool   // the server doesn't want new streams
+}
+
+// newH2CConn sends the client preface and settings on conn.
+func newH2CConn(conn net.Conn) (*h2cConn, error) {
+	h := h2cConn{
+		conn:       conn,
+		w:          bufio.NewWriter(conn),
+		maxFrame:   16384,
+		sendWindow: 65535,
+		initWindow: 65535,
+	}
+	h.framer = http2.NewFramer(h.w, conn)
+	h.framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	h.henc = hpack.NewEncoder(&h.hbuf)
+	if _, err := h.w.WriteString(http2.ClientPreface); err != nil {
+		return nil, err
+	}
+	err := h.framer.WriteSettings(
+		http2.Setting{ID: http2.SettingEnablePush, Val: 0},
+		http2.Setting{ID: http2.SettingInitialWindowSize, Val: h2cWindow},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err = h.framer.WriteWindowUpdate(0, h2cWindow-65535); err != nil {
+		return nil, err
+	}
+	return &h, h.w.Flush()
+}
+
+// reusable returns true if a new request can be sent on the connection.
+func (h *h2cConn) reusable() bool {
+	return !h.goAway && h.streamID < h2cMaxStreamID
+}
+
+// hopHeaders are the http/1.1 connection specific headers not allowed in http/2.
+var hopHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+// writeRequest sends the raw http/1.1 request req on a new stream.
+func (h *h2cConn) writeRequest(req []byte) error {
+	end := bytes.Index(req, []byte("\r\n\r\n"))
+	if end < 0 {
+		return fmt.Errorf("invalid raw request %q", DebugSummary(req, 256))
+	}
+	body := req[end+4:]
+	lines := strings.Split(string(req[:end]), "\r\n")
+	requestLine := strings.SplitN(lines[0], " ", 3)
+	if len(requestLine) != 3 {
+		return fmt.Errorf("invalid request line %q", lines[0])
+	}
+	if h.streamID == 0 {
+		h.streamID = 1
+	} else {
+		h.streamID += 2
+	}
+	h.hbuf.Reset()
+	headers := make([]hpack.HeaderField, 0, len(lines)+2)
+	headers = append(headers,
+		hpack.HeaderField{Name: ":method", Value: requestLine[0]},
+		hpack.HeaderField{Name: ":scheme", Value: "http"},
+		hpack.HeaderField{Name: ":path", Value: requestLine[1]})
+	for _, line := range lines[1:] {
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			continue
+		}
+		name, value := strings.ToLower(line[:i]), strings.TrimSpace(line[i+1:])
+		if hopHeaders[name] {
+			continue
+		}
+		if name == "host" {
+			name = ":authority"
+			headers = append(headers[:3], append([]hpack.HeaderField{{Name: name, Value: value}}, headers[3:]...)...)
+			continue
+		}
+		headers = append(headers, hpack.HeaderField{Name: name, Value: value})
+	}
+	for _, f := range headers {
+		if err := h.henc.WriteField(f); err != nil {
+			return err
+		}
+	}
+	block := h.hbuf.Bytes()
+	first := true
+	for first || len(block) > 0 {
+		n := len(block)
+		if n > h.maxFrame {
+			n = h.maxFrame
+		}
+		var err error
+		if first {
+			err = h.framer.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      h.streamID,
+				BlockFragment: block[:n],
+				EndStream:     len(body) == 0,
+				EndHeaders:    n == len(block),
+			})
+		} else {
+			err = h.framer.WriteContinuation(h.streamID, n == len(block), block[:n])
+		}
+		if err != nil {
+			return err
+		}
+		block = block[n:]
+		first = false
+	}
+	h.streamSend = h.initWindow
+	for len(body) > 0 {
+		n := h.sendable(len(body))
+		if n == 0 {
+			// Wait for window updates from the server:
+			if err := h.w.Flush(); err != nil {
+				return err
+			}
+			f, err := h.framer.ReadFrame()
+			if err != nil {
+				return err
+			}
+			if err = h.control(f); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := h.framer.WriteData(h.streamID, n == len(body), body[:n]); err != nil {
+			return err
+		}
+		h.sendWindow -= n
+		h.streamSend -= n
+		body = body[n:]
+	}
+	return h.w.Flush()
+}
+
+// sendable returns how many of the remaining body bytes can be sent in the next frame.
+func (h *h2cConn) sendable(remaining int) int {
+	n := remaining
+	for _, limit := range []int{h.maxFrame, h.sendWindow, h.streamSend} {
+		if limit < n {
+			n = limit
+		}
+	}
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// control handles the connection level frames (and the ones of other
+// streams), returns an error for RST_STREAM of the current stream or
+// GOAWAY not letting it complete.
+func (h *h2cConn) control(f http2.Frame) error {
+	switch f := f.(type) {
+	case *http2.SettingsFrame:
+		if f.IsAck() {
+			return nil
+		}
+		err := f.ForeachSetting(func(s http2.Setting) error {
+			switch s.ID { // nolint: exhaustive // others are not relevant to us
+			case http2.SettingMaxFrameSize:
+				h.maxFrame = int(s.Val)
+			case http2.SettingInitialWindowSize:
+				h.streamSend += int(s.Val) - h.initWindow
+				h.initWindow = int(s.Val)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return h.framer.WriteSettingsAck()
+	case *http2.PingFrame:
+		if !f.IsAck() {
+			return h.framer.WritePing(true, f.Data)
+		}
+	case *http2.WindowUpdateFrame:
+		if f.StreamID == 0 {
+			h.sendWindow += int(f.Increment)
+		} else if f.StreamID == h.streamID {
+			h.streamSend += int(f.Increment)
+		}
+	case *http2.GoAwayFrame:
+		h.goAway = true
+		if f.LastStreamID < h.streamID {
+			return fmt.Errorf("goaway %v before stream %d", f.ErrCode, h.streamID)
+		}
+	case *http2.RSTStreamFrame:
+		if f.StreamID == h.streamID {
+			return fmt.Errorf("stream reset %v", f.ErrCode)
+		}
+	default:
+		log.Debugf("Ignoring h2c frame %v", f.Header())
+	}
+	return nil
+}
+
+// consumed returns the data frame flow control bytes to the connection window.
+func (h *h2cConn) consumed(n int) error {
+	h.received += n
+	if h.received < h2cWindow/2 {
+		return nil
+	}
+	err := h.framer.WriteWindowUpdate(0, uint32(h.received))
+	h.received = 0
+	return err
+}
+
+// appendHeaders writes the response headers in the buffer, http/1.1 style.
+func (c *FastClient) appendHeaders(fields []hpack.HeaderField) {
+	var buf bytes.Buffer
+	buf.WriteString(h2cStatusPrefix + strconv.Itoa(c.code) + "\r\n")
+	for _, f := range fields {
+		if !f.IsPseudo() {
+			buf.WriteString(f.Name + ": " + f.Value + "\r\n")
+		}
+	}
+	buf.WriteString("\r\n")
+	c.size = copy(c.buffer, buf.Bytes())
+	c.headerLen = c.size
+	if c.size < buf.Len() {
+		log.Errf("Buffer too small (%d) for the %d bytes headers, increase -httpbufferkb", len(c.buffer), buf.Len())
+	}
+}
+
+// appendData adds the body bytes to the buffer, up to the body limit or the
+// buffer size, counting the rest as discarded.
+func (c *FastClient) appendData(data []byte) {
+	max := len(c.buffer)
+	if c.bodyLimit >= 0 && c.headerLen+c.bodyLimit < max {
+		max = c.headerLen + c.bodyLimit
+	}
+	n := 0
+	if c.size < max {
+		n = copy(c.buffer[c.size:max], data)
+		c.size += n
+	}
+	if n < len(data) {
+		if c.bodyLimit < 0 && c.discarded == 0 {
+			log.Errf("Buffer too small for the response, increase -httpbufferkb")
+		}
+		c.discarded += len(data) - n
+	}
+}
+
+// fetchH2C is the h2c version of fetch.
+func (c *FastClient) fetchH2C() (int, []byte, int) {
+	c.code = SocketError
+	c.size = 0
+	c.discarded = 0
+	c.headerLen = 0
+	h := c.h2c
+	reuse := (h != nil)
+	if !reuse {
+		conn := c.connect()
+		if conn == nil {
+			return c.returnRes()
+		}
+		var err error
+		h, err = newH2CConn(conn)
+		if err != nil {
+			log.Errf("Unable to start h2c connection to %v : %v", c.dest, err)
+			conn.Close()
+			return c.returnRes()
+		}
+	} else {
+		log.Debugf("Reusing h2c connection %v", h.conn)
+	}
+	c.h2c = nil // because of error returns and single retry
+	conErr := h.conn.SetDeadline(time.Now().Add(c.reqTimeout))
+	c.updateRequest(!reuse)
+	err := h.writeRequest(c.req)
+	if err != nil || conErr != nil {
+		h.conn.Close()
+		if reuse {
+			// it's ok for the (idle) connection to die once, auto reconnect:
+			log.Infof("Closing dead h2c connection %v (%v)", h.conn, err)
+			c.errorCount++
+			return c.fetchH2C() // recurse once
+		}
+		log.Errf("Unable to send h2c request to %v : %v", c.dest, err)
+		if isTimeout(err) {
+			c.code = TimeoutError
+		}
+		return c.returnRes()
+	}
+	if c.span != nil {
+		c.span.AddEvent("request_sent")
+	}
+	if c.longPoll {
+		c.reqSent = time.Now()
+	}
+	c.readH2CResponse(h, reuse)
+	if c.code == RetryOnce {
+		if c.span != nil {
+			c.span.AddEvent("retry")
+		}
+		return c.fetchH2C() // recurse once
+	}
+	return c.returnRes()
+}
+
+// readH2CResponse reads the frames until the end of the current stream.
+// nolint: gocognit,nestif
+func (c *FastClient) readH2CResponse(h *h2cConn, reusedConn bool) {
+	gotHeaders := false
+	done := false
+	for !done {
+		f, err := h.framer.ReadFrame()
+		if err != nil {
+			h.conn.Close()
+			if reusedConn && !gotHeaders && errors.Is(err, io.EOF) {
+				// Ok for reused connection to be closed once by the server
+				log.Infof("Closing dead h2c connection %v (err %v at first read)", h.conn, err)
+				c.errorCount++
+				c.code = RetryOnce
+				return
+			}
+			log.Errf("h2c read error %v %d : %v", c.dest, c.size, err)
+			c.code = SocketError
+			if isTimeout(err) {
+				c.code = TimeoutError
+			}
+			return
+		}
+		if f.Header().StreamID != h.streamID {
+			if err = h.control(f); err != nil {
+				h.conn.Close()
+				if reusedConn && !gotHeaders && h.goAway {
+					log.Infof("Server closing h2c connection %v: %v", h.conn, err)
+					c.errorCount++
+					c.code = RetryOnce
+					return
+				}
+				log.Errf("h2c error from %v : %v", c.dest, err)
+				c.code = SocketError
+				return
+			}
+			continue
+		}
+		if !gotHeaders && c.span != nil {
+			c.span.AddEvent("first_byte")
+		}
+		switch f := f.(type) {
+		case *http2.MetaHeadersFrame:
+			if gotHeaders { // trailers
+				done = f.StreamEnded()
+				continue
+			}
+			code, _ := strconv.Atoi(f.PseudoValue("status"))
+			if code < http.StatusOK { // informational (100 Continue...)
+				continue
+			}
+			c.code = code
+			c.appendHeaders(f.Fields)
+			gotHeaders = true
+			if !codeIsOK(c.code) && c.logErrors {
+				log.Warnf("[%d] Non ok http code %d (h2c)", c.id, c.code)
+			}
+			done = f.StreamEnded()
+		case *http2.DataFrame:
+			c.appendData(f.Data())
+			err = h.consumed(int(f.Length))
+			done = f.StreamEnded()
+		default:
+			err = h.control(f)
+		}
+		if err != nil {
+			h.conn.Close()
+			log.Errf("h2c error from %v : %v", c.dest, err)
+			c.code = SocketError
+			return
+		}
+	}
+	if log.LogDebug() {
+		log.Debugf("h2c stream %d: code %d, %d bytes (-%d headers), %d discarded",
+			h.streamID, c.code, c.size, c.headerLen, c.discarded)
+	}
+	// Flush the settings/ping acks and window update, if any:
+	if err := h.w.Flush(); err != nil || !c.keepAlive || !h.reusable() || (c.limits != nil && c.limits.next()) {
+		h.conn.Close()
+		return
+	}
+	c.h2c = h // keep the open connection
+}
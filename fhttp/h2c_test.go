@@ -0,0 +1,104 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestH2C(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	protos := make(chan string, 100)
+	mux.HandleFunc("/proto/", func(w http.ResponseWriter, r *http.Request) {
+		protos <- r.Proto + " " + r.Host + " " + r.URL.Path + " " + r.Header.Get("User-Agent")
+		EchoHandler(w, r)
+	})
+	base := fmt.Sprintf("http://localhost:%d/proto/", addr.Port)
+	// Large enough to need window updates from the server:
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 6000)
+	tests := []struct {
+		query   string
+		payload []byte
+		code    int
+		body    []byte
+	}{
+		{"", nil, http.StatusOK, []byte{}},
+		{"?header=X-Foo:bar", []byte("abc"), http.StatusOK, []byte("abc")},
+		{"?status=503", nil, http.StatusServiceUnavailable, []byte{}},
+		{"", payload, http.StatusOK, payload},
+	}
+	for _, keepAlive := range []bool{true, false} {
+		for _, tst := range tests {
+			o := NewHTTPOptions(base + tst.query)
+			o.H2C = true
+			o.DisableKeepAlive = !keepAlive
+			o.Payload = tst.payload
+			c, err := NewClient(o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				code, data, header := c.Fetch()
+				if code != tst.code || !bytes.Equal(data[header:], tst.body) {
+					t.Errorf("%q %d: unexpected %d %d bytes (%d header)", tst.query, len(tst.payload), code, len(data), header)
+				}
+				if !strings.HasPrefix(string(data), "HTTP/2.0 ") {
+					t.Errorf("%q: unexpected response headers %q", tst.query, data[:header])
+				}
+				p := <-protos
+				if !strings.HasPrefix(p, "HTTP/2.0 localhost:"+fmt.Sprint(addr.Port)+" /proto/ fortio.org/fortio-") {
+					t.Errorf("%q: unexpected request %q", tst.query, p)
+				}
+			}
+			if strings.Contains(tst.query, "X-Foo") && c.(ResponseHeaderer).ResponseHeader("X-Foo") != "bar" {
+				t.Errorf("header not found in %q", c.(*FastClient).buffer[:c.(*FastClient).headerLen])
+			}
+			expected := 1
+			if !keepAlive {
+				expected = 3
+			}
+			if sockets := c.Close(); sockets != expected {
+				t.Errorf("%q keepalive %v: unexpected %d sockets", tst.query, keepAlive, sockets)
+			}
+		}
+	}
+	// Server closing idle connections is handled transparently:
+	o := NewHTTPOptions(base + "?close=true")
+	o.H2C = true
+	c, _ := NewClient(o)
+	for i := 0; i < 3; i++ {
+		if code, _, _ := c.Fetch(); code != http.StatusOK {
+			t.Errorf("unexpected code %d with closing server", code)
+		}
+		<-protos
+	}
+	c.Close()
+	// Body limit:
+	o = NewHTTPOptions(base)
+	o.H2C = true
+	o.Payload = payload
+	o.ReadLimit = 100
+	c, _ = NewClient(o)
+	code, data, header := c.Fetch()
+	<-protos
+	if code != http.StatusOK || len(data)-header != 100 || c.(ResponseSizer).ResponseSize() != header+len(payload) {
+		t.Errorf("unexpected read limit result %d %d %d", code, len(data)-header, c.(ResponseSizer).ResponseSize())
+	}
+	c.Close()
+}
@@ -0,0 +1,153 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// ParseHeaderSets parses header sets: blocks of "Key: Value" lines separated
+// by empty lines, lines starting with # being comments. Typically each set is
+// a realistic browser/device combination (User-Agent, Accept-Language,...).
+func ParseHeaderSets(data string) ([]http.Header, error) {
+	var sets []http.Header
+	var cur http.Header
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line == "" {
+			cur = nil
+			continue
+		}
+		s := strings.SplitN(line, ":", 2)
+		if len(s) != 2 || strings.TrimSpace(s[0]) == "" {
+			return nil, fmt.Errorf("invalid header line %d %q, expecting Key: Value", i+1, line)
+		}
+		if cur == nil {
+			cur = make(http.Header)
+			sets = append(sets, cur)
+		}
+		cur.Add(strings.TrimSpace(s[0]), strings.TrimSpace(s[1]))
+	}
+	if len(sets) == 0 {
+		return nil, fmt.Errorf("no header set found")
+	}
+	return sets, nil
+}
+
+// ParseUserAgents parses user agents, one per line (empty lines and # comments
+// are ignored), into single User-Agent header sets.
+func ParseUserAgents(data string) ([]http.Header, error) {
+	var sets []http.Header
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sets = append(sets, http.Header{"User-Agent": []string{line}})
+	}
+	if len(sets) == 0 {
+		return nil, fmt.Errorf("no user agent found")
+	}
+	return sets, nil
+}
+
+// ReadHeaderSets reads the header sets (see ParseHeaderSets) from a file, or
+// user agents (see ParseUserAgents) when userAgents is true.
+func ReadHeaderSets(file string, userAgents bool) ([]http.Header, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var sets []http.Header
+	if userAgents {
+		sets, err = ParseUserAgents(string(data))
+	} else {
+		sets, err = ParseHeaderSets(string(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return sets, nil
+}
+
+// headerSets rotates, round robin, through the HTTPOptions.HeaderSets for a
+// client: each request gets the next set, starting from a different one for
+// each client. Not thread safe, each client has its own.
+type headerSets struct {
+	std  []http.Header // full request headers for each set (std client)
+	raw  [][]byte      // raw headers of each set (fast client)
+	next int
+}
+
+// baseHeaders returns the request headers without the ones the sets replace
+// (from -H and the default User-Agent).
+func baseHeaders(o *HTTPOptions) http.Header {
+	headers := o.GenerateHeaders().Clone()
+	for _, set := range o.HeaderSets {
+		for k := range set {
+			headers.Del(k)
+		}
+	}
+	return headers
+}
+
+func newHeaderSets(o *HTTPOptions) *headerSets {
+	if len(o.HeaderSets) == 0 {
+		return nil
+	}
+	base := baseHeaders(o)
+	h := &headerSets{next: o.ID % len(o.HeaderSets)}
+	for _, set := range o.HeaderSets {
+		full := base.Clone()
+		for k, v := range set {
+			full[k] = v
+		}
+		var buf bytes.Buffer
+		_ = set.Write(&buf)
+		h.std = append(h.std, full)
+		h.raw = append(h.raw, buf.Bytes())
+	}
+	return h
+}
+
+// nextIndex returns the index of the set to use for the next request.
+func (h *headerSets) nextIndex() int {
+	i := h.next
+	h.next = (h.next + 1) % len(h.std)
+	return i
+}
+
+// nextHeaderSet rebuilds the fast client's raw request with the next header
+// set, moving the {uuid} offsets after it (in the payload) accordingly.
+func (c *FastClient) nextHeaderSet() {
+	set := c.headerSets.raw[c.headerSets.nextIndex()]
+	end := c.headerSetOff + c.headerSetLen
+	c.reqAlt = append(append(append(c.reqAlt[:0], c.req[:c.headerSetOff]...), set...), c.req[end:]...)
+	c.req, c.reqAlt = c.reqAlt, c.req
+	delta := len(set) - c.headerSetLen
+	for i, off := range c.uuidOffsets {
+		if off >= end {
+			c.uuidOffsets[i] += delta
+		}
+	}
+	c.headerSetLen = len(set)
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+const testHeaderSets = `# desktop
+User-Agent: Mozilla/5.0 (X11; Linux x86_64) Firefox/90.0
+Accept-Language: en-US
+
+# mobile, longer
+user-agent: Mozilla/5.0 (iPhone; CPU iPhone OS 14_6 like Mac OS X) Mobile/15E148 Safari/604.1
+Accept-Language: fr-FR, fr;q=0.9
+Sec-Ch-Ua-Mobile: ?1
+`
+
+func TestParseHeaderSets(t *testing.T) {
+	sets, err := ParseHeaderSets(testHeaderSets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sets) != 2 || len(sets[0]) != 2 || len(sets[1]) != 3 {
+		t.Fatalf("Unexpected sets %v", sets)
+	}
+	if sets[1].Get("User-Agent") != "Mozilla/5.0 (iPhone; CPU iPhone OS 14_6 like Mac OS X) Mobile/15E148 Safari/604.1" {
+		t.Errorf("Unexpected user agent %q", sets[1].Get("User-Agent"))
+	}
+	for _, bad := range []string{"", "# just a comment\n\n", "User-Agent: ok\nno colon"} {
+		if _, err = ParseHeaderSets(bad); err == nil {
+			t.Errorf("Expected error for %q", bad)
+		}
+	}
+	uas, err := ParseUserAgents("ua1\n\n# comment\nua 2\n")
+	if err != nil || len(uas) != 2 || uas[1].Get("User-Agent") != "ua 2" {
+		t.Errorf("Unexpected user agents %v: %v", uas, err)
+	}
+	if _, err = ParseUserAgents("\n#\n"); err == nil {
+		t.Errorf("Expected error for no user agent")
+	}
+}
+
+func TestHTTPRunnerHeaderSets(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	var mu sync.Mutex
+	var seen map[string]int // user agent|language to count
+	bodyRe := regexp.MustCompile("^id=[0-9a-f-]{36}$")
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		if !bodyRe.Match(body) || r.Header.Get("X-Env") != "test" {
+			t.Errorf("Unexpected body %q or headers %v", body, r.Header)
+		}
+		seen[r.Header.Get("User-Agent")+"|"+r.Header.Get("Accept-Language")]++
+	})
+	sets, _ := ParseHeaderSets(testHeaderSets)
+	for _, std := range []bool{false, true} {
+		seen = make(map[string]int)
+		opts := HTTPRunnerOptions{}
+		opts.QPS = 100
+		opts.Exactly = 20
+		opts.NumThreads = 2
+		opts.URL = fmt.Sprintf("http://localhost:%d/", addr.Port)
+		opts.DisableFastClient = std
+		opts.Payload = []byte("id={uuid}")
+		_ = opts.AddAndValidateExtraHeader("X-Env: test")
+		_ = opts.AddAndValidateExtraHeader("Accept-Language: de") // replaced by the sets
+		opts.HeaderSets = sets
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.RetCodes[http.StatusOK] != 20 {
+			t.Errorf("std %v: unexpected codes %v", std, res.RetCodes)
+		}
+		mu.Lock()
+		if len(seen) != 2 || seen[sets[0].Get("User-Agent")+"|en-US"] != 10 ||
+			seen[sets[1].Get("User-Agent")+"|fr-FR, fr;q=0.9"] != 10 {
+			t.Errorf("std %v: expected the 2 sets 10 times each, got %v", std, seen)
+		}
+		mu.Unlock()
+	}
+}
@@ -20,21 +20,29 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"fortio.org/fortio/fnet"
 	"fortio.org/fortio/log"
+	"fortio.org/fortio/otlp"
+	"fortio.org/fortio/periodic"
 	"fortio.org/fortio/version"
 	"github.com/google/uuid"
 )
@@ -116,6 +124,12 @@ func (h *HTTPOptions) GenerateHeaders() http.Header {
 	if len(h.ContentType) > 0 {
 		allHeaders.Set(contentType, h.ContentType)
 	}
+	if h.ServerTiming {
+		allHeaders.Set(TimingHeader, "1")
+	}
+	if acceptEncoding := h.acceptEncoding(); acceptEncoding != "" {
+		allHeaders.Set("Accept-Encoding", acceptEncoding)
+	}
 	// Add content-length unless already set in custom headers (or we're not doing a POST)
 	if (payloadLen > 0 || len(h.ContentType) > 0) && len(allHeaders.Get(contentLength)) == 0 {
 		allHeaders.Set(contentLength, strconv.Itoa(payloadLen))
@@ -178,7 +192,8 @@ type HTTPOptions struct {
 	CACert            string // `Path` to a custom CA certificate file to be used
 	Cert              string // `Path` to the certificate file to be used
 	Key               string // `Path` to the key file used
-	Resolve           string // resolve Common Name to this ip when use CN as target url
+	Resolve           string // resolve Common Name to this ip when use CN as target url, or curl style host:port:ip
+	SNI               string // TLS server name to present instead of the url's host (std client only)
 	// ExtraHeaders to be added to each request (UserAgent and headers set through AddAndValidateExtraHeader()).
 	extraHeaders http.Header
 	// Host is treated specially, remember that virtual header separately.
@@ -192,6 +207,109 @@ type HTTPOptions struct {
 	UnixDomainSocket string // Path of unix domain socket to use instead of host:port from URL
 	LogErrors        bool   // whether to log non 2xx code as they occur or not
 	ID               int    // id to use for logging (thread id when used as a runner)
+	// TraceHeaders is the trace context headers to generate on each request: TraceW3C, TraceB3 or empty for none.
+	TraceHeaders string
+	// TracePerConnection keeps the same trace id (new span id) for all the requests made on a connection.
+	TracePerConnection bool
+	// SpanExporter when set receives a client span, with the phases as events, for sampled requests.
+	SpanExporter *otlp.Exporter
+	// DiscardBody reads and counts the response body bytes without keeping them.
+	DiscardBody bool
+	// ReadLimit when > 0 keeps at most that many bytes of the response body, the rest is read and counted
+	// but discarded. 0 keeps the whole body.
+	ReadLimit int
+	// AffinityHeader when set is the header carrying an affinity key ("user" id), from 0 to AffinityKeys-1,
+	// each key being always sent on the same connection (see ValidateAffinity).
+	AffinityHeader string
+	AffinityKeys   int
+	numConnections int // number of clients/connections the keys are spread on, set by the runner
+	// SendDeadline adds the DeadlineHeader with each request's deadline: its start plus HTTPReqTimeOut.
+	SendDeadline bool
+	// ServerTiming adds the TimingHeader to the requests, for the echo server to return its processing
+	// timestamps (see ServerTime).
+	ServerTiming bool
+	// AcceptEncoding is the Accept-Encoding header to send (e.g. "gzip, deflate"), the responses being kept
+	// compressed unless Decompress.
+	AcceptEncoding string
+	// Decompress decodes the gzip and deflate responses, counting both their wire and decoded bytes,
+	// and asks for them (DecodableEncodings) when no AcceptEncoding is set. The runs are refused when
+	// the AcceptEncoding lists other encodings (e.g. br) which couldn't be decoded.
+	Decompress bool
+	// LatencyBreakdown times the phases of each request: DNS, connect, TLS, time to first byte and body
+	// (see LatencyPhases, http/1.x only for the fast client).
+	LatencyBreakdown bool
+	// H2C makes the fast client speak HTTP/2 cleartext with prior knowledge (no upgrade) instead of http/1.1.
+	H2C bool
+	// Shared client certificate when reloaded during the run, set by the runner.
+	certs *certReloader
+	// HeaderSets when set are rotated through, one set per request, replacing the same
+	// headers from -H and the default User-Agent (see ParseHeaderSets).
+	HeaderSets []http.Header
+	// CaptureHeader when set is the response header whose values are counted (see HeaderCapturer).
+	CaptureHeader string
+	// Replay when set are recorded requests (see RecordRequests) sent in turn, one per call: their
+	// method, path and query (on the URL's host), headers and body size. Implies the std client.
+	Replay []RecordedRequest
+	// Each call replays the next request in order, across the clients (set by RunReplay).
+	replayInOrder bool
+	// MethodMix when set is the methods, with their payload, of the requests in proportion of their
+	// weights, e.g. 90% GET and 10% POST (see ParseMethodMix). Implies the std client.
+	MethodMix []MixedMethod
+	// ConnMaxLifetime and ConnMaxRequests when > 0 close each keep-alive connection (for a new
+	// one to be made) once it's that old or made that many requests, like proxies recycling
+	// their connections, e.g. to test the server's accept rate under steady churn.
+	ConnMaxLifetime time.Duration
+	ConnMaxRequests int
+	// ConnReuseRange when set (max > 0) replaces ConnMaxRequests with a number of requests
+	// picked at random, for each connection, between its min and max (see ParseConnReuseRange).
+	ConnReuseRange [2]int
+	// SlowWriteInterval when > 0 makes the fast client write its requests SlowWriteBytes (default 1)
+	// at a time with that interval in between, simulating slow clients (slow loris) to check the
+	// target's timeouts and protections, in a controlled test (see slowwrite.go).
+	SlowWriteInterval time.Duration
+	SlowWriteBytes    int
+	// Closed when the run is aborted, to interrupt the slow writes, set by the runner.
+	slowWriteAbort <-chan struct{}
+	// Proxy when set is the forward proxy the connections go through: socks5://[user:password@]host:port
+	// or http://[user:password@]host:port (CONNECT tunnel for the fast client, see ParseProxy).
+	Proxy string
+	// TLSResumption enables TLS session resumption: each client resumes its sessions using its own session
+	// cache (unless reloading its client certificate, see certReloader). Otherwise every new connection
+	// makes a full handshake.
+	TLSResumption bool
+	// DisableTLSSessionTickets makes the client not use (nor ask for) session tickets, with which,
+	// the go client only resuming through tickets, all the handshakes are full ones too.
+	DisableTLSSessionTickets bool
+	// ConnectRate when > 0 limits how fast new connections are opened, in connections per second across
+	// all the clients of a run (independently of the requests' qps), e.g. to ramp up gently on SYN rate
+	// sensitive devices or TLS terminators (see ParseConnectRate). The waits are excluded from the calls' latency.
+	ConnectRate float64
+	// Shared connect rate limiter of the run's clients, set by the runner.
+	connectLimiter *connectLimiter
+	// LongPoll when > 0 is how long the target can hold the requests open (long polling, hanging GETs):
+	// it replaces HTTPReqTimeOut as the requests' deadline, the runner counting the requests still held
+	// then as LongPollHeld instead of TimeoutError, and the clients note when they sent each request
+	// (see RequestSentTimer) for the hold and reconnect durations.
+	LongPoll time.Duration
+}
+
+// bodyLimit returns the max number of body bytes to keep, or -1 for no limit.
+func (h *HTTPOptions) bodyLimit() int {
+	if h.DiscardBody {
+		return 0
+	}
+	if h.ReadLimit > 0 {
+		return h.ReadLimit
+	}
+	return -1
+}
+
+// requestTimeout returns the requests' deadline: LongPoll when set, HTTPReqTimeOut otherwise.
+func (h *HTTPOptions) requestTimeout() time.Duration {
+	if h.LongPoll > 0 {
+		return h.LongPoll
+	}
+	return h.HTTPReqTimeOut
 }
 
 // ResetHeaders resets all the headers, including the User-Agent: one (and the Host: logical special header).
@@ -318,6 +436,58 @@ type Client struct {
 	bodyContainsUUID     bool // if body contains the "{uuid}" pattern (lowercase)
 	logErrors            bool
 	id                   int
+	trace                *traceContext // nil when not generating trace headers
+	affinity             *affinityKeys // nil when not sending affinity keys
+	limits               *connLimits   // nil when not recycling connections
+	sendDeadline         bool
+	reqTimeout           time.Duration
+	headerSets           *headerSets // nil when not rotating header sets
+	replay               *replay     // nil when not replaying recorded requests
+	methodMix            *methodMix  // nil without HTTPOptions.MethodMix
+	captureHeader        string      // response header to capture, if any
+	captured             string      // its value in the last response
+	respHeader           http.Header // headers of the last response
+	exporter             *otlp.Exporter
+	bodyLimit            int                  // max body bytes kept, -1 for all
+	responseSize         int                  // total bytes of the last response body, including discarded ones
+	localAddr            net.Addr             // of the first connection, for ConnectionInfo()
+	remoteAddr           net.Addr             // of the first connection
+	tlsState             *tls.ConnectionState // of the first TLS response
+	tlsConns             *periodic.TLSCounts  // of all the TLS connections, nil when not https
+	connectWait          int64                // atomic, nanoseconds waited for the connect rate limiter
+	phases               *LatencyPhases       // of the last request, nil when not timing them
+	phasesTrace          *httptrace.ClientTrace
+	phaseClock           phaseClock
+}
+
+// ResponseSizer is implemented by the clients which can discard part of the
+// response (see HTTPOptions.DiscardBody and ReadLimit): ResponseSize returns the
+// size of the last response fetched, which can be larger than the data returned.
+type ResponseSizer interface {
+	ResponseSize() int
+}
+
+// ResponseSize returns the size of the last response body, including the discarded bytes.
+func (c *Client) ResponseSize() int {
+	return c.responseSize
+}
+
+// ConnectionInfo returns the local and remote addresses of the first
+// connection and the negotiated TLS state (nil when not using TLS).
+func (c *Client) ConnectionInfo() (local, remote net.Addr, tlsState *tls.ConnectionState) {
+	return c.localAddr, c.remoteAddr, c.tlsState
+}
+
+// TLSConnections returns the counts of the client's TLS connections per
+// negotiated parameters (nil when not using TLS).
+func (c *Client) TLSConnections() *periodic.TLSCounts {
+	return c.tlsConns
+}
+
+// takeConnectWait returns the time waited for the connect rate limiter since
+// the last call (see connectWaiter).
+func (c *Client) takeConnectWait() time.Duration {
+	return time.Duration(atomic.SwapInt64(&c.connectWait, 0))
 }
 
 // Close cleans up any resources used by NewStdClient.
@@ -371,10 +541,76 @@ func (c *Client) Fetch() (int, []byte, int) {
 		c.req.ContentLength = int64(len(bodyBytes))
 		c.req.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
 	}
-	resp, err := c.client.Do(c.req)
+	if c.headerSets != nil {
+		c.req.Header = c.headerSets.std[c.headerSets.nextIndex()]
+	}
+	if c.methodMix != nil {
+		c.methodMix.apply(c.req)
+	}
+	if c.replay != nil {
+		c.replay.apply(c.req)
+	}
+	if c.trace != nil {
+		// The std client can't tell ahead of time if a connection will be reused,
+		// so in per connection mode the trace is per client.
+		c.trace.next(false)
+		c.trace.setHeaders(c.req.Header)
+	}
+	if c.affinity != nil {
+		c.req.Header.Set(c.affinity.header, c.affinity.nextKey())
+	}
+	if c.sendDeadline {
+		c.req.Header.Set(DeadlineHeader, FormatDeadline(time.Now().Add(c.reqTimeout)))
+	}
+	if c.limits != nil {
+		// The transport picks the connection, assume it's the same as for the
+		// previous request (the client's single one when used sequentially).
+		c.req.Close = c.limits.next()
+	}
+	req := c.req
+	if c.localAddr == nil {
+		// Only until we got the first connection's addresses, to not slow down all the requests.
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				c.localAddr = info.Conn.LocalAddr()
+				c.remoteAddr = info.Conn.RemoteAddr()
+			},
+		}))
+	}
+	if c.phases != nil {
+		*c.phases = LatencyPhases{}
+		c.phaseClock = phaseClock{}
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), c.phasesTrace))
+	}
+	var span *otlp.Span
+	if c.exporter != nil && c.exporter.Sample() {
+		span = newRequestSpan(c.exporter, c.req.Method, c.url, c.id)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), spanClientTrace(span)))
+		defer c.exporter.Export(span)
+	}
+	c.captured = ""
+	c.respHeader = nil
+	resp, err := c.client.Do(req)
 	if err != nil {
+		if c.limits != nil {
+			c.limits.reset()
+		}
 		log.Errf("[%d] Unable to send %s request for %s : %v", c.id, c.req.Method, c.url, err)
-		return http.StatusBadRequest, []byte(err.Error()), 0
+		code := http.StatusBadRequest
+		if isTimeout(err) {
+			code = TimeoutError
+		} else if isConnectionError(err) {
+			code = SocketError
+		}
+		if span != nil {
+			endSpan(span, c.trace, code, 0)
+			span.Attributes["error"] = err.Error()
+		}
+		return code, []byte(err.Error()), 0
+	}
+	c.respHeader = resp.Header
+	if c.captureHeader != "" {
+		c.captured = resp.Header.Get(c.captureHeader)
 	}
 	var data []byte
 	if log.LogDebug() {
@@ -384,32 +620,61 @@ func (c *Client) Fetch() (int, []byte, int) {
 			log.Debugf("For URL %s, received:\n%s", c.url, data)
 		}
 	}
-	data, err = ioutil.ReadAll(resp.Body)
+	data, err = c.readBody(resp.Body)
 	resp.Body.Close()
+	if c.phases != nil && !c.phaseClock.firstByte.IsZero() {
+		c.phases[PhaseBody] = time.Since(c.phaseClock.firstByte)
+	}
 	if err != nil {
 		log.Errf("[%d] Unable to read response for %s : %v", c.id, c.url, err)
 		code := resp.StatusCode
-		if codeIsOK(code) {
+		if isTimeout(err) {
+			code = TimeoutError
+		} else if codeIsOK(code) {
 			code = http.StatusNoContent
 			log.Warnf("[%d] Ok code despite read error, switching code to %d", c.id, code)
 		}
 		return code, data, 0
 	}
 	code := resp.StatusCode
-	log.Debugf("[%d] Got %d : %s for %s %s - response is %d bytes", c.id, code, resp.Status, c.req.Method, c.url, len(data))
+	if c.tlsState == nil && resp.TLS != nil {
+		c.tlsState = resp.TLS
+	}
+	if span != nil {
+		endSpan(span, c.trace, code, c.responseSize)
+	}
+	log.Debugf("[%d] Got %d : %s for %s %s - response is %d bytes", c.id, code, resp.Status, c.req.Method, c.url, c.responseSize)
 	if c.logErrors && !codeIsOK(code) {
 		log.Warnf("[%d] Non ok http code %d", c.id, code)
 	}
 	return code, data, 0
 }
 
+// readBody reads the whole body, keeping only up to bodyLimit bytes, and
+// sets responseSize.
+func (c *Client) readBody(body io.Reader) ([]byte, error) {
+	if c.bodyLimit < 0 {
+		data, err := ioutil.ReadAll(body)
+		c.responseSize = len(data)
+		return data, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(body, int64(c.bodyLimit)))
+	c.responseSize = len(data)
+	if err != nil {
+		return data, err
+	}
+	n, err := io.Copy(ioutil.Discard, body)
+	c.responseSize += int(n)
+	return data, err
+}
+
 // NewClient creates either a standard or fast client (depending on
 // the DisableFastClient flag).
 func NewClient(o *HTTPOptions) (Fetcher, error) {
 	o.Init(o.URL) // For completely new options
 	// For changes to options after init
 	o.URLSchemeCheck()
-	if o.DisableFastClient {
+	if o.DisableFastClient || len(o.Replay) > 0 || len(o.MethodMix) > 0 {
 		return NewStdClient(o)
 	}
 	return NewFastClient(o)
@@ -418,20 +683,70 @@ func NewClient(o *HTTPOptions) (Fetcher, error) {
 // NewStdClient creates a client object that wraps the net/http standard client.
 func NewStdClient(o *HTTPOptions) (*Client, error) {
 	o.Init(o.URL) // also normalizes NumConnections etc to be valid.
+	if err := ValidateResolve(o.Resolve); err != nil {
+		log.Errf("%v", err)
+		return nil, err
+	}
 	req, err := newHTTPRequest(o)
 	if req == nil {
 		return nil, err
 	}
+	trace, err := newTraceContext(o)
+	if err != nil {
+		return nil, err
+	}
+	affinity := newAffinityKeys(o)
+	headerSets := newHeaderSets(o)
+	replay, err := newReplay(o, req.URL)
+	if err != nil {
+		return nil, err
+	}
+	if replay != nil && headerSets != nil {
+		return nil, fmt.Errorf("header sets can't be used when replaying recorded requests")
+	}
+	methodMix := newMethodMix(o)
+	if replay != nil && methodMix != nil {
+		return nil, fmt.Errorf("a method mix can't be used when replaying recorded requests")
+	}
+	if o.H2C {
+		log.Warnf("h2c is only supported by the fast client, using the std client's http/1.1 for %s", o.URL)
+	}
+	if o.SlowWriteInterval > 0 {
+		log.Warnf("Slow writes are only supported by the fast client, ignored for %s", o.URL)
+	}
+	if trace != nil || affinity != nil || o.SendDeadline {
+		req.Header = req.Header.Clone() // shared with the options and other clients otherwise
+	}
+	proxyFunc := http.ProxyFromEnvironment
+	if o.Proxy != "" {
+		proxyURL, err := ParseProxy(o.Proxy)
+		if err != nil {
+			log.Errf("%v", err)
+			return nil, err
+		}
+		proxyFunc = http.ProxyURL(proxyURL)
+	}
+	limiter := o.connectLimit()
+	var client Client // referenced by the dialer, for its connect waits
 	tr := http.Transport{
 		MaxIdleConns:        o.NumConnections,
 		MaxIdleConnsPerHost: o.NumConnections,
 		DisableCompression:  !o.Compression,
 		DisableKeepAlives:   o.DisableKeepAlive,
-		Proxy:               http.ProxyFromEnvironment,
+		Proxy:               proxyFunc,
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			// redirect all connections to resolved ip, and use cn as sni host
+			// redirect (matching) connections to resolved ip, and use cn as sni host
 			if o.Resolve != "" {
-				addr = o.Resolve + addr[strings.LastIndex(addr, ":"):]
+				if host, port, err := net.SplitHostPort(addr); err == nil {
+					addr = net.JoinHostPort(resolveTarget(o.Resolve, host, port), port)
+				}
+			}
+			if limiter != nil {
+				waited, err := limiter.wait(ctx)
+				atomic.AddInt64(&client.connectWait, int64(waited))
+				if err != nil {
+					return nil, err
+				}
 			}
 			return (&net.Dialer{
 				Timeout: o.HTTPReqTimeOut,
@@ -439,13 +754,32 @@ func NewStdClient(o *HTTPOptions) (*Client, error) {
 		},
 		TLSHandshakeTimeout: o.HTTPReqTimeOut,
 	}
+	var tlsConns *periodic.TLSCounts
 	if o.https { // nolint: nestif // fine for now
-		tr.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		tlsConns = &periodic.TLSCounts{}
+		tr.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12, ServerName: o.SNI}
+		// Resumed sessions keep the client certificate of the full handshake, so no resumption when reloading it.
+		if o.TLSResumption && o.certs == nil {
+			tr.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+		}
+		tr.TLSClientConfig.SessionTicketsDisabled = o.DisableTLSSessionTickets
+		// Called for every handshake, resumed ones included, after the normal verification.
+		tr.TLSClientConfig.VerifyConnection = func(s tls.ConnectionState) error {
+			if o.Insecure {
+				// Still report the certificate problems, the handshake skipped the verification.
+				tlsConns.AddInsecure(&s, tr.TLSClientConfig.RootCAs)
+			} else {
+				tlsConns.Add(&s)
+			}
+			return nil
+		}
 		if o.Insecure {
 			log.LogVf("Using insecure https")
 			tr.TLSClientConfig.InsecureSkipVerify = true
 		}
-		if len(o.Cert) > 0 && len(o.Key) > 0 {
+		if o.certs != nil {
+			tr.TLSClientConfig.GetClientCertificate = o.certs.clientCertificate
+		} else if len(o.Cert) > 0 && len(o.Key) > 0 {
 			cert, err := tls.LoadX509KeyPair(o.Cert, o.Key)
 			if err != nil {
 				log.Errf("LoadX509KeyPair error for cert %v / key %v: %v", o.Cert, o.Key, err)
@@ -467,7 +801,7 @@ func NewStdClient(o *HTTPOptions) (*Client, error) {
 		}
 	}
 
-	client := Client{
+	client = Client{
 		url:                  o.URL,
 		path:                 req.URL.Path,
 		pathContainsUUID:     strings.Contains(req.URL.Path, uuidToken),
@@ -477,12 +811,32 @@ func NewStdClient(o *HTTPOptions) (*Client, error) {
 		bodyContainsUUID:     strings.Contains(o.PayloadString(), uuidToken),
 		req:                  req,
 		client: &http.Client{
-			Timeout:   o.HTTPReqTimeOut,
+			Timeout:   o.requestTimeout(),
 			Transport: &tr,
 		},
-		transport: &tr,
-		id:        o.ID,
-		logErrors: o.LogErrors,
+		transport:    &tr,
+		id:           o.ID,
+		logErrors:    o.LogErrors,
+		trace:        trace,
+		affinity:     affinity,
+		sendDeadline: o.SendDeadline,
+		limits:       newConnLimits(o),
+		reqTimeout:   o.requestTimeout(),
+		exporter:     o.SpanExporter,
+		bodyLimit:    o.bodyLimit(),
+		tlsConns:     tlsConns,
+	}
+	client.headerSets = headerSets
+	client.methodMix = methodMix
+	if replay != nil {
+		// The recorded requests replace the url and body, including their {uuid}s.
+		client.replay = replay
+		client.pathContainsUUID, client.rawQueryContainsUUID, client.bodyContainsUUID = false, false, false
+	}
+	client.captureHeader = o.CaptureHeader
+	if o.LatencyBreakdown || o.LongPoll > 0 {
+		client.phases = &LatencyPhases{}
+		client.phasesTrace = client.phaseTrace()
 	}
 	if !o.FollowRedirects {
 		// Lets us see the raw response instead of auto following redirects.
@@ -533,9 +887,70 @@ type FastClient struct {
 	parseHeaders bool // don't bother in http/1.0
 	halfClose    bool // allow/do half close when keepAlive is false
 	reqTimeout   time.Duration
-	uuidMarkers  [][]byte
+	uuidOffsets  []int // where the {uuid} replacements are in req, updated in place for each request
+	uuidRaw      uuid.UUID
+	rnd          *rand.Rand // own source to avoid contention on the shared rander between clients
 	logErrors    bool
 	id           int
+	trace        *traceContext // nil when not generating trace headers
+	traceOffsets traceOffsets  // where the trace ids are in req
+	affinity     *affinityKeys // nil when not sending affinity keys
+	limits       *connLimits   // nil when not recycling connections
+	affinityOff  int           // where the affinity key is in req
+	deadlineOff  int           // where the deadline is in req, 0 when not sending it
+	headerSets   *headerSets   // nil when not rotating header sets
+	headerSetOff int           // where the current header set is in req
+	headerSetLen int           // and its length
+	reqAlt       []byte        // the other buffer req is rebuilt into when changing header set
+	captureKey   []byte        // "\r\n<CaptureHeader>:" to find in the response headers, nil when not capturing
+	method       string
+	exporter     *otlp.Exporter
+	span         *otlp.Span // span of the current request when sampled
+	bodyLimit    int        // max body bytes kept in buffer, -1 for all
+	discarded    int        // bytes of the current response read but not kept
+	localAddr    net.Addr   // of the last connection, for ConnectionInfo()
+	useH2C       bool       // http/2 cleartext with prior knowledge instead of http/1.x
+	h2c          *h2cConn   // open h2c connection to reuse, nil if none
+
+	// Slow writes of the request: slowBytes at a time every slowInterval, when > 0.
+	slowInterval time.Duration
+	slowBytes    int
+	slowAbort    <-chan struct{}
+
+	// Forward proxy (then dest) to connect to target through, nil when connecting directly.
+	proxy  *proxyDialer
+	target string
+	// Rate limit of the new connections, nil when not limited, and the time waited for it.
+	connectLimiter *connectLimiter
+	connectWait    time.Duration
+
+	// Phases of the last request, nil when not timing them.
+	phases    *LatencyPhases
+	dnsTime   time.Duration // of the name resolution, done once
+	reqSent   time.Time
+	firstByte time.Time
+	// Note when each request is sent, for the long polls (see HTTPOptions.LongPoll), even with h2c.
+	longPoll bool
+}
+
+// ConnectionInfo returns the local address of the last connection and the
+// resolved destination (no TLS support in the fast client).
+func (c *FastClient) ConnectionInfo() (local, remote net.Addr, tlsState *tls.ConnectionState) {
+	return c.localAddr, c.dest, nil
+}
+
+// ResponseSize returns the size of the last response (headers included, like
+// the returned data), including the discarded bytes.
+func (c *FastClient) ResponseSize() int {
+	return c.size + c.discarded
+}
+
+// takeConnectWait returns the time waited for the connect rate limiter since
+// the last call (see connectWaiter).
+func (c *FastClient) takeConnectWait() time.Duration {
+	d := c.connectWait
+	c.connectWait = 0
+	return d
 }
 
 // Close cleans up any resources used by FastClient.
@@ -547,6 +962,12 @@ func (c *FastClient) Close() int {
 		}
 		c.socket = nil
 	}
+	if c.h2c != nil {
+		if err := c.h2c.conn.Close(); err != nil {
+			log.Warnf("Error closing fast client's h2c connection: %v", err)
+		}
+		c.h2c = nil
+	}
 	return c.socketCount
 }
 
@@ -557,9 +978,18 @@ func NewFastClient(o *HTTPOptions) (Fetcher, error) {
 	method := o.Method()
 	payloadLen := len(o.Payload)
 	o.Init(o.URL)
+	if err := ValidateResolve(o.Resolve); err != nil {
+		log.Errf("%v", err)
+		return nil, err
+	}
 	proto := "1.1"
 	if o.HTTP10 {
-		proto = "1.0"
+		if o.H2C {
+			log.Warnf("Ignoring http 1.0 with h2c")
+			o.HTTP10 = false
+		} else {
+			proto = "1.0"
+		}
 	}
 
 	uuidStrings := []string{}
@@ -591,29 +1021,50 @@ func NewFastClient(o *HTTPOptions) (Fetcher, error) {
 	bc := FastClient{
 		url: o.URL, host: url.Host, hostname: url.Hostname(), port: url.Port(),
 		http10: o.HTTP10, halfClose: o.AllowHalfClose, logErrors: o.LogErrors, id: o.ID,
+		method: method, exporter: o.SpanExporter, bodyLimit: o.bodyLimit(), useH2C: o.H2C,
+	}
+	bc.buffer = getBuffer()
+	if bc.bodyLimit > len(bc.buffer)/2 {
+		log.Warnf("Read limit %d is too large for the buffer, using %d - change -httpbufferkb flag to at least %d",
+			bc.bodyLimit, len(bc.buffer)/2, 2*bc.bodyLimit/1024+1)
+		bc.bodyLimit = len(bc.buffer) / 2
 	}
-	bc.buffer = make([]byte, BufferSizeKb*1024)
 	if bc.port == "" {
 		bc.port = url.Scheme // ie http which turns into 80 later
 		log.LogVf("No port specified, using %s", bc.port)
 	}
 	var addr net.Addr
-	if o.UnixDomainSocket != "" { // nolint: nestif
+	if o.Proxy != "" { // nolint: nestif
+		if o.UnixDomainSocket != "" {
+			return nil, fmt.Errorf("proxy can't be used with a unix domain socket")
+		}
+		bc.proxy, err = newProxyDialer(o.Proxy, o.HTTPReqTimeOut)
+		if err != nil {
+			log.Errf("Bad proxy %s : %v", periodic.Redact(o.Proxy), err)
+			return nil, err
+		}
+		port := bc.port
+		if p, found := schemePorts[port]; found {
+			port = p
+		}
+		// Resolved by the proxy, unless -resolve'd.
+		bc.target = net.JoinHostPort(resolveTarget(o.Resolve, bc.hostname, port), port)
+		log.Infof("Using proxy %v (%v) for %v", bc.proxy.url.Redacted(), bc.proxy.addr, bc.target)
+		addr = bc.proxy.addr
+	} else if o.UnixDomainSocket != "" {
 		log.Infof("Using unix domain socket %v instead of %v %v", o.UnixDomainSocket, bc.hostname, bc.port)
 		uds := &net.UnixAddr{Name: o.UnixDomainSocket, Net: fnet.UnixDomainSocket}
 		addr = uds
 	} else {
 		var tAddr *net.TCPAddr // strangely we get a non nil wrap of nil if assigning to addr directly
 		var err error
-		if o.Resolve != "" {
-			tAddr, err = fnet.Resolve(o.Resolve, bc.port)
-		} else {
-			tAddr, err = fnet.Resolve(bc.hostname, bc.port)
-		}
+		start := time.Now()
+		tAddr, err = fnet.Resolve(resolveTarget(o.Resolve, bc.hostname, bc.port), bc.port)
 		if tAddr == nil {
 			// Error already logged
 			return nil, err
 		}
+		bc.dnsTime = time.Since(start)
 		addr = tAddr
 	}
 	bc.dest = addr
@@ -637,27 +1088,124 @@ func NewFastClient(o *HTTPOptions) (Fetcher, error) {
 			buf.WriteString("Connection: close\r\n")
 		}
 	}
-	bc.reqTimeout = o.HTTPReqTimeOut
+	bc.reqTimeout = o.requestTimeout()
+	bc.trace, err = newTraceContext(o)
+	if err != nil {
+		return nil, err
+	}
+	if bc.trace != nil {
+		bc.traceOffsets = bc.trace.writeRaw(&buf)
+	}
+	if o.CaptureHeader != "" {
+		bc.captureKey = []byte("\r\n" + o.CaptureHeader + ":")
+	}
+	bc.affinity = newAffinityKeys(o)
+	bc.limits = newConnLimits(o)
+	bc.connectLimiter = o.connectLimit()
+	switch {
+	case o.LatencyBreakdown && o.H2C:
+		log.Warnf("Ignoring latency breakdown with h2c")
+	case !o.H2C && (o.LatencyBreakdown || o.LongPoll > 0):
+		bc.phases = &LatencyPhases{}
+	}
+	bc.longPoll = o.LongPoll > 0
+	if o.SlowWriteInterval > 0 {
+		if o.H2C {
+			log.Warnf("Ignoring slow writes with h2c")
+		} else {
+			bc.slowInterval = o.SlowWriteInterval
+			bc.slowBytes = o.SlowWriteBytes
+			bc.slowAbort = o.slowWriteAbort
+			if bc.slowBytes <= 0 {
+				bc.slowBytes = 1
+			}
+		}
+	}
+	if bc.affinity != nil {
+		bc.affinityOff = bc.affinity.writeRaw(&buf)
+	}
+	if o.SendDeadline {
+		bc.deadlineOff = writeDeadlineRaw(&buf, bc.reqTimeout)
+	}
+	headers := o.GenerateHeaders()
+	bc.headerSets = newHeaderSets(o)
+	if bc.headerSets != nil {
+		headers = baseHeaders(o)
+	}
 	w := bufio.NewWriter(&buf)
 	// This writes multiple valued headers properly (unlike calling Get() to do it ourselves)
-	_ = o.GenerateHeaders().Write(w)
+	_ = headers.Write(w)
 	w.Flush()
+	if bc.headerSets != nil {
+		bc.headerSetOff = buf.Len()
+		bc.headerSetLen = len(bc.headerSets.raw[0])
+		buf.Write(bc.headerSets.raw[0])
+	}
 	buf.WriteString("\r\n")
 	// Add the payload to http body
 	if payloadLen > 0 {
 		buf.Write(o.Payload)
 	}
 	bc.req = buf.Bytes()
-	bc.uuidMarkers = [][]byte{}
 	if len(uuidStrings) > 0 {
+		bc.rnd = newRand()
+		pos := 0
 		for _, uuidString := range uuidStrings {
-			bc.uuidMarkers = append(bc.uuidMarkers, []byte(uuidString))
+			idx := bytes.Index(bc.req[pos:], []byte(uuidString))
+			bc.uuidOffsets = append(bc.uuidOffsets, pos+idx)
+			pos += idx + len(uuidString)
 		}
 	}
 	log.Debugf("Created client:\n%+v\n%s", bc.dest, bc.req)
 	return &bc, nil
 }
 
+// bufferPool recycles the response buffers of fast clients released by
+// the runner, avoiding large allocations for each new run.
+var bufferPool sync.Pool
+
+// getBuffer returns a (possibly recycled) BufferSizeKb buffer.
+func getBuffer() []byte {
+	size := BufferSizeKb * 1024
+	if b, ok := bufferPool.Get().(*[]byte); ok && len(*b) == size {
+		return *b
+	}
+	return make([]byte, size)
+}
+
+// releaseBuffer gives the client's buffer back for reuse by future clients.
+// Only to be called after Close() and once the data returned by Fetch()
+// is no longer referenced.
+func releaseBuffer(f Fetcher) {
+	c, ok := f.(*FastClient)
+	if !ok || c.buffer == nil {
+		return
+	}
+	b := c.buffer
+	c.buffer = nil
+	bufferPool.Put(&b)
+}
+
+// uuidLen is the length of the string representation of uuids.
+const uuidLen = 36
+
+// writeUUID writes a new random (version 4) uuid in dst, same as generateUUID() but without allocations.
+func (c *FastClient) writeUUID(dst []byte) {
+	u := c.uuidRaw[:]
+	_, _ = c.rnd.Read(u)
+	u[6] = (u[6] & 0x0f) | 0x40 // Version 4
+	u[8] = (u[8] & 0x3f) | 0x80 // Variant is 10
+	hex.Encode(dst[0:8], u[0:4])
+	dst[8] = '-'
+	hex.Encode(dst[9:13], u[4:6])
+	dst[13] = '-'
+	hex.Encode(dst[14:18], u[6:8])
+	dst[18] = '-'
+	hex.Encode(dst[19:23], u[8:10])
+	dst[23] = '-'
+	hex.Encode(dst[24:], u[10:])
+}
+
 // return the result from the state.
 func (c *FastClient) returnRes() (int, []byte, int) {
 	return c.code, c.buffer[:c.size], c.headerLen
@@ -666,12 +1214,40 @@ func (c *FastClient) returnRes() (int, []byte, int) {
 // connect to destination.
 func (c *FastClient) connect() net.Conn {
 	c.socketCount++
-	socket, err := net.Dial(c.dest.Network(), c.dest.String())
+	if c.connectLimiter != nil {
+		waited, err := c.connectLimiter.wait(context.Background())
+		c.connectWait += waited
+		if err != nil {
+			log.LogVf("Not connecting to %v : %v", c.dest, err)
+			return nil
+		}
+	}
+	var socket net.Conn
+	var err error
+	start := time.Now()
+	if c.proxy != nil {
+		socket, err = c.proxy.dial(c.target)
+	} else {
+		socket, err = net.Dial(c.dest.Network(), c.dest.String())
+	}
 	if err != nil {
 		log.Errf("Unable to connect to %v : %v", c.dest, err)
 		return nil
 	}
+	if c.span != nil {
+		c.span.AddEvent("connected")
+	}
+	if c.phases != nil {
+		c.phases[PhaseConnect] = time.Since(start)
+		if c.socketCount == 1 {
+			c.phases[PhaseDNS] = c.dnsTime
+		}
+	}
+	c.localAddr = socket.LocalAddr()
 	fnet.SetSocketBuffers(socket, len(c.buffer), len(c.req))
+	if c.limits != nil {
+		c.limits.reset()
+	}
 	return socket
 }
 
@@ -681,12 +1257,77 @@ const (
 	SocketError = -1
 	// RetryOnce is used internally as an error code to allow 1 retry for bad socket reuse.
 	RetryOnce = -2
+	// TimeoutError is returned when the request didn't complete within the request timeout (HTTPReqTimeOut).
+	TimeoutError = -3
+	// LongPollHeld is counted by the runner instead of TimeoutError, in long poll mode, for the requests
+	// still held by the target at the end of HTTPOptions.LongPoll (the next call polls again).
+	LongPollHeld = -4
 )
 
+// isTimeout returns true for errors caused by a deadline being exceeded.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// isConnectionError is true for transport errors (connection refused, reset,
+// resolution...), which the std client reports as SocketError like the fast
+// client does (instead of StatusBadRequest, still used for the other errors,
+// e.g. malformed responses) so they count for the reconnect backoff and
+// availability.
+func isConnectionError(err error) bool {
+	var oe *net.OpError
+	return errors.As(err, &oe)
+}
+
 // Fetch fetches the url content. Returns http code, data, offset of body.
 func (c *FastClient) Fetch() (int, []byte, int) {
+	if c.phases != nil {
+		*c.phases = LatencyPhases{}
+		c.firstByte = time.Time{}
+	}
+	if c.longPoll {
+		c.reqSent = time.Time{}
+	}
+	if c.exporter == nil || !c.exporter.Sample() {
+		return c.fetch()
+	}
+	c.span = newRequestSpan(c.exporter, c.method, c.url, c.id)
+	code, data, headerLen := c.fetch()
+	endSpan(c.span, c.trace, code, len(data)+c.discarded)
+	c.exporter.Export(c.span)
+	c.span = nil
+	return code, data, headerLen
+}
+
+// updateRequest updates, in place, the parts of the raw request that change
+// for each request.
+func (c *FastClient) updateRequest(newConnection bool) {
+	if c.headerSets != nil {
+		c.nextHeaderSet()
+	}
+	if c.trace != nil {
+		c.trace.next(newConnection)
+		c.trace.updateRaw(c.req, c.traceOffsets)
+	}
+	if c.affinity != nil {
+		copy(c.req[c.affinityOff:], c.affinity.nextKey())
+	}
+	if c.deadlineOff > 0 {
+		copy(c.req[c.deadlineOff:], FormatDeadline(time.Now().Add(c.reqTimeout)))
+	}
+	for _, off := range c.uuidOffsets {
+		c.writeUUID(c.req[off : off+uuidLen])
+	}
+}
+
+func (c *FastClient) fetch() (int, []byte, int) {
+	if c.useH2C {
+		return c.fetchH2C()
+	}
 	c.code = SocketError
 	c.size = 0
+	c.discarded = 0
 	c.headerLen = 0
 	// Connect or reuse existing socket:
 	conn := c.socket
@@ -701,21 +1342,35 @@ func (c *FastClient) Fetch() (int, []byte, int) {
 	}
 	c.socket = nil // because of error returns and single retry
 	conErr := conn.SetReadDeadline(time.Now().Add(c.reqTimeout))
+	c.updateRequest(!reuse)
 	// Send the request:
-	req := c.req
-	if len(c.uuidMarkers) > 0 {
-		for _, uuidMarker := range c.uuidMarkers {
-			req = bytes.Replace(req, uuidMarker, []byte(generateUUID()), 1)
+	var n int
+	var err error
+	if c.slowInterval > 0 {
+		n, err = c.slowWrite(conn)
+		if errors.Is(err, errSlowWriteAborted) {
+			log.LogVf("[%d] Slow request to %v aborted after %d bytes", c.id, c.dest, n)
+			conn.Close()
+			return c.returnRes()
+		}
+		if err != nil && n > 0 {
+			// The target gave up on the slow request: read its early reply (e.g. 408), if any.
+			log.LogVf("[%d] Slow request to %v interrupted after %d bytes : %v", c.id, c.dest, n, err)
+			c.reqSent = time.Now()
+			_ = conn.SetReadDeadline(time.Now().Add(c.reqTimeout))
+			c.readResponse(conn, false)
+			return c.returnRes()
 		}
+	} else {
+		n, err = conn.Write(c.req)
 	}
-	n, err := conn.Write(req)
 	if err != nil || conErr != nil {
 		if reuse {
 			// it's ok for the (idle) socket to die once, auto reconnect:
 			log.Infof("Closing dead socket %v (%v)", conn, err)
 			conn.Close()
 			c.errorCount++
-			return c.Fetch() // recurse once
+			return c.fetch() // recurse once
 		}
 		log.Errf("Unable to write to %v %v : %v", conn, c.dest, err)
 		return c.returnRes()
@@ -724,6 +1379,12 @@ func (c *FastClient) Fetch() (int, []byte, int) {
 		log.Errf("Short write to %v %v : %d instead of %d", conn, c.dest, n, len(c.req))
 		return c.returnRes()
 	}
+	if c.span != nil {
+		c.span.AddEvent("request_sent")
+	}
+	if c.phases != nil || c.longPoll {
+		c.reqSent = time.Now()
+	}
 	if !c.keepAlive && c.halfClose { // nolint: nestif
 		tcpConn, ok := conn.(*net.TCPConn)
 		if ok {
@@ -738,9 +1399,15 @@ func (c *FastClient) Fetch() (int, []byte, int) {
 	}
 	// Read the response:
 	c.readResponse(conn, reuse)
+	if c.phases != nil && !c.firstByte.IsZero() {
+		c.phases[PhaseBody] = time.Since(c.firstByte)
+	}
 	if c.code == RetryOnce {
 		// Special "eof on reused socket" code
-		return c.Fetch() // recurse once
+		if c.span != nil {
+			c.span.AddEvent("retry")
+		}
+		return c.fetch() // recurse once
 	}
 	// Return the result:
 	return c.returnRes()
@@ -751,6 +1418,33 @@ func codeIsOK(code int) bool {
 	return (code >= 200 && code <= 299) || code == http.StatusTeapot
 }
 
+// discard drops the body bytes, up to max, beyond the ones to keep (see
+// HTTPOptions.ReadLimit) to make room in the buffer. Returns the new max.
+func (c *FastClient) discard(max int) int {
+	keep := c.headerLen + c.bodyLimit
+	end := c.size
+	if max < end {
+		end = max
+	}
+	drop := end - keep
+	if drop <= 0 {
+		return max
+	}
+	// Bytes past max (next chunk size in chunked mode) are preserved.
+	copy(c.buffer[keep:], c.buffer[end:c.size])
+	c.size -= drop
+	c.discarded += drop
+	return max - drop
+}
+
+// readUntilClose returns the max to use when reading until the server closes the connection.
+func (c *FastClient) readUntilClose() int {
+	if c.bodyLimit >= 0 {
+		return math.MaxInt32 // no limit as the extra is discarded
+	}
+	return len(c.buffer)
+}
+
 // Response reading:
 // nolint: nestif,funlen,gocognit,gocyclo // TODO: refactor - unwiedly/ugly atm.
 func (c *FastClient) readResponse(conn net.Conn, reusedSocket bool) {
@@ -767,10 +1461,13 @@ func (c *FastClient) readResponse(conn net.Conn, reusedSocket bool) {
 		// Ugly way to cover the case where we get more than 1 chunk at the end
 		// TODO: need automated tests
 		if !skipRead {
+			if parsedHeaders && c.bodyLimit >= 0 {
+				max = c.discard(max)
+			}
 			n, err := conn.Read(c.buffer[c.size:])
 			if err != nil {
-				if reusedSocket && c.size == 0 {
-					// Ok for reused socket to be dead once (close by server)
+				if reusedSocket && c.size == 0 && !(c.longPoll && isTimeout(err)) {
+					// Ok for reused socket to be dead once (close by server), not to time out in long poll mode (held request)
 					log.Infof("Closing dead socket %v (err %v at first read)", conn, err)
 					c.errorCount++
 					err = conn.Close() // close the previous one
@@ -786,8 +1483,18 @@ func (c *FastClient) readResponse(conn net.Conn, reusedSocket bool) {
 				}
 				log.Errf("Read error %v %v %d : %v", conn, c.dest, c.size, err)
 				c.code = SocketError
+				if isTimeout(err) {
+					c.code = TimeoutError
+				}
 				break
 			}
+			if c.size == 0 && c.span != nil {
+				c.span.AddEvent("first_byte")
+			}
+			if c.size == 0 && c.phases != nil {
+				c.firstByte = time.Now()
+				c.phases[PhaseTTFB] = c.firstByte.Sub(c.reqSent)
+			}
 			c.size += n
 			if log.LogDebug() {
 				log.Debugf("Read ok %d total %d so far (-%d headers = %d data) %s",
@@ -873,7 +1580,7 @@ func (c *FastClient) readResponse(conn net.Conn, reusedSocket bool) {
 							break
 						}
 					} // end of content-length section
-					if max > len(c.buffer) {
+					if max > len(c.buffer) && c.bodyLimit < 0 {
 						log.Warnf("[%d] Buffer is too small for headers %d + data %d - change -httpbufferkb flag to at least %d",
 							c.id, c.headerLen, contentLength, (c.headerLen+contentLength)/1024+1)
 						// TODO: just consume the extra instead
@@ -883,9 +1590,11 @@ func (c *FastClient) readResponse(conn net.Conn, reusedSocket bool) {
 						if found, _ := FoldFind(c.buffer[:c.headerLen], connectionCloseHeader); found {
 							log.Infof("Server wants to close connection, no keep-alive!")
 							keepAlive = false
-							max = len(c.buffer) // reset to read as much as available
+							max = c.readUntilClose() // reset to read as much as available
 						}
 					}
+				} else {
+					max = c.readUntilClose()
 				}
 			}
 		} // end of big if parse header
@@ -915,7 +1624,7 @@ func (c *FastClient) readResponse(conn net.Conn, reusedSocket bool) {
 				} else {
 					max += dataStart + nextChunkLen + 2 // extra CR LF
 					log.Debugf("One more chunk %d -> new max %d", nextChunkLen, max)
-					if max > len(c.buffer) {
+					if max > len(c.buffer) && c.bodyLimit < 0 {
 						log.Errf("Buffer too small for %d data", max)
 					} else {
 						if max <= c.size {
@@ -929,8 +1638,11 @@ func (c *FastClient) readResponse(conn net.Conn, reusedSocket bool) {
 			break // we're done!
 		}
 	} // end of big for loop
+	if parsedHeaders && c.bodyLimit >= 0 {
+		c.discard(c.size) // last read
+	}
 	// Figure out whether to keep or close the socket:
-	if keepAlive && codeIsOK(c.code) {
+	if keepAlive && codeIsOK(c.code) && (c.limits == nil || !c.limits.next()) {
 		c.socket = conn // keep the open socket
 	} else {
 		if err := conn.Close(); err != nil {
@@ -946,3 +1658,10 @@ func generateUUID() string {
 	// We use math random instead of crypto random generator due to performance.
 	return uuid.Must(uuid.NewRandomFromReader(rander)).String()
 }
+
+// newRand returns a new (not thread safe) random source, seeded from the shared one.
+func newRand() *rand.Rand {
+	var seed [8]byte
+	_, _ = rander.Read(seed[:])
+	return rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(seed[:])))) // nolint: gosec // not for crypto
+}
@@ -76,7 +76,7 @@ func makeMirrorRequest(baseURL string, r *http.Request, data []byte) *http.Reque
 func CopyHeaders(req, r *http.Request, all bool) {
 	// Copy only trace headers unless all is true.
 	for k, v := range r.Header {
-		if all || k == EnvoyRequestID || k == TraceHeader || strings.HasPrefix(k, TraceHeadersPrefix) {
+		if all || IsTraceHeader(k) {
 			for _, vv := range v {
 				req.Header.Add(k, vv)
 			}
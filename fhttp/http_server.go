@@ -17,6 +17,7 @@ package fhttp // import "fortio.org/fortio/fhttp"
 // pprof import to get /debug/pprof endpoints on a mux through SetupPPROF.
 import (
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -45,19 +46,28 @@ var (
 	// Start time of the server (used in debug handler for uptime).
 	startTime time.Time
 	// EchoRequests is the number of request received. Only updated in Debug mode.
+	// Kept for compatibility, EchoRequestCount doesn't contend on a single counter.
 	EchoRequests int64
 	// TODO find a way to only include this on binaries and not library mode (#433).
 	defaultEchoServerParams = dflag.DynString(flag.CommandLine, "echo-server-default-params", "",
-		"Default parameters/querystring to use if there isn't one provided explicitly. E.g \"status=404&delay=3s\"")
+		"Default parameters/querystring to use if there isn't one provided explicitly. E.g \"status=404&delay=3s\"").
+		WithValidator(func(v string) error {
+			_, err := url.ParseQuery(v)
+			return err
+		})
 	fetch2CopiesAllHeader = dflag.DynBool(flag.CommandLine, "proxy-all-headers", true,
 		"Determines if only tracing or all headers (and cookies) are copied from request on the fetch2 ui/server endpoint")
 )
 
 // EchoHandler is an http server handler echoing back the input.
 func EchoHandler(w http.ResponseWriter, r *http.Request) {
+	received := time.Now()
 	if log.LogVerbose() {
 		LogRequest(r, "Echo") // will also print headers
 	}
+	if r.Header.Get(TimingHeader) != "" {
+		w = &timingWriter{ResponseWriter: w, received: received}
+	}
 	defaultParams := defaultEchoServerParams.Get()
 	hasQuestionMark := strings.Contains(r.RequestURI, "?")
 	if !hasQuestionMark && len(defaultParams) > 0 {
@@ -80,11 +90,44 @@ func EchoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Debugf("Read %d", len(data))
+	recordRequest(r, data, received)
 	dur := generateDelay(r.FormValue("delay"))
+	busy := generateDelay(r.FormValue("busy"))
+	remaining, hasDeadline := requestDeadline(r, received)
+	if hasDeadline {
+		w.Header().Set(DeadlineRemainingHeader, remaining.Round(time.Millisecond).String())
+		// Give up at the deadline, like a server propagating it would.
+		if busy > remaining {
+			busy = remaining
+		}
+		if busy > 0 && dur > remaining-busy {
+			dur = remaining - busy
+		} else if dur > remaining {
+			dur = remaining
+		}
+	}
+	if busy > 0 {
+		log.LogVf("Burning cpu for %v", busy)
+		_ = burnCPU(busy)
+	}
+	if alloc := r.FormValue("alloc"); alloc != "" {
+		size, hold, err := parseAlloc(alloc)
+		if err != nil {
+			log.Warnf("Bad input alloc: %v", err)
+		} else {
+			log.LogVf("Allocating %d bytes for %v", size, hold)
+			allocMemory(r, size, hold)
+		}
+	}
 	if dur > 0 {
 		log.LogVf("Sleeping for %v", dur)
 		time.Sleep(dur)
 	}
+	if hasDeadline && time.Since(received) >= remaining {
+		log.LogVf("Deadline exceeded (%v remaining when received)", remaining)
+		http.Error(w, "deadline exceeded", http.StatusGatewayTimeout)
+		return
+	}
 	statusStr := r.FormValue("status")
 	var status int
 	if statusStr != "" {
@@ -93,9 +136,9 @@ func EchoHandler(w http.ResponseWriter, r *http.Request) {
 		status = http.StatusOK
 	}
 	if log.LogDebug() {
-		// TODO: this easily lead to contention - use 'thread local'
 		rqNum := atomic.AddInt64(&EchoRequests, 1)
-		log.Debugf("Request # %v", rqNum)
+		echoCounts.record(status)
+		log.Debugf("Request # %v for status %d", rqNum, status)
 	}
 	if r.FormValue("close") != "" {
 		log.Debugf("Adding Connection:close / will close socket")
@@ -133,10 +176,12 @@ func EchoHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func writePayload(w http.ResponseWriter, status int, size int) {
+	payload := fnet.GenerateRandomPayload(size) // max size may have changed since size was validated
+	size = len(payload)
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Content-Length", strconv.Itoa(size))
 	w.WriteHeader(status)
-	n, err := w.Write(fnet.Payload[:size])
+	n, err := w.Write(payload)
 	if err != nil || n != size {
 		log.Errf("Error writing payload of size %d: %d %v", size, n, err)
 	}
@@ -251,9 +296,14 @@ environment:
 }
 */
 
-// DebugHandler returns debug/useful info to http client.
+// DebugHandler returns debug/useful info to http client (as json with ?format=json).
 func DebugHandler(w http.ResponseWriter, r *http.Request) {
 	LogRequest(r, "Debug")
+	// Not FormValue() which would consume a form body:
+	if r.URL.Query().Get("format") == "json" {
+		debugJSONHandler(w, r)
+		return
+	}
 	var buf bytes.Buffer
 	buf.WriteString("Φορτίο version ")
 	buf.WriteString(version.Long())
@@ -294,6 +344,9 @@ func DebugHandler(w http.ResponseWriter, r *http.Request) {
 			first = false
 		}
 	}
+	if r.TLS != nil {
+		newDebugTLS(r.TLS).write(&buf)
+	}
 	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		/*
@@ -377,7 +430,20 @@ func SetupPPROF(mux *http.ServeMux) {
 
 // -- Fetch er (simple http proxy) --
 
-var proxyClient = CreateProxyClient()
+var proxyClient = createFetchClient()
+
+// createFetchClient returns the fetch2 proxy client, which only follows the
+// redirects allowed by the fetch policy.
+func createFetchClient() *http.Client {
+	client := CreateProxyClient()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return CurrentFetchPolicy().Check(req.URL)
+	}
+	return client
+}
 
 // FetcherHandler2 is the handler for the fetcher/proxy that supports h2 input and makes a
 // new request with all headers copied (allows to test sticky routing)
@@ -403,6 +469,11 @@ func FetcherHandler2(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "parsing url failed, invalid url", http.StatusBadRequest)
 		return
 	}
+	if err := CurrentFetchPolicy().Check(req.URL); err != nil {
+		log.Warnf("Refusing fetch from %v: %v", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	OnBehalfOfRequest(req, r)
 	resp, err := proxyClient.Do(req)
 	if err != nil {
@@ -445,8 +516,14 @@ func FetcherHandler(w http.ResponseWriter, r *http.Request) {
 	// Stripped prefix gets replaced by ./ - sometimes...
 	url := strings.TrimPrefix(r.URL.String(), "./")
 	opts := NewHTTPOptions("http://" + url)
+	if err = CheckFetchURL(opts.URL); err != nil {
+		log.Warnf("Refusing fetch from %v: %v", r.RemoteAddr, err)
+		_, _ = conn.Write([]byte("HTTP/1.0 403 Forbidden\r\nContent-Type: text/plain\r\n\r\n" + err.Error() + "\n"))
+		return
+	}
 	opts.HTTPReqTimeOut = 5 * time.Minute
 	OnBehalfOf(opts, r)
+	PropagateTraceHeaders(opts, r)
 	client, _ := NewClient(opts)
 	if client == nil {
 		return // error logged already
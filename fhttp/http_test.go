@@ -16,6 +16,7 @@ package fhttp
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -25,6 +26,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -376,6 +378,68 @@ func TestParseDelay(t *testing.T) {
 	}
 }
 
+func TestParseAlloc(t *testing.T) {
+	if _, _, err := parseAlloc("1MB"); err == nil {
+		t.Errorf("expected alloc= to be disabled by default")
+	}
+	_ = MaxAlloc.Set("104857600")
+	defer func() { _ = MaxAlloc.Set("0") }()
+	tests := []struct {
+		input string
+		size  int64
+		hold  time.Duration
+		err   bool
+	}{
+		{"100", 100, 0, false},
+		{"1.5KB", 1536, 0, false},
+		{"10MB", 10 * 1024 * 1024, 0, false},
+		{"10mib:hold=500ms", 10 * 1024 * 1024, 500 * time.Millisecond, false},
+		{"2kb:hold=10h", 2048, MaxDelay.Get(), false},
+		{"1GB", MaxAlloc.Get(), 0, false}, // capped
+		{"", 0, 0, true},
+		{"KB", 0, 0, true},
+		{"-1MB", 0, 0, true},
+		{"10XB", 0, 0, true},
+		{"1MB:5s", 0, 0, true},
+		{"1MB:hold=x", 0, 0, true},
+		{"1MB:hold=-1s", 0, 0, true},
+	}
+	for _, tst := range tests {
+		size, hold, err := parseAlloc(tst.input)
+		if (err != nil) != tst.err || size != tst.size || hold != tst.hold {
+			t.Errorf("parseAlloc(%q) got %d %v %v, expected %d %v (error %v)", tst.input, size, hold, err, tst.size, tst.hold, tst.err)
+		}
+	}
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/", EchoHandler)
+	for _, q := range []string{"?alloc=1MB", "?alloc=1MB:hold=50ms", "?alloc=bad"} {
+		o := NewHTTPOptions(fmt.Sprintf("http://localhost:%d/%s", addr.Port, q))
+		start := time.Now()
+		if code, _ := Fetch(o); code != http.StatusOK {
+			t.Errorf("unexpected code %d for %s", code, q)
+		}
+		if q == "?alloc=1MB:hold=50ms" && time.Since(start) < 50*time.Millisecond {
+			t.Errorf("response to %s before the end of the hold", q)
+		}
+	}
+	if held := atomic.LoadInt64(&allocHeld); held != 0 {
+		t.Errorf("%d bytes still held after the requests", held)
+	}
+	// Global limit:
+	_ = MaxAllocTotal.Set("1000")
+	defer func() { _ = MaxAllocTotal.Set("1073741824") }()
+	if got := reserveAlloc(600); got != 600 {
+		t.Errorf("reserved %d instead of 600", got)
+	}
+	if got := reserveAlloc(600); got != 400 {
+		t.Errorf("reserved %d instead of the 400 left", got)
+	}
+	if got := reserveAlloc(1); got != 0 {
+		t.Errorf("reserved %d beyond the limit", got)
+	}
+	releaseAlloc(1000)
+}
+
 func TestGenerateStatusBasic(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -932,6 +996,61 @@ func TestBadQueryUUIDFastClient(t *testing.T) {
 	}
 }
 
+// rawKeepAliveServer is a minimal, non allocating, keep-alive http server
+// so client allocations can be measured.
+func rawKeepAliveServer(t testing.TB) int {
+	l, a := fnet.Listen("raw-http", "0")
+	if l == nil {
+		t.Fatalf("unable to listen")
+	}
+	reply := []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				buf := make([]byte, 4096)
+				for {
+					if _, err := c.Read(buf); err != nil {
+						c.Close()
+						return
+					}
+					if _, err := c.Write(reply); err != nil {
+						c.Close()
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return a.(*net.TCPAddr).Port
+}
+
+func TestFastClientNoAllocations(t *testing.T) {
+	prevLevel := log.SetLogLevel(log.Warning) // debug logging does allocate
+	defer log.SetLogLevel(prevLevel)
+	port := rawKeepAliveServer(t)
+	for _, url := range []string{"http://localhost:%d/", "http://localhost:%d/{uuid}?id={uuid}"} {
+		o := NewHTTPOptions(fmt.Sprintf(url, port))
+		o.TraceHeaders = TraceW3C
+		client, _ := NewClient(o)
+		code, _, _ := client.Fetch() // first one connects
+		if code != http.StatusOK {
+			t.Errorf("Got %d instead of 200 for %s", code, url)
+		}
+		allocs := testing.AllocsPerRun(100, func() {
+			client.Fetch()
+		})
+		if allocs != 0 {
+			t.Errorf("Expected 0 allocations per fetch for %s, got %g", url, allocs)
+		}
+		client.Close()
+		releaseBuffer(client)
+	}
+}
+
 func TestUUIDClient(t *testing.T) {
 	m, a := DynamicHTTPServer(false)
 	m.HandleFunc("/", ValidateUUIDPath)
@@ -1418,6 +1537,75 @@ func TestInsecureRequestWithResolve(t *testing.T) {
 	}
 }
 
+func TestResolveTarget(t *testing.T) {
+	tests := []struct {
+		resolve  string
+		host     string
+		port     string
+		expected string
+	}{
+		{"", "www.example.com", "443", "www.example.com"},
+		{"10.0.0.1", "www.example.com", "443", "10.0.0.1"},
+		{"[::1]", "www.example.com", "80", "::1"},
+		{"www.example.com:443:10.0.0.1", "www.example.com", "443", "10.0.0.1"},
+		{"WWW.example.com:80:10.0.0.1", "www.example.com", "http", "10.0.0.1"},
+		{"www.example.com:443:10.0.0.1", "www.example.com", "80", "www.example.com"},
+		{"www.example.com:443:10.0.0.1", "other.example.com", "443", "other.example.com"},
+		{"www.example.com:443:[::1]", "www.example.com", "443", "::1"},
+	}
+	for _, tst := range tests {
+		if got := resolveTarget(tst.resolve, tst.host, tst.port); got != tst.expected {
+			t.Errorf("resolveTarget(%q, %q, %q) got %q expected %q", tst.resolve, tst.host, tst.port, got, tst.expected)
+		}
+	}
+	for _, bad := range []string{"www.example.com:10.0.0.1", "www.example.com:https:10.0.0.1", ":443:10.0.0.1"} {
+		if err := ValidateResolve(bad); err == nil {
+			t.Errorf("Expected error for resolve %q", bad)
+		}
+	}
+}
+
+func TestResolveAndSNI(t *testing.T) {
+	var sni, host string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+	}))
+	srv.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		sni = hello.ServerName
+		return nil, nil
+	}}
+	srv.StartTLS()
+	defer srv.Close()
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+	o := HTTPOptions{
+		URL:      fmt.Sprintf("https://prod.example.com:%d/", port),
+		Insecure: true,
+		Resolve:  fmt.Sprintf("prod.example.com:%d:127.0.0.1", port),
+		SNI:      "sni.example.com",
+	}
+	code, _ := Fetch(&o)
+	if code != http.StatusOK {
+		t.Errorf("Got %d code while expecting 200", code)
+	}
+	if sni != "sni.example.com" || host != fmt.Sprintf("prod.example.com:%d", port) {
+		t.Errorf("Unexpected sni %q and host %q", sni, host)
+	}
+	// Same for the fast client in http.
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+	}))
+	defer plain.Close()
+	port = plain.Listener.Addr().(*net.TCPAddr).Port
+	o = HTTPOptions{
+		URL:     fmt.Sprintf("http://prod.example.com:%d/", port),
+		Resolve: fmt.Sprintf("prod.example.com:%d:127.0.0.1", port),
+	}
+	code, _ = Fetch(&o)
+	if code != http.StatusOK || host != fmt.Sprintf("prod.example.com:%d", port) {
+		t.Errorf("Fast client got %d code and host %q", code, host)
+	}
+}
+
 // ValidateUUIDPath is an http server handler validating /{uuid}.
 func ValidateUUIDPath(w http.ResponseWriter, r *http.Request) {
 	if log.LogVerbose() {
@@ -1536,6 +1724,78 @@ func dedupUUID(uuid string) error {
 	return nil
 }
 
+func TestDiscardBody(t *testing.T) {
+	m, a := DynamicHTTPServer(false)
+	m.HandleFunc("/", EchoHandler)
+	chunks := 50
+	chunk := bytes.Repeat([]byte("0123456789"), 400)
+	m.HandleFunc("/chunked", func(w http.ResponseWriter, r *http.Request) {
+		flusher := w.(http.Flusher)
+		for i := 0; i < chunks; i++ {
+			_, _ = w.Write(chunk)
+			flusher.Flush()
+		}
+	})
+	size := 200000 // larger than the default 128k buffer
+	tests := []struct {
+		path      string
+		std       bool
+		keepAlive bool
+		limit     int // -1 for -discard-body
+	}{
+		{"/?size=200000", false, true, -1},
+		{"/?size=200000", false, true, 100},
+		{"/?size=200000", false, false, -1},
+		{"/chunked", false, true, -1},
+		{"/chunked", false, true, 10},
+		{"/?size=200000", true, true, -1},
+		{"/chunked", true, true, 100},
+	}
+	for _, tst := range tests {
+		opts := NewHTTPOptions(fmt.Sprintf("http://localhost:%d%s", a.Port, tst.path))
+		opts.DisableFastClient = tst.std
+		opts.DisableKeepAlive = !tst.keepAlive
+		if tst.limit < 0 {
+			opts.DiscardBody = true
+		} else {
+			opts.ReadLimit = tst.limit
+		}
+		expectedData := tst.limit
+		if expectedData < 0 {
+			expectedData = 0
+		}
+		cli, _ := NewClient(opts)
+		for i := 0; i < 3; i++ {
+			code, data, headerLen := cli.Fetch()
+			if code != http.StatusOK {
+				t.Errorf("%+v: got code %d", tst, code)
+			}
+			if len(data) != headerLen+expectedData {
+				t.Errorf("%+v: got %d data (header %d), expected %d body bytes", tst, len(data), headerLen, expectedData)
+			}
+			if !tst.std && headerLen == 0 {
+				t.Errorf("%+v: headers not found", tst)
+			}
+			respSize := cli.(ResponseSizer).ResponseSize()
+			expectedSize := headerLen + size
+			if tst.path == "/chunked" {
+				// chunk size lines and trailing crlfs are counted with the fast client
+				expectedSize = headerLen + chunks*len(chunk)
+				if !tst.std {
+					expectedSize += chunks*(len("fa0\r\n")+2) + len("0\r\n\r\n")
+				}
+			}
+			if respSize != expectedSize {
+				t.Errorf("%+v: got response size %d, expected %d", tst, respSize, expectedSize)
+			}
+		}
+		socketCount := cli.Close()
+		if !tst.std && tst.keepAlive && socketCount != 1 {
+			t.Errorf("%+v: expected socket to be reused, got %d sockets", tst, socketCount)
+		}
+	}
+}
+
 // --- for bench mark/comparison
 
 func asciiFold0(str string) []byte {
@@ -1613,4 +1873,18 @@ func BenchmarkFoldFind(b *testing.B) {
 	}
 }
 
+func BenchmarkFastClient(b *testing.B) {
+	log.SetLogLevel(log.Warning)
+	port := rawKeepAliveServer(b)
+	o := NewHTTPOptions(fmt.Sprintf("http://localhost:%d/{uuid}", port))
+	o.TraceHeaders = TraceW3C
+	client, _ := NewClient(o)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		client.Fetch()
+	}
+	client.Close()
+}
+
 // -- end of benchmark tests / end of this file
@@ -17,13 +17,17 @@ package fhttp // import "fortio.org/fortio/fhttp"
 import (
 	"encoding/base64"
 	"flag"
+	"fmt"
 	"html/template"
 	"io"
+	"math"
 	"math/rand"
 	"net/http"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
@@ -328,7 +332,144 @@ func generateSize(sizeInput string) (size int) {
 // MaxDelay is the maximum delay allowed for the echoserver responses.
 // It is a dynamic flag with default value of 1.5s so we can test the default 1s timeout in envoy.
 var MaxDelay = dflag.DynDuration(flag.CommandLine, "max-echo-delay", 1500*time.Millisecond,
-	"Maximum sleep time for delay= echo server parameter. dynamic flag.")
+	"Maximum sleep time for delay= (and cpu time for busy=) echo server parameter. dynamic flag.").
+	WithValidator(dflag.ValidateDynDurationRange(0, MaxDelayLimit))
+
+// MaxDelayLimit is the upper bound for the max-echo-delay dynamic flag.
+const MaxDelayLimit = 1 * time.Hour
+
+// burnCPU keeps the cpu (one core) busy for d, unlike a sleep, to emulate cpu
+// bound work (e.g. to test cpu based autoscaling). Returns the meaningless
+// result of the computation.
+func burnCPU(d time.Duration) float64 {
+	end := time.Now().Add(d)
+	x := 1.
+	for time.Now().Before(end) {
+		for i := 0; i < 1000; i++ {
+			x = math.Sqrt(x + float64(i))
+		}
+	}
+	return x
+}
+
+// MaxAlloc is the maximum size allowed for the alloc= echo server parameter,
+// 0 (the default) disables it.
+var MaxAlloc = dflag.DynInt64(flag.CommandLine, "max-echo-alloc", 0,
+	"Maximum bytes allocated per request for the alloc= echo server parameter, 0 to disable it. dynamic flag.").
+	WithValidator(dflag.ValidateDynInt64Range(0, MaxAllocLimit))
+
+// MaxAllocTotal is the maximum bytes held at the same time by all the alloc=
+// echo server requests.
+var MaxAllocTotal = dflag.DynInt64(flag.CommandLine, "max-echo-alloc-total", 1024*1024*1024,
+	"Maximum bytes held at the same time by all the alloc= echo server requests. dynamic flag.").
+	WithValidator(dflag.ValidateDynInt64Range(0, MaxAllocLimit))
+
+// MaxAllocLimit is the upper bound for the max-echo-alloc dynamic flags.
+const MaxAllocLimit = 64 * 1024 * 1024 * 1024
+
+// allocHeld is the bytes currently held by the alloc= echo server requests.
+var allocHeld int64
+
+// parseByteSize parses a size in bytes with an optional B, KB, MB or GB (or
+// KiB, MiB, GiB, all powers of 1024) suffix, e.g. "10MB".
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	mult := int64(1)
+	upper := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	switch {
+	case strings.HasSuffix(upper, "K"):
+		mult = 1024
+	case strings.HasSuffix(upper, "M"):
+		mult = 1024 * 1024
+	case strings.HasSuffix(upper, "G"):
+		mult = 1024 * 1024 * 1024
+	}
+	if mult > 1 {
+		upper = upper[:len(upper)-1]
+	}
+	n, err := strconv.ParseFloat(upper, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// parseAlloc parses the alloc= echo parameter: "size[:hold=duration]", e.g.
+// "10MB:hold=5s". The size is capped at MaxAlloc and the hold at MaxDelay.
+func parseAlloc(alloc string) (int64, time.Duration, error) {
+	if MaxAlloc.Get() <= 0 {
+		return 0, 0, fmt.Errorf("alloc= is disabled, see -max-echo-alloc")
+	}
+	parts := strings.SplitN(alloc, ":", 2)
+	size, err := parseByteSize(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	if max := MaxAlloc.Get(); size > max {
+		size = max
+	}
+	var hold time.Duration
+	if len(parts) == 2 {
+		if !strings.HasPrefix(parts[1], "hold=") {
+			return 0, 0, fmt.Errorf("invalid alloc %q, expecting size[:hold=duration]", alloc)
+		}
+		if hold, err = time.ParseDuration(strings.TrimPrefix(parts[1], "hold=")); err != nil || hold < 0 {
+			return 0, 0, fmt.Errorf("invalid alloc hold duration in %q", alloc)
+		}
+		if max := MaxDelay.Get(); hold > max {
+			hold = max
+		}
+	}
+	return size, hold, nil
+}
+
+// reserveAlloc reserves up to size bytes of the MaxAllocTotal, returns the bytes
+// reserved (0 when all of it is already held) to release with releaseAlloc.
+func reserveAlloc(size int64) int64 {
+	for {
+		held := atomic.LoadInt64(&allocHeld)
+		left := MaxAllocTotal.Get() - held
+		if left <= 0 {
+			return 0
+		}
+		if size > left {
+			size = left
+		}
+		if atomic.CompareAndSwapInt64(&allocHeld, held, held+size) {
+			return size
+		}
+	}
+}
+
+func releaseAlloc(size int64) {
+	atomic.AddInt64(&allocHeld, -size)
+}
+
+// allocMemory allocates size bytes (less when the MaxAllocTotal would be exceeded),
+// touching every page so they're actually used (resident), and keeps them for
+// hold, or until the request is done, before responding, to emulate memory hungry
+// backends.
+func allocMemory(r *http.Request, size int64, hold time.Duration) {
+	reserved := reserveAlloc(size)
+	defer releaseAlloc(reserved)
+	if reserved < size {
+		log.Warnf("Only allocating %d of the %d bytes requested, -max-echo-alloc-total %d reached",
+			reserved, size, MaxAllocTotal.Get())
+	}
+	buf := make([]byte, reserved)
+	for i := 0; i < len(buf); i += 4096 {
+		buf[i] = 1
+	}
+	if hold > 0 {
+		timer := time.NewTimer(hold)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+		}
+	}
+	runtime.KeepAlive(buf)
+}
 
 // generateDelay from string, format: delay="100ms" for 100% 100ms delay
 // delay="10ms:20,20ms:10,1s:0.5" for 20% 10ms, 10% 20ms, 0.5% 1s and 69.5% 0
@@ -15,13 +15,18 @@
 package fhttp
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
 	"os"
 	"runtime"
 	"runtime/pprof"
 	"sort"
+	"strings"
+	"time"
 
 	"fortio.org/fortio/log"
+	"fortio.org/fortio/otlp"
 	"fortio.org/fortio/periodic"
 	"fortio.org/fortio/stats"
 )
@@ -34,6 +39,7 @@ import (
 type HTTPRunnerResults struct {
 	periodic.RunnerResults
 	client   Fetcher
+	sizer    ResponseSizer // for the response size when (part of) the body is discarded
 	RetCodes map[int]int64
 	// internal type/data
 	sizes       *stats.Histogram
@@ -43,27 +49,218 @@ type HTTPRunnerResults struct {
 	HeaderSizes *stats.HistogramData
 	URL         string
 	SocketCount int
-	// http code to abort the run on (-1 for connection or other socket error)
+	// The request deadline, requests exceeding it are counted as TimeoutError in RetCodes
+	// (LongPollHeld in long poll mode).
+	RequestTimeout time.Duration
+	// http code to abort the run on (-1 for connection or other socket error, -3 for timeouts)
 	AbortOn int
 	aborter *periodic.Aborter
+	// Number of retries made (when a RetryPolicy is set) and the latency they added to the calls.
+	Retries   int64
+	RetryTime *stats.HistogramData
+	retry     *RetryPolicy
+	retryTime *stats.Histogram
+	// Count of each value of the CaptureHeader response header ("" when absent), nil when not capturing,
+	// the values beyond the first MaxHeaderValues being counted as OtherHeaderValues.
+	CaptureHeader string
+	HeaderValues  map[string]int64
+	capturer      HeaderCapturer
+	// Cache classification of the responses (when CacheStats): count and latency per CacheClasses
+	// (only the ones seen) and the ratio of hits over all the responses.
+	CacheCounts   map[string]int64
+	CacheLatency  map[string]*stats.HistogramData
+	CacheHitRatio float64
+	cacheHeaders  ResponseHeaderer
+	cacheLatency  map[string]*stats.Histogram
+	// Count and latency of the calls by response size class (when SizeClasses are set).
+	SizeClasses []SizeClass
+	sizeBounds  []int
+	sizeLatency []*stats.Histogram
+	// Split of the calls' latency (when ServerTiming) between the echo server's time, from receiving
+	// the request to writing the response, and the rest (network,...), and the number of responses
+	// without the server's timestamps.
+	ServerTime          *stats.HistogramData
+	NetworkTime         *stats.HistogramData
+	ServerTimingMissing int64
+	timingHeaders       ResponseHeaderer
+	serverTime          *stats.Histogram
+	networkTime         *stats.Histogram
+	// Content encoding of the responses (when AcceptEncoding or Decompress): count per Content-Encoding
+	// (IdentityEncoding when none), body bytes as received and, when decompressing, once decoded with
+	// their ratio (the encodings other than gzip and deflate, e.g. br, are counted as is in
+	// UndecodedResponses) and the number of bodies which failed to decode.
+	AcceptEncoding     string
+	Decompress         bool
+	ContentEncodings   map[string]int64
+	WireBytes          int64
+	DecodedBytes       int64
+	CompressionRatio   float64
+	DecodeErrors       int64
+	UndecodedResponses int64
+	encodingHeaders    ResponseHeaderer
+	decoder            *contentDecoder
+	// Time spent in the last call not part of its latency, decoding or waiting to connect (see periodic.Untimer).
+	untimed       time.Duration
+	connectWaiter connectWaiter // nil without a ConnectRate
+	// Latency breakdown (when LatencyBreakdown) by phase name (see PhaseNames), for the phases
+	// the calls went through (e.g. Connect only for the new connections).
+	LatencyPhases map[string]*stats.HistogramData
+	phaseTimer    PhaseTimer
+	phases        []*stats.Histogram
+	// Count, status codes and latency of the calls of each method (when MethodMix is set).
+	Methods     map[string]*MethodResult
+	methodMixer MethodMixer
+	methodStats map[string]*methodStats
+	// Long polling (when LongPoll is set): the requests still held at its end are counted as LongPollHeld
+	// and the duration of the polls' holds, from sending the request to the response (or to the deadline),
+	// and of the reconnects, from the end of a poll to the next request sent by that thread, including
+	// the connection setup when the previous one was closed.
+	LongPoll     time.Duration
+	HoldDuration *stats.HistogramData
+	Reconnect    *stats.HistogramData
+	sentTimer    RequestSentTimer
+	hold         *stats.Histogram
+	reconnect    *stats.Histogram
+	lastPollEnd  time.Time
+	// Echo back the optional new connections rate limit (per second), and how many connections had
+	// to wait for it and for how long in total.
+	ConnectRate   float64
+	ConnectWaits  int64
+	ConnectWaited time.Duration
+	// Number of TLS handshakes (https), how many were session resumptions and their ratio.
+	TLSHandshakes     int64
+	TLSResumed        int64
+	TLSResumptionRate float64
+	// Availability of the target (see RunnerResults.Unavailable) and current wait before the next call
+	// after connection errors, starting at reconnectBackoff.
+	availability     *periodic.AvailabilityTracker
+	reconnectBackoff time.Duration
+	backoff          time.Duration
+	// Status code and size of the last call, for the streamed samples.
+	lastCode int
+	lastSize int
+}
+
+// connectionInfo is implemented by both clients, for the run metadata.
+type connectionInfo interface {
+	ConnectionInfo() (local, remote net.Addr, tlsState *tls.ConnectionState)
+}
+
+// tlsConnections is implemented by the std client, for the run metadata.
+type tlsConnections interface {
+	TLSConnections() *periodic.TLSCounts
 }
 
 // Run tests http request fetching. Main call being run at the target QPS.
 // To be set as the Function in RunnerOptions.
 func (httpstate *HTTPRunnerResults) Run(t int) {
 	log.Debugf("Calling in %d", t)
+	httpstate.untimed = 0
+	if httpstate.connectWaiter != nil {
+		httpstate.connectWaiter.takeConnectWait() // of the previous warmup calls, if any
+	}
+	var start time.Time
+	if httpstate.cacheHeaders != nil || httpstate.sizeLatency != nil || httpstate.timingHeaders != nil ||
+		httpstate.methodMixer != nil || httpstate.LongPoll > 0 {
+		start = time.Now()
+	}
 	code, body, headerSize := httpstate.client.Fetch()
+	if httpstate.LongPoll > 0 {
+		code = httpstate.recordLongPoll(code, start)
+	}
+	if httpstate.retry != nil && httpstate.retry.Retries > 0 && httpstate.retry.shouldRetry(code) {
+		code, body, headerSize = httpstate.fetchWithRetries(code, body, headerSize)
+	}
+	if httpstate.connectWaiter != nil {
+		httpstate.untimed = httpstate.connectWaiter.takeConnectWait()
+	}
+	var latency float64
+	if !start.IsZero() {
+		latency = (time.Since(start) - httpstate.untimed).Seconds()
+	}
+	if httpstate.cacheHeaders != nil && code > 0 {
+		class := ClassifyCache(httpstate.cacheHeaders.ResponseHeader)
+		httpstate.CacheCounts[class]++
+		httpstate.cacheLatency[class].Record(latency)
+	}
+	if httpstate.availability != nil {
+		httpstate.recordAvailability(code)
+	}
+	if httpstate.timingHeaders != nil && code > 0 {
+		httpstate.recordServerTiming(latency)
+	}
+	if httpstate.phaseTimer != nil {
+		httpstate.recordPhases()
+	}
+	if httpstate.methodMixer != nil {
+		httpstate.recordMethod(code, latency)
+	}
+	if httpstate.encodingHeaders != nil && codeIsOK(code) {
+		decodeStart := time.Now()
+		httpstate.recordEncoding(body, headerSize)
+		httpstate.untimed += time.Since(decodeStart)
+	}
 	size := len(body)
+	if httpstate.sizer != nil {
+		size = httpstate.sizer.ResponseSize()
+	}
+	if httpstate.sizeLatency != nil && code > 0 {
+		httpstate.sizeLatency[sizeClass(httpstate.sizeBounds, size)].Record(latency)
+	}
 	log.Debugf("Got in %3d hsz %d sz %d - will abort on %d", code, headerSize, size, httpstate.AbortOn)
+	httpstate.lastCode, httpstate.lastSize = code, size
 	httpstate.RetCodes[code]++
 	httpstate.sizes.Record(float64(size))
 	httpstate.headerSizes.Record(float64(headerSize))
+	if httpstate.capturer != nil {
+		addHeaderValue(httpstate.HeaderValues, httpstate.capturer.CapturedHeader(), 1)
+	}
 	if httpstate.AbortOn == code {
 		httpstate.aborter.Abort()
 		log.Infof("Aborted run because of code %d - data %s", code, DebugSummary(body, 1024))
 	}
 }
 
+// LastCallResult returns the status code and size of the last call (see periodic.CallResulter).
+func (httpstate *HTTPRunnerResults) LastCallResult() (int, int64) {
+	return httpstate.lastCode, int64(httpstate.lastSize)
+}
+
+// LastCallFailed returns true when the last call's status code wasn't ok (see periodic.CallErrorer).
+func (httpstate *HTTPRunnerResults) LastCallFailed() bool {
+	return !codeIsOK(httpstate.lastCode) && httpstate.lastCode != LongPollHeld
+}
+
+// UntimedDuration returns the time the last call spent waiting to connect and
+// decoding its response, excluded from its latency (see periodic.Untimer).
+func (httpstate *HTTPRunnerResults) UntimedDuration() time.Duration {
+	return httpstate.untimed
+}
+
+// Warmup makes a warmup call, not counted in the results (see periodic.Warmer).
+func (httpstate *HTTPRunnerResults) Warmup(t int) {
+	code, _, _ := httpstate.client.Fetch()
+	log.Debugf("Warmup call in %d: %d", t, code)
+}
+
+// fetchWithRetries retries a failed call per the RetryPolicy and returns the
+// last attempt's result.
+func (httpstate *HTTPRunnerResults) fetchWithRetries(code int, body []byte, headerSize int) (int, []byte, int) {
+	start := time.Now()
+	backoff := httpstate.retry.Backoff
+	for i := 0; i < httpstate.retry.Retries && httpstate.retry.shouldRetry(code); i++ {
+		log.Debugf("Retrying (%d/%d) after code %d and %v backoff", i+1, httpstate.retry.Retries, code, backoff)
+		if backoff > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		httpstate.Retries++
+		code, body, headerSize = httpstate.client.Fetch()
+	}
+	httpstate.retryTime.Record(time.Since(start).Seconds())
+	return code, body, headerSize
+}
+
 // HTTPRunnerOptions includes the base RunnerOptions plus http specific
 // options.
 type HTTPRunnerOptions struct {
@@ -71,8 +268,30 @@ type HTTPRunnerOptions struct {
 	HTTPOptions               // Need to call Init() to initialize
 	Profiler           string // file to save profiles to. defaults to no profiling
 	AllowInitialErrors bool   // whether initial errors don't cause an abort
-	// Which status code cause an abort of the run (default 0 = don't abort; reminder -1 is returned for socket errors)
+	// Which status code cause an abort of the run (default 0 = don't abort; reminder -1 is returned for socket errors
+	// and -3 for timeouts)
 	AbortOn int
+	// OTLP/HTTP endpoint to send spans of sampled requests to (empty for no export).
+	OTLPEndpoint string
+	// Fraction of the requests to export as spans when OTLPEndpoint is set. (0 is the same as 1: all)
+	OTLPSampleRate float64
+	// Optional retrying of failed calls (default 0 Retries = no retries).
+	Retry RetryPolicy
+	// Classify the responses as cache HIT/MISS/BYPASS (see ClassifyCache) and report the hit ratio and
+	// per class latency.
+	CacheStats bool
+	// Reload the client Cert/Key from disk every CertReloadInterval (if > 0) and/or on SIGHUP during the run,
+	// for new connections (std client).
+	CertReloadInterval time.Duration
+	CertReloadOnSignal bool
+	// Increasing response size boundaries, in bytes, to also report the latency of each size class
+	// (e.g. with variable size responses), none by default. See ParseSizeClasses.
+	SizeClasses []int
+	// Optional validation requests before starting the run (see PreCheck).
+	PreCheck PreCheck
+	// When > 0, after a connection error (e.g. the target restarting) each thread waits that long before
+	// its next call, doubled for each consecutive error up to MaxReconnectBackoff, instead of spinning.
+	ReconnectBackoff time.Duration
 }
 
 // RunHTTPTest runs an http test and returns the aggregated stats.
@@ -83,7 +302,54 @@ func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 	defer r.Options().Abort()
 	numThreads := r.Options().NumThreads
 	o.HTTPOptions.Init(o.URL)
+	if err := ValidateAffinity(&o.HTTPOptions, numThreads); err != nil {
+		return nil, err
+	}
+	o.HTTPOptions.numConnections = numThreads
+	if o.Decompress && o.bodyLimit() >= 0 {
+		return nil, fmt.Errorf("can't decompress the responses when discarding (part of) their body")
+	}
+	if u := undecodableEncodings(o.AcceptEncoding); o.Decompress && len(u) > 0 {
+		return nil, fmt.Errorf("can't decompress %s encoded responses (only gzip and deflate), remove them from the accept-encoding",
+			strings.Join(u, ", "))
+	}
 	out := r.Options().Out // Important as the default value is set from nil to stdout inside NewPeriodicRunner
+	if o.CertReloadInterval > 0 || o.CertReloadOnSignal {
+		certs, err := newCertReloader(o.Cert, o.Key)
+		if err != nil {
+			return nil, err
+		}
+		o.HTTPOptions.certs = certs
+		stop := certs.watch(o.CertReloadInterval, o.CertReloadOnSignal)
+		defer func() {
+			stop()
+			o.HTTPOptions.certs = nil
+			_, _ = fmt.Fprintf(out, "Client cert reloaded %d times\n", certs.reloadCount())
+		}()
+	}
+	if o.SlowWriteInterval > 0 {
+		o.HTTPOptions.slowWriteAbort = r.Options().Stop.StopChan
+		defer func() {
+			o.HTTPOptions.slowWriteAbort = nil
+		}()
+	}
+	if o.ConnectRate > 0 {
+		o.HTTPOptions.connectLimiter = newConnectLimiter(o.ConnectRate)
+		o.HTTPOptions.connectLimiter.abort = r.Options().Stop.StopChan
+		defer func() {
+			o.HTTPOptions.connectLimiter = nil
+		}()
+	}
+	if err := o.PreCheck.run(&o.HTTPOptions, out); err != nil {
+		return nil, err
+	}
+	if o.OTLPEndpoint != "" {
+		o.SpanExporter = otlp.NewExporter(o.OTLPEndpoint, "fortio", o.OTLPSampleRate)
+		defer func() {
+			exported, dropped := o.SpanExporter.Close()
+			_, _ = fmt.Fprintf(out, "Spans exported: %d (dropped %d)\n", exported, dropped)
+		}()
+	}
 	total := HTTPRunnerResults{
 		RetCodes:    make(map[int]int64),
 		sizes:       stats.NewHistogram(0, 100),
@@ -91,6 +357,44 @@ func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 		URL:         o.URL,
 		AbortOn:     o.AbortOn,
 		aborter:     r.Options().Stop,
+		retry:       &o.Retry,
+		retryTime:   stats.NewHistogram(0, .001),
+		// Shared by the threads:
+		availability: periodic.NewAvailabilityTracker(UnavailableMinErrors),
+	}
+	total.RequestTimeout = o.requestTimeout()
+	total.LongPoll = o.LongPoll
+	if o.LongPoll > 0 {
+		total.hold = r.Options().NewLatencyHistogram()
+		total.reconnect = r.Options().NewLatencyHistogram()
+	}
+	total.CaptureHeader = o.CaptureHeader
+	if o.CaptureHeader != "" {
+		total.HeaderValues = make(map[string]int64)
+	}
+	if o.CacheStats {
+		total.CacheCounts = make(map[string]int64)
+		total.cacheLatency = newCacheLatency(r.Options())
+	}
+	if len(o.SizeClasses) > 0 {
+		total.sizeBounds = o.SizeClasses
+		total.sizeLatency = newSizeLatency(o.SizeClasses, r.Options())
+	}
+	if o.ServerTiming {
+		total.serverTime = r.Options().NewLatencyHistogram()
+		total.networkTime = r.Options().NewLatencyHistogram()
+	}
+	if o.LatencyBreakdown {
+		total.phases = newPhaseHistograms(r.Options())
+	}
+	if len(o.MethodMix) > 0 {
+		total.methodStats = newMethodStats(o.MethodMix, r.Options())
+	}
+	countEncodings := o.AcceptEncoding != "" || o.Decompress
+	if countEncodings {
+		total.AcceptEncoding = o.acceptEncoding()
+		total.Decompress = o.Decompress
+		total.ContentEncodings = make(map[string]int64)
 	}
 	httpstate := make([]HTTPRunnerResults, numThreads)
 	for i := 0; i < numThreads; i++ {
@@ -104,7 +408,52 @@ func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 		if err != nil {
 			return nil, err
 		}
-		if o.Exactly <= 0 {
+		if o.bodyLimit() >= 0 {
+			httpstate[i].sizer, _ = httpstate[i].client.(ResponseSizer)
+		}
+		if o.CaptureHeader != "" {
+			httpstate[i].capturer, _ = httpstate[i].client.(HeaderCapturer)
+			httpstate[i].HeaderValues = make(map[string]int64)
+		}
+		if o.CacheStats {
+			httpstate[i].cacheHeaders, _ = httpstate[i].client.(ResponseHeaderer)
+			httpstate[i].CacheCounts = make(map[string]int64)
+			httpstate[i].cacheLatency = newCacheLatency(r.Options())
+		}
+		if total.sizeLatency != nil {
+			httpstate[i].sizeBounds = total.sizeBounds
+			httpstate[i].sizeLatency = newSizeLatency(total.sizeBounds, r.Options())
+		}
+		if o.ServerTiming {
+			httpstate[i].timingHeaders, _ = httpstate[i].client.(ResponseHeaderer)
+			httpstate[i].serverTime = total.serverTime.Clone()
+			httpstate[i].networkTime = total.networkTime.Clone()
+		}
+		if countEncodings {
+			httpstate[i].encodingHeaders, _ = httpstate[i].client.(ResponseHeaderer)
+			httpstate[i].Decompress = o.Decompress
+			httpstate[i].ContentEncodings = make(map[string]int64)
+			httpstate[i].decoder = &contentDecoder{}
+		}
+		if o.LatencyBreakdown {
+			httpstate[i].phaseTimer, _ = httpstate[i].client.(PhaseTimer)
+			httpstate[i].phases = newPhaseHistograms(r.Options())
+		}
+		if o.ConnectRate > 0 {
+			httpstate[i].connectWaiter, _ = httpstate[i].client.(connectWaiter)
+		}
+		if len(o.MethodMix) > 0 {
+			httpstate[i].methodMixer, _ = httpstate[i].client.(MethodMixer)
+			httpstate[i].methodStats = newMethodStats(o.MethodMix, r.Options())
+		}
+		if o.LongPoll > 0 {
+			httpstate[i].LongPoll = o.LongPoll
+			httpstate[i].sentTimer, _ = httpstate[i].client.(RequestSentTimer)
+			httpstate[i].hold = total.hold.Clone()
+			httpstate[i].reconnect = total.reconnect.Clone()
+		}
+		// No initial call when it could be held (long polling) for each thread in turn.
+		if o.Exactly <= 0 && !o.HasWarmup() && o.LongPoll <= 0 {
 			code, data, headerSize := httpstate[i].client.Fetch()
 			if !o.AllowInitialErrors && !codeIsOK(code) {
 				return nil, fmt.Errorf("error %d for %s: %q", code, o.URL, string(data))
@@ -119,6 +468,10 @@ func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 		httpstate[i].RetCodes = make(map[int]int64)
 		httpstate[i].AbortOn = total.AbortOn
 		httpstate[i].aborter = total.aborter
+		httpstate[i].retry = total.retry
+		httpstate[i].retryTime = total.retryTime.Clone()
+		httpstate[i].availability = total.availability
+		httpstate[i].reconnectBackoff = o.ReconnectBackoff
 	}
 	// TODO avoid copy pasta with grpcrunner
 	if o.Profiler != "" {
@@ -150,7 +503,14 @@ func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 	// unused ones. We also must cleanup all the created clients.
 	keys := []int{}
 	for i := 0; i < numThreads; i++ {
+		if ci, ok := httpstate[i].client.(connectionInfo); ok {
+			total.Metadata.AddConnection(ci.ConnectionInfo())
+		}
+		if tc, ok := httpstate[i].client.(tlsConnections); ok {
+			total.Metadata.AddTLSConnections(tc.TLSConnections())
+		}
 		total.SocketCount += httpstate[i].client.Close()
+		releaseBuffer(httpstate[i].client)
 		// Q: is there some copying each time stats[i] is used?
 		for k := range httpstate[i].RetCodes {
 			if _, exists := total.RetCodes[k]; !exists {
@@ -160,6 +520,43 @@ func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 		}
 		total.sizes.Transfer(httpstate[i].sizes)
 		total.headerSizes.Transfer(httpstate[i].headerSizes)
+		total.Retries += httpstate[i].Retries
+		total.retryTime.Transfer(httpstate[i].retryTime)
+		for v, n := range httpstate[i].HeaderValues {
+			addHeaderValue(total.HeaderValues, v, n)
+		}
+		for class, n := range httpstate[i].CacheCounts {
+			total.CacheCounts[class] += n
+			total.cacheLatency[class].Transfer(httpstate[i].cacheLatency[class])
+		}
+		for c, h := range httpstate[i].sizeLatency {
+			total.sizeLatency[c].Transfer(h)
+		}
+		if httpstate[i].timingHeaders != nil {
+			total.serverTime.Transfer(httpstate[i].serverTime)
+			total.networkTime.Transfer(httpstate[i].networkTime)
+			total.ServerTimingMissing += httpstate[i].ServerTimingMissing
+		}
+		for p, h := range httpstate[i].phases {
+			total.phases[p].Transfer(h)
+		}
+		for method, s := range httpstate[i].methodStats {
+			for code, n := range s.codes {
+				total.methodStats[method].codes[code] += n
+			}
+			total.methodStats[method].latency.Transfer(s.latency)
+		}
+		if o.LongPoll > 0 {
+			total.hold.Transfer(httpstate[i].hold)
+			total.reconnect.Transfer(httpstate[i].reconnect)
+		}
+		for enc, n := range httpstate[i].ContentEncodings {
+			total.ContentEncodings[enc] += n
+		}
+		total.WireBytes += httpstate[i].WireBytes
+		total.DecodedBytes += httpstate[i].DecodedBytes
+		total.DecodeErrors += httpstate[i].DecodeErrors
+		total.UndecodedResponses += httpstate[i].UndecodedResponses
 	}
 	// Cleanup state:
 	r.Options().ReleaseRunners()
@@ -168,10 +565,102 @@ func RunHTTPTest(o *HTTPRunnerOptions) (*HTTPRunnerResults, error) {
 	_, _ = fmt.Fprintf(out, "Sockets used: %d (for perfect keepalive, would be %d)\n", total.SocketCount, r.Options().NumThreads)
 	_, _ = fmt.Fprintf(out, "Jitter: %t\n", total.Jitter)
 	for _, k := range keys {
+		if k == TimeoutError {
+			_, _ = fmt.Fprintf(out, "Timeout (%v) : %d (%.1f %%)\n", total.RequestTimeout, total.RetCodes[k],
+				100.*float64(total.RetCodes[k])/totalCount)
+			continue
+		}
+		if k == LongPollHeld {
+			_, _ = fmt.Fprintf(out, "Held (%v) : %d (%.1f %%)\n", total.LongPoll, total.RetCodes[k],
+				100.*float64(total.RetCodes[k])/totalCount)
+			continue
+		}
 		_, _ = fmt.Fprintf(out, "Code %3d : %d (%.1f %%)\n", k, total.RetCodes[k], 100.*float64(total.RetCodes[k])/totalCount)
 	}
+	// Only when some calls were retried: the average of an empty histogram is NaN, which can't be json serialized.
+	if total.retryTime.Count > 0 {
+		total.RetryTime = total.retryTime.Export()
+		_, _ = fmt.Fprintf(out, "Retries: %d for %d calls, added latency avg %.3f ms max %.3f ms\n", total.Retries,
+			total.RetryTime.Count, 1000.*total.RetryTime.Avg, 1000.*total.RetryTime.Max)
+	} else if o.Retry.Retries > 0 {
+		_, _ = fmt.Fprintf(out, "Retries: 0\n")
+	}
+	if o.ConnectRate > 0 {
+		total.ConnectRate = o.ConnectRate
+		total.ConnectWaits, total.ConnectWaited = o.HTTPOptions.connectLimiter.stats()
+		_, _ = fmt.Fprintf(out, "Connect rate limited to %g/s: %d connections waited %v in total\n", total.ConnectRate,
+			total.ConnectWaits, total.ConnectWaited.Round(time.Millisecond))
+	}
+	total.Unavailable = total.availability.Windows(total.StartTime, total.StartTime.Add(total.ActualDuration))
+	periodic.PrintUnavailable(out, total.Unavailable)
+	total.TLSHandshakes, total.TLSResumed = total.Metadata.TLSResumption()
+	if total.TLSHandshakes > 0 {
+		total.TLSResumptionRate = float64(total.TLSResumed) / float64(total.TLSHandshakes)
+		_, _ = fmt.Fprintf(out, "TLS handshakes: %d, resumed: %d (%.1f %%)\n", total.TLSHandshakes, total.TLSResumed,
+			100.*total.TLSResumptionRate)
+	}
+	for _, c := range total.Metadata.TLSCertificates {
+		_, _ = fmt.Fprintf(out, "TLS certificate %q (issuer %q) chain depth %d, expires %s, OCSP stapled %t : %d handshakes\n",
+			c.Subject, c.Issuer, c.ChainDepth, c.NotAfter.Format(time.RFC3339), c.OCSPStapled, c.Count)
+		if c.VerifyError != "" {
+			_, _ = fmt.Fprintf(out, "TLS certificate %q validation error: %s\n", c.Subject, c.VerifyError)
+		}
+	}
+	if o.CaptureHeader != "" {
+		printHeaderValues(out, o.CaptureHeader, total.HeaderValues, totalCount)
+	}
+	if o.CacheStats {
+		responses := int64(0)
+		total.CacheLatency = make(map[string]*stats.HistogramData)
+		for _, class := range CacheClasses {
+			responses += total.CacheCounts[class]
+			if total.CacheCounts[class] > 0 {
+				total.CacheLatency[class] = total.cacheLatency[class].Export().CalcPercentiles(o.Percentiles)
+			}
+		}
+		if responses > 0 {
+			total.CacheHitRatio = float64(total.CacheCounts[CacheHit]) / float64(responses)
+		}
+		printCacheStats(out, total.CacheCounts, total.CacheLatency, total.CacheHitRatio)
+	}
+	if total.sizeLatency != nil {
+		total.SizeClasses = exportSizeClasses(total.sizeBounds, total.sizeLatency, o.Percentiles)
+		printSizeClasses(out, total.SizeClasses)
+	}
+	if o.ServerTiming {
+		// Only when some responses had the timing, as for RetryTime.
+		if total.serverTime.Count > 0 {
+			total.ServerTime = total.serverTime.Export().CalcPercentiles(o.Percentiles)
+			total.NetworkTime = total.networkTime.Export().CalcPercentiles(o.Percentiles)
+		}
+		printServerTiming(out, total.ServerTime, total.NetworkTime, total.ServerTimingMissing)
+	}
+	if countEncodings {
+		if total.Decompress && total.WireBytes > 0 {
+			total.CompressionRatio = float64(total.DecodedBytes) / float64(total.WireBytes)
+		}
+		printEncodings(out, &total)
+	}
+	if o.LatencyBreakdown {
+		total.LatencyPhases = exportPhases(total.phases, o.Percentiles)
+		printPhases(out, total.LatencyPhases)
+	}
+	if len(o.MethodMix) > 0 {
+		total.Methods = exportMethods(total.methodStats, o.Percentiles)
+		printMethods(out, o.MethodMix, total.Methods, totalCount)
+	}
+	if o.LongPoll > 0 {
+		// Only when there were some, as for RetryTime.
+		if total.hold.Count > 0 {
+			total.HoldDuration = total.hold.Export().CalcPercentiles(o.Percentiles)
+		}
+		if total.reconnect.Count > 0 {
+			total.Reconnect = total.reconnect.Export().CalcPercentiles(o.Percentiles)
+		}
+		printLongPoll(out, total.HoldDuration, total.Reconnect)
+	}
 	total.HeaderSizes = total.headerSizes.Export()
-	total.Sizes = total.sizes.Export()
+	total.Sizes = total.sizes.Export().CalcPercentiles(o.Percentiles)
 	if log.LogVerbose() {
 		total.HeaderSizes.Print(out, "Response Header Sizes Histogram")
 		total.Sizes.Print(out, "Response Body/Total Sizes Histogram")
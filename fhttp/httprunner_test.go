@@ -16,14 +16,21 @@
 package fhttp
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"fortio.org/fortio/log"
+	"fortio.org/fortio/periodic"
 )
 
 func TestHTTPRunner(t *testing.T) {
@@ -52,6 +59,9 @@ func TestHTTPRunner(t *testing.T) {
 	if totalReq != httpOk {
 		t.Errorf("Mismatch between requests %d and ok %v", totalReq, res.RetCodes)
 	}
+	if _, err = json.Marshal(res); err != nil {
+		t.Errorf("Unable to json serialize the results: %v", err)
+	}
 	if res.SocketCount != res.RunnerResults.NumThreads {
 		t.Errorf("%d socket used, expected same as thread# %d", res.SocketCount, res.RunnerResults.NumThreads)
 	}
@@ -123,6 +133,375 @@ func testHTTPNotLeaking(t *testing.T, opts *HTTPRunnerOptions) {
 	}
 }
 
+func TestHTTPRunnerDiscardBody(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/", EchoHandler)
+	for _, std := range []bool{false, true} {
+		opts := HTTPRunnerOptions{}
+		opts.QPS = 100
+		opts.Exactly = 10
+		opts.NumThreads = 2
+		opts.URL = fmt.Sprintf("http://localhost:%d/?size=150000", addr.Port)
+		opts.DisableFastClient = std
+		opts.DiscardBody = true
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.RetCodes[http.StatusOK] != 10 {
+			t.Errorf("std %v: unexpected codes %v", std, res.RetCodes)
+		}
+		// Sizes are the full responses even though the bodies were discarded.
+		if res.Sizes.Min < 150000 {
+			t.Errorf("std %v: response sizes %+v should include the discarded bodies", std, res.Sizes)
+		}
+	}
+}
+
+func TestParseRetryOn(t *testing.T) {
+	codes, err := ParseRetryOn("502, 503,connect-error,timeout,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(codes, []int{502, 503, SocketError, TimeoutError}) {
+		t.Errorf("Unexpected codes %v", codes)
+	}
+	if _, err = ParseRetryOn("502,slow"); err == nil {
+		t.Errorf("Expected error for invalid retry-on")
+	}
+}
+
+func TestHTTPRunnerRetries(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	var calls int64
+	// Every other call fails, so each call fails once and its 1st retry succeeds.
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&calls, 1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	opts := HTTPRunnerOptions{}
+	opts.QPS = 100
+	opts.Exactly = 20
+	opts.NumThreads = 1
+	opts.URL = fmt.Sprintf("http://localhost:%d/", addr.Port)
+	opts.Retry = RetryPolicy{Retries: 2, RetryOn: []int{http.StatusServiceUnavailable}, Backoff: time.Millisecond}
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[http.StatusOK] != 20 || len(res.RetCodes) != 1 {
+		t.Errorf("Unexpected codes with retries %v", res.RetCodes)
+	}
+	if res.Retries != 20 || res.RetryTime.Count != 20 || res.RetryTime.Min < 0.001 {
+		t.Errorf("Unexpected retries %d %+v", res.Retries, res.RetryTime)
+	}
+	// Without retries the errors are counted.
+	opts.Retry.Retries = 0
+	res, err = RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[http.StatusServiceUnavailable] != 10 || res.Retries != 0 {
+		t.Errorf("Unexpected codes without retries %v (%d retries)", res.RetCodes, res.Retries)
+	}
+}
+
+func TestHTTPRunnerTimeouts(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/", EchoHandler)
+	for _, std := range []bool{false, true} {
+		opts := HTTPRunnerOptions{}
+		opts.QPS = 100
+		opts.Exactly = 4
+		opts.NumThreads = 2
+		opts.URL = fmt.Sprintf("http://localhost:%d/?delay=300ms", addr.Port)
+		opts.DisableFastClient = std
+		opts.HTTPReqTimeOut = 100 * time.Millisecond
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.RetCodes[TimeoutError] != 4 || len(res.RetCodes) != 1 {
+			t.Errorf("std %v: expected only timeouts, got %v", std, res.RetCodes)
+		}
+		if res.RequestTimeout != 100*time.Millisecond {
+			t.Errorf("std %v: unexpected request timeout %v", std, res.RequestTimeout)
+		}
+	}
+}
+
+func TestHTTPRunnerAffinity(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	var mu sync.Mutex
+	var conns map[string]string // affinity key to remote address
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		k := r.Header.Get("X-User")
+		mu.Lock()
+		defer mu.Unlock()
+		if prev, found := conns[k]; found && prev != r.RemoteAddr {
+			t.Errorf("Key %q received on %s and %s", k, prev, r.RemoteAddr)
+		}
+		conns[k] = r.RemoteAddr
+	})
+	for _, std := range []bool{false, true} {
+		conns = make(map[string]string)
+		opts := HTTPRunnerOptions{}
+		opts.QPS = 100
+		opts.Exactly = 21
+		opts.NumThreads = 3
+		opts.URL = fmt.Sprintf("http://localhost:%d/", addr.Port)
+		opts.DisableFastClient = std
+		opts.AffinityHeader = "x-user"
+		opts.AffinityKeys = 11
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.RetCodes[http.StatusOK] != 21 {
+			t.Errorf("std %v: unexpected codes %v", std, res.RetCodes)
+		}
+		mu.Lock()
+		if len(conns) != 11 || conns["00"] == "" || conns["10"] == "" {
+			t.Errorf("std %v: expected the 11 keys, got %v", std, conns)
+		}
+		mu.Unlock()
+	}
+	opts := HTTPRunnerOptions{}
+	opts.Exactly = 21
+	opts.NumThreads = 3
+	opts.URL = fmt.Sprintf("http://localhost:%d/", addr.Port)
+	opts.AffinityHeader = "x-user"
+	opts.AffinityKeys = 2
+	if _, err := RunHTTPTest(&opts); err == nil {
+		t.Errorf("Expected error with fewer keys than connections")
+	}
+}
+
+func TestHTTPRunnerCaptureHeader(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	var count int64
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt64(&count, 1) % 3 {
+		case 0:
+			w.Header().Set("X-Served-By", "backend-a")
+		case 1:
+			w.Header().Set("X-Served-By", " backend-b ")
+		}
+	})
+	for _, std := range []bool{false, true} {
+		opts := HTTPRunnerOptions{}
+		opts.QPS = 100
+		opts.Exactly = 30
+		opts.NumThreads = 2
+		opts.URL = fmt.Sprintf("http://localhost:%d/", addr.Port)
+		opts.DisableFastClient = std
+		opts.CaptureHeader = "x-served-by"
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.HeaderValues) != 3 || res.HeaderValues["backend-a"] != 10 || res.HeaderValues["backend-b"] != 10 ||
+			res.HeaderValues[""] != 10 {
+			t.Errorf("std %v: unexpected header values %v", std, res.HeaderValues)
+		}
+	}
+}
+
+func TestHTTPRunnerCaptureHeaderCardinality(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	var count int64
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-Id", strconv.FormatInt(atomic.AddInt64(&count, 1), 10))
+	})
+	opts := HTTPRunnerOptions{}
+	opts.QPS = -1
+	opts.Exactly = 3 * MaxHeaderValues
+	opts.NumThreads = 2
+	opts.URL = fmt.Sprintf("http://localhost:%d/", addr.Port)
+	opts.CaptureHeader = "X-Request-Id"
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := int64(0)
+	for _, n := range res.HeaderValues {
+		total += n
+	}
+	if len(res.HeaderValues) != MaxHeaderValues+1 || total != opts.Exactly ||
+		res.HeaderValues[OtherHeaderValues] != opts.Exactly-MaxHeaderValues {
+		t.Errorf("expected %d values plus the others for %d calls, got %d values: %v",
+			MaxHeaderValues, opts.Exactly, len(res.HeaderValues), res.HeaderValues)
+	}
+}
+
+func TestHTTPRunnerWarmup(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	var count int64
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&count, 1) <= 6 {
+			w.WriteHeader(http.StatusServiceUnavailable) // still warming up
+		}
+	})
+	opts := HTTPRunnerOptions{}
+	opts.QPS = 100
+	opts.Duration = 100 * time.Millisecond
+	opts.NumThreads = 2
+	opts.URL = fmt.Sprintf("http://localhost:%d/", addr.Port)
+	opts.WarmupCalls = 6
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err) // the default warmup call would have failed
+	}
+	total := res.DurationHistogram.Count
+	if res.WarmupHistogram == nil || res.WarmupHistogram.Count != 6 || len(res.RetCodes) != 1 ||
+		res.RetCodes[http.StatusOK] != total || atomic.LoadInt64(&count) != 6+total {
+		t.Errorf("unexpected warmup %+v, codes %v for %d calls", res.WarmupHistogram, res.RetCodes, count)
+	}
+}
+
+func TestHTTPRunnerMetadata(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/", EchoHandler)
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(EchoHandler))
+	defer tlsServer.Close()
+	tests := []struct {
+		url string
+		std bool
+		tls bool
+	}{
+		{fmt.Sprintf("http://localhost:%d/", addr.Port), false, false},
+		{fmt.Sprintf("http://localhost:%d/", addr.Port), true, false},
+		{tlsServer.URL, true, true},
+	}
+	for _, tst := range tests {
+		opts := HTTPRunnerOptions{}
+		opts.QPS = 100
+		opts.Exactly = 4
+		opts.NumThreads = 2
+		opts.URL = tst.url
+		opts.DisableFastClient = tst.std
+		opts.Insecure = true
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := res.Metadata
+		if m == nil || m.GOOS != runtime.GOOS || m.GoVersion == "" {
+			t.Fatalf("%+v: missing/bad metadata %+v", tst, m)
+		}
+		if len(m.ClientIPs) != 1 || len(m.TargetIPs) != 1 || m.TargetIPs[0] != "127.0.0.1" {
+			t.Errorf("%+v: unexpected client %v / target %v ips", tst, m.ClientIPs, m.TargetIPs)
+		}
+		if tst.tls != (m.TLSVersion != "" && m.TLSCipher != "") {
+			t.Errorf("%+v: unexpected tls version %q cipher %q", tst, m.TLSVersion, m.TLSCipher)
+		}
+		conns := int64(0)
+		for _, c := range m.TLSConnections {
+			if c.Version != m.TLSVersion || c.Cipher != m.TLSCipher || c.Resumed {
+				t.Errorf("%+v: unexpected tls connections %+v", tst, c)
+			}
+			conns += c.Count
+		}
+		// One keep alive connection per thread.
+		if tst.tls != (conns == 2) {
+			t.Errorf("%+v: unexpected tls connections %+v", tst, m.TLSConnections)
+		}
+	}
+}
+
+func TestHTTPRunnerTLSResumption(t *testing.T) {
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(EchoHandler))
+	defer tlsServer.Close()
+	tests := []struct {
+		resumption bool
+		noTickets  bool
+		resumed    int64
+	}{
+		{true, false, 3}, // only the first of the 4 connections is a full handshake
+		{false, false, 0},
+		{true, true, 0},
+	}
+	for _, tst := range tests {
+		opts := HTTPRunnerOptions{}
+		opts.QPS = 100
+		opts.Exactly = 4
+		opts.NumThreads = 1
+		opts.URL = tlsServer.URL
+		opts.Insecure = true
+		opts.DisableKeepAlive = true
+		opts.TLSResumption = tst.resumption
+		opts.DisableTLSSessionTickets = tst.noTickets
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.TLSHandshakes != 4 || res.TLSResumed != tst.resumed ||
+			res.TLSResumptionRate != float64(tst.resumed)/4 {
+			t.Errorf("%+v: unexpected tls handshakes %d resumed %d rate %g", tst, res.TLSHandshakes, res.TLSResumed,
+				res.TLSResumptionRate)
+		}
+	}
+}
+
+func TestHTTPRunnerTLSCertificates(t *testing.T) {
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(EchoHandler))
+	defer tlsServer.Close()
+	opts := HTTPRunnerOptions{}
+	opts.QPS = 100
+	opts.Exactly = 3
+	opts.NumThreads = 1
+	opts.URL = tlsServer.URL
+	opts.Insecure = true
+	opts.DisableKeepAlive = true
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := res.Metadata.TLSCertificates
+	if len(certs) != 1 {
+		t.Fatalf("Expected 1 certificate, got %+v", certs)
+	}
+	leaf := tlsServer.Certificate()
+	c := certs[0]
+	if c.Count != 3 || c.ChainDepth != 1 || c.OCSPStapled || !c.NotAfter.Equal(leaf.NotAfter) ||
+		c.Subject != leaf.Subject.String() {
+		t.Errorf("Unexpected certificate %+v", c)
+	}
+	// The test server's certificate isn't signed by a known authority, only reported with -k.
+	if !strings.Contains(c.VerifyError, "unknown authority") {
+		t.Errorf("Expected a validation error, got %q", c.VerifyError)
+	}
+}
+
+func TestHTTPRunnerSamples(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/samples/", EchoHandler)
+	var b strings.Builder
+	opts := HTTPRunnerOptions{}
+	opts.QPS = 100
+	opts.Exactly = 4
+	opts.NumThreads = 1
+	opts.URL = fmt.Sprintf("http://localhost:%d/samples/?status=418&size=100", addr.Port)
+	opts.Samples = periodic.NewSampleWriter(&b)
+	if _, err := RunHTTPTest(&opts); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected 4 samples (no warmup), got %q", lines)
+	}
+	for _, l := range lines {
+		var s periodic.Sample
+		if err := json.Unmarshal([]byte(l), &s); err != nil {
+			t.Fatal(err)
+		}
+		if s.Code != http.StatusTeapot || s.Size < 100 || s.Thread != 0 || s.Latency <= 0 {
+			t.Errorf("Unexpected sample %+v", s)
+		}
+	}
+}
+
 func TestHttpNotLeakingFastClient(t *testing.T) {
 	testHTTPNotLeaking(t, &HTTPRunnerOptions{})
 }
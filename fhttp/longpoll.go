@@ -0,0 +1,84 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"fortio.org/fortio/stats"
+)
+
+// RequestSentTimer is implemented by the clients noting when they sent their
+// requests (see HTTPOptions.LongPoll): LastRequestSent returns when the last
+// request was sent, zero if it wasn't (e.g. connection error).
+type RequestSentTimer interface {
+	LastRequestSent() time.Time
+}
+
+// LastRequestSent returns when the last request was sent.
+func (c *Client) LastRequestSent() time.Time {
+	return c.phaseClock.wrote
+}
+
+// LastRequestSent returns when the last request was sent.
+func (c *FastClient) LastRequestSent() time.Time {
+	return c.reqSent
+}
+
+// recordLongPoll records the hold of the last call, started at start, and the
+// reconnect since the previous poll's end and returns its code, LongPollHeld
+// instead of TimeoutError for a request sent and still held at the deadline.
+func (httpstate *HTTPRunnerResults) recordLongPoll(code int, start time.Time) int {
+	end := time.Now()
+	sent := start
+	if httpstate.sentTimer != nil {
+		sent = httpstate.sentTimer.LastRequestSent()
+	}
+	if sent.IsZero() {
+		// Not even sent: not a poll (nor held) and the next one is still a reconnect.
+		return code
+	}
+	if code == TimeoutError {
+		code = LongPollHeld
+	}
+	if code < 0 && code != LongPollHeld {
+		return code
+	}
+	if !httpstate.lastPollEnd.IsZero() {
+		httpstate.reconnect.Record(sent.Sub(httpstate.lastPollEnd).Seconds())
+	}
+	httpstate.hold.Record(end.Sub(sent).Seconds())
+	httpstate.lastPollEnd = end
+	return code
+}
+
+// printLongPoll prints the hold and reconnect durations, when there are some.
+func printLongPoll(out io.Writer, hold, reconnect *stats.HistogramData) {
+	for _, d := range []struct {
+		name string
+		h    *stats.HistogramData
+	}{{"Hold", hold}, {"Reconnect", reconnect}} {
+		if d.h == nil {
+			continue
+		}
+		_, _ = fmt.Fprintf(out, "%-9s : count %d avg %.3f ms", d.name, d.h.Count, 1000.*d.h.Avg)
+		for _, p := range d.h.Percentiles {
+			_, _ = fmt.Fprintf(out, " p%g %.3f ms", p.Percentile, 1000.*p.Value)
+		}
+		_, _ = fmt.Fprintf(out, " max %.3f ms\n", 1000.*d.h.Max)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPRunnerLongPoll(t *testing.T) {
+	var calls int64
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// Every other poll gets an event after 20ms, the others are held until the client gives up.
+		hold := 20 * time.Millisecond
+		if atomic.AddInt64(&calls, 1)%2 == 0 {
+			hold = time.Second
+		}
+		select {
+		case <-time.After(hold):
+			w.WriteHeader(http.StatusOK)
+		case <-r.Context().Done():
+		}
+	})
+	for _, std := range []bool{false, true} {
+		atomic.StoreInt64(&calls, 0)
+		opts := HTTPRunnerOptions{}
+		opts.QPS = -1
+		opts.Exactly = 6
+		opts.NumThreads = 1
+		opts.URL = fmt.Sprintf("http://localhost:%d/", addr.Port)
+		opts.DisableFastClient = std
+		opts.HTTPReqTimeOut = 10 * time.Millisecond // replaced by the long poll deadline
+		opts.LongPoll = 150 * time.Millisecond
+		opts.Percentiles = []float64{50}
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.RetCodes[http.StatusOK] != 3 || res.RetCodes[LongPollHeld] != 3 || res.RetCodes[TimeoutError] != 0 {
+			t.Errorf("std %v: unexpected codes %v", std, res.RetCodes)
+		}
+		if res.ErrorRate() != 0 || res.LongPoll != opts.LongPoll || res.RequestTimeout != opts.LongPoll {
+			t.Errorf("std %v: unexpected error rate %g or deadline %v", std, res.ErrorRate(), res.RequestTimeout)
+		}
+		hold, reconnect := res.HoldDuration, res.Reconnect
+		if hold == nil || reconnect == nil {
+			t.Fatalf("std %v: missing hold %v or reconnect %v", std, hold, reconnect)
+		}
+		if hold.Count != 6 || hold.Min < .02 || hold.Max < .15 || len(hold.Percentiles) != 1 {
+			t.Errorf("std %v: unexpected hold %+v", std, hold)
+		}
+		// No reconnect before the first poll.
+		if reconnect.Count != 5 || reconnect.Max > .1 {
+			t.Errorf("std %v: unexpected reconnect %+v", std, reconnect)
+		}
+	}
+}
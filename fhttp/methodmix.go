@@ -0,0 +1,230 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"fortio.org/fortio/fnet"
+	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/stats"
+)
+
+// MixedMethod is one of the methods of HTTPOptions.MethodMix: its share of the
+// requests, relative to the other methods' Weight, and its (optional) Payload.
+type MixedMethod struct {
+	Method  string
+	Weight  int
+	Payload []byte
+}
+
+// ParseMethodMix parses a comma separated list of METHOD:weight[:payload], e.g.
+// "GET:90,POST:10:@order.json", the payload being @file for the content of that
+// file (unless allowFiles is false, e.g. for remote requests), a number of
+// random bytes or else the payload itself.
+func ParseMethodMix(s string, allowFiles bool) ([]MixedMethod, error) {
+	var res []MixedMethod
+	seen := make(map[string]bool)
+	for _, m := range strings.Split(s, ",") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		f := strings.SplitN(m, ":", 3)
+		method := strings.TrimSpace(f[0])
+		if len(f) < 2 || method == "" || strings.ContainsAny(method, " \t") {
+			return nil, fmt.Errorf("invalid method mix entry %q, expecting METHOD:weight[:payload]", m)
+		}
+		if seen[method] {
+			return nil, fmt.Errorf("duplicate method %s in the method mix", method)
+		}
+		seen[method] = true
+		weight, err := strconv.Atoi(strings.TrimSpace(f[1]))
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("invalid method mix weight %q for %s: should be a positive number", f[1], method)
+		}
+		mm := MixedMethod{Method: method, Weight: weight}
+		if len(f) == 3 {
+			if !allowFiles && strings.HasPrefix(f[2], "@") {
+				return nil, fmt.Errorf("file payload %q of %s not allowed", f[2], method)
+			}
+			if mm.Payload, err = methodPayload(f[2]); err != nil {
+				return nil, fmt.Errorf("payload of %s: %w", method, err)
+			}
+		}
+		res = append(res, mm)
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("empty method mix")
+	}
+	return res, nil
+}
+
+// methodPayload returns the payload of a method mix entry: @file, size or literal.
+func methodPayload(p string) ([]byte, error) {
+	if strings.HasPrefix(p, "@") {
+		return ioutil.ReadFile(p[1:])
+	}
+	if size, err := strconv.Atoi(p); err == nil && size >= 0 {
+		return fnet.GenerateRandomPayload(size), nil // capped to the max payload size
+	}
+	return []byte(p), nil
+}
+
+// methodMix picks the method (and payload) of each request of a (std) client
+// following the weights, by smooth weighted round robin so the ratios hold
+// over any window of a cycle, starting from a different point for each client.
+// Not thread safe, each client has its own.
+type methodMix struct {
+	methods []MixedMethod
+	order   []int // index of the method of each request of a cycle
+	next    int
+	last    int // index of the last request's method
+}
+
+func newMethodMix(o *HTTPOptions) *methodMix {
+	if len(o.MethodMix) == 0 {
+		return nil
+	}
+	gcd := 0
+	for _, m := range o.MethodMix {
+		a, b := gcd, m.Weight
+		for b != 0 {
+			a, b = b, a%b
+		}
+		gcd = a
+	}
+	total := 0
+	for _, m := range o.MethodMix {
+		total += m.Weight / gcd
+	}
+	mix := &methodMix{methods: o.MethodMix, order: make([]int, 0, total)}
+	current := make([]int, len(o.MethodMix))
+	for len(mix.order) < total {
+		best := 0
+		for i, m := range o.MethodMix {
+			current[i] += m.Weight / gcd
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		mix.order = append(mix.order, best)
+	}
+	mix.next = o.ID % total
+	return mix
+}
+
+// apply sets the next method and its payload on req.
+func (m *methodMix) apply(req *http.Request) {
+	m.last = m.order[m.next]
+	m.next = (m.next + 1) % len(m.order)
+	mm := &m.methods[m.last]
+	req.Method = mm.Method
+	req.Body = nil
+	req.ContentLength = 0
+	if len(mm.Payload) > 0 {
+		req.Body = ioutil.NopCloser(bytes.NewReader(mm.Payload))
+		req.ContentLength = int64(len(mm.Payload))
+	}
+}
+
+// MethodMixer is implemented by the clients which can vary the method of their
+// requests (see HTTPOptions.MethodMix): LastMethod returns the last request's.
+type MethodMixer interface {
+	LastMethod() string
+}
+
+// LastMethod returns the method of the last request.
+func (c *Client) LastMethod() string {
+	if c.methodMix != nil {
+		return c.methodMix.methods[c.methodMix.last].Method
+	}
+	return c.req.Method
+}
+
+// MethodResult is the count, status codes and latency of the calls of one of
+// the methods of the mix.
+type MethodResult struct {
+	Count    int64
+	RetCodes map[int]int64
+	Latency  *stats.HistogramData // nil when no call used that method
+}
+
+// methodStats is the per thread, and then merged, data of a method.
+type methodStats struct {
+	codes   map[int]int64
+	latency *stats.Histogram
+}
+
+// newMethodStats returns the stats of each method of the mix.
+func newMethodStats(mix []MixedMethod, ro *periodic.RunnerOptions) map[string]*methodStats {
+	res := make(map[string]*methodStats, len(mix))
+	for _, m := range mix {
+		res[m.Method] = &methodStats{codes: make(map[int]int64), latency: ro.NewLatencyHistogram()}
+	}
+	return res
+}
+
+// recordMethod records the last call's code and latency for its method.
+func (httpstate *HTTPRunnerResults) recordMethod(code int, latency float64) {
+	s := httpstate.methodStats[httpstate.methodMixer.LastMethod()]
+	s.codes[code]++
+	s.latency.Record(latency)
+}
+
+// exportMethods returns the results of each method of the mix.
+func exportMethods(methods map[string]*methodStats, percentiles []float64) map[string]*MethodResult {
+	res := make(map[string]*MethodResult, len(methods))
+	for method, s := range methods {
+		r := &MethodResult{Count: s.latency.Count, RetCodes: s.codes}
+		if s.latency.Count > 0 {
+			r.Latency = s.latency.Export().CalcPercentiles(percentiles)
+		}
+		res[method] = r
+	}
+	return res
+}
+
+// printMethods prints the share, codes and latency of each method, in the mix's order.
+func printMethods(out io.Writer, mix []MixedMethod, methods map[string]*MethodResult, totalCount float64) {
+	for _, m := range mix {
+		r := methods[m.Method]
+		if r == nil || r.Latency == nil {
+			continue
+		}
+		_, _ = fmt.Fprintf(out, "Method %s : %d (%.1f %%)", m.Method, r.Count, 100.*float64(r.Count)/totalCount)
+		codes := make([]int, 0, len(r.RetCodes))
+		for code := range r.RetCodes {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			_, _ = fmt.Fprintf(out, ", code %d : %d", code, r.RetCodes[code])
+		}
+		_, _ = fmt.Fprintf(out, ", latency avg %.3f ms", 1000.*r.Latency.Avg)
+		for _, p := range r.Latency.Percentiles {
+			_, _ = fmt.Fprintf(out, " p%g %.3f ms", p.Percentile, 1000.*p.Value)
+		}
+		_, _ = fmt.Fprintln(out)
+	}
+}
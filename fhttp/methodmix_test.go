@@ -0,0 +1,103 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseMethodMix(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "order.json")
+	if err := ioutil.WriteFile(file, []byte(`{"item":42}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mix, err := ParseMethodMix("GET:90, POST:8:@"+file+",PUT:1:16,PATCH:1:a:b", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mix) != 4 || mix[0].Method != "GET" || mix[0].Weight != 90 || mix[0].Payload != nil ||
+		string(mix[1].Payload) != `{"item":42}` || len(mix[2].Payload) != 16 || string(mix[3].Payload) != "a:b" {
+		t.Errorf("unexpected mix %+v", mix)
+	}
+	for _, bad := range []string{"", "GET", "GET:0", "GET:x", ":1", "GET:1,GET:2", "POST:1:@/does/not/exist"} {
+		if _, err = ParseMethodMix(bad, true); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+	if _, err = ParseMethodMix("POST:1:@"+file, false); err == nil {
+		t.Errorf("expected error for a file payload when not allowed")
+	}
+}
+
+func TestMethodMixOrder(t *testing.T) {
+	o := HTTPOptions{MethodMix: []MixedMethod{{Method: "GET", Weight: 60}, {Method: "POST", Weight: 20}, {Method: "PUT", Weight: 20}}}
+	m := newMethodMix(&o)
+	// Reduced to 3:1:1 and interleaved.
+	if !reflect.DeepEqual(m.order, []int{0, 1, 0, 2, 0}) {
+		t.Errorf("unexpected order %v", m.order)
+	}
+	o.ID = 3
+	if m = newMethodMix(&o); m.next != 3 {
+		t.Errorf("expected client 3 to start at 3, got %d", m.next)
+	}
+	if newMethodMix(&HTTPOptions{}) != nil {
+		t.Errorf("expected no mix without MethodMix")
+	}
+}
+
+func TestHTTPRunnerMethodMix(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		switch {
+		case r.Method == http.MethodGet && len(body) == 0:
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodPost && string(body) == "data":
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	opts := HTTPRunnerOptions{}
+	opts.QPS = -1
+	opts.Exactly = 20
+	opts.NumThreads = 2
+	opts.URL = fmt.Sprintf("http://localhost:%d/", addr.Port)
+	opts.Payload = []byte("replaced by the mix's")
+	opts.MethodMix = []MixedMethod{{Method: "GET", Weight: 4}, {Method: "POST", Weight: 1, Payload: []byte("data")}}
+	opts.Percentiles = []float64{50}
+	opts.Out = os.Stderr
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get, post := res.Methods["GET"], res.Methods["POST"]
+	if get == nil || post == nil {
+		t.Fatalf("missing methods results %+v", res.Methods)
+	}
+	if get.Count != 16 || get.RetCodes[http.StatusOK] != 16 || post.Count != 4 || post.RetCodes[http.StatusCreated] != 4 ||
+		len(get.Latency.Percentiles) != 1 || post.Latency.Count != 4 {
+		t.Errorf("unexpected methods results GET %+v POST %+v", get, post)
+	}
+	if res.RetCodes[http.StatusOK] != 16 || res.RetCodes[http.StatusCreated] != 4 {
+		t.Errorf("unexpected codes %v", res.RetCodes)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http/httptrace"
+	"time"
+
+	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/stats"
+)
+
+// Indexes of the phases in LatencyPhases.
+const (
+	PhaseDNS     = iota // name resolution
+	PhaseConnect        // tcp connection
+	PhaseTLS            // TLS handshake
+	PhaseTTFB           // from the request sent to the first byte of the response
+	PhaseBody           // from the first byte to the end of the response
+	NumPhases
+)
+
+// PhaseNames are the names of the phases, the keys of HTTPRunnerResults.LatencyPhases.
+var PhaseNames = [NumPhases]string{"DNS", "Connect", "TLS", "TTFB", "Body"}
+
+// LatencyPhases is the breakdown of a request's latency (see HTTPOptions.LatencyBreakdown),
+// 0 for the phases it didn't go through, e.g. DNS, Connect and TLS on a reused connection.
+type LatencyPhases [NumPhases]time.Duration
+
+// PhaseTimer is implemented by the clients timing the phases of their requests:
+// LastPhases returns the last request's, nil when not enabled.
+type PhaseTimer interface {
+	LastPhases() *LatencyPhases
+}
+
+// LastPhases returns the phases of the last request. The fast client resolves the
+// name once, when created, which is accounted as the DNS phase of its first request.
+func (c *FastClient) LastPhases() *LatencyPhases {
+	return c.phases
+}
+
+// LastPhases returns the phases of the last request.
+func (c *Client) LastPhases() *LatencyPhases {
+	return c.phases
+}
+
+// phaseClock is the std client's timestamps of the current request's phases.
+type phaseClock struct {
+	dnsStart, connectStart, tlsStart, wrote, firstByte time.Time
+}
+
+// phaseTrace returns the trace hooks timing the std client's phases.
+func (c *Client) phaseTrace() *httptrace.ClientTrace {
+	t := &c.phaseClock
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { t.dnsStart = time.Now() },
+		DNSDone:  func(httptrace.DNSDoneInfo) { c.phases[PhaseDNS] = time.Since(t.dnsStart) },
+		ConnectStart: func(network, addr string) {
+			t.connectStart = time.Now()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err == nil {
+				c.phases[PhaseConnect] = time.Since(t.connectStart)
+			}
+		},
+		TLSHandshakeStart: func() { t.tlsStart = time.Now() },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				c.phases[PhaseTLS] = time.Since(t.tlsStart)
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) { t.wrote = time.Now() },
+		GotFirstResponseByte: func() {
+			t.firstByte = time.Now()
+			c.phases[PhaseTTFB] = t.firstByte.Sub(t.wrote)
+		},
+	}
+}
+
+// newPhaseHistograms returns a histogram for each phase.
+func newPhaseHistograms(ro *periodic.RunnerOptions) []*stats.Histogram {
+	res := make([]*stats.Histogram, NumPhases)
+	for i := range res {
+		res[i] = ro.NewLatencyHistogram()
+	}
+	return res
+}
+
+// exportPhases returns the histograms, with percentiles, of the phases the calls went through.
+func exportPhases(phases []*stats.Histogram, percentiles []float64) map[string]*stats.HistogramData {
+	res := make(map[string]*stats.HistogramData)
+	for i, h := range phases {
+		if h.Count > 0 {
+			res[PhaseNames[i]] = h.Export().CalcPercentiles(percentiles)
+		}
+	}
+	return res
+}
+
+// recordPhases records the phases the last call went through.
+func (httpstate *HTTPRunnerResults) recordPhases() {
+	p := httpstate.phaseTimer.LastPhases()
+	if p == nil {
+		return
+	}
+	for i, d := range p {
+		if d > 0 {
+			httpstate.phases[i].Record(d.Seconds())
+		}
+	}
+}
+
+// printPhases prints the latency breakdown, in the phases' order.
+func printPhases(out io.Writer, phases map[string]*stats.HistogramData) {
+	for _, name := range PhaseNames {
+		h, found := phases[name]
+		if !found {
+			continue
+		}
+		_, _ = fmt.Fprintf(out, "%-7s : count %d avg %.3f ms", name, h.Count, 1000.*h.Avg)
+		for _, p := range h.Percentiles {
+			_, _ = fmt.Fprintf(out, " p%g %.3f ms", p.Percentile, 1000.*p.Value)
+		}
+		_, _ = fmt.Fprintf(out, " max %.3f ms\n", 1000.*h.Max)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLatencyPhases(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/", EchoHandler)
+	for _, std := range []bool{false, true} {
+		o := NewHTTPOptions(fmt.Sprintf("http://localhost:%d/?delay=20ms", addr.Port))
+		o.DisableFastClient = std
+		o.LatencyBreakdown = true
+		client, _ := NewClient(o)
+		for i := 0; i < 2; i++ {
+			code, _, _ := client.Fetch()
+			p := client.(PhaseTimer).LastPhases()
+			if code != http.StatusOK || p == nil {
+				t.Fatalf("std %v: unexpected code %d phases %v", std, code, p)
+			}
+			newConnection := i == 0
+			if (p[PhaseConnect] > 0) != newConnection || p[PhaseTLS] != 0 {
+				t.Errorf("std %v %d: unexpected connection phases %v", std, i, p)
+			}
+			if p[PhaseTTFB] < 20*time.Millisecond || p[PhaseBody] <= 0 || p[PhaseBody] > 20*time.Millisecond {
+				t.Errorf("std %v %d: unexpected response phases %v", std, i, p)
+			}
+		}
+		client.Close()
+	}
+	// Not timed unless asked for:
+	client, _ := NewClient(NewHTTPOptions(fmt.Sprintf("http://localhost:%d/", addr.Port)))
+	client.Fetch()
+	if p := client.(PhaseTimer).LastPhases(); p != nil {
+		t.Errorf("unexpected phases %v without LatencyBreakdown", p)
+	}
+	client.Close()
+}
+
+func TestLatencyPhasesTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(EchoHandler))
+	defer srv.Close()
+	o := HTTPOptions{URL: srv.URL, Insecure: true, DisableFastClient: true, LatencyBreakdown: true}
+	client, _ := NewClient(&o)
+	defer client.Close()
+	code, _, _ := client.Fetch()
+	p := client.(PhaseTimer).LastPhases()
+	if code != http.StatusOK || p[PhaseConnect] <= 0 || p[PhaseTLS] <= 0 || p[PhaseTTFB] <= 0 {
+		t.Errorf("unexpected code %d phases %v", code, p)
+	}
+}
+
+func TestHTTPRunnerLatencyPhases(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/", EchoHandler)
+	for _, std := range []bool{false, true} {
+		opts := HTTPRunnerOptions{}
+		opts.QPS = -1
+		opts.Exactly = 20
+		opts.NumThreads = 2
+		opts.URL = fmt.Sprintf("http://localhost:%d/?delay=5ms", addr.Port)
+		opts.DisableFastClient = std
+		opts.LatencyBreakdown = true
+		opts.Percentiles = []float64{50}
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ttfb, body := res.LatencyPhases["TTFB"], res.LatencyPhases["Body"]
+		if ttfb == nil || body == nil || ttfb.Count != 20 || body.Count != 20 || len(ttfb.Percentiles) != 1 {
+			t.Fatalf("std %v: unexpected phases %+v", std, res.LatencyPhases)
+		}
+		if ttfb.Min < .005 || ttfb.Avg > res.DurationHistogram.Avg {
+			t.Errorf("std %v: unexpected ttfb %+v vs %+v", std, ttfb, res.DurationHistogram)
+		}
+		// Exactly mode: the connections are made during the run, without TLS.
+		if c := res.LatencyPhases["Connect"]; c == nil || c.Count != 2 || res.LatencyPhases["TLS"] != nil {
+			t.Errorf("std %v: unexpected connection phases %+v", std, res.LatencyPhases)
+		}
+	}
+}
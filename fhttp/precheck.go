@@ -0,0 +1,72 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"fortio.org/fortio/log"
+)
+
+// PreCheck is an optional sanity check of the target before the run: that
+// many sequential Requests must all return the ExpectedStatus (0 for any
+// success code) within MaxLatency (0 for no limit), or the run doesn't start.
+type PreCheck struct {
+	Requests       int
+	ExpectedStatus int
+	MaxLatency     time.Duration
+}
+
+// run performs the pre-check requests with their own client, returning an
+// error describing the first failed one.
+func (pc *PreCheck) run(o *HTTPOptions, out io.Writer) error {
+	if pc.Requests <= 0 {
+		return nil
+	}
+	client, err := NewClient(o)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	var maxLatency time.Duration
+	for i := 1; i <= pc.Requests; i++ {
+		start := time.Now()
+		code, data, _ := client.Fetch()
+		latency := time.Since(start)
+		if latency > maxLatency {
+			maxLatency = latency
+		}
+		statusOK := codeIsOK(code)
+		if pc.ExpectedStatus != 0 {
+			statusOK = (code == pc.ExpectedStatus)
+		}
+		if !statusOK {
+			log.LogVf("pre-check %d response: %s", i, DebugSummary(data, 256))
+			expected := "a success code"
+			if pc.ExpectedStatus != 0 {
+				expected = fmt.Sprint(pc.ExpectedStatus)
+			}
+			return fmt.Errorf("pre-check request %d/%d to %s: status %d instead of %s", i, pc.Requests, o.URL, code, expected)
+		}
+		if pc.MaxLatency > 0 && latency > pc.MaxLatency {
+			return fmt.Errorf("pre-check request %d/%d to %s: latency %v over the %v maximum",
+				i, pc.Requests, o.URL, RoundDuration(latency), pc.MaxLatency)
+		}
+	}
+	_, _ = fmt.Fprintf(out, "Pre-check of %d requests passed (max latency %v)\n", pc.Requests, RoundDuration(maxLatency))
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPreCheck(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/", EchoHandler)
+	base := fmt.Sprintf("http://localhost:%d/", addr.Port)
+	tests := []struct {
+		url      string
+		preCheck PreCheck
+		err      string // expected error substring, empty for success
+	}{
+		{"", PreCheck{}, ""},
+		{"", PreCheck{Requests: 3}, ""},
+		{"?status=503", PreCheck{Requests: 3}, "request 1/3 to " + base + "?status=503: status 503 instead of a success code"},
+		{"?status=503", PreCheck{Requests: 2, ExpectedStatus: 503}, ""},
+		{"", PreCheck{Requests: 2, ExpectedStatus: 201}, "status 200 instead of 201"},
+		{"?delay=100ms", PreCheck{Requests: 2, MaxLatency: 50 * time.Millisecond}, "over the 50ms maximum"},
+		{"?delay=10ms", PreCheck{Requests: 2, MaxLatency: time.Second}, ""},
+	}
+	for _, tst := range tests {
+		opts := HTTPRunnerOptions{}
+		opts.QPS = 100
+		opts.Exactly = 5
+		opts.NumThreads = 1
+		opts.URL = base + tst.url
+		opts.PreCheck = tst.preCheck
+		res, err := RunHTTPTest(&opts)
+		if tst.err == "" {
+			if err != nil {
+				t.Errorf("%s %+v: unexpected error %v", tst.url, tst.preCheck, err)
+			} else if res.DurationHistogram.Count != 5 {
+				t.Errorf("%s %+v: expected the run to happen: %d", tst.url, tst.preCheck, res.DurationHistogram.Count)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tst.err) {
+			t.Errorf("%s %+v: expected error %q, got %v", tst.url, tst.preCheck, tst.err, err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"fortio.org/fortio/fnet"
+	"fortio.org/fortio/periodic"
+	"golang.org/x/net/proxy"
+)
+
+// ParseProxy parses and validates a forward proxy url (see HTTPOptions.Proxy):
+// socks5://[user:password@]host:port or http://[user:password@]host:port.
+// The errors have the proxy's password redacted.
+func ParseProxy(p string) (*url.URL, error) {
+	u, err := url.Parse(p)
+	if err != nil {
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err // without the (unredacted) url
+		}
+		return nil, fmt.Errorf("invalid proxy %q: %w", periodic.Redact(p), err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "http" {
+		return nil, fmt.Errorf("invalid proxy %q, expecting socks5://host:port or http://host:port", u.Redacted())
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("proxy %q needs a host:port", u.Redacted())
+	}
+	return u, nil
+}
+
+// proxyDialer opens the fast client's connections through a forward proxy:
+// socks5 or an http CONNECT tunnel.
+type proxyDialer struct {
+	url     *url.URL
+	addr    net.Addr // resolved proxy address
+	timeout time.Duration
+	socks   proxy.Dialer // nil for http CONNECT
+}
+
+func newProxyDialer(p string, timeout time.Duration) (*proxyDialer, error) {
+	u, err := ParseProxy(p)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := fnet.Resolve(u.Hostname(), u.Port())
+	if addr == nil {
+		return nil, err
+	}
+	d := &proxyDialer{url: u, addr: addr, timeout: timeout}
+	if u.Scheme == "socks5" {
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		d.socks, err = proxy.SOCKS5("tcp", addr.String(), auth, &net.Dialer{Timeout: timeout})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// dial connects to target (host:port) through the proxy.
+func (d *proxyDialer) dial(target string) (net.Conn, error) {
+	if d.socks != nil {
+		return d.socks.Dial("tcp", target)
+	}
+	conn, err := net.DialTimeout(d.addr.Network(), d.addr.String(), d.timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err = d.connect(conn, target); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// connect establishes the http CONNECT tunnel to target on conn.
+func (d *proxyDialer) connect(conn net.Conn, target string) error {
+	if d.timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(d.timeout))
+		defer func() { _ = conn.SetDeadline(time.Time{}) }()
+	}
+	req := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+	if d.url.User != nil {
+		password, _ := d.url.User.Password()
+		req += "Proxy-Authorization: " + generateBase64UserCredentials(d.url.User.Username()+":"+password) + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		return err
+	}
+	// Nothing past the response headers is buffered away as the target doesn't
+	// send anything before our request.
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return fmt.Errorf("proxy %s CONNECT error: %w", d.url.Host, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy %s CONNECT to %s failed: %s", d.url.Host, target, resp.Status)
+	}
+	return nil
+}
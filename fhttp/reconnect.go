@@ -0,0 +1,49 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import "time"
+
+const (
+	// MaxReconnectBackoff is the longest wait between connection attempts to an
+	// unavailable target (see HTTPRunnerOptions.ReconnectBackoff).
+	MaxReconnectBackoff = time.Second
+	// UnavailableMinErrors is the number of consecutive connection errors (across
+	// the threads) for the target to be reported as unavailable.
+	UnavailableMinErrors = 3
+)
+
+// recordAvailability tracks the target's availability from the last call's
+// code and sets the backoff before the next call: doubled for each consecutive
+// connection error (SocketError: refused, reset...), none after a success.
+func (httpstate *HTTPRunnerResults) recordAvailability(code int) {
+	httpstate.availability.Record(code != SocketError)
+	switch {
+	case code != SocketError:
+		httpstate.backoff = 0
+	case httpstate.backoff == 0:
+		httpstate.backoff = httpstate.reconnectBackoff
+	default:
+		httpstate.backoff *= 2
+	}
+	if httpstate.backoff > MaxReconnectBackoff {
+		httpstate.backoff = MaxReconnectBackoff
+	}
+}
+
+// Backoff returns the wait before the next call after connection errors (see periodic.Backoffer).
+func (httpstate *HTTPRunnerResults) Backoff() time.Duration {
+	return httpstate.backoff
+}
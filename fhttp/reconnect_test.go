@@ -0,0 +1,124 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"fortio.org/fortio/periodic"
+)
+
+func TestRecordAvailability(t *testing.T) {
+	h := HTTPRunnerResults{availability: periodic.NewAvailabilityTracker(UnavailableMinErrors),
+		reconnectBackoff: 300 * time.Millisecond}
+	expected := []time.Duration{300 * time.Millisecond, 600 * time.Millisecond, MaxReconnectBackoff, MaxReconnectBackoff}
+	for i, e := range expected {
+		h.recordAvailability(SocketError)
+		if h.Backoff() != e {
+			t.Errorf("%d: unexpected backoff %v instead of %v", i, h.Backoff(), e)
+		}
+	}
+	for _, code := range []int{http.StatusOK, http.StatusServiceUnavailable} {
+		h.recordAvailability(SocketError)
+		h.recordAvailability(code)
+		if h.Backoff() != 0 {
+			t.Errorf("unexpected backoff %v after %d", h.Backoff(), code)
+		}
+	}
+	h.reconnectBackoff = 0 // disabled
+	h.recordAvailability(SocketError)
+	h.recordAvailability(SocketError)
+	if h.Backoff() != 0 {
+		t.Errorf("unexpected backoff %v when disabled", h.Backoff())
+	}
+}
+
+// The std client reports connection errors as SocketError, like the fast
+// client, and the other errors still as StatusBadRequest.
+func TestStdClientErrorCodes(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = c.Write([]byte("NOT HTTP\r\n\r\n"))
+			c.Close()
+		}
+	}()
+	refused, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refusedPort := refused.Addr().(*net.TCPAddr).Port
+	refused.Close() // nothing listening: connection refused
+	for _, tst := range []struct {
+		port int
+		code int
+	}{
+		{refusedPort, SocketError},
+		{l.Addr().(*net.TCPAddr).Port, http.StatusBadRequest}, // malformed response
+	} {
+		o := NewHTTPOptions(fmt.Sprintf("http://localhost:%d/", tst.port))
+		o.DisableFastClient = true
+		c, err := NewClient(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code, _, _ := c.Fetch(); code != tst.code {
+			t.Errorf("std client to port %d: got %d instead of %d", tst.port, code, tst.code)
+		}
+		c.Close()
+	}
+}
+
+func TestHTTPRunnerUnavailable(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close() // nothing listening: connection refused
+	for _, std := range []bool{false, true} {
+		opts := HTTPRunnerOptions{}
+		opts.QPS = -1
+		opts.Exactly = 5
+		opts.NumThreads = 1
+		opts.URL = fmt.Sprintf("http://localhost:%d/", port)
+		opts.DisableFastClient = std
+		opts.AllowInitialErrors = true
+		opts.ReconnectBackoff = 10 * time.Millisecond
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 10+20+40+80ms of backoff between the 5 calls
+		if res.ActualDuration < 150*time.Millisecond || res.DurationHistogram.Max > .1 {
+			t.Errorf("std %v: unexpected duration %v max call %g", std, res.ActualDuration, res.DurationHistogram.Max)
+		}
+		if len(res.Unavailable) != 1 || res.Unavailable[0].Errors != 5 {
+			t.Errorf("std %v: unexpected unavailable windows %+v", std, res.Unavailable)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"fortio.org/fortio/fnet"
+	"fortio.org/fortio/log"
+)
+
+// RecordedRequest is a request received by the echo server, as recorded (one
+// json object per line) by RecordRequests and replayed by the client (see
+// HTTPOptions.Replay).
+type RecordedRequest struct {
+	Time   time.Time
+	Method string
+	URI    string // path and query
+	Host   string
+	Header http.Header
+	// The body isn't recorded, only its size and sha256 (hex) digest. It is replayed
+	// as that many bytes of (random) payload.
+	BodySize   int
+	BodySHA256 string `json:",omitempty"`
+	// BodyFile optionally is the file (relative to the requests file) with the actual
+	// body to send instead, e.g. in traces from other sources. Only read by ReadRecordedRequests.
+	BodyFile string `json:",omitempty"`
+	body     []byte // content of the BodyFile
+}
+
+// requestRecorder appends the echo server requests to a file.
+type requestRecorder struct {
+	sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+var (
+	recorderMutex sync.Mutex
+	recorder      *requestRecorder // nil when not recording
+)
+
+// RecordRequests starts recording the requests received by the EchoHandler to
+// file (appended to), see RecordedRequest.
+func RecordRequests(file string) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	log.Infof("Recording echo server requests to %s", file)
+	recorderMutex.Lock()
+	prev := recorder
+	recorder = &requestRecorder{f: f, enc: json.NewEncoder(f)}
+	recorderMutex.Unlock()
+	if prev != nil {
+		prev.close()
+	}
+	return nil
+}
+
+// StopRecording stops recording the requests and closes the file.
+func StopRecording() {
+	recorderMutex.Lock()
+	prev := recorder
+	recorder = nil
+	recorderMutex.Unlock()
+	if prev != nil {
+		prev.close()
+	}
+}
+
+func (rr *requestRecorder) close() {
+	rr.Lock()
+	defer rr.Unlock()
+	if err := rr.f.Close(); err != nil {
+		log.Errf("Error closing requests recording: %v", err)
+	}
+}
+
+// recordRequest records the request, received at t, when recording.
+func recordRequest(r *http.Request, body []byte, t time.Time) {
+	recorderMutex.Lock()
+	rr := recorder
+	recorderMutex.Unlock()
+	if rr == nil {
+		return
+	}
+	req := RecordedRequest{
+		Time:     t,
+		Method:   r.Method,
+		URI:      r.RequestURI,
+		Host:     r.Host,
+		Header:   r.Header,
+		BodySize: len(body),
+	}
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		req.BodySHA256 = hex.EncodeToString(sum[:])
+	}
+	rr.Lock()
+	err := rr.enc.Encode(&req)
+	rr.Unlock()
+	if err != nil {
+		log.Errf("Error recording request %s %s: %v", r.Method, r.RequestURI, err)
+	}
+}
+
+// ParseRecordedRequests parses the recorded requests, one json object per line.
+func ParseRecordedRequests(data []byte) ([]RecordedRequest, error) {
+	var res []RecordedRequest
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, fnet.MaxPayloadSizeLimit)
+	for i := 1; scanner.Scan(); i++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var req RecordedRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			return nil, fmt.Errorf("invalid recorded request line %d: %w", i, err)
+		}
+		if req.Method == "" || req.URI == "" {
+			return nil, fmt.Errorf("recorded request line %d has no method or uri", i)
+		}
+		res = append(res, req)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no recorded request found")
+	}
+	return res, nil
+}
+
+// ReadRecordedRequests reads the recorded requests from a file, and their BodyFile if any.
+func ReadRecordedRequests(file string) ([]RecordedRequest, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	reqs, err := ParseRecordedRequests(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	for i := range reqs {
+		req := &reqs[i]
+		if req.BodyFile == "" {
+			continue
+		}
+		bodyFile := req.BodyFile
+		if !filepath.IsAbs(bodyFile) {
+			bodyFile = filepath.Join(filepath.Dir(file), bodyFile)
+		}
+		if req.body, err = ioutil.ReadFile(bodyFile); err != nil {
+			return nil, fmt.Errorf("%s: body of %s %s: %w", file, req.Method, req.URI, err)
+		}
+		req.BodySize = len(req.body)
+	}
+	return reqs, nil
+}
+
+// replayedHeaders are the recorded headers not replayed, set by the client itself.
+var replayedHeaders = []string{"Content-Length", "Connection", "Transfer-Encoding", "Keep-Alive", "Upgrade"}
+
+// replay rotates, round robin, through the HTTPOptions.Replay requests for a
+// (std) client, starting from a different one for each client. In order (see
+// RunReplay) each client instead sends every numConnections-th request, the
+// ones its runner thread makes the calls of. Not thread safe, each client has
+// its own.
+type replay struct {
+	reqs   []RecordedRequest
+	urls   []*url.URL // target url of each request
+	next   int
+	stride int
+}
+
+func newReplay(o *HTTPOptions, base *url.URL) (*replay, error) {
+	if len(o.Replay) == 0 {
+		return nil, nil
+	}
+	r := &replay{reqs: o.Replay, next: o.ID % len(o.Replay), stride: 1}
+	if o.replayInOrder && o.numConnections > 0 {
+		r.stride = o.numConnections
+	}
+	for _, req := range o.Replay {
+		u, err := base.Parse(req.URI)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recorded request uri %q: %w", req.URI, err)
+		}
+		// Only the path and query are replayed, on the target.
+		u.Scheme, u.Host = base.Scheme, base.Host
+		r.urls = append(r.urls, u)
+	}
+	return r, nil
+}
+
+// apply sets the next recorded request's method, url, headers and body on req.
+func (r *replay) apply(req *http.Request) {
+	i := r.next
+	r.next = (r.next + r.stride) % len(r.reqs)
+	rec := &r.reqs[i]
+	req.Method = rec.Method
+	req.URL = r.urls[i]
+	req.Header = rec.Header.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	for _, h := range replayedHeaders {
+		req.Header.Del(h)
+	}
+	req.Body = nil
+	req.ContentLength = 0
+	if rec.BodySize > 0 {
+		body := rec.body
+		if body == nil {
+			body = fnet.GenerateRandomPayload(rec.BodySize) // capped to the max payload size
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "requests.json")
+	if err := RecordRequests(file); err != nil {
+		t.Fatal(err)
+	}
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/", EchoHandler)
+	base := fmt.Sprintf("http://localhost:%d", addr.Port)
+	if code, _ := FetchURL(base + "/foo?x=1"); code != http.StatusOK {
+		t.Errorf("unexpected code %d", code)
+	}
+	o := NewHTTPOptions(base + "/bar")
+	o.Payload = []byte("hello")
+	o.AddAndValidateExtraHeader("X-Test: abc")
+	if code, _ := Fetch(o); code != http.StatusOK {
+		t.Errorf("unexpected code %d", code)
+	}
+	StopRecording()
+	FetchURL(base + "/not-recorded")
+	reqs, err := ReadRecordedRequests(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 2 {
+		t.Fatalf("expected 2 recorded requests, got %+v", reqs)
+	}
+	if reqs[0].Method != http.MethodGet || reqs[0].URI != "/foo?x=1" || reqs[0].BodySize != 0 || reqs[0].BodySHA256 != "" {
+		t.Errorf("unexpected first request %+v", reqs[0])
+	}
+	if reqs[1].Method != http.MethodPost || reqs[1].URI != "/bar" || reqs[1].Header.Get("X-Test") != "abc" ||
+		reqs[1].BodySize != 5 || !strings.HasPrefix(reqs[1].BodySHA256, "2cf24dba") || reqs[1].Time.Before(reqs[0].Time) {
+		t.Errorf("unexpected second request %+v", reqs[1])
+	}
+	// Replay them on another server:
+	var mutex sync.Mutex
+	replayed := make(map[string]int)
+	mux2, addr2 := DynamicHTTPServer(false)
+	mux2.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		replayed[fmt.Sprintf("%s %s %s %d", r.Method, r.RequestURI, r.Header.Get("X-Test"), len(body))]++
+		mutex.Unlock()
+	})
+	opts := HTTPRunnerOptions{}
+	opts.QPS = 100
+	opts.Exactly = 10
+	opts.NumThreads = 1
+	opts.URL = fmt.Sprintf("http://localhost:%d/ignored", addr2.Port)
+	opts.Replay = reqs
+	res, err := RunHTTPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[http.StatusOK] != 10 || replayed["GET /foo?x=1  0"] != 5 || replayed["POST /bar abc 5"] != 5 {
+		t.Errorf("unexpected replay %v: %v", res.RetCodes, replayed)
+	}
+	opts.HeaderSets = []http.Header{{"User-Agent": {"test"}}}
+	if _, err = RunHTTPTest(&opts); err == nil {
+		t.Errorf("expected error for header sets with replay")
+	}
+	if _, err = ParseRecordedRequests([]byte("{\"Method\":\"GET\"}\n")); err == nil {
+		t.Errorf("expected error for recorded request without uri")
+	}
+	if _, err = ParseRecordedRequests([]byte("\n\n")); err == nil {
+		t.Errorf("expected error for no recorded request")
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/periodic"
+)
+
+// ReplayOptions are the options of a trace replay: each of the HTTPOptions.Replay
+// recorded requests is sent once, in order, at its recorded Time relative to the
+// first one's (divided by Speed).
+type ReplayOptions struct {
+	HTTPRunnerOptions
+	// Speed multiplier of the replay, e.g. 2 to replay twice as fast (0 is the same as 1).
+	Speed float64
+}
+
+// RunReplay replays the recorded requests with their relative timing and returns
+// the usual http run results.
+func RunReplay(o *ReplayOptions) (*HTTPRunnerResults, error) {
+	n := len(o.Replay)
+	if n == 0 {
+		return nil, fmt.Errorf("no recorded request to replay")
+	}
+	speed := o.Speed
+	if speed == 0 {
+		speed = 1
+	}
+	if speed < 0 {
+		return nil, fmt.Errorf("invalid negative replay speed %g", speed)
+	}
+	reqs := make([]RecordedRequest, n)
+	copy(reqs, o.Replay)
+	sort.SliceStable(reqs, func(i, j int) bool { return reqs[i].Time.Before(reqs[j].Time) })
+	arrivals := make([]time.Duration, n)
+	for i := range reqs {
+		arrivals[i] = time.Duration(float64(reqs[i].Time.Sub(reqs[0].Time)) / speed)
+	}
+	ro := o.HTTPRunnerOptions
+	ro.Replay = reqs
+	ro.replayInOrder = true
+	ro.Arrivals = arrivals
+	ro.ConcurrencyOnly = false
+	ro.Exactly = int64(n) // also no warmup call, which would be a replayed request
+	if ro.HasWarmup() {
+		log.Warnf("Ignoring the warmup, its calls would shift the replayed requests")
+		ro.WarmupCalls, ro.WarmupDuration = 0, 0
+	}
+	// The runner would lower the threads below half the calls, but after the
+	// clients got their share of the requests.
+	if ro.NumThreads <= 0 {
+		ro.NumThreads = periodic.DefaultRunnerOptions.NumThreads
+	}
+	if 2*ro.NumThreads > n {
+		ro.NumThreads = n / 2
+		if ro.NumThreads < 1 {
+			ro.NumThreads = 1
+		}
+	}
+	log.Infof("Replaying %d requests over %v (speed %g) with %d threads", n, arrivals[n-1], speed, ro.NumThreads)
+	return RunHTTPTest(&ro)
+}
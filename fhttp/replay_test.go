@@ -0,0 +1,100 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunReplay(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "body.txt"), []byte("some body"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Out of order, with 2 at the same time, to be replayed twice as fast:
+	trace := `{"Time":"2021-01-01T00:00:00.200Z","Method":"GET","URI":"/4"}
+{"Time":"2021-01-01T00:00:00Z","Method":"GET","URI":"/0"}
+{"Time":"2021-01-01T00:00:00.060Z","Method":"POST","URI":"/1","BodyFile":"body.txt"}
+{"Time":"2021-01-01T00:00:00.100Z","Method":"GET","URI":"/2"}
+{"Time":"2021-01-01T00:00:00.100Z","Method":"GET","URI":"/3?x=y"}
+`
+	file := filepath.Join(dir, "trace.json")
+	if err := ioutil.WriteFile(file, []byte(trace), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reqs, err := ReadRecordedRequests(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mutex sync.Mutex
+	received := make(map[string]time.Time)
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		received[fmt.Sprintf("%s %s %s", r.Method, r.RequestURI, body)] = time.Now()
+		mutex.Unlock()
+	})
+	o := ReplayOptions{Speed: 2}
+	o.NumThreads = 8
+	o.URL = fmt.Sprintf("http://localhost:%d/ignored", addr.Port)
+	o.Replay = reqs
+	res, err := RunReplay(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[http.StatusOK] != 5 || res.Exactly != 5 || res.NumThreads != 2 || len(received) != 5 {
+		t.Fatalf("unexpected replay %v %d calls %d threads: %v", res.RetCodes, res.Exactly, res.NumThreads, received)
+	}
+	first := received["GET /0 "]
+	expected := map[string]time.Duration{
+		"POST /1 some body": 30 * time.Millisecond,
+		"GET /2 ":           50 * time.Millisecond,
+		"GET /3?x=y ":       50 * time.Millisecond,
+		"GET /4 ":           100 * time.Millisecond,
+	}
+	for k, d := range expected {
+		at, found := received[k]
+		if !found {
+			t.Errorf("%q not replayed: %v", k, received)
+			continue
+		}
+		// Generous, for slow/loaded test machines:
+		if offset := at.Sub(first); offset < d-5*time.Millisecond || offset > d+30*time.Millisecond {
+			t.Errorf("%q replayed at %v instead of %v", k, offset, d)
+		}
+	}
+	o.Speed = -1
+	if _, err = RunReplay(&o); err == nil {
+		t.Errorf("expected error for negative speed")
+	}
+	o.Replay = nil
+	if _, err = RunReplay(&o); err == nil {
+		t.Errorf("expected error for no requests")
+	}
+	// Missing body file:
+	if err = ioutil.WriteFile(file, []byte(`{"Method":"GET","URI":"/","BodyFile":"nope"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadRecordedRequests(file); err == nil {
+		t.Errorf("expected error for missing body file")
+	}
+}
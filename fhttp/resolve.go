@@ -0,0 +1,77 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ValidateResolve checks the HTTPOptions.Resolve format: either an ip (or
+// name) to connect to for all requests, or curl style host:port:addr to
+// connect to addr only instead of host:port.
+func ValidateResolve(resolve string) error {
+	_, _, _, err := parseResolve(resolve)
+	return err
+}
+
+// ResolveAddr returns the address (ip or name) part of resolve, for both its
+// forms, or an error when it isn't valid.
+func ResolveAddr(resolve string) (string, error) {
+	_, _, addr, err := parseResolve(resolve)
+	return addr, err
+}
+
+// parseResolve splits resolve into host, port and address; host and port
+// are empty for the single address form.
+func parseResolve(resolve string) (host, port, addr string, err error) {
+	if resolve == "" || net.ParseIP(strings.Trim(resolve, "[]")) != nil {
+		return "", "", strings.Trim(resolve, "[]"), nil
+	}
+	parts := strings.SplitN(resolve, ":", 3)
+	if len(parts) == 1 {
+		return "", "", resolve, nil // a name
+	}
+	if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+		return "", "", "", fmt.Errorf("invalid resolve %q, expecting addr or host:port:addr", resolve)
+	}
+	if _, err = strconv.Atoi(parts[1]); err != nil {
+		return "", "", "", fmt.Errorf("invalid port in resolve %q: %v", resolve, err)
+	}
+	return parts[0], parts[1], strings.Trim(parts[2], "[]"), nil
+}
+
+// resolveTarget returns the address to connect to instead of host (and port,
+// numerical or scheme), per the Resolve option, or host itself when it doesn't apply.
+func resolveTarget(resolve, host, port string) string {
+	rHost, rPort, addr, err := parseResolve(resolve)
+	if err != nil || addr == "" {
+		return host
+	}
+	if rHost == "" {
+		return addr
+	}
+	if p, found := schemePorts[port]; found {
+		port = p
+	}
+	if strings.EqualFold(rHost, host) && rPort == port {
+		return addr
+	}
+	return host
+}
+
+var schemePorts = map[string]string{"http": "80", "https": "443"}
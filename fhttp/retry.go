@@ -0,0 +1,77 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// RetryConnectError is the -retry-on keyword for connection/socket errors (SocketError code).
+	RetryConnectError = "connect-error"
+	// RetryTimeout is the -retry-on keyword for requests timing out (TimeoutError code).
+	RetryTimeout = "timeout"
+)
+
+// RetryPolicy is the optional retrying of failed calls by the http runner, to
+// model real clients behavior. The time spent retrying is part of the call's
+// duration and is also reported separately.
+type RetryPolicy struct {
+	// Maximum number of retries per call, 0 for no retries.
+	Retries int
+	// Codes to retry on, SocketError (-1) for connection errors, TimeoutError (-3) for timeouts.
+	RetryOn []int
+	// Wait before the first retry, doubled for each subsequent retry of the same call.
+	Backoff time.Duration
+}
+
+// ParseRetryOn parses a comma separated list of http codes and/or
+// RetryConnectError, RetryTimeout (e.g. "502,503,connect-error") into a list of codes.
+func ParseRetryOn(s string) ([]int, error) {
+	var res []int
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		switch c {
+		case RetryConnectError:
+			res = append(res, SocketError)
+			continue
+		case RetryTimeout:
+			res = append(res, TimeoutError)
+			continue
+		}
+		code, err := strconv.Atoi(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retry-on %q: should be http codes, %s or %s", c, RetryConnectError, RetryTimeout)
+		}
+		res = append(res, code)
+	}
+	return res, nil
+}
+
+// shouldRetry returns true if the code is one of the RetryOn ones.
+func (p *RetryPolicy) shouldRetry(code int) bool {
+	for _, c := range p.RetryOn {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"fortio.org/fortio/fnet"
+	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/stats"
+)
+
+// SizeClass is the count and latency of the calls with a response size (as in
+// the Sizes histogram) in [Min, Max), Max being 0 for the last, unbounded, class.
+type SizeClass struct {
+	Min     int
+	Max     int
+	Count   int64
+	Latency *stats.HistogramData // nil when no call was in that class
+}
+
+// ParseSizeClasses parses a comma separated list of increasing size class
+// boundaries, in bytes with an optional k or m suffix (e.g. "1k,64k,1m").
+func ParseSizeClasses(s string) ([]int, error) {
+	var res []int
+	for _, b := range strings.Split(s, ",") {
+		b = strings.TrimSpace(b)
+		if b == "" {
+			continue
+		}
+		num, mult := b, 1
+		switch strings.ToLower(b[len(b)-1:]) {
+		case "k":
+			num, mult = b[:len(b)-1], fnet.KILOBYTE
+		case "m":
+			num, mult = b[:len(b)-1], fnet.KILOBYTE*fnet.KILOBYTE
+		}
+		size, err := strconv.Atoi(num)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid size class boundary %q: should be a positive number of bytes, k or m", b)
+		}
+		size *= mult
+		if len(res) > 0 && size <= res[len(res)-1] {
+			return nil, fmt.Errorf("size class boundaries should be increasing, %d isn't above %d", size, res[len(res)-1])
+		}
+		res = append(res, size)
+	}
+	return res, nil
+}
+
+// sizeClass returns the index of the class of size for the given boundaries.
+func sizeClass(bounds []int, size int) int {
+	return sort.SearchInts(bounds, size+1)
+}
+
+// newSizeLatency returns the latency histograms of each size class.
+func newSizeLatency(bounds []int, ro *periodic.RunnerOptions) []*stats.Histogram {
+	h := make([]*stats.Histogram, len(bounds)+1)
+	for i := range h {
+		h[i] = ro.NewLatencyHistogram()
+	}
+	return h
+}
+
+// exportSizeClasses returns the results of each size class.
+func exportSizeClasses(bounds []int, latency []*stats.Histogram, percentiles []float64) []SizeClass {
+	res := make([]SizeClass, len(latency))
+	for i, h := range latency {
+		if i > 0 {
+			res[i].Min = bounds[i-1]
+		}
+		if i < len(bounds) {
+			res[i].Max = bounds[i]
+		}
+		res[i].Count = h.Count
+		if h.Count > 0 {
+			res[i].Latency = h.Export().CalcPercentiles(percentiles)
+		}
+	}
+	return res
+}
+
+// printSizeClasses prints the count and latency of each size class seen.
+func printSizeClasses(out io.Writer, classes []SizeClass) {
+	for _, c := range classes {
+		if c.Latency == nil {
+			continue
+		}
+		if c.Max > 0 {
+			_, _ = fmt.Fprintf(out, "Size [%d, %d) : %d", c.Min, c.Max, c.Count)
+		} else {
+			_, _ = fmt.Fprintf(out, "Size >= %d : %d", c.Min, c.Count)
+		}
+		_, _ = fmt.Fprintf(out, ", latency avg %.3f ms", 1000.*c.Latency.Avg)
+		for _, p := range c.Latency.Percentiles {
+			_, _ = fmt.Fprintf(out, " p%g %.3f ms", p.Percentile, 1000.*p.Value)
+		}
+		_, _ = fmt.Fprintln(out)
+	}
+}
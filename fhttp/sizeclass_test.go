@@ -0,0 +1,90 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseSizeClasses(t *testing.T) {
+	bounds, err := ParseSizeClasses(" 100, 1k,64K,1m,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []int{100, 1024, 65536, 1048576}; !reflect.DeepEqual(bounds, expected) {
+		t.Errorf("got %v, expected %v", bounds, expected)
+	}
+	for _, bad := range []string{"1k,100", "10,10", "0", "xk", "-5"} {
+		if _, err = ParseSizeClasses(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+	if bounds, err = ParseSizeClasses(""); err != nil || bounds != nil {
+		t.Errorf("expected no classes for empty input, got %v %v", bounds, err)
+	}
+	for _, tst := range []struct{ size, class int }{{0, 0}, {99, 0}, {100, 1}, {1023, 1}, {1024, 2}, {2000000, 4}} {
+		if c := sizeClass([]int{100, 1024, 65536, 1048576}, tst.size); c != tst.class {
+			t.Errorf("size %d: got class %d, expected %d", tst.size, c, tst.class)
+		}
+	}
+}
+
+func TestHTTPRunnerSizeClasses(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	var count int64
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		size := 100
+		if atomic.AddInt64(&count, 1)%4 == 0 {
+			size = 4000
+		}
+		_, _ = w.Write([]byte(strings.Repeat("x", size)))
+	})
+	for _, std := range []bool{false, true} {
+		atomic.StoreInt64(&count, 0)
+		opts := HTTPRunnerOptions{}
+		opts.QPS = 100
+		opts.Exactly = 40
+		opts.NumThreads = 2
+		opts.URL = fmt.Sprintf("http://localhost:%d/", addr.Port)
+		opts.DisableFastClient = std
+		opts.SizeClasses = []int{1024, 64 * 1024}
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.SizeClasses) != 3 {
+			t.Fatalf("std %v: expected 3 size classes, got %+v", std, res.SizeClasses)
+		}
+		small, big, huge := res.SizeClasses[0], res.SizeClasses[1], res.SizeClasses[2]
+		if small.Min != 0 || small.Max != 1024 || small.Count != 30 || small.Latency == nil || small.Latency.Count != 30 {
+			t.Errorf("std %v: unexpected small class %+v", std, small)
+		}
+		if big.Min != 1024 || big.Max != 64*1024 || big.Count != 10 || big.Latency == nil || big.Latency.Avg <= 0 {
+			t.Errorf("std %v: unexpected big class %+v", std, big)
+		}
+		if huge.Min != 64*1024 || huge.Max != 0 || huge.Count != 0 || huge.Latency != nil {
+			t.Errorf("std %v: unexpected unbounded class %+v", std, huge)
+		}
+		if _, err = json.Marshal(res); err != nil {
+			t.Errorf("std %v: unable to json serialize the results: %v", std, err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+// Slow client ("slow loris") simulation: the fast client sends its requests a
+// few bytes at a time, to check in a controlled test how the target or load
+// balancer handles slow clients (request header/body timeouts, connection
+// limits). Only for targets you own or are allowed to test.
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// errSlowWriteAborted is returned by the slow writes interrupted by the end of the run.
+var errSlowWriteAborted = errors.New("run aborted during slow write")
+
+// slowWrite sends the request SlowWriteBytes at a time, waiting
+// SlowWriteInterval between each, and then starts the read deadline (the
+// request timeout applies to the response, after the slow write). Returns the
+// number of bytes written, and errSlowWriteAborted if the run got aborted
+// meanwhile.
+func (c *FastClient) slowWrite(conn net.Conn) (int, error) {
+	n := 0
+	for n < len(c.req) {
+		if n > 0 {
+			timer := time.NewTimer(c.slowInterval)
+			select {
+			case <-timer.C:
+			case <-c.slowAbort:
+				timer.Stop()
+				return n, errSlowWriteAborted
+			}
+		}
+		end := n + c.slowBytes
+		if end > len(c.req) {
+			end = len(c.req)
+		}
+		w, err := conn.Write(c.req[n:end])
+		n += w
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, conn.SetReadDeadline(time.Now().Add(c.reqTimeout))
+}
@@ -0,0 +1,76 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSlowWrite(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/slow/", EchoHandler)
+	o := HTTPOptions{URL: fmt.Sprintf("http://localhost:%d/slow/", addr.Port), Payload: []byte("abcdefghij")}
+	o.SlowWriteInterval = 2 * time.Millisecond
+	o.SlowWriteBytes = 16
+	client, _ := NewClient(&o)
+	start := time.Now()
+	code, data, header := client.Fetch()
+	elapsed := time.Since(start)
+	client.Close()
+	if code != http.StatusOK || string(data[header:]) != "abcdefghij" {
+		t.Errorf("unexpected %d %q", code, DebugSummary(data, 256))
+	}
+	if min := time.Duration(len(client.(*FastClient).req)/16) * 2 * time.Millisecond; elapsed < min {
+		t.Errorf("request took %v, expected at least %v", elapsed, min)
+	}
+	// A server with a header timeout closes the slow client's connection:
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(EchoHandler))
+	srv.Config.ReadHeaderTimeout = 50 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+	o = HTTPOptions{URL: srv.URL, SlowWriteInterval: 20 * time.Millisecond}
+	client, _ = NewClient(&o)
+	start = time.Now()
+	code, _, _ = client.Fetch()
+	elapsed = time.Since(start)
+	client.Close()
+	if code == http.StatusOK || elapsed > 2*time.Second {
+		t.Errorf("expected an error from the server's header timeout, got %d after %v", code, elapsed)
+	}
+}
+
+func TestSlowWriteAbort(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/slow-abort/", EchoHandler)
+	abort := make(chan struct{})
+	o := HTTPOptions{URL: fmt.Sprintf("http://localhost:%d/slow-abort/", addr.Port), SlowWriteInterval: time.Second}
+	o.slowWriteAbort = abort
+	client, _ := NewClient(&o)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(abort)
+	}()
+	start := time.Now()
+	code, _, _ := client.Fetch()
+	elapsed := time.Since(start)
+	client.Close()
+	if code != SocketError || elapsed > 900*time.Millisecond {
+		t.Errorf("expected the slow write to be aborted, got %d after %v", code, elapsed)
+	}
+}
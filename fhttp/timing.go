@@ -0,0 +1,115 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"fortio.org/fortio/stats"
+)
+
+const (
+	// TimingHeader is the request header asking the echo server for its
+	// processing timestamps (see HTTPOptions.ServerTiming).
+	TimingHeader = "X-Fortio-Timing"
+	// ReceivedHeader is the echo server response header with the time (unix
+	// nanoseconds) the request was received.
+	ReceivedHeader = "X-Fortio-Received"
+	// FirstWriteHeader is the echo server response header with the time (unix
+	// nanoseconds) it started writing the response.
+	FirstWriteHeader = "X-Fortio-First-Write"
+)
+
+// timingWriter adds the ReceivedHeader and FirstWriteHeader to the response
+// when its header is written, whichever way it is.
+type timingWriter struct {
+	http.ResponseWriter
+	received time.Time
+	wrote    bool
+}
+
+func (w *timingWriter) WriteHeader(status int) {
+	if !w.wrote {
+		w.wrote = true
+		h := w.Header()
+		h.Set(ReceivedHeader, strconv.FormatInt(w.received.UnixNano(), 10))
+		h.Set(FirstWriteHeader, strconv.FormatInt(time.Now().UnixNano(), 10))
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *timingWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// ServerTime returns the time the server took, from receiving the request to
+// writing the response, per the ReceivedHeader and FirstWriteHeader of the
+// response (both from the server's clock), false if they're missing or invalid.
+func ServerTime(header func(name string) string) (time.Duration, bool) {
+	received, err := strconv.ParseInt(header(ReceivedHeader), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	firstWrite, err := strconv.ParseInt(header(FirstWriteHeader), 10, 64)
+	if err != nil || firstWrite < received {
+		return 0, false
+	}
+	return time.Duration(firstWrite - received), true
+}
+
+// recordServerTiming splits the latency of the last call between the server
+// time and the rest (network, client,...).
+func (httpstate *HTTPRunnerResults) recordServerTiming(latency float64) {
+	d, ok := ServerTime(httpstate.timingHeaders.ResponseHeader)
+	if !ok {
+		httpstate.ServerTimingMissing++
+		return
+	}
+	server := d.Seconds()
+	httpstate.serverTime.Record(server)
+	network := latency - server
+	if network < 0 {
+		network = 0
+	}
+	httpstate.networkTime.Record(network)
+}
+
+// printServerTiming prints the server and network time split (when there are
+// timed responses) and the number of responses without timing.
+func printServerTiming(out io.Writer, server, network *stats.HistogramData, missing int64) {
+	for _, t := range []struct {
+		name string
+		h    *stats.HistogramData
+	}{{"Server", server}, {"Network", network}} {
+		if t.h == nil {
+			continue
+		}
+		_, _ = fmt.Fprintf(out, "%s time avg %.3f ms", t.name, 1000.*t.h.Avg)
+		for _, p := range t.h.Percentiles {
+			_, _ = fmt.Fprintf(out, " p%g %.3f ms", p.Percentile, 1000.*p.Value)
+		}
+		_, _ = fmt.Fprintln(out)
+	}
+	if missing > 0 {
+		_, _ = fmt.Fprintf(out, "Server timing missing from %d responses\n", missing)
+	}
+}
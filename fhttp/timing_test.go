@@ -0,0 +1,110 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServerTime(t *testing.T) {
+	headers := map[string]string{ReceivedHeader: "1634428800000000000", FirstWriteHeader: "1634428800025000000"}
+	header := func(name string) string { return headers[name] }
+	if d, ok := ServerTime(header); !ok || d != 25*time.Millisecond {
+		t.Errorf("unexpected server time %v %v", d, ok)
+	}
+	headers[FirstWriteHeader] = "1634428799000000000" // before received
+	if d, ok := ServerTime(header); ok {
+		t.Errorf("unexpected server time %v for inverted timestamps", d)
+	}
+	delete(headers, ReceivedHeader)
+	if d, ok := ServerTime(header); ok {
+		t.Errorf("unexpected server time %v without %s", d, ReceivedHeader)
+	}
+}
+
+func TestEchoServerTiming(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/", EchoHandler)
+	base := fmt.Sprintf("http://localhost:%d/", addr.Port)
+	// (the fast client doesn't parse the headers of non ok responses)
+	tests := []struct {
+		query     string
+		stdClient bool
+	}{
+		{"?delay=20ms", false},
+		{"?delay=20ms", true},
+		{"?delay=20ms&size=100", false},
+		{"?delay=20ms&size=100", true},
+		{"?delay=20ms&status=503", true},
+	}
+	for _, tst := range tests {
+		o := NewHTTPOptions(base + tst.query)
+		o.DisableFastClient = tst.stdClient
+		o.ServerTiming = true
+		client, _ := NewClient(o)
+		code, _, _ := client.Fetch()
+		d, ok := ServerTime(client.(ResponseHeaderer).ResponseHeader)
+		client.Close()
+		if code <= 0 || !ok || d < 20*time.Millisecond || d > 500*time.Millisecond {
+			t.Errorf("%q std %v: unexpected code %d server time %v %v", tst.query, tst.stdClient, code, d, ok)
+		}
+	}
+	// No timestamps unless asked for:
+	o := NewHTTPOptions(base)
+	client, _ := NewClient(o)
+	client.Fetch()
+	if v := client.(ResponseHeaderer).ResponseHeader(ReceivedHeader); v != "" {
+		t.Errorf("unexpected %s %q without %s", ReceivedHeader, v, TimingHeader)
+	}
+	client.Close()
+}
+
+func TestHTTPRunnerServerTiming(t *testing.T) {
+	mux, addr := DynamicHTTPServer(false)
+	mux.HandleFunc("/", EchoHandler)
+	mux.HandleFunc("/notiming", func(w http.ResponseWriter, r *http.Request) {})
+	for _, std := range []bool{false, true} {
+		opts := HTTPRunnerOptions{}
+		opts.QPS = 100
+		opts.Exactly = 20
+		opts.NumThreads = 2
+		opts.URL = fmt.Sprintf("http://localhost:%d/?delay=10ms", addr.Port)
+		opts.DisableFastClient = std
+		opts.ServerTiming = true
+		res, err := RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.ServerTime == nil || res.NetworkTime == nil || res.ServerTime.Count != 20 || res.NetworkTime.Count != 20 ||
+			res.ServerTimingMissing != 0 {
+			t.Fatalf("std %v: unexpected server timing %+v %+v %d", std, res.ServerTime, res.NetworkTime, res.ServerTimingMissing)
+		}
+		if res.ServerTime.Min < .01 || res.ServerTime.Avg+res.NetworkTime.Avg > res.DurationHistogram.Avg+.001 {
+			t.Errorf("std %v: unexpected split %g + %g of %g", std, res.ServerTime.Avg, res.NetworkTime.Avg,
+				res.DurationHistogram.Avg)
+		}
+		opts.URL = fmt.Sprintf("http://localhost:%d/notiming", addr.Port)
+		res, err = RunHTTPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.ServerTime != nil || res.ServerTimingMissing != 20 {
+			t.Errorf("std %v: unexpected timing %+v missing %d", std, res.ServerTime, res.ServerTimingMissing)
+		}
+	}
+}
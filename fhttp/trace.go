@@ -0,0 +1,214 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp // import "fortio.org/fortio/fhttp"
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+
+	"fortio.org/fortio/otlp"
+)
+
+// Trace context generation modes for HTTPOptions.TraceHeaders.
+const (
+	// TraceW3C generates W3C trace context `traceparent` headers.
+	TraceW3C = "w3c"
+	// TraceB3 generates open zipkin multi headers (X-B3-TraceId, X-B3-SpanId, X-B3-Sampled).
+	TraceB3 = "b3"
+)
+
+var (
+	// W3CTraceParent is the W3C trace context header.
+	W3CTraceParent = textproto.CanonicalMIMEHeaderKey("traceparent")
+	// W3CTraceState is the W3C vendor specific trace state header, propagated along traceparent.
+	W3CTraceState = textproto.CanonicalMIMEHeaderKey("tracestate")
+	b3TraceID     = textproto.CanonicalMIMEHeaderKey("x-b3-traceid")
+	b3SpanID      = textproto.CanonicalMIMEHeaderKey("x-b3-spanid")
+	b3Sampled     = textproto.CanonicalMIMEHeaderKey("x-b3-sampled")
+)
+
+const (
+	traceIDLen = 32 // hex digits, 16 bytes
+	spanIDLen  = 16 // hex digits, 8 bytes
+)
+
+// ValidateTraceMode returns an error if mode isn't empty, TraceW3C or TraceB3.
+func ValidateTraceMode(mode string) error {
+	switch mode {
+	case "", TraceW3C, TraceB3:
+		return nil
+	}
+	return fmt.Errorf("invalid trace headers mode %q, should be %s or %s", mode, TraceW3C, TraceB3)
+}
+
+// traceContext holds the current ids of a client. Not thread safe, each
+// client has its own.
+type traceContext struct {
+	mode    string
+	perConn bool // new trace id only on new connections instead of each request
+	traceID [traceIDLen]byte
+	spanID  [spanIDLen]byte
+	rnd     *rand.Rand // own source so clients don't contend on a shared lock
+	raw     [traceIDLen / 2]byte
+}
+
+func newTraceContext(o *HTTPOptions) (*traceContext, error) {
+	if o.TraceHeaders == "" {
+		return nil, nil
+	}
+	if err := ValidateTraceMode(o.TraceHeaders); err != nil {
+		return nil, err
+	}
+	t := &traceContext{mode: o.TraceHeaders, perConn: o.TracePerConnection, rnd: newRand()}
+	t.newTrace()
+	return t, nil
+}
+
+// randomHex fills dst with random hex digits (len(dst)/2 random bytes), without allocating.
+func (t *traceContext) randomHex(dst []byte) {
+	n := len(dst) / 2
+	_, _ = t.rnd.Read(t.raw[:n])
+	hex.Encode(dst, t.raw[:n])
+}
+
+// newTrace generates a new trace id and span id.
+func (t *traceContext) newTrace() {
+	t.randomHex(t.traceID[:])
+	t.newSpan()
+}
+
+// newSpan generates a new span id, keeping the trace id.
+func (t *traceContext) newSpan() {
+	t.randomHex(t.spanID[:])
+}
+
+// next updates the ids for the next request, newConn indicates a new connection.
+func (t *traceContext) next(newConn bool) {
+	if newConn || !t.perConn {
+		t.newTrace()
+	} else {
+		t.newSpan()
+	}
+}
+
+// setHeaders sets the trace headers matching the current ids on h.
+func (t *traceContext) setHeaders(h http.Header) {
+	if t.mode == TraceW3C {
+		h.Set(W3CTraceParent, "00-"+string(t.traceID[:])+"-"+string(t.spanID[:])+"-01")
+		return
+	}
+	h.Set(b3TraceID, string(t.traceID[:]))
+	h.Set(b3SpanID, string(t.spanID[:]))
+	h.Set(b3Sampled, "1")
+}
+
+// traceOffsets are the position of the ids inside a pre-built raw request.
+type traceOffsets struct {
+	traceID int
+	spanID  int
+}
+
+// writeRaw appends the headers, with the current ids, to a raw request being
+// built and returns where the ids are so they can be updated in place.
+func (t *traceContext) writeRaw(buf *bytes.Buffer) traceOffsets {
+	var off traceOffsets
+	if t.mode == TraceW3C {
+		buf.WriteString(W3CTraceParent + ": 00-")
+		off.traceID = buf.Len()
+		buf.Write(t.traceID[:])
+		buf.WriteString("-")
+		off.spanID = buf.Len()
+		buf.Write(t.spanID[:])
+		buf.WriteString("-01\r\n")
+		return off
+	}
+	buf.WriteString(b3TraceID + ": ")
+	off.traceID = buf.Len()
+	buf.Write(t.traceID[:])
+	buf.WriteString("\r\n" + b3SpanID + ": ")
+	off.spanID = buf.Len()
+	buf.Write(t.spanID[:])
+	buf.WriteString("\r\n" + b3Sampled + ": 1\r\n")
+	return off
+}
+
+// updateRaw copies the current ids into the raw request at the given offsets.
+func (t *traceContext) updateRaw(req []byte, off traceOffsets) {
+	copy(req[off.traceID:], t.traceID[:])
+	copy(req[off.spanID:], t.spanID[:])
+}
+
+// IsTraceHeader returns true for the (canonical) headers that should be
+// propagated for distributed tracing: envoy request id, b3 and w3c headers.
+func IsTraceHeader(k string) bool {
+	return k == EnvoyRequestID || k == TraceHeader || k == W3CTraceParent || k == W3CTraceState ||
+		strings.HasPrefix(k, TraceHeadersPrefix)
+}
+
+// PropagateTraceHeaders adds the trace headers of the incoming request r to
+// the extra headers of the options (used by the fetch proxy).
+func PropagateTraceHeaders(o *HTTPOptions, r *http.Request) {
+	for k, v := range r.Header {
+		if !IsTraceHeader(k) {
+			continue
+		}
+		for _, vv := range v {
+			_ = o.AddAndValidateExtraHeader(k + ": " + vv)
+		}
+	}
+}
+
+// newRequestSpan starts the span for a sampled request.
+func newRequestSpan(e *otlp.Exporter, method, url string, id int) *otlp.Span {
+	s := e.NewSpan("HTTP " + method)
+	s.Attributes["http.method"] = method
+	s.Attributes["http.url"] = url
+	s.Attributes["fortio.thread"] = id
+	return s
+}
+
+// endSpan completes the span with the result, and the ids matching the
+// generated trace headers if any.
+func endSpan(s *otlp.Span, t *traceContext, code int, size int) {
+	if t != nil {
+		s.SetIDs(t.traceID[:], t.spanID[:])
+	}
+	s.Attributes["http.status_code"] = code
+	s.Attributes["http.response_content_length"] = size
+	s.Error = !codeIsOK(code)
+}
+
+// spanClientTrace records the std client request phases as span events.
+func spanClientTrace(s *otlp.Span) *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { s.AddEvent("dns_start") },
+		DNSDone:  func(httptrace.DNSDoneInfo) { s.AddEvent("dns_done") },
+		ConnectDone: func(network, addr string, err error) {
+			if err == nil {
+				s.AddEvent("connected")
+			}
+		},
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { s.AddEvent("tls_handshake_done") },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { s.AddEvent("request_sent") },
+		GotFirstResponseByte: func() { s.AddEvent("first_byte") },
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fhttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"fortio.org/fortio/periodic"
+)
+
+var traceParentRegex = regexp.MustCompile(`Traceparent: 00-([0-9a-f]{32})-([0-9a-f]{16})-01`)
+
+// fetchTraceIDs fetches twice and returns the 2 sets of trace and span ids found in the echoed debug output.
+func fetchTraceIDs(t *testing.T, o *HTTPOptions, re *regexp.Regexp) [][]string {
+	client, err := NewClient(o)
+	if err != nil {
+		t.Fatalf("unexpected client error %v", err)
+	}
+	defer client.Close()
+	res := [][]string{}
+	for i := 0; i < 2; i++ {
+		code, data, _ := client.Fetch()
+		if code != http.StatusOK {
+			t.Fatalf("Got %d %s instead of ok", code, DebugSummary(data, 256))
+		}
+		m := re.FindSubmatch(data)
+		if m == nil {
+			t.Fatalf("trace headers not found in %s", DebugSummary(data, 1024))
+		}
+		res = append(res, []string{string(m[1]), string(m[2])})
+	}
+	return res
+}
+
+func TestTraceHeadersFastClient(t *testing.T) {
+	_, addr := ServeTCP("0", "/debug")
+	url := fmt.Sprintf("http://localhost:%d/debug", addr.Port)
+	o := NewHTTPOptions(url)
+	o.TraceHeaders = TraceW3C
+	ids := fetchTraceIDs(t, o, traceParentRegex)
+	if ids[0][0] == ids[1][0] || ids[0][1] == ids[1][1] {
+		t.Errorf("expected new trace per request, got %v", ids)
+	}
+	o.TracePerConnection = true
+	ids = fetchTraceIDs(t, o, traceParentRegex)
+	if ids[0][0] != ids[1][0] || ids[0][1] == ids[1][1] {
+		t.Errorf("expected same trace, new span on the same connection, got %v", ids)
+	}
+}
+
+func TestTraceHeadersStdClient(t *testing.T) {
+	_, addr := ServeTCP("0", "/debug")
+	url := fmt.Sprintf("http://localhost:%d/debug", addr.Port)
+	o := NewHTTPOptions(url)
+	o.DisableFastClient = true
+	o.TraceHeaders = TraceB3
+	// debug handler sorts the headers so span id comes first
+	ids := fetchTraceIDs(t, o, regexp.MustCompile(`X-B3-Spanid: ([0-9a-f]{16})\nX-B3-Traceid: ([0-9a-f]{32})`))
+	if ids[0][0] == ids[1][0] || ids[0][1] == ids[1][1] {
+		t.Errorf("expected new trace per request, got %v", ids)
+	}
+	o.TraceHeaders = "bogus"
+	if _, err := NewClient(o); err == nil {
+		t.Errorf("expected error for bogus trace mode")
+	}
+}
+
+func TestFetchPropagatesTraceHeaders(t *testing.T) {
+	mux, addr := ServeTCP("0", "/debug")
+	mux.Handle("/fetch/", http.StripPrefix("/fetch/", http.HandlerFunc(FetcherHandler)))
+	url := fmt.Sprintf("localhost:%d/fetch/localhost:%d/debug", addr.Port, addr.Port)
+	o := NewHTTPOptions(url)
+	tp := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	_ = o.AddAndValidateExtraHeader("traceparent: " + tp)
+	_ = o.AddAndValidateExtraHeader("Not-Propagated: foo")
+	code, data := Fetch(o)
+	if code != http.StatusOK {
+		t.Errorf("Got %d %s instead of ok for %s", code, DebugSummary(data, 256), url)
+	}
+	if !bytes.Contains(data, []byte("Traceparent: "+tp)) {
+		t.Errorf("Result %s doesn't contain expected traceparent", DebugSummary(data, 1024))
+	}
+	if bytes.Contains(data, []byte("Not-Propagated")) {
+		t.Errorf("Result %s shouldn't contain non trace header", DebugSummary(data, 1024))
+	}
+}
+
+// spanCollector is a minimal OTLP/HTTP receiver recording span ids and event names.
+type spanCollector struct {
+	mutex  sync.Mutex
+	spans  []string // "traceid-spanid"
+	events [][]string
+}
+
+func (c *spanCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, _ := ioutil.ReadAll(r.Body)
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID string `json:"traceId"`
+					SpanID  string `json:"spanId"`
+					Events  []struct {
+						Name string `json:"name"`
+					} `json:"events"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				c.spans = append(c.spans, s.TraceID+"-"+s.SpanID)
+				names := []string{}
+				for _, e := range s.Events {
+					names = append(names, e.Name)
+				}
+				c.events = append(c.events, names)
+			}
+		}
+	}
+}
+
+func TestSpanExport(t *testing.T) {
+	_, addr := ServeTCP("0", "/debug")
+	url := fmt.Sprintf("http://localhost:%d/debug", addr.Port)
+	for _, std := range []bool{false, true} {
+		c := &spanCollector{}
+		srv := httptest.NewServer(c)
+		opts := HTTPRunnerOptions{
+			RunnerOptions: periodic.RunnerOptions{
+				QPS:        100,
+				Exactly:    5,
+				NumThreads: 1,
+			},
+			OTLPEndpoint:   srv.URL,
+			OTLPSampleRate: 1,
+		}
+		opts.URL = url
+		opts.DisableFastClient = std
+		opts.TraceHeaders = TraceW3C
+		res, err := RunHTTPTest(&opts)
+		srv.Close()
+		if err != nil {
+			t.Fatalf("std %v: error %v", std, err)
+		}
+		if res.RetCodes[http.StatusOK] != 5 {
+			t.Errorf("std %v: unexpected result %+v", std, res.RetCodes)
+		}
+		if len(c.spans) != 5 {
+			t.Fatalf("std %v: expected 5 spans, got %v", std, c.spans)
+		}
+		for i, ev := range c.events {
+			joined := strings.Join(ev, ",")
+			if !strings.Contains(joined, "request_sent") || !strings.HasSuffix(joined, "first_byte") {
+				t.Errorf("std %v: unexpected events for span %d: %v", std, i, ev)
+			}
+		}
+		if !strings.Contains(strings.Join(c.events[0], ","), "connected,request_sent") {
+			t.Errorf("std %v: first span should have connected event: %v", std, c.events[0])
+		}
+		// ids should be the ones sent in traceparent, so all different
+		seen := map[string]bool{}
+		for _, s := range c.spans {
+			if seen[s] {
+				t.Errorf("std %v: duplicate span %s", std, s)
+			}
+			seen[s] = true
+		}
+	}
+}
@@ -15,6 +15,7 @@
 package fnet // import "fortio.org/fortio/fnet"
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -59,6 +60,11 @@ var (
 	MaxPayloadSize = 256 * KILOBYTE
 	// Payload that is returned during echo call.
 	Payload []byte
+	// MaxPayloadSizeLimit is the upper bound for MaxPayloadSize changes through
+	// the (dynamic) -maxpayloadsizekb flag, to avoid accidental huge allocations.
+	MaxPayloadSizeLimit = 128 * 1024 * KILOBYTE
+	// protects MaxPayloadSize and Payload which can change at runtime.
+	payloadMutex sync.RWMutex
 )
 
 // nolint: gochecknoinits // needed here (unit change)
@@ -67,19 +73,22 @@ func init() {
 }
 
 // ChangeMaxPayloadSize is used to change max payload size and fill it with pseudorandom content.
+// Safe to call while servers are running.
 func ChangeMaxPayloadSize(newMaxPayloadSize int) {
-	if newMaxPayloadSize >= 0 {
-		MaxPayloadSize = newMaxPayloadSize
-	} else {
-		MaxPayloadSize = 0
+	if newMaxPayloadSize < 0 {
+		newMaxPayloadSize = 0
 	}
-	Payload = make([]byte, MaxPayloadSize)
+	payload := make([]byte, newMaxPayloadSize)
 	// One shared and 'constant' (over time) but pseudo random content for payload
 	// (to defeat compression).
-	_, err := rand.Read(Payload) // nolint: gosec // We don't need crypto strength here, just low cpu and speed
+	_, err := rand.Read(payload) // nolint: gosec // We don't need crypto strength here, just low cpu and speed
 	if err != nil {
 		log.Errf("Error changing payload size, read for %d random payload failed: %v", newMaxPayloadSize, err)
 	}
+	payloadMutex.Lock()
+	MaxPayloadSize = newMaxPayloadSize
+	Payload = payload
+	payloadMutex.Unlock()
 }
 
 // NormalizePort parses port and returns host:port if port is in the form
@@ -166,14 +175,150 @@ func TCPEchoServer(name string, port string) net.Addr {
 	return addr
 }
 
-func handleUDPEchoRequest(name string, conn *net.UDPConn, addr *net.UDPAddr, buf []byte) {
-	wb, err := conn.WriteToUDP(buf, addr)
-	log.LogVf("UDP echo server (%v) echoed %d bytes back to %v (err=%v)", name, wb, addr, err)
+func handleTCPSinkRequest(name string, conn net.Conn) {
+	SetSocketBuffers(conn, 256*KILOBYTE, 32*KILOBYTE)
+	n, err := io.Copy(ioutil.Discard, conn)
+	log.LogVf("TCP sink server (%v) discarded %d bytes from %v (err=%v)", name, n, conn.RemoteAddr(), err)
+	_ = conn.Close()
+}
+
+// TCPSinkServer starts a TCP server discarding everything it receives (e.g. as
+// the target of tcp bulk transfers) on given port, name is for logging.
+func TCPSinkServer(name string, port string) net.Addr {
+	listener, addr := Listen(name, port)
+	if listener == nil {
+		return nil // error already logged
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Critf("TCP sink server (%v) error accepting: %v", name, err)
+			} else {
+				log.LogVf("TCP sink server (%v) accepted connection from %v -> %v",
+					name, conn.RemoteAddr(), conn.LocalAddr())
+				go handleTCPSinkRequest(name, conn)
+			}
+		}
+	}()
+	return addr
+}
+
+// Limits of the udp echo server replies (see UDPReply).
+const (
+	MaxUDPReplySize  = 65507 // max udp payload (over IPv4)
+	MaxUDPReplyCount = 100   // datagrams for each received one, limits the amplification
+	// The bytes replied to each datagram are at most that multiple of its size, so
+	// the echo server can't be used as a reflection amplifier (the source address
+	// of a datagram can be spoofed).
+	MaxUDPReplyAmplification = 10
+)
+
+// UDPReply is how the udp echo server replies to each datagram: Count datagrams
+// (1 when 0) of Size bytes (the received datagram's size when 0), the received
+// bytes being truncated or repeated to that size. When Prefix is true each
+// datagram can override them with a prefix, see ParseUDPReplyPrefix. Either way
+// the reply is limited to MaxUDPReplyAmplification times the received bytes.
+type UDPReply struct {
+	Size   int
+	Count  int
+	Prefix bool
+}
+
+// ParseUDPReplyPrefix returns the reply with the Size and/or Count from the
+// "size=N" and "count=N" space separated prefix of the datagram, if any, e.g.
+// "size=1000 count=3 payload...", which is replied to with 3 datagrams of 1000
+// bytes. The values are capped to MaxUDPReplySize and MaxUDPReplyCount.
+func ParseUDPReplyPrefix(data []byte, reply UDPReply) UDPReply {
+	for {
+		var value *int
+		switch {
+		case bytes.HasPrefix(data, []byte("size=")):
+			value, data = &reply.Size, data[len("size="):]
+		case bytes.HasPrefix(data, []byte("count=")):
+			value, data = &reply.Count, data[len("count="):]
+		default:
+			return reply.capped()
+		}
+		i := 0
+		for i < len(data) && data[i] >= '0' && data[i] <= '9' {
+			i++
+		}
+		if i == 0 || (i < len(data) && data[i] != ' ') {
+			return reply.capped() // not a prefix after all
+		}
+		*value, _ = strconv.Atoi(string(data[:i]))
+		if i < len(data) {
+			i++ // the space
+		}
+		data = data[i:]
+	}
+}
+
+func (r UDPReply) capped() UDPReply {
+	if r.Size > MaxUDPReplySize {
+		r.Size = MaxUDPReplySize
+	}
+	if r.Count > MaxUDPReplyCount {
+		r.Count = MaxUDPReplyCount
+	}
+	return r
+}
+
+// datagram returns the reply datagram to the received buf.
+func (r UDPReply) datagram(buf []byte) []byte {
+	if r.Size <= 0 || r.Size == len(buf) {
+		return buf
+	}
+	if r.Size < len(buf) {
+		return buf[:r.Size]
+	}
+	res := make([]byte, r.Size)
+	if len(buf) > 0 {
+		for i := 0; i < r.Size; {
+			i += copy(res[i:], buf)
+		}
+	}
+	return res
+}
+
+func handleUDPEchoRequest(name string, conn *net.UDPConn, addr *net.UDPAddr, buf []byte, reply UDPReply) {
+	if reply.Prefix {
+		reply = ParseUDPReplyPrefix(buf, reply)
+	}
+	data := reply.datagram(buf)
+	count := reply.Count
+	if count <= 0 {
+		count = 1
+	}
+	budget := MaxUDPReplyAmplification * len(buf)
+	if len(data) > budget {
+		data = data[:budget]
+	}
+	if len(data) == 0 {
+		count = 1
+	} else if count*len(data) > budget {
+		count = budget / len(data)
+	}
+	for i := 0; i < count; i++ {
+		wb, err := conn.WriteToUDP(data, addr)
+		log.LogVf("UDP echo server (%v) echoed %d bytes back to %v (%d/%d, err=%v)", name, wb, addr, i+1, count, err)
+		if err != nil {
+			return
+		}
+	}
 }
 
 // UDPEchoServer starts a UDP Echo Server on given port, name is for logging.
 // if async flag is true will spawn go routines to reply otherwise single go routine.
 func UDPEchoServer(name string, port string, async bool) net.Addr {
+	return UDPEchoServerWithReply(name, port, async, UDPReply{})
+}
+
+// UDPEchoServerWithReply starts a UDP Echo Server replying by default (when not
+// overridden by the datagram's prefix, if reply.Prefix, see ParseUDPReplyPrefix)
+// with reply.
+func UDPEchoServerWithReply(name string, port string, async bool, reply UDPReply) net.Addr {
 	if async {
 		name += "-async"
 	}
@@ -193,9 +338,9 @@ func UDPEchoServer(name string, port string, async bool) net.Addr {
 					name, size, addr, conn)
 				// Synchronous or go routines
 				if async {
-					go handleUDPEchoRequest(name, listener, conn, buf[:size])
+					go handleUDPEchoRequest(name, listener, conn, buf[:size], reply)
 				} else {
-					handleUDPEchoRequest(name, listener, conn, buf[:size])
+					handleUDPEchoRequest(name, listener, conn, buf[:size], reply)
 				}
 			}
 		}
@@ -477,6 +622,12 @@ func NormalizeHostPort(inputPort string, addr net.Addr) string {
 // ValidatePayloadSize compares input size with MaxPayLoadSize. If size exceeds the MaxPayloadSize
 // size will set to MaxPayLoadSize.
 func ValidatePayloadSize(size *int) {
+	payloadMutex.RLock()
+	validatePayloadSize(size)
+	payloadMutex.RUnlock()
+}
+
+func validatePayloadSize(size *int) {
 	if *size > MaxPayloadSize && *size > 0 {
 		log.Warnf("Requested size %d greater than max size %d, using max instead (change max using -maxpayloadsizekb)",
 			*size, MaxPayloadSize)
@@ -489,7 +640,9 @@ func ValidatePayloadSize(size *int) {
 
 // GenerateRandomPayload generates a random payload with given input size.
 func GenerateRandomPayload(payloadSize int) []byte {
-	ValidatePayloadSize(&payloadSize)
+	payloadMutex.RLock()
+	defer payloadMutex.RUnlock()
+	validatePayloadSize(&payloadSize)
 	return Payload[:payloadSize]
 }
 
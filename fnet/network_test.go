@@ -223,6 +223,30 @@ func TestTcpEcho(t *testing.T) {
 	}
 }
 
+func TestTCPSink(t *testing.T) {
+	addr := fnet.TCPSinkServer("test-sink", ":0")
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := fnet.GenerateRandomPayload(100 * fnet.KILOBYTE)
+	if n, err := conn.Write(data); err != nil || n != len(data) {
+		t.Errorf("Unexpected write to sink %d %v", n, err)
+	}
+	if err = conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// Nothing is sent back and the sink closes once it got everything:
+	buf := make([]byte, 10)
+	if n, err := conn.Read(buf); n != 0 || err != io.EOF {
+		t.Errorf("Expected EOF from sink, got %d %v", n, err)
+	}
+	if fnet.TCPSinkServer("test-sink-bad", "not a port") != nil {
+		t.Errorf("Expected nil for bad sink port")
+	}
+}
+
 func TestUdpEcho(t *testing.T) {
 	for i := 0; i <= 1; i++ {
 		async := (i == 0)
@@ -244,6 +268,80 @@ func TestUdpEcho(t *testing.T) {
 	}
 }
 
+func TestParseUDPReplyPrefix(t *testing.T) {
+	def := fnet.UDPReply{Size: 10, Count: 2}
+	tests := []struct {
+		in       string
+		expected fnet.UDPReply
+	}{
+		{"", def},
+		{"ABCDEF", def},
+		{"size=100 ABC", fnet.UDPReply{Size: 100, Count: 2}},
+		{"count=3 size=5 ABC", fnet.UDPReply{Size: 5, Count: 3}},
+		{"count=3", fnet.UDPReply{Size: 10, Count: 3}},
+		{"size= 3", def},
+		{"size=3x count=4", def},
+		{"count=4 size=abc", fnet.UDPReply{Size: 10, Count: 4}},
+		{"size=100000 count=1000", fnet.UDPReply{Size: fnet.MaxUDPReplySize, Count: fnet.MaxUDPReplyCount}},
+	}
+	for _, tst := range tests {
+		if actual := fnet.ParseUDPReplyPrefix([]byte(tst.in), def); actual != tst.expected {
+			t.Errorf("for %q got %+v, expected %+v", tst.in, actual, tst.expected)
+		}
+	}
+}
+
+func TestUDPEchoReply(t *testing.T) {
+	addr := fnet.UDPEchoServerWithReply("test-udp-reply", ":0", false, fnet.UDPReply{Count: 2, Prefix: true})
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: addr.(*net.UDPAddr).Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	read := func(expected string) {
+		buf := make([]byte, 100)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil || string(buf[:n]) != expected {
+			t.Errorf("got %q (%v), expected %q", buf[:n], err, expected)
+		}
+	}
+	// Server default of 2 replies:
+	_, _ = conn.Write([]byte("ABC"))
+	read("ABC")
+	read("ABC")
+	// Overridden by the prefix:
+	_, _ = conn.Write([]byte("size=20 count=3 ab"))
+	for i := 0; i < 3; i++ {
+		read("size=20 count=3 absi")
+	}
+	_, _ = conn.Write([]byte("size=4 count=1 xyz"))
+	read("size")
+	// At most 10 times the received bytes: 2 datagrams of 60 for 17 bytes.
+	_, _ = conn.Write([]byte("size=60 count=9 z"))
+	for i := 0; i < 2; i++ {
+		read(strings.Repeat("size=60 count=9 z", 4)[:60])
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 100)); err == nil {
+		t.Errorf("unexpected third reply of %d bytes", n)
+	}
+	// Prefixes are ignored unless enabled:
+	addr = fnet.UDPEchoServerWithReply("test-udp-reply-no-prefix", ":0", false, fnet.UDPReply{})
+	conn2, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: addr.(*net.UDPAddr).Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	conn = conn2
+	_, _ = conn.Write([]byte("size=20 count=3 ab"))
+	read("size=20 count=3 ab")
+	_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 100)); err == nil {
+		t.Errorf("unexpected second reply of %d bytes", n)
+	}
+}
+
 type ErroringWriter struct{}
 
 func (cbb *ErroringWriter) Close() error {
@@ -563,6 +661,27 @@ func TestGenerateRandomPayload(t *testing.T) {
 	}
 }
 
+func TestChangeMaxPayloadSizeConcurrently(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 20; i++ {
+			fnet.ChangeMaxPayloadSize((i % 4) * 1024)
+		}
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			fnet.ChangeMaxPayloadSize(256 * 1024)
+			return
+		default:
+			if l := len(fnet.GenerateRandomPayload(2048)); l > 2048 {
+				t.Errorf("Got %d, expected at most 2048", l)
+			}
+		}
+	}
+}
+
 func TestReadFileForPayload(t *testing.T) {
 	tests := []struct {
 		payloadFile  string
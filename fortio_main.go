@@ -21,24 +21,33 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
 	"fortio.org/fortio/bincommon"
+	"fortio.org/fortio/dflag"
 	"fortio.org/fortio/dflag/configmap"
 	"fortio.org/fortio/fgrpc"
 	"fortio.org/fortio/fhttp"
 	"fortio.org/fortio/fnet"
+	"fortio.org/fortio/icmprunner"
 	"fortio.org/fortio/log"
+	"fortio.org/fortio/mqttrunner"
+	"fortio.org/fortio/otlp"
 	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/redisrunner"
+	"fortio.org/fortio/smtprunner"
 	"fortio.org/fortio/stats"
 	"fortio.org/fortio/tcprunner"
 	"fortio.org/fortio/udprunner"
 	"fortio.org/fortio/ui"
 	"fortio.org/fortio/version"
+	"fortio.org/fortio/wsrunner"
 )
 
 // -- Start of support for multiple proxies (-P) flags on cmd line.
@@ -69,12 +78,51 @@ func (f *httpMultiFlagList) Set(value string) error {
 
 // -- End of -M support.
 
+// autoQPS is the -qps value searching for the max sustainable qps.
+const autoQPS = "auto"
+
+// autoStartQPS is the qps the -qps auto search starts from.
+const autoStartQPS = 10
+
+// -- -qps: a number or auto.
+type qpsFlagValue struct {
+	qps  float64
+	auto bool
+}
+
+func (f *qpsFlagValue) String() string {
+	if f.auto {
+		return autoQPS
+	}
+	return strconv.FormatFloat(f.qps, 'g', -1, 64)
+}
+
+func (f *qpsFlagValue) Set(value string) error {
+	if value == autoQPS {
+		f.auto = true
+		return nil
+	}
+	qps, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("expecting a number or %s", autoQPS)
+	}
+	f.qps, f.auto = qps, false
+	return nil
+}
+
+// -- End of -qps support.
+
 // Usage to a writer.
 func usage(w io.Writer, msgs ...interface{}) {
-	_, _ = fmt.Fprintf(w, "Φορτίο %s usage:\n\t%s command [flags] target\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n",
+	_, _ = fmt.Fprintf(w, "Φορτίο %s usage:\n\t%s command [flags] target\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n",
 		version.Short(),
 		os.Args[0],
-		"where command is one of: load (load testing), server (starts ui, http-echo,",
+		"where command is one of: load (load testing), capacity (http load at increasing",
+		" qps steps until failure), replay (of the -replay-file requests with their timing),",
+		" sweep (a load run per -sweep-sizes x -sweep-qps x -sweep-connections cell),",
+		" calibrate (max qps runs against its own echo server: this machine's baseline),",
+		" merge (of the json results given as arguments, e.g. from several load generators),",
+		" server (starts ui, http-echo,",
 		" redirect, proxies, tcp-echo and grpc ping servers), tcp-echo (only the tcp-echo",
 		" server), report (report only UI server), redirect (only the redirect server),",
 		" proxies (only the -M and -P configured proxies), grpcping (grpc client),",
@@ -100,13 +148,14 @@ const (
 var (
 	defaults = &periodic.DefaultRunnerOptions
 	// Very small default so people just trying with random URLs don't affect the target.
-	qpsFlag         = flag.Float64("qps", defaults.QPS, "Queries Per Seconds or 0 for no wait/max qps")
+	qpsFlag         = qpsFlagValue{qps: defaults.QPS}
 	numThreadsFlag  = flag.Int("c", defaults.NumThreads, "Number of connections/goroutine/threads")
 	durationFlag    = flag.Duration("t", defaults.Duration, "How long to run the test or 0 to run until ^C")
 	percentilesFlag = flag.String("p", "50,75,90,99,99.9", "List of pXX to calculate")
 	resolutionFlag  = flag.Float64("r", defaults.Resolution, "Resolution of the histogram lowest buckets in seconds")
 	offsetFlag      = flag.Duration("offset", defaults.Offset, "Offset of the histogram data")
 	goMaxProcsFlag  = flag.Int("gomaxprocs", 0, "Setting for runtime.GOMAXPROCS, <1 doesn't change the default")
+	autoProcsFlag   = flag.Bool("auto-gomaxprocs", true, "Lower GOMAXPROCS to the container cpu quota unless -gomaxprocs is set")
 	profileFlag     = flag.String("profile", "", "write .cpu and .mem profiles to `file`")
 	grpcFlag        = flag.Bool("grpc", false, "Use GRPC (health check by default, add -ping for ping) for load testing")
 	echoPortFlag    = flag.String("http-port", "8080",
@@ -123,10 +172,38 @@ var (
 		"http echo server `URI` for debug, empty turns off that part (more secure)")
 	jsonFlag = flag.String("json", "",
 		"Json output to provided file `path` or '-' for stdout (empty = no json output, unless -a is used)")
+	csvFlag = flag.String("csv", "",
+		"Also write a flat csv row of the results (one per stage for -stages) to that `file`, appended when it "+
+			"already exists, or '-' for stdout")
+	csvBucketsFlag = flag.Bool("csv-buckets", false,
+		"Also write one -csv row per histogram bucket after each result's row")
+	hgrmFlag = flag.String("hgrm", "",
+		"Also write the latency histogram in HdrHistogram percentile distribution format (in milliseconds) to that "+
+			"`file` (e.g. result.hgrm) or '-' for stdout, to plot or compare it with HdrHistogram tools, wrk2...")
+	bundleFlag = flag.Bool("bundle", false,
+		"Also write a run bundle: a tar.gz of the result json, effective config (flags), environment metadata, "+
+			"warning/error log samples and console log, to the -data-dir as id"+periodic.BundleSuffix+
+			" (listed by the report/browse UI)")
+	junitFlag = flag.String("junit", "",
+		"Also write a JUnit XML test report of the run to that `file` (e.g. junit.xml), with one testcase per -slo, "+
+			"for CI pipelines (Jenkins, GitLab,...)")
+	sloFlag = flag.String("slo", "",
+		"Comma separated SLO `thresholds` checked as the -junit testcases: metric<threshold or metric>threshold with "+
+			"metric error-rate (fraction or %), qps, avg, min, max or pNN latency (duration or seconds), "+
+			"e.g. \"p99<250ms,error-rate<1%\"")
+	assertFlag = flag.String("assert", "",
+		"Comma separated `thresholds`, same syntax as -slo, checked after the run: the verdict is added to the json "+
+			"results and fortio exits with status 2 when any isn't met, e.g. \"p99<200ms,error-rate<0.1%,qps>900\"")
 	uiPathFlag = flag.String("ui-path", "/fortio/", "http server `URI` for UI, empty turns off that part (more secure)")
 	curlFlag   = flag.Bool("curl", false, "Just fetch the content once")
 	labelsFlag = flag.String("labels", "",
 		"Additional config data/labels to add to the resulting JSON, defaults to target URL and hostname")
+	exactPercFlag = flag.Int("exact-percentiles", 0,
+		"Compute the percentiles by exact rank instead of histogram interpolation for runs of up to this many calls "+
+			"(at most 1000000)")
+	histogramTypeFlag = flag.String("histogram-type", string(stats.HistogramFixed),
+		"Histograms `type`: fixed buckets (coarser and coarser for the higher values) or loglinear for the same relative "+
+			"precision (1.6%) of latencies from microseconds to seconds, -r being then only their unit")
 	// do not remove the flag for backward compatibility.  Was absolute `path` to the dir containing the static files dir
 	// which is now embedded in the binary thanks to that support in golang 1.16.
 	_            = flag.String("static-dir", "", "Deprecated/unused `path`.")
@@ -141,20 +218,24 @@ var (
 
 	allowInitialErrorsFlag = flag.Bool("allow-initial-errors", false, "Allow and don't abort on initial warmup errors")
 	abortOnFlag            = flag.Int("abort-on", 0,
-		"Http `code` that if encountered aborts the run. e.g. 503 or -1 for socket errors.")
+		"Http `code` that if encountered aborts the run. e.g. 503 or -1 for socket errors, -3 for timeouts.")
 	autoSaveFlag = flag.Bool("a", false, "Automatically save JSON result with filename based on labels & timestamp")
 	redirectFlag = flag.String("redirect-port", "8081", "Redirect all incoming traffic to https URL"+
 		" (need ingress to work properly). Can be in the form of host:port, ip:port, `port` or \""+disabled+"\" to disable the feature.")
 	exactlyFlag = flag.Int64("n", 0,
 		"Run for exactly this number of calls instead of duration. Default (0) is to use duration (-t). "+
 			"Default is 1 when used as grpc ping count.")
-	syncFlag         = flag.String("sync", "", "index.tsv or s3/gcs bucket xml `URL` to fetch at startup for server modes.")
+	syncFlag = flag.String("sync", "", "index.tsv, s3/gcs or azure blob bucket xml, http directory listing or "+
+		"dav(s):// webdav collection `URL` to fetch at startup for server modes.")
 	syncIntervalFlag = flag.Duration("sync-interval", 0, "Refresh the url every given interval (default, no refresh)")
 
 	baseURLFlag = flag.String("base-url", "",
 		"base `URL` used as prefix for data/index.tsv generation. (when empty, the url from the first request is used)")
-	newMaxPayloadSizeKb = flag.Int("maxpayloadsizekb", fnet.MaxPayloadSize/fnet.KILOBYTE,
-		"MaxPayloadSize is the maximum size of payload to be generated by the EchoHandler size= argument. In `Kbytes`.")
+	_ = dflag.DynInt64(flag.CommandLine, "maxpayloadsizekb", int64(fnet.MaxPayloadSize/fnet.KILOBYTE),
+		"MaxPayloadSize is the maximum size of payload to be generated by the EchoHandler size= argument. In `Kbytes`."+
+			" dynamic flag.").
+		WithValidator(dflag.ValidateDynInt64Range(0, int64(fnet.MaxPayloadSizeLimit/fnet.KILOBYTE))).
+		WithSyncNotifier(func(_, newKb int64) { fnet.ChangeMaxPayloadSize(int(newKb) * fnet.KILOBYTE) })
 
 	// GRPC related flags
 	// To get most debugging/tracing:
@@ -174,12 +255,194 @@ var (
 	mirrorOriginFlag = flag.Bool("multi-mirror-origin", true, "Mirror the request url to the target for multi proxies (-M)")
 	multiSerialFlag  = flag.Bool("multi-serial-mode", false, "Multi server (-M) requests one at a time instead of parallel mode")
 	udpTimeoutFlag   = flag.Duration("udp-timeout", udprunner.UDPTimeOutDefaultValue, "Udp timeout")
+	tcpHoldFlag      = flag.Bool("tcp-hold", false,
+		"tcp load: connection scaling mode, each call opens a new connection which is kept open (use -n for the count)")
+	tcpHoldDurationFlag = flag.Duration("tcp-hold-duration", 10*time.Second,
+		"How long to keep the -tcp-hold connections open once they are all established")
+	tcpHoldPingFlag = flag.Duration("tcp-hold-ping", 0,
+		"Interval at which the payload is sent on each -tcp-hold connection (default 0: idle connections)")
+	tcpFramingFlag = flag.String("tcp-framing", tcprunner.FramingEcho,
+		"tcp load: framing `mode` of the responses, echo of the payload, or length:1|2|4 (big endian length prefix), "+
+			"delim:delimiter (e.g. delim:\\r\\n) or size:n for protocols with other responses")
+	pipelineFlag = flag.Int("pipeline", 1,
+		"tcp/udp load: number of messages sent at once for each call, with their individual latency also reported")
+	burstFlag = flag.Int("burst", 0,
+		"Think time: number of calls each connection makes before staying idle for -dwell (default 0: no think time)")
+	dwellFlag = flag.Duration("dwell", 10*time.Second,
+		"Think time: how long each connection stays idle, kept open, after each -burst of calls")
+	wsPingFlag = flag.Bool("ws-ping", false,
+		"ws load: send ping frames (payload up to 125 bytes) expecting pongs instead of text messages expecting echoes")
+	wsMessagesFlag = flag.Int("ws-messages", 0,
+		"ws load: number of messages per connection before closing it and opening a new one (default 0: no limit)")
+	otlpEndpointFlag = flag.String("otlp-endpoint", "",
+		"OpenTelemetry OTLP/HTTP collector `URL` (e.g. http://localhost:4318) to export client spans of sampled "+
+			"http and grpc calls (see -otlp-sample) and the run summary metrics to")
+	otlpSampleFlag = flag.Float64("otlp-sample", 0.01, "Fraction (0-1] of the http and grpc load calls to export as spans")
+	retriesFlag    = flag.Int("retries", 0,
+		"Number of times to retry http load calls failing with one of the -retry-on codes (default 0: no retries)")
+	retryOnFlag = flag.String("retry-on", "502,503,connect-error",
+		"Comma separated http `codes` and/or connect-error, timeout to retry on when -retries is set")
+	retryBackoffFlag = flag.Duration("retry-backoff", 10*time.Millisecond,
+		"Wait before the first retry of a call, doubled for each subsequent retry")
+	reconnectBackoffFlag = flag.Duration("reconnect-backoff", 0,
+		"Wait before the next http load call after a connection error (e.g. the target restarting), doubled for each "+
+			"consecutive error up to 1s, instead of spinning, e.g. 10ms (default 0: no backoff)")
+	certReloadFlag = flag.Duration("cert-reload", 0,
+		"Reload the client -cert/-key from disk at this interval during the load run, for new connections (0 for never)")
+	certReloadSighupFlag = flag.Bool("cert-reload-sighup", false,
+		"Reload the client -cert/-key from disk on SIGHUP during the load run, for new connections")
+	cacheStatsFlag = flag.Bool("cache-stats", false,
+		"Classify http responses as cache HIT/MISS/BYPASS from their Cache-Status, X-Cache or Age headers "+
+			"and report the hit ratio and latency of each")
+	capacityStepFlag = flag.Float64("capacity-step", 0,
+		"capacity: qps increase of each step (default 0: the starting -qps)")
+	capacityMaxFlag = flag.Float64("capacity-max", 0,
+		"capacity: qps of the last step (default 0: no limit, until a step fails)")
+	capacityErrorsFlag = flag.Float64("capacity-errors", 0.01,
+		"capacity: fraction of non ok responses above which a step fails")
+	capacityLatencyFlag = flag.Duration("capacity-latency", 0,
+		"capacity: latency at -capacity-percentile above which a step fails (default 0: no limit)")
+	capacityPercentileFlag = flag.Float64("capacity-percentile", 99,
+		"capacity: latency percentile checked against -capacity-latency and -capacity-knee")
+	capacityKneeFlag = flag.Float64("capacity-knee", 3,
+		"capacity: a step also fails when its latency exceeds this multiple of the first step's, 0 to disable")
+	capacitySearchFlag = flag.Bool("capacity-search", false,
+		"capacity: binary search the max sustainable qps (doubling from -qps until a step fails, then bisecting "+
+			"down to -capacity-step or 5%) instead of linear steps")
+	checkpointFlag = flag.Duration("checkpoint-interval", 0,
+		"Write intermediate json results of each window of that duration during the run, e.g. 10m for soak tests "+
+			"(next to -json as file_checkpointN.json or in the -data-dir)")
+	timeseriesFlag = flag.Duration("timeseries", 0,
+		"Record the count, avg, p99 and max latency and errors of the calls of each `interval` (min 100ms) of "+
+			"the run in the results' Timeseries, graphed in the web UI, e.g. 1s (default 0: none)")
+	scheduledLatencyFlag = flag.Bool("scheduled-latency", false,
+		"Also report the latency from each call's scheduled start (-qps mode), including the wait when the target "+
+			"can't keep up (coordinated omission correction)")
+	grpcStreamMsgsFlag = flag.Int("grpc-stream-msgs", 0,
+		"grpc load test: send and receive that many ping messages on a bidirectional stream for each call "+
+			"instead of unary pings, and report the per message latency (implies -ping)")
+	sizeClassesFlag = flag.String("size-classes", "",
+		"Comma separated increasing response size `boundaries` (bytes, k or m suffix, e.g. \"1k,64k,1m\") to also "+
+			"report the latency of each size class, useful with variable size responses")
+	redisCmdFlag = flag.String("redis-cmd", "PING",
+		"redis load: comma separated commands (GET, SET and/or PING) sent in turn by each connection")
+	redisKeyFlag = flag.String("redis-key", redisrunner.DefaultKeyPattern,
+		"redis load: key `pattern` of the GET and SET commands, {n} being replaced by a random key number")
+	redisKeysFlag      = flag.Int("redis-keys", redisrunner.DefaultKeys, "redis load: number of distinct keys")
+	redisValueSizeFlag = flag.Int("redis-value-size", 100, "redis load: size in bytes of the SET values")
+	recordFileFlag     = flag.String("record-file", "",
+		"Server mode: append the echo server requests (method, uri, headers, body size and digest) to this file `path`, "+
+			"to be replayed with -replay-file")
+	mqttQoSFlag       = flag.Int("mqtt-qos", 0, "mqtt load: QoS `level` of the published messages (0, 1 or 2)")
+	mqttSubscribeFlag = flag.Bool("mqtt-subscribe", false,
+		"mqtt load: also subscribe to the topic and report the publish to receive latency")
+	preCheckFlag = flag.Int("pre-check", 0,
+		"Number of sequential validation requests sent before the http run, which doesn't start unless they all "+
+			"succeed (see -pre-check-status and -pre-check-max-latency)")
+	preCheckStatusFlag     = flag.Int("pre-check-status", 0, "Expected http status `code` of the -pre-check requests (default any 2xx)")
+	preCheckMaxLatencyFlag = flag.Duration("pre-check-max-latency", 0, "Maximum latency of each -pre-check request (default no limit)")
+	grpcMethodFlag         = flag.String("grpc-method", "",
+		"grpc load test: unary `method` (package.Service/Method) to call instead of health or ping, with the json "+
+			"request from -payload (in which {uuid} is replaced for each call), described by the server reflection "+
+			"or -grpc-protoset")
+	grpcProtosetFlag = flag.String("grpc-protoset", "",
+		"grpc load test: protoset `file` (from protoc --include_imports -o) describing the -grpc-method instead of the server reflection")
+	grpcHealthWatchFlag = flag.Bool("grpc-health-watch", false,
+		"grpc load test: use the health Watch streaming rpc instead of Check, the latency being the time to the first "+
+			"status, and keep each call's stream open until the next call of its thread (so at most -c streams) "+
+			"or the end of the run, counting the status updates")
+	smtpHeloFlag = flag.String("smtp-helo", smtprunner.DefaultHelo,
+		"smtp load: host `name` sent in the EHLO (or HELO) of each handshake")
+	smtpStartTLSFlag = flag.Bool("smtp-starttls", false,
+		"smtp load: also upgrade the smtp:// connections with STARTTLS (and a new EHLO) in each handshake")
+	qpsScheduleFlag = flag.String("qps-schedule", "",
+		"Target qps changing over the run instead of -qps and -t, as comma separated `steps` of \"[from]->to over duration\", "+
+			"\"hold duration\" or \"qps for duration\", e.g. \"0->1000 over 2m, hold 5m, ->0 over 1m\". "+
+			"The results include the histogram of each step")
+	stagesFlag = flag.String("stages", "",
+		"Load in sequential named stages, with different qps and threads, described in `file` by lines of "+
+			"\"name qps threads duration\" (qps max for max speed, 0 threads for -c). The results include each stage's histogram")
+	sweepSizesFlag = flag.String("sweep-sizes", "",
+		"Comma separated payload `sizes` in bytes (0 for none) of the fortio sweep matrix, e.g. 0,1024,65536")
+	sweepQPSFlag = flag.String("sweep-qps", "",
+		"Comma separated `qps` levels (max for max speed) of the fortio sweep matrix, e.g. 100,1000,max")
+	sweepConnectionsFlag = flag.String("sweep-connections", "",
+		"Comma separated numbers of `connections` (threads) of the fortio sweep matrix, e.g. 1,8,64")
+	arrivalFlag = flag.String("arrival", periodic.ArrivalUniform,
+		"Arrival `process` of the calls in -qps mode: uniform (fixed pacing) or poisson (exponentially distributed "+
+			"intervals averaging the qps, open loop like real independent clients, for a random number of calls with -t)")
+	burstSizeFlag = flag.Int("burst-size", 0,
+		"Burst traffic: number of back to back calls (split across the -c connections) made every -burst-interval "+
+			"instead of evenly paced calls, e.g. to test rate limiters, -qps is then derived from them (default 0: no bursts)")
+	burstIntervalFlag = flag.Duration("burst-interval", time.Second,
+		"Burst traffic: interval between the starts of the -burst-size bursts of calls")
+	replaySpeedFlag = flag.Float64("replay-speed", 1,
+		"replay: speed multiplier of the -replay-file requests' timing, e.g. 2 to replay twice as fast")
+	warmupDurationFlag = flag.Duration("warmup-duration", 0,
+		"Warmup for this long, at the -qps, before the load test: the warmup calls are reported separately and "+
+			"excluded from the results, instead of the default single warmup call per connection")
+	warmupCallsFlag = flag.Int64("warmup-calls", 0,
+		"Number of warmup calls (split across the -c connections) before the load test, see -warmup-duration "+
+			"(when both are set the first one reached ends the warmup)")
+	threadWeightsFlag = flag.String("thread-weights", "",
+		"Comma separated relative `weights` of the -c connections' share of the -qps, e.g. 3,1,1 for the first "+
+			"connection to make 3 times more calls than the next 2, to simulate heterogeneous clients "+
+			"(connections beyond the weights have a weight of 1)")
+	udpReplySizeFlag = flag.Int("udp-reply-size", 0,
+		"udp echo server: size of the reply datagrams, the received bytes truncated or repeated to that size "+
+			"(default 0: same as received), can be overridden by a \"size=N \" prefix in the received datagram "+
+			"with -udp-reply-prefix")
+	udpReplyCountFlag = flag.Int("udp-reply-count", 1,
+		"udp echo server: number of reply datagrams for each received one, can be overridden by a \"count=N \" "+
+			"prefix in the received datagram with -udp-reply-prefix (max 100)")
+	udpReplyPrefixFlag = flag.Bool("udp-reply-prefix", false,
+		"udp echo server: let each datagram override -udp-reply-size and -udp-reply-count with a "+
+			"\"size=N count=N \" prefix. Either way the reply is at most 10 times the received bytes")
+	concurrencyOnlyFlag = flag.Bool("concurrency-only", false,
+		"Closed loop mode: keep exactly -c calls in flight, back to back with no qps pacing nor think time, "+
+			"and report the resulting throughput (-qps and the other pacing flags are ignored)")
+	qpsControlFlag = flag.Bool("qps-control", false,
+		"Change the target -qps while the load run is in progress, to explore the latency vs throughput curve "+
+			"interactively: type the new qps (and enter) on stdin, or send SIGUSR1 to double it and SIGUSR2 to halve it "+
+			"(only for uniformly paced -qps runs)")
+	tcpBulkChunkFlag = flag.Int("tcp-bulk-chunk", tcprunner.DefaultBulkChunkSize,
+		"Size in `bytes` of each write of the tcp-bulk:// throughput mode (unless -payload* is set)")
+	tcpSinkPortFlag = flag.String("tcp-sink-port", disabled,
+		"tcp sink (discard) server port, e.g. for tcp-bulk:// load tests, started by the server and tcp-echo "+
+			"commands. Can be in the form of host:port, ip:port, `port` or /unix/domain/path or \""+disabled+"\".")
+	udpFloodFlag = flag.Bool("udp-flood", false,
+		"udp load: send the datagrams at the -qps without waiting for the replies, which are accounted for "+
+			"separately to measure the server side drops (requires -udp-flood-i-understand)")
+	udpFloodConfirmFlag = flag.Bool("udp-flood-i-understand", false,
+		"Confirms the -udp-flood target is yours to stress test and that it can disrupt it and the network")
+	udpFloodMaxPPSFlag = flag.Float64("udp-flood-max-pps", udprunner.DefaultFloodMaxPPS,
+		"Cap of the -udp-flood packets per second (total for all the connections), the -qps is lowered to it "+
+			"and max speed (-qps -1) is that `rate`")
+	loadShapeFlag = flag.String("load-shape", "",
+		"Cyclic target qps for the -t duration instead of -qps, `shape` sine or sawtooth with its period, min (default 0) "+
+			"and max qps, e.g. \"sine:period=60s,min=100,max=1000\" to test autoscalers. The results include the histogram of each step")
+	intervalResultsFlag = flag.Duration("interval-results", 0,
+		"Print a summary of the calls of each window of that `duration` during the run, e.g. 1m to see drift "+
+			"during soak tests without waiting for the final results (see also -interval-results-json)")
+	intervalResultsJSONFlag = flag.String("interval-results-json", "",
+		"Also append the json results of each -interval-results window to that `file`, one line each")
+	streamSamplesFlag = flag.String("stream-samples", "",
+		"Stream one json line per completed call (timestamp, latency, lateness in qps mode, code, thread and size) "+
+			"to that `file` or '-' for stdout during the run, e.g. for real time dashboards")
+	pushStatsFlag = flag.String("push-stats", "",
+		"Push the final and interim stats of the run to that time series database `URL`: influx://host:8086/db "+
+			"(InfluxDB line protocol, influxs:// for https) or statsd://host:8125[/prefix] (gauges)")
+	pushStatsIntervalFlag = flag.Duration("push-stats-interval", 0,
+		"Interval of the -push-stats interim stats, defaults to the -checkpoint-interval or -interval-results one "+
+			"or else 10s")
 )
 
 // nolint: funlen // well yes it's fairly big and lotsa ifs.
 func main() {
 	flag.Var(&proxiesFlags, "P",
 		"Tcp proxies to run, e.g -P \"localport1 dest_host1:dest_port1\" -P \"[::1]:0 www.google.com:443\" ...")
+	flag.Var(&qpsFlag, "qps", "Queries Per Seconds or 0 for no wait/max qps, or auto to search (http only) for the max "+
+		"qps meeting the -capacity-* thresholds, see -capacity-search")
 	flag.Var(&httpMultiFlags, "M", "Http multi proxy to run, e.g -M \"localport1 baseDestURL1 baseDestURL2\" -M ...")
 	bincommon.SharedMain(usage)
 	if len(os.Args) < 2 {
@@ -191,13 +454,15 @@ func main() {
 	if *bincommon.QuietFlag {
 		log.SetLogLevelQuiet(log.Error)
 	}
+	if *goMaxProcsFlag < 1 && *autoProcsFlag {
+		setGoMaxProcsFromQuota()
+	}
 	confDir := *bincommon.ConfigDirectoryFlag
 	if confDir != "" {
 		if _, err := configmap.Setup(flag.CommandLine, confDir); err != nil {
 			log.Critf("Unable to watch config/flag changes in %v: %v", confDir, err)
 		}
 	}
-	fnet.ChangeMaxPayloadSize(*newMaxPayloadSizeKb * fnet.KILOBYTE)
 	percList, err := stats.ParsePercentiles(*percentilesFlag)
 	if err != nil {
 		usageErr("Unable to extract percentiles from -p: ", err)
@@ -217,6 +482,16 @@ func main() {
 		fortioNC()
 	case "load":
 		fortioLoad(*curlFlag, percList)
+	case "capacity":
+		fortioCapacity(percList)
+	case "replay":
+		fortioReplay(percList)
+	case "sweep":
+		fortioSweep(percList)
+	case "calibrate":
+		fortioCalibrate(percList)
+	case "merge":
+		fortioMerge()
 	case "redirect":
 		isServer = true
 		fhttp.RedirectToHTTPS(*redirectFlag)
@@ -231,10 +506,13 @@ func main() {
 	case "tcp-echo":
 		isServer = true
 		fnet.TCPEchoServer("tcp-echo", *tcpPortFlag)
+		if *tcpSinkPortFlag != disabled {
+			fnet.TCPSinkServer("tcp-sink", *tcpSinkPortFlag)
+		}
 		startProxies()
 	case "udp-echo":
 		isServer = true
-		fnet.UDPEchoServer("udp-echo", *udpPortFlag, *udpAsyncFlag)
+		fnet.UDPEchoServerWithReply("udp-echo", *udpPortFlag, *udpAsyncFlag, udpReply())
 		startProxies()
 	case "proxies":
 		if len(flag.Args()) != 0 {
@@ -249,8 +527,11 @@ func main() {
 		if *tcpPortFlag != disabled {
 			fnet.TCPEchoServer("tcp-echo", *tcpPortFlag)
 		}
+		if *tcpSinkPortFlag != disabled {
+			fnet.TCPSinkServer("tcp-sink", *tcpSinkPortFlag)
+		}
 		if *udpPortFlag != disabled {
-			fnet.UDPEchoServer("udp-echo", *udpPortFlag, *udpAsyncFlag)
+			fnet.UDPEchoServerWithReply("udp-echo", *udpPortFlag, *udpAsyncFlag, udpReply())
 		}
 		if *grpcPortFlag != disabled {
 			fgrpc.PingServer(*grpcPortFlag, *bincommon.CertFlag, *bincommon.KeyFlag, fgrpc.DefaultHealthServiceName, uint32(*maxStreamsFlag))
@@ -258,6 +539,11 @@ func main() {
 		if *redirectFlag != disabled {
 			fhttp.RedirectToHTTPS(*redirectFlag)
 		}
+		if *recordFileFlag != "" {
+			if err := fhttp.RecordRequests(*recordFileFlag); err != nil {
+				log.Fatalf("Unable to record requests: %v", err)
+			}
+		}
 		if !ui.Serve(baseURL, *echoPortFlag, *echoDbgPathFlag, *uiPathFlag, *dataDirFlag, percList) {
 			os.Exit(1) // error already logged
 		}
@@ -267,6 +553,11 @@ func main() {
 	default:
 		usageErr("Error: unknown command ", command)
 	}
+	if samplesFile != nil {
+		if err := samplesFile.Close(); err != nil {
+			log.Errf("Error closing -stream-samples file: %v", err)
+		}
+	}
 	if isServer {
 		if confDir == "" {
 			log.Infof("Note: not using dynamic flag watching (use -config to set watch directory)")
@@ -335,6 +626,29 @@ func fortioNC() {
 	}
 }
 
+// setGoMaxProcsFromQuota lowers GOMAXPROCS to match the container cpu quota, if any.
+func setGoMaxProcsFromQuota() {
+	limits := periodic.DetectedContainerLimits()
+	if n := periodic.GOMAXPROCSForQuota(limits); n != runtime.GOMAXPROCS(0) {
+		log.Infof("Setting GOMAXPROCS to %d for the container cpu quota of %g (override with -gomaxprocs)", n, limits.CPUQuota)
+		runtime.GOMAXPROCS(n)
+	}
+}
+
+// checkMemoryLimit warns when the connections' buffers may not fit in the container memory limit.
+func checkMemoryLimit(numThreads int) {
+	limit := periodic.DetectedContainerLimits().MemoryLimit
+	if limit <= 0 {
+		return
+	}
+	// Keep half of the memory for everything else (results, gc headroom,...).
+	maxThreads := limit / 2 / int64(fhttp.BufferSizeKb*1024)
+	if int64(numThreads) > maxThreads {
+		log.Warnf("-c %d connections with -httpbufferkb %d may exceed the container memory limit of %d bytes, suggest -c %d or less",
+			numThreads, fhttp.BufferSizeKb, limit, maxThreads)
+	}
+}
+
 // nolint: funlen // maybe refactor/shorten later.
 func fortioLoad(justCurl bool, percList []float64) {
 	if len(flag.Args()) != 1 {
@@ -345,29 +659,254 @@ func fortioLoad(justCurl bool, percList []float64) {
 		bincommon.FetchURL(httpOpts)
 		return
 	}
+	if qpsFlag.auto {
+		if *grpcFlag || *stagesFlag != "" || *qpsScheduleFlag != "" || *loadShapeFlag != "" ||
+			(strings.Contains(httpOpts.URL, "://") && !strings.HasPrefix(httpOpts.URL, "http")) {
+			usageErr("Error: -qps auto is only supported for plain http(s) load")
+		}
+		fortioCapacity(percList)
+		return
+	}
 	url := httpOpts.URL
+	checkMemoryLimit(*numThreadsFlag)
 	prevGoMaxProcs := runtime.GOMAXPROCS(*goMaxProcsFlag)
-	out := os.Stderr
-	qps := *qpsFlag // TODO possibly use translated <=0 to "max" from results/options normalization in periodic/
-	_, _ = fmt.Fprintf(out, "Fortio %s running at %g queries per second, %d->%d procs",
-		version.Short(), qps, prevGoMaxProcs, runtime.GOMAXPROCS(0))
-	if *exactlyFlag > 0 {
+	out, console := consoleOutput()
+	qps := qpsFlag.qps // TODO possibly use translated <=0 to "max" from results/options normalization in periodic/
+	switch {
+	case *stagesFlag != "":
+		_, _ = fmt.Fprintf(out, "Fortio %s running the stages of %s, %d->%d procs: %s\n",
+			version.Short(), *stagesFlag, prevGoMaxProcs, runtime.GOMAXPROCS(0), url)
+	case *concurrencyOnlyFlag:
+		_, _ = fmt.Fprintf(out, "Fortio %s running %d calls in flight (closed loop), %d->%d procs",
+			version.Short(), *numThreadsFlag, prevGoMaxProcs, runtime.GOMAXPROCS(0))
+	case *qpsScheduleFlag != "":
+		_, _ = fmt.Fprintf(out, "Fortio %s running qps schedule %q, %d->%d procs: %s\n",
+			version.Short(), *qpsScheduleFlag, prevGoMaxProcs, runtime.GOMAXPROCS(0), url)
+	case *loadShapeFlag != "":
+		_, _ = fmt.Fprintf(out, "Fortio %s running load shape %q, %d->%d procs",
+			version.Short(), *loadShapeFlag, prevGoMaxProcs, runtime.GOMAXPROCS(0))
+	case *burstSizeFlag > 0:
+		_, _ = fmt.Fprintf(out, "Fortio %s running bursts of %d calls every %v, %d->%d procs",
+			version.Short(), *burstSizeFlag, *burstIntervalFlag, prevGoMaxProcs, runtime.GOMAXPROCS(0))
+	default:
+		_, _ = fmt.Fprintf(out, "Fortio %s running at %g queries per second, %d->%d procs",
+			version.Short(), qps, prevGoMaxProcs, runtime.GOMAXPROCS(0))
+	}
+	switch {
+	case *stagesFlag != "", *qpsScheduleFlag != "" && !*concurrencyOnlyFlag:
+	case *loadShapeFlag != "" && *durationFlag <= 0:
+		_, _ = fmt.Fprintf(out, ", for one period: %s\n", url)
+	case *exactlyFlag > 0:
 		_, _ = fmt.Fprintf(out, ", for %d calls: %s\n", *exactlyFlag, url)
-	} else {
-		if *durationFlag <= 0 {
-			// Infinite mode is determined by having a negative duration value
-			*durationFlag = -1
-			_, _ = fmt.Fprintf(out, ", until interrupted: %s\n", url)
-		} else {
-			_, _ = fmt.Fprintf(out, ", for %v: %s\n", *durationFlag, url)
-		}
+	case *durationFlag <= 0:
+		// Infinite mode is determined by having a negative duration value
+		*durationFlag = -1
+		_, _ = fmt.Fprintf(out, ", until interrupted: %s\n", url)
+	default:
+		_, _ = fmt.Fprintf(out, ", for %v: %s\n", *durationFlag, url)
 	}
 	if qps <= 0 {
 		qps = -1 // 0==unitialized struct == default duration, -1 (0 for flag) is max
 	}
+	ro := runnerOptions(url, qps, percList, out)
+	if *stagesFlag != "" {
+		fortioStages(url, httpOpts, ro, out, console)
+		return
+	}
+	if *qpsControlFlag {
+		ro.QPSControl = qpsControl(out)
+	}
+	res, err := runLoad(url, httpOpts, ro)
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "Aborting because of %v\n", err)
+		os.Exit(1)
+	}
+	rr := res.Result()
+	rr.Metadata.Flags = periodic.FlagValues(flag.CommandLine)
+	warmup := int64(*numThreadsFlag)
+	switch {
+	case rr.WarmupHistogram != nil:
+		warmup = rr.WarmupHistogram.Count
+	case ro.Exactly > 0, ro.HasWarmup():
+		warmup = 0
+	}
+	_, _ = fmt.Fprintf(out, "All done %d calls (plus %d warmup) %.3f ms avg, %.1f qps\n",
+		rr.DurationHistogram.Count,
+		warmup,
+		1000.*rr.DurationHistogram.Avg,
+		rr.ActualQPS)
+	passed := checkAssertions([]periodic.HasRunnerResult{res}, out)
+	saveJSON(res, rr.ID(), out)
+	saveCSV([]*periodic.RunnerResults{rr}, ro.Percentiles, out)
+	saveHgrm(rr, out)
+	pushResults([]*periodic.RunnerResults{rr}, out)
+	exportRunSummaries([]*periodic.RunnerResults{rr}, out)
+	saveJUnit([]periodic.HasRunnerResult{res}, out)
+	saveBundle(res, rr.ID(), rr, console, out)
+	exitOnFailedAssertions(passed)
+}
+
+// qpsControl returns the -qps-control changing the target qps of the run from
+// the lines typed on stdin and SIGUSR1/SIGUSR2, watched until exit.
+func qpsControl(out io.Writer) *periodic.QPSControl {
+	control := periodic.NewQPSControl()
+	go control.ReadCommands(os.Stdin)
+	_ = control.WatchSignals()
+	_, _ = fmt.Fprintf(out, "Type a new target qps (and enter) to change it, or kill -USR1 %d to double it, -USR2 to halve it\n",
+		os.Getpid())
+	return control
+}
+
+// runLoad runs the load test of the runner matching the url (or -grpc).
+func runLoad(url string, httpOpts *fhttp.HTTPOptions, ro periodic.RunnerOptions) (periodic.HasRunnerResult, error) {
+	if *grpcFlag {
+		o := fgrpc.GRPCRunnerOptions{
+			RunnerOptions:      ro,
+			Destination:        url,
+			CACert:             *bincommon.CACertFlag,
+			Insecure:           bincommon.TLSInsecure(),
+			Service:            *healthSvcFlag,
+			Streams:            *streamsFlag,
+			AllowInitialErrors: *allowInitialErrorsFlag,
+			Payload:            httpOpts.PayloadString(),
+			Delay:              *pingDelayFlag,
+			UsePing:            *doPingLoadFlag,
+			UnixDomainSocket:   httpOpts.UnixDomainSocket,
+		}
+		o.StreamMessages = *grpcStreamMsgsFlag
+		o.Method = *grpcMethodFlag
+		o.Protoset = *grpcProtosetFlag
+		o.HealthWatch = *grpcHealthWatchFlag
+		o.OTLPEndpoint = *otlpEndpointFlag
+		o.OTLPSampleRate = *otlpSampleFlag
+		return fgrpc.RunGRPCTest(&o)
+	} else if strings.HasPrefix(url, tcprunner.TCPURLPrefix) || strings.HasPrefix(url, tcprunner.TCPBulkURLPrefix) {
+		o := tcprunner.RunnerOptions{
+			RunnerOptions: ro,
+		}
+		o.ReqTimeout = httpOpts.HTTPReqTimeOut
+		o.Destination = url
+		o.Payload = httpOpts.Payload
+		o.Hold = *tcpHoldFlag
+		o.HoldDuration = *tcpHoldDurationFlag
+		o.HoldPing = *tcpHoldPingFlag
+		o.Framing = *tcpFramingFlag
+		o.Pipeline = *pipelineFlag
+		o.BulkChunkSize = *tcpBulkChunkFlag
+		return tcprunner.RunTCPTest(&o)
+	} else if strings.HasPrefix(url, wsrunner.WSURLPrefix) || strings.HasPrefix(url, wsrunner.WSSURLPrefix) {
+		o := wsrunner.RunnerOptions{
+			RunnerOptions: ro,
+		}
+		o.ReqTimeout = httpOpts.HTTPReqTimeOut
+		o.Destination = url
+		o.Payload = httpOpts.Payload
+		o.Insecure = httpOpts.Insecure
+		o.Ping = *wsPingFlag
+		o.MessagesPerConnection = *wsMessagesFlag
+		return wsrunner.RunWSTest(&o)
+	} else if strings.HasPrefix(url, redisrunner.RedisURLPrefix) {
+		o := redisrunner.RunnerOptions{
+			RunnerOptions: ro,
+		}
+		o.ReqTimeout = httpOpts.HTTPReqTimeOut
+		o.Destination = url
+		o.Commands = strings.Split(*redisCmdFlag, ",")
+		o.KeyPattern = *redisKeyFlag
+		o.Keys = *redisKeysFlag
+		o.ValueSize = *redisValueSizeFlag
+		return redisrunner.RunRedisTest(&o)
+	} else if strings.HasPrefix(url, mqttrunner.MQTTURLPrefix) {
+		o := mqttrunner.RunnerOptions{
+			RunnerOptions: ro,
+		}
+		o.ReqTimeout = httpOpts.HTTPReqTimeOut
+		o.Destination = url
+		o.Payload = httpOpts.Payload
+		o.QoS = *mqttQoSFlag
+		o.Subscribe = *mqttSubscribeFlag
+		return mqttrunner.RunMQTTTest(&o)
+	} else if strings.HasPrefix(url, icmprunner.ICMPURLPrefix) {
+		o := icmprunner.RunnerOptions{
+			RunnerOptions: ro,
+		}
+		o.ReqTimeout = httpOpts.HTTPReqTimeOut
+		o.Destination = url
+		o.Payload = httpOpts.Payload
+		return icmprunner.RunICMPTest(&o)
+	} else if strings.HasPrefix(url, smtprunner.SMTPURLPrefix) || strings.HasPrefix(url, smtprunner.SMTPSURLPrefix) {
+		o := smtprunner.RunnerOptions{
+			RunnerOptions: ro,
+		}
+		o.ReqTimeout = httpOpts.HTTPReqTimeOut
+		o.Destination = url
+		o.Insecure = httpOpts.Insecure
+		o.Helo = *smtpHeloFlag
+		o.StartTLS = *smtpStartTLSFlag
+		return smtprunner.RunSMTPTest(&o)
+	} else if strings.HasPrefix(url, udprunner.UDPURLPrefix) {
+		o := udprunner.RunnerOptions{
+			RunnerOptions: ro,
+		}
+		o.ReqTimeout = *udpTimeoutFlag
+		o.Destination = url
+		o.Payload = httpOpts.Payload
+		o.Pipeline = *pipelineFlag
+		if *udpFloodFlag && !*udpFloodConfirmFlag {
+			usageErr("Error: -udp-flood requires -udp-flood-i-understand")
+		}
+		o.Flood = *udpFloodFlag
+		o.FloodConfirmed = *udpFloodConfirmFlag
+		o.FloodMaxPPS = *udpFloodMaxPPSFlag
+		return udprunner.RunUDPTest(&o)
+	} else {
+		o := httpRunnerOptions(httpOpts, ro)
+		return fhttp.RunHTTPTest(&o)
+	}
+}
+
+// fortioStages runs the -stages file's stages in sequence and saves the staged results.
+func fortioStages(url string, httpOpts *fhttp.HTTPOptions, ro periodic.RunnerOptions, out io.Writer,
+	console *periodic.ConsoleCapture) {
+	stages, err := periodic.ReadStages(*stagesFlag)
+	if err != nil {
+		usageErr("Error reading -stages: ", err)
+	}
+	res, err := periodic.RunStages(&ro, stages, func(so *periodic.RunnerOptions) (periodic.HasRunnerResult, error) {
+		r, err := runLoad(url, httpOpts, *so)
+		if err == nil {
+			r.Result().Metadata.Flags = periodic.FlagValues(flag.CommandLine)
+		}
+		return r, err
+	})
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "Aborting because of %v\n", err)
+		os.Exit(1)
+	}
+	results := make([]*periodic.RunnerResults, 0, len(res.Stages))
+	stageResults := make([]periodic.HasRunnerResult, 0, len(res.Stages))
+	for _, s := range res.Stages {
+		results = append(results, s.Result.Result())
+		stageResults = append(stageResults, s.Result)
+	}
+	passed := checkAssertions(stageResults, out)
+	saveJSON(res, res.ID(), out)
+	saveCSV(results, ro.Percentiles, out)
+	pushResults(results, out)
+	exportRunSummaries(results, out)
+	saveJUnit(stageResults, out)
+	if len(results) > 0 {
+		saveBundle(res, res.ID(), results[0], console, out)
+	}
+	exitOnFailedAssertions(passed)
+}
+
+// runnerOptions returns the load runner options from the flags.
+func runnerOptions(url string, qps float64, percList []float64, out io.Writer) periodic.RunnerOptions {
 	labels := *labelsFlag
 	if labels == "" {
 		hname, _ := os.Hostname()
+		url := periodic.Redact(url) // no credentials in the labels (and the result file names)
 		shortURL := url
 		for _, p := range []string{"https://", "http://"} {
 			if strings.HasPrefix(url, p) {
@@ -378,6 +917,12 @@ func fortioLoad(justCurl bool, percList []float64) {
 		labels = shortURL + " , " + strings.SplitN(hname, ".", 2)[0]
 		log.LogVf("Generated Labels: %s", labels)
 	}
+	if _, err := periodic.ParseSLOs(*sloFlag); err != nil {
+		usageErr("Error: ", err)
+	}
+	if _, err := periodic.ParseSLOs(*assertFlag); err != nil {
+		usageErr("Error: -assert ", err)
+	}
 	ro := periodic.RunnerOptions{
 		QPS:         qps,
 		Duration:    *durationFlag,
@@ -391,94 +936,677 @@ func fortioLoad(justCurl bool, percList []float64) {
 		RunID:       *bincommon.RunIDFlag,
 		Offset:      *offsetFlag,
 	}
-	var res periodic.HasRunnerResult
+	ro.ExactPercentiles = *exactPercFlag
+	histogramType, err := stats.ParseHistogramType(*histogramTypeFlag)
+	if err != nil {
+		usageErr("Error: -histogram-type", err)
+	}
+	ro.HistogramType = histogramType
+	ro.ThinkCalls = *burstFlag
+	ro.Dwell = *dwellFlag
+	ro.BurstSize = *burstSizeFlag
+	ro.BurstInterval = *burstIntervalFlag
+	ro.WarmupDuration = *warmupDurationFlag
+	ro.WarmupCalls = *warmupCallsFlag
+	ro.ConcurrencyOnly = *concurrencyOnlyFlag
+	ro.ScheduledLatency = *scheduledLatencyFlag
+	ro.TimeseriesInterval = *timeseriesFlag
+	if *streamSamplesFlag != "" {
+		ro.Samples = sampleWriter(*streamSamplesFlag)
+	}
+	if *arrivalFlag != periodic.ArrivalUniform && *arrivalFlag != periodic.ArrivalPoisson {
+		usageErr("Error: -arrival should be uniform or poisson, not", *arrivalFlag)
+	}
+	ro.Arrival = *arrivalFlag
+	if *qpsScheduleFlag != "" {
+		schedule, err := periodic.ParseQPSSchedule(*qpsScheduleFlag)
+		if err != nil {
+			usageErr("Error parsing -qps-schedule: ", err)
+		}
+		ro.Schedule = schedule
+	}
+	if *loadShapeFlag != "" {
+		if *qpsScheduleFlag != "" {
+			usageErr("Error: -load-shape and -qps-schedule are mutually exclusive")
+		}
+		schedule, err := periodic.ParseLoadShape(*loadShapeFlag, *durationFlag)
+		if err != nil {
+			usageErr("Error parsing -load-shape: ", err)
+		}
+		ro.Schedule = schedule
+	}
+	weights, err := periodic.ParseThreadWeights(*threadWeightsFlag)
+	if err != nil {
+		usageErr("Error parsing -thread-weights: ", err)
+	}
+	ro.ThreadWeights = weights
+	if *checkpointFlag > 0 {
+		ro.CheckpointInterval = *checkpointFlag
+		ro.OnCheckpoint = saveCheckpoint(out)
+	}
+	if *intervalResultsFlag > 0 {
+		if *checkpointFlag > 0 && *checkpointFlag != *intervalResultsFlag {
+			usageErr("Error: -interval-results and -checkpoint-interval should be the same when both are set")
+		}
+		ro.CheckpointInterval = *intervalResultsFlag
+		ro.OnCheckpoint = intervalResults(ro.OnCheckpoint, *intervalResultsJSONFlag, out)
+	}
+	if pusher := statsPusher(); pusher != nil {
+		interval := *pushStatsIntervalFlag
+		switch {
+		case ro.CheckpointInterval > 0 && interval > 0 && interval != ro.CheckpointInterval:
+			usageErr("Error: -push-stats-interval should be the same as -checkpoint-interval/-interval-results when set")
+		case ro.CheckpointInterval > 0:
+			interval = ro.CheckpointInterval
+		case interval <= 0:
+			interval = 10 * time.Second
+		}
+		ro.CheckpointInterval = interval
+		ro.OnCheckpoint = pushCheckpoint(pusher, ro.OnCheckpoint)
+	}
+	return ro
+}
+
+// samplesFile is the -stream-samples file, closed once the command is done (the
+// runs write out their samples when they end, see periodic.SampleWriter.Close).
+var samplesFile *os.File
+
+// sampleWriter returns the -stream-samples writer to stdout for "-" or else to the (truncated) file.
+func sampleWriter(fileName string) *periodic.SampleWriter {
+	if fileName == "-" {
+		return periodic.NewSampleWriter(os.Stdout)
+	}
+	f, err := os.Create(fileName)
+	if err != nil {
+		usageErr("Error creating -stream-samples file: ", err)
+	}
+	samplesFile = f
+	return periodic.NewSampleWriter(f)
+}
+
+// httpRunnerOptions returns the http load options from the flags.
+func httpRunnerOptions(httpOpts *fhttp.HTTPOptions, ro periodic.RunnerOptions) fhttp.HTTPRunnerOptions {
+	o := fhttp.HTTPRunnerOptions{
+		HTTPOptions:        *httpOpts,
+		RunnerOptions:      ro,
+		Profiler:           *profileFlag,
+		AllowInitialErrors: *allowInitialErrorsFlag,
+		AbortOn:            *abortOnFlag,
+		OTLPEndpoint:       *otlpEndpointFlag,
+		OTLPSampleRate:     *otlpSampleFlag,
+	}
+	o.Retry.Retries = *retriesFlag
+	o.Retry.Backoff = *retryBackoffFlag
+	o.CertReloadInterval = *certReloadFlag
+	o.CertReloadOnSignal = *certReloadSighupFlag
+	o.CacheStats = *cacheStatsFlag
+	o.ReconnectBackoff = *reconnectBackoffFlag
+	o.PreCheck.Requests = *preCheckFlag
+	o.PreCheck.ExpectedStatus = *preCheckStatusFlag
+	o.PreCheck.MaxLatency = *preCheckMaxLatencyFlag
 	var err error
-	if *grpcFlag {
-		o := fgrpc.GRPCRunnerOptions{
-			RunnerOptions:      ro,
-			Destination:        url,
-			CACert:             *bincommon.CACertFlag,
-			Insecure:           bincommon.TLSInsecure(),
-			Service:            *healthSvcFlag,
-			Streams:            *streamsFlag,
-			AllowInitialErrors: *allowInitialErrorsFlag,
-			Payload:            httpOpts.PayloadString(),
-			Delay:              *pingDelayFlag,
-			UsePing:            *doPingLoadFlag,
-			UnixDomainSocket:   httpOpts.UnixDomainSocket,
+	if o.Retry.RetryOn, err = fhttp.ParseRetryOn(*retryOnFlag); err != nil {
+		usageErr("Error: ", err)
+	}
+	if o.SizeClasses, err = fhttp.ParseSizeClasses(*sizeClassesFlag); err != nil {
+		usageErr("Error: ", err)
+	}
+	return o
+}
+
+// saveJSON writes the results to the -json file (or stdout) or, with -a, to
+// the data dir as id.json.
+func saveJSON(res interface{}, id string, out io.Writer) {
+	jsonFileName := *jsonFlag
+	if !*autoSaveFlag && len(jsonFileName) == 0 {
+		return
+	}
+	if len(jsonFileName) == 0 {
+		jsonFileName = path.Join(*dataDirFlag, id+".json")
+	}
+	if err := writeJSON(res, jsonFileName, out); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+// saveCSV writes the results' csv rows to the -csv file (or stdout), with
+// the header unless appending to an existing non empty file.
+func saveCSV(results []*periodic.RunnerResults, percList []float64, out io.Writer) {
+	csvFileName := *csvFlag
+	if csvFileName == "" {
+		return
+	}
+	if err := writeCSV(results, percList, csvFileName, out); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+// writeCSV appends the results' csv rows to the file, or stdout for "-".
+func writeCSV(results []*periodic.RunnerResults, percList []float64, csvFileName string, out io.Writer) error {
+	if csvFileName == "-" {
+		return periodic.WriteCSV(os.Stdout, results, percList, *csvBucketsFlag, true)
+	}
+	f, err := os.OpenFile(csvFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %w", csvFileName, err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("unable to stat %s: %w", csvFileName, err)
+	}
+	if err = periodic.WriteCSV(f, results, percList, *csvBucketsFlag, fi.Size() == 0); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("unable to write csv to %s: %w", csvFileName, err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("close error for %s: %w", csvFileName, err)
+	}
+	_, _ = fmt.Fprintf(out, "Successfully wrote %d csv results to %s\n", len(results), csvFileName)
+	return nil
+}
+
+// saveHgrm writes the results' latency histogram in milliseconds to the
+// -hgrm file (or stdout), in HdrHistogram percentile distribution format.
+func saveHgrm(rr *periodic.RunnerResults, out io.Writer) {
+	fileName := *hgrmFlag
+	if fileName == "" {
+		return
+	}
+	if fileName == "-" {
+		if err := rr.DurationHistogram.WriteHgrm(os.Stdout, 1000.); err != nil {
+			log.Fatalf("Unable to write hgrm to stdout: %v", err)
 		}
-		res, err = fgrpc.RunGRPCTest(&o)
-	} else if strings.HasPrefix(url, tcprunner.TCPURLPrefix) {
-		o := tcprunner.RunnerOptions{
-			RunnerOptions: ro,
+		return
+	}
+	f, err := os.Create(fileName)
+	if err != nil {
+		log.Fatalf("Unable to create %s: %v", fileName, err)
+	}
+	if err = rr.DurationHistogram.WriteHgrm(f, 1000.); err != nil {
+		log.Fatalf("Unable to write hgrm to %s: %v", fileName, err)
+	}
+	if err = f.Close(); err != nil {
+		log.Fatalf("Close error for %s: %v", fileName, err)
+	}
+	_, _ = fmt.Fprintf(out, "Successfully wrote the latency histogram in hgrm format to %s\n", fileName)
+}
+
+// saveJUnit writes the -junit report of the results against the -slo thresholds.
+func saveJUnit(results []periodic.HasRunnerResult, out io.Writer) {
+	fileName := *junitFlag
+	if fileName == "" {
+		return
+	}
+	slos, _ := periodic.ParseSLOs(*sloFlag) // already validated by runnerOptions
+	f, err := os.Create(fileName)
+	if err != nil {
+		log.Fatalf("Unable to create %s: %v", fileName, err)
+	}
+	failures, err := periodic.WriteJUnit(f, results, slos)
+	if err != nil {
+		log.Fatalf("Unable to write the junit report to %s: %v", fileName, err)
+	}
+	if err = f.Close(); err != nil {
+		log.Fatalf("Close error for %s: %v", fileName, err)
+	}
+	_, _ = fmt.Fprintf(out, "Successfully wrote the junit report (%d failed slo checks) to %s\n", failures, fileName)
+}
+
+// assertFailedExitCode is the exit status when -assert thresholds aren't met,
+// distinct from the errors' 1.
+const assertFailedExitCode = 2
+
+// checkAssertions checks the -assert thresholds against each result, recording
+// its verdict before it's saved, and returns false when any isn't met.
+func checkAssertions(results []periodic.HasRunnerResult, out io.Writer) bool {
+	if *assertFlag == "" {
+		return true
+	}
+	slos, _ := periodic.ParseSLOs(*assertFlag) // already validated by runnerOptions
+	passed := true
+	for _, r := range results {
+		v := periodic.Assert(slos, r)
+		v.Print(out, r.Result().ID())
+		passed = passed && v.Passed
+	}
+	return passed
+}
+
+// exitOnFailedAssertions exits with assertFailedExitCode unless the assertions passed.
+func exitOnFailedAssertions(passed bool) {
+	if !passed {
+		os.Exit(assertFailedExitCode)
+	}
+}
+
+// consoleOutput returns the console (stderr) writer of the run and, with
+// -bundle, its capture, which the logs are also sent to.
+func consoleOutput() (io.Writer, *periodic.ConsoleCapture) {
+	if !*bundleFlag {
+		return os.Stderr, nil
+	}
+	console := periodic.NewConsoleCapture(os.Stderr)
+	log.SetOutput(console)
+	return console, console
+}
+
+// saveBundle writes the -bundle of the run to the data dir as id_bundle.tar.gz
+// (next to the -a id.json), rr being the (first) result whose metadata to include.
+func saveBundle(res interface{}, id string, rr *periodic.RunnerResults, console *periodic.ConsoleCapture, out io.Writer) {
+	if !*bundleFlag {
+		return
+	}
+	fileName := path.Join(*dataDirFlag, id+periodic.BundleSuffix)
+	f, err := os.Create(fileName)
+	if err != nil {
+		log.Fatalf("Unable to create %s: %v", fileName, err)
+	}
+	bundle := periodic.Bundle{Results: res, Metadata: rr.Metadata, Console: console, Secrets: periodic.SecretValues(flag.CommandLine)}
+	if err = periodic.WriteBundle(f, &bundle); err != nil {
+		log.Fatalf("Unable to write the bundle %s: %v", fileName, err)
+	}
+	if err = f.Close(); err != nil {
+		log.Fatalf("Close error for %s: %v", fileName, err)
+	}
+	_, _ = fmt.Fprintf(out, "Successfully wrote the run bundle to %s\n", fileName)
+}
+
+// saveCheckpoint writes the checkpoint next to where the final results go:
+// the -json file name with a _checkpointN suffix (or stdout), or else the data dir.
+func saveCheckpoint(out io.Writer) func(*periodic.Checkpoint) {
+	return func(c *periodic.Checkpoint) {
+		jsonFileName := *jsonFlag
+		switch jsonFileName {
+		case "-":
+		case "":
+			jsonFileName = path.Join(*dataDirFlag, c.ID()+".json")
+		default:
+			jsonFileName = fmt.Sprintf("%s_checkpoint%d.json", strings.TrimSuffix(jsonFileName, ".json"), c.Index)
 		}
-		o.ReqTimeout = httpOpts.HTTPReqTimeOut
-		o.Destination = url
-		o.Payload = httpOpts.Payload
-		res, err = tcprunner.RunTCPTest(&o)
-	} else if strings.HasPrefix(url, udprunner.UDPURLPrefix) {
-		o := udprunner.RunnerOptions{
-			RunnerOptions: ro,
+		if err := writeJSON(c, jsonFileName, out); err != nil {
+			log.Errf("Checkpoint %d not saved: %v", c.Index, err)
 		}
-		o.ReqTimeout = *udpTimeoutFlag
-		o.Destination = url
-		o.Payload = httpOpts.Payload
-		res, err = udprunner.RunUDPTest(&o)
+	}
+}
+
+// exportRunSummaries exports the runs' summary metrics to the -otlp-endpoint, if set.
+func exportRunSummaries(results []*periodic.RunnerResults, out io.Writer) {
+	endpoint := *otlpEndpointFlag
+	if endpoint == "" {
+		return
+	}
+	for _, rr := range results {
+		if err := otlp.ExportRunSummary(endpoint, "fortio", runSummary(rr)); err != nil {
+			log.Errf("Run summary not exported: %v", err)
+			return
+		}
+	}
+	_, _ = fmt.Fprintf(out, "Successfully exported %d run summary metrics to %s\n", len(results), endpoint)
+}
+
+// runSummary returns the otlp run summary of the results.
+func runSummary(rr *periodic.RunnerResults) *otlp.RunSummary {
+	s := otlp.RunSummary{
+		Start: rr.StartTime,
+		End:   rr.StartTime.Add(rr.ActualDuration),
+		QPS:   rr.ActualQPS,
+		Attributes: map[string]interface{}{
+			"fortio.run_type":    rr.RunType,
+			"fortio.labels":      rr.Labels,
+			"fortio.num_threads": rr.NumThreads,
+			"fortio.run_id":      rr.RunID,
+		},
+	}
+	if h := rr.DurationHistogram; h != nil && h.Count > 0 {
+		s.Count = h.Count
+		s.Sum = h.Sum
+		s.Quantiles = append(s.Quantiles, otlp.Quantile{Quantile: 0, Value: h.Min})
+		for _, p := range h.Percentiles {
+			s.Quantiles = append(s.Quantiles, otlp.Quantile{Quantile: p.Percentile / 100., Value: p.Value})
+		}
+		s.Quantiles = append(s.Quantiles, otlp.Quantile{Quantile: 1, Value: h.Max})
+	}
+	return &s
+}
+
+// statsPusher returns the -push-stats pusher, nil when not set.
+func statsPusher() *periodic.StatsPusher {
+	if *pushStatsFlag == "" {
+		return nil
+	}
+	pusher, err := periodic.NewStatsPusher(*pushStatsFlag)
+	if err != nil {
+		usageErr("Error: -push-stats: ", err)
+	}
+	return pusher
+}
+
+// pushCheckpoint returns the checkpoint callback pushing the interim stats
+// before calling next, if any.
+func pushCheckpoint(pusher *periodic.StatsPusher, next func(*periodic.Checkpoint)) func(*periodic.Checkpoint) {
+	return func(c *periodic.Checkpoint) {
+		if err := pusher.PushCheckpoint(c); err != nil {
+			log.Errf("Interval %d stats not pushed: %v", c.Index, err)
+		}
+		if next != nil {
+			next(c)
+		}
+	}
+}
+
+// pushResults pushes the final stats of the runs to -push-stats, if set.
+func pushResults(results []*periodic.RunnerResults, out io.Writer) {
+	pusher := statsPusher()
+	if pusher == nil {
+		return
+	}
+	for _, rr := range results {
+		if err := pusher.PushResults(rr); err != nil {
+			log.Errf("Stats not pushed: %v", err)
+			return
+		}
+	}
+	_, _ = fmt.Fprintf(out, "Successfully pushed %d results stats to %s\n", len(results), *pushStatsFlag)
+}
+
+// intervalResults prints the summary of each checkpoint to out and appends it
+// to the jsonFileName (unless empty) as one line of json, before calling next
+// (unless nil).
+func intervalResults(next func(*periodic.Checkpoint), jsonFileName string, out io.Writer) func(*periodic.Checkpoint) {
+	return func(c *periodic.Checkpoint) {
+		_, _ = fmt.Fprintln(out, c.Summary())
+		if jsonFileName != "" {
+			if err := appendJSONLine(c, jsonFileName); err != nil {
+				log.Errf("Interval %d results not saved: %v", c.Index, err)
+			}
+		}
+		if next != nil {
+			next(c)
+		}
+	}
+}
+
+// appendJSONLine appends res as a single line of json to the file.
+func appendJSONLine(res interface{}, jsonFileName string) error {
+	j, err := json.Marshal(res)
+	if err != nil {
+		return fmt.Errorf("unable to json serialize result: %w", err)
+	}
+	f, err := os.OpenFile(jsonFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %w", jsonFileName, err)
+	}
+	if _, err = f.Write(append(j, '\n')); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("unable to write json to %s: %w", jsonFileName, err)
+	}
+	return f.Close()
+}
+
+// writeJSON writes res as indented json to the file, or stdout for "-".
+func writeJSON(res interface{}, jsonFileName string, out io.Writer) error {
+	j, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to json serialize result: %w", err)
+	}
+	var f *os.File
+	if jsonFileName == "-" {
+		f = os.Stdout
+		jsonFileName = "stdout"
 	} else {
-		o := fhttp.HTTPRunnerOptions{
-			HTTPOptions:        *httpOpts,
-			RunnerOptions:      ro,
-			Profiler:           *profileFlag,
-			AllowInitialErrors: *allowInitialErrorsFlag,
-			AbortOn:            *abortOnFlag,
+		f, err = os.Create(jsonFileName)
+		if err != nil {
+			return fmt.Errorf("unable to create %s: %w", jsonFileName, err)
+		}
+	}
+	n, err := f.Write(append(j, '\n'))
+	if err != nil {
+		return fmt.Errorf("unable to write json to %s: %w", jsonFileName, err)
+	}
+	if f != os.Stdout {
+		err := f.Close()
+		if err != nil {
+			return fmt.Errorf("close error for %s: %w", jsonFileName, err)
+		}
+	}
+	_, _ = fmt.Fprintf(out, "Successfully wrote %d bytes of Json data to %s\n", n, jsonFileName)
+	return nil
+}
+
+// fortioCapacity runs the http capacity (ramp to failure) test.
+func fortioCapacity(percList []float64) {
+	if len(flag.Args()) != 1 {
+		usageErr("Error: fortio capacity needs a url")
+	}
+	httpOpts := bincommon.SharedHTTPOptions()
+	url := httpOpts.URL
+	checkMemoryLimit(*numThreadsFlag)
+	prevGoMaxProcs := runtime.GOMAXPROCS(*goMaxProcsFlag)
+	out := os.Stderr
+	qps, search := qpsFlag.qps, *capacitySearchFlag
+	if qpsFlag.auto {
+		qps, search = autoStartQPS, true
+	}
+	mode := "test"
+	if search {
+		mode = "search"
+	}
+	_, _ = fmt.Fprintf(out, "Fortio %s capacity %s from %g queries per second, %v per step, %d->%d procs: %s\n",
+		version.Short(), mode, qps, *durationFlag, prevGoMaxProcs, runtime.GOMAXPROCS(0), url)
+	o := fhttp.CapacityOptions{
+		HTTPRunnerOptions: httpRunnerOptions(httpOpts, runnerOptions(url, qps, percList, out)),
+		StepQPS:           *capacityStepFlag,
+		MaxQPS:            *capacityMaxFlag,
+		MaxErrorRate:      *capacityErrorsFlag,
+		LatencyPercentile: *capacityPercentileFlag,
+		MaxLatency:        *capacityLatencyFlag,
+		KneeFactor:        *capacityKneeFlag,
+		Search:            search,
+	}
+	res, err := fhttp.RunCapacityTest(&o)
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "Aborting because of %v\n", err)
+		os.Exit(1)
+	}
+	saveJSON(res, res.ID(), out)
+}
+
+// fortioSweep runs the load test for each cell of the -sweep-* matrix, saving
+// each cell's result in the data dir and the matrix summary like -a (or -json).
+func fortioSweep(percList []float64) {
+	if len(flag.Args()) != 1 {
+		usageErr("Error: fortio sweep needs a url or destination")
+	}
+	m, err := periodic.ParseSweepMatrix(*sweepSizesFlag, *sweepQPSFlag, *sweepConnectionsFlag)
+	if err != nil {
+		usageErr("Error: ", err)
+	}
+	if *durationFlag <= 0 && *exactlyFlag <= 0 {
+		usageErr("Error: fortio sweep needs a positive -t duration (or -n calls) per cell")
+	}
+	httpOpts := bincommon.SharedHTTPOptions()
+	url := httpOpts.URL
+	maxThreads := *numThreadsFlag
+	for _, n := range m.NumThreads {
+		if n > maxThreads {
+			maxThreads = n
+		}
+	}
+	checkMemoryLimit(maxThreads)
+	prevGoMaxProcs := runtime.GOMAXPROCS(*goMaxProcsFlag)
+	out, console := consoleOutput()
+	qps := qpsFlag.qps
+	if qps <= 0 {
+		qps = -1
+	}
+	ro := runnerOptions(url, qps, percList, out)
+	cells := len(m.Cells(&ro))
+	_, _ = fmt.Fprintf(out, "Fortio %s sweeping %d cells, %d->%d procs: %s\n",
+		version.Short(), cells, prevGoMaxProcs, runtime.GOMAXPROCS(0), url)
+	res, err := periodic.RunSweep(&ro, m, func(so *periodic.RunnerOptions, c *periodic.SweepCell) (periodic.HasRunnerResult, error) {
+		o := *httpOpts // copy
+		if c.PayloadSize >= 0 {
+			o.Payload = fnet.GenerateRandomPayload(c.PayloadSize)
+		}
+		r, err := runLoad(url, &o, *so)
+		if err == nil {
+			r.Result().Metadata.Flags = periodic.FlagValues(flag.CommandLine)
+		}
+		return r, err
+	})
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "Aborting because of %v\n", err)
+		os.Exit(1)
+	}
+	results := make([]*periodic.RunnerResults, 0, len(res.Cells))
+	cellResults := make([]periodic.HasRunnerResult, 0, len(res.Cells))
+	passed := true
+	for _, c := range res.Cells {
+		passed = checkAssertions([]periodic.HasRunnerResult{c.Result}, out) && passed
+		if err = writeJSON(c.Result, path.Join(*dataDirFlag, c.ResultID+".json"), out); err != nil {
+			log.Fatalf("%v", err)
 		}
-		res, err = fhttp.RunHTTPTest(&o)
+		results = append(results, c.Result.Result())
+		cellResults = append(cellResults, c.Result)
+	}
+	summaryFileName := *jsonFlag
+	if summaryFileName == "" {
+		summaryFileName = path.Join(*dataDirFlag, res.ID()+".json")
+	}
+	if err = writeJSON(res, summaryFileName, out); err != nil {
+		log.Fatalf("%v", err)
+	}
+	saveCSV(results, ro.Percentiles, out)
+	pushResults(results, out)
+	exportRunSummaries(results, out)
+	saveJUnit(cellResults, out)
+	if len(results) > 0 {
+		saveBundle(res, res.ID(), results[0], console, out)
+	}
+	exitOnFailedAssertions(passed)
+}
+
+// fortioCalibrate runs the http load generator against its own in-process echo
+// server, at max qps for the standard numbers of connections, to report this
+// machine's generator capacity baseline.
+func fortioCalibrate(percList []float64) {
+	if len(flag.Args()) != 0 {
+		usageErr("Error: fortio calibrate doesn't take a target")
+	}
+	if *durationFlag <= 0 {
+		usageErr("Error: fortio calibrate needs a positive -t duration per step")
 	}
+	httpOpts := bincommon.SharedHTTPOptions()
+	checkMemoryLimit(fhttp.CalibrationConnections[len(fhttp.CalibrationConnections)-1])
+	prevGoMaxProcs := runtime.GOMAXPROCS(*goMaxProcsFlag)
+	out := os.Stderr
+	_, _ = fmt.Fprintf(out, "Fortio %s calibrating with %v connections, %v per step, %d->%d procs\n",
+		version.Short(), fhttp.CalibrationConnections, *durationFlag, prevGoMaxProcs, runtime.GOMAXPROCS(0))
+	ro := runnerOptions("calibrate", -1, percList, out)
+	ro.Exactly = 0
+	o := fhttp.CalibrationOptions{HTTPRunnerOptions: httpRunnerOptions(httpOpts, ro)}
+	res, err := fhttp.RunCalibration(&o)
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "Aborting because of %v\n", err)
+		os.Exit(1)
+	}
+	saveJSON(res, res.ID(), out)
+}
+
+// udpReply returns the udp echo server's default reply from the flags.
+func udpReply() fnet.UDPReply {
+	return fnet.UDPReply{Size: *udpReplySizeFlag, Count: *udpReplyCountFlag, Prefix: *udpReplyPrefixFlag}
+}
+
+// fortioReplay replays the -replay-file requests, with their relative timing, on the target.
+func fortioReplay(percList []float64) {
+	if len(flag.Args()) != 1 {
+		usageErr("Error: fortio replay needs a url")
+	}
+	httpOpts := bincommon.SharedHTTPOptions()
+	if len(httpOpts.Replay) == 0 {
+		usageErr("Error: fortio replay needs a -replay-file")
+	}
+	url := httpOpts.URL
+	checkMemoryLimit(*numThreadsFlag)
+	prevGoMaxProcs := runtime.GOMAXPROCS(*goMaxProcsFlag)
+	out, console := consoleOutput()
+	_, _ = fmt.Fprintf(out, "Fortio %s replaying %d recorded requests at %gx speed, %d->%d procs: %s\n",
+		version.Short(), len(httpOpts.Replay), *replaySpeedFlag, prevGoMaxProcs, runtime.GOMAXPROCS(0), url)
+	o := fhttp.ReplayOptions{
+		HTTPRunnerOptions: httpRunnerOptions(httpOpts, runnerOptions(url, qpsFlag.qps, percList, out)),
+		Speed:             *replaySpeedFlag,
+	}
+	res, err := fhttp.RunReplay(&o)
 	if err != nil {
 		_, _ = fmt.Fprintf(out, "Aborting because of %v\n", err)
 		os.Exit(1)
 	}
 	rr := res.Result()
-	warmup := *numThreadsFlag
-	if ro.Exactly > 0 {
-		warmup = 0
+	rr.Metadata.Flags = periodic.FlagValues(flag.CommandLine)
+	_, _ = fmt.Fprintf(out, "All done %d calls %.3f ms avg, %.1f qps\n",
+		rr.DurationHistogram.Count, 1000.*rr.DurationHistogram.Avg, rr.ActualQPS)
+	passed := checkAssertions([]periodic.HasRunnerResult{res}, out)
+	saveJSON(res, rr.ID(), out)
+	saveCSV([]*periodic.RunnerResults{rr}, percList, out)
+	saveHgrm(rr, out)
+	pushResults([]*periodic.RunnerResults{rr}, out)
+	exportRunSummaries([]*periodic.RunnerResults{rr}, out)
+	saveJUnit([]periodic.HasRunnerResult{res}, out)
+	saveBundle(res, rr.ID(), rr, console, out)
+	exitOnFailedAssertions(passed)
+}
+
+// fortioMerge combines the json results given as arguments, e.g. of the same run
+// from several load generators, into one written to the -o (or -json) file, stdout
+// by default.
+func fortioMerge() {
+	output := *jsonFlag
+	var files []string
+	args := flag.Args()
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-o" && i+1 < len(args) {
+			i++
+			output = args[i]
+			continue
+		}
+		files = append(files, args[i])
 	}
-	_, _ = fmt.Fprintf(out, "All done %d calls (plus %d warmup) %.3f ms avg, %.1f qps\n",
-		rr.DurationHistogram.Count,
-		warmup,
-		1000.*rr.DurationHistogram.Avg,
-		rr.ActualQPS)
-	jsonFileName := *jsonFlag
-	if *autoSaveFlag || len(jsonFileName) > 0 { //nolint: nestif // but probably should breakup this function
-		var j []byte
-		j, err = json.MarshalIndent(res, "", "  ")
+	if len(files) < 2 {
+		usageErr("Error: fortio merge needs at least 2 json results, e.g. fortio merge a.json b.json -o merged.json")
+	}
+	if output == "" {
+		output = "-"
+	}
+	var merged *periodic.MergeableResults
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
 		if err != nil {
-			log.Fatalf("Unable to json serialize result: %v", err)
-		}
-		var f *os.File
-		if jsonFileName == "-" {
-			f = os.Stdout
-			jsonFileName = "stdout"
-		} else {
-			if len(jsonFileName) == 0 {
-				jsonFileName = path.Join(*dataDirFlag, rr.ID()+".json")
-			}
-			f, err = os.Create(jsonFileName)
-			if err != nil {
-				log.Fatalf("Unable to create %s: %v", jsonFileName, err)
-			}
+			log.Fatalf("Unable to read %s: %v", file, err)
 		}
-		n, err := f.Write(append(j, '\n'))
-		if err != nil {
-			log.Fatalf("Unable to write json to %s: %v", jsonFileName, err)
+		var res periodic.MergeableResults
+		if err = json.Unmarshal(data, &res); err != nil {
+			log.Fatalf("Unable to parse the json results of %s: %v", file, err)
 		}
-		if f != os.Stdout {
-			err := f.Close()
-			if err != nil {
-				log.Fatalf("Close error for %s: %v", jsonFileName, err)
-			}
+		if res.DurationHistogram == nil {
+			log.Fatalf("%s isn't a fortio json result (no DurationHistogram)", file)
+		}
+		if merged == nil {
+			merged = &res
+			continue
+		}
+		if merged, err = merged.Merge(&res); err != nil {
+			log.Fatalf("Unable to merge %s: %v", file, err)
 		}
-		_, _ = fmt.Fprintf(out, "Successfully wrote %d bytes of Json data to %s\n", n, jsonFileName)
+	}
+	out := os.Stderr
+	h := merged.DurationHistogram
+	_, _ = fmt.Fprintf(out, "Merged %d %s results: %d calls %.3f ms avg, %.1f qps over %v with %d connections\n",
+		len(files), merged.RunType, h.Count, 1000.*h.Avg, merged.ActualQPS, merged.ActualDuration, merged.NumThreads)
+	h.PrintPercentiles(out)
+	if err := writeJSON(merged, output, out); err != nil {
+		log.Fatalf("%v", err)
 	}
 }
 
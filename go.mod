@@ -7,6 +7,7 @@ require (
 	github.com/golang/protobuf v1.5.2
 	github.com/google/uuid v1.2.0
 	github.com/stretchr/testify v1.7.0
-	golang.org/x/net v0.0.0-20210503060351-7fd8e65b6420
+	golang.org/x/net v0.17.0
 	google.golang.org/grpc v1.37.0
+	google.golang.org/protobuf v1.26.0
 )
@@ -0,0 +1,319 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package icmprunner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"fortio.org/fortio/fnet"
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/periodic"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var ICMPTimeOutDefaultValue = time.Second
+
+type ICMPResultMap map[string]int64
+
+// RunnerResults is the aggregated result of an ICMPRunner.
+// Also is the internal type used per thread/goroutine.
+type RunnerResults struct {
+	periodic.RunnerResults
+	ICMPOptions
+	RetCodes ICMPResultMap
+	// Raw icmp sockets were used (requires privileges), otherwise the unprivileged
+	// "udp" ping sockets (linux with net.ipv4.ping_group_range, macOS).
+	Privileged bool
+	client     *ICMPClient
+}
+
+// ErrorRate returns the fraction of the calls which weren't OK (see periodic.HasErrorRate).
+func (icmpstate *RunnerResults) ErrorRate() float64 {
+	return periodic.ErrorRate(icmpstate.RetCodes, ICMPStatusOK)
+}
+
+// Run sends an echo request and waits for its reply. Main call being run at
+// the target QPS. To be set as the Function in RunnerOptions.
+func (icmpstate *RunnerResults) Run(t int) {
+	log.Debugf("Calling in %d", t)
+	err := icmpstate.client.Ping()
+	if err != nil {
+		icmpstate.RetCodes[err.Error()]++
+	} else {
+		icmpstate.RetCodes[ICMPStatusOK]++
+	}
+}
+
+// Warmup makes a warmup call, not counted in the results (see periodic.Warmer).
+func (icmpstate *RunnerResults) Warmup(t int) {
+	err := icmpstate.client.Ping()
+	log.Debugf("Warmup call in %d: %v", t, err)
+}
+
+// ICMPOptions are options to the ICMPClient.
+type ICMPOptions struct {
+	Destination string // icmp://host
+	Payload     []byte // echo data, DefaultPayloadSize random bytes if empty
+	ReqTimeout  time.Duration
+}
+
+// RunnerOptions includes the base RunnerOptions plus icmp specific
+// options.
+type RunnerOptions struct {
+	periodic.RunnerOptions
+	ICMPOptions
+}
+
+// ICMPClient is the client used for icmp echo (ping) testing.
+type ICMPClient struct {
+	buffer      []byte
+	req         []byte
+	data        []byte
+	conn        *icmp.PacketConn
+	dest        net.Addr
+	ipv6        bool
+	privileged  bool
+	id          int // only used (and checked) for raw sockets, the kernel sets it otherwise
+	seq         int
+	destination string
+	reqTimeout  time.Duration
+}
+
+const (
+	// DefaultPayloadSize is the echo data size when no payload is given (same as ping's).
+	DefaultPayloadSize = 56
+	protocolICMP       = 1
+	protocolIPv6ICMP   = 58
+)
+
+var (
+	// ICMPURLPrefix is the URL prefix for triggering icmp load.
+	ICMPURLPrefix = "icmp://"
+	// ICMPStatusOK is the map key on success.
+	ICMPStatusOK = "OK"
+	errTimeout   = fmt.Errorf("timeout")
+	errMismatch  = fmt.Errorf("reply not echoing the request data")
+)
+
+// listen opens a raw icmp socket, or an unprivileged udp one if that fails,
+// returning which one was opened.
+func listen(ipv6 bool) (*icmp.PacketConn, bool, error) {
+	network, udpNetwork, addr := "ip4:icmp", "udp4", "0.0.0.0"
+	if ipv6 {
+		network, udpNetwork, addr = "ip6:ipv6-icmp", "udp6", "::"
+	}
+	conn, err := icmp.ListenPacket(network, addr)
+	if err == nil {
+		return conn, true, nil
+	}
+	log.LogVf("Raw icmp socket unavailable (%v), trying unprivileged udp ping socket", err)
+	conn, err = icmp.ListenPacket(udpNetwork, addr)
+	return conn, false, err
+}
+
+// NewICMPClient creates and initialize and returns a client based on the ICMPOptions.
+func NewICMPClient(o *ICMPOptions, connID int) (*ICMPClient, error) {
+	c := ICMPClient{}
+	c.destination = o.Destination
+	u, err := url.Parse(o.Destination)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "icmp" || u.Hostname() == "" {
+		return nil, fmt.Errorf("expecting icmp://host destination, got %q", o.Destination)
+	}
+	tAddr, err := fnet.Resolve(u.Hostname(), "0")
+	if tAddr == nil {
+		return nil, err
+	}
+	c.ipv6 = tAddr.IP.To4() == nil
+	c.conn, c.privileged, err = listen(c.ipv6)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open an icmp socket (raw nor udp): %w", err)
+	}
+	if c.privileged {
+		c.dest = &net.IPAddr{IP: tAddr.IP}
+	} else {
+		c.dest = &net.UDPAddr{IP: tAddr.IP}
+	}
+	c.id = (os.Getpid() + connID) & 0xffff
+	c.data = o.Payload
+	if len(c.data) == 0 {
+		c.data = fnet.GenerateRandomPayload(DefaultPayloadSize)
+	}
+	c.buffer = make([]byte, 1500+len(c.data))
+	c.reqTimeout = o.ReqTimeout
+	if o.ReqTimeout == 0 {
+		log.Debugf("Request timeout not set, using default %v", ICMPTimeOutDefaultValue)
+		c.reqTimeout = ICMPTimeOutDefaultValue
+	}
+	if c.reqTimeout < 0 {
+		log.Warnf("Invalid timeout %v, setting to %v", c.reqTimeout, ICMPTimeOutDefaultValue)
+		c.reqTimeout = ICMPTimeOutDefaultValue
+	}
+	return &c, nil
+}
+
+// Ping sends an echo request and waits for the matching echo reply, or an
+// icmp error (destination unreachable, time exceeded,...) about it (raw
+// sockets only).
+func (c *ICMPClient) Ping() error {
+	c.seq = (c.seq + 1) & 0xffff
+	var typ icmp.Type = ipv4.ICMPTypeEcho
+	if c.ipv6 {
+		typ = ipv6.ICMPTypeEchoRequest
+	}
+	msg := icmp.Message{Type: typ, Body: &icmp.Echo{ID: c.id, Seq: c.seq, Data: c.data}}
+	var err error
+	c.req, err = msg.Marshal(nil) // the kernel computes the ipv6 checksum
+	if err != nil {
+		return err
+	}
+	if err = c.conn.SetReadDeadline(time.Now().Add(c.reqTimeout)); err != nil {
+		return err
+	}
+	if _, err = c.conn.WriteTo(c.req, c.dest); err != nil {
+		log.Errf("Unable to send icmp echo to %v : %v", c.dest, err)
+		return err
+	}
+	proto := protocolICMP
+	if c.ipv6 {
+		proto = protocolIPv6ICMP
+	}
+	for {
+		n, _, err := c.conn.ReadFrom(c.buffer)
+		if err != nil {
+			if os.IsTimeout(err) {
+				return errTimeout
+			}
+			return err
+		}
+		reply, err := icmp.ParseMessage(proto, c.buffer[:n])
+		if err != nil {
+			log.Debugf("Skipping unparsable icmp message: %v", err)
+			continue
+		}
+		switch body := reply.Body.(type) {
+		case *icmp.Echo:
+			if (reply.Type != ipv4.ICMPTypeEchoReply && reply.Type != ipv6.ICMPTypeEchoReply) || !c.ours(body.ID, body.Seq) {
+				continue // stale reply, or the one of another raw socket's request
+			}
+			if !bytes.Equal(body.Data, c.data) {
+				return errMismatch
+			}
+			return nil
+		case *icmp.DstUnreach:
+			if c.quotesRequest(body.Data) {
+				return fmt.Errorf("%v", reply.Type)
+			}
+		case *icmp.TimeExceeded:
+			if c.quotesRequest(body.Data) {
+				return fmt.Errorf("%v", reply.Type)
+			}
+		}
+		log.Debugf("Skipping icmp %v message", reply.Type)
+	}
+}
+
+// ours returns true if id and seq are the ones of the current request.
+func (c *ICMPClient) ours(id, seq int) bool {
+	return seq == c.seq && (!c.privileged || id == c.id)
+}
+
+// quotesRequest returns true if the data of an icmp error, the start of the
+// datagram it is about, is our current echo request.
+func (c *ICMPClient) quotesRequest(data []byte) bool {
+	hdrLen := ipv6.HeaderLen
+	if !c.ipv6 {
+		if len(data) == 0 {
+			return false
+		}
+		hdrLen = int(data[0]&0x0f) * 4
+	}
+	if len(data) < hdrLen+8 {
+		return false
+	}
+	echo := data[hdrLen:]
+	return c.ours(int(binary.BigEndian.Uint16(echo[4:])), int(binary.BigEndian.Uint16(echo[6:])))
+}
+
+// Close closes the icmp socket.
+func (c *ICMPClient) Close() {
+	log.Debugf("Closing %p: %s", c, c.destination)
+	if err := c.conn.Close(); err != nil {
+		log.Warnf("Error closing icmp client's socket: %v", err)
+	}
+}
+
+// RunICMPTest runs an icmp echo (ping) test and returns the aggregated stats.
+func RunICMPTest(o *RunnerOptions) (*RunnerResults, error) {
+	o.RunType = "ICMP"
+	log.Infof("Starting icmp test for %s with %d threads at %.1f qps", o.Destination, o.NumThreads, o.QPS)
+	r := periodic.NewPeriodicRunner(&o.RunnerOptions)
+	defer r.Options().Abort()
+	numThreads := r.Options().NumThreads
+	out := r.Options().Out // Important as the default value is set from nil to stdout inside NewPeriodicRunner
+	total := RunnerResults{
+		ICMPOptions: o.ICMPOptions,
+		RetCodes:    make(ICMPResultMap),
+	}
+	icmpstate := make([]RunnerResults, numThreads)
+	err := periodic.SetupThreads(r, func(i int, firstCall bool) (periodic.Runnable, error) {
+		// Create a client (and socket) for each 'thread'
+		client, err := NewICMPClient(&o.ICMPOptions, i)
+		if client == nil {
+			for j := 0; j < i; j++ {
+				icmpstate[j].client.Close()
+			}
+			return nil, fmt.Errorf("unable to create client %d for %s: %w", i, o.Destination, err)
+		}
+		if firstCall {
+			err := client.Ping()
+			if i == 0 && log.LogVerbose() {
+				log.LogVf("first ping of %s: err %v", o.Destination, err)
+			}
+		}
+		// Setup the stats for each 'thread'
+		icmpstate[i].client = client
+		icmpstate[i].RetCodes = make(ICMPResultMap)
+		return &icmpstate[i], nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	total.Privileged = icmpstate[0].client.privileged
+	total.RunnerResults = r.Run()
+	periodic.MergeThreads(r, numThreads, total.RetCodes, func(i int) map[string]int64 {
+		c := icmpstate[i].client
+		total.Metadata.AddConnection(c.conn.LocalAddr(), c.dest, nil)
+		c.Close()
+		return icmpstate[i].RetCodes
+	})
+	kind := "unprivileged udp"
+	if total.Privileged {
+		kind = "raw"
+	}
+	_, _ = fmt.Fprintf(out, "Using %s icmp sockets\n", kind)
+	periodic.PrintRetCodes(out, "icmp", total.RetCodes, total.DurationHistogram.Count)
+	return &total, nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package icmprunner
+
+import (
+	"testing"
+)
+
+func TestICMPRunner(t *testing.T) {
+	if conn, _, err := listen(false); err != nil {
+		t.Skipf("No icmp socket available in this environment: %v", err)
+	} else {
+		conn.Close()
+	}
+	opts := RunnerOptions{}
+	opts.QPS = 100
+	opts.Exactly = 10
+	opts.NumThreads = 2
+	opts.Destination = "icmp://127.0.0.1"
+	res, err := RunICMPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[ICMPStatusOK] != 10 || res.DurationHistogram.Count != 10 {
+		t.Errorf("unexpected results %+v", res.RetCodes)
+	}
+	if res.RunType != "ICMP" || len(res.Metadata.TargetIPs) != 1 || res.Metadata.TargetIPs[0] != "127.0.0.1" {
+		t.Errorf("unexpected run type or metadata %q %+v", res.RunType, res.Metadata)
+	}
+	opts.Payload = []byte("abc")
+	opts.Exactly = 3
+	opts.NumThreads = 1
+	if res, err = RunICMPTest(&opts); err != nil || res.RetCodes[ICMPStatusOK] != 3 {
+		t.Errorf("unexpected results with payload %+v: %v", res, err)
+	}
+}
+
+func TestICMPErrors(t *testing.T) {
+	for _, d := range []string{"http://localhost", "icmp://", "icmp://doesnotexist.fortio.org.invalid"} {
+		if _, err := NewICMPClient(&ICMPOptions{Destination: d}, 0); err == nil {
+			t.Errorf("expected error for %q", d)
+		}
+	}
+	c := ICMPClient{id: 0x1234, seq: 7, privileged: true}
+	// IPv4 header (20 bytes) followed by the quoted echo request header.
+	quoted := make([]byte, 28)
+	quoted[0] = 0x45
+	copy(quoted[20:], []byte{8, 0, 0, 0, 0x12, 0x34, 0, 7})
+	if !c.quotesRequest(quoted) {
+		t.Errorf("expected match for quoted request")
+	}
+	quoted[27] = 6
+	if c.quotesRequest(quoted) || c.quotesRequest(quoted[:24]) {
+		t.Errorf("expected no match for other or short quoted request")
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"log"
 	"runtime"
 	"strings"
+	"sync"
 	"sync/atomic"
 
 	"fortio.org/fortio/dflag"
@@ -49,6 +50,10 @@ var (
 	// LogFileAndLine determines if the log lines will contain caller file name and line number.
 	LogFileAndLine = flag.Bool("logcaller", true, "Logs filename and line number of callers to log")
 	levelInternal  int32
+	// Lowest of the global and per component levels, what Log() checks against.
+	minLevelInternal int32
+	componentLevels  atomic.Value // map[string]Level
+	levelMutex       sync.Mutex   // serializes level changes so minLevelInternal is consistent
 )
 
 // SetFlagDefaultsForClientTools changes the default value of -logprefix and -logcaller
@@ -83,17 +88,67 @@ func init() {
 	}
 	// virtual dynLevel flag that maps back to actual level
 	_ = dflag.DynString(flag.CommandLine, "loglevel", GetLogLevel().String(),
-		fmt.Sprintf("loglevel, one of %v", levelToStrA)).WithValidator(func(newStr string) error {
-		_, err := ValidateLevel(newStr)
-		return err
-	}).WithSyncNotifier(func(old, newStr string) {
+		fmt.Sprintf("loglevel, one of %v, optionally followed or replaced by comma separated"+
+			" component=level for per package levels (e.g. info,fhttp=debug,fnet=warning)", levelToStrA)).
+		WithValidator(func(newStr string) error {
+			_, _, err := ParseLevels(newStr)
+			return err
+		}).WithSyncNotifier(func(old, newStr string) {
 		_ = setLogLevelStr(newStr) // will succeed as we just validated it first
 	})
+	_ = dflag.DynString(flag.CommandLine, "logsink", SinkStderr,
+		fmt.Sprintf("log output, one of %s, %s, %s (local daemon), udp://host:port or tcp://host:port (remote syslog)"+
+			" or unix:///path (syslog socket)", SinkStderr, SinkJournald, SinkSyslog)).WithValidator(ValidateSink).
+		WithSyncNotifier(func(old, newStr string) {
+			if err := SetSink(newStr); err != nil {
+				Errf("Unable to switch log output to %q: %v", newStr, err)
+			}
+		})
 	log.SetFlags(log.Ltime)
 }
 
 func setLevel(lvl Level) {
+	levelMutex.Lock()
 	atomic.StoreInt32(&levelInternal, int32(lvl))
+	updateMinLevel()
+	levelMutex.Unlock()
+}
+
+// updateMinLevel must be called with levelMutex held.
+func updateMinLevel() {
+	min := atomic.LoadInt32(&levelInternal)
+	for _, l := range getComponentLevels() {
+		if int32(l) < min {
+			min = int32(l)
+		}
+	}
+	atomic.StoreInt32(&minLevelInternal, min)
+}
+
+func getComponentLevels() map[string]Level {
+	m, _ := componentLevels.Load().(map[string]Level)
+	return m
+}
+
+// SetComponentLevels replaces the per component (package directory name,
+// e.g. "fhttp") log levels. Components not in the map use the global level.
+// Pass nil to only use the global level.
+func SetComponentLevels(levels map[string]Level) {
+	m := make(map[string]Level, len(levels))
+	for k, v := range levels {
+		m[k] = v
+	}
+	levelMutex.Lock()
+	componentLevels.Store(m)
+	updateMinLevel()
+	levelMutex.Unlock()
+}
+
+// componentOf returns the component (last directory) of a caller's file path.
+func componentOf(file string) string {
+	file = file[:strings.LastIndex(file, "/")+1] // also works (empty) when there is no /
+	file = strings.TrimSuffix(file, "/")
+	return file[strings.LastIndex(file, "/")+1:]
 }
 
 // String returns the string representation of the level.
@@ -111,15 +166,46 @@ func ValidateLevel(str string) (Level, error) {
 	return lvl, nil
 }
 
+// ParseLevels parses a -loglevel value: a comma separated list of an optional
+// global level and component=level entries, e.g. "info,fhttp=debug,fnet=warning".
+// The returned global level is -1 when not specified.
+func ParseLevels(str string) (Level, map[string]Level, error) {
+	global := Level(-1)
+	components := make(map[string]Level)
+	for _, part := range strings.Split(str, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 1 {
+			lvl, err := ValidateLevel(part)
+			if err != nil {
+				return -1, nil, err
+			}
+			global = lvl
+			continue
+		}
+		comp := strings.TrimSpace(kv[0])
+		if comp == "" {
+			return -1, nil, fmt.Errorf("empty component name in %q", part)
+		}
+		lvl, err := ValidateLevel(kv[1])
+		if err != nil {
+			return -1, nil, fmt.Errorf("%s: %w", comp, err)
+		}
+		components[comp] = lvl
+	}
+	return global, components, nil
+}
+
 // Sets from string.
 func setLogLevelStr(str string) error {
-	var lvl Level
-	var err error
-	if lvl, err = ValidateLevel(str); err != nil {
+	lvl, components, err := ParseLevels(str)
+	if err != nil {
 		return err
 	}
-	SetLogLevel(lvl)
-	return err // nil
+	if lvl >= 0 {
+		SetLogLevel(lvl)
+	}
+	SetComponentLevels(components)
+	return nil
 }
 
 // SetLogLevel sets the log level and returns the previous one.
@@ -159,9 +245,10 @@ func GetLogLevel() Level {
 	return Level(atomic.LoadInt32(&levelInternal))
 }
 
-// Log returns true if a given level is currently logged.
+// Log returns true if a given level is currently logged (by at least one
+// component when per component levels are set).
 func Log(lvl Level) bool {
-	return int32(lvl) >= atomic.LoadInt32(&levelInternal)
+	return int32(lvl) >= atomic.LoadInt32(&minLevelInternal)
 }
 
 // LevelByName returns the LogLevel by its name.
@@ -179,9 +266,31 @@ func logPrintf(lvl Level, format string, rest ...interface{}) {
 	if !Log(lvl) {
 		return
 	}
-	if *LogFileAndLine {
-		_, file, line, _ := runtime.Caller(2)
+	var file string
+	var line int
+	components := getComponentLevels()
+	if *LogFileAndLine || len(components) > 0 {
+		_, file, line, _ = runtime.Caller(2)
+		if len(components) > 0 {
+			cLvl, found := components[componentOf(file)]
+			if !found {
+				cLvl = GetLogLevel()
+			}
+			if lvl < cLvl {
+				return
+			}
+		}
 		file = file[strings.LastIndex(file, "/")+1:]
+	}
+	if sink := getSink(); sink != nil {
+		msg := fmt.Sprintf(format, rest...)
+		if *LogFileAndLine {
+			msg = fmt.Sprint(file, ":", line, *LogPrefix, msg)
+		}
+		if err := sink.Write(lvl, msg); err != nil {
+			log.Print(levelToStrA[lvl][0:1], " ", *LogPrefix, msg, " (log sink error: ", err, ")")
+		}
+	} else if *LogFileAndLine {
 		log.Print(levelToStrA[lvl][0:1], " ", file, ":", line, *LogPrefix, fmt.Sprintf(format, rest...))
 	} else {
 		log.Print(levelToStrA[lvl][0:1], " ", *LogPrefix, fmt.Sprintf(format, rest...))
@@ -114,6 +114,49 @@ func TestLogger1(t *testing.T) {
 	}
 }
 
+func TestComponentLevels(t *testing.T) {
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	SetLogLevelQuiet(Warning)
+	*LogFileAndLine = false
+	*LogPrefix = ""
+	log.SetOutput(w)
+	log.SetFlags(0)
+	if err := setLogLevelStr("log=verbose,fhttp=error"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if GetLogLevel() != Warning {
+		t.Errorf("global level shouldn't have changed, got %v", GetLogLevel())
+	}
+	if !LogVerbose() || LogDebug() {
+		t.Errorf("Log() should be true for lowest component level")
+	}
+	LogVf("test V %d", 1) // this is the "log" component
+	Debugf("test D %d", 2)
+	SetComponentLevels(map[string]Level{"fhttp": Debug})
+	Infof("test I %d", 3) // back to global level warning
+	SetComponentLevels(nil)
+	if LogVerbose() {
+		t.Errorf("LogVerbose() should be false after clearing components")
+	}
+	_ = w.Flush()
+	expected := "V test V 1\n"
+	if actual := b.String(); actual != expected {
+		t.Errorf("unexpected:\n%s\nvs:\n%s\n", actual, expected)
+	}
+	for _, bad := range []string{"foo=", "=debug", "info,x=bogus", "bogus"} {
+		if _, _, err := ParseLevels(bad); err == nil {
+			t.Errorf("expected error parsing %q", bad)
+		}
+	}
+	if c := componentOf("/a/b/fhttp/http_client.go"); c != "fhttp" {
+		t.Errorf("unexpected component %q", c)
+	}
+	if c := componentOf("main.go"); c != "" {
+		t.Errorf("unexpected component %q", c)
+	}
+}
+
 func TestLogFatal(t *testing.T) {
 	defer func() {
 		if r := recover(); r == nil {
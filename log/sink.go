@@ -0,0 +1,200 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log // import "fortio.org/fortio/log"
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Sink is an alternate destination for the log lines, instead of the
+// standard go logger (stderr by default). Implementations must be safe
+// for concurrent use.
+type Sink interface {
+	// Write outputs one already formatted message at the given level.
+	Write(lvl Level, msg string) error
+	// Close releases the underlying connection.
+	Close() error
+}
+
+// Syslog severities (RFC 5424), also used as journald PRIORITY=.
+const (
+	sevAlert   = 1
+	sevCrit    = 2
+	sevErr     = 3
+	sevWarning = 4
+	sevInfo    = 6
+	sevDebug   = 7
+)
+
+// severity maps our levels to syslog/journald severities.
+func (l Level) severity() int {
+	switch l {
+	case Debug, Verbose:
+		return sevDebug
+	case Info:
+		return sevInfo
+	case Warning:
+		return sevWarning
+	case Error:
+		return sevErr
+	case Critical:
+		return sevCrit
+	default:
+		return sevAlert
+	}
+}
+
+const (
+	// SinkStderr is the default sink: the standard go logger.
+	SinkStderr = "stderr"
+	// SinkJournald sends log lines to the local systemd journal.
+	SinkJournald = "journald"
+	// SinkSyslog sends log lines to the local syslog daemon.
+	SinkSyslog = "syslog"
+	// DefaultJournaldSocket is where systemd-journald listens for native protocol datagrams.
+	DefaultJournaldSocket = "/run/systemd/journal/socket"
+)
+
+type sinkHolder struct {
+	sink Sink
+}
+
+var (
+	currentSink atomic.Value // sinkHolder
+	sinkMutex   sync.Mutex   // serializes SetSink calls (and Close of the previous one)
+	// Tag is the identifier used for syslog and journald entries.
+	Tag = filepath.Base(os.Args[0])
+)
+
+// getSink returns the current Sink or nil when using the standard logger.
+func getSink() Sink {
+	h, _ := currentSink.Load().(sinkHolder)
+	return h.sink
+}
+
+// ValidateSink checks the syntax of a log sink specification, one of:
+// "" or "stderr" (default), "journald", "syslog" (local daemon),
+// "udp://host:port" or "tcp://host:port" (remote syslog) and
+// "unix:///path/to/socket" (syslog on a custom socket).
+func ValidateSink(spec string) error {
+	_, _, err := parseSink(spec)
+	return err
+}
+
+// parseSink splits the spec into a kind and an address.
+func parseSink(spec string) (string, string, error) {
+	spec = strings.TrimSpace(spec)
+	switch spec {
+	case "", SinkStderr:
+		return SinkStderr, "", nil
+	case SinkJournald, SinkSyslog:
+		return spec, "", nil
+	}
+	s := strings.SplitN(spec, "://", 2)
+	if len(s) != 2 || s[1] == "" {
+		return "", "", fmt.Errorf("invalid log sink %q, should be one of %s, %s, %s, udp://host:port, tcp://host:port or unix:///path",
+			spec, SinkStderr, SinkJournald, SinkSyslog)
+	}
+	switch s[0] {
+	case "udp", "tcp", "unix", "unixgram":
+		return s[0], s[1], nil
+	}
+	return "", "", fmt.Errorf("invalid log sink network %q in %q, should be udp, tcp, unix or unixgram", s[0], spec)
+}
+
+// SetSink switches the log output to the sink described by spec (see ValidateSink).
+// The previous sink, if any, is closed.
+func SetSink(spec string) error {
+	kind, addr, err := parseSink(spec)
+	if err != nil {
+		return err
+	}
+	var s Sink
+	switch kind {
+	case SinkStderr:
+		// nil sink: standard logger
+	case SinkJournald:
+		s, err = NewJournaldSink(DefaultJournaldSocket)
+	case SinkSyslog:
+		s, err = NewSyslogSink("", "")
+	default:
+		s, err = NewSyslogSink(kind, addr)
+	}
+	if err != nil {
+		return err
+	}
+	sinkMutex.Lock()
+	prev := getSink()
+	currentSink.Store(sinkHolder{s})
+	sinkMutex.Unlock()
+	if prev != nil {
+		_ = prev.Close()
+	}
+	return nil
+}
+
+// JournaldSink writes log entries to systemd-journald using its native
+// datagram protocol, which preserves the level as PRIORITY.
+type JournaldSink struct {
+	conn net.Conn
+}
+
+// NewJournaldSink connects to the journald socket at the given path.
+func NewJournaldSink(path string) (*JournaldSink, error) {
+	conn, err := net.Dial("unixgram", path)
+	if err != nil {
+		return nil, err
+	}
+	return &JournaldSink{conn: conn}, nil
+}
+
+// appendJournaldField adds one KEY=value field, using the binary length
+// prefixed form for values containing newlines.
+func appendJournaldField(b []byte, key, value string) []byte {
+	b = append(b, key...)
+	if !strings.Contains(value, "\n") {
+		b = append(b, '=')
+		b = append(b, value...)
+		return append(b, '\n')
+	}
+	b = append(b, '\n')
+	var l [8]byte
+	binary.LittleEndian.PutUint64(l[:], uint64(len(value)))
+	b = append(b, l[:]...)
+	b = append(b, value...)
+	return append(b, '\n')
+}
+
+// Write sends one entry to the journal.
+func (j *JournaldSink) Write(lvl Level, msg string) error {
+	b := make([]byte, 0, len(msg)+64)
+	b = appendJournaldField(b, "PRIORITY", fmt.Sprint(lvl.severity()))
+	b = appendJournaldField(b, "SYSLOG_IDENTIFIER", Tag)
+	b = appendJournaldField(b, "MESSAGE", strings.TrimRight(msg, "\n"))
+	_, err := j.conn.Write(b)
+	return err
+}
+
+// Close closes the journald socket.
+func (j *JournaldSink) Close() error {
+	return j.conn.Close()
+}
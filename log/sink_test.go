@@ -0,0 +1,93 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log // import "fortio.org/fortio/log"
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateSink(t *testing.T) {
+	for _, ok := range []string{"", "stderr", "journald", "syslog", "udp://localhost:514", "unix:///dev/log"} {
+		if err := ValidateSink(ok); err != nil {
+			t.Errorf("unexpected error for %q: %v", ok, err)
+		}
+	}
+	for _, bad := range []string{"foo", "udp://", "http://foo:80"} {
+		if err := ValidateSink(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestJournaldSink(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "fortio-journald-test.sock")
+	os.Remove(path)
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unable to listen on unixgram %s: %v", path, err)
+	}
+	defer os.Remove(path)
+	defer l.Close()
+	j, err := NewJournaldSink(path)
+	if err != nil {
+		t.Fatalf("unable to create journald sink: %v", err)
+	}
+	defer j.Close()
+	if err = j.Write(Warning, "multi\nline"); err != nil {
+		t.Errorf("write error %v", err)
+	}
+	buf := make([]byte, 1024)
+	_ = l.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := l.Read(buf)
+	if err != nil {
+		t.Fatalf("read error %v", err)
+	}
+	expected := "PRIORITY=4\nSYSLOG_IDENTIFIER=" + Tag + "\nMESSAGE\n\x0a\x00\x00\x00\x00\x00\x00\x00multi\nline\n"
+	if string(buf[:n]) != expected {
+		t.Errorf("got %q expected %q", buf[:n], expected)
+	}
+}
+
+func TestSyslogSink(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("unable to listen on udp: %v", err)
+	}
+	defer pc.Close()
+	err = SetSink("udp://" + pc.LocalAddr().String())
+	if err != nil {
+		t.Skipf("syslog not available: %v", err)
+	}
+	defer SetSink("") // nolint: errcheck
+	prevLevel := SetLogLevelQuiet(Info)
+	defer SetLogLevelQuiet(prevLevel)
+	Errf("test syslog %d", 42)
+	buf := make([]byte, 1024)
+	_ = pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("read error %v", err)
+	}
+	msg := string(buf[:n])
+	// daemon (3) * 8 + err (3) = 27
+	if !strings.HasPrefix(msg, "<27>") || !strings.Contains(msg, "test syslog 42") {
+		t.Errorf("unexpected syslog message %q", msg)
+	}
+}
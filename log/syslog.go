@@ -0,0 +1,60 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package log // import "fortio.org/fortio/log"
+
+import (
+	"log/syslog"
+)
+
+// SyslogSink writes log entries to a syslog daemon, local or remote.
+type SyslogSink struct {
+	w *syslog.Writer
+}
+
+// NewSyslogSink connects to the syslog daemon at the given network and
+// address; empty network and address means the local daemon.
+func NewSyslogSink(network, addr string) (*SyslogSink, error) {
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, Tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogSink{w: w}, nil
+}
+
+// Write sends one entry at the syslog severity matching lvl.
+func (s *SyslogSink) Write(lvl Level, msg string) error {
+	switch lvl.severity() {
+	case sevDebug:
+		return s.w.Debug(msg)
+	case sevInfo:
+		return s.w.Info(msg)
+	case sevWarning:
+		return s.w.Warning(msg)
+	case sevErr:
+		return s.w.Err(msg)
+	case sevCrit:
+		return s.w.Crit(msg)
+	default:
+		return s.w.Alert(msg)
+	}
+}
+
+// Close closes the connection to the syslog daemon.
+func (s *SyslogSink) Close() error {
+	return s.w.Close()
+}
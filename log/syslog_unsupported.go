@@ -0,0 +1,40 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows || plan9
+// +build windows plan9
+
+package log // import "fortio.org/fortio/log"
+
+import (
+	"errors"
+)
+
+// SyslogSink is not available on this platform.
+type SyslogSink struct{}
+
+// NewSyslogSink always returns an error on this platform.
+func NewSyslogSink(network, addr string) (*SyslogSink, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+// Write is never called as NewSyslogSink can't succeed.
+func (s *SyslogSink) Write(lvl Level, msg string) error {
+	return nil
+}
+
+// Close is never called as NewSyslogSink can't succeed.
+func (s *SyslogSink) Close() error {
+	return nil
+}
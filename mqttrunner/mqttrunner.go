@@ -0,0 +1,462 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttrunner
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"fortio.org/fortio/fhttp"
+	"fortio.org/fortio/fnet"
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/stats"
+)
+
+type MQTTResultMap map[string]int64
+
+// RunnerResults is the aggregated result of an MQTTRunner.
+// Also is the internal type used per thread/goroutine.
+type RunnerResults struct {
+	periodic.RunnerResults
+	MQTTOptions
+	RetCodes    MQTTResultMap
+	SocketCount int
+	// Messages received by the subscriber (when Subscribe) and their publish to
+	// receive latency, nil when none was received.
+	Received        int64
+	DeliveryLatency *stats.HistogramData
+	client          *MQTTClient
+}
+
+// ErrorRate returns the fraction of the calls which weren't OK (see periodic.HasErrorRate).
+func (mqttstate *RunnerResults) ErrorRate() float64 {
+	return periodic.ErrorRate(mqttstate.RetCodes, MQTTStatusOK)
+}
+
+// Run publishes a message (and waits for its acknowledgment for QoS 1 and 2).
+// Main call being run at the target QPS. To be set as the Function in RunnerOptions.
+func (mqttstate *RunnerResults) Run(t int) {
+	log.Debugf("Calling in %d", t)
+	err := mqttstate.client.Publish()
+	if err != nil {
+		mqttstate.RetCodes[err.Error()]++
+	} else {
+		mqttstate.RetCodes[MQTTStatusOK]++
+	}
+}
+
+// Warmup makes a warmup call, not counted in the results (see periodic.Warmer).
+// Its message is stamped with 0, so the subscriber doesn't count it.
+func (mqttstate *RunnerResults) Warmup(t int) {
+	mqttstate.client.warmup = true
+	err := mqttstate.client.Publish()
+	mqttstate.client.warmup = false
+	log.Debugf("Warmup call in %d: %v", t, err)
+}
+
+// MQTTOptions are options to the MQTTClient.
+type MQTTOptions struct {
+	Destination string // mqtt://[user[:password]@]host[:port]/topic
+	Payload     []byte // sent after the 8 bytes publish timestamp
+	QoS         int    // 0 (at most once), 1 (at least once) or 2 (exactly once)
+	// Subscribe to the topic with an additional client to measure the publish to receive latency.
+	Subscribe  bool
+	ReqTimeout time.Duration
+}
+
+// RunnerOptions includes the base RunnerOptions plus mqtt specific
+// options.
+type RunnerOptions struct {
+	periodic.RunnerOptions
+	MQTTOptions
+}
+
+// MQTTClient is the client used for mqtt publishing (and subscribing).
+type MQTTClient struct {
+	buffer      []byte
+	pkt         []byte // the packet being sent
+	header      []byte // its variable header
+	payload     []byte
+	dest        net.Addr
+	user        *url.Userinfo
+	clientID    string
+	topic       string
+	qos         byte
+	nextID      uint16
+	socket      net.Conn
+	reader      *bufio.Reader
+	socketCount int
+	destination string
+	reqTimeout  time.Duration
+	localAddr   net.Addr // of the last connection, for the run metadata
+	warmup      bool     // stamp the messages with 0, so the subscriber skips them
+}
+
+var (
+	// MQTTURLPrefix is the URL prefix for triggering mqtt load.
+	MQTTURLPrefix = "mqtt://"
+	// MQTTStatusOK is the map key on success.
+	MQTTStatusOK = "OK"
+	// DefaultTopic is the topic used when the url has no path.
+	DefaultTopic = "fortio"
+)
+
+// NewMQTTClient creates and initialize and returns a client based on the MQTTOptions.
+func NewMQTTClient(o *MQTTOptions, clientID string) (*MQTTClient, error) {
+	c := MQTTClient{}
+	c.destination = periodic.Redact(o.Destination) // no password in the logs and errors
+	u, err := url.Parse(o.Destination)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mqtt destination %q", c.destination)
+	}
+	c.destination = u.Redacted()
+	if u.Scheme != "mqtt" {
+		return nil, fmt.Errorf("expecting mqtt:// destination, got %q", c.destination)
+	}
+	if o.QoS < 0 || o.QoS > 2 {
+		return nil, fmt.Errorf("invalid mqtt qos %d, should be 0, 1 or 2", o.QoS)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "1883"
+	}
+	tAddr, err := fnet.Resolve(u.Hostname(), port)
+	if tAddr == nil {
+		return nil, err
+	}
+	c.dest = tAddr
+	c.user = u.User
+	c.clientID = clientID
+	c.topic = strings.TrimPrefix(u.Path, "/")
+	if c.topic == "" {
+		c.topic = DefaultTopic
+	}
+	c.qos = byte(o.QoS)
+	c.payload = append(make([]byte, 8, 8+len(o.Payload)), o.Payload...)
+	c.reqTimeout = o.ReqTimeout
+	if o.ReqTimeout == 0 {
+		log.Debugf("Request timeout not set, using default %v", fhttp.HTTPReqTimeOutDefaultValue)
+		c.reqTimeout = fhttp.HTTPReqTimeOutDefaultValue
+	}
+	if c.reqTimeout < 0 {
+		log.Warnf("Invalid timeout %v, setting to %v", c.reqTimeout, fhttp.HTTPReqTimeOutDefaultValue)
+		c.reqTimeout = fhttp.HTTPReqTimeOutDefaultValue
+	}
+	return &c, nil
+}
+
+// connect opens a new connection and sends the CONNECT packet.
+func (c *MQTTClient) connect() (net.Conn, error) {
+	c.socketCount++
+	socket, err := net.DialTimeout(c.dest.Network(), c.dest.String(), c.reqTimeout)
+	if err != nil {
+		log.Errf("Unable to connect to %v : %v", c.dest, err)
+		return nil, err
+	}
+	_ = socket.SetDeadline(time.Now().Add(c.reqTimeout))
+	c.reader = bufio.NewReader(socket)
+	flags := byte(0x02) // clean session
+	payload := appendString(nil, c.clientID)
+	if c.user != nil {
+		flags |= 0x80
+		payload = appendString(payload, c.user.Username())
+		if password, ok := c.user.Password(); ok {
+			flags |= 0x40
+			payload = appendString(payload, password)
+		}
+	}
+	header := appendString(nil, "MQTT")
+	header = append(header, protocolLevel, flags, 0, 0) // 0 keep alive: none
+	c.pkt = appendPacket(c.pkt[:0], typeConnect, 0, header, payload)
+	if _, err = socket.Write(c.pkt); err == nil {
+		var typ byte
+		typ, _, c.buffer, err = readPacket(c.reader, c.buffer)
+		if err == nil && (typ != typeConnack || len(c.buffer) != 2 || c.buffer[1] != 0) {
+			err = fmt.Errorf("mqtt connection refused (%v)", c.buffer)
+		}
+	}
+	if err != nil {
+		log.Errf("Mqtt connect error with %v : %v", c.dest, err)
+		socket.Close()
+		return nil, err
+	}
+	c.localAddr = socket.LocalAddr()
+	return socket, nil
+}
+
+// waitAck reads packets until the one of type typ for packet id.
+func (c *MQTTClient) waitAck(typ byte, id uint16) error {
+	for {
+		t, _, body, err := readPacket(c.reader, c.buffer)
+		c.buffer = body
+		if err != nil {
+			return err
+		}
+		if t == typ && len(body) >= 2 && binary.BigEndian.Uint16(body) == id {
+			return nil
+		}
+		log.Debugf("Skipping unexpected mqtt packet type %d", t)
+	}
+}
+
+// Publish publishes a message, stamped with the current time for the
+// subscriber, and waits for its acknowledgment (PUBACK for QoS 1, PUBREC and
+// PUBCOMP for QoS 2).
+func (c *MQTTClient) Publish() error {
+	// Connect or reuse existing socket:
+	conn := c.socket
+	reuse := (conn != nil)
+	if !reuse {
+		var err error
+		conn, err = c.connect()
+		if conn == nil {
+			return err
+		}
+	} else {
+		log.Debugf("Reusing socket %v", conn)
+	}
+	c.socket = nil // because of error returns and single retry
+	conErr := conn.SetDeadline(time.Now().Add(c.reqTimeout))
+	stamp := uint64(time.Now().UnixNano())
+	if c.warmup {
+		stamp = 0
+	}
+	binary.BigEndian.PutUint64(c.payload, stamp)
+	c.header = appendString(c.header[:0], c.topic)
+	var id uint16
+	if c.qos > 0 {
+		c.nextID++
+		if c.nextID == 0 { // 0 isn't a valid packet id
+			c.nextID = 1
+		}
+		id = c.nextID
+		c.header = append(c.header, packetID(id)...)
+	}
+	c.pkt = appendPacket(c.pkt[:0], typePublish, c.qos<<1, c.header, c.payload)
+	_, err := conn.Write(c.pkt)
+	if err != nil || conErr != nil {
+		conn.Close()
+		if reuse {
+			// it's ok for the (idle) socket to die once, auto reconnect:
+			log.Infof("Closing dead socket %v (%v)", conn, err)
+			return c.Publish() // recurse once
+		}
+		log.Errf("Unable to write to %v %v : %v", conn, c.dest, err)
+		return err
+	}
+	switch c.qos {
+	case 1:
+		err = c.waitAck(typePuback, id)
+	case 2:
+		if err = c.waitAck(typePubrec, id); err == nil {
+			if _, err = conn.Write(appendPacket(c.pkt[:0], typePubrel, 0x02, packetID(id))); err == nil {
+				err = c.waitAck(typePubcomp, id)
+			}
+		}
+	}
+	if err != nil {
+		log.Debugf("read error %v", err)
+		conn.Close()
+		return err
+	}
+	c.socket = conn // reuse on success
+	return nil
+}
+
+// Close closes the last connection and returns the total number of sockets used for the run.
+func (c *MQTTClient) Close() int {
+	log.Debugf("Closing %p: %s socket count %d", c, c.destination, c.socketCount)
+	if c.socket != nil {
+		_, _ = c.socket.Write(appendPacket(nil, typeDisconnect, 0))
+		if err := c.socket.Close(); err != nil {
+			log.Warnf("Error closing mqtt client's socket: %v", err)
+		}
+		c.socket = nil
+	}
+	return c.socketCount
+}
+
+// subscriber receives the published messages and records their publish to
+// receive latency.
+type subscriber struct {
+	client   *MQTTClient
+	conn     net.Conn
+	latency  *stats.Histogram
+	received int64 // atomic
+	done     chan struct{}
+}
+
+// newSubscriber connects and subscribes to the topic, then receives the
+// messages until stop().
+func newSubscriber(o *MQTTOptions, clientID string, ro *periodic.RunnerOptions) (*subscriber, error) {
+	c, err := NewMQTTClient(o, clientID)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	const id = 1
+	header := append(packetID(id), appendString(nil, c.topic)...)
+	header = append(header, c.qos)
+	if _, err = conn.Write(appendPacket(nil, typeSubscribe, 0x02, header)); err == nil {
+		if err = c.waitAck(typeSuback, id); err == nil && (len(c.buffer) != 3 || c.buffer[2] > 2) {
+			err = fmt.Errorf("mqtt subscription to %q refused", c.topic)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{}) // until stop()
+	s := &subscriber{client: c, conn: conn, latency: ro.NewLatencyHistogram(), done: make(chan struct{})}
+	go s.receive()
+	return s, nil
+}
+
+// receive records the messages' latency and acknowledges them.
+func (s *subscriber) receive() {
+	defer close(s.done)
+	c := s.client
+	for {
+		typ, flags, body, err := readPacket(c.reader, c.buffer)
+		c.buffer = body
+		if err != nil {
+			log.Debugf("Mqtt subscriber done: %v", err)
+			return
+		}
+		now := time.Now().UnixNano()
+		var ack []byte
+		switch typ {
+		case typePublish:
+			p, err := parsePublish(flags, body)
+			if err != nil {
+				log.Warnf("Mqtt subscriber received an invalid message: %v", err)
+				return
+			}
+			if len(p.payload) < 8 {
+				atomic.AddInt64(&s.received, 1)
+			} else if stamp := int64(binary.BigEndian.Uint64(p.payload)); stamp != 0 { // 0: warmup message, not counted
+				s.latency.Record(float64(now-stamp) / 1e9)
+				atomic.AddInt64(&s.received, 1)
+			}
+			switch p.qos {
+			case 1:
+				ack = appendPacket(c.pkt[:0], typePuback, 0, packetID(p.id))
+			case 2:
+				ack = appendPacket(c.pkt[:0], typePubrec, 0, packetID(p.id))
+			}
+		case typePubrel:
+			if len(body) >= 2 {
+				ack = appendPacket(c.pkt[:0], typePubcomp, 0, body[:2])
+			}
+		}
+		if ack != nil {
+			c.pkt = ack
+			if _, err = s.conn.Write(ack); err != nil {
+				log.Warnf("Mqtt subscriber unable to acknowledge: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// stop waits (up to timeout) for the expected number of messages, then
+// disconnects and returns the number of messages received.
+func (s *subscriber) stop(expected int64, timeout time.Duration) int64 {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&s.received) < expected && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, _ = s.conn.Write(appendPacket(nil, typeDisconnect, 0))
+	s.conn.Close()
+	<-s.done
+	return s.received
+}
+
+// RunMQTTTest runs an mqtt test and returns the aggregated stats.
+func RunMQTTTest(o *RunnerOptions) (*RunnerResults, error) {
+	o.RunType = fmt.Sprintf("MQTT QoS %d", o.QoS)
+	log.Infof("Starting mqtt test for %s with %d threads at %.1f qps", periodic.Redact(o.Destination), o.NumThreads, o.QPS)
+	r := periodic.NewPeriodicRunner(&o.RunnerOptions)
+	defer r.Options().Abort()
+	numThreads := r.Options().NumThreads
+	out := r.Options().Out // Important as the default value is set from nil to stdout inside NewPeriodicRunner
+	total := RunnerResults{
+		MQTTOptions: o.MQTTOptions,
+		RetCodes:    make(MQTTResultMap),
+	}
+	if u, err := url.Parse(o.Destination); err == nil {
+		total.Destination = u.Redacted() // no password in the results
+	}
+	// Unique (and at most 23 characters) client ids, per run.
+	idPrefix := fmt.Sprintf("fortio-%08x", uint32(time.Now().UnixNano()))
+	mqttstate := make([]RunnerResults, numThreads)
+	err := periodic.SetupThreads(r, func(i int, firstCall bool) (periodic.Runnable, error) {
+		// Create a client and connect once for each 'thread'
+		client, err := NewMQTTClient(&o.MQTTOptions, fmt.Sprintf("%s-%d", idPrefix, i))
+		if client == nil {
+			return nil, fmt.Errorf("unable to create client %d for %s: %w", i, total.Destination, err)
+		}
+		if firstCall {
+			err := client.Publish()
+			if i == 0 && log.LogVerbose() {
+				log.LogVf("first publish to %s: err %v", total.Destination, err)
+			}
+		}
+		// Setup the stats for each 'thread'
+		mqttstate[i].client = client
+		mqttstate[i].RetCodes = make(MQTTResultMap)
+		return &mqttstate[i], nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var sub *subscriber
+	if o.Subscribe {
+		// After the warm up calls so their messages aren't counted.
+		sub, err = newSubscriber(&o.MQTTOptions, idPrefix+"-sub", r.Options())
+		if err != nil {
+			return nil, fmt.Errorf("unable to subscribe to %s: %w", total.Destination, err)
+		}
+	}
+	total.RunnerResults = r.Run()
+	periodic.MergeThreads(r, numThreads, total.RetCodes, func(i int) map[string]int64 {
+		c := mqttstate[i].client
+		total.Metadata.AddConnection(c.localAddr, c.dest, nil)
+		total.SocketCount += c.Close()
+		return mqttstate[i].RetCodes
+	})
+	_, _ = fmt.Fprintf(out, "Sockets used: %d (for perfect no error run, would be %d)\n", total.SocketCount, r.Options().NumThreads)
+	periodic.PrintRetCodes(out, "mqtt", total.RetCodes, total.DurationHistogram.Count)
+	if sub != nil {
+		published := total.RetCodes[MQTTStatusOK]
+		total.Received = sub.stop(published, sub.client.reqTimeout)
+		_, _ = fmt.Fprintf(out, "Subscriber received %d of the %d messages published\n", total.Received, published)
+		if sub.latency.Count > 0 {
+			total.DeliveryLatency = sub.latency.Export().CalcPercentiles(r.Options().Percentiles)
+			total.DeliveryLatency.Print(out, "Publish to receive latency")
+		}
+	}
+	return &total, nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttrunner
+
+// Minimal MQTT 3.1.1 packets encoding and decoding, just what is needed to
+// publish and subscribe: no will, retain or session persistence.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"fortio.org/fortio/fnet"
+)
+
+// Control packet types (high nibble of the fixed header).
+const (
+	typeConnect    = 1
+	typeConnack    = 2
+	typePublish    = 3
+	typePuback     = 4
+	typePubrec     = 5
+	typePubrel     = 6
+	typePubcomp    = 7
+	typeSubscribe  = 8
+	typeSuback     = 9
+	typeDisconnect = 14
+
+	protocolLevel = 4 // 3.1.1
+)
+
+var errMalformed = errors.New("malformed mqtt packet")
+
+// appendPacket appends the packet of type typ, with the flags (low nibble of
+// the fixed header), made of the body parts, to buf.
+func appendPacket(buf []byte, typ, flags byte, body ...[]byte) []byte {
+	l := 0
+	for _, b := range body {
+		l += len(b)
+	}
+	buf = append(buf, typ<<4|flags)
+	// Remaining length, 7 bits at a time, least significant first.
+	for {
+		b := byte(l % 128)
+		l /= 128
+		if l > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if l == 0 {
+			break
+		}
+	}
+	for _, b := range body {
+		buf = append(buf, b...)
+	}
+	return buf
+}
+
+// appendString appends the length prefixed s to buf.
+func appendString(buf []byte, s string) []byte {
+	buf = append(buf, byte(len(s)>>8), byte(len(s)))
+	return append(buf, s...)
+}
+
+// readString returns the length prefixed string at the start of b and the rest of b.
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errMalformed
+	}
+	l := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+l {
+		return "", nil, errMalformed
+	}
+	return string(b[2 : 2+l]), b[2+l:], nil
+}
+
+// packetID returns the packet identifier body (of acks, PUBREL,...) for id.
+func packetID(id uint16) []byte {
+	return []byte{byte(id >> 8), byte(id)}
+}
+
+// readPacket reads a packet and returns its type, flags and body (in buf, reused).
+func readPacket(r *bufio.Reader, buf []byte) (byte, byte, []byte, error) {
+	h, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, buf[:0], err
+	}
+	l, mult := 0, 1
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, buf[:0], err
+		}
+		l += int(b&0x7F) * mult
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, 0, buf[:0], errMalformed
+		}
+		mult *= 128
+	}
+	if l > fnet.MaxPayloadSizeLimit {
+		return 0, 0, buf[:0], errMalformed
+	}
+	if cap(buf) < l {
+		buf = make([]byte, l)
+	}
+	buf = buf[:l]
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return 0, 0, buf[:0], err
+	}
+	return h >> 4, h & 0x0F, buf, nil
+}
+
+// publish is a decoded PUBLISH packet.
+type publish struct {
+	qos     byte
+	topic   string
+	id      uint16 // when qos > 0
+	payload []byte
+}
+
+// parsePublish decodes the body of a PUBLISH packet with the given flags.
+func parsePublish(flags byte, body []byte) (publish, error) {
+	p := publish{qos: (flags >> 1) & 0x03}
+	var err error
+	if p.topic, body, err = readString(body); err != nil {
+		return p, err
+	}
+	if p.qos > 0 {
+		if len(body) < 2 {
+			return p, errMalformed
+		}
+		p.id = binary.BigEndian.Uint16(body)
+		body = body[2:]
+	}
+	p.payload = body
+	return p, nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package otlp // import "fortio.org/fortio/otlp"
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/version"
+)
+
+const (
+	// MetricsPath is the OTLP/HTTP path for metrics, see TracesPath.
+	MetricsPath = "/v1/metrics"
+	// DurationMetric is the name of the run summary's calls duration (summary) metric, in seconds.
+	DurationMetric = "fortio.request.duration"
+	// QPSMetric is the name of the run summary's actual qps (gauge) metric.
+	QPSMetric = "fortio.qps"
+)
+
+// Quantile is a (0-1) quantile of the RunSummary durations.
+type Quantile struct {
+	Quantile float64
+	Value    float64
+}
+
+// RunSummary is the summary of a load run, exported as metrics by ExportRunSummary.
+type RunSummary struct {
+	Start time.Time
+	End   time.Time
+	Count int64
+	// Sum of the calls durations, in seconds.
+	Sum float64
+	// Quantiles of the calls durations, in seconds, 0 being the min and 1 the max.
+	Quantiles  []Quantile
+	QPS        float64
+	Attributes map[string]interface{} // string, int, int64, float64 or bool values
+}
+
+// ExportRunSummary synchronously sends the run summary to the OTLP/HTTP
+// endpoint (e.g. http://localhost:4318) as the DurationMetric summary and
+// the QPSMetric gauge, with the summary's attributes.
+func ExportRunSummary(endpoint, service string, s *RunSummary) error {
+	endpoint = endpointURL(endpoint, MetricsPath)
+	body, err := json.Marshal(encodeSummary(service, s))
+	if err != nil {
+		return fmt.Errorf("unable to serialize run summary: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create otlp request for %s: %w", endpoint, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error exporting run summary to %s: %w", endpoint, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("error exporting run summary to %s: http status %d", endpoint, resp.StatusCode)
+	}
+	log.Infof("Exported run summary metrics to %s", endpoint)
+	return nil
+}
+
+// -- OTLP JSON encoding (see opentelemetry-proto metrics/v1 and its JSON mapping).
+
+type jsonQuantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+type dataPoint struct {
+	Attributes        []keyValue     `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	Count             string         `json:"count,omitempty"` // fixed64 are strings in the JSON mapping
+	Sum               *float64       `json:"sum,omitempty"`
+	QuantileValues    []jsonQuantile `json:"quantileValues,omitempty"`
+	AsDouble          *float64       `json:"asDouble,omitempty"`
+}
+
+type dataPoints struct {
+	DataPoints []dataPoint `json:"dataPoints"`
+}
+
+type jsonMetric struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Unit        string      `json:"unit"`
+	Summary     *dataPoints `json:"summary,omitempty"`
+	Gauge       *dataPoints `json:"gauge,omitempty"`
+}
+
+type scopeMetrics struct {
+	Scope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"scope"`
+	Metrics []jsonMetric `json:"metrics"`
+}
+
+type resourceMetrics struct {
+	Resource struct {
+		Attributes []keyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeMetrics []scopeMetrics `json:"scopeMetrics"`
+}
+
+type metricsRequest struct {
+	ResourceMetrics []resourceMetrics `json:"resourceMetrics"`
+}
+
+func encodeSummary(service string, s *RunSummary) *metricsRequest {
+	keys := make([]string, 0, len(s.Attributes))
+	for k := range s.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	attrs := make([]keyValue, 0, len(keys))
+	for _, k := range keys {
+		attrs = append(attrs, toKeyValue(k, s.Attributes[k]))
+	}
+	sum, qps := s.Sum, s.QPS
+	duration := dataPoint{
+		Attributes:        attrs,
+		StartTimeUnixNano: unixNano(s.Start),
+		TimeUnixNano:      unixNano(s.End),
+		Count:             strconv.FormatInt(s.Count, 10),
+		Sum:               &sum,
+	}
+	for _, q := range s.Quantiles {
+		duration.QuantileValues = append(duration.QuantileValues, jsonQuantile(q))
+	}
+	rate := dataPoint{Attributes: attrs, StartTimeUnixNano: unixNano(s.Start), TimeUnixNano: unixNano(s.End), AsDouble: &qps}
+	sm := scopeMetrics{Metrics: []jsonMetric{
+		{Name: DurationMetric, Description: "Duration of the calls of the run", Unit: "s",
+			Summary: &dataPoints{DataPoints: []dataPoint{duration}}},
+		{Name: QPSMetric, Description: "Actual queries per second of the run", Unit: "{request}/s",
+			Gauge: &dataPoints{DataPoints: []dataPoint{rate}}},
+	}}
+	sm.Scope.Name = "fortio"
+	sm.Scope.Version = version.Short()
+	rm := resourceMetrics{ScopeMetrics: []scopeMetrics{sm}}
+	rm.Resource.Attributes = []keyValue{toKeyValue("service.name", service)}
+	return &metricsRequest{ResourceMetrics: []resourceMetrics{rm}}
+}
@@ -0,0 +1,383 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package otlp is a minimal (dependency free) OpenTelemetry OTLP/HTTP JSON
+// span exporter, used to send client spans of sampled load requests to a
+// tracing backend (collector, Jaeger, Tempo...).
+package otlp // import "fortio.org/fortio/otlp"
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/version"
+)
+
+const (
+	// TracesPath is the OTLP/HTTP path for traces, appended to endpoints without a path.
+	TracesPath = "/v1/traces"
+	// QueueSize is how many spans can be pending export before new ones get dropped.
+	QueueSize = 4096
+	// BatchSize is the maximum number of spans sent per export request.
+	BatchSize = 512
+	// FlushInterval is how often pending spans are sent even when the batch isn't full.
+	FlushInterval = 2 * time.Second
+)
+
+// Span kinds and status codes from the OTLP trace proto.
+const (
+	KindClient  = 3
+	StatusOK    = 1
+	StatusError = 2
+)
+
+// Event is a timestamped annotation of a span, used for the request phases.
+type Event struct {
+	Name string
+	Time time.Time
+}
+
+// Span is one (client) span to export.
+type Span struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{} // string, int, int64, float64 or bool values
+	Events     []Event
+	Error      bool
+	mutex      sync.Mutex // for events added from callbacks on other goroutines
+}
+
+// AddEvent records a phase event at the current time. Safe to call
+// concurrently (e.g. from net/http/httptrace callbacks).
+func (s *Span) AddEvent(name string) {
+	s.mutex.Lock()
+	s.Events = append(s.Events, Event{Name: name, Time: time.Now()})
+	s.mutex.Unlock()
+}
+
+// TraceParent returns the W3C trace context traceparent header value of the
+// span, to propagate it to the server.
+func (s *Span) TraceParent() string {
+	return "00-" + hex.EncodeToString(s.TraceID[:]) + "-" + hex.EncodeToString(s.SpanID[:]) + "-01"
+}
+
+// SetIDs sets the trace and span ids from their hex representation (as
+// found in trace headers). Invalid input leaves the ids unchanged.
+func (s *Span) SetIDs(traceID, spanID []byte) {
+	var t [16]byte
+	var sp [8]byte
+	if _, err := hex.Decode(t[:], traceID); err != nil {
+		return
+	}
+	if _, err := hex.Decode(sp[:], spanID); err != nil {
+		return
+	}
+	s.TraceID = t
+	s.SpanID = sp
+}
+
+// Exporter batches and sends spans asynchronously. Export() never blocks,
+// spans are dropped when the queue is full.
+type Exporter struct {
+	endpoint   string
+	service    string
+	sampleRate float64
+	client     *http.Client
+	queue      chan *Span
+	done       chan struct{}
+	closeOnce  sync.Once
+	rndMutex   sync.Mutex
+	rnd        *rand.Rand
+	// Counters, accessed atomically.
+	exported int64
+	dropped  int64
+	errors   int64
+}
+
+// NewExporter creates an exporter sending to the OTLP/HTTP endpoint (e.g.
+// http://localhost:4318) and starts its background sender. sampleRate is
+// the fraction (0-1] of requests Sample() returns true for.
+// Close() must be called to flush and release the exporter.
+func NewExporter(endpoint, service string, sampleRate float64) *Exporter {
+	endpoint = endpointURL(endpoint, TracesPath)
+	if sampleRate <= 0 || sampleRate > 1 {
+		log.Warnf("Invalid otlp sample rate %g, using 1 (all requests)", sampleRate)
+		sampleRate = 1
+	}
+	e := &Exporter{
+		endpoint:   endpoint,
+		service:    service,
+		sampleRate: sampleRate,
+		client:     &http.Client{Timeout: 5 * time.Second},
+		queue:      make(chan *Span, QueueSize),
+		done:       make(chan struct{}),
+		rnd:        rand.New(rand.NewSource(time.Now().UnixNano())), // nolint: gosec // not for crypto
+	}
+	log.Infof("Exporting %g of requests as spans to %s", sampleRate, endpoint)
+	go e.run()
+	return e
+}
+
+// endpointURL returns the url to send the signal of path (TracesPath or
+// MetricsPath) to: the endpoint, with http:// unless it has a scheme, plus
+// the path unless it has a custom one (a standard one being replaced by path).
+func endpointURL(endpoint, path string) string {
+	endpoint = strings.TrimRight(endpoint, "/")
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		endpoint = "http://" + endpoint
+	}
+	for _, p := range []string{TracesPath, MetricsPath} {
+		if strings.HasSuffix(endpoint, p) {
+			return strings.TrimSuffix(endpoint, p) + path
+		}
+	}
+	if strings.Count(endpoint, "/") == 2 { // no path
+		endpoint += path
+	}
+	return endpoint
+}
+
+// Sample returns true if the next request should be traced/exported.
+func (e *Exporter) Sample() bool {
+	if e.sampleRate >= 1 {
+		return true
+	}
+	e.rndMutex.Lock()
+	r := e.rnd.Float64()
+	e.rndMutex.Unlock()
+	return r < e.sampleRate
+}
+
+// NewSpan returns a new span with random ids, started now.
+func (e *Exporter) NewSpan(name string) *Span {
+	s := &Span{Name: name, Start: time.Now(), Attributes: make(map[string]interface{})}
+	e.rndMutex.Lock()
+	_, _ = e.rnd.Read(s.TraceID[:])
+	_, _ = e.rnd.Read(s.SpanID[:])
+	e.rndMutex.Unlock()
+	return s
+}
+
+// Export queues the span for sending, sets its end time if not already set.
+func (e *Exporter) Export(s *Span) {
+	if s.End.IsZero() {
+		s.End = time.Now()
+	}
+	select {
+	case e.queue <- s:
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+	}
+}
+
+// Close flushes the pending spans and stops the exporter. Returns the number
+// of spans exported and dropped (queue full or send errors).
+func (e *Exporter) Close() (exported int64, dropped int64) {
+	e.closeOnce.Do(func() {
+		close(e.queue)
+		<-e.done
+	})
+	exported = atomic.LoadInt64(&e.exported)
+	dropped = atomic.LoadInt64(&e.dropped)
+	log.Infof("Otlp exporter to %s: %d spans exported, %d dropped, %d send errors", e.endpoint, exported, dropped,
+		atomic.LoadInt64(&e.errors))
+	return exported, dropped
+}
+
+func (e *Exporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(FlushInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, BatchSize)
+	for {
+		select {
+		case s, ok := <-e.queue:
+			if !ok {
+				e.send(batch)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= BatchSize {
+				e.send(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			e.send(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (e *Exporter) send(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(e.encode(batch))
+	if err != nil {
+		log.Errf("Unable to serialize %d spans: %v", len(batch), err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body)) // nolint: noctx
+	if err != nil {
+		log.Errf("Unable to create otlp request for %s: %v", e.endpoint, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			err = fmt.Errorf("http status %d", resp.StatusCode)
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&e.errors, 1)
+		atomic.AddInt64(&e.dropped, int64(len(batch)))
+		log.Warnf("Error exporting %d spans to %s: %v", len(batch), e.endpoint, err)
+		return
+	}
+	atomic.AddInt64(&e.exported, int64(len(batch)))
+	log.Debugf("Exported %d spans to %s", len(batch), e.endpoint)
+}
+
+// -- OTLP JSON encoding (see opentelemetry-proto trace/v1 and its JSON mapping).
+
+type anyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"` // int64 are strings in the JSON mapping
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type jsonEvent struct {
+	TimeUnixNano string `json:"timeUnixNano"`
+	Name         string `json:"name"`
+}
+
+type jsonStatus struct {
+	Code int `json:"code"`
+}
+
+type jsonSpan struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []keyValue  `json:"attributes,omitempty"`
+	Events            []jsonEvent `json:"events,omitempty"`
+	Status            jsonStatus  `json:"status"`
+}
+
+type scopeSpans struct {
+	Scope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"scope"`
+	Spans []jsonSpan `json:"spans"`
+}
+
+type resourceSpans struct {
+	Resource struct {
+		Attributes []keyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+func toKeyValue(k string, v interface{}) keyValue {
+	kv := keyValue{Key: k}
+	switch t := v.(type) {
+	case string:
+		kv.Value.StringValue = &t
+	case int:
+		s := strconv.Itoa(t)
+		kv.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(t, 10)
+		kv.Value.IntValue = &s
+	case float64:
+		kv.Value.DoubleValue = &t
+	case bool:
+		kv.Value.BoolValue = &t
+	default:
+		s := fmt.Sprint(t)
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func (e *Exporter) encode(batch []*Span) *exportRequest {
+	ss := scopeSpans{Spans: make([]jsonSpan, 0, len(batch))}
+	ss.Scope.Name = "fortio"
+	ss.Scope.Version = version.Short()
+	for _, s := range batch {
+		js := jsonSpan{
+			TraceID:           hex.EncodeToString(s.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.SpanID[:]),
+			Name:              s.Name,
+			Kind:              KindClient,
+			StartTimeUnixNano: unixNano(s.Start),
+			EndTimeUnixNano:   unixNano(s.End),
+			Status:            jsonStatus{Code: StatusOK},
+		}
+		if s.Error {
+			js.Status.Code = StatusError
+		}
+		keys := make([]string, 0, len(s.Attributes))
+		for k := range s.Attributes {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			js.Attributes = append(js.Attributes, toKeyValue(k, s.Attributes[k]))
+		}
+		s.mutex.Lock()
+		for _, ev := range s.Events {
+			js.Events = append(js.Events, jsonEvent{TimeUnixNano: unixNano(ev.Time), Name: ev.Name})
+		}
+		s.mutex.Unlock()
+		ss.Spans = append(ss.Spans, js)
+	}
+	rs := resourceSpans{ScopeSpans: []scopeSpans{ss}}
+	rs.Resource.Attributes = []keyValue{toKeyValue("service.name", e.service)}
+	return &exportRequest{ResourceSpans: []resourceSpans{rs}}
+}
@@ -0,0 +1,177 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package otlp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector is a test OTLP/HTTP receiver accumulating the spans it gets.
+type collector struct {
+	mutex sync.Mutex
+	paths []string
+	reqs  []exportRequest
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, _ := ioutil.ReadAll(r.Body)
+	var req exportRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.mutex.Lock()
+	c.paths = append(c.paths, r.URL.Path)
+	c.reqs = append(c.reqs, req)
+	c.mutex.Unlock()
+}
+
+func TestExporter(t *testing.T) {
+	c := &collector{}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+	e := NewExporter(srv.URL, "svc", 1)
+	if !e.Sample() {
+		t.Errorf("sample rate 1 should always sample")
+	}
+	s := e.NewSpan("HTTP GET")
+	s.Attributes["http.status_code"] = 200
+	s.Attributes["http.method"] = "GET"
+	s.AddEvent("connected")
+	s.AddEvent("first_byte")
+	s.SetIDs([]byte("0af7651916cd43dd8448eb211c80319c"), []byte("b7ad6b7169203331"))
+	e.Export(s)
+	s2 := e.NewSpan("HTTP POST")
+	s2.Error = true
+	e.Export(s2)
+	exported, dropped := e.Close()
+	if exported != 2 || dropped != 0 {
+		t.Errorf("expected 2 exported 0 dropped, got %d %d", exported, dropped)
+	}
+	if len(c.reqs) != 1 || c.paths[0] != TracesPath {
+		t.Fatalf("expected 1 request to %s, got %+v %v", TracesPath, c.reqs, c.paths)
+	}
+	rs := c.reqs[0].ResourceSpans[0]
+	if v := rs.Resource.Attributes[0].Value.StringValue; v == nil || *v != "svc" {
+		t.Errorf("unexpected resource attributes %+v", rs.Resource.Attributes)
+	}
+	spans := rs.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %+v", spans)
+	}
+	js := spans[0]
+	if js.TraceID != "0af7651916cd43dd8448eb211c80319c" || js.SpanID != "b7ad6b7169203331" {
+		t.Errorf("unexpected ids %s %s", js.TraceID, js.SpanID)
+	}
+	if js.Kind != KindClient || js.Status.Code != StatusOK || spans[1].Status.Code != StatusError {
+		t.Errorf("unexpected kind/status %+v %+v", js, spans[1])
+	}
+	if len(js.Attributes) != 2 || js.Attributes[0].Key != "http.method" ||
+		js.Attributes[1].Value.IntValue == nil || *js.Attributes[1].Value.IntValue != "200" {
+		t.Errorf("unexpected attributes %+v", js.Attributes)
+	}
+	if len(js.Events) != 2 || js.Events[0].Name != "connected" || js.Events[1].Name != "first_byte" {
+		t.Errorf("unexpected events %+v", js.Events)
+	}
+	if len(spans[1].TraceID) != 32 || spans[1].TraceID == js.TraceID {
+		t.Errorf("unexpected random trace id %q", spans[1].TraceID)
+	}
+}
+
+func TestExporterErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	e := NewExporter(srv.URL+"/custom/path", "svc", 0) // invalid rate becomes 1
+	if e.endpoint != srv.URL+"/custom/path" {
+		t.Errorf("path shouldn't be changed, got %s", e.endpoint)
+	}
+	e.Export(e.NewSpan("x"))
+	exported, dropped := e.Close()
+	if exported != 0 || dropped != 1 {
+		t.Errorf("expected 0 exported 1 dropped, got %d %d", exported, dropped)
+	}
+	// Close twice is ok
+	e.Close()
+}
+
+func TestEndpointURL(t *testing.T) {
+	tests := []struct {
+		endpoint, path, expected string
+	}{
+		{"localhost:4318", TracesPath, "http://localhost:4318/v1/traces"},
+		{"https://collector/", MetricsPath, "https://collector/v1/metrics"},
+		{"http://collector:4318/v1/traces", MetricsPath, "http://collector:4318/v1/metrics"},
+		{"http://collector/prefix/v1/metrics", TracesPath, "http://collector/prefix/v1/traces"},
+		{"http://collector/custom", MetricsPath, "http://collector/custom"},
+	}
+	for _, tst := range tests {
+		if got := endpointURL(tst.endpoint, tst.path); got != tst.expected {
+			t.Errorf("endpointURL(%q, %q) = %q, expected %q", tst.endpoint, tst.path, got, tst.expected)
+		}
+	}
+}
+
+func TestExportRunSummary(t *testing.T) {
+	var path string
+	var req metricsRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		data, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+	start := time.Unix(1620000000, 0)
+	s := &RunSummary{
+		Start:      start,
+		End:        start.Add(2 * time.Second),
+		Count:      20,
+		Sum:        0.5,
+		Quantiles:  []Quantile{{0, 0.01}, {0.5, 0.02}, {1, 0.1}},
+		QPS:        10,
+		Attributes: map[string]interface{}{"fortio.run_type": "HTTP", "fortio.num_threads": 4},
+	}
+	if err := ExportRunSummary(srv.URL, "svc", s); err != nil {
+		t.Fatal(err)
+	}
+	if path != MetricsPath || len(req.ResourceMetrics) != 1 {
+		t.Fatalf("unexpected request to %s: %+v", path, req)
+	}
+	metrics := req.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	if len(metrics) != 2 || metrics[0].Name != DurationMetric || metrics[1].Name != QPSMetric {
+		t.Fatalf("unexpected metrics %+v", metrics)
+	}
+	dp := metrics[0].Summary.DataPoints[0]
+	if dp.Count != "20" || *dp.Sum != 0.5 || len(dp.QuantileValues) != 3 || dp.QuantileValues[1].Value != 0.02 ||
+		dp.TimeUnixNano != "1620000002000000000" || len(dp.Attributes) != 2 || dp.Attributes[0].Key != "fortio.num_threads" {
+		t.Errorf("unexpected duration summary %+v", dp)
+	}
+	if g := metrics[1].Gauge.DataPoints[0]; *g.AsDouble != 10 {
+		t.Errorf("unexpected qps gauge %+v", g)
+	}
+	srv.Close()
+	if err := ExportRunSummary(srv.URL, "svc", s); err == nil {
+		t.Errorf("expected an error exporting to a closed server")
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"fmt"
+	"io"
+)
+
+// Verdict is the pass/fail outcome of the assertions (SLOs) checked after a
+// run, for fortio to be used as a CI gate (see Assert).
+type Verdict struct {
+	Passed     bool
+	Assertions []SLOResult
+}
+
+// Assert checks the SLOs against the result and records the Verdict in it.
+// Unlike in the JUnit report, an assertion that can't be checked (e.g. a
+// latency without any call) fails the verdict: the gate shouldn't pass on
+// missing data.
+func Assert(slos []SLO, r HasRunnerResult) *Verdict {
+	v := &Verdict{Passed: true, Assertions: CheckSLOs(slos, r)}
+	for _, c := range v.Assertions {
+		if !c.Passed {
+			v.Passed = false
+		}
+	}
+	r.Result().Verdict = v
+	return v
+}
+
+// Print prints each assertion's outcome and the verdict.
+func (v *Verdict) Print(out io.Writer, name string) {
+	for _, c := range v.Assertions {
+		status := "ok"
+		switch {
+		case c.Skipped != "":
+			status = "FAILED (unchecked)"
+		case !c.Passed:
+			status = "FAILED"
+		}
+		_, _ = fmt.Fprintf(out, "Assert %s : %s (%s)\n", c.Text, status, c.String())
+	}
+	verdict := "PASS"
+	if !v.Passed {
+		verdict = "FAIL"
+	}
+	_, _ = fmt.Fprintf(out, "Verdict for %s: %s\n", name, verdict)
+}
@@ -0,0 +1,72 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"fortio.org/fortio/stats"
+)
+
+func TestAssert(t *testing.T) {
+	h := stats.NewHistogram(0, .001)
+	for i := 1; i <= 100; i++ {
+		h.Record(float64(i) / 1000.)
+	}
+	r := &errorRateResults{errorRate: .0005}
+	r.RunType = "HTTP"
+	r.ActualQPS = 950
+	r.DurationHistogram = h.Export().CalcPercentiles([]float64{99})
+	slos, err := ParseSLOs("p99<200ms,error-rate<0.1%,qps>900")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := Assert(slos, r)
+	if !v.Passed || len(v.Assertions) != 3 || r.Verdict != v {
+		t.Errorf("unexpected verdict %+v", v)
+	}
+	var b bytes.Buffer
+	v.Print(&b, "run 1")
+	if !strings.Contains(b.String(), "Assert qps>900 : ok (qps 950 > 900)\n") ||
+		!strings.HasSuffix(b.String(), "Verdict for run 1: PASS\n") {
+		t.Errorf("unexpected output %q", b.String())
+	}
+	// The verdict is saved in the json results.
+	j, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(j), `"Verdict":{"Passed":true,"Assertions":[{"Text":"p99\u003c200ms"`) {
+		t.Errorf("verdict not in the json %s", j)
+	}
+	r.ActualQPS = 800
+	if v = Assert(slos, r); v.Passed || !v.Assertions[0].Passed || v.Assertions[2].Passed {
+		t.Errorf("unexpected verdict for the qps failure %+v", v)
+	}
+	// Assertions that can't be checked fail the verdict.
+	r2 := &RunnerResults{RunType: "TCP", ActualQPS: 1000, DurationHistogram: r.DurationHistogram}
+	if v = Assert(slos, r2); v.Passed || v.Assertions[1].Skipped == "" {
+		t.Errorf("unexpected verdict without error rate %+v", v)
+	}
+	b.Reset()
+	v.Print(&b, "run 2")
+	if !strings.Contains(b.String(), "Assert error-rate<0.1% : FAILED (unchecked) (no error rate for TCP results)\n") ||
+		!strings.HasSuffix(b.String(), "Verdict for run 2: FAIL\n") {
+		t.Errorf("unexpected output %q", b.String())
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backoffer is optionally implemented by the Runnables to pause before their
+// next call, e.g. backing off while the target is unavailable instead of
+// spinning on connection errors. Like the think time, the pause isn't part of
+// the call's duration and is excluded from the qps pacing.
+type Backoffer interface {
+	Backoff() time.Duration
+}
+
+// UnavailableWindow is a period of the run during which the target was
+// unavailable (e.g. restarting): all the calls failed to connect or had their
+// connection reset.
+type UnavailableWindow struct {
+	Start    time.Duration // offset from the start of the run
+	Duration time.Duration
+	Errors   int64 // failed calls during the window
+}
+
+// AvailabilityTracker detects the windows during which the target is
+// unavailable from the outcome of the calls of all the threads: a window
+// starts with a connection failure and ends with the next successful call,
+// when there were at least minErrors failures in between (so isolated errors
+// don't count as the target being down). It's safe for concurrent use.
+type AvailabilityTracker struct {
+	minErrors int64
+	errors    int64 // of the current streak, accessed atomically for the fast path
+	mu        sync.Mutex
+	start     time.Time // of the current streak
+	windows   []unavailable
+}
+
+type unavailable struct {
+	start, end time.Time
+	errors     int64
+}
+
+// NewAvailabilityTracker returns a tracker counting minErrors (at least 1)
+// consecutive failures as the target being unavailable.
+func NewAvailabilityTracker(minErrors int64) *AvailabilityTracker {
+	if minErrors < 1 {
+		minErrors = 1
+	}
+	return &AvailabilityTracker{minErrors: minErrors}
+}
+
+// Record records the outcome of a call: false when it failed to connect.
+func (a *AvailabilityTracker) Record(ok bool) {
+	if ok && atomic.LoadInt64(&a.errors) == 0 {
+		return // available, as before
+	}
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !ok {
+		if a.errors == 0 {
+			a.start = now
+		}
+		atomic.AddInt64(&a.errors, 1)
+		return
+	}
+	a.end(now)
+}
+
+// end ends the current streak of failures, as a window when long enough.
+func (a *AvailabilityTracker) end(now time.Time) {
+	if a.errors >= a.minErrors {
+		a.windows = append(a.windows, unavailable{a.start, now, a.errors})
+	}
+	atomic.StoreInt64(&a.errors, 0)
+}
+
+// Windows returns the unavailable windows, relative to the start of the run,
+// including the one still ongoing at its end.
+func (a *AvailabilityTracker) Windows(start, end time.Time) []UnavailableWindow {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.errors > 0 {
+		a.end(end)
+	}
+	var res []UnavailableWindow
+	for _, w := range a.windows {
+		res = append(res, UnavailableWindow{Start: w.start.Sub(start), Duration: w.end.Sub(w.start), Errors: w.errors})
+	}
+	return res
+}
+
+// PrintUnavailable prints the unavailable windows, if any.
+func PrintUnavailable(out io.Writer, windows []UnavailableWindow) {
+	for _, w := range windows {
+		_, _ = fmt.Fprintf(out, "Target unavailable [%v-%v] for %v : %d errors\n", w.Start.Round(time.Millisecond),
+			(w.Start + w.Duration).Round(time.Millisecond), w.Duration.Round(time.Millisecond), w.Errors)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// BundleSuffix is the file name suffix of the run bundles in the data dir.
+	BundleSuffix = "_bundle.tar.gz"
+	// MaxErrorSamples is the number of warning and error log lines kept by ConsoleCapture.
+	MaxErrorSamples = 100
+	// MaxConsoleLog is the size of the console log kept by ConsoleCapture, the
+	// rest being truncated.
+	MaxConsoleLog = 16 << 20
+)
+
+// Bundle is the content of a run bundle, see WriteBundle.
+type Bundle struct {
+	// Results are the run's results (json serialized as is).
+	Results interface{}
+	// Metadata is the environment metadata of the run, its Flags being the
+	// effective configuration.
+	Metadata *RunMetadata
+	// Console is the capture of the run's console output and logs, if any.
+	Console *ConsoleCapture
+	// Secrets are values (e.g. of the SensitiveFlags, see SecretValues) to
+	// redact wherever they appear in the config and console log.
+	Secrets []string
+}
+
+// WriteBundle writes the bundle as a tar.gz of:
+//   result.json   the results
+//   config.json   the effective value of the flags
+//   metadata.json the environment metadata (os, go version, hostname, ips,...)
+//   errors.txt    the first MaxErrorSamples warning and error lines of the console log
+//   console.log   the console output and logs of the run.
+// The credentials (see Redact and Bundle.Secrets) are redacted from the config,
+// errors and console log.
+func WriteBundle(w io.Writer, b *Bundle) error {
+	redact := func(s string) string {
+		s = Redact(s)
+		for _, secret := range b.Secrets {
+			if secret != "" {
+				s = strings.ReplaceAll(s, secret, redacted)
+			}
+		}
+		return s
+	}
+	gz := gzip.NewWriter(w)
+	t := tar.NewWriter(gz)
+	now := time.Now()
+	add := func(name string, data []byte) error {
+		hdr := tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), ModTime: now, Typeflag: tar.TypeReg}
+		if err := t.WriteHeader(&hdr); err != nil {
+			return fmt.Errorf("unable to add %s to the bundle: %w", name, err)
+		}
+		if _, err := t.Write(data); err != nil {
+			return fmt.Errorf("unable to add %s to the bundle: %w", name, err)
+		}
+		return nil
+	}
+	addJSON := func(name string, v interface{}) error {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return fmt.Errorf("unable to serialize %s: %w", name, err)
+		}
+		return add(name, append(data, '\n'))
+	}
+	if err := addJSON("result.json", b.Results); err != nil {
+		return err
+	}
+	var metadata RunMetadata
+	config := map[string]string{}
+	if b.Metadata != nil {
+		metadata = *b.Metadata // copy
+		for k, v := range metadata.Flags {
+			config[k] = redact(v)
+		}
+		metadata.Flags = nil // in config.json
+	}
+	if err := addJSON("config.json", config); err != nil {
+		return err
+	}
+	if err := addJSON("metadata.json", &metadata); err != nil {
+		return err
+	}
+	var errors, console []byte
+	if b.Console != nil {
+		errors = []byte(redact(strings.Join(b.Console.ErrorSamples(), "")))
+		console = []byte(redact(string(b.Console.Bytes())))
+	}
+	if err := add("errors.txt", errors); err != nil {
+		return err
+	}
+	if err := add("console.log", console); err != nil {
+		return err
+	}
+	if err := t.Close(); err != nil {
+		return fmt.Errorf("unable to write the bundle: %w", err)
+	}
+	return gz.Close()
+}
+
+// Log lines prefix ("15:04:05 W ..."), with the level's first letter.
+var logLevelRegexp = regexp.MustCompile(`^(?:[0-9/]+ )?(?:[0-9:.]+ )?([WECF]) `)
+
+// ConsoleCapture is a writer keeping a copy of what is written to it (up to
+// MaxConsoleLog) and of the first MaxErrorSamples warning (or more severe)
+// log lines, while passing it through to Out. It's safe for concurrent use.
+type ConsoleCapture struct {
+	Out       io.Writer
+	mutex     sync.Mutex
+	buf       bytes.Buffer
+	truncated bool
+	partial   []byte // incomplete last line, for the error samples
+	samples   []string
+}
+
+// NewConsoleCapture returns a capture passing the output through to out.
+func NewConsoleCapture(out io.Writer) *ConsoleCapture {
+	return &ConsoleCapture{Out: out}
+}
+
+// Write implements io.Writer.
+func (c *ConsoleCapture) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	if room := MaxConsoleLog - c.buf.Len(); room >= len(p) {
+		c.buf.Write(p)
+	} else if !c.truncated {
+		c.buf.Write(p[:room])
+		c.buf.WriteString("\n... truncated ...\n")
+		c.truncated = true
+	}
+	c.partial = append(c.partial, p...)
+	for {
+		i := bytes.IndexByte(c.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := c.partial[:i+1]
+		if len(c.samples) < MaxErrorSamples && logLevelRegexp.Match(line) {
+			c.samples = append(c.samples, string(line))
+		}
+		c.partial = c.partial[i+1:]
+	}
+	c.mutex.Unlock()
+	if c.Out == nil {
+		return len(p), nil
+	}
+	return c.Out.Write(p)
+}
+
+// Bytes returns a copy of the captured output.
+func (c *ConsoleCapture) Bytes() []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]byte(nil), c.buf.Bytes()...)
+}
+
+// ErrorSamples returns the captured warning and error log lines.
+func (c *ConsoleCapture) ErrorSamples() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.samples...)
+}
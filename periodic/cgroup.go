@@ -0,0 +1,181 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"bufio"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"fortio.org/fortio/log"
+)
+
+// ContainerLimits are the cpu and memory limits of the (cgroup v1 or v2)
+// container fortio runs in.
+type ContainerLimits struct {
+	// Cpu quota in number of cores (e.g. 1.5), -1 when not limited or unknown.
+	CPUQuota float64
+	// Memory limit in bytes, -1 when not limited or unknown.
+	MemoryLimit int64
+}
+
+// CgroupRoot is where the cgroup file system is mounted.
+var CgroupRoot = "/sys/fs/cgroup"
+
+var (
+	containerLimits     ContainerLimits
+	containerLimitsOnce sync.Once
+)
+
+// DetectedContainerLimits returns the container limits, detected once.
+func DetectedContainerLimits() ContainerLimits {
+	containerLimitsOnce.Do(func() {
+		containerLimits = ReadContainerLimits(CgroupRoot, "/proc/self/cgroup")
+		log.LogVf("Detected container limits %+v", containerLimits)
+	})
+	return containerLimits
+}
+
+// ReadContainerLimits reads the limits from the cgroup file system mounted
+// at root for the process whose cgroup membership file is procCgroup.
+func ReadContainerLimits(root, procCgroup string) ContainerLimits {
+	l := ContainerLimits{CPUQuota: -1, MemoryLimit: -1}
+	paths := cgroupPaths(procCgroup)
+	// cgroup v2: unified hierarchy ("" controller).
+	for _, dir := range cgroupDirs(root, "", paths) {
+		if q, ok := readCPUMax(filepath.Join(dir, "cpu.max")); ok {
+			l.CPUQuota = q
+			l.MemoryLimit = readLimit(filepath.Join(dir, "memory.max"))
+			return l
+		}
+	}
+	// cgroup v1:
+	for _, dir := range cgroupDirs(root, "cpu", paths) {
+		quota := readLimit(filepath.Join(dir, "cpu.cfs_quota_us"))
+		period := readLimit(filepath.Join(dir, "cpu.cfs_period_us"))
+		if period > 0 {
+			if quota > 0 {
+				l.CPUQuota = float64(quota) / float64(period)
+			}
+			break
+		}
+	}
+	for _, dir := range cgroupDirs(root, "memory", paths) {
+		if limit := readLimit(filepath.Join(dir, "memory.limit_in_bytes")); limit > 0 {
+			l.MemoryLimit = limit
+			break
+		}
+	}
+	return l
+}
+
+// cgroupPaths returns the path of the process' group for each controller
+// ("" for the v2 unified hierarchy).
+func cgroupPaths(procCgroup string) map[string]string {
+	res := make(map[string]string)
+	f, err := os.Open(procCgroup)
+	if err != nil {
+		return res
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		for _, controller := range strings.Split(parts[1], ",") {
+			res[controller] = parts[2]
+		}
+	}
+	return res
+}
+
+// cgroupDirs returns the directories to look into for a controller: the
+// process' own group then the root (which is the process' group when the
+// container has its own cgroup namespace).
+func cgroupDirs(root, controller string, paths map[string]string) []string {
+	base := filepath.Join(root, controller)
+	if p, ok := paths[controller]; ok && p != "/" {
+		return []string{filepath.Join(base, p), base}
+	}
+	return []string{base}
+}
+
+// readCPUMax parses a cgroup v2 cpu.max file ("max 100000" or "150000 100000").
+// Returns false if the file isn't there.
+func readCPUMax(path string) (float64, bool) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return -1, false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 || fields[0] == "max" {
+		return -1, true
+	}
+	quota, err1 := strconv.ParseFloat(fields[0], 64)
+	period, err2 := strconv.ParseFloat(fields[1], 64)
+	if err1 != nil || err2 != nil || quota <= 0 || period <= 0 {
+		log.Warnf("Unexpected cpu.max content %q", data)
+		return -1, true
+	}
+	return quota / period, true
+}
+
+// unlimitedThreshold is above what a cgroup v1 memory limit is considered to
+// be no limit (it's reported as the max int64 rounded to the page size).
+const unlimitedThreshold = int64(1) << 60
+
+// readLimit returns the number in the file or -1 for missing/"max"/unlimited.
+func readLimit(path string) int64 {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return -1
+	}
+	s := strings.TrimSpace(string(data))
+	if s == "max" {
+		return -1
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v <= 0 || v >= unlimitedThreshold {
+		return -1
+	}
+	return v
+}
+
+// GOMAXPROCSForQuota returns the GOMAXPROCS matching the cpu quota: rounded up
+// and not more than the current value. Returns the current value when there
+// is no quota.
+func GOMAXPROCSForQuota(l ContainerLimits) int {
+	current := runtime.GOMAXPROCS(0)
+	if l.CPUQuota <= 0 {
+		return current
+	}
+	n := int(math.Ceil(l.CPUQuota))
+	if n < 1 {
+		n = 1
+	}
+	if n > current {
+		return current
+	}
+	return n
+}
@@ -0,0 +1,100 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func writeCgroupFiles(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadContainerLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		expected ContainerLimits
+	}{
+		{"none", map[string]string{}, ContainerLimits{-1, -1}},
+		{"v2 limited", map[string]string{
+			"proc":                  "0::/\n",
+			"cgroup/cpu.max":        "150000 100000\n",
+			"cgroup/memory.max":     "536870912\n",
+			"cgroup/memory.current": "1234\n",
+		}, ContainerLimits{1.5, 512 << 20}},
+		{"v2 unlimited", map[string]string{
+			"cgroup/cpu.max":    "max 100000\n",
+			"cgroup/memory.max": "max\n",
+		}, ContainerLimits{-1, -1}},
+		{"v2 own group", map[string]string{
+			"proc":                         "0::/kubepods/pod1\n",
+			"cgroup/cpu.max":               "max 100000\n",
+			"cgroup/kubepods/pod1/cpu.max": "50000 100000\n",
+		}, ContainerLimits{0.5, -1}},
+		{"v1 limited", map[string]string{
+			"proc":                         "4:memory:/docker/abc\n2:cpu,cpuacct:/\n",
+			"cgroup/cpu/cpu.cfs_quota_us":  "200000\n",
+			"cgroup/cpu/cpu.cfs_period_us": "100000\n",
+			"cgroup/memory/docker/abc/memory.limit_in_bytes": "1073741824\n",
+			"cgroup/memory/memory.limit_in_bytes":            "9223372036854771712\n",
+		}, ContainerLimits{2, 1 << 30}},
+		{"v1 unlimited", map[string]string{
+			"cgroup/cpu/cpu.cfs_quota_us":         "-1\n",
+			"cgroup/cpu/cpu.cfs_period_us":        "100000\n",
+			"cgroup/memory/memory.limit_in_bytes": "9223372036854771712\n",
+		}, ContainerLimits{-1, -1}},
+	}
+	for _, tst := range tests {
+		dir := t.TempDir()
+		writeCgroupFiles(t, dir, tst.files)
+		l := ReadContainerLimits(filepath.Join(dir, "cgroup"), filepath.Join(dir, "proc"))
+		if l != tst.expected {
+			t.Errorf("%s: got %+v, expected %+v", tst.name, l, tst.expected)
+		}
+	}
+}
+
+func TestGOMAXPROCSForQuota(t *testing.T) {
+	prev := runtime.GOMAXPROCS(4)
+	defer runtime.GOMAXPROCS(prev)
+	tests := []struct {
+		quota    float64
+		expected int
+	}{
+		{-1, 4},
+		{0.2, 1},
+		{1.5, 2},
+		{3, 3},
+		{16, 4}, // never raised
+	}
+	for _, tst := range tests {
+		if n := GOMAXPROCSForQuota(ContainerLimits{CPUQuota: tst.quota}); n != tst.expected {
+			t.Errorf("quota %g: got %d, expected %d", tst.quota, n, tst.expected)
+		}
+	}
+}
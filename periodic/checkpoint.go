@@ -0,0 +1,172 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/stats"
+)
+
+// Checkpoint is the intermediate result of a run for the window since the
+// previous checkpoint (not cumulative), see RunnerOptions.CheckpointInterval.
+type Checkpoint struct {
+	RunType       string
+	Labels        string
+	StartTime     time.Time // of the run
+	RunID         int64
+	SchemaVersion int
+	// Index of the checkpoint, starting at 1.
+	Index          int
+	WindowStart    time.Time
+	WindowDuration time.Duration
+	// Calls completed during the window and their rate.
+	Count     int64
+	ActualQPS float64
+	// Duration of the calls completed during the window, nil if none.
+	DurationHistogram *stats.HistogramData
+}
+
+// ID returns an id for the checkpoint: the run's ID() followed by its index.
+func (c *Checkpoint) ID() string {
+	r := RunnerResults{StartTime: c.StartTime, Labels: c.Labels, RunID: c.RunID}
+	return fmt.Sprintf("%s_checkpoint%d", r.ID(), c.Index)
+}
+
+// Summary returns a one line summary of the checkpoint window: its offset from the
+// start of the run, its calls and rate, and the latency average and percentiles.
+func (c *Checkpoint) Summary() string {
+	offset := c.WindowStart.Sub(c.StartTime).Round(time.Millisecond)
+	end := offset + c.WindowDuration.Round(time.Millisecond)
+	res := fmt.Sprintf("Interval %d [%v-%v] : %d calls qps=%.5g", c.Index, offset, end, c.Count, c.ActualQPS)
+	if h := c.DurationHistogram; h != nil {
+		res += fmt.Sprintf(" avg %.6g", h.Avg)
+		for _, p := range h.Percentiles {
+			res += fmt.Sprintf(" p%g %.6g", p.Percentile, p.Value)
+		}
+		res += fmt.Sprintf(" max %.6g", h.Max)
+	}
+	return res
+}
+
+// windowHistogram is a thread's function duration histogram for the current
+// checkpoint window. The lock is only contended when a checkpoint collects it.
+type windowHistogram struct {
+	sync.Mutex
+	h *stats.Histogram
+}
+
+func (w *windowHistogram) record(v float64) {
+	w.Lock()
+	w.h.Record(v)
+	w.Unlock()
+}
+
+// checkpointer collects the threads' window histograms every CheckpointInterval
+// and calls OnCheckpoint with the result.
+type checkpointer struct {
+	r       *periodicRunner
+	windows []*windowHistogram
+	merged  *stats.Histogram
+	start   time.Time // of the run
+	window  time.Time // start of the current window
+	index   int
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// newCheckpointer returns nil when not checkpointing.
+func newCheckpointer(r *periodicRunner, functionDuration *stats.Histogram, start time.Time) *checkpointer {
+	if r.CheckpointInterval <= 0 || r.OnCheckpoint == nil {
+		return nil
+	}
+	c := &checkpointer{
+		r:       r,
+		windows: make([]*windowHistogram, r.NumThreads),
+		merged:  stats.NewHistogramOfType(functionDuration.Type(), functionDuration.Offset, functionDuration.Divider),
+		start:   start,
+		window:  start,
+		done:    make(chan struct{}),
+	}
+	for t := range c.windows {
+		c.windows[t] = &windowHistogram{h: c.merged.Clone()}
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(r.CheckpointInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.checkpoint()
+			case <-c.done:
+				return
+			}
+		}
+	}()
+	return c
+}
+
+// thread returns the window histogram of thread t, nil when not checkpointing.
+func (c *checkpointer) thread(t int) *windowHistogram {
+	if c == nil {
+		return nil
+	}
+	return c.windows[t]
+}
+
+// checkpoint reports the window ending now and starts the next one.
+func (c *checkpointer) checkpoint() {
+	now := time.Now()
+	for _, w := range c.windows {
+		w.Lock()
+		c.merged.Transfer(w.h)
+		w.Unlock()
+	}
+	c.index++
+	cp := Checkpoint{
+		RunType:        c.r.runType(),
+		Labels:         c.r.Labels,
+		StartTime:      c.start,
+		RunID:          c.r.RunID,
+		SchemaVersion:  SchemaVersion,
+		Index:          c.index,
+		WindowStart:    c.window,
+		WindowDuration: now.Sub(c.window),
+		Count:          c.merged.Count,
+	}
+	cp.ActualQPS = float64(cp.Count) / cp.WindowDuration.Seconds()
+	if cp.Count > 0 {
+		cp.DurationHistogram = c.merged.Export().CalcPercentiles(c.r.Percentiles)
+	}
+	c.merged.Reset()
+	c.window = now
+	log.Infof("Checkpoint %d: %d calls in %v, qps=%.5g", cp.Index, cp.Count, cp.WindowDuration, cp.ActualQPS)
+	c.r.OnCheckpoint(&cp)
+}
+
+// stop stops the periodic checkpoints and reports the last (partial) window.
+func (c *checkpointer) stop() {
+	if c == nil {
+		return
+	}
+	close(c.done)
+	c.wg.Wait()
+	c.checkpoint()
+}
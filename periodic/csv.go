@@ -0,0 +1,100 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// CSV row types, the first column of each row.
+const (
+	CSVRunRow    = "run"
+	CSVBucketRow = "bucket"
+)
+
+// CSVHeader returns the header of the csv rows of results: the common columns,
+// one column per percentile of percList and the histogram bucket columns.
+func CSVHeader(percList []float64) []string {
+	h := []string{
+		"type", "id", "start_time", "labels", "run_type", "num_threads", "requested_qps", "actual_qps",
+		"requested_duration", "actual_duration_s", "count", "min", "max", "avg", "stddev",
+	}
+	for _, p := range percList {
+		h = append(h, "p"+formatFloat(p))
+	}
+	return append(h, "bucket_start", "bucket_end", "bucket_percent", "bucket_count")
+}
+
+// CSVRows returns the flat csv rows of the results, matching CSVHeader(percList):
+// one "run" row followed, when buckets is true, by one "bucket" row per histogram
+// bucket (with only the identifying and bucket columns set).
+func (r *RunnerResults) CSVRows(percList []float64, buckets bool) [][]string {
+	h := r.DurationHistogram
+	row := []string{
+		CSVRunRow, r.ID(), r.StartTime.Format(time.RFC3339Nano), r.Labels, r.RunType, strconv.Itoa(r.NumThreads),
+		r.RequestedQPS, formatFloat(r.ActualQPS), r.RequestedDuration, formatFloat(r.ActualDuration.Seconds()),
+		strconv.FormatInt(h.Count, 10), formatFloat(h.Min), formatFloat(h.Max), formatFloat(h.Avg), formatFloat(h.StdDev),
+	}
+	for _, p := range percList {
+		v := ""
+		for _, hp := range h.Percentiles {
+			if hp.Percentile == p {
+				v = formatFloat(hp.Value)
+				break
+			}
+		}
+		row = append(row, v)
+	}
+	rows := [][]string{append(row, "", "", "", "")}
+	if !buckets {
+		return rows
+	}
+	for _, b := range h.Data {
+		bRow := make([]string, len(row), len(row)+4)
+		bRow[0], bRow[1], bRow[2], bRow[3] = CSVBucketRow, row[1], row[2], row[3]
+		rows = append(rows, append(bRow, formatFloat(b.Start), formatFloat(b.End), formatFloat(b.Percent),
+			strconv.FormatInt(b.Count, 10)))
+	}
+	return rows
+}
+
+// WriteCSV writes the csv rows of the results to w, preceded by the header
+// when header is true (i.e. when not appending to an existing csv).
+func WriteCSV(w io.Writer, results []*RunnerResults, percList []float64, buckets, header bool) error {
+	cw := csv.NewWriter(w)
+	if header {
+		if err := cw.Write(CSVHeader(percList)); err != nil {
+			return err
+		}
+	}
+	for _, r := range results {
+		if r.DurationHistogram == nil {
+			return fmt.Errorf("no duration histogram in %s results", r.ID())
+		}
+		if err := cw.WriteAll(r.CSVRows(percList, buckets)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
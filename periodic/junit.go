@@ -0,0 +1,120 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// JUnit XML report (the de facto format Jenkins, GitLab,... consume), see
+// https://github.com/testmoapp/junitxml
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+	SystemOut string          `xml:"system-out,omitempty"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure"`
+	Skipped   *junitMessage `xml:"skipped"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+}
+
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// WriteJUnit writes the JUnit XML report of the results (e.g. the stages of a
+// staged run), one test suite per result with one test case per SLO, passed or
+// failed (or skipped when it doesn't apply), or a single "run" test case when
+// there are no SLOs. Returns the number of failed test cases.
+func WriteJUnit(w io.Writer, results []HasRunnerResult, slos []SLO) (int, error) {
+	report := junitTestSuites{Name: "fortio"}
+	var total time.Duration
+	for _, r := range results {
+		rr := r.Result()
+		suite := junitTestSuite{
+			Name:      rr.ID(),
+			Time:      junitSeconds(rr.ActualDuration),
+			Timestamp: rr.StartTime.Format("2006-01-02T15:04:05"),
+		}
+		if rr.Labels != "" {
+			suite.Name = rr.Labels
+		}
+		className := "fortio." + strings.ReplaceAll(strings.ToLower(rr.RunType), " ", "_")
+		if h := rr.DurationHistogram; h != nil {
+			suite.SystemOut = fmt.Sprintf("%d calls, %.1f qps, avg %.6g s, min %.6g s, max %.6g s",
+				h.Count, rr.ActualQPS, h.Avg, h.Min, h.Max)
+		}
+		if len(slos) == 0 {
+			suite.Cases = append(suite.Cases, junitTestCase{Name: "run", ClassName: className, Time: suite.Time})
+		}
+		for _, c := range CheckSLOs(slos, r) {
+			tc := junitTestCase{Name: c.Text, ClassName: className, Time: suite.Time}
+			switch {
+			case c.Skipped != "":
+				tc.Skipped = &junitMessage{Message: c.String()}
+				suite.Skipped++
+			case !c.Passed:
+				tc.Failure = &junitMessage{Message: c.String()}
+				suite.Failures++
+			}
+			suite.Cases = append(suite.Cases, tc)
+		}
+		suite.Tests = len(suite.Cases)
+		report.Tests += suite.Tests
+		report.Failures += suite.Failures
+		report.Skipped += suite.Skipped
+		total += rr.ActualDuration
+		report.Suites = append(report.Suites, suite)
+	}
+	report.Time = junitSeconds(total)
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return report.Failures, err
+	}
+	e := xml.NewEncoder(w)
+	e.Indent("", "  ")
+	if err := e.Encode(&report); err != nil {
+		return report.Failures, err
+	}
+	_, err := io.WriteString(w, "\n")
+	return report.Failures, err
+}
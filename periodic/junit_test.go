@@ -0,0 +1,128 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+
+	"fortio.org/fortio/stats"
+)
+
+func TestParseSLOs(t *testing.T) {
+	slos, err := ParseSLOs("p99<250ms, error-rate<1%,qps>100,avg<0.01,p99.9<1s,error-rate<0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []SLO{
+		{"p99<250ms", "p99", 99, true, .25},
+		{"error-rate<1%", SLOErrorRate, 0, true, .01},
+		{"qps>100", SLOQPS, 0, false, 100},
+		{"avg<0.01", SLOAvg, 0, true, .01},
+		{"p99.9<1s", "p99.9", 99.9, true, 1},
+		{"error-rate<0.5", SLOErrorRate, 0, true, .5},
+	}
+	if len(slos) != len(expected) {
+		t.Fatalf("unexpected slos %+v", slos)
+	}
+	for i := range slos {
+		if slos[i] != expected[i] {
+			t.Errorf("slo %d: got %+v expected %+v", i, slos[i], expected[i])
+		}
+	}
+	if slos, err = ParseSLOs(""); err != nil || slos != nil {
+		t.Errorf("expected no slos for empty, got %v %v", slos, err)
+	}
+	for _, bad := range []string{"p99", "p99<", "<1", "p0<1", "p101<1", "px<1", "p99<x", "foo<1", "qps>1%"} {
+		if _, err := ParseSLOs(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+type errorRateResults struct {
+	RunnerResults
+	errorRate float64
+}
+
+func (r *errorRateResults) ErrorRate() float64 {
+	return r.errorRate
+}
+
+func TestErrorRate(t *testing.T) {
+	counts := map[string]int64{"OK": 6, "NIL": 2, "timeout": 2}
+	if r := ErrorRate(counts, "OK"); r != .4 {
+		t.Errorf("unexpected error rate %g", r)
+	}
+	if r := ErrorRate(counts, "OK", "NIL"); r != .2 {
+		t.Errorf("unexpected error rate %g", r)
+	}
+	if r := ErrorRate(nil, "OK"); r != 0 {
+		t.Errorf("unexpected error rate %g for no calls", r)
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	h := stats.NewHistogram(0, .001)
+	for i := 1; i <= 100; i++ {
+		h.Record(float64(i) / 1000.)
+	}
+	r1 := &errorRateResults{errorRate: .02}
+	r1.RunType = "HTTP"
+	r1.Labels = "run 1"
+	r1.ActualQPS = 50
+	r1.ActualDuration = 2 * time.Second
+	r1.DurationHistogram = h.Export().CalcPercentiles([]float64{50})
+	r2 := &RunnerResults{RunType: "TCP", Labels: "run 2", ActualQPS: 200, ActualDuration: time.Second,
+		DurationHistogram: r1.DurationHistogram}
+	slos, err := ParseSLOs("p99<50ms,error-rate<1%,qps>100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	failures, err := WriteJUnit(&b, []HasRunnerResult{r1, r2}, slos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// r1 fails all 3, r2 fails p99 and skips the error rate:
+	if failures != 4 {
+		t.Errorf("unexpected %d failures", failures)
+	}
+	report := junitTestSuites{}
+	if err = xml.Unmarshal(b.Bytes(), &report); err != nil {
+		t.Fatalf("invalid xml %v: %s", err, b.String())
+	}
+	if report.Tests != 6 || report.Failures != 4 || report.Skipped != 1 || report.Time != "3.000" || len(report.Suites) != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	s1, s2 := report.Suites[0], report.Suites[1]
+	if s1.Name != "run 1" || s1.Failures != 3 || s1.Cases[0].ClassName != "fortio.http" ||
+		s1.Cases[0].Failure == nil || !strings.HasPrefix(s1.Cases[0].Failure.Message, "p99 0.099") ||
+		s1.Cases[1].Failure == nil || s1.Cases[1].Failure.Message != "error-rate 0.02 >= 0.01" {
+		t.Errorf("unexpected first suite %+v", s1)
+	}
+	if s2.Name != "run 2" || s2.Failures != 1 || s2.Skipped != 1 || s2.Cases[1].Skipped == nil ||
+		s2.Cases[1].Skipped.Message != "no error rate for TCP results" || s2.Cases[2].Failure != nil || s2.Cases[2].Skipped != nil {
+		t.Errorf("unexpected second suite %+v", s2)
+	}
+	b.Reset()
+	if failures, err = WriteJUnit(&b, []HasRunnerResult{r2}, nil); err != nil || failures != 0 ||
+		!strings.Contains(b.String(), `<testcase name="run" classname="fortio.tcp" time="1.000">`) {
+		t.Errorf("unexpected report without slos %v: %s", err, b.String())
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic // import "fortio.org/fortio/periodic"
+
+import (
+	"fmt"
+	"strconv"
+
+	"fortio.org/fortio/stats"
+)
+
+// MergeResults returns the combination of the results a and b of a run made at
+// the same time by several load generators (e.g. pods) against the same target,
+// for a single report: the run covers both (from the first start to the last
+// end), their qps and connections add up and the histograms are merged (see
+// stats.MergeData). The details specific to each generator (metadata, client
+// stats, timeseries, steps,...) aren't kept. The run types must match.
+func MergeResults(a, b *RunnerResults) (*RunnerResults, error) {
+	if a.RunType != b.RunType {
+		return nil, fmt.Errorf("can't merge %s results with %s ones", a.RunType, b.RunType)
+	}
+	res := RunnerResults{
+		RunType:            a.RunType,
+		Labels:             joinDistinct(a.Labels, b.Labels),
+		StartTime:          a.StartTime,
+		RequestedQPS:       mergeRequestedQPS(a.RequestedQPS, b.RequestedQPS),
+		RequestedDuration:  joinDistinct(a.RequestedDuration, b.RequestedDuration),
+		ActualQPS:          a.ActualQPS + b.ActualQPS,
+		NumThreads:         a.NumThreads + b.NumThreads,
+		Version:            a.Version,
+		SchemaVersion:      a.SchemaVersion,
+		DurationHistogram:  stats.MergeData(a.DurationHistogram, b.DurationHistogram),
+		Exactly:            a.Exactly + b.Exactly,
+		Jitter:             a.Jitter,
+		Arrival:            a.Arrival,
+		RunID:              a.RunID,
+		ScheduledHistogram: stats.MergeData(a.ScheduledHistogram, b.ScheduledHistogram),
+		WarmupCalls:        a.WarmupCalls + b.WarmupCalls,
+		WarmupHistogram:    stats.MergeData(a.WarmupHistogram, b.WarmupHistogram),
+		HistogramType:      a.HistogramType,
+	}
+	if b.StartTime.Before(res.StartTime) {
+		res.StartTime = b.StartTime
+	}
+	end := a.StartTime.Add(a.ActualDuration)
+	if bEnd := b.StartTime.Add(b.ActualDuration); bEnd.After(end) {
+		end = bEnd
+	}
+	res.ActualDuration = end.Sub(res.StartTime)
+	res.WarmupDuration = a.WarmupDuration
+	if b.WarmupDuration > res.WarmupDuration {
+		res.WarmupDuration = b.WarmupDuration
+	}
+	return &res, nil
+}
+
+// joinDistinct returns a, or "a + b" when they differ (and b isn't empty).
+func joinDistinct(a, b string) string {
+	if a == b || b == "" {
+		return a
+	}
+	if a == "" {
+		return b
+	}
+	return a + " + " + b
+}
+
+// mergeRequestedQPS returns the sum of the requested qps, "max" if either was.
+func mergeRequestedQPS(a, b string) string {
+	if a == "max" || b == "max" {
+		return "max"
+	}
+	qa, errA := strconv.ParseFloat(a, 64)
+	qb, errB := strconv.ParseFloat(b, 64)
+	if errA != nil || errB != nil {
+		return joinDistinct(a, b) // schedules
+	}
+	return fmt.Sprintf("%.9g", qa+qb)
+}
+
+// MergeableResults is the part of the json results of any of the runners which
+// can be merged (see Merge): the RunnerResults plus, when present, the target,
+// the count per return code (or status) and the response sizes.
+type MergeableResults struct {
+	RunnerResults
+	URL         string               `json:",omitempty"` // http
+	Destination string               `json:",omitempty"` // tcp, udp, grpc,...
+	RetCodes    map[string]int64     `json:",omitempty"`
+	Sizes       *stats.HistogramData `json:",omitempty"`
+	HeaderSizes *stats.HistogramData `json:",omitempty"`
+}
+
+// Merge returns the combination of the results m and o (see MergeResults).
+func (m *MergeableResults) Merge(o *MergeableResults) (*MergeableResults, error) {
+	rr, err := MergeResults(&m.RunnerResults, &o.RunnerResults)
+	if err != nil {
+		return nil, err
+	}
+	res := MergeableResults{
+		RunnerResults: *rr,
+		URL:           joinDistinct(m.URL, o.URL),
+		Destination:   joinDistinct(m.Destination, o.Destination),
+		Sizes:         stats.MergeData(m.Sizes, o.Sizes),
+		HeaderSizes:   stats.MergeData(m.HeaderSizes, o.HeaderSizes),
+	}
+	if m.RetCodes != nil || o.RetCodes != nil {
+		res.RetCodes = make(map[string]int64)
+		for _, codes := range []map[string]int64{m.RetCodes, o.RetCodes} {
+			for code, n := range codes {
+				res.RetCodes[code] += n
+			}
+		}
+	}
+	return &res, nil
+}
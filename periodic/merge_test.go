@@ -0,0 +1,69 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"fortio.org/fortio/stats"
+)
+
+func TestMergeResults(t *testing.T) {
+	start := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	h1, h2 := stats.NewHistogram(0, .001), stats.NewHistogram(0, .001)
+	for i := 0; i < 100; i++ {
+		h1.Record(.010 + float64(i%2)*.002)
+		h2.Record(.020 + float64(i%2)*.002)
+	}
+	// As read from the json results of 2 load generators.
+	var a, b MergeableResults
+	if err := json.Unmarshal([]byte(`{"RunType": "HTTP", "Labels": "pod1", "RequestedQPS": "100", "NumThreads": 4,
+		"ActualQPS": 99.5, "URL": "http://svc/", "RetCodes": {"200": 99, "503": 1}}`), &a); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(`{"RunType": "HTTP", "Labels": "pod2", "RequestedQPS": "150", "NumThreads": 6,
+		"ActualQPS": 149, "URL": "http://svc/", "RetCodes": {"200": 100}}`), &b); err != nil {
+		t.Fatal(err)
+	}
+	a.StartTime, a.ActualDuration = start, 10*time.Second
+	b.StartTime, b.ActualDuration = start.Add(-time.Second), 10*time.Second
+	a.DurationHistogram = h1.Export().CalcPercentiles([]float64{50})
+	b.DurationHistogram = h2.Export().CalcPercentiles([]float64{50})
+	m, err := a.Merge(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Labels != "pod1 + pod2" || m.RequestedQPS != "250" || m.NumThreads != 10 || m.ActualQPS != 248.5 ||
+		m.URL != "http://svc/" || !m.StartTime.Equal(b.StartTime) || m.ActualDuration != 11*time.Second {
+		t.Errorf("unexpected merged results %+v", m.RunnerResults)
+	}
+	if m.RetCodes["200"] != 199 || m.RetCodes["503"] != 1 || m.Sizes != nil {
+		t.Errorf("unexpected merged codes %v or sizes %v", m.RetCodes, m.Sizes)
+	}
+	if h := m.DurationHistogram; h.Count != 200 || math.Abs(h.Avg-.016) > 1e-9 || len(h.Percentiles) != 1 {
+		t.Errorf("unexpected merged histogram %+v", h)
+	}
+	b.RequestedQPS = "max"
+	if rr, _ := MergeResults(&a.RunnerResults, &b.RunnerResults); rr.RequestedQPS != "max" {
+		t.Errorf("unexpected merged requested qps %q", rr.RequestedQPS)
+	}
+	b.RunType = "TCP"
+	if _, err = a.Merge(&b); err == nil {
+		t.Errorf("expected an error merging different run types")
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RunMetadata describes the environment a run was made in, so the results
+// are self describing for later analysis.
+type RunMetadata struct {
+	GOOS          string
+	GOARCH        string
+	GoVersion     string
+	KernelVersion string // empty when unavailable (non linux)
+	Hostname      string
+	// Local IPs the connections were made from.
+	ClientIPs []string
+	// Resolved IPs of the target that were connected to.
+	TargetIPs []string
+	// Negotiated TLS version and cipher suite, for TLS runs.
+	TLSVersion string
+	TLSCipher  string
+	// Number of TLS connections made per negotiated parameters (when tracked by the runner).
+	TLSConnections []TLSConnectionCount `json:",omitempty"`
+	// Number of full TLS handshakes per served certificate chain (when tracked by the runner).
+	TLSCertificates []TLSCertificateCount `json:",omitempty"`
+	// Effective value of the command line flags (when run from the command line).
+	Flags map[string]string
+}
+
+// SensitiveFlags are the flags whose values are redacted in the metadata (credentials).
+var SensitiveFlags = map[string]bool{"user": true}
+
+const redacted = "<redacted>"
+
+var (
+	// Password of the URLs' user:password@ userinfo (e.g. -proxy, -push-stats, redis:// and mqtt:// ones).
+	urlPasswordRegexp = regexp.MustCompile(`(://[^/\s:@]*):[^/\s@]+@`)
+	// Value of the credentials headers, as -H flags, request dumps and logs.
+	sensitiveHeaderRegexp = regexp.MustCompile(
+		`(?i)((?:proxy-)?authorization|cookie|x-api-key)(\s*[:=]\s*)[^\r\n]*`)
+)
+
+// Redact returns s with the passwords of the URLs it contains replaced by
+// xxxxx (like url.URL.Redacted) and the values of the credentials headers
+// (Authorization, Proxy-Authorization, Cookie and X-Api-Key) redacted.
+func Redact(s string) string {
+	s = urlPasswordRegexp.ReplaceAllString(s, "$1:xxxxx@")
+	return sensitiveHeaderRegexp.ReplaceAllString(s, "$1$2"+redacted)
+}
+
+// SecretValues returns the (non empty) values of the SensitiveFlags of the flag
+// set, to redact them from the logs (see Bundle.Secrets).
+func SecretValues(fs *flag.FlagSet) []string {
+	var res []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if v := f.Value.String(); SensitiveFlags[f.Name] && v != "" {
+			res = append(res, v)
+		}
+	})
+	return res
+}
+
+func newRunMetadata() *RunMetadata {
+	m := &RunMetadata{
+		GOOS:      runtime.GOOS,
+		GOARCH:    runtime.GOARCH,
+		GoVersion: runtime.Version(),
+	}
+	if data, err := ioutil.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		m.KernelVersion = strings.TrimSpace(string(data))
+	}
+	m.Hostname, _ = os.Hostname()
+	return m
+}
+
+// hostOf returns the ip part of an address (the whole address for non ip ones, e.g. unix sockets).
+func hostOf(a net.Addr) string {
+	host, _, err := net.SplitHostPort(a.String())
+	if err != nil {
+		return a.String()
+	}
+	return host
+}
+
+// addUnique inserts s in the sorted list if not already there.
+func addUnique(list []string, s string) []string {
+	i := sort.SearchStrings(list, s)
+	if i < len(list) && list[i] == s {
+		return list
+	}
+	list = append(list, "")
+	copy(list[i+1:], list[i:])
+	list[i] = s
+	return list
+}
+
+// AddConnection records the addresses and TLS state (nil for non TLS) of a connection.
+func (m *RunMetadata) AddConnection(local, remote net.Addr, tlsState *tls.ConnectionState) {
+	if local != nil {
+		m.ClientIPs = addUnique(m.ClientIPs, hostOf(local))
+	}
+	if remote != nil {
+		m.TargetIPs = addUnique(m.TargetIPs, hostOf(remote))
+	}
+	if tlsState != nil && m.TLSVersion == "" {
+		m.TLSVersion = TLSVersionName(tlsState.Version)
+		m.TLSCipher = tls.CipherSuiteName(tlsState.CipherSuite)
+	}
+}
+
+// TLSConnection is the negotiated parameters of a TLS connection.
+type TLSConnection struct {
+	Version string
+	Cipher  string
+	ALPN    string // negotiated application protocol, empty if none
+	Resumed bool   // session resumption (abbreviated handshake)
+}
+
+// NewTLSConnection returns the negotiated parameters of the TLS connection state.
+func NewTLSConnection(s *tls.ConnectionState) TLSConnection {
+	return TLSConnection{
+		Version: TLSVersionName(s.Version),
+		Cipher:  tls.CipherSuiteName(s.CipherSuite),
+		ALPN:    s.NegotiatedProtocol,
+		Resumed: s.DidResume,
+	}
+}
+
+// TLSConnectionCount is the number of connections made with the same TLS parameters.
+type TLSConnectionCount struct {
+	TLSConnection
+	Count int64
+}
+
+// TLSCertificate is a certificate chain served in a full TLS handshake, to
+// surface certificate problems that only some backends (e.g. behind a load
+// balancer) have.
+type TLSCertificate struct {
+	Subject  string // of the leaf certificate
+	Issuer   string
+	NotAfter time.Time // expiry of the leaf certificate
+	// Number of certificates sent by the server, leaf included.
+	ChainDepth  int
+	OCSPStapled bool
+	// Chain validation error, only checked for insecure (-k) connections
+	// as the handshake fails otherwise.
+	VerifyError string `json:",omitempty"`
+}
+
+// NewTLSCertificate returns the certificate chain served in the TLS connection
+// state and its validation error (nil if valid or not checked).
+func NewTLSCertificate(s *tls.ConnectionState, verifyErr error) TLSCertificate {
+	leaf := s.PeerCertificates[0]
+	c := TLSCertificate{
+		Subject:     leaf.Subject.String(),
+		Issuer:      leaf.Issuer.String(),
+		NotAfter:    leaf.NotAfter.UTC(),
+		ChainDepth:  len(s.PeerCertificates),
+		OCSPStapled: len(s.OCSPResponse) > 0,
+	}
+	if verifyErr != nil {
+		c.VerifyError = verifyErr.Error()
+	}
+	return c
+}
+
+// VerifyTLSChain verifies the served certificate chain of the TLS connection
+// state against the roots (nil for the system ones) and its server name.
+func VerifyTLSChain(s *tls.ConnectionState, roots *x509.CertPool) error {
+	opts := x509.VerifyOptions{Roots: roots, DNSName: s.ServerName, Intermediates: x509.NewCertPool()}
+	for _, c := range s.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	_, err := s.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// TLSCertificateCount is the number of full handshakes that served the same certificate chain.
+type TLSCertificateCount struct {
+	TLSCertificate
+	Count int64
+}
+
+// TLSCounts counts TLS connections per negotiated parameters, and full
+// handshakes per served certificate chain. The zero value is ready to use and
+// it's safe for concurrent use (e.g. from a tls.Config.VerifyConnection callback).
+type TLSCounts struct {
+	mu     sync.Mutex
+	counts map[TLSConnection]int64
+	certs  map[TLSCertificate]int64
+}
+
+// Add counts a connection with the TLS state s.
+func (c *TLSCounts) Add(s *tls.ConnectionState) {
+	c.add(s, nil)
+}
+
+// AddInsecure is Add for connections whose certificates weren't verified by
+// the handshake (InsecureSkipVerify): their chain is verified against roots
+// (nil for the system ones) to report the validation errors.
+func (c *TLSCounts) AddInsecure(s *tls.ConnectionState, roots *x509.CertPool) {
+	var err error
+	if !s.DidResume && len(s.PeerCertificates) > 0 {
+		err = VerifyTLSChain(s, roots)
+	}
+	c.add(s, err)
+}
+
+func (c *TLSCounts) add(s *tls.ConnectionState, verifyErr error) {
+	k := NewTLSConnection(s)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[TLSConnection]int64)
+	}
+	c.counts[k]++
+	// Resumed sessions don't get the certificates again.
+	if s.DidResume || len(s.PeerCertificates) == 0 {
+		return
+	}
+	if c.certs == nil {
+		c.certs = make(map[TLSCertificate]int64)
+	}
+	c.certs[NewTLSCertificate(s, verifyErr)]++
+}
+
+// AddTLSConnections adds the TLS connections and certificates counted by c
+// (nil for none) to the metadata's, keeping them sorted by decreasing count.
+func (m *RunMetadata) AddTLSConnections(c *TLSCounts) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, n := range c.counts {
+		found := false
+		for i := range m.TLSConnections {
+			if m.TLSConnections[i].TLSConnection == k {
+				m.TLSConnections[i].Count += n
+				found = true
+				break
+			}
+		}
+		if !found {
+			m.TLSConnections = append(m.TLSConnections, TLSConnectionCount{k, n})
+		}
+	}
+	sort.Slice(m.TLSConnections, func(i, j int) bool {
+		a, b := m.TLSConnections[i], m.TLSConnections[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return fmt.Sprint(a.TLSConnection) < fmt.Sprint(b.TLSConnection)
+	})
+	for k, n := range c.certs {
+		found := false
+		for i := range m.TLSCertificates {
+			if m.TLSCertificates[i].TLSCertificate == k {
+				m.TLSCertificates[i].Count += n
+				found = true
+				break
+			}
+		}
+		if !found {
+			m.TLSCertificates = append(m.TLSCertificates, TLSCertificateCount{k, n})
+		}
+	}
+	sort.Slice(m.TLSCertificates, func(i, j int) bool {
+		a, b := m.TLSCertificates[i], m.TLSCertificates[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return fmt.Sprint(a.TLSCertificate) < fmt.Sprint(b.TLSCertificate)
+	})
+}
+
+// TLSResumption returns the number of TLS handshakes and of resumed ones,
+// from the TLSConnections.
+func (m *RunMetadata) TLSResumption() (handshakes, resumed int64) {
+	for _, c := range m.TLSConnections {
+		handshakes += c.Count
+		if c.Resumed {
+			resumed += c.Count
+		}
+	}
+	return handshakes, resumed
+}
+
+// TLSVersionName returns the name (e.g. "TLS 1.3") of a tls.VersionTLSxx.
+func TLSVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04X", v)
+}
+
+// FlagValues returns the effective value of all the flags of the flag set,
+// with the SensitiveFlags ones, and the credentials in the others (see Redact),
+// redacted.
+func FlagValues(fs *flag.FlagSet) map[string]string {
+	res := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if SensitiveFlags[f.Name] && v != "" {
+			v = redacted
+		}
+		res[f.Name] = Redact(v)
+	})
+	return res
+}
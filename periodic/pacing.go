@@ -0,0 +1,77 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"fmt"
+	"io"
+
+	"fortio.org/fortio/stats"
+)
+
+// PacingResults is the accuracy of the scheduling of the calls in qps mode,
+// to know how much to trust (or discount) results from noisy machines (e.g.
+// shared CI runners) where fortio itself can't keep the requested pace.
+type PacingResults struct {
+	// How late the calls started compared to their intended (scheduled)
+	// start, whatever the cause: sleeping too long or falling behind.
+	Error *stats.HistogramData
+	// How late the wake ups were compared to their target, for the calls
+	// which did sleep (timer and scheduling latency of the machine).
+	SleepOvershoot *stats.HistogramData
+}
+
+// pacingHistograms are a thread's (or the merged) PacingResults histograms.
+type pacingHistograms struct {
+	err       *stats.Histogram
+	overshoot *stats.Histogram
+}
+
+func newPacingHistograms() *pacingHistograms {
+	return &pacingHistograms{err: stats.NewHistogram(0, 0.0001), overshoot: stats.NewHistogram(0, 0.0001)}
+}
+
+func (p *pacingHistograms) clone() *pacingHistograms {
+	return &pacingHistograms{err: p.err.Clone(), overshoot: p.overshoot.Clone()}
+}
+
+// record records the lateness of a call's start, slept telling if it was
+// after a sleep (vs falling behind).
+func (p *pacingHistograms) record(late float64, slept bool) {
+	p.err.Record(late)
+	if slept {
+		p.overshoot.Record(late)
+	}
+}
+
+func (p *pacingHistograms) transfer(src *pacingHistograms) {
+	p.err.Transfer(src.err)
+	p.overshoot.Transfer(src.overshoot)
+}
+
+// results exports the histograms and prints their summary.
+func (p *pacingHistograms) results(out io.Writer, percentiles []float64) *PacingResults {
+	if p.err.Count == 0 {
+		return nil
+	}
+	res := &PacingResults{Error: p.err.Export().CalcPercentiles(percentiles)}
+	_, _ = fmt.Fprintf(out, "Pacing error : avg %.6g max %.6g", p.err.Avg(), p.err.Max)
+	if p.overshoot.Count > 0 {
+		res.SleepOvershoot = p.overshoot.Export().CalcPercentiles(percentiles)
+		_, _ = fmt.Fprintf(out, ", sleep overshoot : count %d avg %.6g max %.6g", p.overshoot.Count, p.overshoot.Avg(), p.overshoot.Max)
+	}
+	_, _ = fmt.Fprintln(out)
+	return res
+}
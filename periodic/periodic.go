@@ -25,6 +25,7 @@ package periodic // import "fortio.org/fortio/periodic"
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"os/signal"
@@ -54,6 +55,23 @@ type Runnable interface {
 	Run(tid int)
 }
 
+// Untimer is implemented by the Runnables whose calls include some work which
+// isn't part of their latency, e.g. decoding the response: the duration of it,
+// in the last call, is subtracted from that call's duration.
+type Untimer interface {
+	UntimedDuration() time.Duration
+}
+
+// callDuration returns the duration, in seconds, of the call f made since
+// fStart, excluding its untimed part (see Untimer).
+func callDuration(f Runnable, fStart time.Time) float64 {
+	d := time.Since(fStart)
+	if u, ok := f.(Untimer); ok {
+		d -= u.UntimedDuration()
+	}
+	return d.Seconds()
+}
+
 // MakeRunners creates an array of NumThreads identical Runnable instances
 // (for the (rare/test) cases where there is no unique state needed).
 func (r *RunnerOptions) MakeRunners(rr Runnable) {
@@ -132,12 +150,102 @@ type RunnerOptions struct {
 	// Enabling jitter (+/-10%) allows these requests to be de-synchronized
 	// When enabled, it is only effective in the '-qps' mode.
 	Jitter bool
+	// Arrival process of the calls in qps mode: ArrivalUniform (default, fixed
+	// pacing) or ArrivalPoisson (exponentially distributed intervals, open loop
+	// like real independent clients). Poisson arrivals make a random number of
+	// calls in duration mode and aren't combined with Jitter or a Schedule.
+	Arrival string
 	// Optional run id; used by the server to identify runs.
 	RunID int64
 	// Optional Offect Duration; to offset the histogram function duration
 	Offset time.Duration
+	// When > 0, runs with up to that many calls report the exact (by rank)
+	// percentiles of the function duration instead of interpolated ones.
+	ExactPercentiles int
+	// Bucketing of the latency histograms: stats.HistogramFixed (default) or
+	// stats.HistogramLogLinear for the same relative precision from microseconds
+	// to seconds (Resolution is then only the unit of the buckets).
+	HistogramType stats.HistogramType
+	// Think time: when ThinkCalls > 0, each thread (and thus its connection)
+	// makes ThinkCalls calls and then stays idle for Dwell before the next
+	// burst. Models clients holding connections open but only talking
+	// occasionally (e.g. to exercise middleboxes idle timeouts). The qps
+	// pacing is suspended while dwelling so in duration mode fewer calls are made.
+	ThinkCalls int
+	Dwell      time.Duration
+	// When CheckpointInterval > 0, OnCheckpoint is called (from a separate
+	// goroutine) every CheckpointInterval during the run, and once at the end,
+	// with the results of the window since the previous checkpoint. For long
+	// (soak) runs, to see the drift over time and not lose everything on a crash.
+	CheckpointInterval time.Duration
+	OnCheckpoint       func(*Checkpoint)
+	// When true (and in qps mode) also record the latency from each call's
+	// scheduled (intended) start instead of its actual start: when the target
+	// can't keep up the calls start late and the function duration alone hides
+	// that wait (coordinated omission).
+	ScheduledLatency bool
+	// Optional target qps changing over the run (ramp up, hold, ramp down...,
+	// see ParseQPSSchedule). When set QPS and Duration are derived from it,
+	// Exactly is ignored and the results include each step's histogram.
+	Schedule QPSSchedule
+	// Burst traffic: when BurstSize > 0 the calls are made in bursts of
+	// BurstSize back to back calls (split across the threads) every
+	// BurstInterval (default 1s) instead of evenly paced, e.g. to test rate
+	// limiters and the queueing of proxies. QPS is then derived from them and
+	// the Arrival and Jitter don't apply.
+	BurstSize     int
+	BurstInterval time.Duration
+	// Replayed arrivals: when set the k-th call is made (by thread k % NumThreads)
+	// at the (sorted) Arrivals[k] offset from the start, e.g. to replay the timing
+	// of recorded requests. Exactly and QPS are then derived from them and the
+	// Schedule, bursts, Arrival and Jitter don't apply.
+	Arrivals []time.Duration
+	// Optional warmup before the run: WarmupCalls calls (split across the threads)
+	// and/or for WarmupDuration, at the run's qps, reported separately and excluded
+	// from the results (see Warmer). Replaces the runners' implicit one call per
+	// thread warmup.
+	WarmupDuration time.Duration
+	WarmupCalls    int64
+	// Optional relative weight of each thread's share of the qps (and calls), e.g.
+	// 3,1,1 for the first thread (connection) to make 3 times more calls than each
+	// of the next 2, to simulate heterogeneous clients. Threads beyond the weights
+	// have a weight of 1. Only in qps mode, without bursts nor Arrivals.
+	ThreadWeights []float64
+	// Closed loop mode: each thread keeps exactly one call in flight, back to
+	// back with no pacing nor think time, and the throughput (ActualQPS) is the
+	// result. Like a max qps (-1) run but explicit, the RunType says so and the
+	// pacing options are ignored.
+	ConcurrencyOnly bool
+	// Optional stream of the outcome of each call (not the warmup ones), e.g.
+	// for real time dashboards, see SampleWriter.
+	Samples *SampleWriter
+	// When > 0 the results include a Timeseries of the calls completed in each
+	// interval of that duration (e.g. 1s) during the run, so latency spikes and
+	// errors bursts are visible instead of flattened into the run's histogram
+	// (see MinTimeseriesInterval and MaxTimeseriesPoints).
+	TimeseriesInterval time.Duration
+	// Optional control to change the target qps while the run is in progress
+	// (see QPSControl), e.g. from the REST api. Only for uniformly paced qps
+	// runs (no schedule, bursts, arrivals nor poisson arrivals); the calls are
+	// then paced until the end of the duration rather than a precomputed count.
+	QPSControl *QPSControl
 }
 
+// concurrencyRunType is appended to the RunType of ConcurrencyOnly runs.
+const concurrencyRunType = " concurrency"
+
+// Arrival processes (see RunnerOptions.Arrival).
+const (
+	ArrivalUniform = "uniform"
+	ArrivalPoisson = "poisson"
+)
+
+// SchemaVersion is the version of the saved results json (RunnerResults,
+// Checkpoint and the other reports). It is incremented when fields are renamed,
+// moved or change meaning so older files can be upgraded when loaded (see the
+// ui package). Files from before versioning have no SchemaVersion (0).
+const SchemaVersion = 1
+
 // RunnerResults encapsulates the actual QPS observed and duration histogram.
 type RunnerResults struct {
 	RunType           string
@@ -149,10 +257,47 @@ type RunnerResults struct {
 	ActualDuration    time.Duration
 	NumThreads        int
 	Version           string
+	SchemaVersion     int
 	DurationHistogram *stats.HistogramData
 	Exactly           int64 // Echo back the requested count
 	Jitter            bool
+	Arrival           string
 	RunID             int64 // Echo back the optional run id.
+	// Fortio's own resource usage during the run, to identify client side bottlenecks.
+	ClientStats *ClientStats
+	// Environment of the run (completed by the specific runners with connections and TLS details).
+	Metadata *RunMetadata
+	// Echo back the optional think time.
+	ThinkCalls int
+	Dwell      time.Duration
+	// Latency from the scheduled start of the calls (see RunnerOptions.ScheduledLatency), nil unless requested.
+	ScheduledHistogram *stats.HistogramData
+	// Echo back the optional qps schedule, and the results of each of its steps.
+	QPSSchedule string
+	Steps       []*StepResult
+	// Echo back the optional burst traffic.
+	BurstSize     int
+	BurstInterval time.Duration
+	// Accuracy of the calls' scheduling, nil unless in qps mode.
+	Pacing *PacingResults
+	// Echo back the optional warmup, and the histogram of its calls' durations.
+	WarmupDuration  time.Duration
+	WarmupCalls     int64
+	WarmupHistogram *stats.HistogramData
+	// Echo back the optional thread weights.
+	ThreadWeights []float64
+	// Echo back the optional timeseries interval, and the calls of each interval of the run.
+	TimeseriesInterval time.Duration     `json:",omitempty"`
+	Timeseries         []TimeseriesPoint `json:",omitempty"`
+	// Windows of the run during which the target was unavailable (e.g. restarting), for the runners
+	// tracking it (see AvailabilityTracker).
+	Unavailable []UnavailableWindow
+	// Echo back the bucketing of the histograms.
+	HistogramType stats.HistogramType
+	// Changes of the target qps made during the run (see RunnerOptions.QPSControl).
+	QPSChanges []QPSChange `json:",omitempty"`
+	// Outcome of the assertions checked after the run (see Assert), nil when none.
+	Verdict *Verdict `json:",omitempty"`
 }
 
 // HasRunnerResult is the interface implictly implemented by HTTPRunnerResults
@@ -193,12 +338,82 @@ var (
 // Once Normalize is called, if Run() is skipped, Abort() must be called to
 // cleanup the watchers.
 func (r *RunnerOptions) Normalize() {
+	if r.Arrival == "" {
+		r.Arrival = ArrivalUniform
+	}
+	if r.HistogramType == "" {
+		r.HistogramType = stats.HistogramFixed
+	}
+	if r.ConcurrencyOnly {
+		r.normalizeConcurrencyOnly()
+	}
+	if len(r.Arrivals) > 0 {
+		if len(r.Schedule) > 0 {
+			log.Warnf("Ignoring the qps schedule as replaying %d arrivals", len(r.Arrivals))
+			r.Schedule = nil
+		}
+		if r.BurstSize > 0 {
+			log.Warnf("Ignoring bursts of %d calls as replaying %d arrivals", r.BurstSize, len(r.Arrivals))
+			r.BurstSize = 0
+		}
+		if r.Arrival == ArrivalPoisson {
+			log.Warnf("Poisson arrivals aren't supported when replaying arrivals")
+			r.Arrival = ArrivalUniform
+		}
+		r.Jitter = false
+		r.Exactly = int64(len(r.Arrivals))
+		span := r.Arrivals[len(r.Arrivals)-1]
+		if span < time.Millisecond {
+			span = time.Millisecond
+		}
+		r.QPS = float64(len(r.Arrivals)) / span.Seconds()
+	}
+	if len(r.Schedule) > 0 {
+		if r.Arrival == ArrivalPoisson {
+			log.Warnf("Poisson arrivals aren't supported with a qps schedule, using its uniform pacing")
+			r.Arrival = ArrivalUniform
+		}
+		if r.Exactly > 0 {
+			log.Warnf("Ignoring exactly %d calls as a qps schedule is set", r.Exactly)
+			r.Exactly = 0
+		}
+		r.QPS = r.Schedule.MaxQPS()
+		r.Duration = r.Schedule.Duration()
+		if r.BurstSize > 0 {
+			log.Warnf("Ignoring bursts of %d calls as a qps schedule is set", r.BurstSize)
+			r.BurstSize = 0
+		}
+	}
+	if r.BurstSize > 0 {
+		if r.BurstInterval <= 0 {
+			r.BurstInterval = time.Second
+		}
+		if r.Arrival == ArrivalPoisson {
+			log.Warnf("Poisson arrivals aren't supported with bursts, using uniform bursts")
+			r.Arrival = ArrivalUniform
+		}
+		r.Jitter = false
+		r.QPS = float64(r.BurstSize) / r.BurstInterval.Seconds()
+	}
 	if r.QPS == 0 {
 		r.QPS = DefaultRunnerOptions.QPS
 	} else if r.QPS < 0 {
 		log.LogVf("Negative qps %f means max speed mode/no wait between calls", r.QPS)
 		r.QPS = -1
 	}
+	if len(r.ThreadWeights) > 0 && (r.QPS < 0 || r.BurstSize > 0 || len(r.Arrivals) > 0) {
+		log.Warnf("Ignoring thread weights %v, only supported in (non burst nor replay) qps mode", r.ThreadWeights)
+		r.ThreadWeights = nil
+	}
+	if r.QPSControl != nil {
+		if !r.CanChangeQPS() {
+			log.Warnf("Ignoring the qps control, only supported for uniformly paced qps runs")
+			r.QPSControl.ignore() // for its users to know their changes wouldn't apply
+			r.QPSControl = nil
+		} else {
+			r.QPSControl.init(r.QPS)
+		}
+	}
 	if r.Out == nil {
 		r.Out = os.Stdout
 	}
@@ -208,6 +423,13 @@ func (r *RunnerOptions) Normalize() {
 	if r.NumThreads < 1 {
 		r.NumThreads = 1
 	}
+	if r.BurstSize > 0 && r.NumThreads > r.BurstSize {
+		log.Warnf("Lowering number of threads to the %d calls of each burst", r.BurstSize)
+		r.NumThreads = r.BurstSize
+	}
+	if len(r.Arrivals) > 0 && r.NumThreads > len(r.Arrivals) {
+		r.NumThreads = len(r.Arrivals)
+	}
 	if r.Percentiles == nil {
 		r.Percentiles = make([]float64, len(DefaultRunnerOptions.Percentiles))
 		copy(r.Percentiles, DefaultRunnerOptions.Percentiles)
@@ -218,6 +440,9 @@ func (r *RunnerOptions) Normalize() {
 	if r.Duration == 0 {
 		r.Duration = DefaultRunnerOptions.Duration
 	}
+	if r.TimeseriesInterval > 0 {
+		r.normalizeTimeseries()
+	}
 	if r.Runners == nil {
 		r.Runners = make([]Runnable, r.NumThreads)
 	}
@@ -297,6 +522,36 @@ func NewPeriodicRunner(params *RunnerOptions) PeriodicRunner {
 	return newPeriodicRunner(params)
 }
 
+// normalizeConcurrencyOnly turns off all the pacing options in ConcurrencyOnly mode.
+func (r *RunnerOptions) normalizeConcurrencyOnly() {
+	if r.QPS > 0 || len(r.Schedule) > 0 || r.BurstSize > 0 || len(r.Arrivals) > 0 || r.ThinkCalls > 0 ||
+		len(r.ThreadWeights) > 0 {
+		log.Warnf("Ignoring the qps, schedule, bursts, arrivals, think time and thread weights in concurrency only mode")
+	}
+	r.QPS = -1
+	r.Schedule = nil
+	r.BurstSize = 0
+	r.Arrivals = nil
+	r.ThinkCalls, r.Dwell = 0, 0
+	r.ThreadWeights = nil
+	r.Jitter = false
+	r.Arrival = ArrivalUniform
+}
+
+// runType returns the RunType of the results, marking the ConcurrencyOnly runs.
+func (r *RunnerOptions) runType() string {
+	if r.ConcurrencyOnly {
+		return r.RunType + concurrencyRunType
+	}
+	return r.RunType
+}
+
+// NewLatencyHistogram returns a new histogram, of the HistogramType and
+// Resolution, for the runners' own latencies (e.g. per message or command).
+func (r *RunnerOptions) NewLatencyHistogram() *stats.Histogram {
+	return stats.NewHistogramOfType(r.HistogramType, 0, r.Resolution)
+}
+
 // Options returns the options pointer.
 func (r *periodicRunner) Options() *RunnerOptions {
 	return &r.RunnerOptions // sort of returning this here
@@ -309,6 +564,9 @@ func (r *periodicRunner) runQPSSetup() (requestedDuration string, requestedQPS s
 	useExactly := (r.Exactly > 0)
 	requestedDuration = "until stop"
 	requestedQPS = fmt.Sprintf("%.9g", r.QPS)
+	if r.Arrival == ArrivalPoisson && log.Log(log.Warning) {
+		_, _ = fmt.Fprintf(r.Out, "Poisson arrivals: exponentially distributed intervals averaging the target qps\n")
+	}
 	if !hasDuration && !useExactly {
 		// Always print that as we need ^C to interrupt, in that case the user need to notice
 		_, _ = fmt.Fprintf(r.Out, "Starting at %g qps with %d thread(s) [gomax %d] until interrupted\n",
@@ -318,6 +576,20 @@ func (r *periodicRunner) runQPSSetup() (requestedDuration string, requestedQPS s
 	// else:
 	requestedDuration = fmt.Sprint(r.Duration)
 	numCalls = int64(r.QPS * r.Duration.Seconds())
+	if len(r.Schedule) > 0 {
+		requestedQPS = r.Schedule.String()
+		numCalls = int64(r.Schedule.Calls())
+		_, _ = fmt.Fprintf(r.Out, "Following qps schedule %s (max %g qps)\n", requestedQPS, r.QPS)
+	}
+	if r.BurstSize > 0 && log.Log(log.Warning) {
+		_, _ = fmt.Fprintf(r.Out, "Bursts of %d calls every %v\n", r.BurstSize, r.BurstInterval)
+	}
+	if len(r.ThreadWeights) > 0 && log.Log(log.Warning) {
+		_, _ = fmt.Fprintf(r.Out, "Thread weights %v (threads beyond have a weight of 1)\n", r.ThreadWeights)
+	}
+	if len(r.Arrivals) > 0 && log.Log(log.Warning) {
+		_, _ = fmt.Fprintf(r.Out, "Replaying %d arrivals over %v\n", len(r.Arrivals), r.Arrivals[len(r.Arrivals)-1])
+	}
 	if useExactly {
 		numCalls = r.Exactly
 		requestedDuration = fmt.Sprintf("exactly %d calls", numCalls)
@@ -406,44 +678,121 @@ func (r *periodicRunner) Run() RunnerResults {
 		r.MakeRunners(r.Runners[0])
 		log.Warnf("Context array was of %d len, replacing with %d clone of first one", runnersLen, len(r.Runners))
 	}
+	var warmup *stats.Histogram
+	if r.HasWarmup() {
+		warmup = r.warmup(runnerChan)
+		if log.Log(log.Warning) {
+			warmup.Counter.Print(r.Out, "Warmup calls")
+		}
+	}
+	clientStats := startClientStats()
 	start := time.Now()
+	if r.QPSControl != nil {
+		r.QPSControl.begin(start)
+	}
 	// Histogram  and stats for Function duration - millisecond precision
-	functionDuration := stats.NewHistogram(r.Offset.Seconds(), r.Resolution)
+	functionDuration := stats.NewHistogramOfType(r.HistogramType, r.Offset.Seconds(), r.Resolution)
+	functionDuration.KeepValues(r.ExactPercentiles)
 	// Histogram and stats for Sleep time (negative offset to capture <0 sleep in their own bucket):
 	sleepTime := stats.NewHistogram(-0.001, 0.001)
+	// Each thread records in its own histograms, without any shared state/lock,
+	// and they are merged once at the end.
+	fDs := make([]*stats.Histogram, r.NumThreads)
+	sDs := make([]*stats.Histogram, r.NumThreads)
+	for t := 0; t < r.NumThreads; t++ {
+		fDs[t] = functionDuration.Clone()
+		sDs[t] = sleepTime.Clone()
+	}
+	// Histograms of the pacing accuracy, in qps mode.
+	var pacing *pacingHistograms
+	pDs := make([]*pacingHistograms, r.NumThreads)
+	if useQPS {
+		pacing = newPacingHistograms()
+		for t := 0; t < r.NumThreads; t++ {
+			pDs[t] = pacing.clone()
+		}
+	}
+	// Histograms for the latency from the scheduled start, when requested.
+	var scheduled *stats.Histogram
+	schDs := make([]*stats.Histogram, r.NumThreads)
+	if r.ScheduledLatency && useQPS {
+		scheduled = stats.NewHistogramOfType(r.HistogramType, r.Offset.Seconds(), r.Resolution)
+		for t := 0; t < r.NumThreads; t++ {
+			schDs[t] = scheduled.Clone()
+		}
+	}
+	// Histograms for the function duration of each step of the schedule, if any.
+	var steps []*stats.Histogram
+	stDs := make([][]*stats.Histogram, r.NumThreads)
+	if len(r.Schedule) > 0 && useQPS {
+		steps = make([]*stats.Histogram, len(r.Schedule))
+		for s := range steps {
+			steps[s] = functionDuration.Clone()
+		}
+		for t := 0; t < r.NumThreads; t++ {
+			stDs[t] = make([]*stats.Histogram, len(steps))
+			for s := range steps {
+				stDs[t][s] = functionDuration.Clone()
+			}
+		}
+	}
+	checkpoints := newCheckpointer(r, functionDuration, start)
+	series := newTimeseries(r.TimeseriesInterval, functionDuration, start)
 	if r.NumThreads <= 1 {
 		log.LogVf("Running single threaded")
-		runOne(0, runnerChan, functionDuration, sleepTime, numCalls+leftOver, start, r)
+		runOne(0, runnerChan, fDs[0], sDs[0], schDs[0], stDs[0], pDs[0], checkpoints.thread(0), series.thread(),
+			numCalls+leftOver, start, r)
 	} else {
 		var wg sync.WaitGroup
-		var fDs []*stats.Histogram
-		var sDs []*stats.Histogram
 		for t := 0; t < r.NumThreads; t++ {
-			durP := functionDuration.Clone()
-			sleepP := sleepTime.Clone()
-			fDs = append(fDs, durP)
-			sDs = append(sDs, sleepP)
-			wg.Add(1)
 			thisNumCalls := numCalls
-			if (leftOver > 0) && (t == 0) {
+			if len(r.ThreadWeights) > 0 && numCalls > 0 {
+				// Each thread does its weighted share of the calls.
+				thisNumCalls = r.weightedCalls(t, numCalls*int64(r.NumThreads)+leftOver)
+				if thisNumCalls == 0 {
+					continue
+				}
+			} else if (leftOver > 0) && (t == 0) {
 				// The first thread gets to do the additional work
 				thisNumCalls += leftOver
 			}
-			go func(t int, durP *stats.Histogram, sleepP *stats.Histogram) {
-				runOne(t, runnerChan, durP, sleepP, thisNumCalls, start, r)
+			wg.Add(1)
+			go func(t int) {
+				runOne(t, runnerChan, fDs[t], sDs[t], schDs[t], stDs[t], pDs[t], checkpoints.thread(t), series.thread(),
+					thisNumCalls, start, r)
 				wg.Done()
-			}(t, durP, sleepP)
+			}(t)
 		}
 		wg.Wait()
-		for t := 0; t < r.NumThreads; t++ {
-			functionDuration.Transfer(fDs[t])
-			sleepTime.Transfer(sDs[t])
+	}
+	checkpoints.stop()
+	if r.Samples != nil {
+		r.Samples.Close()
+	}
+	for t := 0; t < r.NumThreads; t++ {
+		functionDuration.Transfer(fDs[t])
+		sleepTime.Transfer(sDs[t])
+		if scheduled != nil {
+			scheduled.Transfer(schDs[t])
+		}
+		for s := range steps {
+			steps[s].Transfer(stDs[t][s])
+		}
+		if pacing != nil {
+			pacing.transfer(pDs[t])
 		}
 	}
 	elapsed := time.Since(start)
+	cs := clientStats.stop()
 	actualQPS := float64(functionDuration.Count) / elapsed.Seconds()
 	if log.Log(log.Warning) {
 		_, _ = fmt.Fprintf(r.Out, "Ended after %v : %d calls. qps=%.5g\n", elapsed, functionDuration.Count, actualQPS)
+		if r.ThinkCalls > 0 {
+			_, _ = fmt.Fprintf(r.Out, "Think time: %v idle after each burst of %d calls per thread\n", r.Dwell, r.ThinkCalls)
+		}
+		if r.ConcurrencyOnly {
+			_, _ = fmt.Fprintf(r.Out, "Closed loop of %d calls in flight: throughput %.5g qps\n", r.NumThreads, actualQPS)
+		}
 	}
 	if useQPS { // nolint: nestif
 		percentNegative := 100. * float64(sleepTime.Hdata[0]) / float64(sleepTime.Count)
@@ -466,17 +815,51 @@ func (r *periodicRunner) Run() RunnerResults {
 		requestedDuration += fmt.Sprintf(", interrupted after %d", actualCount)
 	}
 	result := RunnerResults{
-		r.RunType, r.Labels, start, requestedQPS, requestedDuration,
-		actualQPS, elapsed, r.NumThreads, version.Short(), functionDuration.Export().CalcPercentiles(r.Percentiles),
-		r.Exactly, r.Jitter, r.RunID,
+		r.runType(), r.Labels, start, requestedQPS, requestedDuration,
+		actualQPS, elapsed, r.NumThreads, version.Short(), SchemaVersion, functionDuration.Export().CalcPercentiles(r.Percentiles),
+		r.Exactly, r.Jitter, r.Arrival, r.RunID, cs, newRunMetadata(),
+		r.ThinkCalls, r.Dwell, nil, "", nil, r.BurstSize, r.BurstInterval, nil,
+		r.WarmupDuration, r.WarmupCalls, nil, r.ThreadWeights, r.TimeseriesInterval, series.points(), nil,
+		r.HistogramType, nil, nil,
+	}
+	if r.QPSControl != nil {
+		result.QPSChanges = r.QPSControl.Changes()
+		if len(result.QPSChanges) > 0 && log.Log(log.Warning) {
+			_, _ = fmt.Fprintf(r.Out, "Target qps changed %d times during the run, last to %g\n",
+				len(result.QPSChanges), result.QPSChanges[len(result.QPSChanges)-1].QPS)
+		}
+	}
+	if warmup != nil && warmup.Count > 0 {
+		result.WarmupHistogram = warmup.Export().CalcPercentiles(r.Percentiles)
 	}
 	if log.Log(log.Warning) {
 		result.DurationHistogram.Print(r.Out, "Aggregated Function Time")
 	} else {
 		functionDuration.Counter.Print(r.Out, "Aggregated Function Time")
-		for _, p := range result.DurationHistogram.Percentiles {
-			_, _ = fmt.Fprintf(r.Out, "# target %g%% %.6g\n", p.Percentile, p.Value)
+		result.DurationHistogram.PrintPercentiles(r.Out)
+	}
+	if scheduled != nil && scheduled.Count > 0 {
+		result.ScheduledHistogram = scheduled.Export().CalcPercentiles(r.Percentiles)
+		if log.Log(log.Warning) {
+			result.ScheduledHistogram.Print(r.Out, "Aggregated Latency from scheduled start")
+		} else {
+			scheduled.Counter.Print(r.Out, "Aggregated Latency from scheduled start")
+			result.ScheduledHistogram.PrintPercentiles(r.Out)
+		}
+	}
+	if pacing != nil {
+		out := r.Out
+		if !log.Log(log.Warning) {
+			out = ioutil.Discard
 		}
+		result.Pacing = pacing.results(out, r.Percentiles)
+	}
+	if steps != nil {
+		result.QPSSchedule = requestedQPS
+		result.Steps = r.stepResults(steps)
+	}
+	if log.Log(log.Warning) || cs.CPUBound() {
+		cs.Print(r.Out)
 	}
 	select {
 	case <-runnerChan: // nothing
@@ -490,16 +873,63 @@ func (r *periodicRunner) Run() RunnerResults {
 
 // runOne runs in 1 go routine (or main one when -c 1 == single threaded mode).
 // nolint: gocognit // we should try to simplify it though.
-func runOne(id int, runnerChan chan struct{},
-	funcTimes *stats.Histogram, sleepTimes *stats.Histogram, numCalls int64, start time.Time, r *periodicRunner) {
+// schedTimes, when not nil, records the latency from each call's scheduled start.
+// stepTimes, when not nil, records the function duration per step of the Schedule.
+// pacing, when not nil, records the lateness of the calls' start.
+// series, when not nil, records the calls in the Timeseries.
+func runOne(id int, runnerChan chan struct{}, funcTimes, sleepTimes, schedTimes *stats.Histogram, stepTimes []*stats.Histogram,
+	pacing *pacingHistograms, window *windowHistogram, series *threadTimeseries, numCalls int64, start time.Time,
+	r *periodicRunner) {
 	var i int64
 	endTime := start.Add(r.Duration)
 	tIDStr := fmt.Sprintf("T%03d", id)
-	perThreadQPS := r.QPS / float64(r.NumThreads)
+	perThreadQPS := r.QPS * r.threadShare(id)
 	useQPS := (perThreadQPS > 0)
 	hasDuration := (r.Duration > 0)
 	useExactly := (r.Exactly > 0)
+	poisson := useQPS && (r.Arrival == ArrivalPoisson)
+	// In burst mode this thread's share of the calls of each burst.
+	var burstCalls int64
+	if useQPS && r.BurstSize > 0 {
+		burstCalls = int64(r.BurstSize / r.NumThreads)
+		if id < r.BurstSize%r.NumThreads {
+			burstCalls++
+		}
+	}
+	bursts := burstCalls > 0
+	arrivals := useQPS && len(r.Arrivals) > 0
+	// Pacing following the changes of the target qps, when it can change.
+	var pacer *qpsPacer
+	if useQPS && r.QPSControl != nil {
+		pacer = newQPSPacer(r.QPSControl, r.threadShare(id))
+	}
 	f := r.Runners[id]
+	// Per thread random source and timer: nothing shared with the other threads in the loop.
+	var rnd *rand.Rand
+	if r.Jitter || poisson {
+		rnd = rand.New(rand.NewSource(start.UnixNano() + int64(id))) // nolint:gosec // not for crypto
+	}
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+	var dwelled time.Duration // total think time, excluded from the qps pacing
+	scheduledStart := start   // when the next call should start (qps mode)
+	var arrival float64       // poisson mode target elapsed of the next call, in seconds
+	// Whether the next call has its own scheduled start (not within a burst), and comes after a sleep.
+	paced, slept := true, false
+	if arrivals && r.Arrivals[id] > 0 {
+		// The first call also waits for its arrival.
+		scheduledStart = start.Add(r.Arrivals[id])
+		sleepDuration := time.Until(scheduledStart)
+		sleepTimes.Record(sleepDuration.Seconds())
+		slept = sleepDuration > 0
+		timer.Reset(sleepDuration)
+		select {
+		case <-runnerChan:
+			return
+		case <-timer.C:
+		}
+	}
 
 MainLoop:
 	for {
@@ -510,47 +940,127 @@ MainLoop:
 				break
 			}
 			// QPS mode:
+			if poisson || bursts || pacer != nil {
+				break // until the end
+			}
 			// Do least 2 iterations, and the last one before bailing because of time
 			if (i >= 2) && (i != numCalls-1) {
-				log.Warnf("%s warning only did %d out of %d calls before reaching %v", tIDStr, i, numCalls, r.Duration)
+				if r.ThinkCalls > 0 {
+					log.LogVf("%s did %d out of %d calls before reaching %v (think time)", tIDStr, i, numCalls, r.Duration)
+				} else {
+					log.Warnf("%s warning only did %d out of %d calls before reaching %v", tIDStr, i, numCalls, r.Duration)
+				}
 				break
 			}
 		}
+		if pacing != nil && paced {
+			pacing.record(fStart.Sub(scheduledStart).Seconds(), slept)
+		}
 		f.Run(id)
-		funcTimes.Record(time.Since(fStart).Seconds())
+		fDuration := callDuration(f, fStart)
+		funcTimes.Record(fDuration)
+		if window != nil {
+			window.record(fDuration)
+		}
+		if series != nil {
+			series.record(f, fStart, fDuration)
+		}
+		if schedTimes != nil {
+			schedTimes.Record(time.Since(scheduledStart).Seconds())
+		}
+		if stepTimes != nil {
+			stepTimes[r.Schedule.stepAt(fStart.Sub(start))].Record(fDuration)
+		}
+		if r.Samples != nil {
+			var late time.Duration
+			if useQPS && paced && fStart.After(scheduledStart) {
+				late = fStart.Sub(scheduledStart)
+			}
+			r.Samples.record(f, id, fStart, fDuration, late)
+		}
 		i++
 		// if using QPS / pre calc expected call # mode:
 		if useQPS { // nolint: nestif
-			if (useExactly || hasDuration) && i >= numCalls {
+			if arrivals {
+				if i*int64(r.NumThreads)+int64(id) >= int64(len(r.Arrivals)) {
+					break // this thread's arrivals are done
+				}
+			} else if (useExactly || (hasDuration && !poisson && !bursts && pacer == nil)) && i >= numCalls {
 				break // expected exit for that mode
 			}
-			elapsed := time.Since(start)
+			d, ok := r.dwell(f, i, runnerChan, timer, endTime)
+			if !ok {
+				break
+			}
+			if bursts && i%burstCalls != 0 {
+				// Back to back within the burst.
+				paced = false
+				select {
+				case <-runnerChan:
+					break MainLoop
+				default:
+					continue
+				}
+			}
+			dwelled += d
+			now := time.Now()
+			elapsed := now.Sub(start) - dwelled
 			var targetElapsedInSec float64
-			if hasDuration {
+			switch {
+			case arrivals:
+				targetElapsedInSec = r.Arrivals[i*int64(r.NumThreads)+int64(id)].Seconds()
+			case bursts:
+				targetElapsedInSec = float64(i/burstCalls) * r.BurstInterval.Seconds()
+			case len(r.Schedule) > 0:
+				// Same spreading as below, of the calls along the schedule's (cumulative) qps curve
+				targetElapsedInSec = r.Schedule.timeOf(float64(i) / float64(numCalls-1) * r.Schedule.Calls()).Seconds()
+			case poisson:
+				// Exponentially distributed interval from the previous (target) arrival
+				arrival += rnd.ExpFloat64() / perThreadQPS
+				targetElapsedInSec = arrival
+			case pacer != nil:
+				targetElapsedInSec = pacer.target(i, elapsed)
+			case hasDuration:
 				// This next line is tricky - such as for 2s duration and 1qps there is 1
 				// sleep of 2s between the 2 calls and for 3qps in 1sec 2 sleep of 1/2s etc
 				targetElapsedInSec = (float64(i) + float64(i)/float64(numCalls-1)) / perThreadQPS
-			} else {
+			default:
 				// Calculate the target elapsed when in endless execution
 				targetElapsedInSec = float64(i) / perThreadQPS
 			}
 			targetElapsedDuration := time.Duration(int64(targetElapsedInSec * 1e9))
+			if (poisson || bursts) && hasDuration && !useExactly && !start.Add(targetElapsedDuration+dwelled).Before(endTime) {
+				break // next arrival (or burst) is past the end
+			}
 			sleepDuration := targetElapsedDuration - elapsed
-			if r.Jitter {
-				sleepDuration += getJitter(sleepDuration)
+			if r.Jitter && !poisson {
+				sleepDuration += getJitter(rnd, sleepDuration)
 			}
 			log.Debugf("%s target next dur %v - sleep %v", tIDStr, targetElapsedDuration, sleepDuration)
 			sleepTimes.Record(sleepDuration.Seconds())
+			scheduledStart = now.Add(sleepDuration)
+			paced, slept = true, sleepDuration > 0
+			timer.Reset(sleepDuration)
 			select {
 			case <-runnerChan:
 				break MainLoop
-			case <-time.After(sleepDuration):
+			case <-timer.C:
 				// continue normal execution
+			case <-pacer.changes():
+				// New target qps: the next call is right away.
+				if !timer.Stop() {
+					<-timer.C
+				}
+				pacer.rebase(i, time.Since(start)-dwelled)
+				scheduledStart = time.Now()
 			}
 		} else { // Not using QPS
 			if useExactly && i >= numCalls {
 				break
 			}
+			if _, ok := r.dwell(f, i, runnerChan, timer, endTime); !ok {
+				break
+			}
 			select {
 			case <-runnerChan:
 				break MainLoop
@@ -559,6 +1069,7 @@ MainLoop:
 			}
 		}
 	}
+	series.flush()
 	elapsed := time.Since(start)
 	actualQPS := float64(i) / elapsed.Seconds()
 	log.Infof("%s ended after %v : %d calls. qps=%g", tIDStr, elapsed, i, actualQPS)
@@ -572,18 +1083,75 @@ MainLoop:
 	}
 }
 
+// stepResults exports the per step histograms and prints a summary line for each.
+func (r *periodicRunner) stepResults(steps []*stats.Histogram) []*StepResult {
+	res := make([]*StepResult, len(steps))
+	var offset time.Duration
+	for s, h := range steps {
+		step := StepResult{
+			QPSStep:   r.Schedule[s],
+			Start:     offset,
+			Count:     h.Count,
+			ActualQPS: float64(h.Count) / r.Schedule[s].Duration.Seconds(),
+		}
+		offset += step.Duration
+		if h.Count > 0 {
+			step.DurationHistogram = h.Export().CalcPercentiles(r.Percentiles)
+		}
+		if log.Log(log.Warning) {
+			_, _ = fmt.Fprintf(r.Out, "Step %d (%s) : %d calls qps=%.5g avg %.6g\n",
+				s+1, QPSSchedule{step.QPSStep}, step.Count, step.ActualQPS, h.Avg())
+		}
+		res[s] = &step
+	}
+	return res
+}
+
+// dwell idles for the Dwell think time after each ThinkCalls calls (i is the
+// number of calls done so far), plus the backoff f asks for (see Backoffer),
+// without going past the end of a duration run.
+// Returns the time spent idle and false if the run got aborted meanwhile.
+func (r *periodicRunner) dwell(f Runnable, i int64, runnerChan chan struct{}, timer *time.Timer,
+	endTime time.Time) (time.Duration, bool) {
+	var d time.Duration
+	if r.ThinkCalls > 0 && i%int64(r.ThinkCalls) == 0 {
+		d = r.Dwell
+	}
+	if b, ok := f.(Backoffer); ok {
+		d += b.Backoff()
+	}
+	if r.Exactly <= 0 && r.Duration > 0 {
+		if left := time.Until(endTime); left < d {
+			d = left
+		}
+	}
+	if d <= 0 {
+		return 0, true
+	}
+	start := time.Now()
+	timer.Reset(d)
+	select {
+	case <-runnerChan:
+		timer.Stop()
+		return time.Since(start), false
+	case <-timer.C:
+		return time.Since(start), true
+	}
+}
+
 func formatDate(d *time.Time) string {
 	return fmt.Sprintf("%d-%02d-%02d-%02d%02d%02d", d.Year(), d.Month(), d.Day(),
 		d.Hour(), d.Minute(), d.Second())
 }
 
 // getJitter returns a jitter time that is (+/-)10% of the duration t if t is >0.
-func getJitter(t time.Duration) time.Duration {
+// rnd is the calling thread's own random source.
+func getJitter(rnd *rand.Rand, t time.Duration) time.Duration {
 	i := int64(float64(t)/10. + 0.5) // rounding to nearest instead of truncate
 	if i <= 0 {
 		return time.Duration(0)
 	}
-	j := rand.Int63n(2*i+1) - i // nolint:gosec // trying to be fast not crypto secure here
+	j := rnd.Int63n(2*i+1) - i
 	return time.Duration(j)
 }
 
@@ -15,14 +15,26 @@
 package periodic
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"fortio.org/fortio/log"
+	"fortio.org/fortio/stats"
 )
 
 type Noop struct{}
@@ -172,6 +184,146 @@ func TestExactlyLargeDur(t *testing.T) {
 	r.Options().ReleaseRunners()
 }
 
+type atomicCount struct {
+	count int64
+}
+
+func (c *atomicCount) Run(i int) {
+	atomic.AddInt64(&c.count, 1)
+}
+
+func TestManyThreadsMerge(t *testing.T) {
+	c := atomicCount{}
+	o := RunnerOptions{
+		QPS:        10000,
+		NumThreads: 50,
+		Exactly:    1010, // 20 per thread + 10 extra for the first one
+		Jitter:     true,
+	}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	res := r.Run()
+	if res.DurationHistogram.Count != o.Exactly || c.count != o.Exactly {
+		t.Errorf("Expected %d calls, got histogram %d and %d calls", o.Exactly, res.DurationHistogram.Count, c.count)
+	}
+	if res.NumThreads != 50 {
+		t.Errorf("Unexpected thread count %d", res.NumThreads)
+	}
+	r.Options().ReleaseRunners()
+}
+
+type codesCounter struct {
+	codes map[string]int64
+}
+
+func (c *codesCounter) Run(i int) {
+	c.codes[fmt.Sprintf("even %t", i%2 == 0)]++
+}
+
+func TestSetupMergeThreads(t *testing.T) {
+	o := RunnerOptions{QPS: -1, NumThreads: 4, Exactly: 10, Out: ioutil.Discard}
+	r := NewPeriodicRunner(&o)
+	if err := SetupThreads(r, func(i int, firstCall bool) (Runnable, error) {
+		if i == 2 {
+			return nil, fmt.Errorf("thread %d failed", i)
+		}
+		return &codesCounter{}, nil
+	}); err == nil || err.Error() != "thread 2 failed" {
+		t.Errorf("expected the error of the 3rd thread, got %v", err)
+	}
+	states := make([]codesCounter, 4)
+	if err := SetupThreads(r, func(i int, firstCall bool) (Runnable, error) {
+		if firstCall {
+			t.Errorf("unexpected first call for an exact number of calls")
+		}
+		states[i].codes = map[string]int64{"thread": int64(i)}
+		return &states[i], nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	res := r.Run()
+	codes := map[string]int64{}
+	MergeThreads(r, len(states), codes, func(i int) map[string]int64 { return states[i].codes })
+	if codes["thread"] != 0+1+2+3 || codes["even true"]+codes["even false"] != 10 {
+		t.Errorf("unexpected merged codes %v", codes)
+	}
+	for i, runner := range r.Options().Runners {
+		if runner != nil {
+			t.Errorf("runner %d not released", i)
+		}
+	}
+	var out bytes.Buffer
+	PrintRetCodes(&out, "test", codes, res.DurationHistogram.Count)
+	expected := fmt.Sprintf("test even false : %d (%.1f %%)\ntest even true : %d (%.1f %%)\ntest thread : 6 (60.0 %%)\n",
+		codes["even false"], 10.*float64(codes["even false"]), codes["even true"], 10.*float64(codes["even true"]))
+	if out.String() != expected {
+		t.Errorf("got %q, expected %q", out.String(), expected)
+	}
+	o2 := RunnerOptions{QPS: -1, NumThreads: 1, Duration: time.Second}
+	_ = SetupThreads(NewPeriodicRunner(&o2), func(i int, firstCall bool) (Runnable, error) {
+		if !firstCall {
+			t.Errorf("expected a first call without warmup nor exact number of calls")
+		}
+		return &Noop{}, nil
+	})
+}
+
+func TestExactPercentiles(t *testing.T) {
+	for _, limit := range []int{0, 20, 100} {
+		c := atomicCount{}
+		o := RunnerOptions{
+			QPS:              10000,
+			NumThreads:       4,
+			Exactly:          40,
+			Percentiles:      []float64{99.9},
+			ExactPercentiles: limit,
+		}
+		r := NewPeriodicRunner(&o)
+		r.Options().MakeRunners(&c)
+		res := r.Run()
+		h := res.DurationHistogram
+		exact := limit >= 40
+		if h.ExactPercentiles != exact {
+			t.Errorf("limit %d: expected exact mode %v, got %v", limit, exact, h.ExactPercentiles)
+		}
+		// With exact percentiles, the p99.9 of 40 values is the max.
+		if exact && h.Percentiles[0].Value != h.Max {
+			t.Errorf("limit %d: exact p99.9 %g should be the max %g", limit, h.Percentiles[0].Value, h.Max)
+		}
+		r.Options().ReleaseRunners()
+	}
+}
+
+func TestHistogramType(t *testing.T) {
+	for _, ht := range []stats.HistogramType{"", stats.HistogramLogLinear} {
+		c := atomicCount{}
+		o := RunnerOptions{
+			QPS:           -1,
+			NumThreads:    2,
+			Exactly:       20,
+			HistogramType: ht,
+		}
+		r := NewPeriodicRunner(&o)
+		r.Options().MakeRunners(&c)
+		res := r.Run()
+		r.Options().ReleaseRunners()
+		expected := ht
+		if expected == "" {
+			expected = stats.HistogramFixed
+		}
+		if res.HistogramType != expected {
+			t.Errorf("expected %q histograms, got %q", expected, res.HistogramType)
+		}
+		h := res.DurationHistogram
+		if h.Count != 20 || h.Data[0].Start != h.Min || h.Data[len(h.Data)-1].End != h.Max {
+			t.Errorf("%q: unexpected histogram %+v", ht, h)
+		}
+		if lh := r.Options().NewLatencyHistogram(); lh.Type() != expected || lh.Divider != DefaultRunnerOptions.Resolution {
+			t.Errorf("%q: unexpected latency histogram %q %g", ht, lh.Type(), lh.Divider)
+		}
+	}
+}
+
 func TestExactlySmallDur(t *testing.T) {
 	var count int64
 	var lock sync.Mutex
@@ -374,13 +526,14 @@ func Test2Watchers(t *testing.T) {
 }
 
 func TestGetJitter(t *testing.T) {
-	d := getJitter(4)
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	d := getJitter(rnd, 4)
 	if d != time.Duration(0) {
 		t.Errorf("getJitter < 5 got %v instead of expected 0", d)
 	}
 	sum := 0.
 	for i := 0; i < 100; i++ {
-		d = getJitter(6)
+		d = getJitter(rnd, 6)
 		a := math.Abs(float64(d))
 		// only valid values are -1, 0, 1
 		if a != 1. && d != 0 {
@@ -393,3 +546,1113 @@ func TestGetJitter(t *testing.T) {
 		t.Errorf("getJitter 6 got %v sum of abs value instead of expected > 60 at -1/+1", sum)
 	}
 }
+
+func TestClientStats(t *testing.T) {
+	var count int64
+	var lock sync.Mutex
+	c := TestCount{&count, &lock}
+	o := RunnerOptions{
+		QPS:        10,
+		NumThreads: 2,
+		Exactly:    4,
+	}
+	ClientStatsInterval = 10 * time.Millisecond
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	res := r.Run()
+	cs := res.ClientStats
+	if cs == nil {
+		t.Fatalf("missing client stats in %+v", res)
+	}
+	if cs.GoroutinesMax < 3 {
+		t.Errorf("expected at least 3 goroutines (main + 2 threads), got %d", cs.GoroutinesMax)
+	}
+	if cs.GOMAXPROCS < 1 || cs.NumCPU < 1 || cs.HeapAllocMax == 0 {
+		t.Errorf("unexpected client stats %+v", cs)
+	}
+	if cs.CPUPercent > 100*float64(cs.NumCPU) || cs.GCPauseMax > cs.GCPauseTotal {
+		t.Errorf("inconsistent client stats %+v", cs)
+	}
+	if runtime.GOOS == "linux" && (cs.OpenFDsMax < 3 || cs.UserCPUSeconds < 0) {
+		t.Errorf("expected fds and cpu on linux, got %+v", cs)
+	}
+	r.Options().ReleaseRunners()
+}
+
+func TestThinkTime(t *testing.T) {
+	for _, qps := range []float64{-1, 1000} {
+		var c atomicCount
+		o := RunnerOptions{
+			QPS:        qps,
+			NumThreads: 1,
+			Exactly:    6,
+			ThinkCalls: 2,
+			Dwell:      50 * time.Millisecond,
+		}
+		r := NewPeriodicRunner(&o)
+		r.Options().MakeRunners(&c)
+		res := r.Run()
+		r.Options().ReleaseRunners()
+		if res.DurationHistogram.Count != 6 || c.count != 6 {
+			t.Errorf("qps %g: unexpected count %d/%d", qps, res.DurationHistogram.Count, c.count)
+		}
+		// 2 dwells, none after the last burst:
+		if res.ActualDuration < 100*time.Millisecond || res.ActualDuration > 200*time.Millisecond {
+			t.Errorf("qps %g: unexpected duration %v for 2 dwells of 50ms", qps, res.ActualDuration)
+		}
+		if res.ThinkCalls != 2 || res.Dwell != o.Dwell {
+			t.Errorf("qps %g: think time not echoed back: %d %v", qps, res.ThinkCalls, res.Dwell)
+		}
+	}
+}
+
+func TestCheckpoints(t *testing.T) {
+	var c atomicCount
+	var checkpoints []*Checkpoint
+	var mu sync.Mutex
+	o := RunnerOptions{
+		QPS:                100,
+		NumThreads:         2,
+		Duration:           550 * time.Millisecond,
+		Labels:             "cp test",
+		CheckpointInterval: 200 * time.Millisecond,
+		OnCheckpoint: func(cp *Checkpoint) {
+			mu.Lock()
+			checkpoints = append(checkpoints, cp)
+			mu.Unlock()
+		},
+	}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	mu.Lock()
+	defer mu.Unlock()
+	// 2 full windows and the last partial one:
+	if len(checkpoints) != 3 {
+		t.Fatalf("unexpected %d checkpoints: %+v", len(checkpoints), checkpoints)
+	}
+	var total int64
+	for i, cp := range checkpoints {
+		if cp.Index != i+1 || !cp.StartTime.Equal(res.StartTime) || cp.Labels != "cp test" {
+			t.Errorf("unexpected checkpoint %d %+v", i, cp)
+		}
+		if i > 0 && !cp.WindowStart.Equal(checkpoints[i-1].WindowStart.Add(checkpoints[i-1].WindowDuration)) {
+			t.Errorf("checkpoint %d window not following the previous one: %+v", i, cp)
+		}
+		if cp.Count == 0 || cp.DurationHistogram == nil || cp.DurationHistogram.Count != cp.Count {
+			t.Errorf("unexpected checkpoint %d counts %+v", i, cp)
+		}
+		total += cp.Count
+	}
+	// Windowed, not cumulative:
+	if total != res.DurationHistogram.Count {
+		t.Errorf("checkpoints total %d doesn't match the run's %d", total, res.DurationHistogram.Count)
+	}
+	if id := checkpoints[2].ID(); !strings.HasSuffix(id, "_cp_test_checkpoint3") {
+		t.Errorf("unexpected checkpoint id %q", id)
+	}
+	summary := checkpoints[1].Summary()
+	if !strings.HasPrefix(summary, "Interval 2 [") || !strings.Contains(summary, " calls qps=") ||
+		!strings.Contains(summary, " p90 ") || !strings.Contains(summary, " max ") {
+		t.Errorf("unexpected checkpoint summary %q", summary)
+	}
+	if summary = (&Checkpoint{Index: 1, WindowDuration: time.Second}).Summary(); summary != "Interval 1 [0s-1s] : 0 calls qps=0" {
+		t.Errorf("unexpected empty checkpoint summary %q", summary)
+	}
+}
+
+type sleeper struct {
+	d time.Duration
+}
+
+func (s *sleeper) Run(t int) {
+	time.Sleep(s.d)
+}
+
+func TestScheduledLatency(t *testing.T) {
+	// Calls of 20ms at 100 qps: each starts later than scheduled.
+	o := RunnerOptions{
+		QPS:              100,
+		NumThreads:       1,
+		Exactly:          10,
+		ScheduledLatency: true,
+	}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&sleeper{20 * time.Millisecond})
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	sch := res.ScheduledHistogram
+	if sch == nil || sch.Count != 10 {
+		t.Fatalf("unexpected scheduled latency %+v", sch)
+	}
+	// Last call scheduled at 90ms but started after 9 calls of 20ms (180ms).
+	if res.DurationHistogram.Max > 0.1 || sch.Max < 0.1 || sch.Avg <= res.DurationHistogram.Avg {
+		t.Errorf("scheduled latency max %g avg %g not above function duration max %g avg %g", sch.Max, sch.Avg,
+			res.DurationHistogram.Max, res.DurationHistogram.Avg)
+	}
+	// Not in max qps mode (no schedule):
+	o = RunnerOptions{QPS: -1, NumThreads: 1, Exactly: 2, ScheduledLatency: true}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&Noop{})
+	res = r.Run()
+	r.Options().ReleaseRunners()
+	if res.ScheduledHistogram != nil {
+		t.Errorf("unexpected scheduled latency in max qps mode %+v", res.ScheduledHistogram)
+	}
+}
+
+func TestParseQPSSchedule(t *testing.T) {
+	s, err := ParseQPSSchedule("0->1000 over 2m, hold 5m, ->0 over 1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := QPSSchedule{{0, 1000, 2 * time.Minute}, {1000, 1000, 5 * time.Minute}, {1000, 0, time.Minute}}
+	if len(s) != len(expected) {
+		t.Fatalf("unexpected schedule %+v", s)
+	}
+	for i := range s {
+		if s[i] != expected[i] {
+			t.Errorf("step %d: got %+v expected %+v", i, s[i], expected[i])
+		}
+	}
+	if s.Duration() != 8*time.Minute || s.MaxQPS() != 1000 || s.Calls() != 60000+300000+30000 {
+		t.Errorf("unexpected totals %v %g %g", s.Duration(), s.MaxQPS(), s.Calls())
+	}
+	str := s.String()
+	if str != "0->1000 over 2m0s, 1000 for 5m0s, 1000->0 over 1m0s" {
+		t.Errorf("unexpected string %q", str)
+	}
+	if s2, err := ParseQPSSchedule(str); err != nil || s2.String() != str {
+		t.Errorf("round trip of %q failed: %v %v", str, s2, err)
+	}
+	for _, bad := range []string{"", "hold 1s", "->10 over 1s", "10 over 1s", "5->10 over", "5->10 over -1s",
+		"5->x over 1s", "-5 for 1s", "0 for 1s, hold 2s", "10 for 0s", "10 for 1s,", "10 during 1s"} {
+		if _, err := ParseQPSSchedule(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestParseLoadShape(t *testing.T) {
+	s, err := ParseLoadShape("sawtooth:period=10s,min=100,max=200", 25*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := QPSSchedule{{100, 200, 10 * time.Second}, {100, 200, 10 * time.Second}, {100, 150, 5 * time.Second}}
+	if len(s) != len(expected) {
+		t.Fatalf("unexpected sawtooth schedule %+v", s)
+	}
+	for i := range s {
+		if s[i] != expected[i] {
+			t.Errorf("sawtooth step %d: got %+v expected %+v", i, s[i], expected[i])
+		}
+	}
+	s, err = ParseLoadShape("sine:period=1m,min=100,max=1000", 2*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != 2*sineSegments || s.Duration() != 2*time.Minute || s.MaxQPS() != 1000 {
+		t.Fatalf("unexpected sine schedule %v", s)
+	}
+	// Starts and ends each period at min, peaks half way, average in the middle:
+	if s[0].From != 100 || s[sineSegments-1].To != 100 || s[sineSegments/2].From != 1000 || s[1].From != 134.25 {
+		t.Errorf("unexpected sine schedule %v", s)
+	}
+	if avg := s.Calls() / s.Duration().Seconds(); math.Abs(avg-550) > 1e-6 {
+		t.Errorf("unexpected sine average qps %g", avg)
+	}
+	// Defaults to one period:
+	if s, err = ParseLoadShape("sine:period=1s,max=10", 0); err != nil || s.Duration() != time.Second || s[0].From != 0 {
+		t.Errorf("unexpected single period sine %v %v", s, err)
+	}
+	for _, bad := range []string{"", "sine", "square:period=1s,max=10", "sine:period=1s", "sine:max=10",
+		"sine:period=-1s,max=10", "sine:period=1s,min=10,max=5", "sine:period=1s,max=x", "sine:period=1s,max=10,foo=1",
+		"sawtooth:period=1s max=10", "sawtooth:period=x,max=10", "sine:period=10ms,max=10"} {
+		if _, err := ParseLoadShape(bad, time.Minute); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+	// Capped number of steps:
+	if _, err := ParseLoadShape("sine:period=1s,max=10", 24*time.Hour); err == nil {
+		t.Errorf("expected an error for too many steps")
+	}
+	if s, err = ParseLoadShape("sawtooth:period=1s,max=10", 24*time.Hour); err != nil || len(s) != 86400 {
+		t.Errorf("unexpected day long sawtooth %d steps %v", len(s), err)
+	}
+}
+
+func TestQPSScheduleTimeOf(t *testing.T) {
+	s, _ := ParseQPSSchedule("0->100 over 2s, 0 for 1s, 50 for 1s, 100->0 over 2s")
+	tests := []struct {
+		n        float64
+		expected time.Duration
+	}{
+		{0, 0},
+		{25, time.Second}, // half way of the ramp up: a quarter of its calls
+		{100, 2 * time.Second},
+		{125, 3500 * time.Millisecond}, // skips the 0 qps step
+		{150, 4 * time.Second},
+		{225, 5 * time.Second}, // 3/4 of the ramp down calls in its first half
+		{250, 6 * time.Second},
+		{300, 6 * time.Second},
+	}
+	for _, tst := range tests {
+		if d := s.timeOf(tst.n); math.Abs(float64(d-tst.expected)) > float64(time.Microsecond) {
+			t.Errorf("timeOf(%g) = %v, expected %v", tst.n, d, tst.expected)
+		}
+	}
+	if i := s.stepAt(2500 * time.Millisecond); i != 1 {
+		t.Errorf("unexpected step %d", i)
+	}
+	if i := s.stepAt(time.Minute); i != 3 {
+		t.Errorf("unexpected step %d past the end", i)
+	}
+}
+
+func TestQPSScheduleRun(t *testing.T) {
+	var c atomicCount
+	s, _ := ParseQPSSchedule("0->200 over 500ms, hold 250ms, ->0 over 500ms")
+	o := RunnerOptions{
+		NumThreads: 2,
+		Exactly:    10, // ignored
+		Schedule:   s,
+	}
+	r := NewPeriodicRunner(&o)
+	if n := r.Options(); n.QPS != 200 || n.Duration != 1250*time.Millisecond || n.Exactly != 0 {
+		t.Errorf("unexpected normalized options %g %v %d", n.QPS, n.Duration, n.Exactly)
+	}
+	r.Options().MakeRunners(&c)
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	// 50 + 50 + 50 calls
+	if res.DurationHistogram.Count != 150 || c.count != 150 {
+		t.Errorf("unexpected count %d/%d", res.DurationHistogram.Count, c.count)
+	}
+	if res.ActualDuration < 1200*time.Millisecond || res.ActualDuration > 1500*time.Millisecond {
+		t.Errorf("unexpected duration %v", res.ActualDuration)
+	}
+	if res.RequestedQPS != s.String() || res.QPSSchedule != s.String() || len(res.Steps) != 3 {
+		t.Fatalf("unexpected schedule results %q %q %+v", res.RequestedQPS, res.QPSSchedule, res.Steps)
+	}
+	var total int64
+	for i, step := range res.Steps {
+		if step.QPSStep != s[i] || step.DurationHistogram == nil || step.DurationHistogram.Count != step.Count {
+			t.Errorf("unexpected step %d %+v", i, step)
+		}
+		// Some slack for the calls at the boundaries between steps:
+		if step.Count < 40 || step.Count > 60 {
+			t.Errorf("unexpected step %d count %d", i, step.Count)
+		}
+		total += step.Count
+	}
+	if res.Steps[2].Start != 750*time.Millisecond {
+		t.Errorf("unexpected last step start %v", res.Steps[2].Start)
+	}
+	if total != res.DurationHistogram.Count {
+		t.Errorf("steps total %d doesn't match the run's %d", total, res.DurationHistogram.Count)
+	}
+}
+
+func TestParseStages(t *testing.T) {
+	stages, err := ParseStages("# comment\nwarmup 10 0 1s\n\n  peak max 8 2m\nlow 0.5 1 10s  \n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Stage{{"warmup", 10, 0, time.Second}, {"peak", -1, 8, 2 * time.Minute}, {"low", 0.5, 1, 10 * time.Second}}
+	if len(stages) != len(expected) {
+		t.Fatalf("unexpected stages %+v", stages)
+	}
+	for i := range stages {
+		if stages[i] != expected[i] {
+			t.Errorf("stage %d: got %+v expected %+v", i, stages[i], expected[i])
+		}
+	}
+	for _, bad := range []string{"", "# only comment", "a 1 1", "a x 1 1s", "a 1 -1 1s", "a 1 1 0s", "a 1 1 1s extra"} {
+		if _, err := ParseStages(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+	if _, err := ReadStages("/does/not/exist"); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
+
+func TestRunStages(t *testing.T) {
+	stages := []Stage{{"a", 100, 0, 200 * time.Millisecond}, {"b", 200, 4, 200 * time.Millisecond}}
+	o := RunnerOptions{NumThreads: 2, Labels: "stages test", Exactly: 10}
+	var threads []int
+	res, err := RunStages(&o, stages, func(so *RunnerOptions) (HasRunnerResult, error) {
+		threads = append(threads, so.NumThreads)
+		var c atomicCount
+		r := NewPeriodicRunner(so)
+		r.Options().MakeRunners(&c)
+		rr := r.Run()
+		r.Options().ReleaseRunners()
+		return &rr, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(threads) != 2 || threads[0] != 2 || threads[1] != 4 {
+		t.Errorf("unexpected threads per stage %v", threads)
+	}
+	if len(res.Stages) != 2 || res.Interrupted || res.Labels != "stages test" || res.SchemaVersion != SchemaVersion {
+		t.Fatalf("unexpected results %+v", res)
+	}
+	for i, s := range res.Stages {
+		if s.Name != stages[i].Name || s.NumThreads != threads[i] || s.Result == nil ||
+			s.DurationHistogram != s.Result.Result().DurationHistogram {
+			t.Errorf("unexpected stage %d result %+v", i, s)
+		}
+	}
+	// Not exactly 10 calls but the stage's qps for its duration:
+	if c := res.Stages[0].DurationHistogram.Count; c != 20 {
+		t.Errorf("unexpected first stage count %d", c)
+	}
+	if c := res.Stages[1].DurationHistogram.Count; c != 40 {
+		t.Errorf("unexpected second stage count %d", c)
+	}
+	if _, err := RunStages(&o, stages, func(so *RunnerOptions) (HasRunnerResult, error) {
+		return nil, os.ErrNotExist
+	}); err == nil || !strings.Contains(err.Error(), "stage a") {
+		t.Errorf("expected the first stage error, got %v", err)
+	}
+}
+
+func TestParseSweepMatrix(t *testing.T) {
+	m, err := ParseSweepMatrix("0, 1024", "100,max,0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.PayloadSizes) != 2 || m.PayloadSizes[1] != 1024 || len(m.QPS) != 3 || m.QPS[0] != 100 ||
+		m.QPS[1] != -1 || m.QPS[2] != -1 || m.NumThreads != nil {
+		t.Errorf("unexpected matrix %+v", m)
+	}
+	o := RunnerOptions{QPS: 10, NumThreads: 3}
+	cells := m.Cells(&o)
+	if len(cells) != 6 || cells[0].Name != "0b_100qps" || cells[5].Name != "1024b_maxqps" || cells[5].NumThreads != 3 {
+		t.Errorf("unexpected cells %+v", cells)
+	}
+	for _, bad := range [][3]string{{"", "", ""}, {"-1", "", ""}, {"", "x", ""}, {"", "", "0"}} {
+		if _, err := ParseSweepMatrix(bad[0], bad[1], bad[2]); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestRunSweep(t *testing.T) {
+	m := SweepMatrix{QPS: []float64{100, 200}, NumThreads: []int{1, 2}}
+	o := RunnerOptions{NumThreads: 4, Labels: "sweep test", Duration: 100 * time.Millisecond, QPS: 50}
+	var cells []string
+	res, err := RunSweep(&o, m, func(so *RunnerOptions, c *SweepCell) (HasRunnerResult, error) {
+		cells = append(cells, fmt.Sprintf("%s %g %d %s", c.Name, so.QPS, so.NumThreads, so.Labels))
+		var count atomicCount
+		r := NewPeriodicRunner(so)
+		r.Options().MakeRunners(&count)
+		rr := r.Run()
+		r.Options().ReleaseRunners()
+		return &rr, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"100qps_1c 100 1 sweep test 100qps_1c", "100qps_2c 100 2 sweep test 100qps_2c",
+		"200qps_1c 200 1 sweep test 200qps_1c", "200qps_2c 200 2 sweep test 200qps_2c"}
+	if strings.Join(cells, ",") != strings.Join(expected, ",") {
+		t.Errorf("unexpected cells runs %q", cells)
+	}
+	if len(res.Cells) != 4 || res.Interrupted || res.Labels != "sweep test" || res.SchemaVersion != SchemaVersion {
+		t.Fatalf("unexpected results %+v", res)
+	}
+	for _, c := range res.Cells {
+		if c.Result == nil || c.DurationHistogram != c.Result.Result().DurationHistogram ||
+			c.ResultID != res.ID()+"_"+c.Name || c.PayloadSize != -1 {
+			t.Errorf("unexpected cell result %+v", c)
+		}
+	}
+	if c := res.Cells[3].DurationHistogram.Count; c != 20 {
+		t.Errorf("unexpected last cell count %d", c)
+	}
+	if _, err := RunSweep(&o, m, func(so *RunnerOptions, c *SweepCell) (HasRunnerResult, error) {
+		return nil, os.ErrNotExist
+	}); err == nil || !strings.Contains(err.Error(), "sweep cell 100qps_1c") {
+		t.Errorf("expected the first cell error, got %v", err)
+	}
+}
+
+type timestamper struct {
+	times []time.Time
+}
+
+func (ts *timestamper) Run(t int) {
+	ts.times = append(ts.times, time.Now())
+}
+
+func TestPoissonArrival(t *testing.T) {
+	for _, arrival := range []string{"", ArrivalPoisson} {
+		ts := timestamper{}
+		o := RunnerOptions{QPS: 500, NumThreads: 1, Exactly: 200, Arrival: arrival}
+		r := NewPeriodicRunner(&o)
+		r.Options().Runners[0] = &ts
+		res := r.Run()
+		if len(ts.times) != 200 || res.DurationHistogram.Count != 200 {
+			t.Fatalf("%q: unexpected %d calls", arrival, len(ts.times))
+		}
+		var intervals stats.Counter
+		for i := 1; i < len(ts.times); i++ {
+			intervals.Record(ts.times[i].Sub(ts.times[i-1]).Seconds())
+		}
+		// Mean of 2ms in both cases, but exponential intervals' stddev is their mean:
+		if intervals.Avg() < 0.0015 || intervals.Avg() > 0.003 {
+			t.Errorf("%q: unexpected average interval %g", arrival, intervals.Avg())
+		}
+		poisson := (intervals.StdDev() > 0.001)
+		if poisson != (arrival == ArrivalPoisson) || (arrival == "" && res.Arrival != ArrivalUniform) || res.Arrival != r.Options().Arrival {
+			t.Errorf("%q: unexpected intervals stddev %g (avg %g), arrival %q", arrival, intervals.StdDev(), intervals.Avg(), res.Arrival)
+		}
+	}
+	// Duration mode: a random number of calls until the end.
+	var c atomicCount
+	o := RunnerOptions{QPS: 1000, NumThreads: 2, Duration: 500 * time.Millisecond, Arrival: ArrivalPoisson}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	if res.DurationHistogram.Count < 380 || res.DurationHistogram.Count > 620 || res.ActualDuration > 550*time.Millisecond {
+		t.Errorf("unexpected %d calls in %v instead of about 500 in 500ms", res.DurationHistogram.Count, res.ActualDuration)
+	}
+	// Not with a schedule:
+	s, _ := ParseQPSSchedule("100 for 1s")
+	o = RunnerOptions{Schedule: s, Arrival: ArrivalPoisson, Stop: bogusTestChan}
+	o.Normalize()
+	if o.Arrival != ArrivalUniform {
+		t.Errorf("unexpected arrival %q with a schedule", o.Arrival)
+	}
+}
+
+func TestBursts(t *testing.T) {
+	ts := timestamper{}
+	o := RunnerOptions{NumThreads: 1, Duration: 500 * time.Millisecond, BurstSize: 10, BurstInterval: 100 * time.Millisecond}
+	r := NewPeriodicRunner(&o)
+	r.Options().Runners[0] = &ts
+	res := r.Run()
+	// 5 bursts, at 0, 100ms,... 400ms
+	if len(ts.times) != 50 || res.BurstSize != 10 || res.BurstInterval != 100*time.Millisecond || res.RequestedQPS != "100" {
+		t.Fatalf("unexpected %d calls, results %+v", len(ts.times), res)
+	}
+	for i := 1; i < len(ts.times); i++ {
+		gap := ts.times[i].Sub(ts.times[i-1])
+		if i%10 == 0 && gap < 80*time.Millisecond || i%10 != 0 && gap > 10*time.Millisecond {
+			t.Errorf("unexpected %v gap before call %d", gap, i)
+		}
+	}
+	// The threads split each burst, and there can't be more threads than calls per burst.
+	var c atomicCount
+	o = RunnerOptions{NumThreads: 8, Exactly: 21, BurstSize: 7, BurstInterval: 50 * time.Millisecond}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	res = r.Run()
+	r.Options().ReleaseRunners()
+	if res.NumThreads != 7 || res.DurationHistogram.Count != 21 || res.ActualDuration < 100*time.Millisecond ||
+		res.ActualDuration > 150*time.Millisecond {
+		t.Errorf("unexpected %d threads, %d calls in %v", res.NumThreads, res.DurationHistogram.Count, res.ActualDuration)
+	}
+	// Not with a schedule:
+	s, _ := ParseQPSSchedule("100 for 1s")
+	o = RunnerOptions{Schedule: s, BurstSize: 10, Stop: bogusTestChan}
+	o.Normalize()
+	if o.BurstSize != 0 || o.QPS != 100 {
+		t.Errorf("unexpected bursts %d qps %g with a schedule", o.BurstSize, o.QPS)
+	}
+}
+
+func TestArrivals(t *testing.T) {
+	ts := timestamper{}
+	arrivals := []time.Duration{0, 0, 20 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond}
+	o := RunnerOptions{NumThreads: 1, Arrivals: arrivals, Jitter: true}
+	r := NewPeriodicRunner(&o)
+	r.Options().Runners[0] = &ts
+	res := r.Run()
+	if len(ts.times) != len(arrivals) || res.Exactly != 6 || res.Jitter || res.RequestedQPS != "60" {
+		t.Fatalf("unexpected %d calls, results %+v", len(ts.times), res)
+	}
+	for i, a := range arrivals {
+		offset := ts.times[i].Sub(ts.times[0])
+		if offset < a || offset > a+15*time.Millisecond {
+			t.Errorf("call %d at %v instead of %v", i, offset, a)
+		}
+	}
+	// Spread on the threads, each waiting for its first arrival:
+	var c atomicCount
+	o = RunnerOptions{NumThreads: 4, Arrivals: []time.Duration{
+		10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond, 40 * time.Millisecond,
+		50 * time.Millisecond, 60 * time.Millisecond, 70 * time.Millisecond,
+	}}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	res = r.Run()
+	r.Options().ReleaseRunners()
+	if res.DurationHistogram.Count != 7 || res.ActualDuration < 70*time.Millisecond || res.ActualDuration > 120*time.Millisecond {
+		t.Errorf("unexpected %d calls in %v", res.DurationHistogram.Count, res.ActualDuration)
+	}
+	// No more threads than arrivals, and a schedule doesn't apply:
+	s, _ := ParseQPSSchedule("100 for 1s")
+	o = RunnerOptions{NumThreads: 8, Arrivals: arrivals[:3], Schedule: s, Stop: bogusTestChan}
+	o.Normalize()
+	if o.NumThreads != 3 || o.Schedule != nil || o.Exactly != 3 {
+		t.Errorf("unexpected %d threads, schedule %v, exactly %d", o.NumThreads, o.Schedule, o.Exactly)
+	}
+}
+
+type warmupCount struct {
+	calls, warmups int64
+}
+
+func (c *warmupCount) Run(i int) {
+	atomic.AddInt64(&c.calls, 1)
+}
+
+func (c *warmupCount) Warmup(i int) {
+	atomic.AddInt64(&c.warmups, 1)
+}
+
+func TestWarmup(t *testing.T) {
+	var c warmupCount
+	o := RunnerOptions{QPS: 100, NumThreads: 3, Exactly: 10, WarmupCalls: 8}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	if c.calls != 10 || c.warmups != 8 || res.DurationHistogram.Count != 10 || res.WarmupCalls != 8 ||
+		res.WarmupHistogram == nil || res.WarmupHistogram.Count != 8 {
+		t.Fatalf("unexpected %d calls %d warmups, results %+v", c.calls, c.warmups, res)
+	}
+	// The run itself, at 100 qps, isn't slowed down by the warmup:
+	if res.ActualDuration > 200*time.Millisecond {
+		t.Errorf("unexpected duration %v", res.ActualDuration)
+	}
+	// By duration, with Run when the runner isn't a Warmer:
+	var a atomicCount
+	o = RunnerOptions{QPS: 100, NumThreads: 1, Exactly: 5, WarmupDuration: 100 * time.Millisecond}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&a)
+	start := time.Now()
+	res = r.Run()
+	r.Options().ReleaseRunners()
+	elapsed := time.Since(start)
+	w := res.WarmupHistogram
+	if w == nil || w.Count < 8 || w.Count > 11 || a.count != 5+w.Count || res.DurationHistogram.Count != 5 ||
+		elapsed < 140*time.Millisecond {
+		t.Errorf("unexpected warmup %+v, %d calls in %v", w, a.count, elapsed)
+	}
+	// No warmup by default:
+	o = RunnerOptions{QPS: 100, Exactly: 4}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	if res = r.Run(); res.WarmupHistogram != nil || o.HasWarmup() {
+		t.Errorf("unexpected warmup %+v", res.WarmupHistogram)
+	}
+	r.Options().ReleaseRunners()
+}
+
+// untimedSleep sleeps 20ms per call, of which 15ms are untimed.
+type untimedSleep struct{}
+
+func (untimedSleep) Run(i int) {
+	time.Sleep(20 * time.Millisecond)
+}
+
+func (untimedSleep) UntimedDuration() time.Duration {
+	return 15 * time.Millisecond
+}
+
+func TestUntimer(t *testing.T) {
+	o := RunnerOptions{QPS: -1, NumThreads: 1, Exactly: 5}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(untimedSleep{})
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	h := res.DurationHistogram
+	if h.Count != 5 || h.Min < 0.005 || h.Avg >= 0.015 {
+		t.Errorf("untimed part not excluded from the calls' duration: %+v", h)
+	}
+}
+
+func TestThreadWeights(t *testing.T) {
+	counts := make([]atomicCount, 3)
+	o := RunnerOptions{QPS: 200, NumThreads: 3, Exactly: 50, ThreadWeights: []float64{3, 1}}
+	r := NewPeriodicRunner(&o)
+	for i := range counts {
+		r.Options().Runners[i] = &counts[i]
+	}
+	res := r.Run()
+	// Third thread has the default weight of 1: 3/5th, 1/5th, 1/5th of the calls.
+	if counts[0].count != 30 || counts[1].count != 10 || counts[2].count != 10 || len(res.ThreadWeights) != 2 {
+		t.Errorf("unexpected weighted calls %v, results %+v", counts, res)
+	}
+	// All at the same pace so they all end about the same time:
+	if res.ActualDuration < 200*time.Millisecond || res.ActualDuration > 300*time.Millisecond {
+		t.Errorf("unexpected duration %v", res.ActualDuration)
+	}
+	// Duration mode:
+	counts = make([]atomicCount, 2)
+	o = RunnerOptions{QPS: 100, NumThreads: 2, Duration: 400 * time.Millisecond, ThreadWeights: []float64{1, 3}}
+	r = NewPeriodicRunner(&o)
+	for i := range counts {
+		r.Options().Runners[i] = &counts[i]
+	}
+	r.Run()
+	if counts[0].count != 10 || counts[1].count != 30 {
+		t.Errorf("unexpected weighted calls in duration mode %v", counts)
+	}
+	// Not at max qps:
+	o = RunnerOptions{QPS: -1, ThreadWeights: []float64{2}, Stop: bogusTestChan}
+	o.Normalize()
+	if o.ThreadWeights != nil {
+		t.Errorf("unexpected thread weights %v at max qps", o.ThreadWeights)
+	}
+}
+
+func TestParseThreadWeights(t *testing.T) {
+	w, err := ParseThreadWeights(" 3, 1,0.5")
+	if err != nil || len(w) != 3 || w[0] != 3 || w[1] != 1 || w[2] != 0.5 {
+		t.Errorf("unexpected %v %v", w, err)
+	}
+	if w, err = ParseThreadWeights(""); err != nil || w != nil {
+		t.Errorf("unexpected %v %v for empty weights", w, err)
+	}
+	for _, s := range []string{"1,x", "1,0", "-2", "1,,2"} {
+		if _, err = ParseThreadWeights(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
+
+type inFlight struct {
+	current, max, calls int64
+}
+
+func (f *inFlight) Run(i int) {
+	c := atomic.AddInt64(&f.current, 1)
+	for {
+		m := atomic.LoadInt64(&f.max)
+		if c <= m || atomic.CompareAndSwapInt64(&f.max, m, c) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	atomic.AddInt64(&f.current, -1)
+	atomic.AddInt64(&f.calls, 1)
+}
+
+func TestConcurrencyOnly(t *testing.T) {
+	var f inFlight
+	o := RunnerOptions{
+		RunType: "Test", QPS: 10, NumThreads: 3, Duration: 200 * time.Millisecond, ConcurrencyOnly: true,
+		ThinkCalls: 2, Dwell: time.Second,
+	}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&f)
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	if no := r.Options(); no.QPS != -1 || no.ThinkCalls != 0 {
+		t.Errorf("unexpected normalized qps %g, think time %d", no.QPS, no.ThinkCalls)
+	}
+	// 3 in flight back to back for 200ms of 10ms calls: ~60 calls, not the 2 of 10 qps
+	if res.RunType != "Test concurrency" || res.RequestedQPS != "max" || f.max != 3 || f.calls < 30 ||
+		res.DurationHistogram.Count != f.calls {
+		t.Errorf("unexpected %d calls, %d max in flight, results %+v", f.calls, f.max, res)
+	}
+}
+
+func TestPacing(t *testing.T) {
+	var c atomicCount
+	o := RunnerOptions{QPS: 200, NumThreads: 2, Exactly: 40}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	p := res.Pacing
+	if p == nil || p.Error.Count != 40 || p.SleepOvershoot == nil || p.SleepOvershoot.Count < 30 || p.SleepOvershoot.Count > 38 {
+		t.Fatalf("unexpected pacing %+v", p)
+	}
+	// Generous, for slow/loaded test machines:
+	if p.Error.Avg > 0.02 || p.Error.Min < 0 || len(p.Error.Percentiles) == 0 {
+		t.Errorf("unexpected pacing error %+v", p.Error)
+	}
+	// Only the first call of each burst is scheduled:
+	o = RunnerOptions{NumThreads: 1, Exactly: 12, BurstSize: 4, BurstInterval: 20 * time.Millisecond}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	res = r.Run()
+	r.Options().ReleaseRunners()
+	if res.Pacing == nil || res.Pacing.Error.Count != 3 || res.Pacing.SleepOvershoot.Count != 2 {
+		t.Errorf("unexpected bursts pacing %+v", res.Pacing)
+	}
+	// Nothing to pace at max qps:
+	o = RunnerOptions{QPS: -1, NumThreads: 1, Exactly: 10}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	res = r.Run()
+	r.Options().ReleaseRunners()
+	if res.Pacing != nil {
+		t.Errorf("unexpected max qps pacing %+v", res.Pacing)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	h := stats.NewHistogram(0, 1)
+	h.Record(1)
+	h.Record(3)
+	r := &RunnerResults{
+		RunType:           "Test",
+		Labels:            "a, b",
+		StartTime:         time.Date(2021, 5, 4, 3, 2, 1, 0, time.UTC),
+		RequestedQPS:      "10",
+		RequestedDuration: "exactly 2 calls",
+		ActualQPS:         9.5,
+		ActualDuration:    1500 * time.Millisecond,
+		NumThreads:        2,
+		DurationHistogram: h.Export().CalcPercentiles([]float64{50, 99.9}),
+	}
+	var b strings.Builder
+	if err := WriteCSV(&b, []*RunnerResults{r}, []float64{50, 90, 99.9}, true, true); err != nil {
+		t.Fatal(err)
+	}
+	expected := "type,id,start_time,labels,run_type,num_threads,requested_qps,actual_qps,requested_duration," +
+		"actual_duration_s,count,min,max,avg,stddev,p50,p90,p99.9,bucket_start,bucket_end,bucket_percent,bucket_count\n" +
+		`run,2021-05-04-030201_a_b,2021-05-04T03:02:01Z,"a, b",Test,2,10,9.5,exactly 2 calls,1.5,2,1,3,2,1,1,,2.998,,,,` + "\n" +
+		`bucket,2021-05-04-030201_a_b,2021-05-04T03:02:01Z,"a, b",,,,,,,,,,,,,,,1,1,50,1` + "\n" +
+		`bucket,2021-05-04-030201_a_b,2021-05-04T03:02:01Z,"a, b",,,,,,,,,,,,,,,2,3,100,1` + "\n"
+	if b.String() != expected {
+		t.Errorf("unexpected csv:\n%s\nvs\n%s", b.String(), expected)
+	}
+	b.Reset()
+	if err := WriteCSV(&b, []*RunnerResults{r}, nil, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(b.String(), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[0], "run,") {
+		t.Errorf("unexpected appended csv rows %q", lines)
+	}
+}
+
+type sampledNoop struct{}
+
+func (n *sampledNoop) Run(t int) {
+}
+
+func (n *sampledNoop) LastCallResult() (int, int64) {
+	return 200, 42
+}
+
+func TestSamples(t *testing.T) {
+	var b strings.Builder
+	o := RunnerOptions{QPS: 100, NumThreads: 2, Exactly: 10, Samples: NewSampleWriter(&b)}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&sampledNoop{})
+	start := time.Now()
+	r.Run()
+	r.Options().ReleaseRunners()
+	threads := map[int]int{}
+	scanner := bufio.NewScanner(strings.NewReader(b.String()))
+	for scanner.Scan() {
+		var s Sample
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			t.Fatalf("invalid sample line %q: %v", scanner.Text(), err)
+		}
+		if s.Code != 200 || s.Size != 42 || s.Latency < 0 || s.Late < 0 || s.Timestamp.Before(start) {
+			t.Errorf("unexpected sample %+v", s)
+		}
+		threads[s.Thread]++
+	}
+	if threads[0] != 5 || threads[1] != 5 || len(threads) != 2 {
+		t.Errorf("unexpected samples per thread %v", threads)
+	}
+	if o.Samples.Errors() != 0 {
+		t.Errorf("unexpected sample errors %d", o.Samples.Errors())
+	}
+	// Without the optional code and size:
+	b.Reset()
+	o = RunnerOptions{QPS: -1, NumThreads: 1, Exactly: 1, Samples: NewSampleWriter(&b)}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&Noop{})
+	r.Run()
+	r.Options().ReleaseRunners()
+	if line := b.String(); strings.Contains(line, `"code"`) || strings.Contains(line, `"late"`) || !strings.Contains(line, `"thread":0`) {
+		t.Errorf("unexpected max qps sample %q", line)
+	}
+}
+
+func TestSampleWriterFlush(t *testing.T) {
+	var b strings.Builder
+	s := NewSampleWriter(&b)
+	s.Write(&Sample{Thread: 1})
+	written := func() int {
+		s.mu.Lock() // the background flushes write under the lock
+		defer s.mu.Unlock()
+		return b.Len()
+	}
+	if n := written(); n != 0 {
+		t.Errorf("sample should be buffered, got %d bytes written", n)
+	}
+	time.Sleep(3 * SampleFlushInterval)
+	if n := written(); n == 0 {
+		t.Errorf("sample should have been flushed in the background")
+	}
+	s.Write(&Sample{Thread: 2})
+	s.Close()
+	if s.stop != nil || !strings.Contains(b.String(), `"thread":2`) {
+		t.Errorf("unexpected state after close %q", b.String())
+	}
+	// Usable again, e.g. by the next run:
+	s.Write(&Sample{Thread: 3})
+	s.Close()
+	if lines := strings.Count(b.String(), "\n"); lines != 3 {
+		t.Errorf("expected 3 samples, got %q", b.String())
+	}
+}
+
+func TestStatsPush(t *testing.T) {
+	h := stats.NewHistogram(0, 1)
+	h.Record(1)
+	h.Record(3)
+	r := &RunnerResults{
+		RunType:           "HTTP",
+		Labels:            "a, b=c",
+		StartTime:         time.Unix(1620000000, 0),
+		RequestedQPS:      "10",
+		ActualQPS:         9.5,
+		ActualDuration:    2 * time.Second,
+		DurationHistogram: h.Export().CalcPercentiles([]float64{50, 99.9}),
+	}
+	var received []string
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mu.Lock()
+		received = append(received, req.URL.String(), string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	p, err := NewStatsPusher("influx://" + strings.TrimPrefix(srv.URL, "http://") + "/perf?rp=week")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.PushResults(r); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"/write?db=perf&precision=ns&rp=week",
+		`fortio,phase=final,run_type=HTTP,labels=a\,\ b\=c count=2i,qps=9.5,requested_qps=10,min=1,max=3,avg=2,stddev=1,` +
+			"p50=1,p99_9=2.998 1620000002000000000"}
+	if len(received) != 2 || received[0] != expected[0] || received[1] != expected[1] {
+		t.Errorf("unexpected influx push %q, expected %q", received, expected)
+	}
+	// statsd:
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if p, err = NewStatsPusher("statsd://" + conn.LocalAddr().String() + "/team/perf"); err != nil {
+		t.Fatal(err)
+	}
+	c := &Checkpoint{RunType: "HTTP", Labels: "x.y", Index: 1, Count: 4, ActualQPS: 2}
+	if err = p.PushCheckpoint(c); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "team.perf.HTTP.x_y.interim.count:4|g\nteam.perf.HTTP.x_y.interim.qps:2|g" {
+		t.Errorf("unexpected statsd push %q", got)
+	}
+	for _, bad := range []string{"influx://host", "foo://host/db", "statsd:///x"} {
+		if _, err := NewStatsPusher(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+type failingEveryOther struct {
+	calls int
+}
+
+func (f *failingEveryOther) Run(t int) {
+	f.calls++
+}
+
+func (f *failingEveryOther) LastCallFailed() bool {
+	return f.calls%2 == 0
+}
+
+func TestTimeseries(t *testing.T) {
+	f := failingEveryOther{}
+	o := RunnerOptions{QPS: 50, NumThreads: 1, Duration: 550 * time.Millisecond, TimeseriesInterval: 200 * time.Millisecond}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&f)
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	if res.TimeseriesInterval != o.TimeseriesInterval || len(res.Timeseries) != 3 {
+		t.Fatalf("unexpected timeseries %v %+v", res.TimeseriesInterval, res.Timeseries)
+	}
+	var count, errors int64
+	for i, p := range res.Timeseries {
+		if p.Start != time.Duration(i)*o.TimeseriesInterval || p.Count == 0 || p.Avg < 0 || p.P99 < p.Avg || p.Max < p.P99 {
+			t.Errorf("unexpected point %d %+v", i, p)
+		}
+		count += p.Count
+		errors += p.Errors
+	}
+	if count != res.DurationHistogram.Count || errors != count/2 {
+		t.Errorf("timeseries total %d calls %d errors doesn't match the run's %d", count, errors, res.DurationHistogram.Count)
+	}
+	// Not recorded by default:
+	o = RunnerOptions{QPS: -1, NumThreads: 1, Exactly: 5}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&Noop{})
+	if res = r.Run(); res.Timeseries != nil {
+		t.Errorf("unexpected timeseries %+v", res.Timeseries)
+	}
+	r.Options().ReleaseRunners()
+	// Bounded interval:
+	o = RunnerOptions{TimeseriesInterval: time.Nanosecond, Duration: time.Second, Stop: bogusTestChan}
+	o.Normalize()
+	if o.TimeseriesInterval != MinTimeseriesInterval {
+		t.Errorf("timeseries interval %v not raised to the minimum", o.TimeseriesInterval)
+	}
+	o = RunnerOptions{TimeseriesInterval: time.Second, Duration: 5 * time.Hour, Stop: bogusTestChan}
+	o.Normalize()
+	if o.TimeseriesInterval != 1800*time.Millisecond {
+		t.Errorf("timeseries interval %v not raised for max %d points", o.TimeseriesInterval, MaxTimeseriesPoints)
+	}
+	// Sparse, and capped, intervals:
+	ts := newTimeseries(time.Second, stats.NewHistogram(0, 1), time.Now())
+	th := ts.thread()
+	for _, index := range []int{3, MaxTimeseriesPoints + 5} {
+		th.index = index
+		th.h.Record(0.5)
+		th.flush()
+	}
+	if points := ts.points(); len(points) != 4 || points[3].Count != 1 || points[0].Count != 0 || len(ts.buckets) != 1 {
+		t.Errorf("unexpected sparse timeseries %+v", points)
+	}
+}
+
+func TestAvailabilityTracker(t *testing.T) {
+	start := time.Now()
+	a := NewAvailabilityTracker(3)
+	a.Record(true)
+	a.Record(false) // isolated errors don't count
+	a.Record(false)
+	a.Record(true)
+	a.Record(false)
+	time.Sleep(20 * time.Millisecond)
+	a.Record(false)
+	a.Record(false)
+	a.Record(false)
+	a.Record(true)
+	a.Record(true)
+	a.Record(false) // still unavailable at the end
+	a.Record(false)
+	a.Record(false)
+	end := time.Now().Add(10 * time.Millisecond)
+	w := a.Windows(start, end)
+	if len(w) != 2 || w[0].Errors != 4 || w[0].Duration < 20*time.Millisecond || w[1].Errors != 3 ||
+		w[1].Start+w[1].Duration != end.Sub(start) || w[1].Start < w[0].Start+w[0].Duration {
+		t.Errorf("unexpected unavailable windows %+v", w)
+	}
+	var b bytes.Buffer
+	PrintUnavailable(&b, []UnavailableWindow{{Start: 1500 * time.Millisecond, Duration: 2 * time.Second, Errors: 42}})
+	if b.String() != "Target unavailable [1.5s-3.5s] for 2s : 42 errors\n" {
+		t.Errorf("unexpected print %q", b.String())
+	}
+}
+
+type backingOff struct {
+	calls int
+}
+
+func (b *backingOff) Run(t int) {
+	b.calls++
+}
+
+func (b *backingOff) Backoff() time.Duration {
+	return time.Duration(b.calls) * 10 * time.Millisecond
+}
+
+func TestBackoff(t *testing.T) {
+	b := backingOff{}
+	o := RunnerOptions{QPS: -1, NumThreads: 1, Exactly: 4}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&b)
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	// Backoff after the first 3 calls, not after the last one nor in the calls' duration:
+	if res.ActualDuration < 60*time.Millisecond || res.DurationHistogram.Max > .01 {
+		t.Errorf("unexpected run duration %v, max call %g", res.ActualDuration, res.DurationHistogram.Max)
+	}
+	// Excluded from the qps pacing: no catching up after the backoff.
+	b = backingOff{}
+	o = RunnerOptions{QPS: 100, NumThreads: 1, Exactly: 4}
+	r = NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&b)
+	res = r.Run()
+	r.Options().ReleaseRunners()
+	if res.ActualDuration < 90*time.Millisecond {
+		t.Errorf("unexpected qps run duration %v", res.ActualDuration)
+	}
+}
+
+func TestQPSControl(t *testing.T) {
+	var c atomicCount
+	control := NewQPSControl()
+	// 1 call per second per thread until changed to 200 qps (100 per thread) after 100ms.
+	o := RunnerOptions{QPS: 2, NumThreads: 2, Duration: 600 * time.Millisecond, QPSControl: control}
+	r := NewPeriodicRunner(&o)
+	r.Options().MakeRunners(&c)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if err := control.SetQPS(200); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	}()
+	res := r.Run()
+	r.Options().ReleaseRunners()
+	if res.DurationHistogram.Count < 80 || res.DurationHistogram.Count > 110 || res.RequestedQPS != "2" {
+		t.Errorf("unexpected %d calls, requested qps %s", res.DurationHistogram.Count, res.RequestedQPS)
+	}
+	if len(res.QPSChanges) != 1 || res.QPSChanges[0].QPS != 200 || res.QPSChanges[0].Offset < 100*time.Millisecond ||
+		res.QPSChanges[0].Offset > 200*time.Millisecond || control.QPS() != 200 {
+		t.Errorf("unexpected qps changes %+v", res.QPSChanges)
+	}
+	if err := control.SetQPS(-1); err == nil {
+		t.Errorf("expected an error for a negative qps")
+	}
+	control.ReadCommands(strings.NewReader("50\n\nbad\n0\n 25 \n"))
+	if q := control.QPS(); q != 25 || len(control.Changes()) != 3 {
+		t.Errorf("unexpected qps %g after the commands, changes %+v", q, control.Changes())
+	}
+	if !control.Active() {
+		t.Errorf("qps control of a paced run should be active")
+	}
+	// Not with bursts, nor once the runner switched to max qps:
+	for _, tst := range []RunnerOptions{{BurstSize: 10, QPS: 10}, {QPS: -1}} {
+		ignored := NewQPSControl()
+		o = tst
+		o.Duration = time.Second
+		o.QPSControl = ignored
+		o.Stop = bogusTestChan
+		o.Normalize()
+		if o.QPSControl != nil || ignored.Active() {
+			t.Errorf("unexpected qps control with %+v", tst)
+		}
+		if err := ignored.SetQPS(10); err == nil || len(ignored.Changes()) != 0 {
+			t.Errorf("expected an error changing the qps of an ignored control, got %v", err)
+		}
+	}
+}
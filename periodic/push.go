@@ -0,0 +1,279 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/stats"
+)
+
+// Stats push phases (the "phase" tag/metric name part).
+const (
+	PushPhaseFinal   = "final"
+	PushPhaseInterim = "interim"
+)
+
+// PushTimeout is the timeout of each stats push.
+var PushTimeout = 5 * time.Second
+
+// StatsPusher pushes the final and interim (checkpoints) stats of runs to a
+// time series database, either InfluxDB, using the line protocol over its
+// (1.x) http write api, or StatsD (as gauges, over udp).
+type StatsPusher struct {
+	URL    string // as given
+	influx *url.URL
+	statsd string // host:port
+	prefix string // of the statsd metrics
+}
+
+// NewStatsPusher returns the pusher of the url:
+//   influx://host[:8086]/db[?rp=...] (or influxs:// for https, user:password@ for basic auth)
+//   statsd://host[:8125][/prefix] (the metrics' prefix, "fortio" by default).
+func NewStatsPusher(rawURL string) (*StatsPusher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	p := StatsPusher{URL: rawURL}
+	switch strings.ToLower(u.Scheme) {
+	case "influx", "influxs":
+		db := strings.Trim(u.Path, "/")
+		if db == "" {
+			return nil, fmt.Errorf("missing database in %q, expecting influx://host:port/db", rawURL)
+		}
+		w := url.URL{Scheme: "http", Host: withDefaultPort(u.Host, "8086"), Path: "/write", User: u.User}
+		if strings.EqualFold(u.Scheme, "influxs") {
+			w.Scheme = "https"
+		}
+		q := u.Query()
+		q.Set("db", db)
+		q.Set("precision", "ns")
+		w.RawQuery = q.Encode()
+		p.influx = &w
+	case "statsd":
+		p.statsd = withDefaultPort(u.Host, "8125")
+		p.prefix = strings.Trim(strings.ReplaceAll(u.Path, "/", "."), ".")
+		if p.prefix == "" {
+			p.prefix = "fortio"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported stats push url %q, expecting influx:// or statsd://", rawURL)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("missing host in stats push url %q", rawURL)
+	}
+	return &p, nil
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// pushStats are the stats pushed for a run or a checkpoint window.
+type pushStats struct {
+	phase        string
+	runType      string
+	labels       string
+	runID        int64
+	time         time.Time // end of the run/window
+	count        int64
+	qps          float64
+	requestedQPS float64 // <= 0 for max/unknown
+	h            *stats.HistogramData
+}
+
+// PushResults pushes the final stats of the run.
+func (p *StatsPusher) PushResults(r *RunnerResults) error {
+	s := pushStats{
+		phase:   PushPhaseFinal,
+		runType: r.RunType,
+		labels:  r.Labels,
+		runID:   r.RunID,
+		time:    r.StartTime.Add(r.ActualDuration),
+		qps:     r.ActualQPS,
+		h:       r.DurationHistogram,
+	}
+	if r.DurationHistogram != nil {
+		s.count = r.DurationHistogram.Count
+	}
+	s.requestedQPS, _ = strconv.ParseFloat(r.RequestedQPS, 64) // "max" -> 0
+	return p.push(&s)
+}
+
+// PushCheckpoint pushes the interim stats of the checkpoint's window.
+func (p *StatsPusher) PushCheckpoint(c *Checkpoint) error {
+	return p.push(&pushStats{
+		phase:   PushPhaseInterim,
+		runType: c.RunType,
+		labels:  c.Labels,
+		runID:   c.RunID,
+		time:    c.WindowStart.Add(c.WindowDuration),
+		count:   c.Count,
+		qps:     c.ActualQPS,
+		h:       c.DurationHistogram,
+	})
+}
+
+func (p *StatsPusher) push(s *pushStats) error {
+	if p.influx != nil {
+		return p.pushInflux(influxLine(s))
+	}
+	return p.pushStatsD(statsDLines(p.prefix, s))
+}
+
+func (p *StatsPusher) pushInflux(line string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), PushTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.influx.String(), strings.NewReader(line))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to push stats to %s: %w", p.influx.Redacted(), err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("influx push to %s failed with %s: %s", p.influx.Redacted(), resp.Status, bytes.TrimSpace(body))
+	}
+	log.LogVf("Pushed stats to %s: %s", p.influx.Redacted(), line)
+	return nil
+}
+
+func (p *StatsPusher) pushStatsD(lines []string) error {
+	conn, err := net.DialTimeout("udp", p.statsd, PushTimeout)
+	if err != nil {
+		return fmt.Errorf("unable to push stats to statsd %s: %w", p.statsd, err)
+	}
+	defer conn.Close()
+	// Batched in packets small enough for common MTUs:
+	var b bytes.Buffer
+	for _, l := range lines {
+		if b.Len() > 0 && b.Len()+1+len(l) > 1432 {
+			if _, err = conn.Write(b.Bytes()); err != nil {
+				return fmt.Errorf("unable to push stats to statsd %s: %w", p.statsd, err)
+			}
+			b.Reset()
+		}
+		if b.Len() > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(l)
+	}
+	if _, err = conn.Write(b.Bytes()); err != nil {
+		return fmt.Errorf("unable to push stats to statsd %s: %w", p.statsd, err)
+	}
+	log.LogVf("Pushed %d stats to statsd %s", len(lines), p.statsd)
+	return nil
+}
+
+// pushFields returns the names and values of the pushed stats, latencies in
+// seconds (like the json results).
+func pushFields(s *pushStats) ([]string, []float64) {
+	names := []string{"count", "qps"}
+	values := []float64{float64(s.count), s.qps}
+	if s.requestedQPS > 0 {
+		names = append(names, "requested_qps")
+		values = append(values, s.requestedQPS)
+	}
+	if h := s.h; h != nil && h.Count > 0 {
+		names = append(names, "min", "max", "avg", "stddev")
+		values = append(values, h.Min, h.Max, h.Avg, h.StdDev)
+		for _, p := range h.Percentiles {
+			names = append(names, "p"+strings.ReplaceAll(strconv.FormatFloat(p.Percentile, 'f', -1, 64), ".", "_"))
+			values = append(values, p.Value)
+		}
+	}
+	return names, values
+}
+
+var (
+	influxTagEscaper  = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\ `)
+	statsDNameEscaper = strings.NewReplacer(" ", "_", ",", "_", ":", "_", "|", "_", "@", "_", "/", "_", "\n", "_")
+)
+
+// influxLine returns the line protocol line of the stats: the "fortio"
+// measurement with the phase, run_type, labels and run_id tags.
+func influxLine(s *pushStats) string {
+	var b strings.Builder
+	b.WriteString("fortio,phase=")
+	b.WriteString(s.phase)
+	if s.runType != "" {
+		b.WriteString(",run_type=")
+		b.WriteString(influxTagEscaper.Replace(s.runType))
+	}
+	if s.labels != "" {
+		b.WriteString(",labels=")
+		b.WriteString(influxTagEscaper.Replace(s.labels))
+	}
+	if s.runID != 0 {
+		b.WriteString(",run_id=")
+		b.WriteString(strconv.FormatInt(s.runID, 10))
+	}
+	names, values := pushFields(s)
+	for i, n := range names {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(n)
+		b.WriteByte('=')
+		if n == "count" {
+			b.WriteString(strconv.FormatInt(s.count, 10))
+			b.WriteByte('i')
+			continue
+		}
+		b.WriteString(strconv.FormatFloat(values[i], 'f', -1, 64))
+	}
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatInt(s.time.UnixNano(), 10))
+	return b.String()
+}
+
+// statsDLines returns the statsd gauges of the stats, named
+// prefix.run_type[.labels].phase.stat.
+func statsDLines(prefix string, s *pushStats) []string {
+	base := prefix
+	if s.runType != "" {
+		base += "." + statsDNameEscaper.Replace(s.runType)
+	}
+	if s.labels != "" {
+		base += "." + statsDNameEscaper.Replace(strings.ReplaceAll(s.labels, ".", "_"))
+	}
+	base += "." + s.phase + "."
+	names, values := pushFields(s)
+	res := make([]string, 0, len(names))
+	for i, n := range names {
+		res = append(res, base+n+":"+strconv.FormatFloat(values[i], 'f', -1, 64)+"|g")
+	}
+	return res
+}
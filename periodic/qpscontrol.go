@@ -0,0 +1,200 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fortio.org/fortio/log"
+)
+
+// QPSControl changes the target qps of a run in progress (see
+// RunnerOptions.QPSControl), e.g. for an operator to explore the latency vs
+// throughput curve interactively in a single run. It is safe for concurrent
+// use and is for a single run.
+type QPSControl struct {
+	mutex   sync.Mutex
+	qps     float64
+	start   time.Time
+	changed chan struct{} // closed, and replaced, on each change to wake up the threads
+	changes []QPSChange
+	ignored bool // by the run, not a uniformly paced qps one (see CanChangeQPS)
+}
+
+// QPSChange is a change of the target qps during a run.
+type QPSChange struct {
+	Offset time.Duration // from the start of the run
+	QPS    float64
+}
+
+// NewQPSControl makes a new QPSControl, to set in the RunnerOptions.
+func NewQPSControl() *QPSControl {
+	return &QPSControl{changed: make(chan struct{})}
+}
+
+// QPS returns the current target qps (0 until the run's options are normalized).
+func (c *QPSControl) QPS() float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.qps
+}
+
+// Active returns false once the run's options normalization ignored the
+// control, the run's qps (as finally set by its runner) not being changeable.
+func (c *QPSControl) Active() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return !c.ignored
+}
+
+// SetQPS changes the target qps of the run, which must be positive (the run
+// stays paced). Each thread makes its next call right away and is then paced
+// at its share of the new qps. Errors if the run ignores the control.
+func (c *QPSControl) SetQPS(qps float64) error {
+	if qps <= 0 || math.IsInf(qps, 0) || math.IsNaN(qps) {
+		return fmt.Errorf("target qps %g should be positive", qps)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.ignored {
+		return fmt.Errorf("the target qps of this run can't be changed, not a uniformly paced qps run")
+	}
+	if qps == c.qps {
+		return nil
+	}
+	var offset time.Duration
+	if !c.start.IsZero() {
+		offset = time.Since(c.start)
+	}
+	log.Infof("Target qps changed from %g to %g after %v", c.qps, qps, offset)
+	c.qps = qps
+	c.changes = append(c.changes, QPSChange{Offset: offset, QPS: qps})
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return nil
+}
+
+// Changes returns the changes of the target qps made so far.
+func (c *QPSControl) Changes() []QPSChange {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]QPSChange(nil), c.changes...)
+}
+
+// ReadCommands changes the target qps to each (non empty) line read from in,
+// e.g. typed on stdin by the operator, until its end.
+func (c *QPSControl) ReadCommands(in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		qps, err := strconv.ParseFloat(line, 64)
+		if err == nil {
+			err = c.SetQPS(qps)
+		}
+		if err != nil {
+			log.Errf("Ignoring invalid target qps %q: %v", line, err)
+		}
+	}
+}
+
+// scale multiplies the target qps by factor.
+func (c *QPSControl) scale(factor float64) {
+	_ = c.SetQPS(c.QPS() * factor)
+}
+
+// init sets the initial target qps, unless already changed.
+func (c *QPSControl) init(qps float64) {
+	c.mutex.Lock()
+	if c.qps == 0 {
+		c.qps = qps
+	}
+	c.mutex.Unlock()
+}
+
+// ignore marks the control as ignored by the run.
+func (c *QPSControl) ignore() {
+	c.mutex.Lock()
+	c.ignored = true
+	c.mutex.Unlock()
+}
+
+// begin notes the start of the run, the origin of the changes' offsets.
+func (c *QPSControl) begin(start time.Time) {
+	c.mutex.Lock()
+	c.start = start
+	c.mutex.Unlock()
+}
+
+// qpsPacer paces the calls of a thread following the changes of a QPSControl.
+type qpsPacer struct {
+	control  *QPSControl
+	share    float64 // of the target qps for this thread
+	qps      float64 // of this thread
+	changed  <-chan struct{}
+	base     float64 // target elapsed, in seconds, of call baseCall
+	baseCall int64
+}
+
+func newQPSPacer(control *QPSControl, share float64) *qpsPacer {
+	p := &qpsPacer{control: control, share: share}
+	p.rebase(0, 0)
+	return p
+}
+
+// changes returns the channel closed on the next change of the target qps,
+// nil (never ready) without pacer.
+func (p *qpsPacer) changes() <-chan struct{} {
+	if p == nil {
+		return nil
+	}
+	return p.changed
+}
+
+// rebase paces from call i, made at elapsed, with the current target qps.
+func (p *qpsPacer) rebase(i int64, elapsed time.Duration) {
+	p.control.mutex.Lock()
+	p.qps, p.changed = p.control.qps*p.share, p.control.changed
+	p.control.mutex.Unlock()
+	p.base, p.baseCall = elapsed.Seconds(), i
+}
+
+// target returns the target elapsed, in seconds, of call i (elapsed being the
+// current one): right away after a change of the target qps and then evenly
+// paced at the new rate.
+func (p *qpsPacer) target(i int64, elapsed time.Duration) float64 {
+	select {
+	case <-p.changed:
+		p.rebase(i, elapsed)
+	default:
+	}
+	return p.base + float64(i-p.baseCall)/p.qps
+}
+
+// CanChangeQPS returns whether the target qps of the (normalized) run can be
+// changed while it's in progress (see QPSControl): only for uniformly paced qps
+// runs, without schedule, bursts, arrivals nor poisson arrivals.
+func (r *RunnerOptions) CanChangeQPS() bool {
+	return r.QPS > 0 && len(r.Schedule) == 0 && r.BurstSize == 0 && len(r.Arrivals) == 0 && r.Arrival != ArrivalPoisson
+}
@@ -0,0 +1,27 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows || plan9 || js
+// +build windows plan9 js
+
+package periodic // import "fortio.org/fortio/periodic"
+
+import "fortio.org/fortio/log"
+
+// WatchSignals isn't implemented on this platform (no SIGUSR1 nor SIGUSR2),
+// use ReadCommands instead.
+func (c *QPSControl) WatchSignals() (stop func()) {
+	log.Warnf("Changing the target qps with signals isn't supported on this platform")
+	return func() {}
+}
@@ -0,0 +1,51 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows && !plan9 && !js
+// +build !windows,!plan9,!js
+
+package periodic // import "fortio.org/fortio/periodic"
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"fortio.org/fortio/log"
+)
+
+// WatchSignals doubles the target qps on SIGUSR1 and halves it on SIGUSR2
+// until the returned stop function is called.
+func (c *QPSControl) WatchSignals() (stop func()) {
+	done := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for {
+			select {
+			case <-done:
+				signal.Stop(sig)
+				return
+			case s := <-sig:
+				factor := 2.
+				if s == syscall.SIGUSR2 {
+					factor = .5
+				}
+				log.Infof("Got %v, multiplying the target qps by %g", s, factor)
+				c.scale(factor)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
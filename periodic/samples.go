@@ -0,0 +1,149 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"fortio.org/fortio/log"
+)
+
+// Sample is the outcome of one call, streamed as a line of json (NDJSON) by
+// a SampleWriter during the run.
+type Sample struct {
+	Timestamp time.Time `json:"timestamp"` // start of the call
+	Latency   float64   `json:"latency"`   // duration of the call, in seconds
+	// How late the call started compared to its scheduled start (qps mode only),
+	// in seconds, for coordinated omission analysis.
+	Late   float64 `json:"late,omitempty"`
+	Code   int     `json:"code,omitempty"` // status code of the call, when the runner has one
+	Thread int     `json:"thread"`
+	Size   int64   `json:"size,omitempty"` // of the response, when the runner has one
+}
+
+// CallResulter is optionally implemented by the Runnables to add the status
+// code and response size of their last call to the streamed Samples.
+type CallResulter interface {
+	LastCallResult() (code int, size int64)
+}
+
+// SampleFlushInterval is how often the buffered samples are written out during
+// the run.
+const SampleFlushInterval = 100 * time.Millisecond
+
+// SampleWriter streams the Samples of each call, one json line each, to an
+// io.Writer. It's safe for concurrent use by the run's threads, which only
+// buffer them: a background go routine writes them out every
+// SampleFlushInterval, so a slow writer doesn't slow down the calls.
+type SampleWriter struct {
+	mu      sync.Mutex
+	buf     *bufio.Writer
+	enc     *json.Encoder
+	errors  int64
+	stop    chan struct{} // of the background flushes, nil when not running
+	stopped chan struct{}
+}
+
+// NewSampleWriter returns a SampleWriter writing to w.
+func NewSampleWriter(w io.Writer) *SampleWriter {
+	buf := bufio.NewWriter(w)
+	return &SampleWriter{buf: buf, enc: json.NewEncoder(buf)}
+}
+
+// Write buffers the sample as one line of json, starting the background
+// flushes if needed. Errors are logged (once) and counted but don't stop the
+// run.
+func (s *SampleWriter) Write(sample *Sample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop == nil {
+		s.stop, s.stopped = make(chan struct{}), make(chan struct{})
+		go s.flushLoop(s.stop, s.stopped)
+	}
+	if err := s.enc.Encode(sample); err != nil {
+		s.failed(err)
+	}
+}
+
+// Close writes out the buffered samples and stops the background flushes, at
+// the end of each run (a later Write, e.g. from the next run of a sweep, starts
+// them again). It doesn't close the underlying io.Writer.
+func (s *SampleWriter) Close() {
+	s.mu.Lock()
+	stop, stopped := s.stop, s.stopped
+	s.stop = nil
+	s.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-stopped
+	}
+	s.mu.Lock()
+	s.flush()
+	s.mu.Unlock()
+}
+
+func (s *SampleWriter) flushLoop(stop, stopped chan struct{}) {
+	defer close(stopped)
+	ticker := time.NewTicker(SampleFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			s.flush()
+			s.mu.Unlock()
+		}
+	}
+}
+
+// flush writes out the buffered samples, called with the lock held.
+func (s *SampleWriter) flush() {
+	if s.buf.Buffered() == 0 {
+		return
+	}
+	if err := s.buf.Flush(); err != nil {
+		s.failed(err)
+	}
+}
+
+// failed logs the first error and counts them all, called with the lock held.
+func (s *SampleWriter) failed(err error) {
+	if s.errors == 0 {
+		log.Errf("Unable to stream sample: %v", err)
+	}
+	s.errors++
+}
+
+// Errors returns the number of errors writing the samples.
+func (s *SampleWriter) Errors() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.errors
+}
+
+// record streams the sample of the call the thread id's Runnable f just made.
+func (s *SampleWriter) record(f Runnable, id int, fStart time.Time, fDuration float64, late time.Duration) {
+	sample := Sample{Timestamp: fStart, Latency: fDuration, Thread: id, Late: late.Seconds()}
+	if cr, ok := f.(CallResulter); ok {
+		sample.Code, sample.Size = cr.LastCallResult()
+	}
+	s.Write(&sample)
+}
@@ -0,0 +1,196 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"fortio.org/fortio/stats"
+)
+
+// QPSStep is a step of a QPSSchedule: the target qps changes linearly from
+// From to To over Duration (constant when they are equal).
+type QPSStep struct {
+	From     float64
+	To       float64
+	Duration time.Duration
+}
+
+// QPSSchedule is a sequence of steps making the target qps change over the
+// run, e.g. to ramp up and down instead of starting and stopping at a
+// constant qps, which hides warm-up and saturation effects.
+type QPSSchedule []QPSStep
+
+// StepResult is the result of the calls started during a step of the QPSSchedule.
+type StepResult struct {
+	QPSStep
+	// Offset of the step from the start of the run.
+	Start     time.Duration
+	Count     int64
+	ActualQPS float64
+	// Duration of the calls started during the step, nil if none.
+	DurationHistogram *stats.HistogramData
+}
+
+// ParseQPSSchedule parses comma separated steps, each either a linear ramp
+// "from->to over duration" (from defaults to the previous step's end qps),
+// "hold duration" keeping the previous step's end qps or a constant
+// "qps for duration", e.g. "0->1000 over 2m, hold 5m, ->0 over 1m".
+func ParseQPSSchedule(s string) (QPSSchedule, error) {
+	var schedule QPSSchedule
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		fields := strings.Fields(part)
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fmt.Errorf("invalid qps schedule step %q", part)
+		}
+		var step QPSStep
+		var err error
+		prev := math.NaN()
+		if len(schedule) > 0 {
+			prev = schedule[len(schedule)-1].To
+		}
+		switch {
+		case len(fields) == 2 && fields[0] == "hold":
+			step.From, step.To = prev, prev
+		case len(fields) == 3 && fields[1] == "over" && strings.Contains(fields[0], "->"):
+			fromTo := strings.SplitN(fields[0], "->", 2)
+			step.From = prev
+			if fromTo[0] != "" {
+				if step.From, err = parseScheduleQPS(fromTo[0]); err != nil {
+					return nil, err
+				}
+			}
+			if step.To, err = parseScheduleQPS(fromTo[1]); err != nil {
+				return nil, err
+			}
+		case len(fields) == 3 && fields[1] == "for":
+			if step.From, err = parseScheduleQPS(fields[0]); err != nil {
+				return nil, err
+			}
+			step.To = step.From
+		default:
+			return nil, fmt.Errorf("invalid qps schedule step %q, expecting \"[from]->to over duration\", "+
+				"\"hold duration\" or \"qps for duration\"", part)
+		}
+		if math.IsNaN(step.From) {
+			return nil, fmt.Errorf("qps schedule step %q needs the starting qps of a previous step", part)
+		}
+		if step.Duration, err = time.ParseDuration(fields[len(fields)-1]); err != nil {
+			return nil, fmt.Errorf("invalid qps schedule step %q duration: %w", part, err)
+		}
+		if step.Duration <= 0 {
+			return nil, fmt.Errorf("qps schedule step %q duration must be positive", part)
+		}
+		schedule = append(schedule, step)
+	}
+	if schedule.MaxQPS() <= 0 {
+		return nil, fmt.Errorf("qps schedule %q never has a positive qps", s)
+	}
+	return schedule, nil
+}
+
+func parseScheduleQPS(s string) (float64, error) {
+	qps, err := strconv.ParseFloat(s, 64)
+	if err != nil || qps < 0 || math.IsInf(qps, 0) {
+		return 0, fmt.Errorf("invalid qps schedule qps %q", s)
+	}
+	return qps, nil
+}
+
+// String returns the schedule in the ParseQPSSchedule syntax.
+func (s QPSSchedule) String() string {
+	parts := make([]string, len(s))
+	for i, step := range s {
+		if step.From == step.To {
+			parts[i] = fmt.Sprintf("%g for %v", step.From, step.Duration)
+		} else {
+			parts[i] = fmt.Sprintf("%g->%g over %v", step.From, step.To, step.Duration)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Duration returns the total duration of the schedule.
+func (s QPSSchedule) Duration() time.Duration {
+	var d time.Duration
+	for _, step := range s {
+		d += step.Duration
+	}
+	return d
+}
+
+// MaxQPS returns the highest target qps of the schedule.
+func (s QPSSchedule) MaxQPS() float64 {
+	max := 0.
+	for _, step := range s {
+		max = math.Max(max, math.Max(step.From, step.To))
+	}
+	return max
+}
+
+// Calls returns the number of calls of the whole schedule.
+func (s QPSSchedule) Calls() float64 {
+	calls := 0.
+	for _, step := range s {
+		calls += step.calls()
+	}
+	return calls
+}
+
+func (step QPSStep) calls() float64 {
+	return (step.From + step.To) / 2 * step.Duration.Seconds()
+}
+
+// timeOf returns when, from the start of the schedule, n calls should have
+// been made (the end of the schedule when it has fewer calls).
+func (s QPSSchedule) timeOf(n float64) time.Duration {
+	var start time.Duration
+	for _, step := range s {
+		calls := step.calls()
+		if n > calls || calls == 0 {
+			n -= calls
+			start += step.Duration
+			continue
+		}
+		// Solve n = from*t + (to-from)*t^2/(2*duration) for t:
+		d := step.Duration.Seconds()
+		var t float64
+		if step.To == step.From {
+			t = n / step.From
+		} else {
+			a := (step.To - step.From) / (2 * d)
+			t = (-step.From + math.Sqrt(math.Max(0, step.From*step.From+4*a*n))) / (2 * a)
+		}
+		return start + time.Duration(math.Min(t, d)*1e9)
+	}
+	return start
+}
+
+// stepAt returns the index of the step at offset t from the start of the
+// schedule (the last one past its end).
+func (s QPSSchedule) stepAt(t time.Duration) int {
+	for i, step := range s {
+		if t < step.Duration {
+			return i
+		}
+		t -= step.Duration
+	}
+	return len(s) - 1
+}
@@ -0,0 +1,173 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic // import "fortio.org/fortio/periodic"
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"time"
+)
+
+// ClientStatsInterval is how often the goroutines, open fds and heap are sampled during a run.
+var ClientStatsInterval = 250 * time.Millisecond
+
+// ClientCPUBoundThreshold is the fraction of the available cpu (GOMAXPROCS cores)
+// used by fortio itself above which a warning is printed: the results are then
+// likely limited by the load generator and not the target.
+const ClientCPUBoundThreshold = 0.9
+
+// ClientStats is the summary of fortio's own (client side) resource usage
+// during a run.
+type ClientStats struct {
+	// Cpu time used by the whole process during the run (-1 when unavailable).
+	UserCPUSeconds   float64
+	SystemCPUSeconds float64
+	// Cpu usage in percent of 1 core (so can be up to GOMAXPROCS * 100).
+	CPUPercent float64
+	GOMAXPROCS int
+	NumCPU     int
+	// Garbage collections during the run.
+	NumGC         uint32
+	GCPauseTotal  time.Duration
+	GCPauseMax    time.Duration
+	GoroutinesMax int
+	// Maximum open file descriptors (sockets included) or -1 when unavailable.
+	OpenFDsMax   int
+	HeapAllocMax uint64
+	// Container limits detected at startup, -1 when not limited (see ContainerLimits).
+	CPUQuota    float64
+	MemoryLimit int64
+}
+
+// CPUBound returns true if the cpu usage was close to the available cpu.
+func (c *ClientStats) CPUBound() bool {
+	return c.CPUPercent >= 0 && c.CPUPercent >= 100*ClientCPUBoundThreshold*float64(c.GOMAXPROCS)
+}
+
+// Print outputs a summary of the client stats.
+func (c *ClientStats) Print(out io.Writer) {
+	_, _ = fmt.Fprintf(out, "Client cpu %.1f%% (user %.3fs sys %.3fs, gomaxprocs %d), %d GCs (pause total %v max %v), "+
+		"max goroutines %d, max open fds %d, max heap %d\n", c.CPUPercent, c.UserCPUSeconds, c.SystemCPUSeconds,
+		c.GOMAXPROCS, c.NumGC, c.GCPauseTotal, c.GCPauseMax, c.GoroutinesMax, c.OpenFDsMax, c.HeapAllocMax)
+	if c.CPUQuota > 0 || c.MemoryLimit > 0 {
+		_, _ = fmt.Fprintf(out, "Container cpu quota %g, memory limit %d\n", c.CPUQuota, c.MemoryLimit)
+	}
+	if c.CPUBound() {
+		_, _ = fmt.Fprintf(out, "WARNING fortio used %.1f%% of its %d cores: results are likely limited by the client\n",
+			c.CPUPercent, c.GOMAXPROCS)
+	}
+}
+
+// openFDs returns the number of open file descriptors of the process or -1
+// when that can't be determined (non linux systems).
+func openFDs() int {
+	f, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(f)
+}
+
+// clientStatsCollector samples the resource usage in the background between
+// start and stop.
+type clientStatsCollector struct {
+	stats    ClientStats
+	start    time.Time
+	startCPU [2]float64
+	startGC  runtime.MemStats
+	done     chan struct{}
+	finished chan struct{}
+}
+
+func startClientStats() *clientStatsCollector {
+	c := &clientStatsCollector{done: make(chan struct{}), finished: make(chan struct{})}
+	runtime.ReadMemStats(&c.startGC)
+	c.stats.GOMAXPROCS = runtime.GOMAXPROCS(0)
+	c.stats.NumCPU = runtime.NumCPU()
+	c.stats.OpenFDsMax = -1
+	limits := DetectedContainerLimits()
+	c.stats.CPUQuota = limits.CPUQuota
+	c.stats.MemoryLimit = limits.MemoryLimit
+	c.startCPU[0], c.startCPU[1] = cpuTimes()
+	c.start = time.Now()
+	c.sample(false)
+	go func() {
+		ticker := time.NewTicker(ClientStatsInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.done:
+				close(c.finished)
+				return
+			case <-ticker.C:
+				c.sample(true)
+			}
+		}
+	}()
+	return c
+}
+
+// sample updates the maximums. Heap is only sampled when asked as it needs
+// a (short) stop the world.
+func (c *clientStatsCollector) sample(heap bool) {
+	if n := runtime.NumGoroutine(); n > c.stats.GoroutinesMax {
+		c.stats.GoroutinesMax = n
+	}
+	if n := openFDs(); n > c.stats.OpenFDsMax {
+		c.stats.OpenFDsMax = n
+	}
+	if heap {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		if m.HeapAlloc > c.stats.HeapAllocMax {
+			c.stats.HeapAllocMax = m.HeapAlloc
+		}
+	}
+}
+
+// stop ends the collection and returns the summary.
+func (c *clientStatsCollector) stop() *ClientStats {
+	close(c.done)
+	<-c.finished
+	c.sample(false)
+	elapsed := time.Since(c.start)
+	user, sys := cpuTimes()
+	var end runtime.MemStats
+	runtime.ReadMemStats(&end)
+	s := &c.stats
+	if end.HeapAlloc > s.HeapAllocMax {
+		s.HeapAllocMax = end.HeapAlloc
+	}
+	if user < 0 {
+		s.UserCPUSeconds, s.SystemCPUSeconds, s.CPUPercent = -1, -1, -1
+	} else {
+		s.UserCPUSeconds = user - c.startCPU[0]
+		s.SystemCPUSeconds = sys - c.startCPU[1]
+		s.CPUPercent = 100. * (s.UserCPUSeconds + s.SystemCPUSeconds) / elapsed.Seconds()
+	}
+	s.NumGC = end.NumGC - c.startGC.NumGC
+	s.GCPauseTotal = time.Duration(end.PauseTotalNs - c.startGC.PauseTotalNs)
+	// PauseNs is a circular buffer of the most recent pauses.
+	n := len(end.PauseNs)
+	for i := uint32(0); i < s.NumGC && i < uint32(n); i++ {
+		p := time.Duration(end.PauseNs[(int(end.NumGC)-1-int(i)+n)%n])
+		if p > s.GCPauseMax {
+			s.GCPauseMax = p
+		}
+	}
+	return s
+}
@@ -0,0 +1,130 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Periodic load shapes (see ParseLoadShape).
+const (
+	LoadShapeSine     = "sine"
+	LoadShapeSawtooth = "sawtooth"
+)
+
+// sineSegments is the number of linear steps approximating each period of a sine load shape.
+const sineSegments = 16
+
+// Bounds of the load shapes (see ParseLoadShape): their period is at least
+// MinLoadShapePeriod and their schedule, repeated for the run's duration, has at
+// most MaxLoadShapeSteps steps.
+const (
+	MinLoadShapePeriod = time.Second
+	MaxLoadShapeSteps  = 100000
+)
+
+// ParseLoadShape parses a cyclic load shape "kind:period=duration,min=qps,max=qps"
+// (min defaults to 0), e.g. "sine:period=60s,min=100,max=1000", and returns the
+// QPSSchedule repeating it for duration (one period when duration <= 0). The sine
+// starts at min, peaks at max half way through each period and is approximated by
+// linear steps, the sawtooth ramps up from min to max over each period and drops
+// back to min. Useful to test autoscalers.
+func ParseLoadShape(s string, duration time.Duration) (QPSSchedule, error) {
+	kv := strings.SplitN(s, ":", 2)
+	kind := strings.TrimSpace(kv[0])
+	if kind != LoadShapeSine && kind != LoadShapeSawtooth {
+		return nil, fmt.Errorf("invalid load shape %q, expecting %s or %s", kind, LoadShapeSine, LoadShapeSawtooth)
+	}
+	if len(kv) != 2 {
+		return nil, fmt.Errorf("load shape %q needs its period and max", s)
+	}
+	var period time.Duration
+	min, max := 0., math.NaN()
+	var err error
+	for _, param := range strings.Split(kv[1], ",") {
+		nv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(nv) != 2 {
+			return nil, fmt.Errorf("invalid load shape parameter %q, expecting name=value", param)
+		}
+		switch nv[0] {
+		case "period":
+			if period, err = time.ParseDuration(nv[1]); err != nil {
+				return nil, fmt.Errorf("invalid load shape period: %w", err)
+			}
+		case "min":
+			min, err = parseScheduleQPS(nv[1])
+		case "max":
+			max, err = parseScheduleQPS(nv[1])
+		default:
+			return nil, fmt.Errorf("unknown load shape parameter %q, expecting period, min or max", nv[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if period < MinLoadShapePeriod {
+		return nil, fmt.Errorf("load shape %q needs a period of at least %v", s, MinLoadShapePeriod)
+	}
+	if math.IsNaN(max) || max <= min {
+		return nil, fmt.Errorf("load shape %q needs a max above its min (%g)", s, min)
+	}
+	if duration <= 0 {
+		duration = period
+	}
+	segments := int64(1)
+	if kind == LoadShapeSine {
+		segments = sineSegments
+	}
+	// Before building it, as a short period over a long duration could be huge.
+	if periods := (int64(duration) + int64(period) - 1) / int64(period); periods > MaxLoadShapeSteps/segments {
+		return nil, fmt.Errorf("load shape %q over %v would have more than %d steps, use a longer period",
+			s, duration, MaxLoadShapeSteps)
+	}
+	var cycle QPSSchedule
+	if kind == LoadShapeSawtooth {
+		cycle = QPSSchedule{{From: min, To: max, Duration: period}}
+	} else {
+		qpsAt := func(i int) float64 {
+			qps := min + (max-min)*(1-math.Cos(2*math.Pi*float64(i)/sineSegments))/2
+			return math.Round(qps*100) / 100 // for readable steps
+		}
+		// The last step ends at the period so rounding doesn't accumulate.
+		for i := 0; i < sineSegments; i++ {
+			start, end := period*time.Duration(i)/sineSegments, period*time.Duration(i+1)/sineSegments
+			cycle = append(cycle, QPSStep{From: qpsAt(i), To: qpsAt(i + 1), Duration: end - start})
+		}
+	}
+	return cycle.repeat(duration), nil
+}
+
+// repeat returns the schedule repeated for duration, the last step being cut
+// (at the qps of that point) when the duration isn't a multiple of the schedule's.
+func (s QPSSchedule) repeat(duration time.Duration) QPSSchedule {
+	var res QPSSchedule
+	for left := duration; left > 0; {
+		for _, step := range s {
+			if step.Duration >= left {
+				to := step.From + (step.To-step.From)*float64(left)/float64(step.Duration)
+				return append(res, QPSStep{From: step.From, To: to, Duration: left})
+			}
+			res = append(res, step)
+			left -= step.Duration
+		}
+	}
+	return res
+}
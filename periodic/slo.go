@@ -0,0 +1,200 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"fortio.org/fortio/stats"
+)
+
+// SLO metrics besides the "p"+percentile latencies (e.g. p99).
+const (
+	SLOErrorRate = "error-rate"
+	SLOQPS       = "qps"
+	SLOAvg       = "avg"
+	SLOMin       = "min"
+	SLOMax       = "max"
+)
+
+// HasErrorRate is implemented by the results which know their fraction of
+// failed calls (e.g. non 2xx http codes), for the error-rate SLO.
+type HasErrorRate interface {
+	ErrorRate() float64
+}
+
+// ErrorRate returns the fraction of the counts (per result code) not in ok,
+// 0 when there are none.
+func ErrorRate(counts map[string]int64, ok ...string) float64 {
+	var total, errors int64
+	for code, n := range counts {
+		total += n
+		errors += n
+		for _, o := range ok {
+			if code == o {
+				errors -= n
+				break
+			}
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(errors) / float64(total)
+}
+
+// SLO is a service level objective threshold on a result metric: the
+// error-rate, the actual qps or a latency (avg, min, max or pNN percentile).
+type SLO struct {
+	Text       string // as given, e.g. "p99<250ms"
+	Metric     string
+	Percentile float64 // of "pNN" metrics
+	Less       bool    // the metric has to be less than the threshold, greater otherwise
+	Threshold  float64 // seconds for latencies, fraction for the error-rate
+}
+
+// ParseSLOs parses the comma separated SLOs, each "metric<threshold" or
+// "metric>threshold" with metric one of error-rate (fraction or % threshold),
+// qps, avg, min, max or pNN (latencies, as durations or seconds), e.g.
+// "p99<250ms,error-rate<1%".
+func ParseSLOs(s string) ([]SLO, error) {
+	var res []SLO
+	for _, f := range splitList(s) {
+		i := strings.IndexAny(f, "<>")
+		if i <= 0 || i == len(f)-1 {
+			return nil, fmt.Errorf("invalid slo %q, expecting metric<threshold or metric>threshold", f)
+		}
+		slo := SLO{Text: f, Metric: strings.TrimSpace(f[:i]), Less: f[i] == '<'}
+		value := strings.TrimSpace(f[i+1:])
+		var err error
+		switch {
+		case slo.Metric == SLOErrorRate:
+			if strings.HasSuffix(value, "%") {
+				slo.Threshold, err = strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+				slo.Threshold /= 100.
+			} else {
+				slo.Threshold, err = strconv.ParseFloat(value, 64)
+			}
+		case slo.Metric == SLOQPS:
+			slo.Threshold, err = strconv.ParseFloat(value, 64)
+		case slo.Metric == SLOAvg, slo.Metric == SLOMin, slo.Metric == SLOMax, strings.HasPrefix(slo.Metric, "p"):
+			if slo.Metric[0] == 'p' {
+				slo.Percentile, err = strconv.ParseFloat(slo.Metric[1:], 64)
+				if err != nil || slo.Percentile <= 0 || slo.Percentile > 100 {
+					return nil, fmt.Errorf("invalid slo %q percentile %q", f, slo.Metric)
+				}
+			}
+			slo.Threshold, err = parseLatency(value)
+		default:
+			return nil, fmt.Errorf("invalid slo %q metric %q, expecting %s, %s, %s, %s, %s or pNN",
+				f, slo.Metric, SLOErrorRate, SLOQPS, SLOAvg, SLOMin, SLOMax)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid slo %q threshold %q", f, value)
+		}
+		res = append(res, slo)
+	}
+	return res, nil
+}
+
+// parseLatency parses a duration (e.g. 250ms) or a number of seconds.
+func parseLatency(s string) (float64, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return d.Seconds(), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// SLOResult is the check of an SLO against a result.
+type SLOResult struct {
+	SLO
+	Value  float64
+	Passed bool
+	// Skipped is the reason the SLO couldn't be checked (e.g. no error rate for
+	// the runner), empty when checked.
+	Skipped string
+}
+
+// String returns the outcome, e.g. "p99 0.312 >= 0.25" for a failure.
+func (r *SLOResult) String() string {
+	if r.Skipped != "" {
+		return r.Skipped
+	}
+	var op string
+	switch {
+	case r.Less && r.Passed:
+		op = "<"
+	case r.Less:
+		op = ">="
+	case r.Passed:
+		op = ">"
+	default:
+		op = "<="
+	}
+	return fmt.Sprintf("%s %.6g %s %.6g", r.Metric, r.Value, op, r.Threshold)
+}
+
+// CheckSLOs checks each SLO against the result.
+func CheckSLOs(slos []SLO, r HasRunnerResult) []SLOResult {
+	rr := r.Result()
+	h := rr.DurationHistogram
+	res := make([]SLOResult, 0, len(slos))
+	for _, slo := range slos {
+		c := SLOResult{SLO: slo}
+		switch {
+		case slo.Metric == SLOErrorRate:
+			if e, ok := r.(HasErrorRate); ok {
+				c.Value = e.ErrorRate()
+			} else {
+				c.Skipped = fmt.Sprintf("no error rate for %s results", rr.RunType)
+			}
+		case slo.Metric == SLOQPS:
+			c.Value = rr.ActualQPS
+		case h == nil || h.Count == 0:
+			c.Skipped = "no calls to check the latency of"
+		case slo.Metric == SLOAvg:
+			c.Value = h.Avg
+		case slo.Metric == SLOMin:
+			c.Value = h.Min
+		case slo.Metric == SLOMax:
+			c.Value = h.Max
+		default:
+			c.Value = percentile(h, slo.Percentile)
+		}
+		switch {
+		case c.Skipped != "":
+		case slo.Less:
+			c.Passed = c.Value < slo.Threshold
+		default:
+			c.Passed = c.Value > slo.Threshold
+		}
+		res = append(res, c)
+	}
+	return res
+}
+
+// percentile returns the percentile of the histogram, as reported in its
+// Percentiles when there (e.g. -p 99), computed otherwise.
+func percentile(h *stats.HistogramData, p float64) float64 {
+	for _, pc := range h.Percentiles {
+		if pc.Percentile == p {
+			return pc.Value
+		}
+	}
+	return h.CalcPercentile(p)
+}
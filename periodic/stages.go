@@ -0,0 +1,207 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/stats"
+)
+
+// Stage is a named part of a staged run, with its own load.
+type Stage struct {
+	Name string
+	// Target qps, -1 for max speed.
+	QPS float64
+	// 0 keeps the run's number of threads.
+	NumThreads int
+	Duration   time.Duration
+}
+
+// StageResult is the result of a Stage of a staged run.
+type StageResult struct {
+	Stage
+	ActualQPS         float64
+	DurationHistogram *stats.HistogramData
+	// Full results of the stage (e.g. *fhttp.HTTPRunnerResults).
+	Result HasRunnerResult
+}
+
+// StagedResults is the report of a staged run: the results of each stage in
+// sequence, to see the latency as a function of the offered load.
+type StagedResults struct {
+	RunType       string
+	Labels        string
+	StartTime     time.Time
+	RunID         int64
+	SchemaVersion int
+	Interrupted   bool
+	Stages        []*StageResult
+}
+
+// ID returns an id for the report, in the same format as the other runs'.
+func (s *StagedResults) ID() string {
+	r := RunnerResults{StartTime: s.StartTime, Labels: s.Labels, RunID: s.RunID}
+	return r.ID()
+}
+
+// ParseStages parses stages, one per line: "name qps threads duration" with
+// qps "max" (or 0) for max speed and 0 threads to keep the run's. Empty lines
+// and lines starting with # are ignored.
+func ParseStages(data string) ([]Stage, error) {
+	var stages []Stage
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("invalid stage line %d %q, expecting name qps threads duration", i+1, line)
+		}
+		s := Stage{Name: fields[0], QPS: -1}
+		var err error
+		if fields[1] != "max" {
+			if s.QPS, err = strconv.ParseFloat(fields[1], 64); err != nil {
+				return nil, fmt.Errorf("invalid stage line %d qps %q", i+1, fields[1])
+			}
+			if s.QPS <= 0 {
+				s.QPS = -1
+			}
+		}
+		if s.NumThreads, err = strconv.Atoi(fields[2]); err != nil || s.NumThreads < 0 {
+			return nil, fmt.Errorf("invalid stage line %d threads %q", i+1, fields[2])
+		}
+		if s.Duration, err = time.ParseDuration(fields[3]); err != nil || s.Duration <= 0 {
+			return nil, fmt.Errorf("invalid stage line %d duration %q", i+1, fields[3])
+		}
+		stages = append(stages, s)
+	}
+	if len(stages) == 0 {
+		return nil, fmt.Errorf("no stage found")
+	}
+	return stages, nil
+}
+
+// ReadStages reads the stages (see ParseStages) from a file.
+func ReadStages(file string) ([]Stage, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	stages, err := ParseStages(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return stages, nil
+}
+
+// RunStages runs the stages in sequence, each with the options o changed to
+// the stage's qps, threads and duration, using run for the runner specific
+// test (e.g. a wrapper of fhttp.RunHTTPTest). Each stage thus makes its own
+// connections. An interrupt (^C) stops the whole run, not just the current stage.
+func RunStages(o *RunnerOptions, stages []Stage, run func(*RunnerOptions) (HasRunnerResult, error)) (*StagedResults, error) {
+	out := o.Out
+	if out == nil {
+		out = os.Stdout
+	}
+	res := &StagedResults{
+		Labels:        o.Labels,
+		StartTime:     time.Now(),
+		RunID:         o.RunID,
+		SchemaVersion: SchemaVersion,
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+	for i, stage := range stages {
+		_, _ = fmt.Fprintf(out, "Stage %d/%d %s\n", i+1, len(stages), stage.Name)
+		so := *o
+		so.QPS = stage.QPS
+		if stage.NumThreads > 0 {
+			so.NumThreads = stage.NumThreads
+		}
+		stage.NumThreads = so.NumThreads
+		so.Duration = stage.Duration
+		so.Exactly = 0
+		so.Schedule = nil
+		so.BurstSize = 0
+		so.ConcurrencyOnly = false
+		so.Runners = nil
+		r, interrupted, err := runInterruptible(sig, &so, run)
+		if err != nil {
+			return nil, fmt.Errorf("stage %s: %w", stage.Name, err)
+		}
+		rr := r.Result()
+		res.RunType = rr.RunType + " stages"
+		res.Stages = append(res.Stages, &StageResult{
+			Stage:             stage,
+			ActualQPS:         rr.ActualQPS,
+			DurationHistogram: rr.DurationHistogram,
+			Result:            r,
+		})
+		if interrupted {
+			log.Warnf("Staged run interrupted during stage %s", stage.Name)
+			res.Interrupted = true
+			break
+		}
+	}
+	res.print(out)
+	return res, nil
+}
+
+// runInterruptible runs run with the options so, with their own Stop,
+// aborted by an interrupt received on sig, and returns whether it was.
+func runInterruptible(sig chan os.Signal, so *RunnerOptions,
+	run func(*RunnerOptions) (HasRunnerResult, error)) (HasRunnerResult, bool, error) {
+	stop := NewAborter()
+	so.Stop = stop
+	var interrupted int32
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-sig:
+			atomic.StoreInt32(&interrupted, 1)
+			stop.Abort()
+		case <-done:
+		}
+	}()
+	r, err := run(so)
+	close(done)
+	return r, atomic.LoadInt32(&interrupted) != 0, err
+}
+
+// print prints the summary of each stage.
+func (s *StagedResults) print(out io.Writer) {
+	_, _ = fmt.Fprintf(out, "Stages:\n")
+	for _, st := range s.Stages {
+		qps := "max"
+		if st.QPS > 0 {
+			qps = fmt.Sprintf("%g", st.QPS)
+		}
+		_, _ = fmt.Fprintf(out, "  %s : %s qps %d threads for %v : actual %.1f qps, %d calls, avg %.3f ms\n",
+			st.Name, qps, st.NumThreads, st.Duration, st.ActualQPS, st.DurationHistogram.Count,
+			1000.*st.DurationHistogram.Avg)
+	}
+}
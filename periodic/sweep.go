@@ -0,0 +1,226 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/stats"
+)
+
+// SweepMatrix is the parameters of a sweep: each combination of its payload
+// sizes, qps and connections (threads) is a cell of the sweep. An empty
+// dimension keeps the run's value.
+type SweepMatrix struct {
+	PayloadSizes []int     // in bytes
+	QPS          []float64 // -1 for max speed
+	NumThreads   []int
+}
+
+// SweepCell is the summary of the run of a cell of a sweep.
+type SweepCell struct {
+	Name        string
+	PayloadSize int // -1 when the run's payload was kept
+	QPS         float64
+	NumThreads  int
+	// ResultID is the ID of the cell's own (full) result, e.g. its json file name without the .json.
+	ResultID          string
+	ActualQPS         float64
+	DurationHistogram *stats.HistogramData
+	// Full results of the cell (e.g. *fhttp.HTTPRunnerResults), saved separately.
+	Result HasRunnerResult `json:"-"`
+}
+
+// SweepResults is the matrix summary of a sweep (fortio sweep): the results of
+// each cell, in order (payload sizes, then qps, then connections).
+type SweepResults struct {
+	RunType       string
+	Labels        string
+	StartTime     time.Time
+	RunID         int64
+	SchemaVersion int
+	Interrupted   bool
+	Matrix        SweepMatrix
+	Cells         []*SweepCell
+}
+
+// ID returns an id for the summary, in the same format as the other runs'.
+func (s *SweepResults) ID() string {
+	r := RunnerResults{StartTime: s.StartTime, Labels: s.Labels, RunID: s.RunID}
+	return r.ID()
+}
+
+// ParseSweepMatrix parses the comma separated lists of payload sizes (bytes),
+// qps ("max" or 0 for max speed) and connections of a sweep. At least one
+// has to be non empty.
+func ParseSweepMatrix(sizes, qps, connections string) (SweepMatrix, error) {
+	m := SweepMatrix{}
+	for _, f := range splitList(sizes) {
+		size, err := strconv.Atoi(f)
+		if err != nil || size < 0 {
+			return m, fmt.Errorf("invalid sweep payload size %q", f)
+		}
+		m.PayloadSizes = append(m.PayloadSizes, size)
+	}
+	for _, f := range splitList(qps) {
+		q := -1.
+		if f != "max" {
+			var err error
+			if q, err = strconv.ParseFloat(f, 64); err != nil || q < 0 {
+				return m, fmt.Errorf("invalid sweep qps %q", f)
+			}
+			if q == 0 {
+				q = -1
+			}
+		}
+		m.QPS = append(m.QPS, q)
+	}
+	for _, f := range splitList(connections) {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 1 {
+			return m, fmt.Errorf("invalid sweep connections %q", f)
+		}
+		m.NumThreads = append(m.NumThreads, n)
+	}
+	if len(m.PayloadSizes)+len(m.QPS)+len(m.NumThreads) == 0 {
+		return m, fmt.Errorf("empty sweep, need payload sizes, qps and/or connections to sweep")
+	}
+	return m, nil
+}
+
+func splitList(s string) []string {
+	var res []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+// Cells returns the cells of the matrix (without results), for the run options
+// o's values of the dimensions it doesn't sweep.
+func (m *SweepMatrix) Cells(o *RunnerOptions) []*SweepCell {
+	sizes, qps, threads := m.PayloadSizes, m.QPS, m.NumThreads
+	if len(sizes) == 0 {
+		sizes = []int{-1}
+	}
+	if len(qps) == 0 {
+		qps = []float64{o.QPS}
+	}
+	if len(threads) == 0 {
+		threads = []int{o.NumThreads}
+	}
+	var res []*SweepCell
+	for _, size := range sizes {
+		for _, q := range qps {
+			for _, n := range threads {
+				c := SweepCell{PayloadSize: size, QPS: q, NumThreads: n}
+				var parts []string
+				if len(m.PayloadSizes) > 0 {
+					parts = append(parts, fmt.Sprintf("%db", size))
+				}
+				if len(m.QPS) > 0 {
+					parts = append(parts, qpsString(q)+"qps")
+				}
+				if len(m.NumThreads) > 0 {
+					parts = append(parts, fmt.Sprintf("%dc", n))
+				}
+				c.Name = strings.Join(parts, "_")
+				res = append(res, &c)
+			}
+		}
+	}
+	return res
+}
+
+func qpsString(qps float64) string {
+	if qps <= 0 {
+		return "max"
+	}
+	return strconv.FormatFloat(qps, 'f', -1, 64)
+}
+
+// RunSweep runs the cells of the matrix in sequence, each with the options o
+// changed to the cell's qps and threads, using run for the runner specific
+// test, which also applies the cell's payload size (e.g. a wrapper of
+// fhttp.RunHTTPTest). The cells' labels are the run's followed by the cell's
+// name. An interrupt (^C) stops the whole sweep, not just the current cell.
+func RunSweep(o *RunnerOptions, m SweepMatrix,
+	run func(*RunnerOptions, *SweepCell) (HasRunnerResult, error)) (*SweepResults, error) {
+	out := o.Out
+	if out == nil {
+		out = os.Stdout
+	}
+	res := &SweepResults{
+		Labels:        o.Labels,
+		StartTime:     time.Now(),
+		RunID:         o.RunID,
+		SchemaVersion: SchemaVersion,
+		Matrix:        m,
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+	cells := m.Cells(o)
+	for i, c := range cells {
+		_, _ = fmt.Fprintf(out, "Sweep cell %d/%d %s\n", i+1, len(cells), c.Name)
+		so := *o
+		so.QPS = c.QPS
+		so.NumThreads = c.NumThreads
+		so.Labels = strings.TrimSpace(o.Labels + " " + c.Name)
+		so.Schedule = nil
+		so.BurstSize = 0
+		so.ConcurrencyOnly = false
+		so.Runners = nil
+		r, interrupted, err := runInterruptible(sig, &so, func(so *RunnerOptions) (HasRunnerResult, error) {
+			return run(so, c)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("sweep cell %s: %w", c.Name, err)
+		}
+		rr := r.Result()
+		res.RunType = rr.RunType + " sweep"
+		c.ResultID = fmt.Sprintf("%s_%s", res.ID(), c.Name)
+		c.ActualQPS = rr.ActualQPS
+		c.DurationHistogram = rr.DurationHistogram
+		c.Result = r
+		res.Cells = append(res.Cells, c)
+		if interrupted {
+			log.Warnf("Sweep interrupted during cell %s", c.Name)
+			res.Interrupted = true
+			break
+		}
+	}
+	res.print(out)
+	return res, nil
+}
+
+// print prints the summary of each cell.
+func (s *SweepResults) print(out io.Writer) {
+	_, _ = fmt.Fprintf(out, "Sweep cells:\n")
+	for _, c := range s.Cells {
+		_, _ = fmt.Fprintf(out, "  %s : %s qps %d threads : actual %.1f qps, %d calls, avg %.3f ms\n",
+			c.Name, qpsString(c.QPS), c.NumThreads, c.ActualQPS, c.DurationHistogram.Count,
+			1000.*c.DurationHistogram.Avg)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+// Skeleton shared by the connection based runners (tcp, udp, ws, redis...):
+// one client and set of stats per thread, created before the run and merged
+// into the totals after it.
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// SetupThreads sets r's Runners to the NumThreads states newThread creates
+// (typically its client, connected once, and its own stats), stopping at the
+// first error. firstCall is true when, the run being neither for an exact
+// number of calls nor with a warmup phase, newThread should make an initial
+// (not counted) call, e.g. to establish the connection.
+func SetupThreads(r PeriodicRunner, newThread func(i int, firstCall bool) (Runnable, error)) error {
+	o := r.Options()
+	firstCall := o.Exactly <= 0 && !o.HasWarmup()
+	for i := 0; i < o.NumThreads; i++ {
+		t, err := newThread(i, firstCall)
+		if err != nil {
+			return err
+		}
+		o.Runners[i] = t
+	}
+	return nil
+}
+
+// MergeThreads calls merge for each of the n threads set up before the run
+// (NumThreads may have reduced but it's ok to accumulate the 0s of the unused
+// ones, and all the clients must be cleaned up), adding the result codes it
+// returns to codes, and then releases r's runners.
+func MergeThreads(r PeriodicRunner, n int, codes map[string]int64, merge func(i int) map[string]int64) {
+	for i := 0; i < n; i++ {
+		for k, v := range merge(i) {
+			codes[k] += v
+		}
+	}
+	r.Options().ReleaseRunners()
+}
+
+// PrintRetCodes prints the count, and percentage of the total calls, of each
+// result code, in order, prefixed by the protocol name (e.g. "tcp").
+func PrintRetCodes(out io.Writer, protocol string, codes map[string]int64, total int64) {
+	keys := make([]string, 0, len(codes))
+	for k := range codes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(out, "%s %s : %d (%.1f %%)\n", protocol, k, codes[k], 100.*float64(codes[k])/float64(total))
+	}
+}
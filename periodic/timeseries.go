@@ -0,0 +1,168 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"sync"
+	"time"
+
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/stats"
+)
+
+// Bounds of the Timeseries (see RunnerOptions.TimeseriesInterval): the interval
+// is at least MinTimeseriesInterval, and long enough for the run's duration to
+// have at most MaxTimeseriesPoints; the calls beyond that many intervals (e.g.
+// of runs until stopped) aren't in the Timeseries.
+const (
+	MinTimeseriesInterval = 100 * time.Millisecond
+	MaxTimeseriesPoints   = 10000
+)
+
+// TimeseriesPoint is the calls completed during one interval of the run (see
+// RunnerOptions.TimeseriesInterval), latencies in seconds, 0 when no calls.
+type TimeseriesPoint struct {
+	Start  time.Duration // offset of the interval from the start of the run
+	Count  int64
+	Errors int64 // failed calls, for the runners reporting them (see CallErrorer)
+	Avg    float64
+	P99    float64
+	Max    float64
+}
+
+// CallErrorer is optionally implemented by the Runnables to count their failed
+// calls (e.g. non 2xx http codes) in the Timeseries.
+type CallErrorer interface {
+	LastCallFailed() bool
+}
+
+// timeseries collects the threads' histograms of each interval of the run, only
+// for the intervals with calls. Threads only lock it when their calls move to the
+// next interval.
+type timeseries struct {
+	interval time.Duration
+	start    time.Time
+	proto    *stats.Histogram
+	mu       sync.Mutex
+	buckets  map[int]*stats.Histogram
+	errors   map[int]int64
+	length   int // index of the last interval with calls + 1
+}
+
+// normalizeTimeseries applies the bounds of the timeseries interval.
+func (r *RunnerOptions) normalizeTimeseries() {
+	interval := r.TimeseriesInterval
+	if interval < MinTimeseriesInterval {
+		interval = MinTimeseriesInterval
+	}
+	if r.Duration > 0 && r.Exactly <= 0 {
+		if min := (r.Duration + MaxTimeseriesPoints - 1) / MaxTimeseriesPoints; interval < min {
+			interval = min
+		}
+	}
+	if interval != r.TimeseriesInterval {
+		log.Warnf("Raising the timeseries interval from %v to %v (min %v, max %d points)",
+			r.TimeseriesInterval, interval, MinTimeseriesInterval, MaxTimeseriesPoints)
+		r.TimeseriesInterval = interval
+	}
+}
+
+// threadTimeseries is a thread's histogram for its current interval.
+type threadTimeseries struct {
+	ts     *timeseries
+	index  int
+	h      *stats.Histogram
+	errors int64
+}
+
+// newTimeseries returns nil when not recording a timeseries.
+func newTimeseries(interval time.Duration, functionDuration *stats.Histogram, start time.Time) *timeseries {
+	if interval <= 0 {
+		return nil
+	}
+	return &timeseries{
+		interval: interval,
+		start:    start,
+		proto:    stats.NewHistogramOfType(functionDuration.Type(), functionDuration.Offset, functionDuration.Divider),
+		buckets:  make(map[int]*stats.Histogram),
+		errors:   make(map[int]int64),
+	}
+}
+
+// thread returns the recorder of a thread, nil when not recording.
+func (ts *timeseries) thread() *threadTimeseries {
+	if ts == nil {
+		return nil
+	}
+	return &threadTimeseries{ts: ts, h: ts.proto.Clone()}
+}
+
+// record adds the call of f which started at fStart, in the interval it ended in.
+func (t *threadTimeseries) record(f Runnable, fStart time.Time, fDuration float64) {
+	end := fStart.Sub(t.ts.start) + time.Duration(fDuration*1e9)
+	if index := int(end / t.ts.interval); index != t.index {
+		t.flush()
+		t.index = index
+	}
+	t.h.Record(fDuration)
+	if ce, ok := f.(CallErrorer); ok && ce.LastCallFailed() {
+		t.errors++
+	}
+}
+
+// flush transfers the thread's current interval to the timeseries.
+func (t *threadTimeseries) flush() {
+	if t == nil || t.h.Count == 0 {
+		return
+	}
+	ts := t.ts
+	if t.index >= MaxTimeseriesPoints {
+		t.h.Reset()
+		t.errors = 0
+		return
+	}
+	ts.mu.Lock()
+	b := ts.buckets[t.index]
+	if b == nil {
+		b = ts.proto.Clone()
+		ts.buckets[t.index] = b
+	}
+	b.Transfer(t.h)
+	ts.errors[t.index] += t.errors
+	if t.index >= ts.length {
+		ts.length = t.index + 1
+	}
+	ts.mu.Unlock()
+	t.errors = 0
+}
+
+// points returns the timeseries, once all the threads are flushed.
+func (ts *timeseries) points() []TimeseriesPoint {
+	if ts == nil {
+		return nil
+	}
+	res := make([]TimeseriesPoint, ts.length)
+	for i := range res {
+		res[i] = TimeseriesPoint{Start: time.Duration(i) * ts.interval, Errors: ts.errors[i]}
+		if h := ts.buckets[i]; h != nil && h.Count > 0 {
+			res[i].Count = h.Count
+			data := h.Export()
+			res[i].Avg = data.Avg
+			res[i].P99 = data.CalcPercentile(99)
+			res[i].Max = data.Max
+		}
+	}
+	return res
+}
@@ -0,0 +1,110 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"sync"
+	"time"
+
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/stats"
+)
+
+// Warmer is implemented by the Runnables that can make a warmup call (see
+// RunnerOptions.WarmupCalls) without counting it in their own results. The
+// warmup calls of the others are made with their Run.
+type Warmer interface {
+	Warmup(tid int)
+}
+
+// HasWarmup returns true when a warmup phase is configured, in which case the
+// runners skip their implicit one call per thread warmup.
+func (r *RunnerOptions) HasWarmup() bool {
+	return r.WarmupCalls > 0 || r.WarmupDuration > 0
+}
+
+// warmup makes the warmup calls, at the run's qps, until WarmupCalls (split
+// across the threads) are done or WarmupDuration elapsed, whichever is first.
+// Returns the histogram of their durations.
+func (r *periodicRunner) warmup(runnerChan chan struct{}) *stats.Histogram {
+	h := stats.NewHistogramOfType(r.HistogramType, r.Offset.Seconds(), r.Resolution)
+	hs := make([]*stats.Histogram, r.NumThreads)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for t := 0; t < r.NumThreads; t++ {
+		hs[t] = h.Clone()
+		calls := r.WarmupCalls / int64(r.NumThreads)
+		if int64(t) < r.WarmupCalls%int64(r.NumThreads) {
+			calls++
+		}
+		if r.WarmupCalls > 0 && calls == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(t int, calls int64) {
+			r.warmupOne(t, runnerChan, hs[t], calls, start)
+			wg.Done()
+		}(t, calls)
+	}
+	wg.Wait()
+	for t := 0; t < r.NumThreads; t++ {
+		h.Transfer(hs[t])
+	}
+	log.Infof("Warmup ended after %v : %d calls", time.Since(start), h.Count)
+	return h
+}
+
+// warmupOne makes one thread's warmup calls (calls of them, or until the end
+// of the WarmupDuration when 0).
+func (r *periodicRunner) warmupOne(id int, runnerChan chan struct{}, h *stats.Histogram, calls int64, start time.Time) {
+	run := r.Runners[id].Run
+	if w, ok := r.Runners[id].(Warmer); ok {
+		run = w.Warmup
+	}
+	perThreadQPS := r.QPS * r.threadShare(id)
+	endTime := start.Add(r.WarmupDuration)
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+	for i := int64(1); ; i++ {
+		fStart := time.Now()
+		if r.WarmupDuration > 0 && fStart.After(endTime) {
+			return
+		}
+		run(id)
+		h.Record(time.Since(fStart).Seconds())
+		if calls > 0 && i >= calls {
+			return
+		}
+		if perThreadQPS <= 0 {
+			select {
+			case <-runnerChan:
+				return
+			default:
+				continue
+			}
+		}
+		next := start.Add(time.Duration(float64(i) / perThreadQPS * 1e9))
+		if r.WarmupDuration > 0 && !next.Before(endTime) {
+			return // next call is past the end
+		}
+		timer.Reset(time.Until(next))
+		select {
+		case <-runnerChan:
+			return
+		case <-timer.C:
+		}
+	}
+}
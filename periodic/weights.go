@@ -0,0 +1,80 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package periodic
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseThreadWeights parses comma separated (positive) thread weights, e.g. "3,1,1"
+// (see RunnerOptions.ThreadWeights). Empty input returns nil (no weights).
+func ParseThreadWeights(s string) ([]float64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	var res []float64
+	for _, w := range strings.Split(s, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(w), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid thread weight %q: %w", w, err)
+		}
+		if f <= 0 {
+			return nil, fmt.Errorf("thread weight %q should be positive", w)
+		}
+		res = append(res, f)
+	}
+	return res, nil
+}
+
+// threadWeight returns the weight of thread id, 1 beyond the ThreadWeights.
+func (r *RunnerOptions) threadWeight(id int) float64 {
+	if id < len(r.ThreadWeights) {
+		return r.ThreadWeights[id]
+	}
+	return 1
+}
+
+// threadShare returns the fraction of the qps (and calls) made by thread id.
+func (r *RunnerOptions) threadShare(id int) float64 {
+	if len(r.ThreadWeights) == 0 {
+		return 1 / float64(r.NumThreads)
+	}
+	var sum float64
+	for t := 0; t < r.NumThreads; t++ {
+		sum += r.threadWeight(t)
+	}
+	return r.threadWeight(id) / sum
+}
+
+// weightedCalls returns thread id's share of the total calls, the first thread
+// also doing the rounding left over (like the unweighted split) and each at
+// least 2 when not for Exactly calls (as needed by the duration mode pacing).
+func (r *RunnerOptions) weightedCalls(id int, total int64) int64 {
+	calls := int64(float64(total) * r.threadShare(id))
+	if id == 0 {
+		left := total
+		for t := 0; t < r.NumThreads; t++ {
+			left -= int64(float64(total) * r.threadShare(t))
+		}
+		calls += left
+	}
+	if r.Exactly <= 0 && calls < 2 {
+		calls = 2
+	}
+	return calls
+}
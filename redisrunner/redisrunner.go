@@ -0,0 +1,397 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redisrunner
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"fortio.org/fortio/fhttp"
+	"fortio.org/fortio/fnet"
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/stats"
+)
+
+type RedisResultMap map[string]int64
+
+// RunnerResults is the aggregated result of a RedisRunner.
+// Also is the internal type used per thread/goroutine.
+type RunnerResults struct {
+	periodic.RunnerResults
+	RedisOptions
+	// Count of each outcome: RedisStatusOK, RedisStatusNil, the prefix of the
+	// error replies (e.g. ERR) or the connection error.
+	RetCodes    RedisResultMap
+	SocketCount int
+	// Latency of each command, nil for the ones not sent.
+	CommandLatency map[string]*stats.HistogramData
+	commandTime    map[string]*stats.Histogram
+	client         *RedisClient
+}
+
+// ErrorRate returns the fraction of the calls which failed, i.e. neither OK nor NIL (see periodic.HasErrorRate).
+func (redisstate *RunnerResults) ErrorRate() float64 {
+	return periodic.ErrorRate(redisstate.RetCodes, RedisStatusOK, RedisStatusNil)
+}
+
+// Run sends the next command and records its latency. Main call being run at
+// the target QPS. To be set as the Function in RunnerOptions.
+func (redisstate *RunnerResults) Run(t int) {
+	log.Debugf("Calling in %d", t)
+	start := time.Now()
+	cmd, _, err := redisstate.client.Fetch()
+	redisstate.commandTime[cmd].Record(time.Since(start).Seconds())
+	switch e := err.(type) {
+	case nil:
+		redisstate.RetCodes[RedisStatusOK]++
+	case redisError:
+		redisstate.RetCodes[e.prefix()]++
+	default:
+		if err == errNil {
+			redisstate.RetCodes[RedisStatusNil]++
+		} else {
+			redisstate.RetCodes[err.Error()]++
+		}
+	}
+}
+
+// Warmup makes a warmup call, not counted in the results (see periodic.Warmer).
+func (redisstate *RunnerResults) Warmup(t int) {
+	cmd, _, err := redisstate.client.Fetch()
+	log.Debugf("Warmup %s call in %d: %v", cmd, t, err)
+}
+
+// RedisOptions are options to the RedisClient.
+type RedisOptions struct {
+	Destination string // redis://[[user]:password@]host[:port][/db]
+	// Commands sent in turn by each connection: GET, SET and/or PING (the default).
+	Commands []string
+	// Key of the GET and SET commands, where "{n}" is replaced by a random key number in [0, Keys).
+	KeyPattern string
+	Keys       int
+	ValueSize  int // of the SET values
+	ReqTimeout time.Duration
+}
+
+// RunnerOptions includes the base RunnerOptions plus redis specific
+// options.
+type RunnerOptions struct {
+	periodic.RunnerOptions
+	RedisOptions
+}
+
+// RedisClient is the client used for redis testing.
+type RedisClient struct {
+	buffer      []byte
+	req         []byte
+	value       []byte
+	dest        net.Addr
+	socket      net.Conn
+	reader      *bufio.Reader
+	commands    []string
+	keyPattern  string
+	keys        int
+	next        int // index of the next command
+	auth        [][]byte
+	db          string
+	socketCount int
+	destination string
+	reqTimeout  time.Duration
+	rnd         *rand.Rand
+	localAddr   net.Addr // of the last connection, for the run metadata
+}
+
+var (
+	// RedisURLPrefix is the URL prefix for triggering redis load.
+	RedisURLPrefix = "redis://"
+	// RedisStatusOK is the map key on success.
+	RedisStatusOK = "OK"
+	// RedisStatusNil is the map key for nil replies (e.g. GET of a missing key).
+	RedisStatusNil = "NIL"
+	// DefaultKeyPattern is the default KeyPattern.
+	DefaultKeyPattern = "fortio:{n}"
+	// DefaultKeys is the default number of Keys.
+	DefaultKeys = 1000
+)
+
+// ValidateCommands checks and normalizes (upper cases) the commands, returns
+// the default PING when empty.
+func ValidateCommands(commands []string) ([]string, error) {
+	var res []string
+	for _, c := range commands {
+		c = strings.ToUpper(strings.TrimSpace(c))
+		switch c {
+		case "":
+			continue
+		case "GET", "SET", "PING":
+			res = append(res, c)
+		default:
+			return nil, fmt.Errorf("unsupported redis command %q, should be GET, SET or PING", c)
+		}
+	}
+	if len(res) == 0 {
+		res = []string{"PING"}
+	}
+	return res, nil
+}
+
+// NewRedisClient creates and initialize and returns a client based on the RedisOptions.
+func NewRedisClient(o *RedisOptions) (*RedisClient, error) {
+	c := RedisClient{}
+	c.destination = periodic.Redact(o.Destination) // no password in the logs and errors
+	u, err := url.Parse(o.Destination)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis destination %q", c.destination)
+	}
+	c.destination = u.Redacted()
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("expecting redis:// destination, got %q", c.destination)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "6379"
+	}
+	tAddr, err := fnet.Resolve(u.Hostname(), port)
+	if tAddr == nil {
+		return nil, err
+	}
+	c.dest = tAddr
+	if password, ok := u.User.Password(); ok {
+		c.auth = [][]byte{[]byte("AUTH")}
+		if user := u.User.Username(); user != "" {
+			c.auth = append(c.auth, []byte(user))
+		}
+		c.auth = append(c.auth, []byte(password))
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if _, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis db %q in %q", db, c.destination)
+		}
+		c.db = db
+	}
+	if c.commands, err = ValidateCommands(o.Commands); err != nil {
+		return nil, err
+	}
+	c.keyPattern = o.KeyPattern
+	if c.keyPattern == "" {
+		c.keyPattern = DefaultKeyPattern
+	}
+	c.keys = o.Keys
+	if c.keys <= 0 {
+		c.keys = DefaultKeys
+	}
+	size := o.ValueSize
+	fnet.ValidatePayloadSize(&size)
+	c.value = fnet.GenerateRandomPayload(size)
+	c.rnd = rand.New(rand.NewSource(time.Now().UnixNano())) // nolint: gosec // only for picking keys
+	c.reqTimeout = o.ReqTimeout
+	if o.ReqTimeout == 0 {
+		log.Debugf("Request timeout not set, using default %v", fhttp.HTTPReqTimeOutDefaultValue)
+		c.reqTimeout = fhttp.HTTPReqTimeOutDefaultValue
+	}
+	if c.reqTimeout < 0 {
+		log.Warnf("Invalid timeout %v, setting to %v", c.reqTimeout, fhttp.HTTPReqTimeOutDefaultValue)
+		c.reqTimeout = fhttp.HTTPReqTimeOutDefaultValue
+	}
+	return &c, nil
+}
+
+// call sends the command args and reads the reply.
+func (c *RedisClient) call(conn net.Conn, args ...[]byte) ([]byte, error) {
+	c.req = appendCommand(c.req[:0], args...)
+	if _, err := conn.Write(c.req); err != nil {
+		return nil, err
+	}
+	var err error
+	c.buffer, err = readReply(c.reader, c.buffer)
+	return c.buffer, err
+}
+
+// connect opens a new connection, authenticates and selects the db if needed.
+func (c *RedisClient) connect() (net.Conn, error) {
+	c.socketCount++
+	socket, err := net.DialTimeout(c.dest.Network(), c.dest.String(), c.reqTimeout)
+	if err != nil {
+		log.Errf("Unable to connect to %v : %v", c.dest, err)
+		return nil, err
+	}
+	_ = socket.SetDeadline(time.Now().Add(c.reqTimeout))
+	c.reader = bufio.NewReader(socket)
+	if c.auth != nil {
+		if _, err = c.call(socket, c.auth...); err != nil {
+			log.Errf("Redis AUTH error with %v : %v", c.dest, err)
+			socket.Close()
+			return nil, err
+		}
+	}
+	if c.db != "" {
+		if _, err = c.call(socket, []byte("SELECT"), []byte(c.db)); err != nil {
+			log.Errf("Redis SELECT %s error with %v : %v", c.db, c.dest, err)
+			socket.Close()
+			return nil, err
+		}
+	}
+	c.localAddr = socket.LocalAddr()
+	return socket, nil
+}
+
+// key returns a random key from the KeyPattern.
+func (c *RedisClient) key() []byte {
+	return []byte(strings.Replace(c.keyPattern, "{n}", strconv.Itoa(c.rnd.Intn(c.keys)), 1))
+}
+
+// Fetch sends the next command and returns it with its reply.
+func (c *RedisClient) Fetch() (string, []byte, error) {
+	cmd := c.commands[c.next]
+	// Connect or reuse existing socket:
+	conn := c.socket
+	reuse := (conn != nil)
+	if !reuse {
+		var err error
+		conn, err = c.connect()
+		if conn == nil {
+			c.next = (c.next + 1) % len(c.commands)
+			return cmd, nil, err
+		}
+	} else {
+		log.Debugf("Reusing socket %v", conn)
+	}
+	c.socket = nil // because of error returns and single retry
+	conErr := conn.SetDeadline(time.Now().Add(c.reqTimeout))
+	var args [][]byte
+	switch cmd {
+	case "GET":
+		args = [][]byte{[]byte(cmd), c.key()}
+	case "SET":
+		args = [][]byte{[]byte(cmd), c.key(), c.value}
+	default:
+		args = [][]byte{[]byte(cmd)}
+	}
+	c.req = appendCommand(c.req[:0], args...)
+	_, err := conn.Write(c.req)
+	if err != nil || conErr != nil {
+		conn.Close()
+		if reuse {
+			// it's ok for the (idle) socket to die once, auto reconnect:
+			log.Infof("Closing dead socket %v (%v)", conn, err)
+			return c.Fetch() // recurse once
+		}
+		log.Errf("Unable to write to %v %v : %v", conn, c.dest, err)
+		c.next = (c.next + 1) % len(c.commands)
+		return cmd, nil, err
+	}
+	c.next = (c.next + 1) % len(c.commands)
+	c.buffer, err = readReply(c.reader, c.buffer)
+	if err != nil && err != errNil {
+		if _, isRedisErr := err.(redisError); !isRedisErr {
+			log.Debugf("read error %v", err)
+			conn.Close()
+			return cmd, c.buffer, err
+		}
+	}
+	c.socket = conn // reuse on success, nil and error replies
+	return cmd, c.buffer, err
+}
+
+// Close closes the last connection and returns the total number of sockets used for the run.
+func (c *RedisClient) Close() int {
+	log.Debugf("Closing %p: %s socket count %d", c, c.destination, c.socketCount)
+	if c.socket != nil {
+		if err := c.socket.Close(); err != nil {
+			log.Warnf("Error closing redis client's socket: %v", err)
+		}
+		c.socket = nil
+	}
+	return c.socketCount
+}
+
+// RunRedisTest runs a redis test and returns the aggregated stats.
+func RunRedisTest(o *RunnerOptions) (*RunnerResults, error) {
+	o.RunType = "Redis"
+	var err error
+	if o.Commands, err = ValidateCommands(o.Commands); err != nil {
+		return nil, err
+	}
+	log.Infof("Starting redis test for %s (%s) with %d threads at %.1f qps", periodic.Redact(o.Destination),
+		strings.Join(o.Commands, ","), o.NumThreads, o.QPS)
+	r := periodic.NewPeriodicRunner(&o.RunnerOptions)
+	defer r.Options().Abort()
+	numThreads := r.Options().NumThreads
+	out := r.Options().Out // Important as the default value is set from nil to stdout inside NewPeriodicRunner
+	total := RunnerResults{
+		RedisOptions:   o.RedisOptions,
+		RetCodes:       make(RedisResultMap),
+		CommandLatency: make(map[string]*stats.HistogramData),
+		commandTime:    make(map[string]*stats.Histogram),
+	}
+	if u, err := url.Parse(o.Destination); err == nil {
+		total.Destination = u.Redacted() // no password in the results
+	}
+	for _, cmd := range o.Commands {
+		total.commandTime[cmd] = r.Options().NewLatencyHistogram()
+	}
+	redisstate := make([]RunnerResults, numThreads)
+	err = periodic.SetupThreads(r, func(i int, firstCall bool) (periodic.Runnable, error) {
+		// Create a client and connect once for each 'thread'
+		redisstate[i].client, err = NewRedisClient(&o.RedisOptions)
+		if redisstate[i].client == nil {
+			return nil, fmt.Errorf("unable to create client %d for %s: %w", i, total.Destination, err)
+		}
+		if firstCall {
+			cmd, data, err := redisstate[i].client.Fetch()
+			if i == 0 && log.LogVerbose() {
+				log.LogVf("first %s to %s: err %v, received %d: %q", cmd, total.Destination, err, len(data), data)
+			}
+		}
+		// Setup the stats for each 'thread'
+		redisstate[i].RetCodes = make(RedisResultMap)
+		redisstate[i].commandTime = make(map[string]*stats.Histogram)
+		for cmd, h := range total.commandTime {
+			redisstate[i].commandTime[cmd] = h.Clone()
+		}
+		return &redisstate[i], nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	total.RunnerResults = r.Run()
+	periodic.MergeThreads(r, numThreads, total.RetCodes, func(i int) map[string]int64 {
+		c := redisstate[i].client
+		total.Metadata.AddConnection(c.localAddr, c.dest, nil)
+		total.SocketCount += c.Close()
+		for cmd, h := range redisstate[i].commandTime {
+			total.commandTime[cmd].Transfer(h)
+		}
+		return redisstate[i].RetCodes
+	})
+	_, _ = fmt.Fprintf(out, "Sockets used: %d (for perfect no error run, would be %d)\n", total.SocketCount, r.Options().NumThreads)
+	for _, cmd := range o.Commands {
+		h := total.commandTime[cmd]
+		if h.Count == 0 || total.CommandLatency[cmd] != nil {
+			continue
+		}
+		total.CommandLatency[cmd] = h.Export().CalcPercentiles(r.Options().Percentiles)
+		h.Print(out, "Redis "+cmd+" latency", r.Options().Percentiles)
+	}
+	periodic.PrintRetCodes(out, "redis", total.RetCodes, total.DurationHistogram.Count)
+	return &total, nil
+}
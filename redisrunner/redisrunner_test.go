@@ -0,0 +1,208 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redisrunner
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedis is a minimal in memory redis server for the tests: PING, GET, SET,
+// AUTH (password "secret") and SELECT.
+type fakeRedis struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func (f *fakeRedis) serve(t *testing.T) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.data = make(map[string][]byte)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.handle(conn)
+		}
+	}()
+	return "redis://" + l.Addr().String()
+}
+
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(string(line[1:]))
+	args := make([][]byte, n)
+	for i := range args {
+		if args[i], err = readReply(r, nil); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		var reply string
+		f.mu.Lock()
+		switch cmd := strings.ToUpper(string(args[0])); {
+		case cmd == "PING":
+			reply = "+PONG\r\n"
+		case cmd == "AUTH" && string(args[len(args)-1]) == "secret":
+			reply = "+OK\r\n"
+		case cmd == "SELECT":
+			reply = "+OK\r\n"
+		case cmd == "SET" && len(args) == 3:
+			f.data[string(args[1])] = args[2]
+			reply = "+OK\r\n"
+		case cmd == "GET" && len(args) == 2:
+			if v, found := f.data[string(args[1])]; found {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+			} else {
+				reply = "$-1\r\n"
+			}
+		default:
+			reply = "-ERR unexpected " + cmd + "\r\n"
+		}
+		f.mu.Unlock()
+		if _, err = io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func TestRESP(t *testing.T) {
+	cmd := appendCommand(nil, []byte("SET"), []byte("k"), []byte("hello"))
+	if expected := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$5\r\nhello\r\n"; string(cmd) != expected {
+		t.Errorf("got %q, expected %q", cmd, expected)
+	}
+	tests := []struct {
+		reply string
+		value string
+		err   error
+	}{
+		{"+OK\r\n", "OK", nil},
+		{":42\r\n", "42", nil},
+		{"$5\r\nhello\r\n", "hello", nil},
+		{"$0\r\n\r\n", "", nil},
+		{"$-1\r\n", "", errNil},
+		{"*-1\r\n", "", errNil},
+		{"*2\r\n$1\r\na\r\n-ERR in array\r\n", "", nil},
+		{"-WRONGTYPE Operation against a key\r\n", "", redisError("WRONGTYPE Operation against a key")},
+		{"$5\r\nhelloXX", "", errProtocol},
+		{"?\r\n", "", errProtocol},
+		{"+OK\n", "", errProtocol},
+		{"$3\r\nab", "", io.ErrUnexpectedEOF},
+	}
+	for _, tst := range tests {
+		v, err := readReply(bufio.NewReader(strings.NewReader(tst.reply)), nil)
+		if string(v) != tst.value || err != tst.err {
+			t.Errorf("for %q got %q %v, expected %q %v", tst.reply, v, err, tst.value, tst.err)
+		}
+	}
+	if p := redisError("NOAUTH Authentication required.").prefix(); p != "NOAUTH" {
+		t.Errorf("unexpected error prefix %q", p)
+	}
+}
+
+func TestRedisRunner(t *testing.T) {
+	f := fakeRedis{}
+	dest := f.serve(t)
+	opts := RunnerOptions{}
+	opts.QPS = 100
+	opts.Exactly = 20
+	opts.NumThreads = 2
+	opts.Destination = strings.Replace(dest, "redis://", "redis://:secret@", 1) + "/2"
+	opts.Commands = []string{"set", "GET"}
+	opts.Keys = 5
+	opts.ValueSize = 100
+	res, err := RunRedisTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[RedisStatusOK]+res.RetCodes[RedisStatusNil] != 20 || res.SocketCount != 2 {
+		t.Errorf("unexpected results %v with %d sockets", res.RetCodes, res.SocketCount)
+	}
+	if res.CommandLatency["SET"].Count != 10 || res.CommandLatency["GET"].Count != 10 || res.CommandLatency["PING"] != nil {
+		t.Errorf("unexpected per command latency %+v", res.CommandLatency)
+	}
+	if strings.Contains(res.Destination, "secret") {
+		t.Errorf("password not redacted in %q", res.Destination)
+	}
+	f.mu.Lock()
+	for k, v := range f.data {
+		if !strings.HasPrefix(k, "fortio:") || len(v) != 100 {
+			t.Errorf("unexpected key %q with %d bytes value", k, len(v))
+		}
+	}
+	f.mu.Unlock()
+	if _, err = json.Marshal(res); err != nil {
+		t.Errorf("unable to json serialize the results: %v", err)
+	}
+	// Default PING, with a wrong password: every connection fails to authenticate.
+	opts.Commands = nil
+	opts.Destination = strings.Replace(dest, "redis://", "redis://:wrong@", 1)
+	res, err = RunRedisTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[RedisStatusOK] != 0 || res.RetCodes["ERR"] != 20 || res.CommandLatency["PING"].Count != 20 {
+		t.Errorf("expected auth errors, got %v", res.RetCodes)
+	}
+}
+
+func TestRedisRunnerErrors(t *testing.T) {
+	for _, o := range []RedisOptions{
+		{Destination: "http://localhost:6379/"},
+		{Destination: "redis://localhost/foo"},
+		{Destination: "redis://localhost", Commands: []string{"DEL"}},
+		{Destination: "redis://:secret@localhost/foo"},
+		{Destination: "redis://:secret@local host:%zz"},
+	} {
+		_, err := NewRedisClient(&o)
+		if err == nil {
+			t.Errorf("expected error for %+v", o)
+		} else if strings.Contains(err.Error(), "secret") {
+			t.Errorf("password not redacted in %v", err)
+		}
+	}
+	c, err := NewRedisClient(&RedisOptions{Destination: "redis://localhost:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, _, err := c.Fetch()
+	if cmd != "PING" || err == nil {
+		t.Errorf("expected connection error for default PING, got %s %v", cmd, err)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redisrunner
+
+// Minimal (client side) RESP, the REdis Serialization Protocol: commands are
+// sent as arrays of bulk strings and replies are read, only keeping the value
+// of non array ones.
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"fortio.org/fortio/fnet"
+)
+
+var (
+	errProtocol = errors.New("redis protocol error")
+	// errNil is returned for nil replies, e.g. GET of a missing key.
+	errNil = errors.New("nil reply")
+)
+
+// redisError is an error reply from the server, e.g. "ERR unknown command".
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// prefix returns the error prefix, e.g. ERR, WRONGTYPE or NOAUTH.
+func (e redisError) prefix() string {
+	return strings.SplitN(string(e), " ", 2)[0]
+}
+
+// appendCommand appends the RESP encoding of the command args to buf.
+func appendCommand(buf []byte, args ...[]byte) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, a := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(a)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, a...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// readLine returns the line without its \r\n, only valid until the next read.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' { // type byte and \r\n at least
+		return nil, errProtocol
+	}
+	return line[:len(line)-2], nil
+}
+
+// readReply reads a reply and returns its value (in buf, reused, for bulk
+// strings), errNil for nil replies and redisError for error replies. The
+// elements of array replies are read but not returned.
+func readReply(r *bufio.Reader, buf []byte) ([]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return buf[:0], err
+	}
+	switch line[0] {
+	case '+', ':':
+		return append(buf[:0], line[1:]...), nil
+	case '-':
+		return buf[:0], redisError(line[1:])
+	case '$', '*':
+	default:
+		return buf[:0], errProtocol
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > fnet.MaxPayloadSizeLimit {
+		return buf[:0], errProtocol
+	}
+	if n < 0 {
+		return buf[:0], errNil
+	}
+	if line[0] == '*' {
+		for i := 0; i < n; i++ {
+			buf, err = readReply(r, buf)
+			if err != nil && err != errNil {
+				if _, isRedisErr := err.(redisError); !isRedisErr {
+					return buf[:0], err
+				}
+			}
+		}
+		return buf[:0], nil
+	}
+	if cap(buf) < n+2 {
+		buf = make([]byte, n+2)
+	}
+	buf = buf[:n+2]
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return buf[:0], err
+	}
+	if buf[n] != '\r' || buf[n+1] != '\n' {
+		return buf[:0], errProtocol
+	}
+	return buf[:n], nil
+}
@@ -0,0 +1,284 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smtprunner
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"fortio.org/fortio/fhttp"
+	"fortio.org/fortio/fnet"
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/periodic"
+)
+
+type SMTPResultMap map[string]int64
+
+// RunnerResults is the aggregated result of an SMTPRunner.
+// Also is the internal type used per thread/goroutine.
+type RunnerResults struct {
+	periodic.RunnerResults
+	SMTPOptions
+	RetCodes    SMTPResultMap
+	SocketCount int
+	client      *SMTPClient
+}
+
+// ErrorRate returns the fraction of the handshakes which didn't end with a 250 reply (see periodic.HasErrorRate).
+func (smtpstate *RunnerResults) ErrorRate() float64 {
+	return periodic.ErrorRate(smtpstate.RetCodes, SMTPStatusOK)
+}
+
+// Run does one handshake. Main call being run at the target QPS.
+// To be set as the Function in RunnerOptions.
+func (smtpstate *RunnerResults) Run(t int) {
+	log.Debugf("Calling in %d", t)
+	code, err := smtpstate.client.Handshake()
+	if code == "" {
+		smtpstate.RetCodes[err.Error()]++
+	} else {
+		smtpstate.RetCodes[code]++
+	}
+}
+
+// Warmup makes a warmup call, not counted in the results (see periodic.Warmer).
+func (smtpstate *RunnerResults) Warmup(t int) {
+	code, err := smtpstate.client.Handshake()
+	log.Debugf("Warmup call in %d: %q %v", t, code, err)
+}
+
+// SMTPOptions are options to the SMTPClient.
+type SMTPOptions struct {
+	Destination string // smtp://host[:port] or smtps://host[:port]
+	Helo        string // name sent in the EHLO (or HELO), DefaultHelo if empty
+	StartTLS    bool   // upgrade smtp:// connections with STARTTLS
+	Insecure    bool   // do not verify certs for smtps and STARTTLS
+	ReqTimeout  time.Duration
+}
+
+// RunnerOptions includes the base RunnerOptions plus smtp specific
+// options.
+type RunnerOptions struct {
+	periodic.RunnerOptions
+	SMTPOptions
+}
+
+// SMTPClient is the client used for smtp handshakes testing.
+type SMTPClient struct {
+	dest        net.Addr
+	host        string
+	helo        string
+	startTLS    bool
+	implicitTLS bool        // smtps://
+	tlsConfig   *tls.Config // nil unless smtps:// or STARTTLS
+	tlsState    *tls.ConnectionState
+	tlsConns    *periodic.TLSCounts // nil unless tlsConfig is set
+	localAddr   net.Addr
+	socketCount int
+	destination string
+	reqTimeout  time.Duration
+}
+
+const (
+	// DefaultHelo is the name sent in the EHLO when none is given.
+	DefaultHelo = "localhost"
+	// SMTPStatusOK is the map key on success: the reply code to the EHLO (or
+	// HELO), after STARTTLS if requested.
+	SMTPStatusOK = "250"
+)
+
+var (
+	// SMTPURLPrefix is the URL prefix for triggering smtp load.
+	SMTPURLPrefix = "smtp://"
+	// SMTPSURLPrefix is the URL prefix for triggering smtp over TLS load.
+	SMTPSURLPrefix = "smtps://"
+	errNoStartTLS  = fmt.Errorf("STARTTLS not supported by the server")
+)
+
+// NewSMTPClient creates and initialize and returns a client based on the SMTPOptions.
+func NewSMTPClient(o *SMTPOptions) (*SMTPClient, error) {
+	c := SMTPClient{}
+	c.destination = o.Destination
+	u, err := url.Parse(o.Destination)
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "smtp":
+		if port == "" {
+			port = "25"
+		}
+		c.startTLS = o.StartTLS
+	case "smtps":
+		if port == "" {
+			port = "465"
+		}
+		if o.StartTLS {
+			log.Warnf("Ignoring STARTTLS for already TLS %s", o.Destination)
+		}
+		c.implicitTLS = true
+	default:
+		return nil, fmt.Errorf("expecting smtp:// or smtps:// destination, got %q", o.Destination)
+	}
+	if c.startTLS || c.implicitTLS {
+		c.tlsConfig = &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: o.Insecure} // nolint: gosec // user requested
+		c.tlsConns = &periodic.TLSCounts{}
+	}
+	tAddr, err := fnet.Resolve(u.Hostname(), port)
+	if tAddr == nil {
+		return nil, err
+	}
+	c.dest = tAddr
+	c.host = u.Hostname()
+	c.helo = o.Helo
+	if c.helo == "" {
+		c.helo = DefaultHelo
+	}
+	c.reqTimeout = o.ReqTimeout
+	if o.ReqTimeout == 0 {
+		log.Debugf("Request timeout not set, using default %v", fhttp.HTTPReqTimeOutDefaultValue)
+		c.reqTimeout = fhttp.HTTPReqTimeOutDefaultValue
+	}
+	if c.reqTimeout < 0 {
+		log.Warnf("Invalid timeout %v, setting to %v", c.reqTimeout, fhttp.HTTPReqTimeOutDefaultValue)
+		c.reqTimeout = fhttp.HTTPReqTimeOutDefaultValue
+	}
+	return &c, nil
+}
+
+// replyCode returns the smtp reply code of err, empty if it isn't an smtp error.
+func replyCode(err error) string {
+	var tErr *textproto.Error
+	if errors.As(err, &tErr) {
+		return strconv.Itoa(tErr.Code)
+	}
+	return ""
+}
+
+// Handshake connects, reads the greeting, sends EHLO (HELO if the server
+// doesn't support it) and optionally STARTTLS followed by a new EHLO, then
+// QUIT. Returns the reply code (SMTPStatusOK on success, the one of the failed
+// command otherwise) or an empty one and the error for non smtp errors.
+func (c *SMTPClient) Handshake() (string, error) {
+	conn, err := net.DialTimeout(c.dest.Network(), c.dest.String(), c.reqTimeout)
+	if err != nil {
+		log.Errf("Unable to connect to %v : %v", c.dest, err)
+		return "", err
+	}
+	c.socketCount++
+	c.localAddr = conn.LocalAddr()
+	_ = conn.SetDeadline(time.Now().Add(c.reqTimeout))
+	if c.implicitTLS {
+		tlsConn := tls.Client(conn, c.tlsConfig)
+		if err = tlsConn.Handshake(); err != nil {
+			log.Errf("TLS handshake error with %v : %v", c.dest, err)
+			conn.Close()
+			return "", err
+		}
+		conn = tlsConn
+		state := tlsConn.ConnectionState()
+		c.tlsState = &state
+		c.tlsConns.Add(&state)
+	}
+	client, err := smtp.NewClient(conn, c.host) // reads the greeting, closes conn on error
+	if err != nil {
+		log.LogVf("Greeting error from %v : %v", c.dest, err)
+		return replyCode(err), err
+	}
+	defer client.Close()
+	if err = client.Hello(c.helo); err != nil {
+		log.LogVf("EHLO/HELO error from %v : %v", c.dest, err)
+		return replyCode(err), err
+	}
+	if c.startTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return "", errNoStartTLS
+		}
+		if err = client.StartTLS(c.tlsConfig); err != nil {
+			log.LogVf("STARTTLS error with %v : %v", c.dest, err)
+			return replyCode(err), err
+		}
+		if state, ok := client.TLSConnectionState(); ok {
+			c.tlsState = &state
+			c.tlsConns.Add(&state)
+		}
+	}
+	if err = client.Quit(); err != nil {
+		// The handshake itself succeeded.
+		log.Debugf("QUIT error from %v : %v", c.dest, err)
+	}
+	return SMTPStatusOK, nil
+}
+
+// RunSMTPTest runs an smtp handshakes test and returns the aggregated stats.
+func RunSMTPTest(o *RunnerOptions) (*RunnerResults, error) {
+	switch {
+	case strings.HasPrefix(o.Destination, SMTPSURLPrefix):
+		o.RunType = "SMTPS"
+	case o.StartTLS:
+		o.RunType = "SMTP STARTTLS"
+	default:
+		o.RunType = "SMTP"
+	}
+	log.Infof("Starting smtp test for %s with %d threads at %.1f qps", o.Destination, o.NumThreads, o.QPS)
+	r := periodic.NewPeriodicRunner(&o.RunnerOptions)
+	defer r.Options().Abort()
+	numThreads := r.Options().NumThreads
+	out := r.Options().Out // Important as the default value is set from nil to stdout inside NewPeriodicRunner
+	total := RunnerResults{
+		SMTPOptions: o.SMTPOptions,
+		RetCodes:    make(SMTPResultMap),
+	}
+	smtpstate := make([]RunnerResults, numThreads)
+	err := periodic.SetupThreads(r, func(i int, firstCall bool) (periodic.Runnable, error) {
+		client, err := NewSMTPClient(&o.SMTPOptions)
+		if client == nil {
+			return nil, fmt.Errorf("unable to create client %d for %s: %w", i, o.Destination, err)
+		}
+		if firstCall {
+			code, err := client.Handshake()
+			if i == 0 && log.LogVerbose() {
+				log.LogVf("first hit of %s: code %q err %v", o.Destination, code, err)
+			}
+		}
+		// Setup the stats for each 'thread'
+		smtpstate[i].client = client
+		smtpstate[i].RetCodes = make(SMTPResultMap)
+		return &smtpstate[i], nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	total.RunnerResults = r.Run()
+	periodic.MergeThreads(r, numThreads, total.RetCodes, func(i int) map[string]int64 {
+		c := smtpstate[i].client
+		total.SocketCount += c.socketCount
+		total.Metadata.AddConnection(c.localAddr, c.dest, c.tlsState)
+		total.Metadata.AddTLSConnections(c.tlsConns)
+		return smtpstate[i].RetCodes
+	})
+	_, _ = fmt.Fprintf(out, "Sockets used: %d (for perfect no error run, would be %d)\n", total.SocketCount, total.DurationHistogram.Count)
+	periodic.PrintRetCodes(out, "smtp", total.RetCodes, total.DurationHistogram.Count)
+	return &total, nil
+}
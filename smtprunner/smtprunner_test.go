@@ -0,0 +1,189 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smtprunner
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"fortio.org/fortio/periodic"
+)
+
+// fakeServer is a minimal smtp server for the tests.
+type fakeServer struct {
+	greeting    string      // defaults to "220 fake ESMTP"
+	noEHLO      bool        // only HELO is supported
+	tlsConfig   *tls.Config // offers STARTTLS when set
+	implicitTLS bool        // smtps
+}
+
+func (f *fakeServer) serve(t *testing.T) int {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.implicitTLS {
+		l = tls.NewListener(l, f.tlsConfig)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.handle(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func (f *fakeServer) handle(conn net.Conn) {
+	defer func() { conn.Close() }()
+	greeting := f.greeting
+	if greeting == "" {
+		greeting = "220 fake ESMTP"
+	}
+	fmt.Fprintf(conn, "%s\r\n", greeting)
+	if !strings.HasPrefix(greeting, "220") {
+		return
+	}
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.Fields(line + " x")[0])
+		switch {
+		case cmd == "EHLO" && !f.noEHLO:
+			if f.tlsConfig != nil && !f.implicitTLS {
+				fmt.Fprintf(conn, "250-fake\r\n250-PIPELINING\r\n250 STARTTLS\r\n")
+			} else {
+				fmt.Fprintf(conn, "250-fake\r\n250 PIPELINING\r\n")
+			}
+		case cmd == "HELO":
+			fmt.Fprintf(conn, "250 fake\r\n")
+		case cmd == "STARTTLS" && f.tlsConfig != nil:
+			fmt.Fprintf(conn, "220 go ahead\r\n")
+			tlsConn := tls.Server(conn, f.tlsConfig)
+			conn, reader = tlsConn, bufio.NewReader(tlsConn)
+		case cmd == "QUIT":
+			fmt.Fprintf(conn, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprintf(conn, "502 not implemented\r\n")
+		}
+	}
+}
+
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestSMTPRunner(t *testing.T) {
+	tlsConfig := testTLSConfig(t)
+	tests := []struct {
+		server   fakeServer
+		scheme   string
+		startTLS bool
+		insecure bool
+		code     string // expected RetCodes key (for all the calls)
+		tls      bool   // expected to be recorded in the metadata
+	}{
+		{fakeServer{}, "smtp", false, false, SMTPStatusOK, false},
+		{fakeServer{noEHLO: true}, "smtp", false, false, SMTPStatusOK, false},
+		{fakeServer{greeting: "554 go away"}, "smtp", false, false, "554", false},
+		{fakeServer{tlsConfig: tlsConfig}, "smtp", true, true, SMTPStatusOK, true},
+		{fakeServer{}, "smtp", true, true, errNoStartTLS.Error(), false},
+		{fakeServer{tlsConfig: tlsConfig, implicitTLS: true}, "smtps", false, true, SMTPStatusOK, true},
+	}
+	for _, tst := range tests {
+		tst := tst
+		port := tst.server.serve(t)
+		opts := RunnerOptions{
+			RunnerOptions: periodic.RunnerOptions{
+				QPS:        100,
+				Exactly:    10,
+				NumThreads: 2,
+			},
+		}
+		opts.Destination = fmt.Sprintf("%s://localhost:%d", tst.scheme, port)
+		opts.StartTLS = tst.startTLS
+		opts.Insecure = tst.insecure
+		res, err := RunSMTPTest(&opts)
+		if err != nil {
+			t.Errorf("%s %+v: unexpected error %v", opts.Destination, tst.server, err)
+			continue
+		}
+		if res.RetCodes[tst.code] != 10 || len(res.RetCodes) != 1 || res.SocketCount != 10 {
+			t.Errorf("%s %+v: expected 10 %q, got %v (%d sockets)", opts.Destination, tst.server, tst.code, res.RetCodes, res.SocketCount)
+		}
+		if (res.Metadata.TLSVersion != "") != tst.tls {
+			t.Errorf("%s %+v: unexpected tls version %q", opts.Destination, tst.server, res.Metadata.TLSVersion)
+		}
+	}
+}
+
+func TestSMTPErrors(t *testing.T) {
+	for _, dest := range []string{"http://localhost", "smtp://doesnotexist.fortio.org"} {
+		if _, err := NewSMTPClient(&SMTPOptions{Destination: dest}); err == nil {
+			t.Errorf("expected error for %s", dest)
+		}
+	}
+	// Cert verification failure (self signed):
+	port := (&fakeServer{tlsConfig: testTLSConfig(t), implicitTLS: true}).serve(t)
+	c, err := NewSMTPClient(&SMTPOptions{Destination: fmt.Sprintf("smtps://localhost:%d", port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, err := c.Handshake(); code != "" || err == nil {
+		t.Errorf("expected tls error, got %q %v", code, err)
+	}
+	// Connection refused:
+	l, _ := net.Listen("tcp", "localhost:0")
+	l.Close()
+	c, _ = NewSMTPClient(&SMTPOptions{Destination: "smtp://" + l.Addr().String()})
+	if code, err := c.Handshake(); code != "" || err == nil {
+		t.Errorf("expected connection error, got %q %v", code, err)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats // import "fortio.org/fortio/stats"
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// HgrmTicksPerHalfDistance is the number of percentile lines of the .hgrm
+// output per halving of the distance to 100%, same as HdrHistogram's default.
+const HgrmTicksPerHalfDistance = 5
+
+// WriteHgrm writes the histogram in the HdrHistogram percentile distribution
+// (.hgrm) format, with the values multiplied by scale (e.g. 1000 to output
+// milliseconds from seconds like wrk2), so it can be plotted and compared by
+// the HdrHistogram tooling. Percentiles are interpolated from the buckets (or
+// exact, see ExactPercentiles).
+func (e *HistogramData) WriteHgrm(out io.Writer, scale float64) error {
+	if _, err := fmt.Fprintf(out, "%12s %14s %10s %14s\n\n", "Value", "Percentile", "TotalCount", "1/(1-Percentile)"); err != nil {
+		return err
+	}
+	if e.Count > 0 && len(e.Data) > 0 {
+		count := float64(e.Count)
+		// Until less than one value is above, then the 100% line (max).
+		for p := 0.; (100.-p)/100.*count >= 1; {
+			totalCount := int64(math.Ceil(p / 100. * count))
+			if totalCount < 1 {
+				totalCount = 1
+			}
+			if _, err := fmt.Fprintf(out, "%12.3f %2.12f %10d %14.2f\n",
+				scale*e.CalcPercentile(p), p/100., totalCount, 100./(100.-p)); err != nil {
+				return err
+			}
+			halfDistance := math.Pow(2, math.Floor(math.Log2(100./(100.-p)))+1)
+			p += 100. / (HgrmTicksPerHalfDistance * halfDistance)
+		}
+		if _, err := fmt.Fprintf(out, "%12.3f %2.12f %10d\n", scale*e.Max, 1., e.Count); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(out, "#[Mean    = %12.3f, StdDeviation   = %12.3f]\n#[Max     = %12.3f, Total count    = %12d]\n",
+		scale*e.Avg, scale*e.StdDev, scale*e.Max, e.Count)
+	return err
+}
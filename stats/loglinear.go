@@ -0,0 +1,139 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats // import "fortio.org/fortio/stats"
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// HistogramType is the bucketing of a Histogram.
+type HistogramType string
+
+const (
+	// HistogramFixed is the default bucketing: the fixed list of buckets, from
+	// 0 to 100000 times the divider, fine for the low values and coarser and
+	// coarser for the higher ones (with everything above in the last bucket).
+	HistogramFixed HistogramType = "fixed"
+	// HistogramLogLinear is the HdrHistogram like bucketing: each power of 2 is
+	// split in LogLinearSubBuckets buckets so the values have the same relative
+	// precision whatever their magnitude (e.g. latencies from microseconds to
+	// seconds). Only the buckets with values are stored.
+	HistogramLogLinear HistogramType = "loglinear"
+)
+
+// LogLinearSubBuckets is the number of buckets per power of 2 of the
+// HistogramLogLinear histograms, i.e. a relative precision better than 1.6%.
+const LogLinearSubBuckets = 64
+
+// logLinearZero is the index of the bucket of the values <= 0 (after offset).
+const logLinearZero = math.MinInt32
+
+// ParseHistogramType returns the histogram type from its name (flag), empty
+// being the default HistogramFixed.
+func ParseHistogramType(s string) (HistogramType, error) {
+	switch t := HistogramType(s); t {
+	case "":
+		return HistogramFixed, nil
+	case HistogramFixed, HistogramLogLinear:
+		return t, nil
+	default:
+		return "", fmt.Errorf("histogram type should be %s or %s, not %q", HistogramFixed, HistogramLogLinear, s)
+	}
+}
+
+// NewHistogramOfType creates a new histogram of the given type, empty meaning
+// HistogramFixed. Returns nil for an unknown type or a zero divider.
+func NewHistogramOfType(t HistogramType, offset float64, divider float64) *Histogram {
+	switch t {
+	case "", HistogramFixed:
+		return NewHistogram(offset, divider)
+	case HistogramLogLinear:
+		if divider == 0 {
+			return nil
+		}
+		return &Histogram{Offset: offset, Divider: divider, sparse: make(map[int]int32)}
+	default:
+		return nil
+	}
+}
+
+// Type returns the bucketing of the histogram.
+func (h *Histogram) Type() HistogramType {
+	if h.sparse != nil {
+		return HistogramLogLinear
+	}
+	return HistogramFixed
+}
+
+// logLinearIdx returns the index of the bucket of the scaled value: the
+// power of 2 (exponent) and which of its sub buckets.
+func logLinearIdx(scaledVal float64) int {
+	if scaledVal <= 0 {
+		return logLinearZero
+	}
+	frac, exp := math.Frexp(scaledVal) // frac in [0.5, 1[
+	sub := int((2*frac - 1) * LogLinearSubBuckets)
+	return exp*LogLinearSubBuckets + sub
+}
+
+// logLinearInterval returns the [start, end[ (scaled) interval of a bucket.
+func logLinearInterval(idx int) (float64, float64) {
+	exp := idx / LogLinearSubBuckets
+	sub := idx % LogLinearSubBuckets
+	if sub < 0 { // negative exponents, for values below the divider
+		exp--
+		sub += LogLinearSubBuckets
+	}
+	width := math.Ldexp(1./LogLinearSubBuckets, exp-1)
+	start := math.Ldexp(1, exp-1) + float64(sub)*width
+	return start, start + width
+}
+
+// exportLogLinear exports the non empty buckets of a HistogramLogLinear
+// histogram, in order, like Export does for the fixed ones.
+func (h *Histogram) exportLogLinear(res *HistogramData) {
+	idxs := make([]int, 0, len(h.sparse))
+	for idx, count := range h.sparse {
+		if count > 0 {
+			idxs = append(idxs, idx)
+		}
+	}
+	if len(idxs) == 0 {
+		return
+	}
+	sort.Ints(idxs)
+	var total int64
+	ctrTotal := float64(h.Count)
+	for _, idx := range idxs {
+		var b Bucket
+		if idx == logLinearZero {
+			b.End = h.Offset
+		} else {
+			start, end := logLinearInterval(idx)
+			b.Start = h.Divider*start + h.Offset
+			b.End = h.Divider*end + h.Offset
+		}
+		if len(res.Data) == 0 {
+			b.Start = h.Min
+		}
+		b.Count = int64(h.sparse[idx])
+		total += b.Count
+		b.Percent = 100. * float64(total) / ctrTotal
+		res.Data = append(res.Data, b)
+	}
+	res.Data[len(res.Data)-1].End = h.Max
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats // import "fortio.org/fortio/stats"
+
+import (
+	"math"
+	"sort"
+)
+
+// MergeData returns the combination of the exported histograms a and b, e.g.
+// of the same test run from several load generators, either being possibly
+// nil. The counters are combined exactly while the buckets are aligned on the
+// union of both sets of bucket boundaries: the count of a bucket spanning
+// several of the merged ones is split in proportion of their overlap (assuming
+// its values are evenly spread, as CalcPercentile does). The percentiles of
+// both are calculated again, on the merged buckets.
+func MergeData(a, b *HistogramData) *HistogramData {
+	if a == nil || a.Count == 0 && b != nil {
+		a, b = b, a
+	}
+	if a == nil {
+		return nil
+	}
+	res := &HistogramData{Count: a.Count, Min: a.Min, Max: a.Max, Sum: a.Sum, Avg: a.Avg, StdDev: a.StdDev}
+	if b != nil && b.Count > 0 {
+		res.Count += b.Count
+		res.Min = math.Min(a.Min, b.Min)
+		res.Max = math.Max(a.Max, b.Max)
+		res.Sum += b.Sum
+		res.Avg = res.Sum / float64(res.Count)
+		// From the sums of squares, like Counter.StdDev.
+		sumOfSquares := sumOfSquares(a) + sumOfSquares(b)
+		sigma := sumOfSquares/float64(res.Count) - res.Avg*res.Avg
+		if sigma > 0 {
+			res.StdDev = math.Sqrt(sigma)
+		}
+	}
+	res.Data = mergeBuckets(a.Data, bucketsOf(b))
+	var percentiles []float64
+	seen := make(map[float64]bool)
+	for _, h := range []*HistogramData{a, b} {
+		if h == nil {
+			continue
+		}
+		for _, p := range h.Percentiles {
+			if !seen[p.Percentile] {
+				seen[p.Percentile] = true
+				percentiles = append(percentiles, p.Percentile)
+			}
+		}
+	}
+	sort.Float64s(percentiles)
+	return res.CalcPercentiles(percentiles)
+}
+
+func sumOfSquares(h *HistogramData) float64 {
+	return (h.StdDev*h.StdDev + h.Avg*h.Avg) * float64(h.Count)
+}
+
+func bucketsOf(h *HistogramData) []Bucket {
+	if h == nil {
+		return nil
+	}
+	return h.Data
+}
+
+// mergeBuckets splits the buckets of a and b on all their boundaries and sums
+// the (split) counts. Buckets are ]Start, End], so a single value bucket
+// (Start == End) is added to the merged bucket ending with it.
+func mergeBuckets(a, b []Bucket) []Bucket {
+	var bounds []float64
+	for _, data := range [][]Bucket{a, b} {
+		for _, bucket := range data {
+			bounds = append(bounds, bucket.Start, bucket.End)
+		}
+	}
+	if len(bounds) == 0 {
+		return nil
+	}
+	sort.Float64s(bounds)
+	uniq := bounds[:1]
+	for _, v := range bounds[1:] {
+		if v != uniq[len(uniq)-1] {
+			uniq = append(uniq, v)
+		}
+	}
+	bounds = uniq
+	// counts[0] is the single point bounds[0] bucket, counts[i] the ]bounds[i-1], bounds[i]] one.
+	counts := make([]float64, len(bounds))
+	for _, data := range [][]Bucket{a, b} {
+		for _, bucket := range data {
+			first := sort.SearchFloat64s(bounds, bucket.Start)
+			last := sort.SearchFloat64s(bounds, bucket.End)
+			if first == last {
+				counts[last] += float64(bucket.Count)
+				continue
+			}
+			width := bucket.End - bucket.Start
+			for i := first + 1; i <= last; i++ {
+				counts[i] += float64(bucket.Count) * (bounds[i] - bounds[i-1]) / width
+			}
+		}
+	}
+	// Rounded cumulatively to keep the total count.
+	var res []Bucket
+	var total float64
+	var prev, rounded int64
+	for i, c := range counts {
+		total += c
+		rounded = int64(math.Round(total))
+		if rounded == prev {
+			continue
+		}
+		b := Bucket{Interval: Interval{Start: bounds[i], End: bounds[i]}, Count: rounded - prev}
+		if i > 0 {
+			b.Start = bounds[i-1]
+		}
+		res = append(res, b)
+		prev = rounded
+	}
+	var cumulated int64
+	for i := range res {
+		cumulated += res[i].Count
+		res[i].Percent = 100. * float64(cumulated) / float64(rounded)
+	}
+	return res
+}
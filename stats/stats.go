@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -146,14 +147,20 @@ var (
 )
 
 // Histogram extends Counter and adds an histogram.
-// Must be created using NewHistogram or anotherHistogram.Clone()
-// and not directly.
+// Must be created using NewHistogram, NewHistogramOfType or
+// anotherHistogram.Clone() and not directly.
 type Histogram struct {
 	Counter
 	Offset  float64 // offset applied to data before fitting into buckets
 	Divider float64 // divider applied to data before fitting into buckets
 	// Don't access directly (outside of this package):
 	Hdata []int32 // numValues buckets (one more than values, for last one)
+	// Buckets of the HistogramLogLinear type (nil for HistogramFixed), by index.
+	sparse map[int]int32
+	// Exact percentiles mode (see KeepValues): the recorded values, as long
+	// as there are no more than exactLimit of them.
+	exactLimit int
+	values     []float64
 }
 
 // For export of the data:
@@ -191,6 +198,10 @@ type HistogramData struct {
 	StdDev      float64
 	Data        []Bucket
 	Percentiles []Percentile
+	// ExactPercentiles is true when the Percentiles are the exact rank
+	// (nearest-rank) values instead of interpolated from the histogram buckets.
+	ExactPercentiles bool      `json:",omitempty"`
+	sortedValues     []float64 // when ExactPercentiles
 }
 
 // NewHistogram creates a new histogram (sets up the buckets).
@@ -250,6 +261,29 @@ func lookUpIdx(scaledValue int) int {
 	return 0
 }
 
+// MaxExactValues is the highest KeepValues limit, so the memory of the exact
+// percentiles mode stays bounded (8 bytes per value) whatever the run length.
+const MaxExactValues = 1000000
+
+// KeepValues enables the exact percentiles mode: up to limit values are kept
+// so the percentiles can be computed by exact rank instead of interpolated
+// within the buckets, which is misleading for small number of values (e.g.
+// the p99.9 of 20 values). Beyond limit values the values are dropped and the
+// histogram interpolation is used. 0 to disable, capped to MaxExactValues.
+func (h *Histogram) KeepValues(limit int) {
+	if limit > MaxExactValues {
+		log.Warnf("Capping the exact percentiles to runs of %d calls (instead of %d)", MaxExactValues, limit)
+		limit = MaxExactValues
+	}
+	h.exactLimit = limit
+	h.values = nil
+}
+
+// hasAllValues returns true when exact mode is on and all the values are kept.
+func (h *Histogram) hasAllValues() bool {
+	return h.exactLimit > 0 && int64(len(h.values)) == h.Count
+}
+
 // Record records a data point.
 func (h *Histogram) Record(v float64) {
 	h.RecordN(v, 1)
@@ -257,6 +291,13 @@ func (h *Histogram) Record(v float64) {
 
 // RecordN efficiently records a data point N times.
 func (h *Histogram) RecordN(v float64, n int) {
+	if h.hasAllValues() && h.Count+int64(n) <= int64(h.exactLimit) {
+		for i := 0; i < n; i++ {
+			h.values = append(h.values, v)
+		}
+	} else {
+		h.values = nil // too many, falling back to interpolation
+	}
 	h.Counter.RecordN(v, n)
 	h.record(v, n)
 }
@@ -266,6 +307,10 @@ func (h *Histogram) record(v float64, count int) {
 	// Scaled value to bucketize - we subtract epsilon because the interval
 	// is open to the left ] start, end ] so when exactly on start it has
 	// to fall on the previous bucket. TODO add boundary tests
+	if h.sparse != nil {
+		h.sparse[logLinearIdx((v-h.Offset)/h.Divider)] += int32(count)
+		return
+	}
 	scaledVal := (v-h.Offset)/h.Divider - 0.0001
 	var idx int
 	if scaledVal <= firstValue {
@@ -295,6 +340,9 @@ func (e *HistogramData) CalcPercentile(percentile float64) float64 {
 	if percentile >= 100 {
 		return e.Max
 	}
+	if e.ExactPercentiles {
+		return exactPercentile(e.sortedValues, percentile)
+	}
 	// We assume Min is at least a single point so at least covers 1/Count %
 	pp := 100. / float64(e.Count) // previous percentile
 	if percentile <= pp {
@@ -310,6 +358,20 @@ func (e *HistogramData) CalcPercentile(percentile float64) float64 {
 	return e.Max // not reached
 }
 
+// exactPercentile returns the nearest-rank percentile: the smallest of the
+// sorted values such that at least percentile % of the values are less or
+// equal to it.
+func exactPercentile(sorted []float64, percentile float64) float64 {
+	rank := int(math.Ceil(percentile / 100. * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
+
 // Export translate the internal representation of the histogram data in
 // an externally usable one. Calculates the request Percentiles.
 func (h *Histogram) Export() *HistogramData {
@@ -320,6 +382,16 @@ func (h *Histogram) Export() *HistogramData {
 	res.Sum = h.Counter.Sum
 	res.Avg = h.Counter.Avg()
 	res.StdDev = h.Counter.StdDev()
+	if h.hasAllValues() && h.Count > 0 {
+		res.ExactPercentiles = true
+		res.sortedValues = make([]float64, len(h.values))
+		copy(res.sortedValues, h.values)
+		sort.Float64s(res.sortedValues)
+	}
+	if h.sparse != nil {
+		h.exportLogLinear(&res)
+		return &res
+	}
 	multiplier := h.Divider
 	offset := h.Offset
 	// calculate the last bucket index
@@ -404,9 +476,18 @@ func (e *HistogramData) Print(out io.Writer, msg string) {
 		}
 		_, _ = fmt.Fprintf(out, "%s %.6g <= %.6g , %.6g , %.2f, %d\n", sep, b.Start, b.End, (b.Start+b.End)/2., b.Percent, b.Count)
 	}
-	// print the information of target percentiles
+	e.PrintPercentiles(out)
+}
+
+// PrintPercentiles prints the target percentiles, marked "(exact)" when
+// computed by exact rank.
+func (e *HistogramData) PrintPercentiles(out io.Writer) {
+	suffix := ""
+	if e.ExactPercentiles {
+		suffix = " (exact)"
+	}
 	for _, p := range e.Percentiles {
-		_, _ = fmt.Fprintf(out, "# target %g%% %.6g\n", p.Percentile, p.Value)
+		_, _ = fmt.Fprintf(out, "# target %g%% %.6g%s\n", p.Percentile, p.Value, suffix)
 	}
 }
 
@@ -429,15 +510,20 @@ func (h *Histogram) Log(msg string, percentiles []float64) {
 // Reset clears the data. Reset it to NewHistogram state.
 func (h *Histogram) Reset() {
 	h.Counter.Reset()
-	// Leave Offset and Divider alone
+	// Leave Offset and Divider (and exact mode) alone
 	for i := 0; i < len(h.Hdata); i++ {
 		h.Hdata[i] = 0
 	}
+	for idx := range h.sparse {
+		delete(h.sparse, idx)
+	}
+	h.values = h.values[:0]
 }
 
 // Clone returns a copy of the histogram.
 func (h *Histogram) Clone() *Histogram {
-	hCopy := NewHistogram(h.Offset, h.Divider)
+	hCopy := NewHistogramOfType(h.Type(), h.Offset, h.Divider)
+	hCopy.exactLimit = h.exactLimit
 	hCopy.CopyFrom(h)
 	return hCopy
 }
@@ -446,13 +532,17 @@ func (h *Histogram) Clone() *Histogram {
 func (h *Histogram) CopyFrom(src *Histogram) {
 	h.Counter = src.Counter
 	h.copyHDataFrom(src)
+	h.values = append(h.values[:0], src.values...)
 }
 
 // copyHDataFrom appends histogram data values to this object from the src.
 // Src histogram data values will be appended according to this object's
 // offset and divider.
 func (h *Histogram) copyHDataFrom(src *Histogram) {
-	if h.Divider == src.Divider && h.Offset == src.Offset {
+	if h.Divider == src.Divider && h.Offset == src.Offset && h.Type() == src.Type() {
+		for idx, count := range src.sparse {
+			h.sparse[idx] += count
+		}
 		for i := 0; i < len(h.Hdata); i++ {
 			h.Hdata[i] += src.Hdata[i]
 		}
@@ -466,7 +556,8 @@ func (h *Histogram) copyHDataFrom(src *Histogram) {
 }
 
 // Merge two different histogram with different scale parameters
-// Lowest offset and highest divider value will be selected on new Histogram as scale parameters.
+// Lowest offset and highest divider value will be selected on new Histogram as scale parameters,
+// which is of the type of h1.
 func Merge(h1 *Histogram, h2 *Histogram) *Histogram {
 	divider := h1.Divider
 	offset := h1.Offset
@@ -476,7 +567,8 @@ func Merge(h1 *Histogram, h2 *Histogram) *Histogram {
 	if h2.Offset < h1.Offset {
 		offset = h2.Offset
 	}
-	newH := NewHistogram(offset, divider)
+	newH := NewHistogramOfType(h1.Type(), offset, divider)
+	newH.exactLimit = h1.exactLimit
 	newH.Transfer(h1)
 	newH.Transfer(h2)
 	return newH
@@ -493,6 +585,11 @@ func (h *Histogram) Transfer(src *Histogram) {
 		return
 	}
 	h.copyHDataFrom(src)
+	if h.hasAllValues() && src.hasAllValues() && h.Count+src.Count <= int64(h.exactLimit) {
+		h.values = append(h.values, src.values...)
+	} else {
+		h.values = nil
+	}
 	h.Counter.Transfer(&src.Counter)
 	src.Reset()
 }
@@ -19,6 +19,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"math"
 	"math/rand"
 	"os"
 	"reflect"
@@ -374,6 +375,45 @@ func TestHistogramExport1(t *testing.T) {
 }`, "Json output")
 }
 
+func TestExactPercentiles(t *testing.T) {
+	h := NewHistogram(0, 10)
+	h.KeepValues(6)
+	for _, v := range []float64{751, -137.4, 501, 1001.67, 251} {
+		h.Record(v)
+	}
+	e := h.Export().CalcPercentiles([]float64{0, 20, 50, 80, 99.9})
+	CheckEquals(t, e.ExactPercentiles, true, "exact mode")
+	expected := []float64{-137.4, -137.4, 501, 751, 1001.67}
+	for i, p := range e.Percentiles {
+		CheckEquals(t, p.Value, expected[i], fmt.Sprintf("exact p%g", p.Percentile))
+	}
+	var b bytes.Buffer
+	e.PrintPercentiles(&b)
+	CheckEquals(t, strings.Count(b.String(), " (exact)\n"), 5, "exact percentiles are marked")
+	// Merging per thread histograms keeps the values while below the limit
+	h2 := h.Clone()
+	h2.Reset()
+	h2.Record(10)
+	h.Transfer(h2)
+	e = h.Export().CalcPercentiles([]float64{50})
+	CheckEquals(t, e.ExactPercentiles, true, "exact after transfer")
+	CheckEquals(t, e.Percentiles[0].Value, 251., "exact p50 after transfer")
+	// One more than the limit: back to interpolation
+	h.Record(20)
+	e = h.Export().CalcPercentiles([]float64{50})
+	CheckEquals(t, e.ExactPercentiles, false, "interpolated above limit")
+	CheckEquals(t, e.Percentiles[0].Value, 275., "interpolated p50")
+	// Reset starts over in exact mode
+	h.Reset()
+	h.RecordN(42, 3)
+	e = h.Export().CalcPercentiles([]float64{99})
+	CheckEquals(t, e.ExactPercentiles, true, "exact after reset")
+	CheckEquals(t, e.Percentiles[0].Value, 42., "exact p99 after reset")
+	// The limit is capped
+	h.KeepValues(MaxExactValues + 1)
+	CheckEquals(t, h.exactLimit, MaxExactValues, "capped limit")
+}
+
 const (
 	NumRandomHistogram = 2000
 )
@@ -795,6 +835,46 @@ func TestAllBucketBoundaries(t *testing.T) {
 	}
 }
 
+func TestWriteHgrm(t *testing.T) {
+	h := NewHistogram(0, 0.001)
+	for i := 1; i <= 20; i++ {
+		h.Record(float64(i) / 1000.)
+	}
+	var b bytes.Buffer
+	if err := h.Export().WriteHgrm(&b, 1000.); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(b.String(), "\n")
+	expected := map[int]string{
+		0:  "       Value     Percentile TotalCount 1/(1-Percentile)",
+		1:  "",
+		2:  "       1.000 0.000000000000          1           1.00",
+		7:  "      10.000 0.500000000000         10           2.00",
+		13: "      15.500 0.775000000000         16           4.44",
+		24: "      19.000 0.950000000000         19          20.00",
+		25: "      20.000 1.000000000000         20",
+		26: "#[Mean    =       10.500, StdDeviation   =        5.766]",
+		27: "#[Max     =       20.000, Total count    =           20]",
+		28: "",
+	}
+	if len(lines) != 29 {
+		t.Fatalf("unexpected hgrm output:\n%s", b.String())
+	}
+	for i, l := range expected {
+		if lines[i] != l {
+			t.Errorf("line %d: got %q expected %q", i, lines[i], l)
+		}
+	}
+	// No data, just the header and footer:
+	b.Reset()
+	if err := NewHistogram(0, 1).Export().WriteHgrm(&b, 1.); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(b.String(), "\n"); n != 4 {
+		t.Errorf("unexpected empty hgrm output:\n%s", b.String())
+	}
+}
+
 // TODO: add test with data 1.0 1.0001 1.999 2.0 2.5
 // should get 3 buckets 0-1 with count 1
 // 1-2 with count 3
@@ -813,3 +893,175 @@ func BenchmarkBucketLookUpWithRandomValues(b *testing.B) {
 		testHistogram.Record(float64(rand.Intn(100000)))
 	}
 }
+
+func TestParseHistogramType(t *testing.T) {
+	for _, tst := range []struct {
+		in  string
+		out HistogramType
+	}{
+		{"", HistogramFixed},
+		{"fixed", HistogramFixed},
+		{"loglinear", HistogramLogLinear},
+	} {
+		if ht, err := ParseHistogramType(tst.in); err != nil || ht != tst.out {
+			t.Errorf("ParseHistogramType(%q) got %q, %v; expected %q", tst.in, ht, err, tst.out)
+		}
+	}
+	if _, err := ParseHistogramType("hdr"); err == nil {
+		t.Errorf("expected an error for an unknown histogram type")
+	}
+	if h := NewHistogramOfType("hdr", 0, 1); h != nil {
+		t.Errorf("expected nil histogram for an unknown type, got %+v", h)
+	}
+	if h := NewHistogramOfType(HistogramLogLinear, 0, 0); h != nil {
+		t.Errorf("expected nil histogram for a 0 divider, got %+v", h)
+	}
+}
+
+func TestLogLinearBuckets(t *testing.T) {
+	for i := 0; i < 10000; i++ {
+		v := math.Exp(40*rand.Float64() - 20) // nolint: gosec // just test data
+		idx := logLinearIdx(v)
+		start, end := logLinearInterval(idx)
+		if v < start || v >= end {
+			t.Fatalf("%g not in its bucket %d [%g, %g[", v, idx, start, end)
+		}
+		if (end-start)/start > 1./LogLinearSubBuckets {
+			t.Errorf("bucket %d [%g, %g[ wider than the relative precision", idx, start, end)
+		}
+		if next, _ := logLinearInterval(idx + 1); next != end {
+			t.Errorf("bucket %d end %g isn't the next one's start %g", idx, end, next)
+		}
+	}
+	if idx := logLinearIdx(0); idx != logLinearZero {
+		t.Errorf("0 should be in the zero bucket, got %d", idx)
+	}
+}
+
+func TestLogLinearHistogram(t *testing.T) {
+	h := NewHistogramOfType(HistogramLogLinear, 0, 0.001)
+	if h.Type() != HistogramLogLinear {
+		t.Errorf("unexpected type %q", h.Type())
+	}
+	// latencies from 50 microseconds to 7.3 seconds.
+	for _, v := range []float64{0.00005, 0.002, 7.3} {
+		h.RecordN(v, 100)
+	}
+	e := h.Export().CalcPercentiles([]float64{25, 50, 99})
+	if len(e.Data) != 3 {
+		t.Errorf("expected 3 buckets, got %+v", e.Data)
+	}
+	if e.Data[0].Start != 0.00005 || e.Data[2].End != 7.3 || e.Data[2].Percent != 100 {
+		t.Errorf("unexpected buckets %+v", e.Data)
+	}
+	for i, expected := range []float64{0.00005, 0.002, 7.3} {
+		if p := e.Percentiles[i].Value; math.Abs(p-expected)/expected > 1./LogLinearSubBuckets {
+			t.Errorf("p%g %g too far from %g", e.Percentiles[i].Percentile, p, expected)
+		}
+	}
+	// With the fixed buckets, 7.3s is in the ]5s, 7.5s] one.
+	f := NewHistogram(0, 0.001)
+	f.RecordN(7.3, 100)
+	f.RecordN(0.2, 1)
+	if p := f.Export().CalcPercentile(50); math.Abs(p-7.3)/7.3 < 0.1 {
+		t.Errorf("fixed p50 %g unexpectedly precise", p)
+	}
+}
+
+func TestLogLinearTransfer(t *testing.T) {
+	h1 := NewHistogramOfType(HistogramLogLinear, -1, 1)
+	h1.Record(-3) // in the <= offset bucket
+	h1.Record(10)
+	h2 := h1.Clone()
+	if h2.Type() != HistogramLogLinear || h2.Count != 2 {
+		t.Errorf("unexpected clone %+v", h2)
+	}
+	h2.Record(1000)
+	h1.Transfer(h2)
+	if h2.Count != 0 || len(h2.Export().Data) != 0 {
+		t.Errorf("transferred histogram should be empty: %+v", h2.Export())
+	}
+	e := h1.Export()
+	if e.Count != 5 || len(e.Data) != 3 {
+		t.Fatalf("unexpected merged histogram %+v", e)
+	}
+	if e.Data[0].Start != -3 || e.Data[0].End != -1 || e.Data[0].Count != 2 || e.Data[1].Count != 2 || e.Data[2].End != 1000 {
+		t.Errorf("unexpected merged buckets %+v", e.Data)
+	}
+	// Merging a fixed histogram re-records its buckets' mid points.
+	f := NewHistogram(0, 1)
+	f.Record(5)
+	m := Merge(h1, f)
+	if m.Type() != HistogramLogLinear || m.Count != 6 {
+		t.Errorf("unexpected merge %+v", m.Export())
+	}
+	m.Reset()
+	if m.Type() != HistogramLogLinear || len(m.Export().Data) != 0 {
+		t.Errorf("unexpected reset %+v", m.Export())
+	}
+}
+
+func TestMergeData(t *testing.T) {
+	percentiles := []float64{50, 90, 99}
+	h1 := NewHistogram(0, .001)
+	h2 := NewHistogram(0, .001)
+	all := NewHistogram(0, .001)
+	for i := 1; i <= 200; i++ {
+		v := float64(i) / 1000.
+		if i%3 == 0 {
+			h2.Record(v)
+		} else {
+			h1.Record(v)
+		}
+		all.Record(v)
+	}
+	e1, e2 := h1.Export().CalcPercentiles(percentiles), h2.Export().CalcPercentiles([]float64{99.9, 50})
+	expected := all.Export().CalcPercentiles([]float64{50, 90, 99, 99.9})
+	m := MergeData(e1, e2)
+	if m.Count != expected.Count || m.Min != expected.Min || m.Max != expected.Max || math.Abs(m.Sum-expected.Sum) > 1e-9 ||
+		math.Abs(m.Avg-expected.Avg) > 1e-9 || math.Abs(m.StdDev-expected.StdDev) > 1e-9 {
+		t.Errorf("unexpected merged counter %+v vs %+v", m, expected)
+	}
+	last := m.Data[len(m.Data)-1]
+	if last.Percent != 100 || last.End != .2 || m.Data[0].Start != .001 {
+		t.Errorf("unexpected merged buckets %+v", m.Data)
+	}
+	var n int64
+	for _, b := range m.Data {
+		n += b.Count
+	}
+	if n != 200 {
+		t.Errorf("merged buckets count %d instead of 200", n)
+	}
+	// Same boundaries (but for the edges) so close to the histogram of all the values.
+	if len(m.Percentiles) != 4 {
+		t.Fatalf("expected the union of the percentiles: %+v", m.Percentiles)
+	}
+	for i, p := range m.Percentiles {
+		if p.Percentile != expected.Percentiles[i].Percentile || math.Abs(p.Value-expected.Percentiles[i].Value) > .002 {
+			t.Errorf("unexpected merged percentile %+v vs %+v", p, expected.Percentiles[i])
+		}
+	}
+	// Different resolutions: the coarse buckets are split on the fine ones.
+	coarse := NewHistogram(0, .01)
+	coarse.Record(.015)
+	coarse.Record(.019)
+	fine := NewHistogram(0, .001)
+	fine.Record(.0175)
+	m = MergeData(fine.Export(), coarse.Export())
+	if m.Count != 3 || len(m.Data) != 2 || m.Data[0].Start != .015 || m.Data[0].End != .0175 ||
+		m.Data[0].Count != 2 || m.Data[1].End != .019 || m.Data[1].Count != 1 {
+		t.Errorf("unexpected merge of different resolutions %+v", m.Data)
+	}
+	// Nil or empty ones.
+	if MergeData(nil, nil) != nil {
+		t.Errorf("expected nil merge of nils")
+	}
+	empty := NewHistogram(0, 1).Export()
+	if m = MergeData(empty, e2); m.Count != e2.Count || len(m.Data) != len(e2.Data) {
+		t.Errorf("unexpected merge with empty %+v", m)
+	}
+	if m = MergeData(e1, nil); m.Count != e1.Count || m == e1 || len(m.Percentiles) != 3 {
+		t.Errorf("unexpected merge with nil %+v", m)
+	}
+}
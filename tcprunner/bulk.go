@@ -0,0 +1,201 @@
+// Copyright 2021 Fortio Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package tcprunner
+
+// Bulk transfer (throughput, iperf like) mode: each thread streams chunks of
+// data, back to back, over its connection for the whole run and the goodput
+// of each connection and of all of them is reported. Whatever the target
+// sends back (e.g. an echo server) is read and discarded, so a sink (see
+// fnet.TCPSinkServer) or an echo server can be used.
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fortio.org/fortio/fhttp"
+	"fortio.org/fortio/fnet"
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/periodic"
+)
+
+// TCPBulkURLPrefix is the URL prefix for triggering the tcp bulk transfer mode.
+const TCPBulkURLPrefix = "tcp-bulk://"
+
+// DefaultBulkChunkSize is the default size of each write of the bulk mode.
+const DefaultBulkChunkSize = 128 * 1024
+
+// BulkOptions are the options for the bulk transfer mode.
+type BulkOptions struct {
+	// Bulk is true to stream data as fast as possible instead of exchanging
+	// messages (also set by a TCPBulkURLPrefix destination).
+	Bulk bool
+	// Size of each write (call), DefaultBulkChunkSize when 0.
+	BulkChunkSize int
+}
+
+// BulkResults are the bulk transfer mode results, goodputs are in bytes per second.
+type BulkResults struct {
+	ChunkSize         int
+	Goodput           float64
+	ConnectionGoodput []float64
+}
+
+// bulkState is the per thread state of the bulk mode.
+type bulkState struct {
+	RetCodes    TCPResultMap
+	dest        net.Addr
+	chunk       []byte
+	reqTimeout  time.Duration
+	conn        net.Conn
+	localAddr   net.Addr
+	socketCount int
+	bytesSent   int64
+	received    int64 // accessed atomically, by the draining goroutines
+	wg          sync.WaitGroup
+}
+
+// Run writes one chunk, (re)connecting if needed.
+func (b *bulkState) Run(t int) {
+	if b.conn == nil {
+		if err := b.connect(); err != nil {
+			log.Errf("[%d] Unable to connect to %v : %v", t, b.dest, err)
+			b.RetCodes[err.Error()]++
+			return
+		}
+	}
+	_ = b.conn.SetWriteDeadline(time.Now().Add(b.reqTimeout))
+	n, err := b.conn.Write(b.chunk)
+	b.bytesSent += int64(n)
+	if err != nil {
+		log.Errf("[%d] Unable to write to %v : %v", t, b.dest, err)
+		b.RetCodes[err.Error()]++
+		b.close()
+		return
+	}
+	b.RetCodes[TCPStatusOK]++
+}
+
+func (b *bulkState) connect() error {
+	b.socketCount++
+	conn, err := net.DialTimeout(b.dest.Network(), b.dest.String(), b.reqTimeout)
+	if err != nil {
+		return err
+	}
+	b.conn = conn
+	b.localAddr = conn.LocalAddr()
+	b.wg.Add(1)
+	go func() {
+		n, _ := io.Copy(ioutil.Discard, conn)
+		atomic.AddInt64(&b.received, n)
+		b.wg.Done()
+	}()
+	return nil
+}
+
+func (b *bulkState) close() {
+	if b.conn == nil {
+		return
+	}
+	if err := b.conn.Close(); err != nil {
+		log.Warnf("Error closing bulk connection: %v", err)
+	}
+	b.conn = nil
+}
+
+// runBulk is RunTCPTest for the bulk transfer mode.
+func runBulk(o *RunnerOptions, r periodic.PeriodicRunner) (*RunnerResults, error) {
+	numThreads := r.Options().NumThreads
+	out := r.Options().Out
+	dest := o.Destination
+	if strings.HasPrefix(dest, TCPBulkURLPrefix) {
+		dest = TCPURLPrefix + strings.TrimPrefix(dest, TCPBulkURLPrefix)
+	}
+	tAddr, err := fnet.ResolveDestination(dest)
+	if tAddr == nil {
+		return nil, err
+	}
+	chunkSize := o.BulkChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultBulkChunkSize
+	}
+	chunk := o.Payload
+	if len(chunk) == 0 {
+		chunk = fnet.GenerateRandomPayload(chunkSize)
+	}
+	reqTimeout := o.ReqTimeout
+	if reqTimeout <= 0 {
+		reqTimeout = fhttp.HTTPReqTimeOutDefaultValue
+	}
+	total := RunnerResults{
+		aborter:  r.Options().Stop,
+		RetCodes: make(TCPResultMap),
+		Bulk:     &BulkResults{ChunkSize: len(chunk)},
+	}
+	total.Destination = o.Destination
+	states := make([]bulkState, numThreads)
+	for i := 0; i < numThreads; i++ {
+		states[i] = bulkState{RetCodes: make(TCPResultMap), dest: tAddr, chunk: chunk, reqTimeout: reqTimeout}
+		r.Options().Runners[i] = &states[i]
+	}
+	total.RunnerResults = r.Run()
+	duration := total.ActualDuration.Seconds()
+	periodic.MergeThreads(r, numThreads, total.RetCodes, func(i int) map[string]int64 {
+		s := &states[i]
+		s.close()
+		s.wg.Wait()
+		total.Metadata.AddConnection(s.localAddr, s.dest, nil)
+		total.SocketCount += s.socketCount
+		total.BytesSent += s.bytesSent
+		total.BytesReceived += atomic.LoadInt64(&s.received)
+		total.Bulk.ConnectionGoodput = append(total.Bulk.ConnectionGoodput, float64(s.bytesSent)/duration)
+		return s.RetCodes
+	})
+	total.Bulk.Goodput = float64(total.BytesSent) / duration
+	_, _ = fmt.Fprintf(out, "Sockets used: %d (for perfect no error run, would be %d)\n", total.SocketCount, numThreads)
+	_, _ = fmt.Fprintf(out, "Total Bytes sent: %d, received: %d\n", total.BytesSent, total.BytesReceived)
+	printGoodput(out, total.Bulk)
+	periodic.PrintRetCodes(out, "tcp", total.RetCodes, total.DurationHistogram.Count)
+	return &total, nil
+}
+
+// printGoodput prints the aggregate goodput, and the per connection min, avg and max.
+func printGoodput(out io.Writer, b *BulkResults) {
+	if len(b.ConnectionGoodput) == 0 {
+		return
+	}
+	lo, hi := b.ConnectionGoodput[0], b.ConnectionGoodput[0]
+	for _, g := range b.ConnectionGoodput {
+		if g < lo {
+			lo = g
+		}
+		if g > hi {
+			hi = g
+		}
+	}
+	avg := b.Goodput / float64(len(b.ConnectionGoodput))
+	_, _ = fmt.Fprintf(out, "Goodput: %.2f Mbit/s (%d bytes chunks), per connection min %.2f avg %.2f max %.2f Mbit/s\n",
+		mbits(b.Goodput), b.ChunkSize, mbits(lo), mbits(avg), mbits(hi))
+}
+
+func mbits(bytesPerSec float64) float64 {
+	return bytesPerSec * 8 / 1e6
+}
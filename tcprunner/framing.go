@@ -0,0 +1,167 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcprunner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"fortio.org/fortio/fnet"
+	"fortio.org/fortio/log"
+)
+
+// Framing modes of the responses (TCPOptions.Framing), the request payload
+// is always sent as is (so it should include the protocol's framing).
+const (
+	// FramingEcho expects the exact payload back (default).
+	FramingEcho = "echo"
+	// FramingLength expects a big endian length prefix of 1, 2 or 4 bytes ("length:2") followed by that many bytes.
+	FramingLength = "length"
+	// FramingDelimiter expects a response ending with the (go quoted string escapes) delimiter, e.g. "delim:\r\n".
+	FramingDelimiter = "delim"
+	// FramingSize expects a response of exactly that many bytes, e.g. "size:128".
+	FramingSize = "size"
+)
+
+// framing is the parsed TCPOptions.Framing.
+type framing struct {
+	mode      string
+	prefixLen int    // FramingLength
+	delimiter []byte // FramingDelimiter
+	size      int    // FramingSize
+}
+
+var (
+	errBadFrame  = errors.New("bad frame")
+	errPastFrame = errors.New("read past frame")
+)
+
+// parseFraming parses a framing mode: echo, length:1|2|4, delim:<delimiter> or size:<n>.
+func parseFraming(s string) (*framing, error) {
+	if s == "" || s == FramingEcho {
+		return &framing{mode: FramingEcho}, nil
+	}
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid framing %q, should be echo, length:1|2|4, delim:<delimiter> or size:<n>", s)
+	}
+	f := &framing{mode: parts[0]}
+	var err error
+	switch f.mode {
+	case FramingLength:
+		f.prefixLen, err = strconv.Atoi(parts[1])
+		if err == nil && f.prefixLen != 1 && f.prefixLen != 2 && f.prefixLen != 4 {
+			err = fmt.Errorf("length prefix should be 1, 2 or 4 bytes, not %d", f.prefixLen)
+		}
+	case FramingDelimiter:
+		var d string
+		d, err = strconv.Unquote("\"" + parts[1] + "\"")
+		f.delimiter = []byte(d)
+	case FramingSize:
+		f.size, err = strconv.Atoi(parts[1])
+		if err == nil && (f.size <= 0 || f.size > fnet.MaxPayloadSizeLimit) {
+			err = fmt.Errorf("size should be between 1 and %d, not %d", fnet.MaxPayloadSizeLimit, f.size)
+		}
+	default:
+		err = fmt.Errorf("unknown mode %q", f.mode)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid framing %q: %w", s, err)
+	}
+	return f, nil
+}
+
+// frameLength returns the length of the complete response frame in b, or -1
+// if more data is needed.
+func (f *framing) frameLength(b []byte) (int, error) {
+	switch f.mode {
+	case FramingSize:
+		if len(b) < f.size {
+			return -1, nil
+		}
+		return f.size, nil
+	case FramingDelimiter:
+		idx := bytes.Index(b, f.delimiter)
+		if idx < 0 {
+			return -1, nil
+		}
+		return idx + len(f.delimiter), nil
+	case FramingLength:
+		if len(b) < f.prefixLen {
+			return -1, nil
+		}
+		var l uint64
+		switch f.prefixLen {
+		case 1:
+			l = uint64(b[0])
+		case 2:
+			l = uint64(binary.BigEndian.Uint16(b))
+		case 4:
+			l = uint64(binary.BigEndian.Uint32(b))
+		}
+		if l > uint64(fnet.MaxPayloadSizeLimit) {
+			return 0, errBadFrame
+		}
+		total := f.prefixLen + int(l)
+		if len(b) < total {
+			return -1, nil
+		}
+		return total, nil
+	}
+	return 0, errBadFrame // not reached for echo, handled directly
+}
+
+// readFrame reads a complete response frame into the client's buffer (grown
+// as needed) and returns it. When pipelining, the bytes read past the frame
+// are kept for the next one.
+func (c *TCPClient) readFrame(conn net.Conn) ([]byte, error) {
+	size := copy(c.buffer, c.buffer[c.carryOff:c.carryOff+c.carry])
+	c.carry = 0
+	var err error
+	for {
+		frameLen, ferr := c.framing.frameLength(c.buffer[:size])
+		if ferr != nil {
+			return c.buffer[:size], ferr
+		}
+		if frameLen >= 0 {
+			if size > frameLen {
+				if c.pipeline <= 1 {
+					return c.buffer[:size], errPastFrame
+				}
+				c.carryOff, c.carry = frameLen, size-frameLen
+			}
+			return c.buffer[:frameLen], nil
+		}
+		if err != nil {
+			log.Debugf("read error before end of frame (%d bytes): %v", size, err)
+			return c.buffer[:size], errShortRead
+		}
+		if size == len(c.buffer) {
+			if size >= fnet.MaxPayloadSizeLimit {
+				return c.buffer[:size], errBadFrame
+			}
+			c.buffer = append(c.buffer, make([]byte, len(c.buffer)+1)...)
+		}
+		var n int
+		n, err = conn.Read(c.buffer[size:])
+		size += n
+		c.bytesReceived += int64(n)
+	}
+}
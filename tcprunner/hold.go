@@ -0,0 +1,367 @@
+// Copyright 2021 Fortio Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package tcprunner
+
+// Connection scaling ("hold") mode: each call opens a new connection which is
+// then kept open, mostly idle, in a shared pool instead of one goroutine per
+// connection. On linux the pool uses epoll to find the (few) connections with
+// activity and a small number of workers to handle them, so hundreds of
+// thousands of connections can be held for load balancer/conntrack tests.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fortio.org/fortio/fhttp"
+	"fortio.org/fortio/fnet"
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/periodic"
+)
+
+// HoldOptions are the options for the connection holding mode.
+type HoldOptions struct {
+	// Hold is true to keep each new connection open (1 connection per call)
+	// instead of exchanging messages over NumThreads connections.
+	Hold bool
+	// HoldDuration is how long to keep the connections once they are all established.
+	HoldDuration time.Duration
+	// HoldPing is the interval at which the payload is sent (and echo expected)
+	// on each held connection. 0 for fully idle connections.
+	HoldPing time.Duration
+}
+
+// HoldResults are the connection holding mode counters.
+type HoldResults struct {
+	// Connections still open at the end of the hold duration.
+	HeldConnections int64
+	// Connections closed (or reset) by the other side while being held.
+	ClosedByPeer int64
+	// Errors writing pings or reading their reply.
+	PingErrors int64
+}
+
+// idleConn is a held connection.
+type idleConn struct {
+	conn    net.Conn
+	fd      int // for the poller, when available
+	pending int32
+	closed  int32
+}
+
+// idlePool holds the connections. Handling of readable connections is done by
+// a fixed number of workers fed by the platform specific poller.
+type idlePool struct {
+	mutex      sync.Mutex
+	conns      map[*idleConn]struct{}
+	payload    []byte
+	reqTimeout time.Duration
+	work       chan *idleConn
+	done       chan struct{}
+	wg         sync.WaitGroup
+	poller     poller
+	// Counters, accessed atomically.
+	closedByPeer  int64
+	pingErrors    int64
+	bytesSent     int64
+	bytesReceived int64
+}
+
+// poller is the platform specific way to be notified of connections with
+// data (or closed) to read. It either queues them to the pool's work channel
+// for the workers or reads them directly.
+type poller interface {
+	add(c *idleConn) error
+	// rearm is called after a notified connection has been handled.
+	rearm(c *idleConn)
+	remove(c *idleConn)
+	close()
+}
+
+func newIdlePool(numWorkers int, payload []byte, ping time.Duration, reqTimeout time.Duration) (*idlePool, error) {
+	p := &idlePool{
+		conns:      make(map[*idleConn]struct{}),
+		payload:    payload,
+		reqTimeout: reqTimeout,
+		work:       make(chan *idleConn, 1024),
+		done:       make(chan struct{}),
+	}
+	var err error
+	p.poller, err = newPoller(p)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < numWorkers; i++ {
+		p.wg.Add(1)
+		go p.worker()
+	}
+	if ping > 0 {
+		p.wg.Add(1)
+		go p.pinger(ping)
+	}
+	return p, nil
+}
+
+// add transfers a connection to the pool.
+func (p *idlePool) add(conn net.Conn) error {
+	c := &idleConn{conn: conn, fd: -1}
+	p.mutex.Lock()
+	p.conns[c] = struct{}{}
+	p.mutex.Unlock()
+	if err := p.poller.add(c); err != nil {
+		p.drop(c)
+		return err
+	}
+	return nil
+}
+
+// size returns the number of connections currently held.
+func (p *idlePool) size() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return int64(len(p.conns))
+}
+
+// drop closes and forgets a connection.
+func (p *idlePool) drop(c *idleConn) {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return
+	}
+	p.poller.remove(c)
+	p.mutex.Lock()
+	delete(p.conns, c)
+	p.mutex.Unlock()
+	_ = c.conn.Close()
+}
+
+func (p *idlePool) worker() {
+	defer p.wg.Done()
+	buf := make([]byte, 4096)
+	for {
+		select {
+		case <-p.done:
+			return
+		case c := <-p.work:
+			p.handleReadable(c, buf)
+		}
+	}
+}
+
+// handleReadable reads what is available on a connection the poller found
+// readable: ping replies or the end of the connection.
+func (p *idlePool) handleReadable(c *idleConn, buf []byte) {
+	if atomic.LoadInt32(&c.closed) != 0 {
+		return
+	}
+	// Short deadline, in case of spurious wake up, data should be there already.
+	_ = c.conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if p.read(c, buf) {
+		p.poller.rearm(c)
+	}
+}
+
+// read reads once from the connection, returns false if the connection is done.
+func (p *idlePool) read(c *idleConn, buf []byte) bool {
+	n, err := c.conn.Read(buf)
+	atomic.AddInt64(&p.bytesReceived, int64(n))
+	if err != nil {
+		var nErr net.Error
+		if errors.As(err, &nErr) && nErr.Timeout() {
+			return true
+		}
+		if atomic.LoadInt32(&c.closed) != 0 {
+			return false // closed on our side
+		}
+		if !errors.Is(err, io.EOF) {
+			log.LogVf("Held connection %v error: %v", c.conn.RemoteAddr(), err)
+		}
+		atomic.AddInt64(&p.closedByPeer, 1)
+		p.drop(c)
+		return false
+	}
+	if pending := atomic.AddInt32(&c.pending, -int32(n)); pending < 0 {
+		atomic.StoreInt32(&c.pending, 0) // unsolicited data, ignored
+	}
+	return true
+}
+
+// pinger sends the payload on all the held connections at the interval.
+func (p *idlePool) pinger(interval time.Duration) {
+	defer p.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.pingAll()
+		}
+	}
+}
+
+func (p *idlePool) pingAll() {
+	p.mutex.Lock()
+	conns := make([]*idleConn, 0, len(p.conns))
+	for c := range p.conns {
+		conns = append(conns, c)
+	}
+	p.mutex.Unlock()
+	for _, c := range conns {
+		if atomic.LoadInt32(&c.pending) != 0 {
+			atomic.AddInt64(&p.pingErrors, 1) // previous reply still missing
+		}
+		// set before writing as the reply can be read before Write returns
+		atomic.StoreInt32(&c.pending, int32(len(p.payload)))
+		_ = c.conn.SetWriteDeadline(time.Now().Add(p.reqTimeout))
+		n, err := c.conn.Write(p.payload)
+		atomic.AddInt64(&p.bytesSent, int64(n))
+		if err != nil {
+			atomic.StoreInt32(&c.pending, 0)
+			atomic.AddInt64(&p.pingErrors, 1)
+		}
+	}
+}
+
+// close stops the pool and closes all the connections, returns how many were still open.
+func (p *idlePool) close() int64 {
+	close(p.done)
+	p.poller.close()
+	p.mutex.Lock()
+	conns := p.conns
+	p.conns = make(map[*idleConn]struct{})
+	p.mutex.Unlock()
+	for c := range conns {
+		atomic.StoreInt32(&c.closed, 1)
+		_ = c.conn.Close()
+	}
+	p.wg.Wait()
+	return int64(len(conns))
+}
+
+// holdState is the per thread state in hold mode: each Run() opens a new
+// connection which is handed over to the shared pool.
+type holdState struct {
+	RetCodes    TCPResultMap
+	dest        net.Addr
+	pool        *idlePool
+	reqTimeout  time.Duration
+	socketCount int
+}
+
+// Run opens one more connection and keeps it.
+func (h *holdState) Run(t int) {
+	h.socketCount++
+	conn, err := net.DialTimeout(h.dest.Network(), h.dest.String(), h.reqTimeout)
+	if err != nil {
+		log.LogVf("[%d] Unable to connect to %v : %v", t, h.dest, err)
+		h.RetCodes[err.Error()]++
+		return
+	}
+	if err = h.pool.add(conn); err != nil {
+		log.Errf("[%d] Unable to hold connection to %v : %v", t, h.dest, err)
+		h.RetCodes[err.Error()]++
+		return
+	}
+	h.RetCodes[TCPStatusOK]++
+}
+
+// connectAborted tells if the connection phase ended early because of an Abort().
+func connectAborted(o *periodic.RunnerOptions, res *periodic.RunnerResults) bool {
+	if o.Exactly > 0 {
+		return res.DurationHistogram.Count < o.Exactly
+	}
+	return o.Duration > 0 && res.ActualDuration < o.Duration
+}
+
+// holdConnections waits for the hold duration. Run() closes the stop channel once
+// the connections are established so a new one is armed, for Abort() to cut the
+// hold short.
+func holdConnections(stop *periodic.Aborter, out io.Writer, n int64, d time.Duration) {
+	abort := make(chan struct{}, 1)
+	stop.Lock()
+	stop.StopChan = abort
+	stop.Unlock()
+	_, _ = fmt.Fprintf(out, "Holding %d connections for %v\n", n, d)
+	timer := time.NewTimer(d)
+	select {
+	case <-timer.C:
+		stop.Abort()
+	case <-abort:
+		timer.Stop()
+		log.Infof("Hold aborted, closing the %d connections", n)
+	}
+}
+
+// runHold is RunTCPTest for the connection holding mode.
+func runHold(o *RunnerOptions, r periodic.PeriodicRunner) (*RunnerResults, error) {
+	numThreads := r.Options().NumThreads
+	out := r.Options().Out
+	tAddr, err := fnet.ResolveDestination(o.Destination)
+	if tAddr == nil {
+		return nil, err
+	}
+	payload := o.Payload
+	if len(payload) == 0 {
+		payload = GeneratePayload(0, 0)
+	}
+	reqTimeout := o.ReqTimeout
+	if reqTimeout <= 0 {
+		reqTimeout = fhttp.HTTPReqTimeOutDefaultValue
+	}
+	if limit := fileLimit(); limit > 0 && o.Exactly > 0 && uint64(o.Exactly) > limit {
+		log.Warnf("Open files limit %d is lower than the %d connections requested, increase it (ulimit -n)", limit, o.Exactly)
+	}
+	pool, err := newIdlePool(numThreads, payload, o.HoldPing, reqTimeout)
+	if err != nil {
+		return nil, err
+	}
+	total := RunnerResults{
+		aborter:  r.Options().Stop,
+		RetCodes: make(TCPResultMap),
+		Hold:     &HoldResults{},
+	}
+	total.Destination = o.Destination
+	states := make([]holdState, numThreads)
+	for i := 0; i < numThreads; i++ {
+		states[i] = holdState{RetCodes: make(TCPResultMap), dest: tAddr, pool: pool, reqTimeout: reqTimeout}
+		r.Options().Runners[i] = &states[i]
+	}
+	total.RunnerResults = r.Run()
+	if connectAborted(r.Options(), &total.RunnerResults) {
+		log.Warnf("Run aborted, not holding the %d connections", pool.size())
+	} else {
+		holdConnections(r.Options().Stop, out, pool.size(), o.HoldDuration)
+	}
+	total.Hold.HeldConnections = pool.close()
+	total.Hold.ClosedByPeer = atomic.LoadInt64(&pool.closedByPeer)
+	total.Hold.PingErrors = atomic.LoadInt64(&pool.pingErrors)
+	total.BytesSent = atomic.LoadInt64(&pool.bytesSent)
+	total.BytesReceived = atomic.LoadInt64(&pool.bytesReceived)
+	periodic.MergeThreads(r, numThreads, total.RetCodes, func(i int) map[string]int64 {
+		total.SocketCount += states[i].socketCount
+		return states[i].RetCodes
+	})
+	_, _ = fmt.Fprintf(out, "Connections held: %d, closed by peer: %d, ping errors: %d\n",
+		total.Hold.HeldConnections, total.Hold.ClosedByPeer, total.Hold.PingErrors)
+	_, _ = fmt.Fprintf(out, "Total Bytes sent: %d, received: %d\n", total.BytesSent, total.BytesReceived)
+	periodic.PrintRetCodes(out, "tcp", total.RetCodes, total.DurationHistogram.Count)
+	return &total, nil
+}
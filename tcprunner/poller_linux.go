@@ -0,0 +1,141 @@
+// Copyright 2021 Fortio Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package tcprunner
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+
+	"fortio.org/fortio/log"
+)
+
+// epollPoller watches the held connections with its own epoll instance
+// (in addition to the go runtime's netpoller) and queues the ready ones
+// to the pool's workers. One shot mode so a connection is only handled by
+// one worker at a time.
+type epollPoller struct {
+	epfd   int
+	pool   *idlePool
+	mutex  sync.Mutex
+	fds    map[int32]*idleConn
+	closed bool
+	done   chan struct{}
+}
+
+const epollEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+func newPoller(p *idlePool) (poller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("epoll create: %w", err)
+	}
+	ep := &epollPoller{epfd: epfd, pool: p, fds: make(map[int32]*idleConn), done: make(chan struct{})}
+	go ep.loop()
+	return ep, nil
+}
+
+func (ep *epollPoller) add(c *idleConn) error {
+	sc, ok := c.conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("no file descriptor for %v", c.conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ctlErr error
+	err = raw.Control(func(fd uintptr) {
+		c.fd = int(fd)
+		ep.mutex.Lock()
+		ep.fds[int32(fd)] = c
+		ep.mutex.Unlock()
+		ev := syscall.EpollEvent{Events: epollEvents, Fd: int32(fd)}
+		ctlErr = syscall.EpollCtl(ep.epfd, syscall.EPOLL_CTL_ADD, int(fd), &ev)
+	})
+	if err == nil {
+		err = ctlErr
+	}
+	return err
+}
+
+func (ep *epollPoller) rearm(c *idleConn) {
+	ev := syscall.EpollEvent{Events: epollEvents, Fd: int32(c.fd)}
+	if err := syscall.EpollCtl(ep.epfd, syscall.EPOLL_CTL_MOD, c.fd, &ev); err != nil {
+		log.LogVf("epoll rearm of %d: %v", c.fd, err)
+	}
+}
+
+func (ep *epollPoller) remove(c *idleConn) {
+	if c.fd < 0 {
+		return
+	}
+	ep.mutex.Lock()
+	delete(ep.fds, int32(c.fd))
+	closed := ep.closed
+	ep.mutex.Unlock()
+	if !closed {
+		_ = syscall.EpollCtl(ep.epfd, syscall.EPOLL_CTL_DEL, c.fd, nil)
+	}
+}
+
+func (ep *epollPoller) loop() {
+	defer close(ep.done)
+	events := make([]syscall.EpollEvent, 256)
+	for {
+		n, err := syscall.EpollWait(ep.epfd, events, 100) // ms, to check for close
+		ep.mutex.Lock()
+		if ep.closed {
+			ep.mutex.Unlock()
+			return
+		}
+		ready := make([]*idleConn, 0, n)
+		for i := 0; i < n; i++ {
+			if c, found := ep.fds[events[i].Fd]; found {
+				ready = append(ready, c)
+			}
+		}
+		ep.mutex.Unlock()
+		if err != nil && err != syscall.EINTR { // nolint: errorlint // syscall errors are not wrapped
+			log.Errf("epoll wait error: %v", err)
+			return
+		}
+		for _, c := range ready {
+			select {
+			case ep.pool.work <- c:
+			case <-ep.pool.done:
+				return
+			}
+		}
+	}
+}
+
+func (ep *epollPoller) close() {
+	ep.mutex.Lock()
+	ep.closed = true
+	ep.mutex.Unlock()
+	<-ep.done
+	_ = syscall.Close(ep.epfd)
+}
+
+// fileLimit returns the current (soft) limit of open files.
+func fileLimit() uint64 {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0
+	}
+	return rl.Cur
+}
@@ -0,0 +1,49 @@
+// Copyright 2021 Fortio Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+//go:build !linux
+// +build !linux
+
+package tcprunner
+
+// goroutinePoller is the portable fallback: one (blocked in read) goroutine
+// per held connection.
+type goroutinePoller struct {
+	pool *idlePool
+}
+
+func newPoller(p *idlePool) (poller, error) {
+	return &goroutinePoller{pool: p}, nil
+}
+
+func (g *goroutinePoller) add(c *idleConn) error {
+	g.pool.wg.Add(1)
+	go func() {
+		defer g.pool.wg.Done()
+		buf := make([]byte, 4096)
+		for g.pool.read(c, buf) {
+		}
+	}()
+	return nil
+}
+
+func (g *goroutinePoller) rearm(c *idleConn)  {}
+func (g *goroutinePoller) remove(c *idleConn) {}
+func (g *goroutinePoller) close()             {}
+
+// fileLimit returns 0 (unknown) on this platform.
+func fileLimit() uint64 {
+	return 0
+}
@@ -19,13 +19,14 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"sort"
+	"strings"
 	"time"
 
 	"fortio.org/fortio/fhttp"
 	"fortio.org/fortio/fnet"
 	"fortio.org/fortio/log"
 	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/stats"
 )
 
 type TCPResultMap map[string]int64
@@ -39,15 +40,31 @@ type RunnerResults struct {
 	SocketCount   int
 	BytesSent     int64
 	BytesReceived int64
-	client        *TCPClient
-	aborter       *periodic.Aborter
+	// Histogram of the bytes received by each call.
+	Sizes *stats.HistogramData
+	sizes *stats.Histogram
+	// Connection holding mode results, nil otherwise.
+	Hold *HoldResults
+	// Bulk transfer mode results, nil otherwise.
+	Bulk    *BulkResults
+	client  *TCPClient
+	aborter *periodic.Aborter
+	// Latency of each message when pipelining (Pipeline > 1), nil otherwise.
+	MessageLatency *stats.HistogramData
+}
+
+// ErrorRate returns the fraction of the calls which weren't OK (see periodic.HasErrorRate).
+func (tcpstate *RunnerResults) ErrorRate() float64 {
+	return periodic.ErrorRate(tcpstate.RetCodes, TCPStatusOK)
 }
 
 // Run tests tcp request fetching. Main call being run at the target QPS.
 // To be set as the Function in RunnerOptions.
 func (tcpstate *RunnerResults) Run(t int) {
 	log.Debugf("Calling in %d", t)
+	received := tcpstate.client.bytesReceived
 	_, err := tcpstate.client.Fetch()
+	tcpstate.sizes.Record(float64(tcpstate.client.bytesReceived - received))
 	if err != nil {
 		tcpstate.RetCodes[err.Error()]++
 	} else {
@@ -55,12 +72,26 @@ func (tcpstate *RunnerResults) Run(t int) {
 	}
 }
 
+// Warmup makes a warmup call, not counted in the results (see periodic.Warmer).
+func (tcpstate *RunnerResults) Warmup(t int) {
+	messageTime := tcpstate.client.messageTime
+	tcpstate.client.messageTime = nil
+	_, err := tcpstate.client.Fetch()
+	tcpstate.client.messageTime = messageTime
+	log.Debugf("Warmup call in %d: %v", t, err)
+}
+
 // TCPOptions are options to the TCPClient.
 type TCPOptions struct {
 	Destination      string
 	Payload          []byte // what to send (and check)
 	UnixDomainSocket string // Path of unix domain socket to use instead of host:port from URL
 	ReqTimeout       time.Duration
+	// Framing of the responses: FramingEcho (default, same as empty), or length:1|2|4, delim:<delimiter>,
+	// size:<n> for protocols not echoing the payload (see the Framing* constants).
+	Framing string
+	// Number of messages sent at once for each call, their responses being read in order (default 0 is 1).
+	Pipeline int
 }
 
 // RunnerOptions includes the base RunnerOptions plus tcp specific
@@ -68,6 +99,8 @@ type TCPOptions struct {
 type RunnerOptions struct {
 	periodic.RunnerOptions
 	TCPOptions // Need to call Init() to initialize
+	HoldOptions
+	BulkOptions
 }
 
 // TCPClient is the client used for tcp echo testing.
@@ -84,6 +117,13 @@ type TCPClient struct {
 	destination   string
 	doGenerate    bool
 	reqTimeout    time.Duration
+	localAddr     net.Addr // of the last connection, for the run metadata
+	framing       *framing
+	carryOff      int // start of the bytes read past the last frame (pipelining)
+	carry         int // number of such bytes
+	pipeline      int
+	batch         []byte           // the pipelined messages
+	messageTime   *stats.Histogram // per message latency when pipelining
 }
 
 var (
@@ -107,6 +147,10 @@ func GeneratePayload(t int, i int64) []byte {
 // NewTCPClient creates and initialize and returns a client based on the TCPOptions.
 func NewTCPClient(o *TCPOptions) (*TCPClient, error) {
 	c := TCPClient{}
+	var err error
+	if c.framing, err = parseFraming(o.Framing); err != nil {
+		return nil, err
+	}
 	d := o.Destination
 	c.destination = d
 	tAddr, err := fnet.ResolveDestination(d)
@@ -120,6 +164,7 @@ func NewTCPClient(o *TCPOptions) (*TCPClient, error) {
 		c.req = GeneratePayload(0, 0)
 	}
 	c.buffer = make([]byte, len(c.req))
+	c.pipeline = o.Pipeline
 	c.reqTimeout = o.ReqTimeout
 	if o.ReqTimeout == 0 {
 		log.Debugf("Request timeout not set, using default %v", fhttp.HTTPReqTimeOutDefaultValue)
@@ -139,6 +184,8 @@ func (c *TCPClient) connect() (net.Conn, error) {
 		log.Errf("Unable to connect to %v : %v", c.dest, err)
 		return nil, err
 	}
+	c.localAddr = socket.LocalAddr()
+	c.carry = 0
 	fnet.SetSocketBuffers(socket, len(c.buffer), len(c.req))
 	return socket, nil
 }
@@ -163,10 +210,15 @@ func (c *TCPClient) Fetch() ([]byte, error) {
 	if c.doGenerate {
 		c.req = GeneratePayload(c.connID, c.messageCount) // TODO write directly in buffer to avoid generating garbage for GC to clean
 	}
-	n, err := conn.Write(c.req)
+	req := c.req
+	if c.pipeline > 1 {
+		req = c.pipelinedRequests()
+	}
+	start := time.Now()
+	n, err := conn.Write(req)
 	c.bytesSent = c.bytesSent + int64(n)
 	if log.LogDebug() {
-		log.Debugf("wrote %d (%q): %v", n, string(c.req), err)
+		log.Debugf("wrote %d (%q): %v", n, string(req), err)
 	}
 	if err != nil || conErr != nil {
 		if reuse {
@@ -178,10 +230,20 @@ func (c *TCPClient) Fetch() ([]byte, error) {
 		log.Errf("Unable to write to %v %v : %v", conn, c.dest, err)
 		return nil, err
 	}
-	if n != len(c.req) {
-		log.Errf("Short write to %v %v : %d instead of %d", conn, c.dest, n, len(c.req))
+	if n != len(req) {
+		log.Errf("Short write to %v %v : %d instead of %d", conn, c.dest, n, len(req))
 		return nil, io.ErrShortWrite
 	}
+	if c.pipeline > 1 {
+		return c.readPipelined(conn, start)
+	}
+	if c.framing.mode != FramingEcho {
+		data, err := c.readFrame(conn)
+		if err == nil {
+			c.socket = conn // reuse on success
+		}
+		return data, err
+	}
 	// assert that len(c.buffer) == len(c.req)
 	n, err = conn.Read(c.buffer)
 	c.bytesReceived = c.bytesReceived + int64(n)
@@ -203,6 +265,59 @@ func (c *TCPClient) Fetch() ([]byte, error) {
 	return c.buffer[:n], nil
 }
 
+// pipelinedRequests returns the Pipeline messages to send at once, starting
+// with c.req.
+func (c *TCPClient) pipelinedRequests() []byte {
+	c.batch = append(c.batch[:0], c.req...)
+	for i := 1; i < c.pipeline; i++ {
+		if c.doGenerate {
+			c.messageCount++
+			c.batch = append(c.batch, GeneratePayload(c.connID, c.messageCount)...)
+		} else {
+			c.batch = append(c.batch, c.req...)
+		}
+	}
+	return c.batch
+}
+
+// readPipelined reads, in order, the responses to the pipelined messages
+// sent at start and records their latency.
+func (c *TCPClient) readPipelined(conn net.Conn, start time.Time) ([]byte, error) {
+	msgLen := len(c.req) // all the messages have the same length
+	var data []byte
+	var err error
+	for i := 0; i < c.pipeline; i++ {
+		if c.framing.mode == FramingEcho {
+			data, err = c.readEcho(conn, c.batch[i*msgLen:(i+1)*msgLen])
+		} else {
+			data, err = c.readFrame(conn)
+		}
+		if err != nil {
+			return data, err
+		}
+		if c.messageTime != nil {
+			c.messageTime.Record(time.Since(start).Seconds())
+		}
+	}
+	c.socket = conn // reuse on success
+	return data, nil
+}
+
+// readEcho reads the full echo of the expected message.
+func (c *TCPClient) readEcho(conn net.Conn, expected []byte) ([]byte, error) {
+	n, err := io.ReadFull(conn, c.buffer[:len(expected)])
+	c.bytesReceived += int64(n)
+	if err != nil {
+		log.Debugf("read error %d/%d: %v", n, len(expected), err)
+		return c.buffer[:n], errShortRead
+	}
+	if !bytes.Equal(c.buffer[:n], expected) {
+		log.Infof("Mismatch between sent %q and received %q", string(expected), string(c.buffer[:n]))
+		return c.buffer[:n], errMismatch
+	}
+	return c.buffer[:n], nil
+}
+
 // Close closes the last connection and returns the total number of sockets used for the run.
 func (c *TCPClient) Close() int {
 	log.Debugf("Closing %p: %s socket count %d", c, c.destination, c.socketCount)
@@ -216,63 +331,84 @@ func (c *TCPClient) Close() int {
 }
 
 // RunTCPTest runs an tcp test and returns the aggregated stats.
-// Some refactoring to avoid copy-pasta between the now 3 runners would be good.
 func RunTCPTest(o *RunnerOptions) (*RunnerResults, error) {
 	o.RunType = "TCP"
+	if strings.HasPrefix(o.Destination, TCPBulkURLPrefix) {
+		o.Bulk = true
+	}
+	if o.Bulk {
+		o.RunType = "TCP bulk"
+		o.QPS = -1 // as fast as possible
+	}
+	if (o.Hold || o.Bulk) && o.HasWarmup() {
+		return nil, fmt.Errorf("%s test doesn't support a warmup phase", o.RunType)
+	}
 	log.Infof("Starting tcp test for %s with %d threads at %.1f qps", o.Destination, o.NumThreads, o.QPS)
 	r := periodic.NewPeriodicRunner(&o.RunnerOptions)
 	defer r.Options().Abort()
 	numThreads := r.Options().NumThreads
 	o.TCPOptions.Destination = o.Destination
+	if o.Hold {
+		return runHold(o, r)
+	}
+	if o.Bulk {
+		return runBulk(o, r)
+	}
 	out := r.Options().Out // Important as the default value is set from nil to stdout inside NewPeriodicRunner
 	total := RunnerResults{
 		aborter:  r.Options().Stop,
 		RetCodes: make(TCPResultMap),
 	}
 	total.Destination = o.Destination
+	messageTime := r.Options().NewLatencyHistogram()
+	total.sizes = stats.NewHistogram(0, 1)
 	tcpstate := make([]RunnerResults, numThreads)
-	var err error
-	for i := 0; i < numThreads; i++ {
-		r.Options().Runners[i] = &tcpstate[i]
+	err := periodic.SetupThreads(r, func(i int, firstCall bool) (periodic.Runnable, error) {
 		// Create a client (and transport) and connect once for each 'thread'
-		tcpstate[i].client, err = NewTCPClient(&o.TCPOptions)
-		if tcpstate[i].client == nil {
+		client, err := NewTCPClient(&o.TCPOptions)
+		if client == nil {
 			return nil, fmt.Errorf("unable to create client %d for %s: %w", i, o.Destination, err)
 		}
-		tcpstate[i].client.connID = i
-		if o.Exactly <= 0 {
-			data, err := tcpstate[i].client.Fetch()
+		client.connID = i
+		if firstCall {
+			data, err := client.Fetch()
 			if i == 0 && log.LogVerbose() {
 				log.LogVf("first hit of %s: err %v, received %d: %q", o.Destination, err, len(data), data)
 			}
 		}
+		client.messageTime = messageTime.Clone() // after the warmup call
 		// Setup the stats for each 'thread'
+		tcpstate[i].client = client
 		tcpstate[i].aborter = total.aborter
 		tcpstate[i].RetCodes = make(TCPResultMap)
+		tcpstate[i].sizes = total.sizes.Clone()
+		return &tcpstate[i], nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	total.RunnerResults = r.Run()
-	// Numthreads may have reduced but it should be ok to accumulate 0s from
-	// unused ones. We also must cleanup all the created clients.
-	keys := []string{}
-	for i := 0; i < numThreads; i++ {
+	periodic.MergeThreads(r, numThreads, total.RetCodes, func(i int) map[string]int64 {
+		total.Metadata.AddConnection(tcpstate[i].client.localAddr, tcpstate[i].client.dest, nil)
 		total.SocketCount += tcpstate[i].client.Close()
 		total.BytesReceived += tcpstate[i].client.bytesReceived
 		total.BytesSent += tcpstate[i].client.bytesSent
-		for k := range tcpstate[i].RetCodes {
-			if _, exists := total.RetCodes[k]; !exists {
-				keys = append(keys, k)
-			}
-			total.RetCodes[k] += tcpstate[i].RetCodes[k]
-		}
-	}
-	// Cleanup state:
-	r.Options().ReleaseRunners()
-	totalCount := float64(total.DurationHistogram.Count)
+		messageTime.Transfer(tcpstate[i].client.messageTime)
+		total.sizes.Transfer(tcpstate[i].sizes)
+		return tcpstate[i].RetCodes
+	})
 	_, _ = fmt.Fprintf(out, "Sockets used: %d (for perfect no error run, would be %d)\n", total.SocketCount, r.Options().NumThreads)
 	_, _ = fmt.Fprintf(out, "Total Bytes sent: %d, received: %d\n", total.BytesSent, total.BytesReceived)
-	sort.Strings(keys)
-	for _, k := range keys {
-		_, _ = fmt.Fprintf(out, "tcp %s : %d (%.1f %%)\n", k, total.RetCodes[k], 100.*float64(total.RetCodes[k])/totalCount)
+	if o.Pipeline > 1 && messageTime.Count > 0 {
+		total.MessageLatency = messageTime.Export().CalcPercentiles(r.Options().Percentiles)
+		total.MessageLatency.Print(out, fmt.Sprintf("Per message latency (pipeline of %d)", o.Pipeline))
+	}
+	total.Sizes = total.sizes.Export().CalcPercentiles(r.Options().Percentiles)
+	if log.LogVerbose() {
+		total.Sizes.Print(out, "Response Sizes Histogram")
+	} else if log.Log(log.Warning) {
+		total.sizes.Counter.Print(out, "Response Sizes")
 	}
+	periodic.PrintRetCodes(out, "tcp", total.RetCodes, total.DurationHistogram.Count)
 	return &total, nil
 }
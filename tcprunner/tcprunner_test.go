@@ -16,12 +16,16 @@
 package tcprunner
 
 import (
+	"bytes"
 	"fmt"
+	"math"
 	"net"
 	"runtime"
 	"testing"
+	"time"
 
 	"fortio.org/fortio/fnet"
+	"fortio.org/fortio/periodic"
 )
 
 func TestTCPRunnerBadDestination(t *testing.T) {
@@ -56,6 +60,38 @@ func TestTCPRunner(t *testing.T) {
 	if res.SocketCount != res.RunnerResults.NumThreads {
 		t.Errorf("%d socket used, expected same as thread# %d", res.SocketCount, res.RunnerResults.NumThreads)
 	}
+	// Each call receives the echo of the default 24 bytes payload:
+	if res.Sizes == nil || res.Sizes.Count != totalReq || res.Sizes.Min != 24 || res.Sizes.Max != 24 {
+		t.Errorf("Unexpected response sizes %+v", res.Sizes)
+	}
+}
+
+func TestTCPWarmup(t *testing.T) {
+	addr := fnet.TCPEchoServer("test-echo-warmup", ":0")
+	opts := RunnerOptions{}
+	opts.QPS = 100
+	opts.NumThreads = 2
+	opts.Exactly = 10
+	opts.WarmupCalls = 6
+	opts.Destination = fmt.Sprintf("tcp://localhost:%d/", addr.(*net.TCPAddr).Port)
+	res, err := RunTCPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The warmup calls aren't counted in the tcp results:
+	if res.RetCodes[TCPStatusOK] != 10 || res.Sizes.Count != 10 || res.WarmupHistogram == nil || res.WarmupHistogram.Count != 6 {
+		t.Errorf("Unexpected results %v %d sizes, warmup %+v", res.RetCodes, res.Sizes.Count, res.WarmupHistogram)
+	}
+	// Not supported in bulk nor hold modes:
+	opts.Bulk = true
+	if _, err = RunTCPTest(&opts); err == nil {
+		t.Errorf("Expected error for warmup in bulk mode")
+	}
+	opts.Bulk = false
+	opts.Hold = true
+	if _, err = RunTCPTest(&opts); err == nil {
+		t.Errorf("Expected error for warmup in hold mode")
+	}
 }
 
 func TestTCPNotLeaking(t *testing.T) {
@@ -95,3 +131,267 @@ func TestTCPNotLeaking(t *testing.T) {
 		t.Errorf("%d socket used, expected same as thread# %d", res.SocketCount, res.RunnerResults.NumThreads)
 	}
 }
+
+func TestTCPHold(t *testing.T) {
+	addr := fnet.TCPEchoServer("test-echo-hold", ":0")
+	opts := RunnerOptions{}
+	opts.QPS = 0
+	opts.NumThreads = 4
+	opts.Exactly = 50
+	opts.Destination = fmt.Sprintf("tcp://localhost:%d/", addr.(*net.TCPAddr).Port)
+	opts.Hold = true
+	opts.HoldDuration = 300 * time.Millisecond
+	opts.HoldPing = 100 * time.Millisecond
+	res, err := RunTCPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[TCPStatusOK] != 50 || res.SocketCount != 50 {
+		t.Errorf("Expected 50 connections, got %v / %d", res.RetCodes, res.SocketCount)
+	}
+	if res.Hold.HeldConnections != 50 || res.Hold.ClosedByPeer != 0 || res.Hold.PingErrors != 0 {
+		t.Errorf("Unexpected hold results %+v", res.Hold)
+	}
+	// The replies to the last pings can still be in flight when the connections are closed.
+	if res.BytesSent == 0 || res.BytesReceived == 0 || res.BytesReceived > res.BytesSent {
+		t.Errorf("Expected echoed pings, sent %d received %d", res.BytesSent, res.BytesReceived)
+	}
+}
+
+func TestTCPHoldClosedByPeer(t *testing.T) {
+	l, a := fnet.Listen("test-closing", ":0")
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				c.Close()
+			}()
+		}
+	}()
+	opts := RunnerOptions{}
+	opts.NumThreads = 2
+	opts.Exactly = 10
+	opts.Destination = fmt.Sprintf("localhost:%d", a.(*net.TCPAddr).Port)
+	opts.Hold = true
+	opts.HoldDuration = 300 * time.Millisecond
+	res, err := RunTCPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Hold.HeldConnections != 0 || res.Hold.ClosedByPeer != 10 {
+		t.Errorf("Expected all 10 connections closed by peer, got %+v", res.Hold)
+	}
+	l.Close()
+}
+
+func TestTCPHoldAbort(t *testing.T) {
+	addr := fnet.TCPEchoServer("test-echo-hold-abort", ":0")
+	opts := RunnerOptions{}
+	opts.QPS = -1
+	opts.NumThreads = 2
+	opts.Exactly = 10
+	opts.Destination = fmt.Sprintf("localhost:%d", addr.(*net.TCPAddr).Port)
+	opts.Hold = true
+	opts.HoldDuration = time.Hour
+	stop := periodic.NewAborter()
+	opts.Stop = stop
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		stop.Abort()
+	}()
+	start := time.Now()
+	res, err := RunTCPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Hold wasn't aborted, took %v", elapsed)
+	}
+	if res.Hold.HeldConnections != 10 {
+		t.Errorf("Expected 10 held connections, got %+v", res.Hold)
+	}
+}
+
+func TestParseFraming(t *testing.T) {
+	tests := []struct {
+		framing  string
+		expected framing
+	}{
+		{"", framing{mode: FramingEcho}},
+		{"echo", framing{mode: FramingEcho}},
+		{"length:2", framing{mode: FramingLength, prefixLen: 2}},
+		{`delim:\r\n`, framing{mode: FramingDelimiter, delimiter: []byte("\r\n")}},
+		{"size:128", framing{mode: FramingSize, size: 128}},
+	}
+	for _, tst := range tests {
+		f, err := parseFraming(tst.framing)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", tst.framing, err)
+			continue
+		}
+		if f.mode != tst.expected.mode || f.prefixLen != tst.expected.prefixLen || f.size != tst.expected.size ||
+			!bytes.Equal(f.delimiter, tst.expected.delimiter) {
+			t.Errorf("Parsing %q got %+v expected %+v", tst.framing, f, tst.expected)
+		}
+	}
+	for _, bad := range []string{"length:3", "length:x", "delim:", "size:0", "size", "foo:1"} {
+		if _, err := parseFraming(bad); err == nil {
+			t.Errorf("Expected error for framing %q", bad)
+		}
+	}
+}
+
+// framedServer replies to each read with response, in 2 writes to exercise partial reads.
+func framedServer(t *testing.T, response []byte) net.Listener {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				for {
+					if _, err := conn.Read(buf); err != nil {
+						return
+					}
+					_, _ = conn.Write(response[:len(response)/2])
+					time.Sleep(time.Millisecond)
+					if _, err := conn.Write(response[len(response)/2:]); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func TestTCPRunnerFraming(t *testing.T) {
+	long := append([]byte{0x01, 0x2C}, bytes.Repeat([]byte("x"), 300)...) // 300 bytes length prefixed
+	tests := []struct {
+		framing  string
+		response []byte
+		ok       bool
+	}{
+		{`delim:\r\n`, []byte("+OK\r\n"), true},
+		{"length:2", long, true},
+		{"size:302", long, true},
+		{"size:10", long, false}, // more than expected
+		{"echo", []byte("+OK\r\n"), false},
+	}
+	for _, tst := range tests {
+		l := framedServer(t, tst.response)
+		opts := RunnerOptions{}
+		opts.QPS = 100
+		opts.Exactly = 10
+		opts.NumThreads = 2
+		opts.Destination = fmt.Sprintf("tcp://%s", l.Addr().String())
+		opts.Payload = []byte("PING\r\n")
+		opts.Framing = tst.framing
+		res, err := RunTCPTest(&opts)
+		l.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (res.RetCodes[TCPStatusOK] == 10) != tst.ok {
+			t.Errorf("Framing %s: unexpected results %v", tst.framing, res.RetCodes)
+		}
+		if tst.ok && (res.SocketCount != 2 || res.BytesReceived != 10*int64(len(tst.response))) {
+			t.Errorf("Framing %s: unexpected sockets %d / bytes received %d", tst.framing, res.SocketCount, res.BytesReceived)
+		}
+	}
+	opts := RunnerOptions{}
+	opts.Destination = "tcp://localhost:1"
+	opts.Framing = "length:3"
+	if _, err := RunTCPTest(&opts); err == nil {
+		t.Errorf("Expected error for invalid framing")
+	}
+}
+
+func TestTCPRunnerPipeline(t *testing.T) {
+	addr := fnet.TCPEchoServer("test-echo-pipeline", ":0")
+	for _, framing := range []string{FramingEcho, `delim:\r\n`} {
+		opts := RunnerOptions{}
+		opts.QPS = -1
+		opts.Exactly = 10
+		opts.NumThreads = 2
+		opts.Pipeline = 4
+		opts.Destination = fmt.Sprintf("tcp://localhost:%d/", addr.(*net.TCPAddr).Port)
+		opts.Framing = framing
+		if framing != FramingEcho {
+			opts.Payload = []byte("PING\r\n")
+		}
+		res, err := RunTCPTest(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.RetCodes[TCPStatusOK] != 10 || res.SocketCount != 2 {
+			t.Errorf("Framing %s: unexpected results %v with %d sockets", framing, res.RetCodes, res.SocketCount)
+		}
+		if res.MessageLatency == nil || res.MessageLatency.Count != 40 {
+			t.Errorf("Framing %s: expected 40 messages latencies, got %+v", framing, res.MessageLatency)
+		}
+		if res.BytesSent != res.BytesReceived {
+			t.Errorf("Framing %s: mismatch between bytes sent %d and received %d", framing, res.BytesSent, res.BytesReceived)
+		}
+	}
+}
+
+func TestTCPBulk(t *testing.T) {
+	addr := fnet.TCPSinkServer("test-sink", ":0")
+	opts := RunnerOptions{}
+	opts.NumThreads = 3
+	opts.Duration = 200 * time.Millisecond
+	opts.Destination = fmt.Sprintf("tcp-bulk://localhost:%d/", addr.(*net.TCPAddr).Port)
+	opts.BulkChunkSize = 1000
+	res, err := RunTCPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RunType != "TCP bulk" || res.RequestedQPS != "max" || res.SocketCount != 3 {
+		t.Errorf("Unexpected bulk run %s %s %d sockets", res.RunType, res.RequestedQPS, res.SocketCount)
+	}
+	ok := res.RetCodes[TCPStatusOK]
+	if ok == 0 || ok != res.DurationHistogram.Count || res.BytesSent != 1000*ok || res.BytesReceived != 0 {
+		t.Errorf("Unexpected bulk results %v %d calls, sent %d received %d",
+			res.RetCodes, res.DurationHistogram.Count, res.BytesSent, res.BytesReceived)
+	}
+	b := res.Bulk
+	if b == nil || b.ChunkSize != 1000 || len(b.ConnectionGoodput) != 3 || b.Goodput <= 0 {
+		t.Fatalf("Unexpected bulk results %+v", b)
+	}
+	sum := 0.
+	for _, g := range b.ConnectionGoodput {
+		sum += g
+	}
+	if math.Abs(sum-b.Goodput) > 1e-6*b.Goodput {
+		t.Errorf("Sum of the connections goodput %g != aggregate %g", sum, b.Goodput)
+	}
+	// Echo server works too, what's received back being drained:
+	opts = RunnerOptions{}
+	opts.NumThreads = 1
+	opts.Exactly = 20
+	opts.Destination = fmt.Sprintf("localhost:%d", fnet.TCPEchoServer("test-echo-bulk", ":0").(*net.TCPAddr).Port)
+	opts.Bulk = true
+	res, err = RunTCPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[TCPStatusOK] != 20 || res.BytesSent != 20*DefaultBulkChunkSize || res.BytesReceived > res.BytesSent {
+		t.Errorf("Unexpected bulk to echo results %v sent %d received %d", res.RetCodes, res.BytesSent, res.BytesReceived)
+	}
+	opts.Destination = "tcp-bulk://doesnotexist.fortio.org:1111"
+	if _, err = RunTCPTest(&opts); err == nil {
+		t.Errorf("Expected error for bad bulk destination")
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package udprunner
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"fortio.org/fortio/fnet"
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/tcprunner"
+)
+
+// DefaultFloodMaxPPS is the default cap of the flood mode packets per second.
+const DefaultFloodMaxPPS = 10000
+
+// FloodOptions are the options of the flood mode: datagrams are sent at the
+// target rate without waiting for the replies, which are read separately and
+// accounted for using their sequence number, to measure the server side drops.
+type FloodOptions struct {
+	Flood bool
+	// Explicit confirmation that flooding the Destination is intended, the flood mode errors out without it.
+	FloodConfirmed bool
+	// Packets per second cap (total across the threads), DefaultFloodMaxPPS when 0. The qps is lowered to it,
+	// and a max speed (qps <= 0) flood runs at it.
+	FloodMaxPPS float64
+}
+
+// floodWindow is how many sequence numbers, above the lowest one not received
+// yet, are tracked for the loss and duplicates accounting. Replies further
+// behind the highest one received are given up on (counted as lost) and, if
+// they arrive later, as duplicates.
+const floodWindow = 1 << 16
+
+// seqWindow tracks the sequence numbers received, in constant memory, as a
+// ring bitmap of the floodWindow ones from base.
+type seqWindow struct {
+	base  int64 // lowest sequence number not received yet, all the lower ones were (or were given up on)
+	bits  [floodWindow / 64]uint64
+	count int64 // distinct sequence numbers received
+}
+
+func (w *seqWindow) isSet(seq int64) bool {
+	i := seq % floodWindow
+	return w.bits[i/64]&(1<<(i%64)) != 0
+}
+
+func (w *seqWindow) flip(seq int64) {
+	i := seq % floodWindow
+	w.bits[i/64] ^= 1 << (i % 64)
+}
+
+// add records seq as received and returns false if it already was (duplicate).
+func (w *seqWindow) add(seq int64) bool {
+	if seq < w.base {
+		return false
+	}
+	if newBase := seq - floodWindow + 1; newBase > w.base {
+		// Too far ahead: give up on the oldest missing ones.
+		if newBase-w.base >= floodWindow {
+			w.bits = [floodWindow / 64]uint64{}
+			w.base = newBase
+		}
+		for ; w.base < newBase; w.base++ {
+			if w.isSet(w.base) {
+				w.flip(w.base)
+			}
+		}
+	}
+	if w.isSet(seq) {
+		return false
+	}
+	w.flip(seq)
+	w.count++
+	for w.isSet(w.base) {
+		w.flip(w.base)
+		w.base++
+	}
+	return true
+}
+
+// floodState is the per thread state of the flood mode.
+type floodState struct {
+	RetCodes  UDPResultMap
+	dest      net.Addr
+	connID    int
+	req       []byte
+	prefix    []byte // of the generated payloads, empty for a fixed payload
+	conn      net.Conn
+	sent      int64
+	bytesSent int64
+	// Updated by the reading goroutine, read once it's done:
+	wg            sync.WaitGroup
+	received      seqWindow
+	replies       int64
+	highest       int64
+	outOfOrder    int64
+	duplicates    int64
+	bytesReceived int64
+}
+
+// Run sends one datagram, without waiting for its reply.
+func (f *floodState) Run(t int) {
+	f.sent++
+	if len(f.prefix) > 0 {
+		f.req = tcprunner.GeneratePayload(f.connID, f.sent)
+	}
+	n, err := f.conn.Write(f.req)
+	f.bytesSent += int64(n)
+	if err != nil {
+		log.Debugf("[%d] Unable to write to %v : %v", t, f.dest, err)
+		f.RetCodes[err.Error()]++
+		return
+	}
+	f.RetCodes[UDPStatusOK]++
+}
+
+// read accounts for the replies until the connection is closed or times out.
+func (f *floodState) read(size int) {
+	defer f.wg.Done()
+	buf := make([]byte, size)
+	for {
+		n, err := f.conn.Read(buf)
+		if os.IsTimeout(err) || errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue // e.g. connection refused from an icmp error, keep reading
+		}
+		f.bytesReceived += int64(n)
+		f.replies++
+		if len(f.prefix) == 0 || n <= len(f.prefix) || !bytes.Equal(buf[:len(f.prefix)], f.prefix) {
+			continue
+		}
+		seq, err := strconv.ParseInt(string(buf[len(f.prefix):n]), 10, 64)
+		if err != nil {
+			continue
+		}
+		if !f.received.add(seq) {
+			f.duplicates++
+			continue
+		}
+		if seq < f.highest {
+			f.outOfOrder++
+		} else {
+			f.highest = seq
+		}
+	}
+}
+
+// runFlood is RunUDPTest for the flood mode.
+func runFlood(o *RunnerOptions, r periodic.PeriodicRunner) (*RunnerResults, error) {
+	numThreads := r.Options().NumThreads
+	out := r.Options().Out
+	tAddr, err := fnet.UDPResolveDestination(o.Destination)
+	if tAddr == nil {
+		return nil, err
+	}
+	total := RunnerResults{
+		aborter:  r.Options().Stop,
+		RetCodes: make(UDPResultMap),
+	}
+	total.Destination = o.Destination
+	states := make([]floodState, numThreads)
+	for i := 0; i < numThreads; i++ {
+		f := &states[i]
+		*f = floodState{RetCodes: make(UDPResultMap), dest: tAddr, connID: i, req: o.Payload}
+		f.received.base = 1 // the sequence numbers start at 1
+		if len(f.req) == 0 {
+			f.req = tcprunner.GeneratePayload(i, 0)
+			f.prefix = f.req[:12] // see UDPClient.sequence
+		}
+		f.conn, err = net.Dial(tAddr.Network(), tAddr.String())
+		if err != nil {
+			for j := 0; j < i; j++ {
+				_ = states[j].conn.Close()
+			}
+			return nil, fmt.Errorf("unable to connect %d to %s: %w", i, o.Destination, err)
+		}
+		fnet.SetSocketBuffers(f.conn, 256*fnet.KILOBYTE, 256*fnet.KILOBYTE)
+		f.wg.Add(1)
+		go f.read(len(f.req) + 1)
+		r.Options().Runners[i] = f
+	}
+	total.RunnerResults = r.Run()
+	reqTimeout := o.ReqTimeout
+	if reqTimeout <= 0 {
+		reqTimeout = UDPTimeOutDefaultValue
+	}
+	// Give the last replies the request timeout to arrive:
+	deadline := time.Now().Add(reqTimeout)
+	for i := range states {
+		_ = states[i].conn.SetReadDeadline(deadline)
+	}
+	var replies int64
+	periodic.MergeThreads(r, numThreads, total.RetCodes, func(i int) map[string]int64 {
+		f := &states[i]
+		f.wg.Wait()
+		_ = f.conn.Close()
+		total.SocketCount++
+		total.BytesSent += f.bytesSent
+		total.BytesReceived += f.bytesReceived
+		total.Messages += f.sent
+		total.Lost += f.sent - f.received.count
+		total.OutOfOrder += f.outOfOrder
+		total.Duplicates += f.duplicates
+		replies += f.replies
+		return f.RetCodes
+	})
+	_, _ = fmt.Fprintf(out, "Sockets used: %d (for perfect no error run, would be %d)\n", total.SocketCount, numThreads)
+	_, _ = fmt.Fprintf(out, "Total Bytes sent: %d, received: %d\n", total.BytesSent, total.BytesReceived)
+	if len(states) > 0 && len(states[0].prefix) > 0 {
+		if total.Messages > 0 {
+			total.LossRate = float64(total.Lost) / float64(total.Messages)
+		}
+		_, _ = fmt.Fprintf(out, "Flood of %d datagrams, lost: %d (%.2f %%), out of order: %d, duplicates: %d\n",
+			total.Messages, total.Lost, 100.*total.LossRate, total.OutOfOrder, total.Duplicates)
+	} else {
+		total.Lost = 0 // can't tell without the sequence numbers
+		_, _ = fmt.Fprintf(out, "Flood of %d datagrams, %d replies\n", total.Messages, replies)
+	}
+	periodic.PrintRetCodes(out, "udp", total.RetCodes, total.DurationHistogram.Count)
+	return &total, nil
+}
+
+// normalizeFlood checks the flood confirmation and caps the rate, rejecting the
+// options which would bypass the cap by changing the rate during the run.
+func (o *RunnerOptions) normalizeFlood() error {
+	if !o.FloodConfirmed {
+		return fmt.Errorf("udp flood of %s requires FloodConfirmed", o.Destination)
+	}
+	switch {
+	case len(o.Schedule) > 0:
+		return fmt.Errorf("udp flood doesn't support a qps schedule nor load shape")
+	case o.BurstSize > 0:
+		return fmt.Errorf("udp flood doesn't support bursts")
+	case len(o.Arrivals) > 0:
+		return fmt.Errorf("udp flood doesn't support replayed arrivals")
+	case o.QPSControl != nil:
+		return fmt.Errorf("udp flood doesn't support changing the qps during the run")
+	case o.HasWarmup():
+		return fmt.Errorf("udp flood doesn't support a warmup phase")
+	}
+	maxPPS := o.FloodMaxPPS
+	if maxPPS <= 0 {
+		maxPPS = DefaultFloodMaxPPS
+	}
+	if o.QPS <= 0 || o.QPS > maxPPS {
+		log.Warnf("Capping the udp flood to %g packets per second (instead of %g)", maxPPS, o.QPS)
+		o.QPS = maxPPS
+	}
+	if o.ConcurrencyOnly {
+		log.Warnf("Ignoring concurrency only mode for the udp flood")
+		o.ConcurrencyOnly = false
+	}
+	o.RunType = "UDP flood"
+	return nil
+}
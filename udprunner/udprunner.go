@@ -20,12 +20,13 @@ import (
 	"io"
 	"net"
 	"os"
-	"sort"
+	"strconv"
 	"time"
 
 	"fortio.org/fortio/fnet"
 	"fortio.org/fortio/log"
 	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/stats"
 	"fortio.org/fortio/tcprunner"
 )
 
@@ -44,15 +45,35 @@ type RunnerResults struct {
 	SocketCount   int
 	BytesSent     int64
 	BytesReceived int64
-	client        *UDPClient
-	aborter       *periodic.Aborter
+	// Histogram of the bytes received by each call.
+	Sizes   *stats.HistogramData
+	sizes   *stats.Histogram
+	client  *UDPClient
+	aborter *periodic.Aborter
+	// Sequence accounting, only with the default generated payloads (which include a sequence number):
+	// Messages sent, replies never received (lost), received after their timeout while waiting for
+	// a later one (out of order) and received more than once (duplicates).
+	Messages   int64
+	Lost       int64
+	OutOfOrder int64
+	Duplicates int64
+	LossRate   float64 // Lost / Messages
+	// Latency of each message when pipelining (Pipeline > 1), nil otherwise.
+	MessageLatency *stats.HistogramData
+}
+
+// ErrorRate returns the fraction of the calls which weren't OK (see periodic.HasErrorRate).
+func (udpstate *RunnerResults) ErrorRate() float64 {
+	return periodic.ErrorRate(udpstate.RetCodes, UDPStatusOK)
 }
 
 // Run tests udp request fetching. Main call being run at the target QPS.
 // To be set as the Function in RunnerOptions.
 func (udpstate *RunnerResults) Run(t int) {
 	log.Debugf("Calling in %d", t)
+	received := udpstate.client.bytesReceived
 	_, err := udpstate.client.Fetch()
+	udpstate.sizes.Record(float64(udpstate.client.bytesReceived - received))
 	if err != nil {
 		udpstate.RetCodes[err.Error()]++
 	} else {
@@ -60,11 +81,22 @@ func (udpstate *RunnerResults) Run(t int) {
 	}
 }
 
+// Warmup makes a warmup call, not counted in the results (see periodic.Warmer).
+func (udpstate *RunnerResults) Warmup(t int) {
+	messageTime := udpstate.client.messageTime
+	udpstate.client.messageTime = nil
+	_, err := udpstate.client.Fetch()
+	udpstate.client.messageTime = messageTime
+	log.Debugf("Warmup call in %d: %v", t, err)
+}
+
 // UDPOptions are options to the UDPClient.
 type UDPOptions struct {
 	Destination string
 	Payload     []byte // what to send (and check)
 	ReqTimeout  time.Duration
+	// Number of messages sent at once for each call, all their replies being waited for (default 0 is 1).
+	Pipeline int
 }
 
 // RunnerOptions includes the base RunnerOptions plus udp specific
@@ -72,6 +104,7 @@ type UDPOptions struct {
 type RunnerOptions struct {
 	periodic.RunnerOptions
 	UDPOptions // Need to call Init() to initialize
+	FloodOptions
 }
 
 // UDPClient is the client used for udp echo testing.
@@ -88,6 +121,15 @@ type UDPClient struct {
 	destination   string
 	doGenerate    bool
 	reqTimeout    time.Duration
+	// sequence accounting (doGenerate mode)
+	pending    map[int64]bool // timed out messages whose reply may still arrive
+	outOfOrder int64
+	duplicates int64
+	// pipelining
+	pipeline    int
+	batchStart  int64            // sequence of the first message of the current call
+	received    []bool           // replies received for the current call's messages
+	messageTime *stats.Histogram // per message latency
 }
 
 var (
@@ -115,8 +157,13 @@ func NewUDPClient(o *UDPOptions) (*UDPClient, error) {
 	if len(c.req) == 0 { // len(nil) array is also valid and 0
 		c.doGenerate = true
 		c.req = tcprunner.GeneratePayload(0, 0)
+		c.pending = make(map[int64]bool)
 	}
 	c.buffer = make([]byte, len(c.req))
+	c.pipeline = o.Pipeline
+	if c.pipeline > 1 {
+		c.received = make([]bool, c.pipeline)
+	}
 	c.reqTimeout = o.ReqTimeout
 	if o.ReqTimeout == 0 {
 		log.Debugf("Request timeout not set, using default %v", UDPTimeOutDefaultValue)
@@ -144,6 +191,7 @@ func (c *UDPClient) Fetch() ([]byte, error) {
 	// Connect or reuse existing socket:
 	conn := c.socket
 	c.messageCount++
+	c.batchStart = c.messageCount
 	reuse := (conn != nil)
 	if !reuse {
 		var err error
@@ -161,6 +209,7 @@ func (c *UDPClient) Fetch() ([]byte, error) {
 		// TODO write directly in buffer to avoid generating garbage for GC to clean
 		c.req = tcprunner.GeneratePayload(c.connID, c.messageCount)
 	}
+	start := time.Now()
 	n, err := conn.Write(c.req)
 	c.bytesSent = c.bytesSent + int64(n)
 	if log.LogDebug() {
@@ -180,13 +229,27 @@ func (c *UDPClient) Fetch() ([]byte, error) {
 		log.Errf("Short write to %v %v : %d instead of %d", conn, c.dest, n, len(c.req))
 		return nil, io.ErrShortWrite
 	}
+	if c.pipeline > 1 {
+		return c.fetchPipelined(conn, start)
+	}
 	// assert that len(c.buffer) == len(c.req)
-	n, err = conn.Read(c.buffer)
-	c.bytesReceived = c.bytesReceived + int64(n)
-	if log.LogDebug() {
-		log.Debugf("read %d (%q): %v", n, string(c.buffer[:n]), err)
+	for {
+		n, err = conn.Read(c.buffer)
+		c.bytesReceived = c.bytesReceived + int64(n)
+		if log.LogDebug() {
+			log.Debugf("read %d (%q): %v", n, string(c.buffer[:n]), err)
+		}
+		if err != nil || !c.staleReply(c.buffer[:n]) {
+			break
+		}
+		// else keep waiting for the reply to this message, until the deadline.
 	}
 	if os.IsTimeout(err) {
+		if c.doGenerate {
+			// Keep the socket so a late reply is accounted for instead of lost.
+			c.pending[c.messageCount] = true
+			c.socket = conn
+		}
 		return c.buffer[:n], errTimeout
 	}
 	if n < len(c.req) {
@@ -204,6 +267,115 @@ func (c *UDPClient) Fetch() ([]byte, error) {
 	return c.buffer[:n], nil
 }
 
+// fetchPipelined sends the rest of the Pipeline messages, the first one
+// having been sent at start, and waits for all the replies (in any order)
+// recording their latency.
+func (c *UDPClient) fetchPipelined(conn net.Conn, start time.Time) ([]byte, error) {
+	for i := 1; i < c.pipeline; i++ {
+		c.messageCount++
+		if c.doGenerate {
+			c.req = tcprunner.GeneratePayload(c.connID, c.messageCount)
+		}
+		n, err := conn.Write(c.req)
+		c.bytesSent = c.bytesSent + int64(n)
+		if err != nil {
+			log.Errf("Unable to write to %v %v : %v", conn, c.dest, err)
+			return nil, err
+		}
+	}
+	for i := range c.received {
+		c.received[i] = false
+	}
+	var n int
+	var err error
+	for count := 0; count < c.pipeline; {
+		n, err = conn.Read(c.buffer)
+		c.bytesReceived = c.bytesReceived + int64(n)
+		if log.LogDebug() {
+			log.Debugf("read %d (%q): %v", n, string(c.buffer[:n]), err)
+		}
+		if err != nil {
+			break
+		}
+		if c.staleReply(c.buffer[:n]) {
+			continue
+		}
+		if n != len(c.req) {
+			return c.buffer[:n], errShortRead
+		}
+		idx := count // not generated: all the messages are identical
+		if c.doGenerate {
+			seq, ok := c.sequence(c.buffer[:n])
+			if !ok || seq > c.messageCount {
+				log.Infof("Unexpected reply %q while waiting for %d to %d", string(c.buffer[:n]), c.batchStart, c.messageCount)
+				return c.buffer[:n], errMismatch
+			}
+			idx = int(seq - c.batchStart)
+			if c.received[idx] {
+				c.duplicates++
+				continue
+			}
+		} else if !bytes.Equal(c.buffer[:n], c.req) {
+			log.Infof("Mismatch between sent %q and received %q", string(c.req), string(c.buffer[:n]))
+			return c.buffer[:n], errMismatch
+		}
+		c.received[idx] = true
+		count++
+		if c.messageTime != nil {
+			c.messageTime.Record(time.Since(start).Seconds())
+		}
+	}
+	if os.IsTimeout(err) {
+		if c.doGenerate {
+			// Keep the socket so late replies are accounted for instead of lost.
+			for i, got := range c.received {
+				if !got {
+					c.pending[c.batchStart+int64(i)] = true
+				}
+			}
+			c.socket = conn
+		}
+		return c.buffer[:n], errTimeout
+	}
+	if err != nil {
+		return c.buffer[:n], err
+	}
+	c.socket = conn // reuse on success
+	return c.buffer[:n], nil
+}
+
+// sequence returns the sequence number of a generated payload received
+// for this client, false if it isn't one.
+func (c *UDPClient) sequence(b []byte) (int64, bool) {
+	const seqOffset = 12 // see tcprunner.GeneratePayload
+	if len(b) != len(c.req) || len(b) <= seqOffset || !bytes.Equal(b[:seqOffset], c.req[:seqOffset]) {
+		return 0, false
+	}
+	seq, err := strconv.ParseInt(string(b[seqOffset:]), 10, 64)
+	return seq, err == nil
+}
+
+// staleReply accounts for, and returns true for, replies to previous
+// messages: late (out of order) or duplicate ones.
+func (c *UDPClient) staleReply(b []byte) bool {
+	if !c.doGenerate {
+		return false
+	}
+	seq, ok := c.sequence(b)
+	if !ok || seq >= c.batchStart {
+		return false
+	}
+	if c.pending[seq] {
+		delete(c.pending, seq)
+		c.outOfOrder++
+		log.Debugf("Late reply for message %d while waiting for %d", seq, c.messageCount)
+	} else {
+		c.duplicates++
+		log.Debugf("Duplicate reply for message %d while waiting for %d", seq, c.messageCount)
+	}
+	return true
+}
+
 // Close closes the last connection and returns the total number of sockets used for the run.
 func (c *UDPClient) Close() int {
 	log.Debugf("Closing %p: %s socket count %d", c, c.destination, c.socketCount)
@@ -220,60 +392,84 @@ func (c *UDPClient) Close() int {
 // Some refactoring to avoid copy-pasta between the now 3 runners would be good.
 func RunUDPTest(o *RunnerOptions) (*RunnerResults, error) {
 	o.RunType = "UDP"
+	if o.Flood {
+		if err := o.normalizeFlood(); err != nil {
+			return nil, err
+		}
+	}
 	log.Infof("Starting udp test for %s with %d threads at %.1f qps", o.Destination, o.NumThreads, o.QPS)
 	r := periodic.NewPeriodicRunner(&o.RunnerOptions)
 	defer r.Options().Abort()
 	numThreads := r.Options().NumThreads
 	o.UDPOptions.Destination = o.Destination
+	if o.Flood {
+		return runFlood(o, r)
+	}
 	out := r.Options().Out // Important as the default value is set from nil to stdout inside NewPeriodicRunner
 	total := RunnerResults{
 		aborter:  r.Options().Stop,
 		RetCodes: make(UDPResultMap),
 	}
 	total.Destination = o.Destination
+	messageTime := r.Options().NewLatencyHistogram()
+	total.sizes = stats.NewHistogram(0, 1)
 	udpstate := make([]RunnerResults, numThreads)
-	var err error
-	for i := 0; i < numThreads; i++ {
-		r.Options().Runners[i] = &udpstate[i]
+	err := periodic.SetupThreads(r, func(i int, firstCall bool) (periodic.Runnable, error) {
 		// Create a client (and transport) and connect once for each 'thread'
-		udpstate[i].client, err = NewUDPClient(&o.UDPOptions)
-		if udpstate[i].client == nil {
+		client, err := NewUDPClient(&o.UDPOptions)
+		if client == nil {
 			return nil, fmt.Errorf("unable to create client %d for %s: %w", i, o.Destination, err)
 		}
-		udpstate[i].client.connID = i
-		if o.Exactly <= 0 {
-			data, err := udpstate[i].client.Fetch()
+		client.connID = i
+		if firstCall {
+			data, err := client.Fetch()
 			if i == 0 && log.LogVerbose() {
 				log.LogVf("first hit of %s: err %v, received %d: %q", o.Destination, err, len(data), data)
 			}
 		}
+		client.messageTime = messageTime.Clone() // after the warmup call
 		// Setup the stats for each 'thread'
+		udpstate[i].client = client
 		udpstate[i].aborter = total.aborter
 		udpstate[i].RetCodes = make(UDPResultMap)
+		udpstate[i].sizes = total.sizes.Clone()
+		return &udpstate[i], nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	total.RunnerResults = r.Run()
-	// Numthreads may have reduced but it should be ok to accumulate 0s from
-	// unused ones. We also must cleanup all the created clients.
-	keys := []string{}
-	for i := 0; i < numThreads; i++ {
+	periodic.MergeThreads(r, numThreads, total.RetCodes, func(i int) map[string]int64 {
 		total.SocketCount += udpstate[i].client.Close()
 		total.BytesReceived += udpstate[i].client.bytesReceived
 		total.BytesSent += udpstate[i].client.bytesSent
-		for k := range udpstate[i].RetCodes {
-			if _, exists := total.RetCodes[k]; !exists {
-				keys = append(keys, k)
-			}
-			total.RetCodes[k] += udpstate[i].RetCodes[k]
-		}
-	}
-	// Cleanup state:
-	r.Options().ReleaseRunners()
-	totalCount := float64(total.DurationHistogram.Count)
+		total.Messages += udpstate[i].client.messageCount
+		total.Lost += int64(len(udpstate[i].client.pending))
+		total.OutOfOrder += udpstate[i].client.outOfOrder
+		total.Duplicates += udpstate[i].client.duplicates
+		messageTime.Transfer(udpstate[i].client.messageTime)
+		total.sizes.Transfer(udpstate[i].sizes)
+		return udpstate[i].RetCodes
+	})
 	_, _ = fmt.Fprintf(out, "Sockets used: %d (for perfect no error run, would be %d)\n", total.SocketCount, r.Options().NumThreads)
 	_, _ = fmt.Fprintf(out, "Total Bytes sent: %d, received: %d\n", total.BytesSent, total.BytesReceived)
-	sort.Strings(keys)
-	for _, k := range keys {
-		_, _ = fmt.Fprintf(out, "udp %s : %d (%.1f %%)\n", k, total.RetCodes[k], 100.*float64(total.RetCodes[k])/totalCount)
+	if total.Messages > 0 {
+		total.LossRate = float64(total.Lost) / float64(total.Messages)
+	}
+	if udpstate[0].client.doGenerate {
+		_, _ = fmt.Fprintf(out, "Messages: %d, lost: %d (%.2f %%), out of order: %d, duplicates: %d\n",
+			total.Messages, total.Lost, 100.*total.LossRate, total.OutOfOrder, total.Duplicates)
+	}
+	if o.Pipeline > 1 && messageTime.Count > 0 {
+		total.MessageLatency = messageTime.Export().CalcPercentiles(r.Options().Percentiles)
+		total.MessageLatency.Print(out, fmt.Sprintf("Per message latency (pipeline of %d)", o.Pipeline))
+	}
+	total.Sizes = total.sizes.Export().CalcPercentiles(r.Options().Percentiles)
+	if log.LogVerbose() {
+		total.Sizes.Print(out, "Response Sizes Histogram")
+	} else if log.Log(log.Warning) {
+		total.sizes.Counter.Print(out, "Response Sizes")
 	}
+	periodic.PrintRetCodes(out, "udp", total.RetCodes, total.DurationHistogram.Count)
 	return &total, nil
 }
@@ -19,9 +19,12 @@ import (
 	"fmt"
 	"net"
 	"runtime"
+	"strconv"
 	"testing"
+	"time"
 
 	"fortio.org/fortio/fnet"
+	"fortio.org/fortio/periodic"
 )
 
 func TestUDPRunnerBadDestination(t *testing.T) {
@@ -56,6 +59,10 @@ func TestUDPRunner(t *testing.T) {
 	if res.SocketCount != res.RunnerResults.NumThreads {
 		t.Errorf("%d socket used, expected same as thread# %d", res.SocketCount, res.RunnerResults.NumThreads)
 	}
+	// Each call receives the echo of the default 24 bytes payload:
+	if res.Sizes == nil || res.Sizes.Count != totalReq || res.Sizes.Min != 24 || res.Sizes.Max != 24 {
+		t.Errorf("Unexpected response sizes %+v", res.Sizes)
+	}
 }
 
 func TestUDPNotLeaking(t *testing.T) {
@@ -95,3 +102,168 @@ func TestUDPNotLeaking(t *testing.T) {
 		t.Errorf("%d socket used, expected same as thread# %d", res.SocketCount, res.RunnerResults.NumThreads)
 	}
 }
+
+// lossyServer echoes udp packets except every 5th one which is dropped, the 3rd
+// one which is echoed late and the 7th one which is echoed twice.
+func lossyServer(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			data := append([]byte{}, buf[:n]...)
+			seq, _ := strconv.Atoi(string(data[12:]))
+			switch {
+			case seq%5 == 0:
+				continue
+			case seq == 3:
+				time.AfterFunc(80*time.Millisecond, func() { _, _ = conn.WriteTo(data, addr) })
+				continue
+			case seq == 7:
+				_, _ = conn.WriteTo(data, addr)
+			}
+			_, _ = conn.WriteTo(data, addr)
+		}
+	}()
+	return conn
+}
+
+func TestUDPRunnerLoss(t *testing.T) {
+	conn := lossyServer(t)
+	defer conn.Close()
+	opts := RunnerOptions{}
+	opts.QPS = -1
+	opts.Exactly = 20
+	opts.NumThreads = 1
+	opts.ReqTimeout = 50 * time.Millisecond
+	opts.Destination = fmt.Sprintf("udp://localhost:%d/", conn.LocalAddr().(*net.UDPAddr).Port)
+	res, err := RunUDPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Messages != 20 || res.Lost != 4 || res.OutOfOrder != 1 || res.Duplicates != 1 {
+		t.Errorf("Unexpected messages %d lost %d out of order %d duplicates %d",
+			res.Messages, res.Lost, res.OutOfOrder, res.Duplicates)
+	}
+	if res.LossRate != 0.2 {
+		t.Errorf("Unexpected loss rate %g", res.LossRate)
+	}
+	if res.RetCodes[UDPStatusOK] != 15 || res.RetCodes["timeout"] != 5 {
+		t.Errorf("Unexpected codes %v", res.RetCodes)
+	}
+	if res.SocketCount != 1 {
+		t.Errorf("Expected the socket to be kept across timeouts, got %d", res.SocketCount)
+	}
+}
+
+func TestUDPRunnerPipeline(t *testing.T) {
+	addr := fnet.UDPEchoServer("test-echo-pipeline", ":0", false)
+	opts := RunnerOptions{}
+	opts.QPS = -1
+	opts.Exactly = 10
+	opts.NumThreads = 1
+	opts.Pipeline = 5
+	opts.Destination = fmt.Sprintf("udp://localhost:%d/", addr.(*net.UDPAddr).Port)
+	res, err := RunUDPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[UDPStatusOK] != 10 || res.Messages != 50 || res.Lost != 0 {
+		t.Errorf("Unexpected codes %v, messages %d, lost %d", res.RetCodes, res.Messages, res.Lost)
+	}
+	if res.MessageLatency == nil || res.MessageLatency.Count != 50 {
+		t.Errorf("Expected 50 messages latencies, got %+v", res.MessageLatency)
+	}
+}
+
+func TestUDPFlood(t *testing.T) {
+	addr := fnet.UDPEchoServerWithReply("test-echo-flood", ":0", false, fnet.UDPReply{Count: 2})
+	opts := RunnerOptions{}
+	opts.QPS = -1
+	opts.NumThreads = 2
+	opts.Duration = 300 * time.Millisecond
+	opts.Destination = fmt.Sprintf("udp://localhost:%d/", addr.(*net.UDPAddr).Port)
+	opts.Flood = true
+	opts.FloodMaxPPS = 1000
+	if _, err := RunUDPTest(&opts); err == nil {
+		t.Fatalf("Expected error for unconfirmed flood")
+	}
+	opts.FloodConfirmed = true
+	opts.BurstSize = 100000
+	if _, err := RunUDPTest(&opts); err == nil {
+		t.Fatalf("Expected error for flood bursts beyond the pps cap")
+	}
+	opts.BurstSize = 0
+	opts.Schedule = periodic.QPSSchedule{{From: 100000, To: 100000, Duration: time.Second}}
+	if _, err := RunUDPTest(&opts); err == nil {
+		t.Fatalf("Expected error for a flood schedule beyond the pps cap")
+	}
+	opts.Schedule = nil
+	opts.WarmupCalls = 10
+	if _, err := RunUDPTest(&opts); err == nil {
+		t.Fatalf("Expected error for a flood warmup")
+	}
+	opts.WarmupCalls = 0
+	res, err := RunUDPTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RunType != "UDP flood" || res.RequestedQPS != "1000" || res.ActualQPS > 1100 {
+		t.Errorf("Unexpected flood run %s %s qps, actual %g", res.RunType, res.RequestedQPS, res.ActualQPS)
+	}
+	if res.Messages == 0 || res.Messages != res.RetCodes[UDPStatusOK] || res.SocketCount != 2 {
+		t.Errorf("Unexpected flood %d messages %v, %d sockets", res.Messages, res.RetCodes, res.SocketCount)
+	}
+	// Loopback shouldn't drop much, and each reply is doubled by the server:
+	if res.Lost > res.Messages/10 || res.Duplicates != res.Messages-res.Lost || res.LossRate != float64(res.Lost)/float64(res.Messages) {
+		t.Errorf("Unexpected flood accounting %d messages: lost %d (%g) duplicates %d out of order %d",
+			res.Messages, res.Lost, res.LossRate, res.Duplicates, res.OutOfOrder)
+	}
+	if res.BytesSent != 24*res.Messages || res.BytesReceived != 2*24*(res.Messages-res.Lost) {
+		t.Errorf("Unexpected flood bytes sent %d received %d", res.BytesSent, res.BytesReceived)
+	}
+}
+
+func TestSeqWindow(t *testing.T) {
+	w := seqWindow{base: 1}
+	steps := []struct {
+		seq      int64
+		added    bool
+		base     int64
+		received int64
+	}{
+		{1, true, 2, 1},
+		{3, true, 2, 2},
+		{3, false, 2, 2}, // duplicate within the window
+		{2, true, 4, 3},  // fills the gap, base moves past 3
+		{1, false, 4, 3}, // duplicate below the window
+		{0, false, 4, 3},
+		{5 + floodWindow, true, 6, 4}, // 4 and 5 given up on
+		{4, false, 6, 4},              // too late
+		{10 * floodWindow, true, 9*floodWindow + 1, 5}, // whole window given up on
+		{9*floodWindow + 1, true, 9*floodWindow + 2, 6},
+	}
+	for i, s := range steps {
+		if added := w.add(s.seq); added != s.added || w.base != s.base || w.count != s.received {
+			t.Errorf("%d: add(%d) = %t, base %d, count %d; expected %t %d %d", i, s.seq, added, w.base, w.count,
+				s.added, s.base, s.received)
+		}
+	}
+	// Long run with some loss and reordering, in constant memory:
+	w = seqWindow{base: 1}
+	for seq := int64(1); seq <= 10*floodWindow; seq += 2 {
+		w.add(seq + 1)
+		if seq%1000 != 1 {
+			w.add(seq)
+		}
+	}
+	if expected := int64(10*floodWindow - 10*floodWindow/1000 - 1); w.count != expected {
+		t.Errorf("got %d received, expected %d", w.count, expected)
+	}
+}
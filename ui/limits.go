@@ -0,0 +1,178 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ui // import "fortio.org/fortio/ui"
+
+// Per run safety caps of the UI and REST triggered runs, so a shared fortio
+// server can't be used to load arbitrary (internet) hosts.
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"fortio.org/fortio/dflag"
+	"fortio.org/fortio/fhttp"
+	"fortio.org/fortio/periodic"
+)
+
+var (
+	maxRunQPS = dflag.DynFloat64(flag.CommandLine, "max-run-qps", 0,
+		"Maximum qps of each UI/REST triggered run in server mode (max speed runs are refused when set), "+
+			"0 for no limit. dynamic flag.")
+	maxRunDuration = dflag.DynDuration(flag.CommandLine, "max-run-duration", 0,
+		"Maximum duration of each UI/REST triggered run in server mode (runs until stopped are refused when set), "+
+			"0 for no limit. dynamic flag.")
+	maxRunConnections = dflag.DynInt64(flag.CommandLine, "max-run-connections", 0,
+		"Maximum number of threads (connections) of each UI/REST triggered run in server mode, 0 for no limit. "+
+			"dynamic flag.")
+	allowedTargetCIDRs = dflag.DynStringSlice(flag.CommandLine, "allowed-target-cidrs", []string{},
+		"Comma separated list of CIDRs (e.g. 10.0.0.0/8,127.0.0.1/32) the UI/REST triggered runs' targets must "+
+			"resolve to in server mode, empty for any. dynamic flag.").WithValidator(validateCIDRs)
+)
+
+func validateCIDRs(cidrs []string) error {
+	_, err := parseCIDRs(cidrs)
+	return err
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	res := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+// checkRunLimits returns an error when the (already normalized) run, of
+// pipeline messages per call (tcp and udp runs, 1 otherwise), exceeds the per
+// run limits or when one of the targets (the run's resolve address and url,
+// and its proxy or otlp endpoint url when set) doesn't resolve to an allowed
+// cidr.
+func checkRunLimits(ro *periodic.RunnerOptions, pipeline int, resolve string, targets ...string) error {
+	if pipeline < 1 {
+		pipeline = 1
+	}
+	if max := maxRunQPS.Get(); max > 0 && (ro.QPS <= 0 || ro.QPS*float64(pipeline) > max) {
+		qps := "max qps"
+		if ro.QPS > 0 {
+			qps = fmt.Sprintf("%g qps", ro.QPS)
+		}
+		if pipeline > 1 {
+			qps += fmt.Sprintf(" times a pipeline of %d messages", pipeline)
+		}
+		return fmt.Errorf("%s requested, over the maximum of %g (-max-run-qps)", qps, max)
+	}
+	if max := maxRunDuration.Get(); max > 0 {
+		d, err := runDuration(ro)
+		if err != nil {
+			return fmt.Errorf("%v, with a maximum run duration of %v (-max-run-duration)", err, max)
+		}
+		if d > max {
+			return fmt.Errorf("%v run requested, over the maximum of %v (-max-run-duration)", d, max)
+		}
+	}
+	if max := maxRunConnections.Get(); max > 0 && int64(ro.NumThreads) > max {
+		return fmt.Errorf("%d threads requested, over the maximum of %d (-max-run-connections)", ro.NumThreads, max)
+	}
+	allowed, err := parseCIDRs(allowedTargetCIDRs.Get())
+	if err != nil || len(allowed) == 0 {
+		return err
+	}
+	if resolve != "" {
+		addr, err := fhttp.ResolveAddr(resolve)
+		if err != nil {
+			return err
+		}
+		if err = checkTarget(addr, allowed); err != nil {
+			return err
+		}
+	}
+	for _, t := range targets {
+		if t == "" {
+			continue
+		}
+		if err := checkTarget(targetHost(t), allowed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runDuration returns the expected duration of the run.
+func runDuration(ro *periodic.RunnerOptions) (time.Duration, error) {
+	switch {
+	case ro.Exactly > 0 && ro.QPS > 0:
+		return ro.WarmupDuration + time.Duration(float64(ro.Exactly)/ro.QPS*float64(time.Second)), nil
+	case ro.Exactly > 0:
+		return 0, fmt.Errorf("unbounded duration of %d calls at max qps", ro.Exactly)
+	case ro.Duration < 0:
+		return 0, fmt.Errorf("run until stopped requested")
+	}
+	return ro.WarmupDuration + ro.Duration, nil
+}
+
+// targetHost returns the host part of a target: an url, host:port (e.g. for
+// grpc), ip or host name.
+func targetHost(target string) string {
+	if strings.Contains(target, "://") {
+		if u, err := url.Parse(target); err == nil {
+			return u.Hostname()
+		}
+	}
+	target = strings.SplitN(target, "/", 2)[0]
+	if host, _, err := net.SplitHostPort(target); err == nil {
+		return host
+	}
+	return strings.Trim(target, "[]")
+}
+
+// checkTarget returns an error unless all the ips the host resolves to are
+// within the allowed networks.
+func checkTarget(host string, allowed []*net.IPNet) error {
+	if host == "" {
+		return fmt.Errorf("no target host to check against the allowed cidrs (-allowed-target-cidrs)")
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = net.LookupIP(host); err != nil {
+			return fmt.Errorf("unable to resolve target %q to check it against the allowed cidrs: %w", host, err)
+		}
+	}
+	for _, ip := range ips {
+		found := false
+		for _, n := range allowed {
+			if n.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("target %q (%v) isn't within the allowed cidrs (-allowed-target-cidrs)", host, ip)
+		}
+	}
+	return nil
+}
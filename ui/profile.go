@@ -0,0 +1,233 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ui // import "fortio.org/fortio/ui"
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"fortio.org/fortio/fhttp"
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/periodic"
+)
+
+const (
+	// ProfileSuffix is the file name suffix of the profile bundles in the data dir.
+	ProfileSuffix = "_profile.zip"
+	// DefaultProfileDuration is the default duration of the cpu profile of a bundle.
+	DefaultProfileDuration = 30 * time.Second
+	// MaxProfileDuration is the maximum duration of the cpu profile of a bundle.
+	MaxProfileDuration = 5 * time.Minute
+	// MaxProfileBundles is the number of profile bundles kept in the data dir,
+	// the older ones being removed after each capture.
+	MaxProfileBundles = 10
+	// Mutex contention sampling rate (1 in n events) while capturing, when not already enabled.
+	profileMutexFraction = 5
+)
+
+// ErrProfileInProgress is returned when a capture is requested while another
+// one is in progress (there can be only one cpu profile anyway).
+var ErrProfileInProgress = errors.New("a profile capture is already in progress")
+
+// profiling is 1 while a capture is in progress.
+var profiling int32
+
+// ProfileReply is the REST reply to a profile bundle capture.
+type ProfileReply struct {
+	Bundle   string // file name in the data dir
+	Duration string // of the cpu profile
+}
+
+// CaptureProfiles captures a bundle of profiles: cpu for the given duration (at
+// most MaxProfileDuration), then heap, goroutines and mutex contention, as a zip
+// of pprof files in dir, keeping only the MaxProfileBundles newest bundles there.
+// Returns the bundle file name, or ErrProfileInProgress during another capture.
+func CaptureProfiles(dir string, duration time.Duration) (string, error) {
+	if !atomic.CompareAndSwapInt32(&profiling, 0, 1) {
+		return "", ErrProfileInProgress
+	}
+	defer atomic.StoreInt32(&profiling, 0)
+	return captureProfiles(dir, duration)
+}
+
+// captureProfiles is CaptureProfiles once profiling is set.
+func captureProfiles(dir string, duration time.Duration) (string, error) {
+	if dir == "" {
+		return "", fmt.Errorf("no data dir to save the profiles to")
+	}
+	if duration <= 0 {
+		duration = DefaultProfileDuration
+	}
+	if duration > MaxProfileDuration {
+		duration = MaxProfileDuration
+	}
+	now := time.Now()
+	name := fmt.Sprintf("%d-%02d-%02d-%02d%02d%02d%s", now.Year(), now.Month(), now.Day(),
+		now.Hour(), now.Minute(), now.Second(), ProfileSuffix)
+	f, err := ioutil.TempFile(dir, ".profile-*")
+	if err != nil {
+		return "", err
+	}
+	tmpName := f.Name()
+	err = writeProfiles(f, duration)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, path.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return "", err
+	}
+	log.Infof("Saved profiles bundle %s in %s", name, dir)
+	rotateProfiles(dir)
+	return name, nil
+}
+
+// rotateProfiles removes the profile bundles of dir beyond the MaxProfileBundles
+// newest (their names being their date).
+func rotateProfiles(dir string) {
+	files, err := ioutil.ReadDir(dir) // sorted by name
+	if err != nil {
+		log.Errf("Unable to list %s: %v", dir, err)
+		return
+	}
+	var bundles []string
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ProfileSuffix) && !f.IsDir() {
+			bundles = append(bundles, f.Name())
+		}
+	}
+	for i := 0; i < len(bundles)-MaxProfileBundles; i++ {
+		if err = os.Remove(path.Join(dir, bundles[i])); err != nil {
+			log.Errf("Unable to remove old profiles bundle %s: %v", bundles[i], err)
+			continue
+		}
+		log.Infof("Removed old profiles bundle %s", bundles[i])
+	}
+}
+
+func writeProfiles(f *os.File, duration time.Duration) error {
+	prevFraction := runtime.SetMutexProfileFraction(-1)
+	if prevFraction == 0 {
+		runtime.SetMutexProfileFraction(profileMutexFraction)
+		defer runtime.SetMutexProfileFraction(0)
+	}
+	z := zip.NewWriter(f)
+	now := time.Now()
+	create := func(name string) (io.Writer, error) {
+		return z.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: now})
+	}
+	w, err := create("cpu.pprof")
+	if err != nil {
+		return err
+	}
+	if err = pprof.StartCPUProfile(w); err != nil {
+		return err
+	}
+	log.Infof("Capturing %v cpu profile", duration)
+	time.Sleep(duration)
+	pprof.StopCPUProfile()
+	runtime.GC() // up to date heap statistics
+	for _, p := range []string{"heap", "goroutine", "mutex"} {
+		if w, err = create(p + ".pprof"); err != nil {
+			return err
+		}
+		if err = pprof.Lookup(p).WriteTo(w, 0); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
+
+// ProfileList returns the profile bundles in data dir, newest first.
+func ProfileList() []string {
+	return suffixList(ProfileSuffix)
+}
+
+// BundleList returns the run bundles (see periodic.WriteBundle) in data dir, newest first.
+func BundleList() []string {
+	return suffixList(periodic.BundleSuffix)
+}
+
+// suffixList returns the files of data dir with the suffix, newest first.
+func suffixList(suffix string) (list []string) {
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		log.Critf("Can list directory %s: %v", dataDir, err)
+		return
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		name := files[i].Name()
+		if strings.HasSuffix(name, suffix) && !files[i].IsDir() {
+			list = append(list, name)
+		}
+	}
+	return list
+}
+
+// RESTProfileHandler is the api to capture a profile bundle (see CaptureProfiles)
+// in the data dir. The cpu profile lasts the seconds parameter (30 by default,
+// at most MaxProfileDuration) and the reply is sent once done unless async is on.
+// Requests during another capture are refused with a 409.
+func RESTProfileHandler(w http.ResponseWriter, r *http.Request) {
+	fhttp.LogRequest(r, "REST Profile Api call")
+	duration := DefaultProfileDuration
+	if s := r.FormValue("seconds"); s != "" {
+		d, err := time.ParseDuration(s + "s")
+		if err != nil || d <= 0 || d > MaxProfileDuration {
+			Error(w, ErrorReply{fmt.Sprintf("invalid seconds %s, should be positive and at most %v", s, MaxProfileDuration), err})
+			return
+		}
+		duration = d
+	}
+	if !atomic.CompareAndSwapInt32(&profiling, 0, 1) {
+		errorWithStatus(w, http.StatusConflict, ErrorReply{ErrProfileInProgress.Error(), ErrProfileInProgress})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.FormValue("async") == "on" {
+		go func() {
+			defer atomic.StoreInt32(&profiling, 0)
+			if _, err := captureProfiles(dataDir, duration); err != nil {
+				log.Errf("Unable to capture profiles: %v", err)
+			}
+		}()
+		_, _ = w.Write([]byte(fmt.Sprintf("{\"started\": %q}", duration.String())))
+		return
+	}
+	name, err := captureProfiles(dataDir, duration)
+	atomic.StoreInt32(&profiling, 0)
+	if err != nil {
+		log.Errf("Unable to capture profiles: %v", err)
+		Error(w, ErrorReply{"Unable to capture profiles", err})
+		return
+	}
+	b, _ := json.Marshal(ProfileReply{Bundle: name, Duration: duration.String()})
+	_, _ = w.Write(b)
+}
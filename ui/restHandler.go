@@ -13,11 +13,16 @@ import (
 
 	"fortio.org/fortio/fgrpc"
 	"fortio.org/fortio/fhttp"
+	"fortio.org/fortio/icmprunner"
 	"fortio.org/fortio/log"
+	"fortio.org/fortio/mqttrunner"
 	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/redisrunner"
+	"fortio.org/fortio/smtprunner"
 	"fortio.org/fortio/stats"
 	"fortio.org/fortio/tcprunner"
 	"fortio.org/fortio/udprunner"
+	"fortio.org/fortio/wsrunner"
 )
 
 // ErrorReply is returned on errors.
@@ -28,11 +33,16 @@ type ErrorReply struct {
 
 // Error writes serialized ErrorReply to the writer.
 func Error(w http.ResponseWriter, msg ErrorReply) {
+	errorWithStatus(w, http.StatusBadRequest, msg)
+}
+
+// errorWithStatus writes serialized ErrorReply to the writer with the given http status.
+func errorWithStatus(w http.ResponseWriter, status int, msg ErrorReply) {
 	if w == nil {
 		// async mode, nothing to do
 		return
 	}
-	w.WriteHeader(http.StatusBadRequest)
+	w.WriteHeader(status)
 	b, _ := json.Marshal(msg)
 	_, _ = w.Write(b)
 }
@@ -125,7 +135,7 @@ func RESTRunHandler(w http.ResponseWriter, r *http.Request) { // nolint: funlen
 	if runner == "" {
 		runner = "http"
 	}
-	log.Infof("Starting API run %s load request from %v for %s", runner, r.RemoteAddr, url)
+	log.Infof("Starting API run %s load request from %v for %s", runner, r.RemoteAddr, periodic.Redact(url))
 	async := (FormValue(r, jd, "async") == "on")
 	payload := FormValue(r, jd, "payload")
 	labels := FormValue(r, jd, "labels")
@@ -170,13 +180,78 @@ func RESTRunHandler(w http.ResponseWriter, r *http.Request) { // nolint: funlen
 		Exactly:     n,
 		Jitter:      jitter,
 	}
+	ro.ExactPercentiles, _ = strconv.Atoi(FormValue(r, jd, "exact-percentiles"))
+	if ro.ExactPercentiles < 0 || ro.ExactPercentiles > stats.MaxExactValues {
+		Error(w, ErrorReply{fmt.Sprintf("exact-percentiles should be between 0 and %d", stats.MaxExactValues), nil})
+		return
+	}
+	histogramType, err := stats.ParseHistogramType(FormValue(r, jd, "histogram-type"))
+	if err != nil {
+		Error(w, ErrorReply{"Invalid histogram-type", err})
+		return
+	}
+	ro.HistogramType = histogramType
+	ro.ThinkCalls, _ = strconv.Atoi(FormValue(r, jd, "burst"))
+	ro.Dwell, _ = time.ParseDuration(FormValue(r, jd, "dwell"))
+	ro.BurstSize, _ = strconv.Atoi(FormValue(r, jd, "burst-size"))
+	ro.BurstInterval, _ = time.ParseDuration(FormValue(r, jd, "burst-interval"))
+	ro.WarmupDuration, _ = time.ParseDuration(FormValue(r, jd, "warmup-duration"))
+	ro.WarmupCalls, _ = strconv.ParseInt(FormValue(r, jd, "warmup-calls"), 10, 64)
+	ro.ScheduledLatency = (FormValue(r, jd, "scheduled-latency") == "on")
+	ro.TimeseriesInterval, _ = time.ParseDuration(FormValue(r, jd, "timeseries"))
+	ro.ConcurrencyOnly = (FormValue(r, jd, "concurrency-only") == "on")
+	ro.Arrival = FormValue(r, jd, "arrival")
+	if ro.Arrival != "" && ro.Arrival != periodic.ArrivalUniform && ro.Arrival != periodic.ArrivalPoisson {
+		Error(w, ErrorReply{"arrival should be uniform or poisson, not " + ro.Arrival, nil})
+		return
+	}
+	if schedule := FormValue(r, jd, "qps-schedule"); schedule != "" {
+		ro.Schedule, err = periodic.ParseQPSSchedule(schedule)
+		if err != nil {
+			Error(w, ErrorReply{"qps-schedule parsing error: " + err.Error(), err})
+			return
+		}
+	}
+	if shape := FormValue(r, jd, "load-shape"); shape != "" {
+		ro.Schedule, err = periodic.ParseLoadShape(shape, ro.Duration)
+		if err != nil {
+			Error(w, ErrorReply{"load-shape parsing error: " + err.Error(), err})
+			return
+		}
+	}
+	if ro.ThreadWeights, err = periodic.ParseThreadWeights(FormValue(r, jd, "thread-weights")); err != nil {
+		Error(w, ErrorReply{"thread-weights parsing error: " + err.Error(), err})
+		return
+	}
+	// Validated before taking a run slot (and starting the Normalize() watcher).
+	var methodMix []fhttp.MixedMethod
+	if mix := FormValue(r, jd, "method-mix"); mix != "" {
+		if methodMix, err = fhttp.ParseMethodMix(mix, false); err != nil {
+			Error(w, ErrorReply{"Invalid method-mix", err})
+			return
+		}
+	}
+	if strings.HasPrefix(url, tcprunner.TCPBulkURLPrefix) {
+		ro.QPS = -1 // RunTCPTest streams as fast as possible, check the limits for that.
+	}
 	ro.Normalize()
-	uiRunMapMutex.Lock()
-	id++ // start at 1 as 0 means interrupt all
-	runid := id
-	runs[runid] = &ro
-	uiRunMapMutex.Unlock()
-	ro.RunID = runid
+	pipeline := 1 // messages per call
+	if strings.HasPrefix(url, tcprunner.TCPURLPrefix) || strings.HasPrefix(url, udprunner.UDPURLPrefix) {
+		pipeline, _ = strconv.Atoi(FormValue(r, jd, "pipeline"))
+	}
+	if err = checkRunLimits(&ro, pipeline, resolve, url, FormValue(r, jd, "proxy"), FormValue(r, jd, "otlp-endpoint")); err != nil {
+		ro.Abort() // cleanup the Normalize() watcher
+		log.Warnf("Refusing run from %v: %v", r.RemoteAddr, err)
+		errorWithStatus(w, http.StatusForbidden, ErrorReply{"Run over the server limits: " + err.Error(), err})
+		return
+	}
+	runid, err := startRun(&ro, pipeline, runner, url, r)
+	if err != nil {
+		ro.Abort() // cleanup the Normalize() watcher
+		log.Warnf("Refusing run from %v: %v", r.RemoteAddr, err)
+		errorWithStatus(w, http.StatusServiceUnavailable, ErrorReply{"Too many concurrent runs: " + err.Error(), err})
+		return
+	}
 	log.Infof("New run id %d", runid)
 	httpopts := &fhttp.HTTPOptions{}
 	httpopts.HTTPReqTimeOut = timeout // to be normalized in init 0 replaced by default value
@@ -185,6 +260,49 @@ func RESTRunHandler(w http.ResponseWriter, r *http.Request) { // nolint: funlen
 	httpopts.DisableFastClient = stdClient
 	httpopts.Insecure = httpsInsecure
 	httpopts.Resolve = resolve
+	httpopts.SNI = FormValue(r, jd, "sni")
+	httpopts.Proxy = FormValue(r, jd, "proxy")
+	httpopts.TLSResumption = (FormValue(r, jd, "tls-resumption") == "on")
+	httpopts.DisableTLSSessionTickets = (FormValue(r, jd, "disable-tls-session-tickets") == "on")
+	httpopts.TraceHeaders = FormValue(r, jd, "trace-headers")
+	httpopts.TracePerConnection = (FormValue(r, jd, "trace-per-connection") == "on")
+	httpopts.DiscardBody = (FormValue(r, jd, "discard-body") == "on")
+	httpopts.ReadLimit, _ = strconv.Atoi(FormValue(r, jd, "read-limit"))
+	httpopts.AffinityHeader = FormValue(r, jd, "affinity-header")
+	httpopts.AffinityKeys, _ = strconv.Atoi(FormValue(r, jd, "affinity-keys"))
+	httpopts.SendDeadline = (FormValue(r, jd, "send-deadline") == "on")
+	httpopts.ServerTiming = (FormValue(r, jd, "server-timing") == "on")
+	httpopts.LatencyBreakdown = (FormValue(r, jd, "latency-breakdown") == "on")
+	httpopts.LongPoll, _ = time.ParseDuration(FormValue(r, jd, "long-poll"))
+	httpopts.AcceptEncoding = FormValue(r, jd, "accept-encoding")
+	httpopts.Decompress = (FormValue(r, jd, "decompress") == "on")
+	httpopts.H2C = (FormValue(r, jd, "h2c") == "on")
+	httpopts.ConnMaxLifetime, _ = time.ParseDuration(FormValue(r, jd, "conn-max-lifetime"))
+	httpopts.ConnMaxRequests, _ = strconv.Atoi(FormValue(r, jd, "conn-max-requests"))
+	if reuse := FormValue(r, jd, "connection-reuse-range"); reuse != "" {
+		if reuseRange, rerr := fhttp.ParseConnReuseRange(reuse); rerr != nil {
+			log.Errf("Ignoring %v", rerr)
+		} else {
+			httpopts.ConnReuseRange = reuseRange
+		}
+	}
+	if rate := FormValue(r, jd, "connect-rate"); rate != "" {
+		if connectRate, rerr := fhttp.ParseConnectRate(rate); rerr != nil {
+			log.Errf("Ignoring %v", rerr)
+		} else {
+			httpopts.ConnectRate = connectRate
+		}
+	}
+	httpopts.MethodMix = methodMix
+	httpopts.CaptureHeader = FormValue(r, jd, "capture-header")
+	if sets := FormValue(r, jd, "header-sets"); sets != "" {
+		httpopts.HeaderSets, err = fhttp.ParseHeaderSets(sets)
+	} else if uas := FormValue(r, jd, "user-agents"); uas != "" {
+		httpopts.HeaderSets, err = fhttp.ParseUserAgents(uas)
+	}
+	if err != nil {
+		log.Errf("Ignoring invalid header sets: %v", err)
+	}
 	if len(payload) > 0 {
 		httpopts.Payload = []byte(payload)
 	}
@@ -228,9 +346,15 @@ func Run(w http.ResponseWriter, r *http.Request, jd map[string]interface{},
 		if grpcSecure {
 			o.Destination = fhttp.AddHTTPS(url)
 		}
+		o.StreamMessages, _ = strconv.Atoi(FormValue(r, jd, "grpc-stream-msgs"))
+		// Only the server reflection, no server side protoset file, from the api.
+		o.Method = FormValue(r, jd, "grpc-method")
+		if o.Method != "" {
+			o.Payload = httpopts.PayloadString()
+		}
 		// TODO: ReqTimeout: timeout
 		res, err = fgrpc.RunGRPCTest(&o)
-	} else if strings.HasPrefix(url, tcprunner.TCPURLPrefix) {
+	} else if strings.HasPrefix(url, tcprunner.TCPURLPrefix) || strings.HasPrefix(url, tcprunner.TCPBulkURLPrefix) {
 		// TODO: copy pasta from fortio_main
 		o := tcprunner.RunnerOptions{
 			RunnerOptions: ro,
@@ -238,7 +362,65 @@ func Run(w http.ResponseWriter, r *http.Request, jd map[string]interface{},
 		o.ReqTimeout = httpopts.HTTPReqTimeOut
 		o.Destination = url
 		o.Payload = httpopts.Payload
+		o.Framing = FormValue(r, jd, "tcp-framing")
+		o.Pipeline, _ = strconv.Atoi(FormValue(r, jd, "pipeline"))
+		o.BulkChunkSize, _ = strconv.Atoi(FormValue(r, jd, "tcp-bulk-chunk"))
 		res, err = tcprunner.RunTCPTest(&o)
+	} else if strings.HasPrefix(url, wsrunner.WSURLPrefix) || strings.HasPrefix(url, wsrunner.WSSURLPrefix) {
+		// TODO: copy pasta from fortio_main
+		o := wsrunner.RunnerOptions{
+			RunnerOptions: ro,
+		}
+		o.ReqTimeout = httpopts.HTTPReqTimeOut
+		o.Destination = url
+		o.Payload = httpopts.Payload
+		o.Insecure = httpopts.Insecure
+		o.Ping = (FormValue(r, jd, "ws-ping") == "on")
+		o.MessagesPerConnection, _ = strconv.Atoi(FormValue(r, jd, "ws-messages"))
+		res, err = wsrunner.RunWSTest(&o)
+	} else if strings.HasPrefix(url, redisrunner.RedisURLPrefix) {
+		// TODO: copy pasta from fortio_main
+		o := redisrunner.RunnerOptions{
+			RunnerOptions: ro,
+		}
+		o.ReqTimeout = httpopts.HTTPReqTimeOut
+		o.Destination = url
+		o.Commands = strings.Split(FormValue(r, jd, "redis-cmd"), ",")
+		o.KeyPattern = FormValue(r, jd, "redis-key")
+		o.Keys, _ = strconv.Atoi(FormValue(r, jd, "redis-keys"))
+		o.ValueSize, _ = strconv.Atoi(FormValue(r, jd, "redis-value-size"))
+		res, err = redisrunner.RunRedisTest(&o)
+	} else if strings.HasPrefix(url, mqttrunner.MQTTURLPrefix) {
+		// TODO: copy pasta from fortio_main
+		o := mqttrunner.RunnerOptions{
+			RunnerOptions: ro,
+		}
+		o.ReqTimeout = httpopts.HTTPReqTimeOut
+		o.Destination = url
+		o.Payload = httpopts.Payload
+		o.QoS, _ = strconv.Atoi(FormValue(r, jd, "mqtt-qos"))
+		o.Subscribe = (FormValue(r, jd, "mqtt-subscribe") == "on")
+		res, err = mqttrunner.RunMQTTTest(&o)
+	} else if strings.HasPrefix(url, icmprunner.ICMPURLPrefix) {
+		// TODO: copy pasta from fortio_main
+		o := icmprunner.RunnerOptions{
+			RunnerOptions: ro,
+		}
+		o.ReqTimeout = httpopts.HTTPReqTimeOut
+		o.Destination = url
+		o.Payload = httpopts.Payload
+		res, err = icmprunner.RunICMPTest(&o)
+	} else if strings.HasPrefix(url, smtprunner.SMTPURLPrefix) || strings.HasPrefix(url, smtprunner.SMTPSURLPrefix) {
+		// TODO: copy pasta from fortio_main
+		o := smtprunner.RunnerOptions{
+			RunnerOptions: ro,
+		}
+		o.ReqTimeout = httpopts.HTTPReqTimeOut
+		o.Destination = url
+		o.Insecure = httpopts.Insecure
+		o.Helo = FormValue(r, jd, "smtp-helo")
+		o.StartTLS = (FormValue(r, jd, "smtp-starttls") == "on")
+		res, err = smtprunner.RunSMTPTest(&o)
 	} else if strings.HasPrefix(url, udprunner.UDPURLPrefix) {
 		// TODO: copy pasta from fortio_main
 		o := udprunner.RunnerOptions{
@@ -247,18 +429,33 @@ func Run(w http.ResponseWriter, r *http.Request, jd map[string]interface{},
 		o.ReqTimeout = httpopts.HTTPReqTimeOut
 		o.Destination = url
 		o.Payload = httpopts.Payload
+		o.Pipeline, _ = strconv.Atoi(FormValue(r, jd, "pipeline"))
 		res, err = udprunner.RunUDPTest(&o)
 	} else {
 		o := fhttp.HTTPRunnerOptions{
 			HTTPOptions:        *httpopts,
 			RunnerOptions:      ro,
 			AllowInitialErrors: true,
+			OTLPEndpoint:       FormValue(r, jd, "otlp-endpoint"),
+		}
+		o.OTLPSampleRate, _ = strconv.ParseFloat(FormValue(r, jd, "otlp-sample"), 64)
+		o.Retry.Retries, _ = strconv.Atoi(FormValue(r, jd, "retries"))
+		o.Retry.Backoff, _ = time.ParseDuration(FormValue(r, jd, "retry-backoff"))
+		o.CertReloadInterval, _ = time.ParseDuration(FormValue(r, jd, "cert-reload"))
+		o.CacheStats = (FormValue(r, jd, "cache-stats") == "on")
+		o.ReconnectBackoff, _ = time.ParseDuration(FormValue(r, jd, "reconnect-backoff"))
+		o.PreCheck.Requests, _ = strconv.Atoi(FormValue(r, jd, "pre-check"))
+		o.PreCheck.ExpectedStatus, _ = strconv.Atoi(FormValue(r, jd, "pre-check-status"))
+		o.PreCheck.MaxLatency, _ = time.ParseDuration(FormValue(r, jd, "pre-check-max-latency"))
+		if o.Retry.RetryOn, err = fhttp.ParseRetryOn(FormValue(r, jd, "retry-on")); err != nil {
+			log.Errf("Ignoring invalid retry-on: %v", err)
+		}
+		if o.SizeClasses, err = fhttp.ParseSizeClasses(FormValue(r, jd, "size-classes")); err != nil {
+			log.Errf("Ignoring invalid size-classes: %v", err)
 		}
 		res, err = fhttp.RunHTTPTest(&o)
 	}
-	uiRunMapMutex.Lock()
-	delete(runs, ro.RunID)
-	uiRunMapMutex.Unlock()
+	endRun(ro.RunID)
 	if err != nil {
 		log.Errf("Init error for %s mode with url %s and options %+v : %v", runner, url, ro, err)
 		Error(w, ErrorReply{"Aborting because of error", err})
@@ -284,13 +481,6 @@ func Run(w http.ResponseWriter, r *http.Request, jd map[string]interface{},
 	}
 }
 
-// RESTStatusHandler will print the state of the runs.
-func RESTStatusHandler(w http.ResponseWriter, r *http.Request) {
-	fhttp.LogRequest(r, "REST Status Api call")
-	w.WriteHeader(http.StatusServiceUnavailable)
-	w.Write([]byte("{\"error\":\"status not yet implemented\"}"))
-}
-
 // RESTStopHandler is the api to stop a given run by runid or all the runs if unspecified/0.
 func RESTStopHandler(w http.ResponseWriter, r *http.Request) {
 	fhttp.LogRequest(r, "REST Stop Api call")
@@ -305,7 +495,7 @@ func StopByRunID(runid int64) int {
 	if runid <= 0 { // Stop all
 		i := 0
 		for k, v := range runs {
-			v.Abort()
+			v.ro.Abort()
 			delete(runs, k)
 			i++
 		}
@@ -318,7 +508,7 @@ func StopByRunID(runid int64) int {
 	if found {
 		delete(runs, runid)
 		uiRunMapMutex.Unlock()
-		v.Abort()
+		v.ro.Abort()
 		log.Infof("Interrupted run id %d", runid)
 		return 1
 	}
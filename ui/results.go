@@ -0,0 +1,122 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ui // import "fortio.org/fortio/ui"
+
+// Loading of the saved results json files, upgrading the ones written with an
+// older periodic.SchemaVersion so the report servers can keep showing
+// historical results as the schema evolves.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/stats"
+)
+
+// upgrades[v] upgrades a result of schema version v to version v+1, so
+// len(upgrades) must be periodic.SchemaVersion.
+var upgrades = []func(res map[string]interface{}){
+	upgradeFromV0,
+}
+
+// upgradeFromV0 adds what the browse page expects but files from older
+// versions lack: the fields added over time and the percentiles of runs
+// saved without -p (computed back from the histogram buckets).
+func upgradeFromV0(res map[string]interface{}) {
+	if _, isCapacity := res["MaxSustainableQPS"]; isCapacity {
+		return
+	}
+	for k, v := range map[string]interface{}{"Labels": "", "RunID": 0, "Jitter": false, "Exactly": 0} {
+		if _, found := res[k]; !found {
+			res[k] = v
+		}
+	}
+	for _, k := range []string{"DurationHistogram", "ScheduledHistogram"} {
+		if h, ok := res[k].(map[string]interface{}); ok && h["Percentiles"] == nil {
+			res[k] = withPercentiles(h)
+		}
+	}
+}
+
+// withPercentiles returns the histogram with the default percentiles computed
+// from its data (or unchanged if it isn't a valid histogram).
+func withPercentiles(h map[string]interface{}) interface{} {
+	data, _ := json.Marshal(h)
+	var hd stats.HistogramData
+	if err := json.Unmarshal(data, &hd); err != nil || len(hd.Data) == 0 {
+		return h
+	}
+	percList := defaultPercentileList
+	if percList == nil {
+		percList = periodic.DefaultRunnerOptions.Percentiles
+	}
+	return hd.CalcPercentiles(percList)
+}
+
+// UpgradeResults returns the json results data upgraded to the current
+// periodic.SchemaVersion, and whether it was from an older version.
+func UpgradeResults(data []byte) ([]byte, bool, error) {
+	var res map[string]interface{}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, false, err
+	}
+	version := 0
+	if v, ok := res["SchemaVersion"].(float64); ok {
+		version = int(v)
+	}
+	if version >= len(upgrades) {
+		return data, false, nil
+	}
+	if version < 0 {
+		return nil, false, fmt.Errorf("invalid schema version %d", version)
+	}
+	for ; version < len(upgrades); version++ {
+		upgrades[version](res)
+	}
+	res["SchemaVersion"] = version
+	data, err := json.MarshalIndent(res, "", "  ")
+	return data, true, err
+}
+
+// serveUpgradedResults sends the json results file name (relative to the data
+// dir) upgraded to the current schema. Returns false, for the caller to serve
+// the file as is, when it doesn't need (or can't get) an upgrade.
+func serveUpgradedResults(w http.ResponseWriter, name string) bool {
+	f, err := http.Dir(dataDir).Open(name)
+	if err != nil {
+		return false
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return false
+	}
+	data, upgraded, err := UpgradeResults(data)
+	if err != nil {
+		log.Warnf("Unable to upgrade results %s: %v", name, err)
+		return false
+	}
+	if !upgraded {
+		return false
+	}
+	log.LogVf("Upgraded results %s to schema version %d", name, periodic.SchemaVersion)
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+	return true
+}
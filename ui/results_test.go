@@ -0,0 +1,107 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ui
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"fortio.org/fortio/periodic"
+)
+
+func TestUpgradeResults(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/results_v0.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upgraded, ok, err := UpgradeResults(data)
+	if err != nil || !ok {
+		t.Fatalf("expected an upgrade of the v0 results, got %v %v", ok, err)
+	}
+	var res periodic.RunnerResults
+	if err = json.Unmarshal(upgraded, &res); err != nil {
+		t.Fatalf("unable to read back the upgraded results: %v", err)
+	}
+	if res.SchemaVersion != periodic.SchemaVersion || res.RunType != "HTTP" || res.Labels != "" || res.RunID != 0 {
+		t.Errorf("unexpected upgraded results %+v", res)
+	}
+	// The added fields are there, not just zero values:
+	var fields map[string]interface{}
+	_ = json.Unmarshal(upgraded, &fields)
+	for _, k := range []string{"Labels", "RunID", "Jitter", "Exactly"} {
+		if _, found := fields[k]; !found {
+			t.Errorf("missing %s in the upgraded results", k)
+		}
+	}
+	// The percentiles are computed back from the histogram:
+	h := res.DurationHistogram
+	if h == nil || h.Count != 4 || len(h.Percentiles) != 1 || h.Percentiles[0].Percentile != 90 ||
+		h.Percentiles[0].Value < 0.003 || h.Percentiles[0].Value > 0.004 {
+		t.Errorf("unexpected upgraded histogram %+v", h)
+	}
+	// Already current: unchanged.
+	again, ok, err := UpgradeResults(upgraded)
+	if err != nil || ok || string(again) != string(upgraded) {
+		t.Errorf("current results shouldn't be upgraded: %v %v", ok, err)
+	}
+	// Capacity results only get their version.
+	upgraded, ok, err = UpgradeResults([]byte(`{"MaxSustainableQPS": 100}`))
+	if err != nil || !ok {
+		t.Fatalf("expected an upgrade of the v0 capacity results, got %v %v", ok, err)
+	}
+	fields = nil
+	_ = json.Unmarshal(upgraded, &fields)
+	if len(fields) != 2 || fields["SchemaVersion"] != float64(periodic.SchemaVersion) {
+		t.Errorf("unexpected upgraded capacity results %v", fields)
+	}
+	if _, _, err = UpgradeResults([]byte(`{"SchemaVersion": -1}`)); err == nil {
+		t.Errorf("expected an error for a negative schema version")
+	}
+	if _, _, err = UpgradeResults([]byte(`not json`)); err == nil {
+		t.Errorf("expected an error for invalid json")
+	}
+}
+
+func TestServeUpgradedResults(t *testing.T) {
+	prev := dataDir
+	dataDir = "testdata"
+	defer func() { dataDir = prev }()
+	w := httptest.NewRecorder()
+	if !serveUpgradedResults(w, "/results_v0.json") {
+		t.Fatalf("expected the v0 results to be served upgraded")
+	}
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected response %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var res periodic.RunnerResults
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("unable to read the served results: %v", err)
+	}
+	if res.SchemaVersion != periodic.SchemaVersion || res.DurationHistogram == nil ||
+		len(res.DurationHistogram.Percentiles) == 0 {
+		t.Errorf("unexpected served results %+v", res)
+	}
+	// Left to the caller when missing (or outside the data dir):
+	for _, name := range []string{"/missing.json", "/../results.go"} {
+		w = httptest.NewRecorder()
+		if serveUpgradedResults(w, name) || w.Body.Len() != 0 {
+			t.Errorf("%s shouldn't be served", name)
+		}
+	}
+}
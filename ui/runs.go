@@ -0,0 +1,187 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ui // import "fortio.org/fortio/ui"
+
+// Tracking of the concurrent UI and REST triggered runs, each with its own
+// RunnerOptions and run id, within the server wide limits.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"fortio.org/fortio/dflag"
+	"fortio.org/fortio/fhttp"
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/periodic"
+)
+
+var (
+	maxConcurrentRuns = dflag.DynInt64(flag.CommandLine, "max-concurrent-runs", 0,
+		"Maximum number of UI/REST triggered runs executing at the same time in server mode, 0 for no limit. dynamic flag.")
+	maxConcurrentThreads = dflag.DynInt64(flag.CommandLine, "max-concurrent-threads", 0,
+		"Maximum total number of threads (connections) of the UI/REST triggered runs executing at the same time "+
+			"in server mode, 0 for no limit. dynamic flag.")
+)
+
+// RunStatus describes a UI or REST triggered run in progress.
+type RunStatus struct {
+	RunID      int64
+	Runner     string
+	URL        string // with its password, if any, redacted
+	Labels     string
+	StartTime  time.Time
+	QPS        float64
+	NumThreads int
+	Duration   string // "until stopped" or the run's duration, empty for a fixed number of calls
+	Exactly    int64
+	RemoteAddr string // who triggered the run
+	ro         *periodic.RunnerOptions
+	pipeline   int // messages per call, for the qps limit of the qps changes
+}
+
+// RunsStatus is the rest/status api reply.
+type RunsStatus struct {
+	Runs                 []*RunStatus
+	MaxConcurrentRuns    int64
+	MaxConcurrentThreads int64
+}
+
+// startRun checks the concurrency limits, and if within them, assigns a new
+// run id to the (already normalized) ro, of pipeline messages per call, and
+// tracks it until endRun.
+func startRun(ro *periodic.RunnerOptions, pipeline int, runner, url string, r *http.Request) (int64, error) {
+	uiRunMapMutex.Lock()
+	defer uiRunMapMutex.Unlock()
+	if max := maxConcurrentRuns.Get(); max > 0 && int64(len(runs)) >= max {
+		return 0, fmt.Errorf("already %d runs in progress, the maximum (-max-concurrent-runs)", len(runs))
+	}
+	if max := maxConcurrentThreads.Get(); max > 0 {
+		threads := int64(0)
+		for _, s := range runs {
+			threads += int64(s.NumThreads)
+		}
+		if threads+int64(ro.NumThreads) > max {
+			return 0, fmt.Errorf("%d threads requested plus the %d of the %d runs in progress would exceed the maximum "+
+				"of %d (-max-concurrent-threads)", ro.NumThreads, threads, len(runs), max)
+		}
+	}
+	id++ // start at 1 as 0 means interrupt all
+	s := RunStatus{
+		RunID:      id,
+		Runner:     runner,
+		URL:        periodic.Redact(url),
+		Labels:     ro.Labels,
+		StartTime:  time.Now(),
+		QPS:        ro.QPS,
+		NumThreads: ro.NumThreads,
+		Exactly:    ro.Exactly,
+		RemoteAddr: r.RemoteAddr,
+		ro:         ro,
+		pipeline:   pipeline,
+	}
+	switch {
+	case ro.Exactly > 0:
+	case ro.Duration < 0:
+		s.Duration = "until stopped"
+	default:
+		s.Duration = ro.Duration.String()
+	}
+	if ro.CanChangeQPS() {
+		// Its target qps can be changed while it's in progress (rest/qps).
+		ro.QPSControl = periodic.NewQPSControl()
+	}
+	runs[id] = &s
+	ro.RunID = id
+	return id, nil
+}
+
+// endRun stops tracking the run (no-op if it was stopped already).
+func endRun(runid int64) {
+	uiRunMapMutex.Lock()
+	delete(runs, runid)
+	uiRunMapMutex.Unlock()
+}
+
+// RESTStatusHandler returns the runs in progress, or only the one of the
+// runid parameter when set.
+func RESTStatusHandler(w http.ResponseWriter, r *http.Request) {
+	fhttp.LogRequest(r, "REST Status Api call")
+	runid, _ := strconv.ParseInt(r.FormValue("runid"), 10, 64)
+	status := RunsStatus{
+		Runs:                 []*RunStatus{},
+		MaxConcurrentRuns:    maxConcurrentRuns.Get(),
+		MaxConcurrentThreads: maxConcurrentThreads.Get(),
+	}
+	uiRunMapMutex.Lock()
+	for k, v := range runs {
+		if runid <= 0 || k == runid {
+			s := *v // copy under lock
+			status.Runs = append(status.Runs, &s)
+		}
+	}
+	uiRunMapMutex.Unlock()
+	sort.Slice(status.Runs, func(i, j int) bool { return status.Runs[i].RunID < status.Runs[j].RunID })
+	w.Header().Set("Content-Type", "application/json")
+	if runid > 0 && len(status.Runs) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	b, _ := json.MarshalIndent(status, "", "  ")
+	_, _ = w.Write(b)
+}
+
+// RESTQPSHandler is the api to change the target qps of the run in progress of
+// the runid parameter to the qps parameter, e.g. to explore the latency vs
+// throughput curve interactively. Returns the updated run status.
+func RESTQPSHandler(w http.ResponseWriter, r *http.Request) {
+	fhttp.LogRequest(r, "REST QPS Api call")
+	runid, _ := strconv.ParseInt(r.FormValue("runid"), 10, 64)
+	qps, err := strconv.ParseFloat(r.FormValue("qps"), 64)
+	if err != nil {
+		Error(w, ErrorReply{"Invalid qps", err})
+		return
+	}
+	uiRunMapMutex.Lock()
+	defer uiRunMapMutex.Unlock()
+	s, found := runs[runid]
+	if !found {
+		errorWithStatus(w, http.StatusNotFound, ErrorReply{fmt.Sprintf("Run id %d not found", runid), nil})
+		return
+	}
+	// The runner may also have changed the qps afterwards (e.g. max qps for tcp-bulk), ignoring the control:
+	if s.ro.QPSControl == nil || !s.ro.QPSControl.Active() {
+		Error(w, ErrorReply{fmt.Sprintf("Run id %d qps can't be changed, not a uniformly paced qps run", runid), nil})
+		return
+	}
+	check := *s.ro
+	check.QPS = qps
+	if err = checkRunLimits(&check, s.pipeline, ""); err != nil {
+		log.Warnf("Refusing qps change of run %d from %v: %v", runid, r.RemoteAddr, err)
+		errorWithStatus(w, http.StatusForbidden, ErrorReply{"Qps over the server limits: " + err.Error(), err})
+		return
+	}
+	if err = s.ro.QPSControl.SetQPS(qps); err != nil {
+		Error(w, ErrorReply{"Invalid qps", err})
+		return
+	}
+	s.QPS = qps
+	w.Header().Set("Content-Type", "application/json")
+	b, _ := json.MarshalIndent(s, "", "  ")
+	_, _ = w.Write(b)
+}
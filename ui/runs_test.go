@@ -0,0 +1,53 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ui
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"fortio.org/fortio/periodic"
+)
+
+func TestRESTQPSRunnerOverride(t *testing.T) {
+	ro := periodic.RunnerOptions{QPS: 10, NumThreads: 1, Duration: time.Second}
+	ro.Normalize()
+	id, err := startRun(&ro, 1, "tcp", "tcp://localhost:8078", httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer endRun(id)
+	changeQPS := func(qps float64) (int, float64) {
+		w := httptest.NewRecorder()
+		RESTQPSHandler(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/fortio/rest/qps?runid=%d&qps=%g", id, qps), nil))
+		uiRunMapMutex.Lock()
+		defer uiRunMapMutex.Unlock()
+		return w.Code, runs[id].QPS
+	}
+	if code, qps := changeQPS(20); code != http.StatusOK || qps != 20 {
+		t.Errorf("expected the qps change of the paced run, got %d, qps %g", code, qps)
+	}
+	// The runner's own copy of the options then switches to max qps (like tcp-bulk), its normalization
+	// ignoring the control:
+	runner := ro
+	runner.QPS = -1
+	runner.Normalize()
+	if code, qps := changeQPS(30); code != http.StatusBadRequest || qps != 20 {
+		t.Errorf("expected the qps change to be refused once ignored by the runner, got %d, qps %g", code, qps)
+	}
+}
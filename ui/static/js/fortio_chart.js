@@ -68,6 +68,7 @@ const logYAxe = {
 
 let chart = {}
 let overlayChart = {}
+let tsChart = {}
 let mchart = {}
 
 function myRound (v, digits = 6) {
@@ -96,7 +97,7 @@ function makeTitle (res) {
   }
   if (res.URL) { // http results
     firstLine += res.URL
-  } else { // grpc/tcp results
+  } else if (res.Destination) { // grpc/tcp results
     firstLine += res.Destination
   }
   title.push(firstLine + ' - ' + formatDate(res.StartTime))
@@ -108,6 +109,12 @@ function makeTitle (res) {
     }
   }
   percStr += ', max ' + myRound(1000.0 * res.DurationHistogram.Max, 3) + ' ms'
+  if (res.WindowStart) { // checkpoint (intermediate results of a window of the run)
+    title.push('Checkpoint ' + res.Index + ': ' + res.Count + ' calls in the ' + myRound(res.WindowDuration / 1e9, 1) +
+      's window from ' + formatDate(res.WindowStart) + ' (' + myRound(res.ActualQPS, 1) + ' actual qps)')
+    title.push(percStr)
+    return title
+  }
   let statusOk = res.RetCodes[200]
   if (!statusOk) { // grpc or tcp results
     statusOk = res.RetCodes.SERVING || res.RetCodes.OK
@@ -126,9 +133,46 @@ function makeTitle (res) {
         res.RequestedDuration + ' (actual time ' + myRound(res.ActualDuration / 1e9, 1) + 's), jitter: ' +
   res.Jitter + ', ' + errStr)
   title.push(percStr)
+  if (res.Sizes && res.Sizes.Count > 0) { // http/tcp/udp bytes received per call
+    title.push(makeSizesTitle(res.Sizes))
+  }
+  if (res.LatencyPhases && Object.keys(res.LatencyPhases).length > 0) { // http -latency-breakdown
+    title.push(makePhasesTitle(res.LatencyPhases))
+  }
   return title
 }
 
+// Same order as fhttp.PhaseNames, each with its average and highest percentile.
+const phaseNames = ['DNS', 'Connect', 'TLS', 'TTFB', 'Body']
+
+function makePhasesTitle (phases) {
+  const parts = []
+  for (const name of phaseNames) {
+    const h = phases[name]
+    if (!h) {
+      continue
+    }
+    let str = name + ' avg ' + myRound(1000.0 * h.Avg, 3)
+    if (h.Percentiles && h.Percentiles.length > 0) {
+      const p = h.Percentiles[h.Percentiles.length - 1]
+      str += ' p' + p.Percentile + ' ' + myRound(1000.0 * p.Value, 3)
+    }
+    parts.push(str + ' ms')
+  }
+  return 'Latency phases: ' + parts.join(', ')
+}
+
+function makeSizesTitle (sizes) {
+  let sizeStr = 'Response size: min ' + sizes.Min + ' bytes, average ' + myRound(sizes.Avg, 1) + ' bytes'
+  if (sizes.Percentiles) {
+    for (let i = 0; i < sizes.Percentiles.length; i++) {
+      const p = sizes.Percentiles[i]
+      sizeStr += ', p' + p.Percentile + ' ' + myRound(p.Value, 1)
+    }
+  }
+  return sizeStr + ', max ' + sizes.Max + ' bytes'
+}
+
 function fortioResultToJsChartData (res) {
   const dataP = [{
     x: 0.0,
@@ -190,7 +234,10 @@ function fortioResultToJsChartData (res) {
   return {
     title: makeTitle(res),
     dataP: dataP,
-    dataH: dataH
+    dataH: dataH,
+    timeseries: res.Timeseries,
+    timeseriesInterval: res.TimeseriesInterval,
+    unavailable: res.Unavailable
   }
 }
 
@@ -199,6 +246,141 @@ function showChart (data) {
   // Load configuration (min, max, isLogarithmic, ...) from the update form.
   updateChartOptions(chart)
   toggleVisibility()
+  makeTimeseriesChart(data)
+}
+
+// Latency over time (RunnerResults.Timeseries): avg, p99 and max latency and
+// count and errors of the calls of each interval of the run, and the intervals
+// during which the target was unavailable (RunnerResults.Unavailable) shaded.
+function makeTimeseriesChart (data) {
+  const timeseries = data.timeseries
+  deleteTimeseriesChart()
+  const container = document.getElementById('cc2')
+  if (!container || !timeseries || timeseries.length === 0) {
+    return
+  }
+  container.style.display = 'block'
+  const labels = []
+  const avg = []
+  const p99 = []
+  const max = []
+  const count = []
+  const errors = []
+  const unavailable = []
+  let maxCount = 0
+  for (let i = 0; i < timeseries.length; i++) {
+    maxCount = Math.max(maxCount, timeseries[i].Count)
+  }
+  for (let i = 0; i < timeseries.length; i++) {
+    const point = timeseries[i]
+    labels.push(myRound(point.Start / 1e9, 3))
+    avg.push(myRound(1000.0 * point.Avg, 3))
+    p99.push(myRound(1000.0 * point.P99, 3))
+    max.push(myRound(1000.0 * point.Max, 3))
+    count.push(point.Count)
+    errors.push(point.Errors)
+    let down = false
+    const windows = data.unavailable || []
+    for (let j = 0; j < windows.length; j++) {
+      const w = windows[j]
+      if (w.Start < point.Start + data.timeseriesInterval && w.Start + w.Duration > point.Start) {
+        down = true
+      }
+    }
+    unavailable.push(down ? maxCount : null)
+  }
+  const ctx = document.getElementById('chart2').getContext('2d')
+  tsChart = new Chart(ctx, {
+    type: 'line',
+    data: {
+      labels: labels,
+      datasets: [{
+        label: 'avg',
+        data: avg,
+        yAxisID: 'L',
+        fill: false,
+        backgroundColor: 'rgba(87, 167, 134, .9)',
+        borderColor: 'rgba(87, 167, 134, .9)'
+      }, {
+        label: 'p99',
+        data: p99,
+        yAxisID: 'L',
+        fill: false,
+        backgroundColor: 'rgba(204, 102, 0, .9)',
+        borderColor: 'rgba(204, 102, 0, .9)'
+      }, {
+        label: 'max',
+        data: max,
+        yAxisID: 'L',
+        fill: false,
+        hidden: true,
+        backgroundColor: 'rgba(134, 87, 167, .9)',
+        borderColor: 'rgba(134, 87, 167, .9)'
+      }, {
+        label: 'Calls',
+        data: count,
+        yAxisID: 'C',
+        fill: false,
+        borderDash: [5, 5],
+        backgroundColor: 'rgba(36, 64, 238, .9)',
+        borderColor: 'rgba(36, 64, 238, .9)'
+      }, {
+        label: 'Errors',
+        data: errors,
+        yAxisID: 'C',
+        fill: false,
+        borderDash: [5, 5],
+        backgroundColor: 'rgba(238, 36, 36, .9)',
+        borderColor: 'rgba(238, 36, 36, .9)'
+      }, {
+        label: 'Target unavailable',
+        data: unavailable,
+        yAxisID: 'C',
+        steppedLine: true,
+        pointRadius: 0,
+        borderWidth: 0,
+        backgroundColor: 'rgba(238, 36, 36, .15)'
+      }]
+    },
+    options: {
+      responsive: true,
+      maintainAspectRatio: false,
+      title: {
+        display: true,
+        fontStyle: 'normal',
+        text: 'Latency over time'
+      },
+      scales: {
+        xAxes: [{
+          scaleLabel: {
+            display: true,
+            labelString: 'Time from the start in seconds'
+          }
+        }],
+        yAxes: [{
+          id: 'L',
+          position: 'left',
+          ticks: {
+            beginAtZero: true
+          },
+          scaleLabel: {
+            display: true,
+            labelString: 'Response time in ms'
+          }
+        }, {
+          id: 'C',
+          position: 'right',
+          ticks: {
+            beginAtZero: true
+          },
+          scaleLabel: {
+            display: true,
+            labelString: 'Count'
+          }
+        }]
+      }
+    }
+  })
 }
 
 function toggleVisibility () {
@@ -224,6 +406,7 @@ function makeOverlayChart (dataA, dataB) {
   }
   deleteSingleChart()
   deleteMultiChart()
+  deleteTimeseriesChart()
   const ctx = chartEl.getContext('2d')
   const title = makeOverlayChartTitle(dataA.title, dataB.title)
   overlayChart = new Chart(ctx, {
@@ -519,6 +702,84 @@ function endMultiChart (len) {
   mchart.update()
 }
 
+// Capacity report (fortio capacity): latencies and actual qps of each step.
+function makeCapacityChart (res) {
+  makeMultiChart()
+  let n = 0
+  for (let i = 0; i < res.Steps.length; i++) {
+    const step = res.Steps[i]
+    if (!step.Result) {
+      continue
+    }
+    fortioAddToMultiResult(n, step.Result)
+    mchart.data.labels[n] = step.TargetQPS + ' qps' + (step.Passed ? '' : ' (failed)')
+    n++
+  }
+  let title = 'Capacity of ' + res.URL + ': '
+  if (res.MaxSustainableQPS > 0) {
+    title += 'max sustainable ' + myRound(res.MaxSustainableQPS, 1) + ' qps (knee at the ' + res.KneeTargetQPS + ' qps step)'
+  } else {
+    title += 'no sustainable qps found'
+  }
+  mchart.options.title.text = [title, 'Latency in milliseconds']
+  endMultiChart(n)
+}
+
+// Staged run (fortio load -stages): latencies and actual qps of each stage.
+function makeStagesChart (res) {
+  makeMultiChart()
+  let n = 0
+  for (let i = 0; i < res.Stages.length; i++) {
+    const stage = res.Stages[i]
+    if (!stage.Result) {
+      continue
+    }
+    fortioAddToMultiResult(n, stage.Result)
+    const qps = stage.QPS > 0 ? stage.QPS : 'max'
+    mchart.data.labels[n] = stage.Name + ' (' + qps + ' qps, ' + stage.NumThreads + ' threads)'
+    n++
+  }
+  let title = res.Stages.length + ' stages of ' + res.Labels
+  if (res.Interrupted) {
+    title += ' (interrupted)'
+  }
+  mchart.options.title.text = [title, 'Latency in milliseconds']
+  endMultiChart(n)
+}
+
+// Sweep matrix summary (fortio sweep): latencies and actual qps of each cell.
+function makeSweepChart (res) {
+  makeMultiChart()
+  let n = 0
+  for (let i = 0; i < res.Cells.length; i++) {
+    const cell = res.Cells[i]
+    if (!cell.DurationHistogram) {
+      continue
+    }
+    fortioAddToMultiResult(n, cell)
+    mchart.data.labels[n] = cell.Name
+    n++
+  }
+  let title = 'Sweep of ' + res.Cells.length + ' cells of ' + res.Labels
+  if (res.Interrupted) {
+    title += ' (interrupted)'
+  }
+  mchart.options.title.text = [title, 'Latency in milliseconds']
+  endMultiChart(n)
+}
+
+function deleteTimeseriesChart () {
+  const container = document.getElementById('cc2')
+  if (container) {
+    container.style.display = 'none'
+  }
+  if (Object.keys(tsChart).length === 0) {
+    return
+  }
+  tsChart.destroy()
+  tsChart = {}
+}
+
 function deleteOverlayChart () {
   if (Object.keys(overlayChart).length === 0) {
     return
@@ -553,6 +814,7 @@ function makeMultiChart () {
   }
   deleteSingleChart()
   deleteOverlayChart()
+  deleteTimeseriesChart()
   const ctx = chartEl.getContext('2d')
   mchart = new Chart(ctx, {
     type: 'line',
@@ -0,0 +1,227 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ui
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// entry is the comparable part of a syncEntry.
+type entry struct {
+	name, url string
+	size      int64
+	md5       string // hex
+}
+
+func toEntries(entries []syncEntry) []entry {
+	res := []entry{}
+	for _, e := range entries {
+		res = append(res, entry{e.name, e.url, e.size, hex.EncodeToString(e.md5)})
+	}
+	return res
+}
+
+func TestBucketEntries(t *testing.T) {
+	tests := []struct {
+		name     string
+		baseURL  string
+		listing  string
+		expected []entry
+		next     string
+	}{
+		{
+			"s3", "https://storage.googleapis.com/fortio-data",
+			`<?xml version='1.0' encoding='UTF-8'?><ListBucketResult xmlns="http://doc.s3.amazonaws.com/2006-03-01">
+<NextMarker>fortio.istio.io/b.json</NextMarker>
+<Contents><Key>fortio.istio.io/a.json</Key><Size>123</Size><ETag>"0123456789abcdef0123456789abcdef"</ETag></Contents>
+<Contents><Key>b.json</Key><Size>4</Size><ETag>"0123456789abcdef0123456789abcdef-2"</ETag></Contents>
+</ListBucketResult>`,
+			[]entry{
+				{"a.json", "https://storage.googleapis.com/fortio-data/fortio.istio.io/a.json", 123, "0123456789abcdef0123456789abcdef"},
+				{"b.json", "https://storage.googleapis.com/fortio-data/b.json", 4, ""}, // multipart etag isn't a md5
+			},
+			"fortio.istio.io/b.json",
+		},
+		{
+			"azure", "https://account.blob.core.windows.net/data?restype=container&comp=list&prefix=x/&sig=abc&sv=2020",
+			`<?xml version="1.0" encoding="utf-8"?><EnumerationResults ContainerName="data"><Blobs>
+<Blob><Name>x/a.json</Name><Properties><Content-Length>42</Content-Length>
+<Content-MD5>ASNFZ4mrze8BI0VniavN7w==</Content-MD5></Properties></Blob>
+<Blob><Name>x/c.json</Name><Properties><Content-Length>7</Content-Length></Properties></Blob>
+</Blobs><NextMarker>2!abc</NextMarker></EnumerationResults>`,
+			[]entry{
+				{"a.json", "https://account.blob.core.windows.net/data/x/a.json?sig=abc&sv=2020", 42,
+					"0123456789abcdef0123456789abcdef"},
+				{"c.json", "https://account.blob.core.windows.net/data/x/c.json?sig=abc&sv=2020", 7, ""},
+			},
+			"2!abc",
+		},
+		{"empty", "https://storage.googleapis.com/fortio-data", `<ListBucketResult></ListBucketResult>`, []entry{}, ""},
+	}
+	for _, tst := range tests {
+		bu, err := url.Parse(tst.baseURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, next, err := bucketEntries([]byte(tst.listing), bu)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tst.name, err)
+		}
+		if got := toEntries(entries); !reflect.DeepEqual(got, tst.expected) || next != tst.next {
+			t.Errorf("%s: got %+v next %q, expected %+v next %q", tst.name, got, next, tst.expected, tst.next)
+		}
+	}
+}
+
+func TestDirectoryEntries(t *testing.T) {
+	tests := []struct {
+		name     string
+		baseURL  string
+		listing  string
+		dav      bool
+		expected []entry
+		err      bool
+	}{
+		{
+			"webdav", "http://dav.example.com/results",
+			`<?xml version="1.0" encoding="utf-8"?><D:multistatus xmlns:D="DAV:">
+<D:response><D:href>/results/</D:href><D:propstat><D:prop/></D:propstat></D:response>
+<D:response><D:href>/results/a.json</D:href>
+<D:propstat><D:prop><D:getcontentlength>1234</D:getcontentlength></D:prop></D:propstat></D:response>
+<D:response><D:href>b.json</D:href><D:propstat><D:prop/></D:propstat></D:response>
+<D:response><D:href>/results/notes.txt</D:href></D:response>
+<D:response><D:href>http://other.example.com/results/c.json</D:href></D:response>
+</D:multistatus>`,
+			true,
+			[]entry{
+				{"a.json", "http://dav.example.com/results/a.json", 1234, ""},
+				{"b.json", "http://dav.example.com/results/b.json", -1, ""},
+			},
+			false,
+		},
+		{"bad webdav", "http://dav.example.com/results/", `<multistatus><response>`, true, nil, true},
+		{
+			"html", "https://www.example.com/data/index.html",
+			`<html><body><h1>Index of /data</h1>
+<a href="../">Parent</a> <a href="a.json">a.json</a> <A HREF='sub/b.json'>b.json</A>
+<a class="x" href="/data/a.json">again</a> <a href="c.json?x=1&amp;y=2">c.json</a>
+<a href="https://evil.example.com/d.json">d.json</a> <a href="e.txt">e.txt</a></body></html>`,
+			false,
+			[]entry{
+				{"a.json", "https://www.example.com/data/a.json", -1, ""},
+				{"b.json", "https://www.example.com/data/sub/b.json", -1, ""},
+				{"c.json", "https://www.example.com/data/c.json?x=1&y=2", -1, ""},
+			},
+			false,
+		},
+		{"html no links", "https://www.example.com/data", `<html><body>Nothing here</body></html>`, false, []entry{}, false},
+	}
+	for _, tst := range tests {
+		entries, err := directoryEntries([]byte(tst.listing), tst.baseURL, tst.dav)
+		if (err != nil) != tst.err {
+			t.Errorf("%s: unexpected error %v", tst.name, err)
+			continue
+		}
+		if tst.err {
+			continue
+		}
+		if got := toEntries(entries); !reflect.DeepEqual(got, tst.expected) {
+			t.Errorf("%s: got %+v, expected %+v", tst.name, got, tst.expected)
+		}
+	}
+}
+
+func TestDeleteRemoved(t *testing.T) {
+	prev := dataDir
+	dataDir = t.TempDir()
+	defer func() { dataDir = prev }()
+	const syncURL = "https://www.example.com/data/"
+	write := func(names ...string) {
+		for _, n := range names {
+			if err := ioutil.WriteFile(path.Join(dataDir, n), []byte("{}"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(path.Join(dataDir, name))
+		return err == nil
+	}
+	manifest := func() string {
+		data, _ := ioutil.ReadFile(syncManifest(syncURL))
+		return string(data)
+	}
+	// local.json was there before the first sync and old.json, listed, was already up to date:
+	write("local.json", "old.json", "a.json", "b.json")
+	tests := []struct {
+		name     string
+		entries  []syncEntry
+		manifest string   // after the sync
+		deleted  []string // expected to be gone
+		kept     []string // expected to still be there
+	}{
+		{
+			"first sync", []syncEntry{{name: "a.json", downloaded: true}, {name: "b.json", downloaded: true}, {name: "old.json"}},
+			"a.json\nb.json\n", nil, []string{"local.json", "old.json", "a.json", "b.json"},
+		},
+		{
+			"a removed upstream", []syncEntry{{name: "b.json"}, {name: "old.json"}},
+			"b.json\n", []string{"a.json"}, []string{"local.json", "old.json", "b.json"},
+		},
+		{
+			"all removed upstream", nil,
+			"", []string{"b.json"}, []string{"local.json", "old.json"},
+		},
+	}
+	for _, tst := range tests {
+		w := httptest.NewRecorder()
+		deleteRemoved(w, syncURL, tst.entries)
+		if m := manifest(); m != tst.manifest {
+			t.Errorf("%s: got manifest %q, expected %q", tst.name, m, tst.manifest)
+		}
+		for _, n := range tst.deleted {
+			if exists(n) {
+				t.Errorf("%s: %s should have been deleted", tst.name, n)
+			}
+			if !strings.Contains(w.Body.String(), n+"<td>deleted") {
+				t.Errorf("%s: %s deletion not reported in %q", tst.name, n, w.Body.String())
+			}
+		}
+		for _, n := range tst.kept {
+			if !exists(n) {
+				t.Errorf("%s: %s, never downloaded or still listed, was deleted", tst.name, n)
+			}
+		}
+	}
+	// Only plain json file names of the manifest are deleted:
+	write("c.json")
+	if err := ioutil.WriteFile(syncManifest(syncURL), []byte("../local.json\nlocal.txt\nc.json\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	write("local.txt")
+	deleteRemoved(httptest.NewRecorder(), syncURL, nil)
+	if exists("c.json") || !exists("local.txt") || !exists("local.json") {
+		t.Errorf("unexpected deletions with a manifest with paths: c %v local.txt %v local.json %v",
+			exists("c.json"), exists("local.txt"), exists("local.json"))
+	}
+}
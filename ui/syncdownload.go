@@ -0,0 +1,247 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ui // import "fortio.org/fortio/ui"
+
+// Incremental, parallel, download of the sync listings' json files.
+
+import (
+	"bufio"
+	"bytes"
+
+	// nolint: gosec // md5 is mandated by the listings' checksums, not our choice
+	"crypto/md5"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"fortio.org/fortio/dflag"
+	"fortio.org/fortio/fhttp"
+	"fortio.org/fortio/log"
+)
+
+var (
+	syncConcurrency = dflag.DynInt64(flag.CommandLine, "sync-concurrency", 4,
+		"Maximum number of parallel downloads of the -sync (and UI sync) json files. dynamic flag.").
+		WithValidator(func(n int64) error {
+			if n < 1 {
+				return fmt.Errorf("sync-concurrency must be at least 1, got %d", n)
+			}
+			return nil
+		})
+	syncDelete = dflag.DynBool(flag.CommandLine, "sync-delete", false,
+		"Remove the local json files previously synced from a sync url which are no longer listed by it. "+
+			"dynamic flag.")
+)
+
+// downloadAll downloads the entries' json files, in parallel, skipping the
+// ones already downloaded (same size and checksum when the listing has them).
+func downloadAll(w http.ResponseWriter, o *fhttp.HTTPOptions, entries []syncEntry) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Fatalf("downloadAll expecting a flushable response")
+	}
+	n := len(entries)
+	workers := int(syncConcurrency.Get())
+	if workers > n {
+		workers = n
+	}
+	_, _ = w.Write([]byte(fmt.Sprintf("Now fetching %d referenced objects, %d at a time:<script>setPB(1,%d)</script>\n",
+		n, workers, n+1)))
+	_, _ = w.Write([]byte("<table>"))
+	flusher.Flush()
+	var mutex sync.Mutex // for w and done
+	done := 1
+	work := make(chan *syncEntry)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		// One client per worker as they aren't safe for concurrent use:
+		client, _ := fhttp.NewStdClient(o) // o's url was already validated
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer client.Close()
+			for e := range work {
+				status, code := downloadOne(client, e)
+				mutex.Lock()
+				done++
+				_, _ = w.Write([]byte("<tr><td>"))
+				_, _ = w.Write([]byte(template.HTMLEscapeString(e.key)))
+				_, _ = w.Write([]byte(status))
+				_, _ = w.Write([]byte(fmt.Sprintf("</tr><script>setPB(%d)</script>\n", done)))
+				if code != 0 {
+					w.WriteHeader(code)
+				}
+				flusher.Flush()
+				mutex.Unlock()
+			}
+		}()
+	}
+	for i := range entries {
+		work <- &entries[i]
+	}
+	close(work)
+	wg.Wait()
+}
+
+// downloadOne downloads the entry unless it's not a json file or already up to
+// date. Returns the html status cell(s) and the error code to report, if any.
+func downloadOne(client *fhttp.Client, e *syncEntry) (string, int) {
+	log.Infof("downloadOne(%s,%s)", e.name, e.url)
+	if e.url == "" {
+		return "<td>skipped (not a valid url)", 0
+	}
+	if !strings.HasSuffix(e.name, ".json") {
+		return "<td>skipped (not json)", 0
+	}
+	localPath := path.Join(dataDir, e.name)
+	fi, err := os.Stat(localPath)
+	update := false
+	if err == nil {
+		if e.size < 0 && e.md5 == nil {
+			return "<td>skipped (already exists)", 0
+		}
+		if upToDate(localPath, fi.Size(), e) {
+			return "<td>skipped (up to date)", 0
+		}
+		update = true
+	} else if !os.IsNotExist(err) {
+		// note that if data dir doesn't exist this will trigger too - TODO: check datadir earlier
+		log.Warnf("check %s : %v", localPath, err)
+		// don't return the details of the error to not leak local data dir etc
+		return "<td>❌ skipped (access error)", 0
+	}
+	// url already validated
+	_ = client.ChangeURL(e.url)
+	code1, data1, _ := client.Fetch()
+	if code1 != http.StatusOK {
+		return fmt.Sprintf("<td>❌ Http error, code %d", code1), 424 /*Failed Dependency*/
+	}
+	// nolint: gosec // checksum, not crypto
+	if sum := md5.Sum(data1); e.md5 != nil && !bytes.Equal(sum[:], e.md5) {
+		log.Errf("Checksum mismatch for %s: %x instead of %x", e.url, sum, e.md5)
+		return "<td>❌ skipped (checksum mismatch)", 424 /*Failed Dependency*/
+	}
+	err = ioutil.WriteFile(localPath, data1, 0o644) // nolint: gosec // we do want 644
+	if err != nil {
+		log.Errf("Unable to save %s: %v", localPath, err)
+		return "<td>❌ skipped (write error)", http.StatusInternalServerError
+	}
+	// finally ! success !
+	e.downloaded = true
+	log.Infof("Success fetching %s - saved at %s", e.url, localPath)
+	if update {
+		return "<td class='checkmark'>✓ (updated)", 0
+	}
+	// checkmark
+	return "<td class='checkmark'>✓", 0
+}
+
+// upToDate returns true when the local file has the size and checksum of the
+// entry (the ones the listing has).
+func upToDate(localPath string, size int64, e *syncEntry) bool {
+	if e.size >= 0 && size != e.size {
+		return false
+	}
+	if e.md5 == nil {
+		return true
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		log.Warnf("Open error for %s: %v", localPath, err)
+		return false
+	}
+	defer f.Close()
+	h := md5.New() // nolint: gosec // checksum, not crypto
+	if _, err = io.Copy(h, f); err != nil {
+		log.Warnf("Read error for %s: %v", localPath, err)
+		return false
+	}
+	return bytes.Equal(h.Sum(nil), e.md5)
+}
+
+// syncManifest returns the path of the (hidden) file listing the json files
+// synced from the sync url u, to find the ones removed upstream.
+func syncManifest(u string) string {
+	return path.Join(dataDir, fmt.Sprintf(".sync-%x.txt", sha256.Sum256([]byte(u))))
+}
+
+// deleteRemoved removes the json files downloaded from u by a previous
+// (-sync-delete) sync which are no longer in its (complete) listing entries, and
+// records the ones still synced from u: previously recorded and still listed, or
+// downloaded by this sync. Local files which were never downloaded from u (e.g.
+// already there before the first sync) are thus never deleted.
+func deleteRemoved(w http.ResponseWriter, u string, entries []syncEntry) {
+	listed := map[string]bool{}
+	synced := map[string]bool{}
+	for i := range entries {
+		listed[entries[i].name] = true
+		if entries[i].downloaded {
+			synced[entries[i].name] = true
+		}
+	}
+	manifest := syncManifest(u)
+	if f, err := os.Open(manifest); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			name := scanner.Text()
+			// Only plain json file names (it's our file but still):
+			if !strings.HasSuffix(name, ".json") || strings.ContainsAny(name, "/\\") {
+				continue
+			}
+			if listed[name] {
+				synced[name] = true
+				continue
+			}
+			err = os.Remove(path.Join(dataDir, name))
+			if os.IsNotExist(err) {
+				continue
+			}
+			_, _ = w.Write([]byte("<tr><td>"))
+			_, _ = w.Write([]byte(template.HTMLEscapeString(name)))
+			if err != nil {
+				log.Errf("Unable to remove %s: %v", name, err)
+				_, _ = w.Write([]byte("<td>❌ removed upstream but delete error</tr>\n"))
+				continue
+			}
+			log.Infof("Removed %s, no longer listed by %s", name, u)
+			_, _ = w.Write([]byte("<td>deleted (removed upstream)</tr>\n"))
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		log.Errf("Unable to read sync manifest %s: %v", manifest, err)
+	}
+	names := make([]string, 0, len(synced))
+	for name := range synced {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b bytes.Buffer
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteString("\n")
+	}
+	if err := ioutil.WriteFile(manifest, b.Bytes(), 0o644); err != nil { // nolint: gosec // we do want 644
+		log.Errf("Unable to write sync manifest %s: %v", manifest, err)
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ui // import "fortio.org/fortio/ui"
+
+// Sync listing formats beyond the index.tsv and s3/gcs bucket xml ones: Azure
+// Blob container listings, WebDAV (PROPFIND) and http directory listings.
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"fortio.org/fortio/fhttp"
+	"fortio.org/fortio/log"
+)
+
+// syncEntry is one object/file of a sync listing.
+type syncEntry struct {
+	key  string // as listed, for display
+	name string // local file name
+	url  string
+	size int64  // -1 when unknown
+	md5  []byte // nil when unknown
+	// set by downloadOne when it saved the file (downloaded or updated)
+	downloaded bool
+}
+
+// AzureEnumerationResults is the minimum we need out of Azure Blob container listings.
+// https://docs.microsoft.com/en-us/rest/api/storageservices/list-blobs
+// e.g. https://account.blob.core.windows.net/fortio-data?restype=container&comp=list&prefix=fortio.istio.io/
+type AzureEnumerationResults struct {
+	NextMarker string      `xml:"NextMarker"`
+	Blobs      []AzureBlob `xml:"Blobs>Blob"`
+}
+
+// AzureBlob is one blob of AzureEnumerationResults.
+type AzureBlob struct {
+	Name string `xml:"Name"`
+	Size int64  `xml:"Properties>Content-Length"`
+	MD5  string `xml:"Properties>Content-MD5"` // base64
+}
+
+// DAVMultiStatus is the minimum we need out of WebDAV PROPFIND (Depth: 1) listings.
+// http://www.webdav.org/specs/rfc4918.html#METHOD_PROPFIND
+type DAVMultiStatus struct {
+	Responses []DAVResponse `xml:"response"`
+}
+
+// DAVResponse is one resource of DAVMultiStatus.
+type DAVResponse struct {
+	Href   string `xml:"href"`
+	Length string `xml:"propstat>prop>getcontentlength"`
+}
+
+// Query parameters of the Azure listing requests, not to be passed on to the
+// blobs' urls (unlike the SAS token ones).
+var azureListParams = []string{"restype", "comp", "prefix", "delimiter", "marker", "maxresults", "include"}
+
+// Links of http directory listings (apache, nginx, python's http.server,...).
+var hrefRegexp = regexp.MustCompile(`(?i)<a\s[^>]*href\s*=\s*["']([^"']+)["']`)
+
+// xmlRoot returns the (local) name of the root element of the xml document
+// or "" if data doesn't start like xml.
+func xmlRoot(data []byte) string {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false // html pages are fine too
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return ""
+		}
+		if se, ok := t.(xml.StartElement); ok {
+			return se.Name.Local
+		}
+	}
+}
+
+// davURL returns the http(s) url of a dav:// or davs:// url, and whether it was one.
+func davURL(u string) (string, bool) {
+	lu := strings.ToLower(u)
+	switch {
+	case strings.HasPrefix(lu, "dav://"):
+		return "http://" + u[len("dav://"):], true
+	case strings.HasPrefix(lu, "davs://"):
+		return "https://" + u[len("davs://"):], true
+	}
+	return u, false
+}
+
+// propfind lists the WebDAV collection at o.URL (Depth: 1).
+func propfind(o *fhttp.HTTPOptions) (int, []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), o.HTTPReqTimeOut)
+	defer cancel()
+	body := `<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><prop><getcontentlength/></prop></propfind>`
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", o.URL, strings.NewReader(body))
+	if err != nil {
+		log.Errf("Unable to make PROPFIND request for %s : %v", o.URL, err)
+		return -1, nil
+	}
+	req.Header = o.AllHeaders()
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Errf("Unable to PROPFIND %s : %v", o.URL, err)
+		return -1, nil
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Errf("Unable to read PROPFIND response of %s : %v", o.URL, err)
+		return -1, nil
+	}
+	return resp.StatusCode, data
+}
+
+// tsvEntries returns the entries of an index.tsv (url, size and base64 md5
+// columns, the later 2 being optional).
+func tsvEntries(sdata string) []syncEntry {
+	lines := strings.Split(sdata, "\n")
+	res := make([]syncEntry, 0, len(lines)-1)
+	for _, l := range lines[1:] {
+		parts := strings.Split(strings.TrimSpace(l), "\t")
+		e := syncEntry{key: parts[0], size: -1}
+		if ur, err := url.Parse(parts[0]); err == nil {
+			e.url = parts[0]
+			pathParts := strings.Split(ur.Path, "/")
+			e.name = pathParts[len(pathParts)-1]
+		}
+		if len(parts) > 1 {
+			e.size = parseSize(parts[1])
+		}
+		if len(parts) > 2 {
+			e.md5, _ = base64.StdEncoding.DecodeString(parts[2])
+		}
+		res = append(res, e)
+	}
+	return res
+}
+
+func parseSize(s string) int64 {
+	size, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || size < 0 {
+		return -1
+	}
+	return size
+}
+
+// bucketEntries parses s3/gcs and Azure Blob listings into the entries of
+// the objects, at baseURL.
+func bucketEntries(data []byte, bu *url.URL) (entries []syncEntry, nextMarker string, err error) {
+	azure := xmlRoot(data) == "EnumerationResults"
+	if azure {
+		l := AzureEnumerationResults{}
+		err = xml.Unmarshal(data, &l)
+		log.Infof("Parsed azure %+v", l)
+		for _, b := range l.Blobs {
+			md5, _ := base64.StdEncoding.DecodeString(b.MD5)
+			entries = append(entries, syncEntry{key: b.Name, size: b.Size, md5: md5})
+		}
+		nextMarker = l.NextMarker
+	} else {
+		l := ListBucketResult{}
+		err = xml.Unmarshal(data, &l)
+		log.Infof("Parsed %+v", l)
+		for _, o := range l.Contents {
+			entries = append(entries, syncEntry{key: o.Key, size: o.Size, md5: etagMD5(o.ETag)})
+		}
+		nextMarker = l.NextMarker
+	}
+	for i := range entries {
+		e := &entries[i]
+		pathParts := strings.Split(e.key, "/")
+		e.name = pathParts[len(pathParts)-1]
+		newURL := *bu // copy
+		newURL.Path = newURL.Path + "/" + e.key
+		if azure {
+			newURL.RawQuery = azureBlobQuery(bu.Query())
+		}
+		e.url = newURL.String()
+	}
+	return entries, nextMarker, err
+}
+
+// etagMD5 returns the md5 of s3/gcs ETags, which are the hex md5 of the
+// objects except for multipart uploads (and encrypted objects).
+func etagMD5(etag string) []byte {
+	md5, err := hex.DecodeString(strings.Trim(etag, `"`))
+	if err != nil || len(md5) != 16 {
+		return nil
+	}
+	return md5
+}
+
+// azureBlobQuery returns the query of the listing's blobs' urls: the listing
+// one without the listing parameters (so the SAS token, if any, is kept).
+func azureBlobQuery(q url.Values) string {
+	for _, p := range azureListParams {
+		q.Del(p)
+	}
+	return q.Encode()
+}
+
+// directoryEntries returns the json files listed in a WebDAV multistatus
+// (when dav) or an html directory listing, resolved against the listing's url
+// and restricted to its host.
+func directoryEntries(data []byte, baseURL string, dav bool) ([]syncEntry, error) {
+	bu, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(bu.Path, "/") && path.Ext(bu.Path) == "" {
+		bu.Path += "/" // directory, for the relative links
+	}
+	var responses []DAVResponse
+	if dav {
+		l := DAVMultiStatus{}
+		if err = xml.Unmarshal(data, &l); err != nil {
+			return nil, err
+		}
+		log.Infof("Parsed dav %+v", l)
+		responses = l.Responses
+	} else {
+		for _, m := range hrefRegexp.FindAllSubmatch(data, -1) {
+			responses = append(responses, DAVResponse{Href: html.UnescapeString(string(m[1]))})
+		}
+	}
+	res := []syncEntry{}
+	seen := map[string]bool{}
+	for _, r := range responses {
+		ref, err := url.Parse(strings.TrimSpace(r.Href))
+		if err != nil {
+			continue
+		}
+		u := bu.ResolveReference(ref)
+		if u.Host != bu.Host || !strings.HasSuffix(u.Path, ".json") || seen[u.String()] {
+			continue
+		}
+		seen[u.String()] = true
+		res = append(res, syncEntry{key: u.String(), name: path.Base(u.Path), url: u.String(), size: parseSize(r.Length)})
+	}
+	return res, nil
+}
+
+// listLinks lists the json files of a WebDAV or html directory listing.
+// @returns false on error.
+func listLinks(w http.ResponseWriter, data []byte, baseURL string, dav bool) ([]syncEntry, bool) {
+	entries, err := directoryEntries(data, baseURL, dav)
+	if err != nil {
+		log.Errf("directory listing parsing error %v", err)
+		_, _ = w.Write([]byte("❌ listing parsing error, check logs<script>setPB(1,1)</script></body></html>\n"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+	kind := "directory listing"
+	if dav {
+		kind = "webdav listing"
+	}
+	_, _ = w.Write([]byte(fmt.Sprintf("success %s fetch! Found %d json files.\n", kind, len(entries))))
+	return entries, true
+}
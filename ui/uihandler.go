@@ -24,7 +24,6 @@ import (
 	"embed"
 	"encoding/base64"
 	"encoding/json"
-	"encoding/xml"
 	"flag"
 	"fmt"
 	"html"
@@ -81,7 +80,7 @@ var (
 	syncTemplate   *template.Template
 	uiRunMapMutex  = &sync.Mutex{}
 	id             int64
-	runs           = make(map[int64]*periodic.RunnerOptions)
+	runs           = make(map[int64]*RunStatus)
 	// Base URL used for index - useful when running under an ingress with prefix.
 	baseURL string
 
@@ -89,13 +88,15 @@ var (
 )
 
 const (
-	fetchURI      = "fetch/"
-	fetch2URI     = "fetch2/"
-	restRunURI    = "rest/run"
-	restStatusURI = "rest/status"
-	restStopURI   = "rest/stop"
-	faviconPath   = "/favicon.ico"
-	modegrpc      = "grpc"
+	fetchURI       = "fetch/"
+	fetch2URI      = "fetch2/"
+	restRunURI     = "rest/run"
+	restStatusURI  = "rest/status"
+	restStopURI    = "rest/stop"
+	restQPSURI     = "rest/qps"
+	restProfileURI = "rest/profile"
+	faviconPath    = "/favicon.ico"
+	modegrpc       = "grpc"
 )
 
 // TODO: auto map from (Http)RunnerOptions to form generation and/or accept
@@ -193,15 +194,19 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		Exactly:     n,
 		Jitter:      jitter,
 	}
+	var runErr error // when the run can't start because of the per run or concurrency limits
 	if mode == run {
 		ro.Normalize()
-		uiRunMapMutex.Lock()
-		id++ // start at 1 as 0 means interrupt all
-		runid = id
-		runs[runid] = &ro
-		uiRunMapMutex.Unlock()
-		log.Infof("New run id %d", runid)
-		ro.RunID = id
+		runErr = checkRunLimits(&ro, 1, resolve, url)
+		if runErr == nil {
+			runid, runErr = startRun(&ro, 1, runner, url, r)
+		}
+		if runErr != nil {
+			ro.Abort() // cleanup the Normalize() watcher
+			log.Warnf("Refusing run from %v: %v", r.RemoteAddr, runErr)
+		} else {
+			log.Infof("New run id %d", runid)
+		}
 	}
 	httpopts := &fhttp.HTTPOptions{}
 	httpopts.HTTPReqTimeOut = timeout // to be normalized in init 0 replaced by default value
@@ -247,10 +252,12 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 			URLHostPort                 string
 			DoStop                      bool
 			DoLoad                      bool
+			DataDir                     string
 		}{
 			r, defaultHeaders, version.Short(), logoPath, debugPath, chartJSPath,
 			startTime.Format(time.ANSIC), url, labels, runid,
 			fhttp.RoundDuration(time.Since(startTime)), durSeconds, urlHostPort, mode == stop, mode == run,
+			dataDir,
 		})
 		if err != nil {
 			log.Critf("Template execution failed: %v", err)
@@ -262,6 +269,12 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	case stop:
 		StopByRunID(runid)
 	case run:
+		if runErr != nil {
+			_, _ = w.Write([]byte(fmt.Sprintf(
+				"❌ Not starting because of %s\n</pre><script>document.getElementById('running').style.display = 'none';</script></body></html>\n",
+				html.EscapeString(runErr.Error()))))
+			return
+		}
 		// mode == run case:
 		for _, header := range r.Form["H"] {
 			if len(header) == 0 {
@@ -292,7 +305,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 			}
 			// TODO: ReqTimeout: timeout
 			res, err = fgrpc.RunGRPCTest(&o)
-		} else if strings.HasPrefix(url, tcprunner.TCPURLPrefix) {
+		} else if strings.HasPrefix(url, tcprunner.TCPURLPrefix) || strings.HasPrefix(url, tcprunner.TCPBulkURLPrefix) {
 			// TODO: copy pasta from fortio_main
 			o := tcprunner.RunnerOptions{
 				RunnerOptions: ro,
@@ -318,9 +331,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 			}
 			res, err = fhttp.RunHTTPTest(&o)
 		}
-		uiRunMapMutex.Lock()
-		delete(runs, ro.RunID)
-		uiRunMapMutex.Unlock()
+		endRun(ro.RunID)
 		if err != nil {
 			log.Errf("Init error for %s mode with url %s and options %+v : %v", runner, url, ro, err)
 
@@ -466,6 +477,8 @@ func BrowseHandler(w http.ResponseWriter, r *http.Request) {
 	yMax := r.FormValue("yMax")
 	yLog, _ := strconv.ParseBool(r.FormValue("yLog"))
 	dataList := DataList()
+	profileList := ProfileList()
+	bundleList := BundleList()
 	selectedValues := r.URL.Query()["sel"]
 	preselectedDataList, numSelected := SelectValues(dataList, selectedValues)
 
@@ -492,13 +505,15 @@ func BrowseHandler(w http.ResponseWriter, r *http.Request) {
 		Search              string
 		ChartOptions        ChartOptions
 		PreselectedDataList []SelectableValue
+		ProfileList         []string
+		BundleList          []string
 		URLHostPort         string
 		DoRender            bool
 		DoSearch            bool
 		DoLoadSelected      bool
 	}{
 		r, extraBrowseLabel, version.Short(), logoPath, chartJSPath,
-		url, search, chartOptions, preselectedDataList, urlHostPort,
+		url, search, chartOptions, preselectedDataList, profileList, bundleList, urlHostPort,
 		doRender, doSearch, doLoadSelected,
 	})
 	if err != nil {
@@ -622,12 +637,16 @@ func LogAndFilterDataRequest(h http.Handler) http.Handler {
 			sendTSVDataIndex(urlPrefix, w)
 			return
 		}
-		if !strings.HasSuffix(path, ".json") {
-			log.Warnf("Filtering request for non .json '%s'", path)
+		if !strings.HasSuffix(path, ".json") && !strings.HasSuffix(path, ProfileSuffix) &&
+			!strings.HasSuffix(path, periodic.BundleSuffix) {
+			log.Warnf("Filtering request for non .json (or profile/run bundle) '%s'", path)
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 		fhttp.CacheOn(w)
+		if strings.HasSuffix(path, ".json") && serveUpgradedResults(w, strings.TrimPrefix(path, uiPath+"data")) {
+			return
+		}
 		h.ServeHTTP(w, r)
 	})
 }
@@ -692,7 +711,9 @@ func SyncHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	_, _ = w.Write([]byte("Fetch of index/bucket url ... "))
 	flusher.Flush()
-	o := fhttp.NewHTTPOptions(uStr)
+	// dav:// and davs:// urls are WebDAV collections to list with PROPFIND:
+	hURL, dav := davURL(uStr)
+	o := fhttp.NewHTTPOptions(hURL)
 	fhttp.OnBehalfOf(o, r)
 	// If we had hundreds of thousands of entry we should stream, parallelize (connection pool)
 	// and not do multiple passes over the same data, but for small tsv this is fine.
@@ -703,174 +724,112 @@ func SyncHandler(w http.ResponseWriter, r *http.Request) {
 		// too late to write headers
 		return
 	}
-	code, data, _ := client.Fetch()
+	var code int
+	var data []byte
+	if dav {
+		code, data = propfind(o)
+	} else {
+		code, data, _ = client.Fetch()
+	}
 	defer client.Close()
-	if code != http.StatusOK {
+	if code != http.StatusOK && !(dav && code == http.StatusMultiStatus) {
 		_, _ = w.Write([]byte(fmt.Sprintf("http error, code %d<script>setPB(1,1)</script></body></html>\n", code)))
 		// too late to write headers
 		return
 	}
 	sdata := strings.TrimSpace(string(data))
-	if strings.HasPrefix(sdata, "TsvHttpData-1.0") {
-		processTSV(w, client, sdata)
-	} else {
-		if !processXML(w, client, data, uStr, 0) {
+	var entries []syncEntry
+	complete := true
+	switch root := strings.ToLower(xmlRoot(data)); {
+	case strings.HasPrefix(sdata, "TsvHttpData-1.0"):
+		entries = tsvEntries(sdata)
+		_, _ = w.Write([]byte(fmt.Sprintf("success tsv fetch! Found %d referenced URLs.\n", len(entries))))
+	case root == "multistatus", root == "html":
+		if entries, ok = listLinks(w, data, hURL, root == "multistatus"); !ok {
+			return
+		}
+	default:
+		if entries, complete, ok = listXML(w, client, data, hURL, 0, nil); !ok {
 			return
 		}
 	}
+	downloadAll(w, o, entries)
+	if syncDelete.Get() && complete {
+		deleteRemoved(w, uStr, entries)
+	}
 	_, _ = w.Write([]byte("</table>"))
 	_, _ = w.Write([]byte("\n</body></html>\n"))
 }
 
-func processTSV(w http.ResponseWriter, client *fhttp.Client, sdata string) {
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		log.Fatalf("processTSV expecting a flushable response")
-	}
-	lines := strings.Split(sdata, "\n")
-	n := len(lines)
-
-	_, _ = w.Write([]byte(fmt.Sprintf("success tsv fetch! Now fetching %d referenced URLs:<script>setPB(1,%d)</script>\n",
-		n-1, n)))
-	_, _ = w.Write([]byte("<table>"))
-	flusher.Flush()
-	for i, l := range lines[1:] {
-		parts := strings.Split(l, "\t")
-		u := parts[0]
-		_, _ = w.Write([]byte("<tr><td>"))
-		_, _ = w.Write([]byte(template.HTMLEscapeString(u)))
-		ur, err := url.Parse(u)
-		if err != nil {
-			_, _ = w.Write([]byte("<td>skipped (not a valid url)"))
-		} else {
-			uPath := ur.Path
-			pathParts := strings.Split(uPath, "/")
-			name := pathParts[len(pathParts)-1]
-			downloadOne(w, client, name, u)
-		}
-		_, _ = w.Write([]byte(fmt.Sprintf("</tr><script>setPB(%d)</script>\n", i+2)))
-		flusher.Flush()
-	}
-}
-
 // ListBucketResult is the minimum we need out of s3 xml results.
 // https://docs.aws.amazon.com/AmazonS3/latest/API/RESTBucketGET.html
 // e.g. https://storage.googleapis.com/fortio-data?max-keys=2&prefix=fortio.istio.io/
 type ListBucketResult struct {
-	NextMarker string   `xml:"NextMarker"`
-	Names      []string `xml:"Contents>Key"`
+	NextMarker string         `xml:"NextMarker"`
+	Contents   []BucketObject `xml:"Contents"`
 }
 
-// @returns true if started a table successfully - false is error.
-func processXML(w http.ResponseWriter, client *fhttp.Client, data []byte, baseURL string, level int) bool {
+// BucketObject is one object of ListBucketResult.
+type BucketObject struct {
+	Key  string `xml:"Key"`
+	Size int64  `xml:"Size"`
+	ETag string `xml:"ETag"`
+}
+
+// listXML appends the objects of the bucket listing, and of its continuations,
+// to entries.
+// @returns whether the listing is complete, and false on error.
+func listXML(w http.ResponseWriter, client *fhttp.Client, data []byte, baseURL string, level int,
+	entries []syncEntry) ([]syncEntry, bool, bool) {
 	// We already know this parses as we just fetched it:
 	bu, _ := url.Parse(baseURL)
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		log.Fatalf("processXML expecting a flushable response")
+		log.Fatalf("listXML expecting a flushable response")
 	}
-	l := ListBucketResult{}
-	err := xml.Unmarshal(data, &l)
+	objects, nextMarker, err := bucketEntries(data, bu)
 	if err != nil {
 		log.Errf("xml unmarshal error %v", err)
 		// don't show the error / would need html escape to avoid CSS attacks
 		_, _ = w.Write([]byte("❌ xml parsing error, check logs<script>setPB(1,1)</script></body></html>\n"))
 		w.WriteHeader(http.StatusInternalServerError)
-		return false
-	}
-	n := len(l.Names)
-	log.Infof("Parsed %+v", l)
-
-	_, _ = w.Write([]byte(fmt.Sprintf("success xml fetch #%d! Now fetching %d referenced objects:<script>setPB(1,%d)</script>\n",
-		level+1, n, n+1)))
-	if level == 0 {
-		_, _ = w.Write([]byte("<table>"))
-	}
-	for i, el := range l.Names {
-		_, _ = w.Write([]byte("<tr><td>"))
-		_, _ = w.Write([]byte(template.HTMLEscapeString(el)))
-		pathParts := strings.Split(el, "/")
-		name := pathParts[len(pathParts)-1]
-		newURL := *bu // copy
-		newURL.Path = newURL.Path + "/" + el
-		fullURL := newURL.String()
-		downloadOne(w, client, name, fullURL)
-		_, _ = w.Write([]byte(fmt.Sprintf("</tr><script>setPB(%d)</script>\n", i+2)))
-		flusher.Flush()
+		return nil, false, false
 	}
+	entries = append(entries, objects...)
+	_, _ = w.Write([]byte(fmt.Sprintf("success xml fetch #%d! Found %d referenced objects.\n", level+1, len(objects))))
 	flusher.Flush()
 	// Is there more data ? (NextMarker present)
-	if len(l.NextMarker) == 0 {
-		return true
+	if len(nextMarker) == 0 {
+		return entries, true, true
 	}
 	if level > 100 {
 		log.Errf("Too many chunks, stopping after 100")
 		w.WriteHeader(509 /* Bandwidth Limit Exceeded */)
-		return true
+		return entries, false, true
 	}
 	q := bu.Query()
-	if q.Get("marker") == l.NextMarker {
+	if q.Get("marker") == nextMarker {
 		log.Errf("Loop with same marker %+v", bu)
 		w.WriteHeader(508 /* Loop Detected */)
-		return true
+		return entries, false, true
 	}
-	q.Set("marker", l.NextMarker)
+	q.Set("marker", nextMarker)
 	bu.RawQuery = q.Encode()
 	newBaseURL := bu.String()
 	// url already validated
-	_, _ = w.Write([]byte("<tr><td>"))
+	_, _ = w.Write([]byte("<br />Fetch of "))
 	_, _ = w.Write([]byte(template.HTMLEscapeString(newBaseURL)))
-	_, _ = w.Write([]byte("<td>"))
+	_, _ = w.Write([]byte(" ... "))
 	_ = client.ChangeURL(newBaseURL)
 	ncode, ndata, _ := client.Fetch()
 	if ncode != http.StatusOK {
 		log.Errf("Can't fetch continuation with marker %+v", bu)
 
-		_, _ = w.Write([]byte(fmt.Sprintf("❌ http error, code %d<script>setPB(1,1)</script></table></body></html>\n", ncode)))
-		w.WriteHeader(424 /*Failed Dependency*/)
-		return false
-	}
-	return processXML(w, client, ndata, newBaseURL, level+1) // recurse
-}
-
-func downloadOne(w http.ResponseWriter, client *fhttp.Client, name string, u string) {
-	log.Infof("downloadOne(%s,%s)", name, u)
-	if !strings.HasSuffix(name, ".json") {
-		_, _ = w.Write([]byte("<td>skipped (not json)"))
-		return
-	}
-	localPath := path.Join(dataDir, name)
-	_, err := os.Stat(localPath)
-	if err == nil {
-		_, _ = w.Write([]byte("<td>skipped (already exists)"))
-		return
-	}
-	// note that if data dir doesn't exist this will trigger too - TODO: check datadir earlier
-	if !os.IsNotExist(err) {
-		log.Warnf("check %s : %v", localPath, err)
-		// don't return the details of the error to not leak local data dir etc
-		_, _ = w.Write([]byte("<td>❌ skipped (access error)"))
-		return
-	}
-	// url already validated
-	_ = client.ChangeURL(u)
-	code1, data1, _ := client.Fetch()
-	if code1 != http.StatusOK {
-		_, _ = w.Write([]byte(fmt.Sprintf("<td>❌ Http error, code %d", code1)))
+		_, _ = w.Write([]byte(fmt.Sprintf("❌ http error, code %d<script>setPB(1,1)</script></body></html>\n", ncode)))
 		w.WriteHeader(424 /*Failed Dependency*/)
-		return
-	}
-	err = ioutil.WriteFile(localPath, data1, 0o644) // nolint: gosec // we do want 644
-	if err != nil {
-		log.Errf("Unable to save %s: %v", localPath, err)
-		_, _ = w.Write([]byte("<td>❌ skipped (write error)"))
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil, false, false
 	}
-	// finally ! success !
-	log.Infof("Success fetching %s - saved at %s", u, localPath)
-	// checkmark
-	_, _ = w.Write([]byte("<td class='checkmark'>✓"))
+	return listXML(w, client, ndata, newBaseURL, level+1, entries) // recurse
 }
 
 // Serve starts the fhttp.Serve() plus the UI server on the given port
@@ -909,6 +868,8 @@ func Serve(baseurl, port, debugpath, uipath, datadir string, percentileList []fl
 	mux.HandleFunc(restStatusPath, RESTStatusHandler)
 	restStopPath := uiPath + restStopURI
 	mux.HandleFunc(restStopPath, RESTStopHandler)
+	restQPSPath := uiPath + restQPSURI
+	mux.HandleFunc(restQPSPath, RESTQPSHandler)
 
 	logoPath = version.Short() + "/static/img/fortio-logo-gradient-no-bg.svg"
 	chartJSPath = version.Short() + "/static/js/Chart.min.js"
@@ -947,6 +908,7 @@ func Serve(baseurl, port, debugpath, uipath, datadir string, percentileList []fl
 	if dataDir != "" {
 		fs := http.FileServer(http.Dir(dataDir))
 		mux.Handle(uiPath+"data/", LogAndFilterDataRequest(http.StripPrefix(uiPath+"data", fs)))
+		mux.HandleFunc(uiPath+restProfileURI, RESTProfileHandler)
 		if datadir == "." {
 			var err error
 			datadir, err = os.Getwd()
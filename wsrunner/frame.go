@@ -0,0 +1,180 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wsrunner
+
+// Minimal (client side) RFC 6455 WebSocket handshake and framing, just what
+// is needed to measure message round trips: no extensions/compression.
+
+import (
+	"bufio"
+	"crypto/sha1" // nolint: gosec // mandated by the websocket protocol, not used for security
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+
+	"fortio.org/fortio/fnet"
+)
+
+// Frame opcodes.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+
+	finBit  = 0x80
+	maskBit = 0x80
+	// Control frames (ping) payload limit.
+	maxControlPayload = 125
+	acceptGUID        = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var (
+	errBadFrame     = errors.New("bad frame")
+	errFrameTooLong = errors.New("frame too long")
+)
+
+// handshake sends the upgrade request on the connection and checks the server's reply.
+func handshake(w io.Writer, r *bufio.Reader, host, requestURI string, rnd *rand.Rand) error {
+	var k [16]byte
+	_, _ = rnd.Read(k[:])
+	key := base64.StdEncoding.EncodeToString(k[:])
+	req := "GET " + requestURI + " HTTP/1.1\r\nHost: " + host + "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := io.WriteString(w, req); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		return fmt.Errorf("websocket handshake failed with status %q", resp.Status)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") || resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return fmt.Errorf("invalid websocket handshake response headers %v", resp.Header)
+	}
+	return nil
+}
+
+// acceptKey is the Sec-WebSocket-Accept value expected for key.
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + acceptGUID)) // nolint: gosec // see import
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// appendFrame appends the masked (as all client frames must be) frame to buf.
+func appendFrame(buf []byte, opcode byte, payload []byte, rnd *rand.Rand) []byte {
+	buf = append(buf, finBit|opcode)
+	l := len(payload)
+	switch {
+	case l < 126:
+		buf = append(buf, maskBit|byte(l))
+	case l <= 0xFFFF:
+		buf = append(buf, maskBit|126, byte(l>>8), byte(l))
+	default:
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(l))
+		buf = append(buf, maskBit|127)
+		buf = append(buf, b[:]...)
+	}
+	var mask [4]byte
+	_, _ = rnd.Read(mask[:])
+	buf = append(buf, mask[:]...)
+	for i, b := range payload {
+		buf = append(buf, b^mask[i%4])
+	}
+	return buf
+}
+
+// readFrame reads the next frame, data messages fragments being assembled,
+// into buf (grown as needed) and returns its opcode and payload.
+func readFrame(r *bufio.Reader, buf []byte) (byte, []byte, error) {
+	var opcode byte
+	payload := buf[:0]
+	for {
+		var hdr [2]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return 0, payload, err
+		}
+		fin := hdr[0]&finBit != 0
+		op := hdr[0] & 0x0F
+		l := uint64(hdr[1] & 0x7F)
+		switch l {
+		case 126:
+			var b [2]byte
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return 0, payload, err
+			}
+			l = uint64(binary.BigEndian.Uint16(b[:]))
+		case 127:
+			var b [8]byte
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return 0, payload, err
+			}
+			l = binary.BigEndian.Uint64(b[:])
+		}
+		if l+uint64(len(payload)) > uint64(fnet.MaxPayloadSizeLimit) {
+			return 0, payload, errFrameTooLong
+		}
+		var mask [4]byte
+		masked := hdr[1]&maskBit != 0
+		if masked {
+			if _, err := io.ReadFull(r, mask[:]); err != nil {
+				return 0, payload, err
+			}
+		}
+		start := len(payload)
+		end := start + int(l)
+		if end > cap(payload) {
+			payload = append(payload[:cap(payload)], make([]byte, end-cap(payload))...)
+		}
+		payload = payload[:end]
+		if _, err := io.ReadFull(r, payload[start:]); err != nil {
+			return 0, payload[:start], err
+		}
+		if masked {
+			for i := start; i < end; i++ {
+				payload[i] ^= mask[(i-start)%4]
+			}
+		}
+		if op >= opClose {
+			if !fin || l > maxControlPayload || start > 0 {
+				// Control frames interleaved in fragmented messages aren't supported.
+				return op, payload, errBadFrame
+			}
+			return op, payload, nil
+		}
+		if op != opContinuation {
+			if start > 0 {
+				return op, payload, errBadFrame
+			}
+			opcode = op
+		} else if start == 0 && opcode == 0 {
+			return op, payload, errBadFrame
+		}
+		if fin {
+			return opcode, payload, nil
+		}
+	}
+}
@@ -0,0 +1,382 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wsrunner
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"time"
+
+	"fortio.org/fortio/fhttp"
+	"fortio.org/fortio/fnet"
+	"fortio.org/fortio/log"
+	"fortio.org/fortio/periodic"
+	"fortio.org/fortio/stats"
+	"fortio.org/fortio/tcprunner"
+)
+
+type WSResultMap map[string]int64
+
+// RunnerResults is the aggregated result of a WSRunner.
+// Also is the internal type used per thread/goroutine.
+type RunnerResults struct {
+	periodic.RunnerResults
+	WSOptions
+	RetCodes      WSResultMap
+	SocketCount   int
+	BytesSent     int64 // messages payload bytes
+	BytesReceived int64
+	// Time to establish the connections (including TLS and the websocket upgrade), nil when none succeeded.
+	ConnectTime *stats.HistogramData
+	client      *WSClient
+	aborter     *periodic.Aborter
+}
+
+// ErrorRate returns the fraction of the calls which weren't OK (see periodic.HasErrorRate).
+func (wsstate *RunnerResults) ErrorRate() float64 {
+	return periodic.ErrorRate(wsstate.RetCodes, WSStatusOK)
+}
+
+// Run tests websocket message round trips. Main call being run at the target QPS.
+// To be set as the Function in RunnerOptions.
+func (wsstate *RunnerResults) Run(t int) {
+	log.Debugf("Calling in %d", t)
+	_, err := wsstate.client.Fetch()
+	if err != nil {
+		wsstate.RetCodes[err.Error()]++
+	} else {
+		wsstate.RetCodes[WSStatusOK]++
+	}
+}
+
+// Warmup makes a warmup call, not counted in the results (see periodic.Warmer).
+func (wsstate *RunnerResults) Warmup(t int) {
+	_, err := wsstate.client.Fetch()
+	log.Debugf("Warmup call in %d: %v", t, err)
+}
+
+// WSOptions are options to the WSClient.
+type WSOptions struct {
+	Destination string // ws:// or wss:// url
+	Payload     []byte // what to send (and check), generated when empty
+	ReqTimeout  time.Duration
+	Insecure    bool // do not verify certs for wss
+	// Ping sends ping frames (expecting pongs) instead of text messages (expecting them echoed).
+	Ping bool
+	// Number of messages sent on a connection before closing it and opening a new one, 0 for no limit.
+	MessagesPerConnection int
+}
+
+// RunnerOptions includes the base RunnerOptions plus websocket specific
+// options.
+type RunnerOptions struct {
+	periodic.RunnerOptions
+	WSOptions
+}
+
+// WSClient is the client used for websocket echo testing.
+type WSClient struct {
+	buffer        []byte
+	frame         []byte // the frame being sent
+	req           []byte
+	dest          net.Addr
+	host          string // for the Host header and TLS server name
+	requestURI    string
+	tlsConfig     *tls.Config // nil for ws://
+	socket        net.Conn
+	reader        *bufio.Reader
+	connID        int // 0-9999
+	messageCount  int64
+	connMessages  int // messages sent on the current connection
+	bytesSent     int64
+	bytesReceived int64
+	socketCount   int
+	destination   string
+	doGenerate    bool
+	reqTimeout    time.Duration
+	ping          bool
+	perConnection int
+	rnd           *rand.Rand
+	localAddr     net.Addr             // of the last connection, for the run metadata
+	tlsState      *tls.ConnectionState // of the last connection (wss)
+	tlsConns      *periodic.TLSCounts  // of all the connections (wss)
+	connectTime   *stats.Histogram     // nil when not recording
+}
+
+var (
+	// WSURLPrefix is the URL prefix for triggering websocket load.
+	WSURLPrefix = "ws://"
+	// WSSURLPrefix is the URL prefix for triggering websocket over TLS load.
+	WSSURLPrefix = "wss://"
+	// WSStatusOK is the map key on success.
+	WSStatusOK   = "OK"
+	errShortRead = fmt.Errorf("short read")
+	errMismatch  = fmt.Errorf("read not echoing writes")
+	errClosed    = fmt.Errorf("closed by server")
+)
+
+// NewWSClient creates and initialize and returns a client based on the WSOptions.
+func NewWSClient(o *WSOptions) (*WSClient, error) {
+	c := WSClient{}
+	c.destination = o.Destination
+	u, err := url.Parse(o.Destination)
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "ws":
+		if port == "" {
+			port = "80"
+		}
+	case "wss":
+		if port == "" {
+			port = "443"
+		}
+		c.tlsConfig = &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: o.Insecure} // nolint: gosec // user requested
+		c.tlsConns = &periodic.TLSCounts{}
+	default:
+		return nil, fmt.Errorf("expecting ws:// or wss:// destination, got %q", o.Destination)
+	}
+	tAddr, err := fnet.Resolve(u.Hostname(), port)
+	if tAddr == nil {
+		return nil, err
+	}
+	c.dest = tAddr
+	c.host = u.Host
+	c.requestURI = u.RequestURI()
+	c.req = o.Payload
+	if len(c.req) == 0 { // len(nil) array is also valid and 0
+		c.doGenerate = true
+		c.req = tcprunner.GeneratePayload(0, 0)
+	}
+	c.ping = o.Ping
+	if c.ping && len(c.req) > maxControlPayload {
+		return nil, fmt.Errorf("ping payload can't be more than %d bytes, got %d", maxControlPayload, len(c.req))
+	}
+	c.perConnection = o.MessagesPerConnection
+	c.buffer = make([]byte, len(c.req))
+	c.rnd = rand.New(rand.NewSource(time.Now().UnixNano())) // nolint: gosec // only for masks and keys
+	c.reqTimeout = o.ReqTimeout
+	if o.ReqTimeout == 0 {
+		log.Debugf("Request timeout not set, using default %v", fhttp.HTTPReqTimeOutDefaultValue)
+		c.reqTimeout = fhttp.HTTPReqTimeOutDefaultValue
+	}
+	if c.reqTimeout < 0 {
+		log.Warnf("Invalid timeout %v, setting to %v", c.reqTimeout, fhttp.HTTPReqTimeOutDefaultValue)
+		c.reqTimeout = fhttp.HTTPReqTimeOutDefaultValue
+	}
+	return &c, nil
+}
+
+// connect opens a new connection and does the websocket upgrade handshake.
+func (c *WSClient) connect() (net.Conn, error) {
+	c.socketCount++
+	start := time.Now()
+	socket, err := net.DialTimeout(c.dest.Network(), c.dest.String(), c.reqTimeout)
+	if err != nil {
+		log.Errf("Unable to connect to %v : %v", c.dest, err)
+		return nil, err
+	}
+	_ = socket.SetDeadline(time.Now().Add(c.reqTimeout))
+	if c.tlsConfig != nil {
+		tlsConn := tls.Client(socket, c.tlsConfig)
+		if err = tlsConn.Handshake(); err != nil {
+			log.Errf("TLS handshake error with %v : %v", c.dest, err)
+			socket.Close()
+			return nil, err
+		}
+		socket = tlsConn
+		state := tlsConn.ConnectionState()
+		c.tlsState = &state
+		c.tlsConns.Add(&state)
+	}
+	c.reader = bufio.NewReader(socket)
+	if err = handshake(socket, c.reader, c.host, c.requestURI, c.rnd); err != nil {
+		log.Errf("Websocket handshake error with %v : %v", c.destination, err)
+		socket.Close()
+		return nil, err
+	}
+	c.localAddr = socket.LocalAddr()
+	c.connMessages = 0
+	if c.connectTime != nil {
+		c.connectTime.Record(time.Since(start).Seconds())
+	}
+	return socket, nil
+}
+
+// Fetch sends a message (or a ping) and waits for its echo (or pong).
+func (c *WSClient) Fetch() ([]byte, error) {
+	// Connect or reuse existing socket:
+	conn := c.socket
+	c.messageCount++
+	reuse := (conn != nil)
+	if !reuse {
+		var err error
+		conn, err = c.connect()
+		if conn == nil {
+			return nil, err
+		}
+	} else {
+		log.Debugf("Reusing socket %v", conn)
+	}
+	c.socket = nil // because of error returns and single retry
+	conErr := conn.SetDeadline(time.Now().Add(c.reqTimeout))
+	// Send the message:
+	if c.doGenerate {
+		c.req = tcprunner.GeneratePayload(c.connID, c.messageCount)
+	}
+	opcode := byte(opText)
+	if c.ping {
+		opcode = opPing
+	}
+	c.frame = appendFrame(c.frame[:0], opcode, c.req, c.rnd)
+	_, err := conn.Write(c.frame)
+	if err != nil || conErr != nil {
+		conn.Close()
+		if reuse {
+			// it's ok for the (idle) socket to die once, auto reconnect:
+			log.Infof("Closing dead socket %v (%v)", conn, err)
+			return c.Fetch() // recurse once
+		}
+		log.Errf("Unable to write to %v %v : %v", conn, c.dest, err)
+		return nil, err
+	}
+	c.bytesSent += int64(len(c.req))
+	c.connMessages++
+	// Read until the reply, answering pings and skipping unsolicited pongs:
+	for {
+		var op byte
+		op, c.buffer, err = readFrame(c.reader, c.buffer)
+		if err != nil {
+			log.Debugf("read error %v after %d bytes", err, len(c.buffer))
+			conn.Close()
+			if err == errBadFrame || err == errFrameTooLong {
+				return c.buffer, err
+			}
+			return c.buffer, errShortRead
+		}
+		c.bytesReceived += int64(len(c.buffer))
+		if op == opClose {
+			conn.Close()
+			return c.buffer, errClosed
+		}
+		if op == opPing {
+			_, _ = conn.Write(appendFrame(nil, opPong, c.buffer, c.rnd))
+			continue
+		}
+		if c.ping != (op == opPong) {
+			continue // unsolicited pong or message
+		}
+		if bytes.Equal(c.buffer, c.req) {
+			break
+		}
+		if c.ping {
+			continue // stale pong
+		}
+		log.Infof("Mismatch between sent %q and received %q", string(c.req), string(c.buffer))
+		conn.Close()
+		return c.buffer, errMismatch
+	}
+	if c.perConnection > 0 && c.connMessages >= c.perConnection {
+		c.closeConn(conn)
+		return c.buffer, nil
+	}
+	c.socket = conn // reuse on success
+	return c.buffer, nil
+}
+
+// closeConn closes the connection, starting with a websocket close frame.
+func (c *WSClient) closeConn(conn net.Conn) {
+	_, _ = conn.Write(appendFrame(nil, opClose, []byte{0x03, 0xE8}, c.rnd)) // 1000: normal closure
+	if err := conn.Close(); err != nil {
+		log.Warnf("Error closing websocket client's socket: %v", err)
+	}
+}
+
+// Close closes the last connection and returns the total number of sockets used for the run.
+func (c *WSClient) Close() int {
+	log.Debugf("Closing %p: %s socket count %d", c, c.destination, c.socketCount)
+	if c.socket != nil {
+		c.closeConn(c.socket)
+		c.socket = nil
+	}
+	return c.socketCount
+}
+
+// RunWSTest runs a websocket test and returns the aggregated stats.
+func RunWSTest(o *RunnerOptions) (*RunnerResults, error) {
+	o.RunType = "WS"
+	log.Infof("Starting websocket test for %s with %d threads at %.1f qps", o.Destination, o.NumThreads, o.QPS)
+	r := periodic.NewPeriodicRunner(&o.RunnerOptions)
+	defer r.Options().Abort()
+	numThreads := r.Options().NumThreads
+	o.WSOptions.Destination = o.Destination
+	out := r.Options().Out // Important as the default value is set from nil to stdout inside NewPeriodicRunner
+	total := RunnerResults{
+		aborter:  r.Options().Stop,
+		RetCodes: make(WSResultMap),
+	}
+	total.Destination = o.Destination
+	connectTime := r.Options().NewLatencyHistogram()
+	wsstate := make([]RunnerResults, numThreads)
+	err := periodic.SetupThreads(r, func(i int, firstCall bool) (periodic.Runnable, error) {
+		// Create a client and connect once for each 'thread'
+		client, err := NewWSClient(&o.WSOptions)
+		if client == nil {
+			return nil, fmt.Errorf("unable to create client %d for %s: %w", i, o.Destination, err)
+		}
+		client.connID = i
+		client.connectTime = connectTime.Clone()
+		if firstCall {
+			data, err := client.Fetch()
+			if i == 0 && log.LogVerbose() {
+				log.LogVf("first hit of %s: err %v, received %d: %q", o.Destination, err, len(data), data)
+			}
+		}
+		// Setup the stats for each 'thread'
+		wsstate[i].client = client
+		wsstate[i].aborter = total.aborter
+		wsstate[i].RetCodes = make(WSResultMap)
+		return &wsstate[i], nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	total.RunnerResults = r.Run()
+	periodic.MergeThreads(r, numThreads, total.RetCodes, func(i int) map[string]int64 {
+		c := wsstate[i].client
+		total.Metadata.AddConnection(c.localAddr, c.dest, c.tlsState)
+		total.Metadata.AddTLSConnections(c.tlsConns)
+		total.SocketCount += c.Close()
+		total.BytesReceived += c.bytesReceived
+		total.BytesSent += c.bytesSent
+		connectTime.Transfer(c.connectTime)
+		return wsstate[i].RetCodes
+	})
+	_, _ = fmt.Fprintf(out, "Sockets used: %d (for perfect no error run, would be %d)\n", total.SocketCount, r.Options().NumThreads)
+	_, _ = fmt.Fprintf(out, "Total Bytes sent: %d, received: %d\n", total.BytesSent, total.BytesReceived)
+	if connectTime.Count > 0 {
+		total.ConnectTime = connectTime.Export().CalcPercentiles(r.Options().Percentiles)
+		total.ConnectTime.Print(out, "Connection (including websocket upgrade) time")
+	}
+	periodic.PrintRetCodes(out, "ws", total.RetCodes, total.DurationHistogram.Count)
+	return &total, nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2021 Fortio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wsrunner
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func echoServer(tls bool) (*httptest.Server, string) {
+	h := websocket.Server{Handler: func(ws *websocket.Conn) {
+		for {
+			var msg []byte
+			if err := websocket.Message.Receive(ws, &msg); err != nil {
+				return
+			}
+			if err := websocket.Message.Send(ws, msg); err != nil {
+				return
+			}
+		}
+	}}
+	if tls {
+		s := httptest.NewTLSServer(h)
+		return s, strings.Replace(s.URL, "https://", WSSURLPrefix, 1) + "/echo"
+	}
+	s := httptest.NewServer(h)
+	return s, strings.Replace(s.URL, "http://", WSURLPrefix, 1) + "/echo"
+}
+
+func TestWSRunner(t *testing.T) {
+	tests := []struct {
+		tls         bool
+		ping        bool
+		payload     string
+		perConn     int
+		expectedSoc int
+	}{
+		{false, false, "", 0, 2},
+		{false, true, "", 0, 2},
+		{false, false, strings.Repeat("x", 70000), 0, 2}, // 64 bits length frames
+		{false, false, "hello", 5, 4},
+		{true, false, "", 0, 2},
+	}
+	for _, tst := range tests {
+		srv, dest := echoServer(tst.tls)
+		opts := RunnerOptions{}
+		opts.QPS = 100
+		opts.Exactly = 20
+		opts.NumThreads = 2
+		opts.Destination = dest
+		opts.Insecure = true
+		opts.Ping = tst.ping
+		opts.Payload = []byte(tst.payload)
+		opts.MessagesPerConnection = tst.perConn
+		res, err := RunWSTest(&opts)
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.RetCodes[WSStatusOK] != 20 || res.SocketCount != tst.expectedSoc {
+			t.Errorf("%+v: unexpected results %v with %d sockets", tst, res.RetCodes, res.SocketCount)
+		}
+		if res.BytesSent != res.BytesReceived || res.BytesSent == 0 {
+			t.Errorf("%+v: mismatch between bytes sent %d and received %d", tst, res.BytesSent, res.BytesReceived)
+		}
+		if res.ConnectTime.Count != int64(tst.expectedSoc) {
+			t.Errorf("%+v: unexpected connect time count %d", tst, res.ConnectTime.Count)
+		}
+	}
+}
+
+func TestWSRunnerErrors(t *testing.T) {
+	opts := RunnerOptions{}
+	opts.Exactly = 1
+	opts.Destination = "http://localhost:1234/"
+	if _, err := RunWSTest(&opts); err == nil {
+		t.Errorf("Expected error for non ws:// destination")
+	}
+	opts.Destination = "ws://localhost:1/"
+	opts.NumThreads = 1
+	res, err := RunWSTest(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RetCodes[WSStatusOK] != 0 || res.SocketCount != 1 {
+		t.Errorf("Expected connection error, got %v", res.RetCodes)
+	}
+	if res.ConnectTime != nil {
+		t.Errorf("Expected no connect time without connection, got %+v", res.ConnectTime)
+	}
+	wsOpts := WSOptions{Destination: "ws://localhost:1/", Ping: true, Payload: make([]byte, 126)}
+	if _, err := NewWSClient(&wsOpts); err == nil {
+		t.Errorf("Expected error for too large ping payload")
+	}
+}